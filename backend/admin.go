@@ -0,0 +1,459 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shared-state prefixes of the caches /api/admin/cache can flush
+var adminCaches = map[string]string{
+	"query":    "query:",       // Answers by prompt
+	"semantic": "semantic:",    // Answers by similar question
+	"models":   modelsCacheKey, // Models pulled into Ollama
+}
+
+// tenantSettingsKey holds settings set through the admin API, which take the
+// place of the tenant's entry in CONFIG_FILE
+func tenantSettingsKey(tenant string) string {
+	return "tenantsettings:" + tenant
+}
+
+// adminIndexHandler serves GET /api/admin: the admin endpoints, so a frontend can
+// discover them
+func adminIndexHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin"), "/") != "" {
+		sendError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if !validateMethod(w, r, "GET") || !requireAdmin(w, r) {
+		return
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{"endpoints": []string{
+		"GET /api/admin/config",
+		"POST /api/admin/config/reload",
+		"GET /api/admin/ollama",
+		"GET /api/admin/circuits",
+		"POST /api/admin/circuits/reset",
+		"GET /api/admin/tenants",
+		"GET|PUT|PATCH|DELETE /api/admin/tenants/{tenant}",
+		"POST /api/admin/tenants/{tenant}/usage/reset",
+		"GET /api/admin/usage",
+		"GET /api/admin/jobs",
+		"GET /api/admin/cache",
+		"POST /api/admin/cache/flush",
+		"GET /api/admin/stats",
+		"GET /api/admin/corpus",
+		"POST /api/admin/corpus/check",
+		"POST /api/admin/signed-urls",
+	}})
+}
+
+// TenantAdminView is a tenant on /api/admin/tenants
+type TenantAdminView struct {
+	Tenant     string         `json:"tenant"`
+	Settings   TenantSettings `json:"settings"`   // In effect
+	Overridden bool           `json:"overridden"` // Set through the admin API rather than CONFIG_FILE
+	Today      TenantUsage    `json:"today"`
+}
+
+func tenantAdminView(tenant string) TenantAdminView {
+	_, overridden := tenantOverride(tenant)
+	return TenantAdminView{tenant, tenantSettings(tenant), overridden, tenantUsage(tenant, time.Now())}
+}
+
+// knownTenants returns the tenants with settings or usage today, sorted
+func knownTenants() ([]string, error) {
+	tenants := make(map[string]bool)
+	for tenant := range getConfig().Tenants {
+		tenants[tenant] = true
+	}
+	overrides, err := sharedState.Keys(tenantSettingsKey(""))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range overrides {
+		tenants[strings.TrimPrefix(key, tenantSettingsKey(""))] = true
+	}
+	usage, err := sharedState.Keys("usage:")
+	if err != nil {
+		return nil, err
+	}
+	// Keys are usage:{tenant}:{date}:{counter}, and tenant names hold no colon
+	today := usageDate(time.Now())
+	for _, key := range usage {
+		if parts := strings.Split(strings.TrimPrefix(key, "usage:"), ":"); len(parts) == 3 && parts[1] == today {
+			tenants[parts[0]] = true
+		}
+	}
+	names := make([]string, 0, len(tenants))
+	for tenant := range tenants {
+		names = append(names, tenant)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// adminTenantsHandler serves GET /api/admin/tenants
+func adminTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "GET") || !requireAdmin(w, r) {
+		return
+	}
+	names, err := knownTenants()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to list tenants: %v", err))
+		return
+	}
+	tenants := make([]TenantAdminView, len(names))
+	for i, tenant := range names {
+		tenants[i] = tenantAdminView(tenant)
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{"tenants": tenants})
+}
+
+// tenantSettingsPatch changes the fields it sets
+type tenantSettingsPatch struct {
+	DefaultModel  *string   `json:"defaultModel"`
+	AllowedModels *[]string `json:"allowedModels"`
+	DailyQueries  *int64    `json:"dailyQueries"`
+	DailyTokens   *int64    `json:"dailyTokens"`
+
+	MaxUploadBytes  *int64 `json:"maxUploadBytes"`
+	MaxQueryLength  *int   `json:"maxQueryLength"`
+	MaxAnswerTokens *int   `json:"maxAnswerTokens"`
+}
+
+func (p tenantSettingsPatch) apply(s TenantSettings) TenantSettings {
+	if p.DefaultModel != nil {
+		s.DefaultModel = *p.DefaultModel
+	}
+	if p.AllowedModels != nil {
+		s.AllowedModels = *p.AllowedModels
+	}
+	if p.DailyQueries != nil {
+		s.DailyQueries = *p.DailyQueries
+	}
+	if p.DailyTokens != nil {
+		s.DailyTokens = *p.DailyTokens
+	}
+	if p.MaxUploadBytes != nil {
+		s.MaxUploadBytes = *p.MaxUploadBytes
+	}
+	if p.MaxQueryLength != nil {
+		s.MaxQueryLength = *p.MaxQueryLength
+	}
+	if p.MaxAnswerTokens != nil {
+		s.MaxAnswerTokens = *p.MaxAnswerTokens
+	}
+	return s
+}
+
+// adminTenantMu serializes this instance's read-modify-write of tenant settings
+var adminTenantMu sync.Mutex
+
+// handleAdminTenant serves /api/admin/tenants/{tenant}: GET shows the tenant, PUT
+// replaces its settings, PATCH changes some of them (e.g. to raise a quota), and
+// DELETE drops the settings set here, falling back to CONFIG_FILE.
+// POST /api/admin/tenants/{tenant}/usage/reset clears today's usage.
+func handleAdminTenant(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/tenants/"), "/"), "/")
+	tenant := parts[0]
+	if !validTenant.MatchString(tenant) {
+		sendError(w, http.StatusBadRequest, "Invalid tenant (use up to 64 letters, digits, ., - or _)")
+		return
+	}
+	if len(parts) == 3 && parts[1] == "usage" && parts[2] == "reset" {
+		if !validateMethod(w, r, "POST") || !requireAdmin(w, r) {
+			return
+		}
+		resetTenantUsage(tenant)
+		sendJSON(w, http.StatusOK, tenantAdminView(tenant))
+		return
+	} else if len(parts) != 1 {
+		sendError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PUT", "PATCH":
+		adminTenantMu.Lock()
+		defer adminTenantMu.Unlock()
+		var settings TenantSettings
+		if r.Method == "PUT" {
+			if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+				sendError(w, http.StatusBadRequest, "Invalid request")
+				return
+			}
+		} else {
+			var patch tenantSettingsPatch
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				sendError(w, http.StatusBadRequest, "Invalid request")
+				return
+			}
+			settings = patch.apply(tenantSettings(tenant))
+		}
+		if err := (TenantConfig{tenant: settings}).validate(); err != nil {
+			sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		setJSON(tenantSettingsKey(tenant), settings, 0)
+	case "DELETE":
+		if _, overridden := tenantOverride(tenant); !overridden {
+			sendError(w, http.StatusNotFound, "Tenant has no settings set through the admin API")
+			return
+		}
+		if err := sharedState.Delete(tenantSettingsKey(tenant)); err != nil {
+			sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to delete tenant settings: %v", err))
+			return
+		}
+	default:
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	sendJSON(w, http.StatusOK, tenantAdminView(tenant))
+}
+
+// resetTenantUsage clears a tenant's counters for today, lifting its quotas
+// until new usage reaches them
+func resetTenantUsage(tenant string) {
+	date := usageDate(time.Now())
+	for _, counter := range []string{"queries", "tokens"} {
+		if err := sharedState.Delete(usageKey(tenant, date, counter)); err != nil {
+			log.Printf("Failed to reset usage of tenant %s: %v", tenant, err)
+		}
+	}
+}
+
+// CircuitStatus is an Ollama endpoint's breaker: open once a call to it failed
+// with a connection error or 5xx, so calls skip it, and closed again by the next
+// successful health check
+type CircuitStatus struct {
+	URL       string    `json:"url"`
+	State     string    `json:"state"` // closed or open
+	LastError string    `json:"lastError,omitempty"`
+	CheckedAt time.Time `json:"checkedAt,omitempty"`
+}
+
+func circuitStatuses() []CircuitStatus {
+	endpoints := ollamaEndpoints.all()
+	circuits := make([]CircuitStatus, len(endpoints))
+	for i, e := range endpoints {
+		e.mu.Lock()
+		circuits[i] = CircuitStatus{URL: e.URL, State: "closed", LastError: e.lastError, CheckedAt: e.checkedAt}
+		if !e.healthy {
+			circuits[i].State = "open"
+		}
+		e.mu.Unlock()
+	}
+	return circuits
+}
+
+// adminCircuitsHandler serves GET /api/admin/circuits, and POST
+// /api/admin/circuits/reset, which health-checks every endpoint now instead of
+// waiting for the next interval
+func adminCircuitsHandler(w http.ResponseWriter, r *http.Request) {
+	reset := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/circuits"), "/")
+	switch {
+	case reset == "reset":
+		if !validateMethod(w, r, "POST") || !requireAdmin(w, r) {
+			return
+		}
+		var wg sync.WaitGroup
+		for _, e := range ollamaEndpoints.all() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				e.check()
+			}()
+		}
+		wg.Wait()
+	case reset != "":
+		sendError(w, http.StatusNotFound, "Not found")
+		return
+	case !validateMethod(w, r, "GET") || !requireAdmin(w, r):
+		return
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{"circuits": circuitStatuses()})
+}
+
+// adminJobsHandler serves GET /api/admin/jobs: every job, with counts by type
+// and state (?type= and ?state= filter the list)
+func adminJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "GET") || !requireAdmin(w, r) {
+		return
+	}
+	all := jobStore.List("", "", "")
+	counts := make(map[string]map[string]int)
+	for _, job := range all {
+		if counts[job.Type] == nil {
+			counts[job.Type] = make(map[string]int)
+		}
+		counts[job.Type][job.State]++
+	}
+	query := r.URL.Query()
+	jobs := slices.DeleteFunc(all, func(job JobStatus) bool {
+		return (query.Get("type") != "" && job.Type != query.Get("type")) || (query.Get("state") != "" && job.State != query.Get("state"))
+	})
+	sendJSON(w, http.StatusOK, map[string]interface{}{"counts": counts, "jobs": jobs})
+}
+
+// adminCacheHandler serves GET /api/admin/cache, the entries in each cache, and
+// POST /api/admin/cache/flush, which empties them. `?cache=` picks one cache and
+// `?document=` limits both to the entries of one document; the models cache
+// belongs to no document.
+func adminCacheHandler(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/cache"), "/")
+	if action != "" && action != "flush" {
+		sendError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	method := "GET"
+	if action == "flush" {
+		method = "POST"
+	}
+	if !validateMethod(w, r, method) || !requireAdmin(w, r) {
+		return
+	}
+
+	// Answers cached for a document outlive it, so a deleted one can still be named
+	document := r.URL.Query().Get("document")
+	docs := documentStore.All()
+	if document != "" {
+		docs = nil
+		if doc, exists := documentStore.Get(document); exists {
+			docs = []*Document{doc}
+		}
+	}
+
+	var caches []string
+	switch name := r.URL.Query().Get("cache"); {
+	case name == "":
+		for name := range adminCaches {
+			if document == "" || name != "models" {
+				caches = append(caches, name)
+			}
+		}
+		caches = append(caches, "embeddings")
+	case name == "models" && document != "":
+		sendError(w, http.StatusBadRequest, "The models cache cannot be limited to a document")
+		return
+	case name == "embeddings" || adminCaches[name] != "":
+		caches = append(caches, name)
+	default:
+		sendError(w, http.StatusBadRequest, "cache must be query, semantic, models or embeddings")
+		return
+	}
+
+	entries := make(map[string]int, len(caches))
+	for _, name := range caches {
+		var n int
+		var err error
+		if name == "embeddings" {
+			n = summaryVectorEntries(docs, action == "flush")
+		} else {
+			n, err = sharedCacheEntries(adminCaches[name]+documentCacheTag(document), action == "flush")
+		}
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to list the %s cache: %v", name, err))
+			return
+		}
+		entries[name] = n
+	}
+	if action == "flush" {
+		sendJSON(w, http.StatusOK, map[string]interface{}{"message": "Cache flushed", "flushed": entries})
+		return
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{"entries": entries})
+}
+
+// sharedCacheEntries counts the shared-state keys under prefix, deleting them
+// when flush is set
+func sharedCacheEntries(prefix string, flush bool) (int, error) {
+	keys, err := sharedState.Keys(prefix)
+	if err != nil || !flush {
+		return len(keys), err
+	}
+	for _, key := range keys {
+		if err := sharedState.Delete(key); err != nil {
+			log.Printf("Failed to flush %s: %v", key, err)
+		}
+	}
+	return len(keys), nil
+}
+
+// summaryVectorEntries counts the documents holding an embedding of their
+// summary, dropping them when flush is set. They live in this process only.
+func summaryVectorEntries(docs []*Document, flush bool) int {
+	n := 0
+	for _, doc := range docs {
+		if doc.summaryVec.cached() {
+			n++
+			if flush {
+				doc.summaryVec.reset()
+			}
+		}
+	}
+	return n
+}
+
+// StoreStats summarizes what the server holds
+type StoreStats struct {
+	Documents       int            `json:"documents"`
+	Archived        int            `json:"archived"`
+	Chunks          int            `json:"chunks"`
+	ContentBytes    int64          `json:"contentBytes"`
+	Embedded        int            `json:"embedded"` // Documents retrieved by vector
+	Summarized      int            `json:"summarized"`
+	ByCollection    map[string]int `json:"byCollection"` // Documents per collection; "" for none
+	Collections     int            `json:"collections"`
+	IndexedTerms    int            `json:"indexedTerms"` // Distinct words over every document's index
+	Trashed         int            `json:"trashed"`
+	Jobs            int            `json:"jobs"`
+	SharedStateKeys int            `json:"sharedStateKeys"`
+}
+
+// adminStatsHandler serves GET /api/admin/stats
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "GET") || !requireAdmin(w, r) {
+		return
+	}
+	stats := StoreStats{ByCollection: make(map[string]int)}
+	for _, doc := range documentStore.All() {
+		doc.mu.RLock()
+		stats.Documents++
+		stats.Chunks += len(doc.Chunks)
+		stats.ContentBytes += int64(doc.ContentSize)
+		stats.ByCollection[doc.Collection]++
+		if doc.ArchivedAt != nil {
+			stats.Archived++
+		}
+		if doc.hasVectors() {
+			stats.Embedded++
+		}
+		if doc.HasSummary && doc.Summary != "" {
+			stats.Summarized++
+		}
+		doc.mu.RUnlock()
+	}
+	stats.Collections = len(collectionStore.List())
+	documentStore.terms.mu.RLock()
+	stats.IndexedTerms = len(documentStore.terms.chunks)
+	documentStore.terms.mu.RUnlock()
+	if trashed, err := listTrash(); err == nil {
+		stats.Trashed = len(trashed)
+	}
+	stats.Jobs = len(jobStore.List("", "", ""))
+	if keys, err := sharedState.Keys(""); err == nil {
+		stats.SharedStateKeys = len(keys)
+	}
+	sendJSON(w, http.StatusOK, stats)
+}
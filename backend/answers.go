@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Longest instruction accepted by the refine endpoint
+const maxRefineInstructionLength = 500
+
+// storedAnswer keeps what produced an answer so it can be revised without running
+// retrieval again
+type storedAnswer struct {
+	ID             string              `json:"id"`
+	DocumentName   string              `json:"documentName"`
+	ModelName      string              `json:"modelName"`
+	Prompt         string              `json:"prompt"` // Context, question and instructions the answer was generated from
+	Response       string              `json:"response"`
+	SourceChunks   []string            `json:"sourceChunks"`
+	UsedSummary    bool                `json:"usedSummary"`
+	Citations      []string            `json:"citations,omitempty"`
+	SourcePages    []int               `json:"sourcePages,omitempty"`
+	SourceMetadata []map[string]string `json:"sourceMetadata,omitempty"`
+	SourceDocs     []string            `json:"sourceDocuments,omitempty"` // Document of each source chunk, for multi-document queries
+	Deterministic  bool                `json:"deterministic,omitempty"`
+	Tables         []*tableSource      `json:"tables,omitempty"` // Table sources, in table mode
+	CreatedAt      time.Time           `json:"createdAt"`
+}
+
+// RefineRequest asks for a previous answer to be rewritten
+type RefineRequest struct {
+	AnswerID    string `json:"answerId"`
+	Instruction string `json:"instruction"`         // e.g. "shorter" or "explain for a non-lawyer"
+	ModelName   string `json:"modelName,omitempty"` // Defaults to the model of the previous answer
+	Verify      string `json:"verify,omitempty"`    // lexical or llm
+}
+
+func answerKey(tenant, id string) string {
+	return "answer:" + tenant + ":" + id
+}
+
+// storeAnswer keeps an answer for ANSWER_TTL and returns its ID, or "" when
+// answers are not kept
+func storeAnswer(tenant string, answer storedAnswer) string {
+	ttl := time.Duration(getConfig().AnswerTTL)
+	if ttl == 0 {
+		return ""
+	}
+	answer.ID = randomID()
+	answer.CreatedAt = time.Now().UTC()
+	setJSON(answerKey(tenant, answer.ID), answer, ttl)
+	return answer.ID
+}
+
+// response returns the answer as a query response
+func (a *storedAnswer) response() *QueryResponse {
+	return &QueryResponse{
+		Response:        a.Response,
+		SourceChunks:    a.SourceChunks,
+		UsedSummary:     a.UsedSummary,
+		Citations:       a.Citations,
+		SourcePages:     a.SourcePages,
+		SourceMetadata:  a.SourceMetadata,
+		SourceDocuments: a.SourceDocs,
+		AnswerID:        a.ID,
+	}
+}
+
+// refineAnswer rewrites a previous answer following an instruction, from the
+// context it was generated from
+func refineAnswer(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+
+	var req RefineRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	req.Instruction = strings.TrimSpace(req.Instruction)
+	if req.AnswerID == "" || req.Instruction == "" {
+		sendError(w, http.StatusBadRequest, "answerId and instruction are required")
+		return
+	}
+	if len(req.Instruction) > maxRefineInstructionLength {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("instruction must be at most %d characters", maxRefineInstructionLength))
+		return
+	}
+	if !validVerifyMethod(req.Verify) {
+		sendError(w, http.StatusBadRequest, "verify must be lexical or llm")
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	var previous storedAnswer
+	if !getJSON(answerKey(tenant, req.AnswerID), &previous) {
+		sendError(w, http.StatusNotFound, "Answer not found or expired")
+		return
+	}
+
+	prompt := fmt.Sprintf(`%s %s
+
+Rewrite the answer above following this instruction: %s
+Use only the context given above and keep the citations that still apply.
+
+Rewritten answer:`, previous.Prompt, strings.TrimSpace(previous.Response), req.Instruction)
+
+	model := previous.ModelName
+	if req.ModelName != "" {
+		model = req.ModelName
+	}
+	ctx := answerLimitContext(documentCacheContext(r.Context(), previous.DocumentName), tenant)
+	if previous.Deterministic {
+		ctx = deterministicContext(ctx)
+	}
+	response, cached, err := cachedAnswer(ctx, prompt, model)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get response: %v", err))
+		return
+	}
+
+	var tableRows []TableRow
+	if previous.Tables != nil {
+		response, tableRows = usedRows(response, previous.Tables)
+	}
+
+	refined := previous
+	refined.ModelName = model
+	refined.Response = response
+	refined.ID = storeAnswer(tenant, refined)
+	result := refined.response()
+	result.TableRows = tableRows
+	result.Cached = cached
+	result.RefinedFrom = previous.ID
+	if req.Verify != "" {
+		result.Verification = verifyAnswer(ctx, req.Verify, response, refined.SourceChunks, model)
+	}
+	sendJSON(w, http.StatusOK, result)
+}
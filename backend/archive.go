@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Listing modes for archived documents (archived query parameter)
+const (
+	ArchivedExclude = ""        // Default: leave them out
+	ArchivedInclude = "include" // List them with the others
+	ArchivedOnly    = "only"    // List only them
+)
+
+// IsArchived tells whether a document is archived
+func (d *Document) IsArchived() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.ArchivedAt != nil
+}
+
+// activeDocuments drops archived documents, unless includeArchived is set
+func activeDocuments(docs []*Document, includeArchived bool) []*Document {
+	if includeArchived {
+		return docs
+	}
+	active := make([]*Document, 0, len(docs))
+	for _, doc := range docs {
+		if !doc.IsArchived() {
+			active = append(active, doc)
+		}
+	}
+	return active
+}
+
+// archivedFilter wraps a listing predicate with the archived query parameter
+func archivedFilter(r *http.Request, match func(*Document) bool) (func(*Document) bool, error) {
+	mode := r.URL.Query().Get("archived")
+	if mode != ArchivedExclude && mode != ArchivedInclude && mode != ArchivedOnly {
+		return nil, newAPIError(http.StatusBadRequest, "archived must be include or only")
+	}
+	return func(doc *Document) bool {
+		if mode != ArchivedInclude && (doc.ArchivedAt != nil) != (mode == ArchivedOnly) {
+			return false
+		}
+		return match == nil || match(doc)
+	}, nil
+}
+
+// handleArchiveDocument archives (POST /api/document/{name}/archive) or
+// unarchives (POST /api/document/{name}/unarchive) a document. Archived documents
+// keep their chunks and embeddings but are left out of listings and
+// collection-wide queries, and are queried only with includeArchived.
+func handleArchiveDocument(w http.ResponseWriter, r *http.Request, docName string, archive bool) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+	doc, ok := getDocumentOrError(w, docName)
+	if !ok {
+		return
+	}
+
+	var at *time.Time
+	var collection string
+	if !updateDocument(w, r, doc, walArchive, func() string {
+		collection = doc.Collection
+		if !archive {
+			doc.ArchivedAt = nil
+			return ""
+		}
+		if doc.ArchivedAt == nil {
+			now := time.Now()
+			doc.ArchivedAt = &now
+		}
+		at = doc.ArchivedAt
+		return at.Format(time.RFC3339Nano)
+	}) {
+		return
+	}
+	// Collection glossaries leave archived documents out
+	invalidateGlossary(docName, collection)
+	if !archive {
+		sendJSON(w, http.StatusOK, map[string]string{"message": "Document unarchived"})
+		return
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"message":    "Document archived",
+		"archivedAt": at,
+	})
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Authentication modes (AUTH_MODE)
+const (
+	AuthNone    = "none"    // Every request is let through, acting for the tenant in X-Tenant-ID
+	AuthAPIKey  = "apikey"  // Keys from API_KEYS, each optionally bound to a tenant
+	AuthJWT     = "jwt"     // Bearer tokens signed with JWT_SECRET or the key in JWT_PUBLIC_KEY_FILE
+	AuthWebhook = "webhook" // AUTH_WEBHOOK_URL decides from the request context
+)
+
+const jwtLeeway = 30 * time.Second // Clock skew allowed on exp and nbf
+
+// AuthDecision is an authenticator's verdict on a request. A tenant, when set,
+// is the one the request acts for, and X-Tenant-ID may not name another.
+type AuthDecision struct {
+	Allow   bool   `json:"allow"`
+	Tenant  string `json:"tenant,omitempty"`
+	Subject string `json:"subject,omitempty"` // Who made the request, logged with denials
+	Reason  string `json:"reason,omitempty"`  // Why it was denied, returned to the client
+}
+
+// Authenticator is implemented by authentication extensions. Returning an
+// apiError answers the request with it (401 for missing or bad credentials);
+// other errors are taken as the authenticator being unavailable and get 503.
+type Authenticator interface {
+	Authenticate(r *http.Request) (AuthDecision, error)
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface
+type AuthenticatorFunc func(r *http.Request) (AuthDecision, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (AuthDecision, error) { return f(r) }
+
+// authenticator checks every API request; nil lets all through
+var authenticator Authenticator
+
+// SetAuthenticator replaces the authenticator chosen by AUTH_MODE; call it before
+// the server starts
+func SetAuthenticator(a Authenticator) {
+	authenticator = a
+}
+
+type authDecisionKey struct{}
+
+// authenticatedTenant returns the tenant the authenticator bound the request to
+func authenticatedTenant(r *http.Request) string {
+	decision, _ := r.Context().Value(authDecisionKey{}).(AuthDecision)
+	return decision.Tenant
+}
+
+// authExempt reports whether a path checks its own credentials: admin endpoints
+// take ADMIN_TOKEN, and share links and signed URLs carry their own secret
+func authExempt(path string) bool {
+	return path == "/api/admin" || strings.HasPrefix(path, "/api/admin/") ||
+		strings.HasPrefix(path, "/api/share/") || strings.HasPrefix(path, "/api/signed/")
+}
+
+// authenticated runs the authenticator before every API request
+func authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authenticator == nil || r.Method == "OPTIONS" || authExempt(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		decision, err := authenticator.Authenticate(r)
+		if err != nil {
+			var apiErr *apiError
+			if errors.As(err, &apiErr) {
+				if apiErr.Status == http.StatusUnauthorized {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+				}
+				sendAPIError(w, err)
+				return
+			}
+			log.Printf("Authentication failed for %s %s: %v", r.Method, r.URL.Path, err)
+			sendError(w, http.StatusServiceUnavailable, "Authentication is unavailable")
+			return
+		}
+		if !decision.Allow {
+			reason := decision.Reason
+			if reason == "" {
+				reason = "Access denied"
+			}
+			log.Printf("Denied %s %s to %q: %s", r.Method, r.URL.Path, decision.Subject, reason)
+			sendError(w, http.StatusForbidden, reason)
+			return
+		}
+		if decision.Tenant != "" && !validTenant.MatchString(decision.Tenant) {
+			log.Printf("Authenticator returned invalid tenant %q for %s %s", decision.Tenant, r.Method, r.URL.Path)
+			sendError(w, http.StatusForbidden, "Access denied")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authDecisionKey{}, decision)))
+	})
+}
+
+// loadAuthenticator sets up the authenticator named by AUTH_MODE
+func loadAuthenticator() error {
+	switch mode := getEnv("AUTH_MODE", AuthNone); mode {
+	case AuthNone:
+		return nil
+	case AuthAPIKey:
+		a, err := newAPIKeyAuth(getEnv("API_KEYS", ""))
+		if err != nil {
+			return err
+		}
+		authenticator = a
+		log.Printf("Requiring API keys (%d configured)", len(a.keys))
+	case AuthJWT:
+		a, err := newJWTAuth()
+		if err != nil {
+			return err
+		}
+		authenticator = a
+		log.Printf("Requiring JWTs signed with %s", a.alg)
+	case AuthWebhook:
+		a, err := newWebhookAuth(getEnv("AUTH_WEBHOOK_URL", ""), time.Duration(envDuration("AUTH_WEBHOOK_TIMEOUT", 5*time.Second)))
+		if err != nil {
+			return err
+		}
+		authenticator = a
+		log.Printf("Authorizing requests through %s", a.url)
+	default:
+		return fmt.Errorf("unknown AUTH_MODE %q (use none, apikey, jwt or webhook)", mode)
+	}
+	return nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// apiKeyAuth accepts requests carrying a known key in X-API-Key or as a bearer
+// token. Keys are held by their hash, so lookups take the same time for all.
+type apiKeyAuth struct {
+	keys map[[sha256.Size]byte]string // Key hash to tenant, "" when not bound to one
+}
+
+// newAPIKeyAuth parses API_KEYS: comma-separated keys, each optionally
+// followed by =tenant
+func newAPIKeyAuth(raw string) (*apiKeyAuth, error) {
+	a := &apiKeyAuth{keys: make(map[[sha256.Size]byte]string)}
+	for _, entry := range strings.Split(raw, ",") {
+		key, tenant, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		if key == "" {
+			continue
+		}
+		if tenant != "" && !validTenant.MatchString(tenant) {
+			return nil, fmt.Errorf("invalid tenant %q in API_KEYS", tenant)
+		}
+		registerSecret(key)
+		a.keys[sha256.Sum256([]byte(key))] = tenant
+	}
+	if len(a.keys) == 0 {
+		return nil, fmt.Errorf("AUTH_MODE=apikey needs API_KEYS")
+	}
+	return a, nil
+}
+
+func (a *apiKeyAuth) Authenticate(r *http.Request) (AuthDecision, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = bearerToken(r)
+	}
+	if key == "" {
+		return AuthDecision{}, newAPIError(http.StatusUnauthorized, "API key required")
+	}
+	tenant, ok := a.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return AuthDecision{}, newAPIError(http.StatusUnauthorized, "Invalid API key")
+	}
+	return AuthDecision{Allow: true, Tenant: tenant}, nil
+}
+
+// jwtAuth accepts requests with a bearer JWT signed with HS256, RS256 or ES256,
+// unexpired and, when configured, from the expected issuer and for the expected
+// audience. The tenant comes from a claim.
+type jwtAuth struct {
+	alg         string
+	secret      []byte
+	publicKey   crypto.PublicKey
+	issuer      string
+	audience    string
+	tenantClaim string
+}
+
+// newJWTAuth reads JWT_SECRET (HS256) or JWT_PUBLIC_KEY_FILE (PEM RSA or P-256
+// key), JWT_ISSUER, JWT_AUDIENCE and JWT_TENANT_CLAIM
+func newJWTAuth() (*jwtAuth, error) {
+	a := &jwtAuth{
+		issuer:      getEnv("JWT_ISSUER", ""),
+		audience:    getEnv("JWT_AUDIENCE", ""),
+		tenantClaim: getEnv("JWT_TENANT_CLAIM", "tenant"),
+	}
+	secret, keyFile := getEnv("JWT_SECRET", ""), getEnv("JWT_PUBLIC_KEY_FILE", "")
+	switch {
+	case secret != "" && keyFile != "":
+		return nil, fmt.Errorf("set either JWT_SECRET or JWT_PUBLIC_KEY_FILE")
+	case secret != "":
+		a.alg, a.secret = "HS256", []byte(secret)
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWT_PUBLIC_KEY_FILE: %w", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("JWT_PUBLIC_KEY_FILE holds no PEM block")
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT public key: %w", err)
+		}
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			a.alg = "RS256"
+		case *ecdsa.PublicKey:
+			if k.Curve != elliptic.P256() {
+				return nil, fmt.Errorf("JWT ECDSA keys must use P-256")
+			}
+			a.alg = "ES256"
+		default:
+			return nil, fmt.Errorf("JWT public key must be RSA or ECDSA")
+		}
+		a.publicKey = key
+	default:
+		return nil, fmt.Errorf("AUTH_MODE=jwt needs JWT_SECRET or JWT_PUBLIC_KEY_FILE")
+	}
+	return a, nil
+}
+
+func (a *jwtAuth) Authenticate(r *http.Request) (AuthDecision, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return AuthDecision{}, newAPIError(http.StatusUnauthorized, "Bearer token required")
+	}
+	claims, err := a.verify(token, time.Now())
+	if err != nil {
+		return AuthDecision{}, newAPIError(http.StatusUnauthorized, "Invalid token: "+err.Error())
+	}
+	decision := AuthDecision{Allow: true}
+	decision.Subject, _ = claims["sub"].(string)
+	if tenant, ok := claims[a.tenantClaim]; ok {
+		if decision.Tenant, ok = tenant.(string); !ok {
+			return AuthDecision{}, newAPIError(http.StatusUnauthorized, "Invalid token: "+a.tenantClaim+" claim is not a string")
+		}
+	}
+	return decision, nil
+}
+
+// verify checks a token's signature and claims and returns the claims
+func (a *jwtAuth) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != a.alg {
+		return nil, fmt.Errorf("algorithm %q is not accepted", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if !a.validSignature(signed, signature) {
+		return nil, fmt.Errorf("bad signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return nil, fmt.Errorf("wrong issuer")
+	}
+	if a.audience != "" && !jwtAudienceHas(claims["aud"], a.audience) {
+		return nil, fmt.Errorf("wrong audience")
+	}
+	return claims, nil
+}
+
+func (a *jwtAuth) validSignature(signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch a.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS256":
+		return rsa.VerifyPKCS1v15(a.publicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	case "ES256":
+		if len(signature) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(a.publicKey.(*ecdsa.PublicKey), digest[:], r, s)
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("malformed token")
+	}
+	return nil
+}
+
+// jwtAudienceHas reports whether an aud claim, a string or a list, names audience
+func jwtAudienceHas(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AuthRequest is the request context posted to AUTH_WEBHOOK_URL
+type AuthRequest struct {
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Query      string            `json:"query,omitempty"`
+	RemoteAddr string            `json:"remoteAddr"`
+	Headers    map[string]string `json:"headers"` // Canonical names; repeated headers are joined with ", "
+}
+
+// webhookAuth asks an external policy service about every request. It answers
+// 200 with an AuthDecision; anything else, or no answer in time, gets the
+// client a 503.
+type webhookAuth struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookAuth(url string, timeout time.Duration) (*webhookAuth, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("AUTH_MODE=webhook needs an http(s) AUTH_WEBHOOK_URL")
+	}
+	return &webhookAuth{url: url, client: &http.Client{Timeout: timeout}}, nil
+}
+
+func (a *webhookAuth) Authenticate(r *http.Request) (AuthDecision, error) {
+	request := AuthRequest{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		RemoteAddr: r.RemoteAddr,
+		Headers:    make(map[string]string, len(r.Header)),
+	}
+	for name, values := range r.Header {
+		if name == adminTokenHeader { // The admin token is not the webhook's to see
+			continue
+		}
+		request.Headers[name] = strings.Join(values, ", ")
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return AuthDecision{}, err
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), "POST", a.url, bytes.NewReader(payload))
+	if err != nil {
+		return AuthDecision{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return AuthDecision{}, fmt.Errorf("auth webhook request failed: %w", err)
+	}
+	defer closeFile(resp.Body, "auth webhook response body")
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return AuthDecision{}, fmt.Errorf("failed to read auth webhook response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return AuthDecision{}, newOutputError(body, "auth webhook returned status %d", resp.StatusCode)
+	}
+	var decision AuthDecision
+	if err := json.Unmarshal(body, &decision); err != nil {
+		return AuthDecision{}, fmt.Errorf("invalid auth webhook response: %w", err)
+	}
+	return decision, nil
+}
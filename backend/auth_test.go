@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "a-test-secret-of-reasonable-length"
+
+// jwtSigningInput encodes a token's header and claims
+func jwtSigningInput(t *testing.T, alg string, claims map[string]interface{}) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+}
+
+func hs256Token(t *testing.T, alg string, secret []byte, claims map[string]interface{}) string {
+	t.Helper()
+	input := jwtSigningInput(t, alg, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func rs256Token(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	input := jwtSigningInput(t, "RS256", claims)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// tamperedClaims swaps the claims of a signed token, keeping its header and signature
+func tamperedClaims(t *testing.T, token string, claims map[string]interface{}) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	forged := strings.Split(jwtSigningInput(t, "HS256", claims), ".")
+	return parts[0] + "." + forged[1] + "." + parts[2]
+}
+
+func TestJWTVerifyHS256(t *testing.T) {
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	t.Setenv("JWT_PUBLIC_KEY_FILE", "")
+	t.Setenv("JWT_ISSUER", "https://auth.example.com")
+	t.Setenv("JWT_AUDIENCE", "rag")
+	a, err := newJWTAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "alice",
+			"iss": "https://auth.example.com",
+			"aud": "rag",
+			"exp": now.Add(time.Hour).Unix(),
+			"nbf": now.Add(-time.Minute).Unix(),
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	secret := []byte(testJWTSecret)
+
+	tests := []struct {
+		name  string
+		token string
+		err   string // Empty for an accepted token
+	}{
+		{"valid", hs256Token(t, "HS256", secret, claims(nil)), ""},
+		{"audience in a list", hs256Token(t, "HS256", secret, claims(map[string]interface{}{"aud": []string{"other", "rag"}})), ""},
+		{"expired within the leeway", hs256Token(t, "HS256", secret, claims(map[string]interface{}{"exp": now.Add(-jwtLeeway / 2).Unix()})), ""},
+		{"alg none", jwtSigningInput(t, "none", claims(nil)) + ".", "algorithm"},
+		{"alg none with a signature", hs256Token(t, "none", secret, claims(nil)), "algorithm"},
+		{"other HMAC algorithm", hs256Token(t, "HS512", secret, claims(nil)), "algorithm"},
+		{"wrong secret", hs256Token(t, "HS256", []byte("another-secret"), claims(nil)), "bad signature"},
+		{"altered claims", tamperedClaims(t, hs256Token(t, "HS256", secret, claims(nil)), claims(map[string]interface{}{"sub": "mallory"})), "bad signature"},
+		{"expired", hs256Token(t, "HS256", secret, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), "expired"},
+		{"not valid yet", hs256Token(t, "HS256", secret, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})), "not valid yet"},
+		{"wrong audience", hs256Token(t, "HS256", secret, claims(map[string]interface{}{"aud": "billing"})), "audience"},
+		{"audience list without ours", hs256Token(t, "HS256", secret, claims(map[string]interface{}{"aud": []string{"billing"}})), "audience"},
+		{"no audience", hs256Token(t, "HS256", secret, claims(map[string]interface{}{"aud": nil})), "audience"},
+		{"wrong issuer", hs256Token(t, "HS256", secret, claims(map[string]interface{}{"iss": "https://evil.example.com"})), "issuer"},
+		{"two parts", jwtSigningInput(t, "HS256", claims(nil)), "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := a.verify(tt.token, now)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("rejected: %v", err)
+			case tt.err != "" && err == nil:
+				t.Fatalf("accepted, want an error about %q", tt.err)
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Fatalf("got %v, want an error about %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestJWTVerifyRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	keyFile := filepath.Join(t.TempDir(), "jwt.pem")
+	if err := os.WriteFile(keyFile, publicPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_PUBLIC_KEY_FILE", keyFile)
+	t.Setenv("JWT_ISSUER", "")
+	t.Setenv("JWT_AUDIENCE", "")
+	a, err := newJWTAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.alg != "RS256" {
+		t.Fatalf("alg %q, want RS256", a.alg)
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{"sub": "alice", "exp": now.Add(time.Hour).Unix()}
+	if _, err := a.verify(rs256Token(t, key, claims), now); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+
+	// HS/RS confusion: a token "signed" with HMAC over the public key, which an
+	// attacker can read, must not pass as RS256
+	for _, secret := range [][]byte{publicPEM, der} {
+		if _, err := a.verify(hs256Token(t, "HS256", secret, claims), now); err == nil || !strings.Contains(err.Error(), "algorithm") {
+			t.Errorf("HS256 token keyed with the public key: %v, want an algorithm error", err)
+		}
+	}
+	if _, err := a.verify(jwtSigningInput(t, "none", claims)+".", now); err == nil {
+		t.Error("alg none accepted")
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.verify(rs256Token(t, other, claims), now); err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Errorf("token signed with another key: %v, want a bad signature", err)
+	}
+	expired := map[string]interface{}{"sub": "alice", "exp": now.Add(-time.Hour).Unix()}
+	if _, err := a.verify(rs256Token(t, key, expired), now); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expired token: %v, want expired", err)
+	}
+}
+
+// useAuthMode sets up the authenticator AUTH_MODE names until the test ends
+func useAuthMode(t *testing.T, mode string) {
+	t.Helper()
+	saved := authenticator
+	t.Cleanup(func() { authenticator = saved })
+	authenticator = nil
+	t.Setenv("AUTH_MODE", mode)
+	if err := loadAuthenticator(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminRouteBehindJWT(t *testing.T) {
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	t.Setenv("JWT_PUBLIC_KEY_FILE", "")
+	t.Setenv("JWT_ISSUER", "")
+	t.Setenv("JWT_AUDIENCE", "")
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	root := t.TempDir()
+	t.Setenv("INGEST_PATH_ROOTS", root)
+	useAuthMode(t, AuthJWT)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/ingest/path", corsHandler(adminOnly(writerOnly(ingestPathHandler))))
+	handler := authenticated(mux)
+	token := hs256Token(t, "HS256", []byte(testJWTSecret), map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name          string
+		authorization string
+		adminToken    string
+		status        int
+	}{
+		{"JWT and admin token", "Bearer " + token, "admin-secret", http.StatusOK},
+		{"JWT without admin token", "Bearer " + token, "", http.StatusUnauthorized},
+		{"JWT and wrong admin token", "Bearer " + token, "guess", http.StatusUnauthorized},
+		{"admin token without JWT", "", "admin-secret", http.StatusUnauthorized},
+		{"admin token as the bearer token", "Bearer admin-secret", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.NewReader(fmt.Sprintf(`{"path": %q}`, root))
+			r := httptest.NewRequest("POST", "/api/ingest/path", body)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.adminToken != "" {
+				r.Header.Set(adminTokenHeader, tt.adminToken)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("got %d %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+}
+
+func TestSourceRoutesBehindAPIKeys(t *testing.T) {
+	t.Setenv("API_KEYS", "key-1=acme")
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	useAuthMode(t, AuthAPIKey)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sources", corsHandler(adminOnly(writerOnly(sourcesHandler))))
+	mux.HandleFunc("/api/source/", corsHandler(adminOnly(writerOnly(handleSourceByName))))
+	handler := authenticated(mux)
+
+	tests := []struct {
+		path       string
+		adminToken string
+		status     int
+	}{
+		{"/api/sources", "admin-secret", http.StatusOK},
+		{"/api/source/unknown", "admin-secret", http.StatusNotFound},
+		{"/api/sources", "", http.StatusUnauthorized},
+		{"/api/source/unknown", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Header.Set("Authorization", "Bearer key-1")
+		if tt.adminToken != "" {
+			r.Header.Set(adminTokenHeader, tt.adminToken)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("GET %s with admin token %q: got %d %s, want %d", tt.path, tt.adminToken, w.Code, w.Body.String(), tt.status)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	backfillJobType      = "embedding-backfill"
+	defaultBackfillBatch = 16
+	defaultBackfillDelay = time.Second
+)
+
+// BackfillRequest selects the documents to embed and how fast to go
+type BackfillRequest struct {
+	Model      string   `json:"model"`      // Defaults to the collection's embedding model, then EMBEDDING_MODEL
+	Collection string   `json:"collection"` // Only documents in this collection
+	Documents  []string `json:"documents"`  // Only these documents
+	BatchSize  int      `json:"batchSize"`  // Chunks per batch
+	BatchDelay string   `json:"batchDelay"` // Pause between batches, e.g. "500ms"
+	Force      bool     `json:"force"`      // Re-embed documents already embedded with the model
+}
+
+// BackfillResult reports the outcome for one document of a backfill job
+type BackfillResult struct {
+	Document  string `json:"document"`
+	Chunks    int    `json:"chunks"`
+	Embedded  int    `json:"embedded"`
+	Retrieval string `json:"retrieval"`
+	Error     string `json:"error,omitempty"`
+}
+
+// backfillTargets returns the documents the request covers that still need embeddings
+func backfillTargets(req BackfillRequest, model string) []*Document {
+	var docs []*Document
+	switch {
+	case len(req.Documents) > 0:
+		for _, name := range req.Documents {
+			if doc, exists := documentStore.Get(name); exists {
+				docs = append(docs, doc)
+			}
+		}
+	case req.Collection != "":
+		docs = documentStore.ByCollection(req.Collection)
+	default:
+		docs = documentStore.All()
+	}
+
+	targets := make([]*Document, 0, len(docs))
+	for _, doc := range docs {
+		doc.mu.RLock()
+		done := doc.hasVectors() && doc.EmbeddingModel == model
+		empty := len(doc.Chunks) == 0
+		doc.mu.RUnlock()
+		if !empty && (req.Force || !done) {
+			targets = append(targets, doc)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	return targets
+}
+
+// runBackfill embeds each document in rate-limited batches. A document switches to
+// vector retrieval as soon as all of its chunks are embedded; until then queries
+// keep using its previous embeddings or the word index.
+func runBackfill(ctx context.Context, job *Job, docs []*Document, model string, batchSize int, delay time.Duration) (interface{}, error) {
+	total := 0
+	chunks := make([][]string, len(docs))
+	for i, doc := range docs {
+		doc.mu.RLock()
+		chunks[i] = append([]string(nil), doc.Chunks...)
+		doc.mu.RUnlock()
+		total += len(chunks[i])
+	}
+	job.SetProgress(0, total)
+
+	results := make([]BackfillResult, 0, len(docs))
+	publish := func() {
+		snapshot := append([]BackfillResult(nil), results...)
+		job.Update(func(s *JobStatus) { s.Result = snapshot })
+	}
+
+	done, failed := 0, 0
+	for i, doc := range docs {
+		job.Update(func(s *JobStatus) {
+			s.Message = fmt.Sprintf("Embedding %s (%d of %d documents)", doc.Name, i+1, len(docs))
+		})
+		result := BackfillResult{Document: doc.Name, Chunks: len(chunks[i]), Retrieval: doc.RetrievalMode()}
+
+		vectors := make([]QuantizedVector, 0, len(chunks[i]))
+		var err error
+		for start := 0; start < len(chunks[i]) && err == nil; start += batchSize {
+			if start > 0 {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					err = ctx.Err()
+					continue
+				}
+			}
+			var batch [][]float64
+			batch, err = embedChunks(ctx, chunks[i][start:min(start+batchSize, len(chunks[i]))], model)
+			if err != nil {
+				continue
+			}
+			for _, vec := range batch {
+				vectors = append(vectors, quantizeVector(vec))
+			}
+			done += len(batch)
+			job.SetProgress(done, total)
+		}
+		result.Embedded = len(vectors)
+
+		if err == nil {
+			err = attachEmbeddings(doc, model, vectors)
+		}
+
+		if err != nil {
+			failed++
+			result.Error = err.Error()
+			log.Printf("Embedding backfill failed for %s: %v", doc.Name, err)
+		} else {
+			result.Retrieval = doc.RetrievalMode()
+		}
+		results = append(results, result)
+		publish()
+
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+	}
+
+	job.Update(func(s *JobStatus) {
+		s.Message = fmt.Sprintf("Embedded %d of %d documents with %s", len(docs)-failed, len(docs), model)
+	})
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d documents failed", failed, len(docs))
+	}
+	return results, nil
+}
+
+// attachEmbeddings gives a document the vectors computed for its chunks, unless
+// it was replaced or re-chunked meanwhile
+func attachEmbeddings(doc *Document, model string, vectors []QuantizedVector) error {
+	if current, exists := documentStore.Get(doc.Name); !exists || current != doc {
+		return fmt.Errorf("document changed during backfill")
+	}
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	if doc.superseded || len(doc.Chunks) != len(vectors) {
+		return fmt.Errorf("document changed during backfill")
+	}
+	doc.Embeddings = vectors
+	doc.EmbeddingModel = model
+	persistence.log(updateRecord(doc, walEmbeddings, ""))
+	return nil
+}
+
+// backfillEmbeddings starts a job that embeds existing documents (POST /api/embeddings/backfill)
+func backfillEmbeddings(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	var req BackfillRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	model := req.Model
+	if model == "" && req.Collection != "" {
+		if c, exists := collectionStore.Get(req.Collection); exists {
+			model = c.EmbeddingModel
+		}
+	}
+	if model == "" {
+		model = getConfig().EmbeddingModel
+	}
+	if model == "" {
+		sendError(w, http.StatusBadRequest, "model is required unless the collection has an embedding model or EMBEDDING_MODEL is set")
+		return
+	}
+
+	batchSize := req.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBackfillBatch
+	}
+	delay := defaultBackfillDelay
+	if req.BatchDelay != "" {
+		d, err := time.ParseDuration(req.BatchDelay)
+		if err != nil || d < 0 {
+			sendError(w, http.StatusBadRequest, "batchDelay must be a duration such as 500ms")
+			return
+		}
+		delay = d
+	}
+
+	if jobStore.Active(backfillJobType) {
+		sendError(w, http.StatusConflict, "An embedding backfill is already running")
+		return
+	}
+
+	// Targets are resolved again whenever the job runs, so a retry skips documents
+	// embedded since and picks up replaced ones
+	docs := backfillTargets(req, model)
+	job := jobStore.Start(tenant, backfillJobType, "chunks", func(ctx context.Context, job *Job) (interface{}, error) {
+		return runBackfill(ctx, job, backfillTargets(req, model), model, batchSize, delay)
+	})
+
+	sendJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message": fmt.Sprintf("Embedding backfill started for %d documents", len(docs)),
+		"job":     job.Snapshot(),
+	})
+}
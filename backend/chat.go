@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChatTurn is one question of a chat session with its answer and sources
+type ChatTurn struct {
+	Document       string              `json:"document"`
+	Query          string              `json:"query"`
+	CorrectedQuery string              `json:"correctedQuery,omitempty"`
+	RewrittenQuery string              `json:"rewrittenQuery,omitempty"` // The follow-up restated on its own
+	Response       string              `json:"response"`
+	SourceChunks   []string            `json:"sourceChunks,omitempty"`
+	Citations      []string            `json:"citations,omitempty"`
+	SourcePages    []int               `json:"sourcePages,omitempty"`
+	SourceMetadata []map[string]string `json:"sourceMetadata,omitempty"`
+	SourceChunkIDs []int               `json:"sourceChunkIds,omitempty"` // Stable IDs of the source chunks, for follow-ups reusing them
+	CreatedAt      time.Time           `json:"createdAt"`
+}
+
+// ChatSession is the conversation recorded for queries sharing a sessionId within a
+// tenant. Sessions live in shared state, so every instance sees them, and expire
+// CHAT_SESSION_TTL after their last turn.
+type ChatSession struct {
+	ID        string     `json:"id"`
+	Tenant    string     `json:"tenant"`
+	Title     string     `json:"title"` // Generated from the first exchange
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	Turns     []ChatTurn `json:"turns"`
+	// Summary of the first MemoryTurns turns, given to the model instead of them
+	Memory      string `json:"memory,omitempty"`
+	MemoryTurns int    `json:"memoryTurns"`
+}
+
+// ChatSessionSummary is a session listing entry
+type ChatSessionSummary struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	TurnCount int       `json:"turnCount"`
+	LastQuery string    `json:"lastQuery"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ChatRequest is a message to a chat session: a query whose exchange is recorded
+// in the session, which is started when sessionId is left out
+type ChatRequest struct {
+	QueryRequest
+	Message string `json:"message"` // The question; query is accepted too
+}
+
+// ChatResponse is the answer to a chat message and the session it belongs to
+type ChatResponse struct {
+	SessionID string `json:"sessionId"`
+	*QueryResponse
+}
+
+// ChatMessage is one side of an exchange in a session's dialogue
+type ChatMessage struct {
+	Role      string    `json:"role"` // user or assistant
+	Content   string    `json:"content"`
+	Document  string    `json:"document,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Session listing page sizes
+const (
+	defaultSessionPageSize = 20
+	maxSessionPageSize     = 100
+)
+
+// Longest generated session title, in characters
+const maxSessionTitleLength = 80
+
+var validSessionID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// validChatSessionID rejects malformed IDs and "sessions", the listing's path
+func validChatSessionID(id string) bool {
+	return validSessionID.MatchString(id) && id != "sessions"
+}
+
+// chatMu serializes this instance's read-modify-write of sessions
+var chatMu sync.Mutex
+
+func chatSessionKey(tenant, id string) string {
+	return "chat:" + tenant + ":" + id
+}
+
+func getChatSession(tenant, id string) (*ChatSession, bool) {
+	var session ChatSession
+	if !getJSON(chatSessionKey(tenant, id), &session) {
+		return nil, false
+	}
+	return &session, true
+}
+
+func saveChatSession(session *ChatSession) {
+	setJSON(chatSessionKey(session.Tenant, session.ID), session, time.Duration(getConfig().ChatSessionTTL))
+}
+
+// recordChatTurn appends a turn to a session. The first turn creates the session,
+// titled after its question until a generated title replaces it.
+func recordChatTurn(tenant, id, model string, turn ChatTurn) {
+	chatMu.Lock()
+	defer chatMu.Unlock()
+
+	session, exists := getChatSession(tenant, id)
+	if !exists {
+		session = &ChatSession{ID: id, Tenant: tenant, Title: truncateTitle(turn.Query), CreatedAt: turn.CreatedAt}
+		go titleChatSession(tenant, id, model, turn)
+	}
+	session.Turns = append(session.Turns, turn)
+	session.UpdatedAt = turn.CreatedAt
+	saveChatSession(session)
+	if len(session.unsummarizedTurns()) > 0 {
+		go updateChatMemory(tenant, id, model)
+	}
+}
+
+// titleChatSession asks the model for a short title describing a session's first
+// exchange; failures keep the title taken from the question
+func titleChatSession(tenant, id, model string, turn ChatTurn) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic titling chat session %s: %v", id, r)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(backgroundContext(context.Background()), time.Minute)
+	defer cancel()
+	prompt := fmt.Sprintf(`Write a title of at most six words for a conversation that starts with this exchange. Reply with the title only.
+
+Question: %s
+
+Answer: %s
+
+Title:`, turn.Query, excerpt(turn.Response))
+	response, err := callOllamaContext(ctx, prompt, model)
+	if err != nil {
+		log.Printf("Failed to title chat session %s: %v", id, err)
+		return
+	}
+	title := cleanTitle(response)
+	if title == "" {
+		return
+	}
+
+	chatMu.Lock()
+	defer chatMu.Unlock()
+	session, exists := getChatSession(tenant, id)
+	if !exists {
+		return
+	}
+	session.Title = title
+	saveChatSession(session)
+}
+
+// cleanTitle keeps the first line of a generated title without labels or quotes
+func cleanTitle(response string) string {
+	title := strings.TrimSpace(response)
+	if i := strings.IndexByte(title, '\n'); i >= 0 {
+		title = title[:i]
+	}
+	title = strings.TrimSpace(strings.TrimPrefix(title, "Title:"))
+	title = strings.Trim(title, `"'*#. `)
+	return truncateTitle(title)
+}
+
+// truncateTitle shortens text to a title length at a word boundary
+func truncateTitle(text string) string {
+	words := strings.Fields(text)
+	title := ""
+	for _, w := range words {
+		next := strings.TrimSpace(title + " " + w)
+		if len([]rune(next)) > maxSessionTitleLength {
+			if title == "" {
+				return string([]rune(w)[:maxSessionTitleLength])
+			}
+			return title + " …"
+		}
+		title = next
+	}
+	return title
+}
+
+// listChatSessions returns a tenant's sessions, most recently active first
+func listChatSessions(tenant string) ([]ChatSessionSummary, error) {
+	keys, err := sharedState.Keys(chatSessionKey(tenant, ""))
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]ChatSessionSummary, 0, len(keys))
+	for _, key := range keys {
+		var session ChatSession
+		if !getJSON(key, &session) {
+			continue // Expired since listed
+		}
+		summary := ChatSessionSummary{
+			ID:        session.ID,
+			Title:     session.Title,
+			TurnCount: len(session.Turns),
+			CreatedAt: session.CreatedAt,
+			UpdatedAt: session.UpdatedAt,
+		}
+		if len(session.Turns) > 0 {
+			summary.LastQuery = session.Turns[len(session.Turns)-1].Query
+		}
+		sessions = append(sessions, summary)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].UpdatedAt.Equal(sessions[j].UpdatedAt) {
+			return sessions[i].UpdatedAt.After(sessions[j].UpdatedAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions, nil
+}
+
+// chatSessionsHandler lists the tenant's sessions a page at a time (?limit=, ?offset=)
+func chatSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	limit, offset := defaultSessionPageSize, 0
+	query := r.URL.Query()
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxSessionPageSize {
+			sendError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxSessionPageSize))
+			return
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			sendError(w, http.StatusBadRequest, "offset must not be negative")
+			return
+		}
+	}
+
+	sessions, err := listChatSessions(tenant)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to list sessions: %v", err))
+		return
+	}
+	response := map[string]interface{}{"total": len(sessions), "limit": limit, "offset": offset}
+	page := sessions[min(offset, len(sessions)):min(offset+limit, len(sessions))]
+	response["sessions"] = page
+	if offset+limit < len(sessions) {
+		response["nextOffset"] = offset + limit
+	}
+	sendJSON(w, http.StatusOK, response)
+}
+
+// chatHandler serves POST /api/chat: answers a message from the selected document
+// with the session's conversation so far, and records the exchange
+func chatHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if req.Message != "" {
+		req.Query = req.Message
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		sendError(w, http.StatusBadRequest, "message is required")
+		return
+	}
+	if req.Documents.selected() {
+		sendError(w, http.StatusBadRequest, "Chat messages are answered from one document; use documentName")
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	req.Tenant = tenant
+	if req.SessionID == "" {
+		req.SessionID = randomID()
+	}
+
+	resp, err := runQuery(req.QueryRequest)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, ChatResponse{SessionID: req.SessionID, QueryResponse: resp})
+}
+
+// chatTurn records a query and its response
+func chatTurn(req QueryRequest, resp *QueryResponse) ChatTurn {
+	return ChatTurn{
+		Document:       req.DocumentName,
+		Query:          req.Query,
+		CorrectedQuery: resp.CorrectedQuery,
+		RewrittenQuery: resp.RewrittenQuery,
+		Response:       resp.Response,
+		SourceChunks:   resp.SourceChunks,
+		Citations:      resp.Citations,
+		SourcePages:    resp.SourcePages,
+		SourceMetadata: resp.SourceMetadata,
+		CreatedAt:      time.Now().UTC(),
+	}
+}
+
+// handleChatByID serves GET /api/chat/{sessionId}, /api/chat/{sessionId}/export,
+// /api/chat/{sessionId}/memory and /api/chat/{sessionId}/messages
+func handleChatByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/chat/"), "/"), "/")
+	id := parts[0]
+	if len(parts) > 2 || len(parts) == 2 && parts[1] != "export" && parts[1] != "memory" && parts[1] != "messages" {
+		sendError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	session, exists := getChatSession(tenant, id)
+	if !exists {
+		sendError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	if len(parts) == 1 {
+		sendJSON(w, http.StatusOK, session)
+		return
+	}
+	if parts[1] == "memory" {
+		handleChatMemory(w, session)
+		return
+	}
+	if parts[1] == "messages" {
+		sendJSON(w, http.StatusOK, map[string]interface{}{"sessionId": session.ID, "messages": session.messages()})
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "markdown", "md":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chat-%s.md"`, id))
+		if _, err := w.Write([]byte(session.markdown())); err != nil {
+			log.Printf("Failed to write chat export: %v", err)
+		}
+	case "json":
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chat-%s.json"`, id))
+		sendJSON(w, http.StatusOK, session)
+	case "pdf":
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chat-%s.pdf"`, id))
+		if _, err := w.Write(renderTextPDF(session.pdfLines())); err != nil {
+			log.Printf("Failed to write chat export: %v", err)
+		}
+	default:
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported export format %q (use markdown, json or pdf)", format))
+	}
+}
+
+// messages returns the session's dialogue, a user and an assistant message per turn
+func (s *ChatSession) messages() []ChatMessage {
+	messages := make([]ChatMessage, 0, 2*len(s.Turns))
+	for _, turn := range s.Turns {
+		messages = append(messages,
+			ChatMessage{Role: "user", Content: turn.Query, Document: turn.Document, CreatedAt: turn.CreatedAt},
+			ChatMessage{Role: "assistant", Content: turn.Response, Document: turn.Document, CreatedAt: turn.CreatedAt})
+	}
+	return messages
+}
+
+// exportHeader is the session's title and a line describing it
+func (s *ChatSession) exportHeader() (string, string) {
+	title := s.Title
+	if title == "" {
+		title = "Chat session " + s.ID
+	}
+	return title, fmt.Sprintf("%d questions, %s to %s", len(s.Turns),
+		s.CreatedAt.Format("2006-01-02 15:04 MST"), s.UpdatedAt.Format("2006-01-02 15:04 MST"))
+}
+
+// source describes where a turn's source chunk came from
+func (t ChatTurn) source(i int) string {
+	var parts []string
+	if i < len(t.Citations) {
+		parts = append(parts, t.Citations[i])
+	} else {
+		parts = append(parts, t.Document)
+		if i < len(t.SourcePages) && t.SourcePages[i] > 0 {
+			parts = append(parts, fmt.Sprintf("p. %d", t.SourcePages[i]))
+		}
+		if i < len(t.SourceMetadata) && timeCode(t.SourceMetadata[i]) != "" {
+			parts = append(parts, "["+timeCode(t.SourceMetadata[i])+"]")
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// excerpt shortens a source chunk for exports
+func excerpt(chunk string) string {
+	const maxWords = 60
+	words := strings.Fields(chunk)
+	if len(words) > maxWords {
+		return strings.Join(words[:maxWords], " ") + " …"
+	}
+	return strings.Join(words, " ")
+}
+
+func (s *ChatSession) markdown() string {
+	var b strings.Builder
+	title, header := s.exportHeader()
+	fmt.Fprintf(&b, "# %s\n\n_%s_\n", title, header)
+	for i, turn := range s.Turns {
+		fmt.Fprintf(&b, "\n## %d. %s\n\n", i+1, turn.Query)
+		fmt.Fprintf(&b, "_%s, %s_\n\n", turn.Document, turn.CreatedAt.Format("2006-01-02 15:04 MST"))
+		if turn.CorrectedQuery != "" {
+			fmt.Fprintf(&b, "_Answered as: %s_\n\n", turn.CorrectedQuery)
+		}
+		fmt.Fprintf(&b, "%s\n", strings.TrimSpace(turn.Response))
+		if len(turn.SourceChunks) > 0 {
+			b.WriteString("\n**Sources**\n\n")
+			for j, chunk := range turn.SourceChunks {
+				fmt.Fprintf(&b, "%d. %s\n   > %s\n", j+1, turn.source(j), excerpt(chunk))
+			}
+		}
+	}
+	return b.String()
+}
+
+func (s *ChatSession) pdfLines() []pdfLine {
+	title, header := s.exportHeader()
+	lines := []pdfLine{{Text: title, Bold: true}, {Text: header}}
+	for i, turn := range s.Turns {
+		lines = append(lines, pdfLine{}, pdfLine{Text: fmt.Sprintf("%d. %s", i+1, turn.Query), Bold: true},
+			pdfLine{Text: fmt.Sprintf("%s, %s", turn.Document, turn.CreatedAt.Format("2006-01-02 15:04 MST"))})
+		if turn.CorrectedQuery != "" {
+			lines = append(lines, pdfLine{Text: "Answered as: " + turn.CorrectedQuery})
+		}
+		lines = append(lines, pdfLine{})
+		for _, paragraph := range strings.Split(strings.TrimSpace(turn.Response), "\n") {
+			lines = append(lines, pdfLine{Text: paragraph})
+		}
+		if len(turn.SourceChunks) > 0 {
+			lines = append(lines, pdfLine{}, pdfLine{Text: "Sources", Bold: true})
+			for j, chunk := range turn.SourceChunks {
+				lines = append(lines, pdfLine{Text: fmt.Sprintf("%d. %s", j+1, turn.source(j))},
+					pdfLine{Text: "   \"" + excerpt(chunk) + "\""})
+			}
+		}
+	}
+	return lines
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Longest answer excerpt, in words, a summarization prompt gets for each turn
+const memoryAnswerWords = 150
+
+// chatMemoryRunning marks sessions whose memory is being updated; guarded by chatMu
+var chatMemoryRunning = make(map[string]bool)
+
+// recentTurns returns the turns given to the model verbatim: the latest
+// CHAT_HISTORY_TURNS that are not yet folded into the memory
+func (s *ChatSession) recentTurns() []ChatTurn {
+	start := max(len(s.Turns)-getConfig().ChatHistoryTurns, s.MemoryTurns, 0)
+	return s.Turns[min(start, len(s.Turns)):]
+}
+
+// unsummarizedTurns returns the turns that have left the verbatim window but are not
+// yet in the memory
+func (s *ChatSession) unsummarizedTurns() []ChatTurn {
+	end := len(s.Turns) - getConfig().ChatHistoryTurns
+	if end <= s.MemoryTurns {
+		return nil
+	}
+	return s.Turns[s.MemoryTurns:end]
+}
+
+// withConversation prepends a session's memory and recent turns to a prompt, so
+// follow-up questions are answered in context
+func withConversation(prompt string, session *ChatSession) string {
+	if session == nil {
+		return prompt
+	}
+	recent := session.recentTurns()
+	if session.Memory == "" && len(recent) == 0 {
+		return prompt
+	}
+	var b strings.Builder
+	b.WriteString("Conversation so far (use it to understand the question; answer from the context):\n")
+	if session.Memory != "" {
+		fmt.Fprintf(&b, "Summary of earlier turns: %s\n", session.Memory)
+	}
+	for _, turn := range recent {
+		fmt.Fprintf(&b, "User: %s\nAssistant: %s\n", turn.Query, strings.TrimSpace(turn.Response))
+	}
+	return b.String() + "\n" + prompt
+}
+
+// updateChatMemory folds the turns that left the verbatim window into the session's
+// memory. Runs in the background after a turn is recorded; callers must not hold
+// chatMu.
+func updateChatMemory(tenant, id, model string) {
+	key := chatSessionKey(tenant, id)
+	chatMu.Lock()
+	if chatMemoryRunning[key] {
+		chatMu.Unlock()
+		return
+	}
+	chatMemoryRunning[key] = true
+	session, exists := getChatSession(tenant, id)
+	chatMu.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic updating memory of chat session %s: %v", id, r)
+		}
+		chatMu.Lock()
+		delete(chatMemoryRunning, key)
+		chatMu.Unlock()
+	}()
+	if !exists {
+		return
+	}
+	pending := session.unsummarizedTurns()
+	if len(pending) == 0 {
+		return
+	}
+
+	var exchanges strings.Builder
+	for _, turn := range pending {
+		answer := strings.Fields(turn.Response)
+		if len(answer) > memoryAnswerWords {
+			answer = append(answer[:memoryAnswerWords], "…")
+		}
+		fmt.Fprintf(&exchanges, "User: %s\nAssistant: %s\n\n", turn.Query, strings.Join(answer, " "))
+	}
+	memory := session.Memory
+	if memory == "" {
+		memory = "(empty)"
+	}
+	prompt := fmt.Sprintf(`You maintain the memory of a conversation about documents. Update the memory with the new exchanges. Keep facts that were established, the user's goals and preferences, and open questions; drop small talk. Write at most 150 words.
+
+Current memory:
+%s
+
+New exchanges:
+%s
+Updated memory:`, memory, exchanges.String())
+
+	ctx, cancel := context.WithTimeout(backgroundContext(context.Background()), 2*time.Minute)
+	defer cancel()
+	response, err := callOllamaContext(ctx, prompt, model)
+	if err != nil {
+		log.Printf("Failed to update memory of chat session %s: %v", id, err)
+		return
+	}
+	response = strings.TrimSpace(response)
+	if response == "" {
+		return
+	}
+
+	chatMu.Lock()
+	defer chatMu.Unlock()
+	current, exists := getChatSession(tenant, id)
+	// Another instance may have updated the memory meanwhile
+	if !exists || current.MemoryTurns != session.MemoryTurns {
+		return
+	}
+	current.Memory = response
+	current.MemoryTurns += len(pending)
+	saveChatSession(current)
+}
+
+// handleChatMemory returns a session's memory block (read-only)
+func handleChatMemory(w http.ResponseWriter, session *ChatSession) {
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"id":           session.ID,
+		"memory":       session.Memory,
+		"memoryTurns":  session.MemoryTurns,
+		"recentTurns":  len(session.recentTurns()),
+		"historyTurns": getConfig().ChatHistoryTurns,
+	})
+}
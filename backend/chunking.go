@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Chunking strategies
+const (
+	ChunkFixed     = "fixed"     // Pack words up to the chunk size
+	ChunkSentence  = "sentence"  // Pack whole sentences where possible
+	ChunkParagraph = "paragraph" // Pack whole paragraphs where possible
+)
+
+// ChunkOptions controls how text is split into chunks
+type ChunkOptions struct {
+	Strategy string `json:"strategy,omitempty"`
+	Size     int    `json:"size,omitempty"`    // Target chunk size in characters
+	Overlap  int    `json:"overlap,omitempty"` // Words repeated from the end of the previous chunk
+}
+
+// Characters an English word takes on average, with the space after it; used to
+// weigh an overlap in words against a chunk size in characters
+const charsPerWord = 6
+
+var paragraphBreak = regexp.MustCompile(`\n[ \t\r]*\n|` + pageSeparator)
+
+func validateChunkOptions(opts ChunkOptions) error {
+	switch opts.Strategy {
+	case "", ChunkFixed, ChunkSentence, ChunkParagraph:
+	default:
+		return fmt.Errorf("unknown chunk strategy %q", opts.Strategy)
+	}
+	if opts.Size < 0 || opts.Overlap < 0 {
+		return fmt.Errorf("chunk size and overlap must not be negative")
+	}
+	if limit := maxChunkOverlap(opts.Size); opts.Overlap > limit {
+		return fmt.Errorf("chunk overlap is too large for the chunk size (at most %d words)", limit)
+	}
+	return nil
+}
+
+// maxChunkOverlap is the largest overlap allowed for a chunk size, 0 taking the
+// configured size: half the words that fit in a chunk
+func maxChunkOverlap(size int) int {
+	if size <= 0 {
+		size = getConfig().ChunkSize
+	}
+	return size / charsPerWord / 2
+}
+
+// wordRange is a half-open range of word indices
+type wordRange struct{ start, end int }
+
+// segmentWords groups word indices into the units a strategy keeps together
+func segmentWords(text string, words []string, strategy string) []wordRange {
+	var segments []wordRange
+	switch strategy {
+	case ChunkParagraph:
+		offset := 0
+		for _, para := range paragraphBreak.Split(text, -1) {
+			n := len(strings.Fields(para))
+			if n > 0 {
+				segments = append(segments, wordRange{offset, offset + n})
+			}
+			offset += n
+		}
+	case ChunkSentence:
+		start := 0
+		for i, w := range words {
+			trimmed := strings.TrimRight(w, `"')]»”’`)
+			if strings.HasSuffix(trimmed, ".") || strings.HasSuffix(trimmed, "!") || strings.HasSuffix(trimmed, "?") {
+				segments = append(segments, wordRange{start, i + 1})
+				start = i + 1
+			}
+		}
+		if start < len(words) {
+			segments = append(segments, wordRange{start, len(words)})
+		}
+	default:
+		for i := range words {
+			segments = append(segments, wordRange{i, i + 1})
+		}
+	}
+	return segments
+}
+
+// chunkWithOptions splits text into chunks and returns the word offset each chunk starts at.
+// Segments larger than the chunk size are split word by word.
+func chunkWithOptions(text string, opts ChunkOptions) ([]string, []int) {
+	if len(text) == 0 {
+		return []string{}, []int{}
+	}
+
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return []string{text}, []int{0}
+	}
+
+	size := opts.Size
+	if size <= 0 {
+		size = getConfig().ChunkSize
+	}
+
+	estimatedChunks := len(text) / size
+	if estimatedChunks == 0 {
+		estimatedChunks = 1
+	}
+	chunks := make([]string, 0, estimatedChunks)
+	starts := make([]int, 0, estimatedChunks)
+
+	wordLen := func(i int) int { return len(words[i]) + 1 }
+	// Words before flushedEnd were carried over from the previous chunk
+	curStart, curEnd, curSize, flushedEnd := 0, 0, 0, 0
+
+	flush := func() {
+		if curEnd <= flushedEnd {
+			return
+		}
+		chunks = append(chunks, strings.Join(words[curStart:curEnd], " "))
+		starts = append(starts, curStart)
+
+		// Carry the trailing overlap words into the next chunk; a chunk shorter
+		// than the overlap carries all but its first word
+		next := curEnd - max(min(opts.Overlap, curEnd-curStart-1), 0)
+		curStart, curSize, flushedEnd = next, 0, curEnd
+		for i := next; i < curEnd; i++ {
+			curSize += wordLen(i)
+		}
+	}
+
+	add := func(seg wordRange, segSize int) {
+		if curSize+segSize > size && curEnd > flushedEnd {
+			flush()
+		}
+		// Carried words give way to a segment that would not fit beside them
+		for curStart < flushedEnd && curSize+segSize > size {
+			curSize -= wordLen(curStart)
+			curStart++
+		}
+		curEnd = seg.end
+		curSize += segSize
+	}
+
+	for _, seg := range segmentWords(text, words, opts.Strategy) {
+		segSize := 0
+		for i := seg.start; i < seg.end; i++ {
+			segSize += wordLen(i)
+		}
+		if segSize <= size || seg.end-seg.start == 1 {
+			add(seg, segSize)
+			continue
+		}
+		for i := seg.start; i < seg.end; i++ {
+			add(wordRange{i, i + 1}, wordLen(i))
+		}
+	}
+	flush()
+
+	return chunks, starts
+}
+
+// chunkWordStarts returns the word offset of each chunk assuming chunks are
+// consecutive and non-overlapping (used when hooks replace the chunk list)
+func chunkWordStarts(chunks []string) []int {
+	starts := make([]int, len(chunks))
+	offset := 0
+	for i, c := range chunks {
+		starts[i] = offset
+		offset += len(strings.Fields(c))
+	}
+	return starts
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// chunkTestText is words of varied length in sentences of seven words and
+// paragraphs of three sentences
+func chunkTestText(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "w%d%s", i, strings.Repeat("x", i%5))
+		switch {
+		case i == n-1:
+			b.WriteString(".")
+		case i%21 == 20:
+			b.WriteString(".\n\n")
+		case i%7 == 6:
+			b.WriteString(". ")
+		default:
+			b.WriteString(" ")
+		}
+	}
+	return b.String()
+}
+
+func TestChunkOverlap(t *testing.T) {
+	text := chunkTestText(400)
+	words := strings.Fields(text)
+	tests := []struct {
+		name  string
+		opts  ChunkOptions
+		exact bool // Every chunk repeats exactly min(Overlap, its predecessor's words - 1)
+	}{
+		{"fixed without overlap", ChunkOptions{Strategy: ChunkFixed, Size: 100}, true},
+		{"fixed with overlap", ChunkOptions{Strategy: ChunkFixed, Size: 100, Overlap: 8}, true},
+		{"fixed with the largest overlap", ChunkOptions{Strategy: ChunkFixed, Size: 512, Overlap: maxChunkOverlap(512)}, true},
+		{"sentence with overlap", ChunkOptions{Strategy: ChunkSentence, Size: 120, Overlap: 5}, false},
+		{"paragraph with overlap", ChunkOptions{Strategy: ChunkParagraph, Size: 300, Overlap: 10}, false},
+		{"overlap longer than a chunk", ChunkOptions{Strategy: ChunkFixed, Size: 30, Overlap: 40}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks, starts := chunkWithOptions(text, tt.opts)
+			if len(chunks) < 2 || len(chunks) != len(starts) {
+				t.Fatalf("got %d chunks and %d starts", len(chunks), len(starts))
+			}
+
+			prevEnd := 0
+			for i, chunk := range chunks {
+				if len(chunk) > tt.opts.Size {
+					t.Errorf("chunk %d has %d characters, over the size of %d", i, len(chunk), tt.opts.Size)
+				}
+				fields := strings.Fields(chunk)
+				if got := words[starts[i] : starts[i]+len(fields)]; !reflect.DeepEqual(got, fields) {
+					t.Fatalf("chunk %d does not hold the words from its start %d", i, starts[i])
+				}
+				if i > 0 {
+					overlap := prevEnd - starts[i]
+					prevLen := len(strings.Fields(chunks[i-1]))
+					limit := min(tt.opts.Overlap, prevLen-1)
+					switch {
+					case tt.exact && overlap != limit:
+						t.Errorf("chunk %d repeats %d words, want %d", i, overlap, limit)
+					case overlap < 0 || overlap > limit:
+						t.Errorf("chunk %d repeats %d words, want 0 to %d", i, overlap, limit)
+					case tt.opts.Overlap > 0 && overlap == 0 && !tt.exact && i == 1:
+						t.Errorf("chunk %d repeats no words of an overlap of %d", i, tt.opts.Overlap)
+					}
+					if starts[i]+len(fields) <= prevEnd {
+						t.Errorf("chunk %d adds no words", i)
+					}
+				}
+				prevEnd = starts[i] + len(fields)
+			}
+			if prevEnd != len(words) {
+				t.Errorf("chunks end at word %d of %d", prevEnd, len(words))
+			}
+
+			streamed, err := streamChunks(bufio.NewReader(strings.NewReader(text)), tt.opts, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(streamed.Chunks, chunks) || !reflect.DeepEqual(streamed.Starts, starts) {
+				t.Errorf("streamed chunking differs: %d chunks starting at %v, want %d starting at %v",
+					len(streamed.Chunks), streamed.Starts, len(chunks), starts)
+			}
+		})
+	}
+}
+
+func TestValidateChunkOverlap(t *testing.T) {
+	tests := []struct {
+		opts  ChunkOptions
+		valid bool
+	}{
+		{ChunkOptions{Size: 100, Overlap: 8}, true},
+		{ChunkOptions{Size: 100, Overlap: 40}, false},
+		{ChunkOptions{Size: 1200, Overlap: 20}, true},
+		{ChunkOptions{Overlap: maxChunkOverlap(0)}, true},
+		{ChunkOptions{Overlap: maxChunkOverlap(0) + 1}, false},
+		{ChunkOptions{Size: 100, Overlap: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := validateChunkOptions(tt.opts); (err == nil) != tt.valid {
+			t.Errorf("validateChunkOptions(%+v) = %v, want valid %v", tt.opts, err, tt.valid)
+		}
+	}
+}
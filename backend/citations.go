@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Supported citation styles
+const (
+	CitationAPA      = "apa"
+	CitationMLA      = "mla"
+	CitationBluebook = "bluebook"
+)
+
+// parseMetadataDate accepts the date layouts users commonly type at upload
+func parseMetadataDate(value string) (*time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006", time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("unrecognized date %q (use YYYY, YYYY-MM or YYYY-MM-DD)", value)
+}
+
+func validCitationStyle(style string) bool {
+	switch strings.ToLower(style) {
+	case CitationAPA, CitationMLA, CitationBluebook:
+		return true
+	}
+	return false
+}
+
+// formatCitation renders a reference for a document in the requested style.
+// The filename stands in for the title when no title metadata is available.
+func formatCitation(meta DocumentMetadata, fileName, style string) string {
+	title := meta.Title
+	if title == "" {
+		title = fileName
+	}
+	author := strings.TrimSpace(meta.Author)
+
+	switch strings.ToLower(style) {
+	case CitationMLA:
+		var b strings.Builder
+		if author != "" {
+			b.WriteString(strings.TrimSuffix(author, ".") + ". ")
+		}
+		b.WriteString(title + ".")
+		if meta.Date != nil {
+			b.WriteString(" " + meta.Date.Format("2 Jan. 2006") + ".")
+		}
+		return b.String()
+
+	case CitationBluebook:
+		year := ""
+		if meta.Date != nil {
+			year = fmt.Sprintf(" (%d)", meta.Date.Year())
+		}
+		if author != "" {
+			return fmt.Sprintf("%s, %s%s.", author, title, year)
+		}
+		return fmt.Sprintf("%s%s.", title, year)
+
+	default: // APA
+		year := "n.d."
+		if meta.Date != nil {
+			year = fmt.Sprintf("%d", meta.Date.Year())
+		}
+		if author != "" {
+			return fmt.Sprintf("%s. (%s). %s.", strings.TrimSuffix(author, "."), year, title)
+		}
+		return fmt.Sprintf("%s. (%s).", title, year)
+	}
+}
+
+func handleGetDocumentCitation(w http.ResponseWriter, r *http.Request, docName string) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+
+	style := r.URL.Query().Get("style")
+	if style == "" {
+		style = CitationAPA
+	}
+	if !validCitationStyle(style) {
+		sendError(w, http.StatusBadRequest, "Unsupported citation style")
+		return
+	}
+
+	doc, ok := getDocumentOrError(w, docName)
+	if !ok {
+		return
+	}
+
+	doc.mu.RLock()
+	citation := formatCitation(doc.Metadata, doc.Name, style)
+	doc.mu.RUnlock()
+
+	sendJSON(w, http.StatusOK, map[string]string{"style": strings.ToLower(style), "citation": citation})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Document metadata holding the label given by classification
+const MetaType = "type"
+
+// Classification methods
+const (
+	ClassifyKeywords = "keywords" // Count the labels' keywords in the text
+	ClassifyLLM      = "llm"      // Ask the model to pick a label
+)
+
+// Leading text classified; labels are decided by how a document opens
+const classifySampleChars = 6000
+
+// ClassificationConfig controls the labelling of uploads against a taxonomy
+type ClassificationConfig struct {
+	Enabled  bool         `json:"enabled"`         // Classify uploads that do not set classify
+	Method   string       `json:"method"`          // keywords or llm
+	Model    string       `json:"model,omitempty"` // For the llm method; defaults to defaultModel
+	MinScore int          `json:"minScore"`        // Keyword matches a label needs (keywords method)
+	Labels   []ClassLabel `json:"labels"`
+}
+
+// ClassLabel is one document type of the taxonomy. Documents given the label are
+// processed with its preset unless the upload chose one.
+type ClassLabel struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"` // Shown to the model
+	Keywords    []string `json:"keywords,omitempty"`    // Words or phrases typical of the type
+	Preset      string   `json:"preset,omitempty"`
+}
+
+// defaultTaxonomy is used until the config file sets classification.labels
+var defaultTaxonomy = []ClassLabel{
+	{
+		Name:        "invoice",
+		Description: "Invoices, bills and receipts",
+		Keywords:    []string{"invoice", "invoice number", "bill to", "amount due", "due date", "subtotal", "vat", "payment terms", "receipt", "total due"},
+	},
+	{
+		Name:        "contract",
+		Description: "Contracts, agreements and terms of service",
+		Keywords:    []string{"agreement", "parties", "hereby", "whereas", "governing law", "termination", "indemnify", "liability", "effective date", "in witness whereof"},
+		Preset:      "contract",
+	},
+	{
+		Name:        "report",
+		Description: "Reports, research papers and white papers",
+		Keywords:    []string{"abstract", "introduction", "methodology", "results", "conclusion", "findings", "executive summary", "figure", "references", "appendix"},
+		Preset:      "research-paper",
+	},
+	{
+		Name:        "resume",
+		Description: "Resumes and CVs",
+		Keywords:    []string{"resume", "curriculum vitae", "work experience", "education", "skills", "employment history", "certifications", "linkedin", "references available"},
+	},
+	{
+		Name:        "transcript",
+		Description: "Meeting transcripts and minutes",
+		Keywords:    []string{"meeting", "minutes", "attendees", "agenda", "action items", "transcript", "speaker", "next steps"},
+		Preset:      "meeting-transcript",
+	},
+}
+
+func (c ClassificationConfig) validate() error {
+	if c.Method != ClassifyKeywords && c.Method != ClassifyLLM {
+		return fmt.Errorf("unknown classification.method %q (use keywords or llm)", c.Method)
+	}
+	if c.MinScore < 0 {
+		return errors.New("classification.minScore cannot be negative")
+	}
+	seen := make(map[string]bool)
+	for _, label := range c.Labels {
+		name := strings.TrimSpace(label.Name)
+		if name == "" || seen[name] {
+			return fmt.Errorf("classification labels need unique names (got %q)", label.Name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// classifying tells whether an ingestion labels its document
+func classifying(opts IngestOptions) bool {
+	if opts.Classify != nil {
+		return *opts.Classify
+	}
+	return getConfig().Classification.Enabled
+}
+
+// classifyUpload labels a document from the start of its text, storing the label
+// as the type metadata. It returns the label, or nil when none fits or
+// classification fails, which leaves the document unlabelled.
+func classifyUpload(opts IngestOptions, text string) (IngestOptions, *ClassLabel) {
+	label, err := classifyText(context.Background(), getConfig().Classification, text)
+	if err != nil {
+		log.Printf("Classification of %s failed, leaving it unlabelled: %v", opts.Name, err)
+		return opts, nil
+	}
+	if label == nil {
+		log.Printf("Classification of %s matched no label", opts.Name)
+		return opts, nil
+	}
+	opts.Metadata = withCustomMetadata(opts.Metadata, MetaType, label.Name)
+	log.Printf("Classified %s as %s", opts.Name, label.Name)
+	return opts, label
+}
+
+// withCustomMetadata returns meta with a custom field set, leaving the original map unchanged
+func withCustomMetadata(meta DocumentMetadata, key, value string) DocumentMetadata {
+	custom := make(map[string]string, len(meta.Custom)+1)
+	for k, v := range meta.Custom {
+		custom[k] = v
+	}
+	custom[key] = value
+	meta.Custom = custom
+	return meta
+}
+
+// readTextSample reads up to n bytes from the start of a text file
+func readTextSample(filePath string, n int64) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, n))
+	if err != nil {
+		return "", err
+	}
+	return strings.ToValidUTF8(string(data), ""), nil
+}
+
+// classifyText returns the taxonomy label of a text, or nil when none fits
+func classifyText(ctx context.Context, cfg ClassificationConfig, text string) (*ClassLabel, error) {
+	if len(cfg.Labels) == 0 || strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	if len(text) > classifySampleChars {
+		text = strings.ToValidUTF8(text[:classifySampleChars], "")
+	}
+	if cfg.Method == ClassifyLLM {
+		return classifyWithModel(ctx, cfg, text)
+	}
+	return classifyByKeywords(cfg, text), nil
+}
+
+// classifyByKeywords picks the label with the most keyword matches, counting
+// each keyword up to three times. Ties go to the label listed first.
+func classifyByKeywords(cfg ClassificationConfig, text string) *ClassLabel {
+	// Words are compared with single spaces around them, as for exclusions
+	normalized := " " + strings.Join(termWords(text), " ") + " "
+	var best *ClassLabel
+	bestScore := 0
+	for i, label := range cfg.Labels {
+		score := 0
+		for _, keyword := range label.Keywords {
+			if words := termWords(keyword); len(words) > 0 {
+				score += min(strings.Count(normalized, " "+strings.Join(words, " ")+" "), 3)
+			}
+		}
+		if score > bestScore {
+			best, bestScore = &cfg.Labels[i], score
+		}
+	}
+	if bestScore < max(cfg.MinScore, 1) {
+		return nil
+	}
+	return best
+}
+
+// classifyWithModel asks the model which label fits the text
+func classifyWithModel(ctx context.Context, cfg ClassificationConfig, text string) (*ClassLabel, error) {
+	model := modelOrDefault(cfg.Model)
+	if model == "" {
+		return nil, errors.New("no model configured; set classification.model or defaultModel")
+	}
+
+	var b strings.Builder
+	b.WriteString("Classify the document below as one of these types:\n")
+	for _, label := range cfg.Labels {
+		b.WriteString("- " + label.Name)
+		if label.Description != "" {
+			b.WriteString(": " + label.Description)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("Reply with the type name only, or \"none\" if no type fits.\n\nDocument:\n")
+	b.WriteString(text)
+
+	reply, _, err := cachedAnswer(ctx, b.String(), model)
+	if err != nil {
+		return nil, err
+	}
+	return matchLabel(cfg.Labels, reply), nil
+}
+
+// matchLabel finds the label a model reply names: the whole reply, else the first
+// label mentioned in it
+func matchLabel(labels []ClassLabel, reply string) *ClassLabel {
+	reply = strings.ToLower(strings.Trim(strings.TrimSpace(reply), ".\"'*`"))
+	for i, label := range labels {
+		if strings.EqualFold(label.Name, reply) {
+			return &labels[i]
+		}
+	}
+	words := " " + strings.Join(termWords(reply), " ") + " "
+	best, bestAt := -1, len(words)
+	for i, label := range labels {
+		name := termWords(label.Name)
+		if len(name) == 0 {
+			continue
+		}
+		at := strings.Index(words, " "+strings.Join(name, " ")+" ")
+		if at >= 0 && at < bestAt {
+			best, bestAt = i, at
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	return &labels[best]
+}
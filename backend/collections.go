@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Collection holds settings shared by every document uploaded into it.
+// Collections are replaced wholesale on update, so a *Collection is never mutated.
+type Collection struct {
+	Name            string           `json:"name"`
+	PreprocessRules []PreprocessRule `json:"preprocessRules,omitempty"`
+	Chunking        ChunkOptions     `json:"chunking"`
+	EmbeddingModel  string           `json:"embeddingModel,omitempty"`
+	Exclusions      *Exclusions      `json:"exclusions,omitempty"`  // Chunks kept out of every query's context
+	Recency         *RecencyRanking  `json:"recency,omitempty"`     // Ranks newer chunks higher
+	FieldBoosts     *FieldBoosts     `json:"fieldBoosts,omitempty"` // Overrides the configured field boosts
+	Synonyms        [][]string       `json:"synonyms,omitempty"`    // Groups of equivalent terms for keyword retrieval
+	Fallback        string           `json:"fallback,omitempty"`    // Context of queries no chunk matches; overrides RETRIEVAL_FALLBACK
+	CreatedAt       time.Time        `json:"createdAt"`
+	UpdatedAt       time.Time        `json:"updatedAt"`
+	rules           []compiledRule   // Compiled PreprocessRules
+	thesaurus       *thesaurus       // Compiled Synonyms
+}
+
+// CollectionStore global storage of collection settings
+type CollectionStore struct {
+	collections map[string]*Collection
+	mu          sync.RWMutex
+}
+
+func NewCollectionStore() *CollectionStore {
+	return &CollectionStore{
+		collections: make(map[string]*Collection),
+	}
+}
+
+func (cs *CollectionStore) Get(name string) (*Collection, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	c, exists := cs.collections[name]
+	return c, exists
+}
+
+func (cs *CollectionStore) Set(c *Collection) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if existing, exists := cs.collections[c.Name]; exists {
+		c.CreatedAt = existing.CreatedAt
+	}
+	cs.collections[c.Name] = c
+}
+
+func (cs *CollectionStore) Delete(name string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, exists := cs.collections[name]; !exists {
+		return false
+	}
+	delete(cs.collections, name)
+	return true
+}
+
+func (cs *CollectionStore) List() []*Collection {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	result := make([]*Collection, 0, len(cs.collections))
+	for _, c := range cs.collections {
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+var collectionStore = NewCollectionStore()
+
+// collectionRules returns the compiled preprocessing rules for a collection, if any
+func collectionRules(name string) []compiledRule {
+	if c, exists := collectionStore.Get(name); exists {
+		return c.rules
+	}
+	return nil
+}
+
+// applyCollectionSettings fills chunking and embedding options left unset at
+// upload from the collection, then from the defaults
+func applyCollectionSettings(opts IngestOptions) IngestOptions {
+	if c, exists := collectionStore.Get(opts.Collection); exists {
+		if opts.Chunking.Strategy == "" {
+			opts.Chunking.Strategy = c.Chunking.Strategy
+		}
+		if opts.Chunking.Size == 0 {
+			opts.Chunking.Size = c.Chunking.Size
+		}
+		if opts.Chunking.Overlap == 0 {
+			opts.Chunking.Overlap = c.Chunking.Overlap
+		}
+		if opts.EmbeddingModel == "" {
+			opts.EmbeddingModel = c.EmbeddingModel
+		}
+	}
+	if opts.Chunking.Strategy == "" {
+		opts.Chunking.Strategy = ChunkFixed
+	}
+	if opts.Chunking.Size == 0 {
+		opts.Chunking.Size = getConfig().ChunkSize
+	}
+	return opts
+}
+
+// collectionSummary is a listing entry for a collection
+type collectionSummary struct {
+	*Collection
+	DocumentCount int `json:"documentCount"`
+}
+
+// collectionsHandler lists collections (GET) or creates/replaces one (POST)
+func collectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && !validateMethod(w, r, "POST") {
+		return
+	}
+
+	if r.Method == "GET" {
+		list := collectionStore.List()
+		result := make([]collectionSummary, 0, len(list))
+		for _, c := range list {
+			result = append(result, collectionSummary{c, len(documentStore.ByCollection(c.Name))})
+		}
+		sendJSON(w, http.StatusOK, map[string]interface{}{"collections": result})
+		return
+	}
+
+	var c Collection
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" || strings.Contains(c.Name, "/") {
+		sendError(w, http.StatusBadRequest, "Invalid collection name")
+		return
+	}
+
+	if err := validateChunkOptions(c.Chunking); err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rules, err := compileRules(c.PreprocessRules)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if c.Exclusions != nil {
+		if err := c.Exclusions.validate(); err != nil {
+			sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if c.Recency != nil {
+		if err := c.Recency.validate(); err != nil {
+			sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if c.FieldBoosts != nil {
+		if err := c.FieldBoosts.validate(); err != nil {
+			sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	synonyms, err := compileThesaurus(c.Synonyms)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validFallback(c.Fallback) {
+		sendError(w, http.StatusBadRequest, "fallback must be first, vector, summary or none")
+		return
+	}
+	c.rules = rules
+	c.thesaurus = synonyms
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
+
+	collectionStore.Set(&c)
+	sendJSON(w, http.StatusOK, &c)
+}
+
+func handleCollectionByName(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/collection/")
+	parts := strings.Split(path, "/")
+	name := parts[0]
+
+	// Previews are dry runs; deleting and re-chunking change stored state
+	if (r.Method == "DELETE" || r.Method == "PUT" || (len(parts) == 2 && parts[1] == "rechunk")) && rejectOnReplica(w) {
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method == "DELETE" {
+			handleDeleteCollection(w, r, name)
+		} else {
+			handleGetCollection(w, r, name)
+		}
+	} else if len(parts) == 3 && parts[1] == "preprocess" && parts[2] == "preview" {
+		handlePreprocessPreview(w, r, name)
+	} else if len(parts) == 2 && parts[1] == "rechunk" {
+		handleRechunkCollection(w, r, name)
+	} else if len(parts) == 2 && parts[1] == "thesaurus" {
+		handleCollectionThesaurus(w, r, name)
+	} else if len(parts) == 2 && parts[1] == "query" {
+		rateLimited(func(w http.ResponseWriter, r *http.Request) { handleCollectionQuery(w, r, name) })(w, r)
+	} else if len(parts) == 2 && parts[1] == "extract" {
+		rateLimited(func(w http.ResponseWriter, r *http.Request) { handleCollectionExtract(w, r, name) })(w, r)
+	} else {
+		sendError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func handleGetCollection(w http.ResponseWriter, r *http.Request, name string) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+
+	c, exists := collectionStore.Get(name)
+	if !exists {
+		sendError(w, http.StatusNotFound, "Collection not found")
+		return
+	}
+	sendJSON(w, http.StatusOK, collectionSummary{c, len(documentStore.ByCollection(name))})
+}
+
+// handleDeleteCollection removes collection settings; member documents are kept
+func handleDeleteCollection(w http.ResponseWriter, r *http.Request, name string) {
+	if !validateMethod(w, r, "DELETE") {
+		return
+	}
+
+	if !collectionStore.Delete(name) {
+		sendError(w, http.StatusNotFound, "Collection not found")
+		return
+	}
+	sendJSON(w, http.StatusOK, map[string]string{"message": "Collection deleted"})
+}
+
+// PreprocessPreviewRequest selects the text and rules for a dry run
+type PreprocessPreviewRequest struct {
+	DocumentName string           `json:"documentName,omitempty"`
+	Text         string           `json:"text,omitempty"`
+	Rules        []PreprocessRule `json:"rules,omitempty"` // Defaults to the collection's rules
+}
+
+// handlePreprocessPreview shows the effect of preprocessing rules without storing anything
+func handlePreprocessPreview(w http.ResponseWriter, r *http.Request, name string) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+
+	var req PreprocessPreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	rules := collectionRules(name)
+	if req.Rules != nil {
+		compiled, err := compileRules(req.Rules)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		rules = compiled
+	}
+
+	text := req.Text
+	if req.DocumentName != "" {
+		if _, ok := getDocumentOrError(w, req.DocumentName); !ok {
+			return
+		}
+		// Re-extract so the preview starts from the raw, unprocessed text
+		filePath, release, err := openStoredFile(filepath.Join("./documents", req.DocumentName))
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "Failed to read document file")
+			return
+		}
+		extracted, err := extractText(filePath)
+		release()
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "Failed to extract text")
+			return
+		}
+		text = extracted.Text
+	}
+
+	processed, results := applyPreprocessRules(text, rules)
+
+	const previewLength = 5000
+	truncate := func(s string) string {
+		if len(s) <= previewLength {
+			return s
+		}
+		n := previewLength
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		return s[:n]
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"originalLength":  len(text),
+		"processedLength": len(processed),
+		"rules":           results,
+		"original":        truncate(text),
+		"processed":       truncate(processed),
+	})
+}
+
+// RechunkResult reports the outcome of re-processing one member document
+type RechunkResult struct {
+	Document   string `json:"document"`
+	ChunkCount int    `json:"chunkCount,omitempty"`
+	Skipped    bool   `json:"skipped,omitempty"` // Already matches the collection's settings
+	Error      string `json:"error,omitempty"`
+}
+
+// handleRechunkCollection re-processes member documents with the collection's current
+// chunking and embedding settings. Documents already up to date are skipped unless ?force=true.
+func handleRechunkCollection(w http.ResponseWriter, r *http.Request, name string) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+
+	if _, exists := collectionStore.Get(name); !exists {
+		sendError(w, http.StatusNotFound, "Collection not found")
+		return
+	}
+	force := r.URL.Query().Get("force") == "true"
+	target := applyCollectionSettings(IngestOptions{Collection: name})
+
+	docs := documentStore.ByCollection(name)
+	results := make([]RechunkResult, 0, len(docs))
+	classify := false // Re-chunking keeps each document's label and preset
+	for _, doc := range docs {
+		doc.mu.RLock()
+		currentModel := doc.EmbeddingModel
+		hasSummary, summary := doc.HasSummary, doc.Summary
+		doc.mu.RUnlock()
+
+		embeddingModel := currentModel
+		if target.EmbeddingModel != "" {
+			embeddingModel = target.EmbeddingModel
+		}
+		if !force && doc.Chunking == target.Chunking && currentModel == embeddingModel {
+			results = append(results, RechunkResult{Document: doc.Name, ChunkCount: doc.ChunkCount, Skipped: true})
+			continue
+		}
+
+		var updated *Document
+		err := withDocumentLease(doc.Name, func() error {
+			filePath, release, err := openStoredFile(filepath.Join("./documents", doc.Name))
+			if err != nil {
+				return err
+			}
+			defer release()
+			updated, _, err = ingestFile(filePath, IngestOptions{
+				Name:           doc.Name,
+				Collection:     name,
+				Metadata:       doc.Metadata,
+				Instructions:   doc.Instructions,
+				EmbeddingModel: embeddingModel,
+				FullReprocess:  true,
+				RecordMapping:  doc.RecordMapping,
+				Preset:         doc.Preset,
+				Classify:       &classify,
+			})
+			// Summaries describe the whole text, so they survive re-chunking
+			if err == nil && hasSummary {
+				updated.UpdateSummary(summary)
+			}
+			return err
+		})
+		if err != nil {
+			results = append(results, RechunkResult{Document: doc.Name, Error: err.Error()})
+			continue
+		}
+		invalidateGlossary(doc.Name, name)
+		results = append(results, RechunkResult{Document: doc.Name, ChunkCount: updated.ChunkCount})
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"collection": name,
+		"chunking":   target.Chunking,
+		"results":    results,
+	})
+}
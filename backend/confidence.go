@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Confidence levels
+const (
+	ConfidenceHigh   = "high"
+	ConfidenceMedium = "medium"
+	ConfidenceLow    = "low"
+)
+
+// Scores from this level up are reported as high confidence
+const highConfidence = 0.75
+
+// Cosine similarities mapped onto 0 and 1 for the similarity signal; embedding
+// models rarely score unrelated text below the first or paraphrases above the second
+const (
+	similarityFloor   = 0.3
+	similarityCeiling = 0.8
+)
+
+// ConfidenceConfig controls how answer confidence is scored
+type ConfidenceConfig struct {
+	SelfAssess      bool    `json:"selfAssess"`      // Ask the model to rate each answer against its sources
+	ReviewThreshold float64 `json:"reviewThreshold"` // Answers scoring below this need review
+}
+
+func (c ConfidenceConfig) validate() error {
+	if c.ReviewThreshold < 0 || c.ReviewThreshold > 1 {
+		return fmt.Errorf("confidence.reviewThreshold must be between 0 and 1")
+	}
+	return nil
+}
+
+// AnswerConfidence tells how far an answer can be trusted. Score is between 0
+// and 1 and combines the retrieval signals with the self-assessment, when run.
+type AnswerConfidence struct {
+	Score          float64  `json:"score"`
+	Level          string   `json:"level"` // high, medium or low
+	NeedsReview    bool     `json:"needsReview"`
+	Coverage       float64  `json:"coverage"`                 // Share of the question's terms found in the sources
+	Similarity     *float64 `json:"similarity,omitempty"`     // Best source's embedding similarity, scaled to 0-1
+	Separation     *float64 `json:"separation,omitempty"`     // How far the sources stand out from the other chunks
+	SelfAssessment *float64 `json:"selfAssessment,omitempty"` // The model's own 0-1 rating of how well the sources support the answer
+	NoMatch        bool     `json:"noMatch,omitempty"`        // No chunk matched; the context came from the retrieval fallback
+	Hedged         bool     `json:"hedged,omitempty"`         // The answer says the sources do not cover the question
+}
+
+// hedgePhrases mark answers that say the context does not answer the question
+var hedgePhrases = []string{
+	"does not contain", "doesn't contain", "does not mention", "doesn't mention",
+	"not mentioned", "does not provide", "doesn't provide", "no information",
+	"not specified", "cannot find", "can't find", "unable to find", "i don't know",
+	"i do not know", "not enough information", "does not say", "doesn't say",
+}
+
+// questionWords are dropped with stopwords when measuring coverage
+var questionWords = wordSet("what which who whom whose when where why how many much does do did can could should would will please tell me about there any")
+
+// retrievalSignals holds what retrieval knew about the chunks it picked
+type retrievalSignals struct {
+	scores  []float64 // Embedding scores of all allowed chunks, best first; nil for keyword retrieval
+	noMatch bool
+}
+
+// queryCoverage returns the share of the query's content terms (or their synonyms)
+// found in the retrieved chunks
+func queryCoverage(query string, chunks []string, synonyms *thesaurus) float64 {
+	found := make(map[string]bool)
+	for _, chunk := range chunks {
+		for _, w := range tokenize(chunk) {
+			found[w] = true
+		}
+	}
+
+	var total, matched float64
+	for _, term := range synonyms.expandQuery(strings.Join(tokenize(query), " ")) {
+		if words := term.alternatives[0]; len(words) == 1 && (questionWords[words[0]] || isStopword(words[0])) {
+			continue
+		}
+		total += term.weight
+		for _, words := range term.alternatives {
+			all := true
+			for _, w := range words {
+				all = all && found[w]
+			}
+			if all {
+				matched += term.weight
+				break
+			}
+		}
+	}
+	if total == 0 {
+		return 1
+	}
+	return matched / total
+}
+
+func isStopword(w string) bool {
+	for _, words := range stopwords {
+		if words[w] {
+			return true
+		}
+	}
+	return false
+}
+
+func clamp01(x float64) float64 {
+	return math.Max(0, math.Min(1, x))
+}
+
+// scoreConfidence rates an answer from its retrieval signals and, when enabled,
+// the model's assessment of it
+func scoreConfidence(ctx context.Context, req QueryRequest, collection string, sources []string, response string, signals retrievalSignals) *AnswerConfidence {
+	var synonyms *thesaurus
+	if c, exists := collectionStore.Get(collection); exists {
+		synonyms = c.thesaurus
+	}
+	conf := &AnswerConfidence{NoMatch: signals.noMatch}
+	if !signals.noMatch {
+		conf.Coverage = queryCoverage(req.Query, sources, synonyms)
+	}
+	retrieval := conf.Coverage
+
+	// With embeddings, the best similarity and how far the picked chunks stand out
+	// from the rest are blended with the term coverage
+	if len(signals.scores) > 0 {
+		similarity := clamp01((signals.scores[0] - similarityFloor) / (similarityCeiling - similarityFloor))
+		conf.Similarity = &similarity
+		if len(signals.scores) > len(sources) {
+			var picked, rest float64
+			for i, s := range signals.scores {
+				if i < len(sources) {
+					picked += s / float64(len(sources))
+				} else {
+					rest += s / float64(len(signals.scores)-len(sources))
+				}
+			}
+			separation := clamp01((picked - rest) / 0.2)
+			conf.Separation = &separation
+			retrieval = 0.4*conf.Coverage + 0.4*similarity + 0.2*separation
+		} else {
+			retrieval = 0.5*conf.Coverage + 0.5*similarity
+		}
+	}
+	conf.Score = retrieval
+
+	cfg := getConfig().Confidence
+	if (cfg.SelfAssess || req.SelfAssess) && !signals.noMatch {
+		if rating, ok := selfAssess(ctx, req, sources, response); ok {
+			conf.SelfAssessment = &rating
+			conf.Score = (retrieval + rating) / 2
+		}
+	}
+
+	lower := strings.ToLower(response)
+	for _, phrase := range hedgePhrases {
+		if strings.Contains(lower, phrase) {
+			conf.Hedged = true
+			conf.Score = math.Min(conf.Score, 0.25)
+			break
+		}
+	}
+	if signals.noMatch {
+		conf.Score = math.Min(conf.Score, 0.1)
+	}
+
+	conf.Score = math.Round(conf.Score*100) / 100
+	switch {
+	case conf.Score >= highConfidence:
+		conf.Level = ConfidenceHigh
+	case conf.Score >= cfg.ReviewThreshold:
+		conf.Level = ConfidenceMedium
+	default:
+		conf.Level = ConfidenceLow
+	}
+	conf.NeedsReview = conf.Score < cfg.ReviewThreshold
+	return conf
+}
+
+var ratingPattern = regexp.MustCompile(`\d+(?:\.\d+)?`)
+
+// selfAssess asks the model to rate from 0 to 10 how well the sources support
+// the answer, and returns the rating scaled to 0-1
+func selfAssess(ctx context.Context, req QueryRequest, sources []string, response string) (float64, bool) {
+	prompt := fmt.Sprintf(`You check answers written from document excerpts. Rate from 0 to 10 how fully the excerpts support the answer to the question: 10 if every claim in the answer is stated in the excerpts, 0 if the excerpts do not address the question or contradict the answer. Reply with the number only.
+
+Excerpts:
+%s
+
+Question: %s
+
+Answer: %s
+
+Rating:`, strings.Join(sources, "\n\n"), req.Query, strings.TrimSpace(response))
+
+	rating, _, err := cachedAnswer(ctx, prompt, modelOrDefault(req.ModelName))
+	if err != nil {
+		return 0, false
+	}
+	match := ratingPattern.FindString(rating)
+	if match == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(match, 64)
+	if err != nil {
+		return 0, false
+	}
+	return clamp01(n / 10), true
+}
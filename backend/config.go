@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Config holds the tunables that can change while the server runs. Values start
+// from the environment and are overridden by the JSON file named by CONFIG_FILE,
+// which is re-read on POST /api/admin/config/reload or SIGHUP. Keys missing from
+// the file keep their environment values.
+type Config struct {
+	MaxConcurrentOllama  int                     `json:"maxConcurrentOllama"`
+	RequestTimeout       duration                `json:"requestTimeout"`      // Bounds each Ollama call, or the wait for each piece of a streamed answer
+	ChunkSize            int                     `json:"chunkSize"`           // Characters per chunk of uploads that set no chunkSize
+	InteractiveReserved  int                     `json:"interactiveReserved"` // Ollama slots background work may not use
+	DefaultModel         string                  `json:"defaultModel"`        // Used when a request names no model
+	EmbeddingModel       string                  `json:"embeddingModel"`      // Embeds documents uploaded without one, for vector retrieval
+	CORSOrigins          []string                `json:"corsOrigins"`         // "*" allows any origin
+	RateLimitPerMinute   int64                   `json:"rateLimitPerMinute"`  // 0 disables limiting
+	RateLimitTrustProxy  bool                    `json:"rateLimitTrustProxy"`
+	QueryCacheTTL        duration                `json:"queryCacheTTL"`        // 0 disables the query cache
+	SemanticCache        SemanticCacheConfig     `json:"semanticCache"`        // Reuse answers to similar questions
+	ContextDedup         ContextDedupConfig      `json:"contextDedup"`         // Remove repeated text from query context
+	RetrievalFallback    string                  `json:"retrievalFallback"`    // Context of queries no chunk matches: first, vector, summary or none
+	ImportanceWeight     float64                 `json:"importanceWeight"`     // How far the static chunk prior moves relevance, 0-1; 0 ignores it
+	SummaryContext       string                  `json:"summaryContext"`       // How the document summary reaches query context: retrieve, always or never
+	QueryRouting         bool                    `json:"queryRouting"`         // Classify questions to pick the pipeline answering them
+	ChatReuseRetrieval   bool                    `json:"chatReuseRetrieval"`   // Answer chat follow-ups from the previous turn's sources
+	ChatRewriteFollowUps bool                    `json:"chatRewriteFollowUps"` // Have the model restate chat follow-ups on their own before retrieval
+	AnswerTTL            duration                `json:"answerTTL"`            // How long answers can be refined; 0 disables refining
+	TrashRetention       duration                `json:"trashRetention"`       // How long deleted documents can be restored; 0 deletes at once
+	RequireIfMatch       bool                    `json:"requireIfMatch"`       // Refuse document changes without an If-Match header; opt-in, as the bundled frontend sends none
+	OllamaRetries        int                     `json:"ollamaRetries"`
+	OllamaRetryBackoff   duration                `json:"ollamaRetryBackoff"`
+	Deterministic        bool                    `json:"deterministic"` // Greedy sampling with Seed for every request
+	LogPrompts           bool                    `json:"logPrompts"`    // Log prompts, replies and hook output, which hold document text
+	Seed                 int64                   `json:"seed"`
+	Provider             string                  `json:"provider"`            // ollama, openai, mock to run without a model, or a name from providers
+	OpenAI               OpenAIServer            `json:"openai"`              // The openai provider
+	Providers            map[string]OpenAIServer `json:"providers,omitempty"` // More OpenAI-compatible servers by name, for models named name:model
+	FieldBoosts          FieldBoosts             `json:"fieldBoosts"`         // Weight of query words matched in headings and titles
+	SpellCorrection      string                  `json:"spellCorrection"`     // Default spelling mode of queries: off, suggest or auto
+	ChatSessionTTL       duration                `json:"chatSessionTTL"`      // Chat sessions expire this long after their last turn; 0 keeps them
+	ChatHistoryTurns     int                     `json:"chatHistoryTurns"`    // Latest session turns given to the model verbatim; older ones are summarized
+	Confidence           ConfidenceConfig        `json:"confidence"`
+	Classification       ClassificationConfig    `json:"classification"`
+	Routing              RoutingConfig           `json:"routing"`
+	Ollama               OllamaPoolConfig        `json:"ollama"`
+	Concurrency          ConcurrencyConfig       `json:"concurrency"`       // Ollama slots per model or kind of call
+	ContextWindow        ContextWindowConfig     `json:"contextWindow"`     // Context window of each model, which query prompts must fit
+	Tenants              TenantConfig            `json:"tenants,omitempty"` // Default model, allowed models and daily quotas per tenant
+	Mock                 MockConfig              `json:"mock"`
+}
+
+// duration is a time.Duration written as a string such as "10m" in JSON
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"10m\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+var currentConfig atomic.Pointer[Config]
+
+func init() {
+	c := configFromEnv()
+	currentConfig.Store(&c)
+	applyConcurrency(&c)
+	ollamaEndpoints.setURLs(c.Ollama.URLs)
+}
+
+// getConfig returns the configuration in effect; callers must not modify it
+func getConfig() *Config {
+	return currentConfig.Load()
+}
+
+// requestTimeout bounds a call to Ollama or another external service
+func requestTimeout() time.Duration {
+	return time.Duration(getConfig().RequestTimeout)
+}
+
+func envInt(key string, fallback int64) int64 {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		log.Printf("Invalid %s %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+func envDuration(key string, fallback time.Duration) duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return duration(fallback)
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Printf("Invalid %s %q, using %v", key, value, fallback)
+		return duration(fallback)
+	}
+	return duration(d)
+}
+
+func envFloat(key string, fallback float64) float64 {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		log.Printf("Invalid %s %q, using %v", key, value, fallback)
+		return fallback
+	}
+	return f
+}
+
+func configFromEnv() Config {
+	var origins []string
+	for _, origin := range strings.Split(getEnv("CORS_ORIGINS", "*"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return Config{
+		MaxConcurrentOllama: int(envInt("OLLAMA_MAX_CONCURRENT", MaxConcurrentOllama)),
+		InteractiveReserved: int(envInt("OLLAMA_INTERACTIVE_RESERVED", 1)),
+		RequestTimeout:      envDuration("OLLAMA_REQUEST_TIMEOUT", DefaultRequestTimeout),
+		ChunkSize:           int(envInt("CHUNK_SIZE", DefaultChunkSize)),
+		DefaultModel:        getEnv("DEFAULT_MODEL", ""),
+		EmbeddingModel:      getEnv("EMBEDDING_MODEL", ""),
+		CORSOrigins:         origins,
+		RateLimitPerMinute:  envInt("RATE_LIMIT_PER_MINUTE", 0),
+		RateLimitTrustProxy: getEnv("RATE_LIMIT_TRUST_PROXY", "") == "true",
+		QueryCacheTTL:       envDuration("QUERY_CACHE_TTL", 10*time.Minute),
+		SemanticCache: SemanticCacheConfig{
+			Threshold:  envFloat("SEMANTIC_CACHE_THRESHOLD", 0),
+			MaxEntries: int(envInt("SEMANTIC_CACHE_ENTRIES", 100)),
+		},
+		AnswerTTL:          envDuration("ANSWER_TTL", time.Hour),
+		TrashRetention:     envDuration("TRASH_RETENTION", 7*24*time.Hour),
+		RequireIfMatch:     getEnv("REQUIRE_IF_MATCH", "") == "true",
+		OllamaRetries:      int(envInt("OLLAMA_RETRIES", 2)),
+		OllamaRetryBackoff: envDuration("OLLAMA_RETRY_BACKOFF", time.Second),
+		Deterministic:      getEnv("DETERMINISTIC", "") == "true",
+		LogPrompts:         getEnv("LOG_PROMPTS", "") == "true",
+		Seed:               envInt("DETERMINISTIC_SEED", 0),
+		Provider:           getEnv("LLM_PROVIDER", ProviderOllama),
+		OpenAI: OpenAIServer{
+			URL:       getEnv("OPENAI_BASE_URL", "https://api.openai.com/v1"),
+			APIKeyEnv: "OPENAI_API_KEY",
+		},
+		SpellCorrection:      getEnv("SPELL_CORRECTION", SpellingSuggest),
+		ChatSessionTTL:       envDuration("CHAT_SESSION_TTL", 30*24*time.Hour),
+		ChatHistoryTurns:     int(envInt("CHAT_HISTORY_TURNS", 4)),
+		RetrievalFallback:    getEnv("RETRIEVAL_FALLBACK", FallbackFirst),
+		ImportanceWeight:     envFloat("CHUNK_IMPORTANCE_WEIGHT", 0.3),
+		SummaryContext:       getEnv("SUMMARY_CONTEXT", SummaryRetrieve),
+		QueryRouting:         getEnv("QUERY_ROUTING", "true") == "true",
+		ChatReuseRetrieval:   getEnv("CHAT_REUSE_RETRIEVAL", "true") == "true",
+		ChatRewriteFollowUps: getEnv("CHAT_REWRITE_FOLLOWUPS", "true") == "true",
+		ContextDedup: ContextDedupConfig{
+			Sentences:      getEnv("CONTEXT_DEDUP", "true") == "true",
+			SummaryOverlap: envFloat("SUMMARY_OVERLAP", 0.8),
+		},
+		FieldBoosts: FieldBoosts{
+			Heading: envFloat("FIELD_BOOST_HEADING", 1),
+			Title:   envFloat("FIELD_BOOST_TITLE", 0.5),
+		},
+		Confidence: ConfidenceConfig{
+			SelfAssess:      getEnv("CONFIDENCE_SELF_ASSESS", "") == "true",
+			ReviewThreshold: envFloat("CONFIDENCE_REVIEW_THRESHOLD", 0.5),
+		},
+		Classification: ClassificationConfig{
+			Enabled:  getEnv("CLASSIFY_UPLOADS", "") == "true",
+			Method:   getEnv("CLASSIFY_METHOD", ClassifyKeywords),
+			Model:    getEnv("CLASSIFY_MODEL", ""),
+			MinScore: 2,
+			Labels:   append([]ClassLabel(nil), defaultTaxonomy...),
+		},
+		Ollama: OllamaPoolConfig{
+			URLs:           parseOllamaURLs(getEnv("OLLAMA_URLS", DefaultOllamaURL)),
+			Balancing:      getEnv("OLLAMA_BALANCING", BalanceLeastLoaded),
+			HealthInterval: envDuration("OLLAMA_HEALTH_INTERVAL", 10*time.Second),
+			SwapDelay:      envDuration("OLLAMA_SWAP_DELAY", 5*time.Second),
+		},
+		Concurrency: concurrencyFromEnv(),
+		ContextWindow: ContextWindowConfig{
+			Default:  int(envInt("CONTEXT_WINDOW", 0)),
+			Reserve:  int(envInt("CONTEXT_RESERVE", 512)),
+			Overflow: getEnv("CONTEXT_OVERFLOW", OverflowTrim),
+		},
+		Mock: MockConfig{
+			Latency:     envDuration("MOCK_LATENCY", 0),
+			FailureRate: envFloat("MOCK_FAILURE_RATE", 0),
+		},
+	}
+}
+
+// concurrencyFromEnv gives embeddings their own slots when OLLAMA_EMBED_MAX_CONCURRENT
+// is set; finer budgets are set in CONFIG_FILE
+func concurrencyFromEnv() ConcurrencyConfig {
+	var c ConcurrencyConfig
+	if n := envInt("OLLAMA_EMBED_MAX_CONCURRENT", 0); n > 0 {
+		c.Budgets = append(c.Budgets, ConcurrencyBudget{Operation: OperationEmbed, MaxConcurrent: int(n)})
+	}
+	return c
+}
+
+func (c Config) validate() error {
+	switch {
+	case c.MaxConcurrentOllama < 1:
+		return errors.New("maxConcurrentOllama must be at least 1")
+	case c.InteractiveReserved < 0:
+		return errors.New("interactiveReserved cannot be negative")
+	case c.RequestTimeout <= 0:
+		return errors.New("requestTimeout must be positive")
+	case c.ChunkSize < 1:
+		return errors.New("chunkSize must be at least 1")
+	case c.RateLimitPerMinute < 0:
+		return errors.New("rateLimitPerMinute cannot be negative")
+	case c.QueryCacheTTL < 0:
+		return errors.New("queryCacheTTL cannot be negative")
+	case c.AnswerTTL < 0:
+		return errors.New("answerTTL cannot be negative")
+	case c.TrashRetention < 0:
+		return errors.New("trashRetention cannot be negative")
+	case c.ChatSessionTTL < 0:
+		return errors.New("chatSessionTTL cannot be negative")
+	case c.ChatHistoryTurns < 0:
+		return errors.New("chatHistoryTurns cannot be negative")
+	case c.OllamaRetries < 0:
+		return errors.New("ollamaRetries cannot be negative")
+	case c.OllamaRetryBackoff <= 0:
+		return errors.New("ollamaRetryBackoff must be positive")
+	case c.ImportanceWeight < 0 || c.ImportanceWeight > 1:
+		return errors.New("importanceWeight must be between 0 and 1")
+	case c.RetrievalFallback == "" || !validFallback(c.RetrievalFallback):
+		return fmt.Errorf("unknown retrievalFallback %q (use first, vector, summary or none)", c.RetrievalFallback)
+	case !validSummaryContext(c.SummaryContext):
+		return fmt.Errorf("unknown summaryContext %q (use retrieve, always or never)", c.SummaryContext)
+	case !validSpellingMode(c.SpellCorrection):
+		return fmt.Errorf("unknown spellCorrection %q (use off, suggest or auto)", c.SpellCorrection)
+	}
+	if err := validateProviders(c); err != nil {
+		return err
+	}
+	if err := c.ContextDedup.validate(); err != nil {
+		return err
+	}
+	if err := c.SemanticCache.validate(); err != nil {
+		return err
+	}
+	if err := c.FieldBoosts.validate(); err != nil {
+		return err
+	}
+	if err := c.Confidence.validate(); err != nil {
+		return err
+	}
+	if err := c.Classification.validate(); err != nil {
+		return err
+	}
+	if err := c.Routing.validate(); err != nil {
+		return err
+	}
+	if err := c.Ollama.validate(); err != nil {
+		return err
+	}
+	if err := c.Concurrency.validate(); err != nil {
+		return err
+	}
+	if err := c.Tenants.validate(); err != nil {
+		return err
+	}
+	if err := c.ContextWindow.validate(); err != nil {
+		return err
+	}
+	return c.Mock.validate()
+}
+
+// readConfig builds the configuration from the environment and CONFIG_FILE
+func readConfig() (Config, error) {
+	c := configFromEnv()
+	if path := getEnv("CONFIG_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return c, fmt.Errorf("failed to read config file: %w", err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&c); err != nil {
+			return c, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+	return c, c.validate()
+}
+
+// reloadConfig re-reads the configuration and applies it, returning the names of
+// the settings that changed. On error the running configuration is kept.
+func reloadConfig() ([]string, error) {
+	next, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	changed := configChanges(*getConfig(), next)
+	currentConfig.Store(&next)
+	applyConcurrency(&next)
+	ollamaEndpoints.setURLs(next.Ollama.URLs)
+	return changed, nil
+}
+
+// configChanges lists the JSON names of settings that differ
+func configChanges(before, after Config) []string {
+	var changed []string
+	b, a := reflect.ValueOf(before), reflect.ValueOf(after)
+	for i := 0; i < b.NumField(); i++ {
+		if !reflect.DeepEqual(b.Field(i).Interface(), a.Field(i).Interface()) {
+			changed = append(changed, strings.Split(b.Type().Field(i).Tag.Get("json"), ",")[0])
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// watchConfigSignals reloads the configuration on SIGHUP
+func watchConfigSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		changed, err := reloadConfig()
+		if err != nil {
+			log.Printf("Configuration reload failed, keeping current settings: %v", err)
+			continue
+		}
+		log.Printf("Configuration reloaded on SIGHUP (changed: %s)", strings.Join(changed, ", "))
+	}
+}
+
+// modelOrDefault returns the requested model, or the configured default model
+func modelOrDefault(model string) string {
+	if model != "" {
+		return model
+	}
+	return getConfig().DefaultModel
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for a request's
+// origin, or "" when the origin is not allowed
+func allowedOrigin(origin string) string {
+	for _, allowed := range getConfig().CORSOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// adminTokenHeader carries ADMIN_TOKEN on routes where Authorization holds the
+// credentials AUTH_MODE asks for
+const adminTokenHeader = "X-Admin-Token"
+
+// requireAdmin allows admin requests carrying ADMIN_TOKEN in X-Admin-Token or as
+// a bearer token, or from loopback when no token is configured, and reports
+// whether it did
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if token := getEnv("ADMIN_TOKEN", ""); token != "" {
+		credential := r.Header.Get("Authorization")
+		if given := r.Header.Get(adminTokenHeader); given != "" {
+			credential = "Bearer " + given
+		}
+		if subtle.ConstantTimeCompare([]byte(credential), []byte("Bearer "+token)) != 1 {
+			sendError(w, http.StatusUnauthorized, "Admin token required")
+			return false
+		}
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		sendError(w, http.StatusForbidden, "Admin endpoints are only available from localhost unless ADMIN_TOKEN is set")
+		return false
+	}
+	return true
+}
+
+// adminOnly serves a route only to requests requireAdmin allows
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requireAdmin(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+// adminConfigHandler returns the configuration in effect (GET /api/admin/config)
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "GET") || !requireAdmin(w, r) {
+		return
+	}
+	sendJSON(w, http.StatusOK, getConfig())
+}
+
+// adminReloadConfigHandler re-reads the configuration (POST /api/admin/config/reload)
+func adminReloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "POST") || !requireAdmin(w, r) {
+		return
+	}
+	changed, err := reloadConfig()
+	if err != nil {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("Configuration not reloaded: %v", err))
+		return
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	log.Printf("Configuration reloaded (changed: %s)", strings.Join(changed, ", "))
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Configuration reloaded",
+		"changed": changed,
+		"config":  getConfig(),
+	})
+}
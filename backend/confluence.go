@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type confluenceClient struct {
+	baseURL string
+	email   string
+	token   string
+}
+
+type confluencePage struct {
+	ID      string `json:"id"`
+	Title   string `json:"title"`
+	Version struct {
+		Number int `json:"number"`
+	} `json:"version"`
+	Ancestors []struct {
+		Title string `json:"title"`
+	} `json:"ancestors"`
+	Body struct {
+		Storage struct {
+			Value string `json:"value"`
+		} `json:"storage"`
+	} `json:"body"`
+	Links struct {
+		WebUI string `json:"webui"`
+	} `json:"_links"`
+}
+
+// get calls the Confluence REST API, using basic auth when an account email is
+// configured (Cloud) and a bearer personal access token otherwise (Server/Data Center)
+func (c *confluenceClient) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/rest/api"+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if c.email != "" {
+		req.SetBasicAuth(c.email, c.token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := sourceHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("confluence request failed: %w", err)
+	}
+	defer closeFile(resp.Body, "confluence response body")
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("confluence error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// spacePages lists every page in a space with its version and ancestors, without bodies
+func (c *confluenceClient) spacePages(ctx context.Context, space string) ([]confluencePage, error) {
+	const limit = 100
+	var pages []confluencePage
+	for start := 0; ; start += limit {
+		query := url.Values{
+			"spaceKey": {space},
+			"type":     {"page"},
+			"expand":   {"version,ancestors"},
+			"start":    {strconv.Itoa(start)},
+			"limit":    {strconv.Itoa(limit)},
+		}
+		var result struct {
+			Results []confluencePage `json:"results"`
+			Size    int              `json:"size"`
+		}
+		if err := c.get(ctx, "/content", query, &result); err != nil {
+			return nil, err
+		}
+		pages = append(pages, result.Results...)
+		if result.Size < limit {
+			return pages, nil
+		}
+	}
+}
+
+var (
+	confluenceCodeMacro = regexp.MustCompile(`(?s)<ac:structured-macro[^>]*ac:name="code"[^>]*>.*?<ac:plain-text-body><!\[CDATA\[(.*?)\]\]></ac:plain-text-body>.*?</ac:structured-macro>`)
+	confluenceLinkTitle = regexp.MustCompile(`(?s)<ac:link[^>]*>.*?ri:content-title="([^"]*)".*?</ac:link>`)
+)
+
+// confluenceToMarkdown converts Confluence storage format (XHTML with ac: macros) to Markdown
+func confluenceToMarkdown(storage string) string {
+	storage = confluenceCodeMacro.ReplaceAllStringFunc(storage, func(macro string) string {
+		code := confluenceCodeMacro.FindStringSubmatch(macro)[1]
+		return "<pre>" + strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(code) + "</pre>"
+	})
+	storage = confluenceLinkTitle.ReplaceAllString(storage, "$1")
+	return htmlToMarkdown(storage)
+}
+
+// confluenceEnvSite reports whether CONFLUENCE_TOKEN may be used for a site: only
+// the site CONFLUENCE_URL names gets it, so a source cannot send it elsewhere
+func confluenceEnvSite(siteURL string) bool {
+	configured := os.Getenv("CONFLUENCE_URL")
+	if configured == "" || os.Getenv("CONFLUENCE_TOKEN") == "" {
+		return false
+	}
+	a, errA := url.Parse(siteURL)
+	b, errB := url.Parse(configured)
+	return errA == nil && errB == nil && a.Scheme == b.Scheme && strings.EqualFold(a.Host, b.Host) &&
+		strings.TrimSuffix(a.Path, "/") == strings.TrimSuffix(b.Path, "/") && a.User == nil
+}
+
+// syncConfluenceSource imports the pages of a space, fetching bodies only for
+// pages whose version changed, with the ancestor titles as hierarchy metadata
+func syncConfluenceSource(ctx context.Context, src Source, items map[string]*SourceItem) (int, int, error) {
+	token, email := src.Token, src.Email
+	if token == "" {
+		if !confluenceEnvSite(src.URL) {
+			return 0, 0, errors.New("the source has no token and its url is not CONFLUENCE_URL")
+		}
+		token = os.Getenv("CONFLUENCE_TOKEN")
+		if email == "" {
+			email = os.Getenv("CONFLUENCE_EMAIL")
+		}
+	}
+	client := &confluenceClient{baseURL: strings.TrimSuffix(src.URL, "/"), email: email, token: token}
+
+	pages, err := client.spacePages(ctx, src.Space)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var changed, unchanged int
+	var failed []string
+	for _, page := range pages {
+		version := "v" + strconv.Itoa(page.Version.Number)
+		if pageUnchanged(items, page.ID, version) {
+			unchanged++
+			continue
+		}
+
+		var full confluencePage
+		if err := client.get(ctx, "/content/"+page.ID, url.Values{"expand": {"body.storage"}}, &full); err != nil {
+			recordItemError(trackItem(items, page.ID, itemDocumentName(src, page.Title, page.ID, ".md")), err)
+			failed = append(failed, page.Title)
+			continue
+		}
+
+		path := make([]string, 0, len(page.Ancestors)+1)
+		for _, a := range page.Ancestors {
+			path = append(path, a.Title)
+		}
+		path = append(path, page.Title)
+
+		ok, err := ingestPage(src, items, page.ID, page.Title, path, client.baseURL+page.Links.WebUI,
+			confluenceToMarkdown(full.Body.Storage.Value), version)
+		switch {
+		case err != nil:
+			failed = append(failed, page.Title)
+		case ok:
+			changed++
+		default:
+			unchanged++
+		}
+	}
+
+	if len(failed) > 0 {
+		return changed, unchanged, fmt.Errorf("failed to ingest %s", strings.Join(failed, ", "))
+	}
+	return changed, unchanged, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+)
+
+// How a query whose prompt does not fit the model's context window is handled
+const (
+	OverflowTrim   = "trim"   // Leave out the lowest-ranked chunks until it fits
+	OverflowReject = "reject" // Refuse the query with a 413
+)
+
+// ContextWindowConfig keeps query prompts within the models' context windows, so
+// the model is never handed a prompt it would cut short itself
+type ContextWindowConfig struct {
+	Default  int                  `json:"default"`  // Tokens of models no entry matches; 0 leaves their prompts unchecked
+	Models   []ModelContextWindow `json:"models"`   // The first entry matching the model wins
+	Reserve  int                  `json:"reserve"`  // Tokens kept free for the answer unless maxAnswerTokens sets them
+	Overflow string               `json:"overflow"` // trim or reject; queries may choose with contextOverflow
+}
+
+// ModelContextWindow is the context window of the models matching a glob
+type ModelContextWindow struct {
+	Model  string `json:"model"` // e.g. "llama3*"
+	Tokens int    `json:"tokens"`
+}
+
+// ContextTrim is the warning of a query answered without some of its chunks, left
+// out so that the prompt fits the model's context window
+type ContextTrim struct {
+	Window        int            `json:"window"`       // Tokens, including those kept for the answer
+	PromptTokens  int            `json:"promptTokens"` // Estimated size of the prompt sent
+	DroppedChunks []DroppedChunk `json:"droppedChunks"`
+}
+
+// DroppedChunk is a retrieved chunk that was left out of the prompt
+type DroppedChunk struct {
+	Document string  `json:"document"`
+	Chunk    int     `json:"chunk"`             // Position in the document
+	ChunkID  int     `json:"chunkId,omitempty"` // Stable ID, see chunkIds
+	Page     int     `json:"page,omitempty"`
+	Score    float64 `json:"score,omitempty"`
+	Tokens   int     `json:"tokens"` // Estimated
+}
+
+func validContextOverflow(mode string) bool {
+	return mode == "" || mode == OverflowTrim || mode == OverflowReject
+}
+
+func (c ContextWindowConfig) validate() error {
+	switch {
+	case c.Default < 0 || c.Reserve < 0:
+		return errors.New("contextWindow default and reserve cannot be negative")
+	case c.Overflow == "" || !validContextOverflow(c.Overflow):
+		return fmt.Errorf("unknown contextWindow.overflow %q (use trim or reject)", c.Overflow)
+	}
+	for i, m := range c.Models {
+		if _, err := path.Match(m.Model, ""); err != nil || m.Model == "" {
+			return fmt.Errorf("context window %d: invalid model pattern %q", i+1, m.Model)
+		}
+		if m.Tokens < 1 {
+			return fmt.Errorf("context window %d: tokens must be at least 1", i+1)
+		}
+	}
+	return nil
+}
+
+// window returns the context window of a model in tokens, 0 when unknown
+func (c ContextWindowConfig) window(model string) int {
+	for _, m := range c.Models {
+		if matched, _ := path.Match(m.Model, model); matched {
+			return m.Tokens
+		}
+	}
+	return c.Default
+}
+
+// estimateTokens counts four characters per token, like meterTokens
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// fitContextWindow finds how many of a prompt's sources, taken in order, fit the
+// model's context window along with the answer. build returns the prompt holding
+// the first n sources, and its last call is for the count returned, along with
+// the estimated size of that prompt. When the sources do not all fit in reject
+// mode, or not even the first fits, the query is refused with a 413.
+func fitContextWindow(ctx context.Context, model, overflow string, sources int, build func(n int) string) (int, int, error) {
+	config := getConfig().ContextWindow
+	window := config.window(model)
+	prompt := build(sources)
+	if window == 0 {
+		return sources, estimateTokens(prompt), nil
+	}
+	if overflow == "" {
+		overflow = config.Overflow
+	}
+	reserve := config.Reserve
+	if limit := answerTokenLimit(ctx); limit > 0 {
+		reserve = limit
+	}
+
+	tokens := estimateTokens(prompt)
+	needed := tokens
+	for n := sources; ; n-- {
+		if n < sources {
+			tokens = estimateTokens(build(n))
+		}
+		if tokens+reserve <= window {
+			return n, tokens, nil
+		}
+		if overflow == OverflowReject || n <= 1 {
+			break
+		}
+	}
+	message := fmt.Sprintf("The prompt needs about %d tokens, but %s's context window of %d has %d left once %d are kept for the answer", needed, model, window, max(window-reserve, 0), reserve)
+	if overflow != OverflowReject && sources > 1 {
+		message += "; leaving out chunks did not help"
+	}
+	return 0, 0, &apiError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Message: message,
+		Details: map[string]interface{}{"limit": "contextWindow", "max": window, "size": needed, "reserved": reserve},
+	}
+}
+
+// ollamaOptions adds the context window configured for a model to the generation
+// options, as Ollama otherwise uses its own default however long the prompt
+func ollamaOptions(ctx context.Context, model string) map[string]interface{} {
+	options := generationOptions(ctx)
+	if window := getConfig().ContextWindow.window(model); window > 0 {
+		if options == nil {
+			options = make(map[string]interface{})
+		}
+		options["num_ctx"] = window
+	}
+	return options
+}
+
+// droppedChunks describes the chunks of a document left out of a prompt, with
+// their retrieval scores when there are any
+func droppedChunks(doc *Document, chunks []string, indices []int, scores []float64) []DroppedChunk {
+	ids := sourceChunkIDs(doc, indices)
+	dropped := make([]DroppedChunk, len(indices))
+	for i, idx := range indices {
+		dropped[i] = DroppedChunk{Document: doc.Name, Chunk: idx, Tokens: estimateTokens(chunks[i])}
+		if ids != nil {
+			dropped[i].ChunkID = ids[i]
+		}
+		if len(doc.ChunkPages) > idx {
+			dropped[i].Page = doc.ChunkPages[idx]
+		}
+		if i < len(scores) {
+			dropped[i].Score = scores[i]
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const corpusRepairJobType = "corpus-repair"
+
+// Kinds of corpus issue
+const (
+	IssueOrphanedFile      = "orphaned-file"      // File in ./documents without a document
+	IssueMissingFile       = "missing-file"       // Document whose uploaded file is gone
+	IssueMissingEmbeddings = "missing-embeddings" // Chunks without embeddings although a model applies
+	IssueStaleIndex        = "stale-index"        // Chunk data out of step, or the file changed after indexing
+)
+
+// Issues logged one by one at startup; the rest are counted
+const maxLoggedIssues = 20
+
+// CorpusIssue is a mismatch between a document, its file and its embeddings
+type CorpusIssue struct {
+	Kind     string `json:"kind"`
+	Document string `json:"document"`
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired,omitempty"`
+	Error    string `json:"error,omitempty"` // Why it could not be repaired
+}
+
+// repairable tells whether the repair job can fix the issue; a missing file has
+// to be uploaded again
+func (i CorpusIssue) repairable() bool {
+	return i.Kind != IssueMissingFile
+}
+
+// CorpusReport is the outcome of reconciling the store with ./documents
+type CorpusReport struct {
+	CheckedAt time.Time      `json:"checkedAt"`
+	Documents int            `json:"documents"`
+	Files     int            `json:"files"`
+	Counts    map[string]int `json:"counts"` // Issues by kind
+	Issues    []CorpusIssue  `json:"issues"`
+	RepairJob string         `json:"repairJob,omitempty"` // Job repairing the issues, when asked for
+}
+
+// lastCorpusReport is the latest check, served by /api/admin/corpus
+var lastCorpusReport struct {
+	report *CorpusReport
+	mu     sync.Mutex
+}
+
+// storedFiles returns the modification time of each uploaded file, leaving out
+// the trash, page images and other hidden entries
+func storedFiles() (map[string]time.Time, error) {
+	entries, err := os.ReadDir("./documents")
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]time.Time, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // Removed since it was listed
+		}
+		files[entry.Name()] = info.ModTime()
+	}
+	return files, nil
+}
+
+// checkCorpus reconciles the documents with their files and embeddings
+func checkCorpus() (*CorpusReport, error) {
+	files, err := storedFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list documents directory: %w", err)
+	}
+	docs := documentStore.All()
+	report := &CorpusReport{CheckedAt: time.Now(), Documents: len(docs), Files: len(files), Counts: make(map[string]int), Issues: []CorpusIssue{}}
+
+	known := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		known[doc.Name] = true
+		modified, exists := files[doc.Name]
+		report.Issues = append(report.Issues, documentIssues(doc, modified, exists)...)
+	}
+	for name := range files {
+		if !known[name] {
+			report.Issues = append(report.Issues, CorpusIssue{Kind: IssueOrphanedFile, Document: name, Detail: "no document was indexed from this file"})
+		}
+	}
+	sort.Slice(report.Issues, func(i, j int) bool {
+		a, b := report.Issues[i], report.Issues[j]
+		if a.Document != b.Document {
+			return a.Document < b.Document
+		}
+		return a.Kind < b.Kind
+	})
+	for _, issue := range report.Issues {
+		report.Counts[issue.Kind]++
+	}
+	return report, nil
+}
+
+// documentIssues checks one document against its file, modified at the given
+// time when it exists
+func documentIssues(doc *Document, modified time.Time, exists bool) []CorpusIssue {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	var issues []CorpusIssue
+	add := func(kind, format string, args ...interface{}) {
+		issues = append(issues, CorpusIssue{Kind: kind, Document: doc.Name, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	if !exists {
+		add(IssueMissingFile, "the uploaded file is missing from ./documents")
+	}
+
+	n := len(doc.Chunks)
+	switch {
+	case exists && modified.After(doc.CreatedAt):
+		add(IssueStaleIndex, "the file changed at %s, after it was indexed at %s", modified.UTC().Format(time.RFC3339), doc.CreatedAt.UTC().Format(time.RFC3339))
+	case doc.ChunkCount != n || len(doc.ChunkIDs) != n || len(doc.chunkStarts) != n:
+		add(IssueStaleIndex, "%d chunks but a chunk count of %d, %d chunk IDs and %d offsets", n, doc.ChunkCount, len(doc.ChunkIDs), len(doc.chunkStarts))
+	case len(doc.ChunkPages) > 0 && len(doc.ChunkPages) != n || len(doc.ChunkMetadata) > 0 && len(doc.ChunkMetadata) != n:
+		add(IssueStaleIndex, "%d chunks but %d page numbers and %d metadata entries", n, len(doc.ChunkPages), len(doc.ChunkMetadata))
+	}
+
+	switch model := defaultEmbeddingModel(doc.Collection); {
+	case n == 0:
+	case doc.EmbeddingModel != "" && len(doc.Embeddings) != n:
+		add(IssueMissingEmbeddings, "%d of %d chunks embedded with %s", len(doc.Embeddings), n, doc.EmbeddingModel)
+	case doc.EmbeddingModel != "" && !sameDimensions(doc.Embeddings):
+		add(IssueMissingEmbeddings, "embeddings of different dimensions from %s", doc.EmbeddingModel)
+	case doc.EmbeddingModel == "" && model != "":
+		add(IssueMissingEmbeddings, "not embedded, although %s applies", model)
+	}
+	return issues
+}
+
+func sameDimensions(vectors []QuantizedVector) bool {
+	for _, v := range vectors {
+		if v.Dim() != vectors[0].Dim() {
+			return false
+		}
+	}
+	return true
+}
+
+// repairCorpus fixes what it can of a report's issues: orphaned files are indexed,
+// stale documents re-processed from their files with their settings, metadata and
+// summary, and missing embeddings computed
+func repairCorpus(ctx context.Context, job *Job, issues []CorpusIssue) (interface{}, error) {
+	var todo []int
+	for i, issue := range issues {
+		if issue.repairable() {
+			todo = append(todo, i)
+		} else {
+			issues[i].Error = "upload the file again"
+		}
+	}
+	// Documents are re-processed before embedding, which would otherwise embed
+	// chunks about to be replaced
+	sort.SliceStable(todo, func(a, b int) bool {
+		return issues[todo[a]].Kind != IssueMissingEmbeddings && issues[todo[b]].Kind == IssueMissingEmbeddings
+	})
+	job.SetProgress(0, len(todo))
+
+	failed := 0
+	for done, i := range todo {
+		if ctx.Err() != nil {
+			return issues, ctx.Err()
+		}
+		issue := &issues[i]
+		job.Update(func(s *JobStatus) {
+			s.Message = fmt.Sprintf("Repairing %s (%s)", issue.Document, issue.Kind)
+		})
+		var err error
+		switch issue.Kind {
+		case IssueOrphanedFile:
+			_, err = reprocessStored(issue.Document, nil, nil, "")
+		case IssueStaleIndex:
+			if doc, exists := documentStore.Get(issue.Document); exists {
+				_, err = reprocessStored(issue.Document, doc, nil, "")
+			}
+		case IssueMissingEmbeddings:
+			if doc, exists := documentStore.Get(issue.Document); exists {
+				err = embedDocument(ctx, doc)
+			}
+		}
+		if err != nil {
+			failed++
+			issue.Error = err.Error()
+			log.Printf("Failed to repair %s (%s): %v", issue.Document, issue.Kind, err)
+		} else {
+			issue.Repaired = true
+		}
+		job.SetProgress(done+1, len(todo))
+		snapshot := append([]CorpusIssue(nil), issues...)
+		job.Update(func(s *JobStatus) { s.Result = snapshot })
+	}
+
+	job.Update(func(s *JobStatus) {
+		s.Message = fmt.Sprintf("Repaired %d of %d issues", len(todo)-failed, len(todo))
+	})
+	if failed > 0 {
+		return issues, fmt.Errorf("%d of %d repairs failed", failed, len(todo))
+	}
+	return issues, nil
+}
+
+// embedDocument computes the embeddings of all of a document's chunks with its
+// model, or the collection's or EMBEDDING_MODEL when it has none
+func embedDocument(ctx context.Context, doc *Document) error {
+	doc.mu.RLock()
+	model := doc.EmbeddingModel
+	chunks := append([]string(nil), doc.Chunks...)
+	doc.mu.RUnlock()
+	if model == "" {
+		model = defaultEmbeddingModel(doc.Collection)
+	}
+
+	vectors := make([]QuantizedVector, 0, len(chunks))
+	for start := 0; start < len(chunks); start += defaultBackfillBatch {
+		batch, err := embedChunks(ctx, chunks[start:min(start+defaultBackfillBatch, len(chunks))], model)
+		if err != nil {
+			return err
+		}
+		for _, vec := range batch {
+			vectors = append(vectors, quantizeVector(vec))
+		}
+	}
+	return attachEmbeddings(doc, model, vectors)
+}
+
+// runCorpusCheck checks the corpus, starting a repair job for the issues when
+// repair is set, and keeps the report for /api/admin/corpus
+func runCorpusCheck(repair bool) (*CorpusReport, error) {
+	report, err := checkCorpus()
+	if err != nil {
+		return nil, err
+	}
+	// The job checks again when it runs, so a retry repairs the corpus as it
+	// stands then
+	if repair && len(report.Issues) > 0 {
+		job := jobStore.Start("", corpusRepairJobType, "issues", func(ctx context.Context, job *Job) (interface{}, error) {
+			current, err := checkCorpus()
+			if err != nil {
+				return nil, err
+			}
+			return repairCorpus(ctx, job, current.Issues)
+		})
+		report.RepairJob = job.Snapshot().ID
+	}
+	lastCorpusReport.mu.Lock()
+	lastCorpusReport.report = report
+	lastCorpusReport.mu.Unlock()
+	return report, nil
+}
+
+// startupCorpusCheck reconciles the documents restored from PERSIST_DIR with
+// ./documents and their embeddings (CORPUS_CHECK), logging what drifted and
+// repairing it in the background when CORPUS_REPAIR is set
+func startupCorpusCheck() {
+	if getEnv("CORPUS_CHECK", "true") != "true" {
+		return
+	}
+	report, err := runCorpusCheck(getEnv("CORPUS_REPAIR", "false") == "true")
+	if err != nil {
+		log.Printf("Corpus check failed: %v", err)
+		return
+	}
+	if len(report.Issues) == 0 {
+		log.Printf("Corpus check: %d documents and %d files are consistent", report.Documents, report.Files)
+		return
+	}
+	for i, issue := range report.Issues {
+		if i == maxLoggedIssues {
+			log.Printf("Corpus check: %d more issues; see /api/admin/corpus", len(report.Issues)-i)
+			break
+		}
+		log.Printf("Corpus check: %s: %s (%s)", issue.Document, issue.Detail, issue.Kind)
+	}
+	if report.RepairJob != "" {
+		log.Printf("Corpus check: %d issues in %d documents and %d files; repairing them in job %s", len(report.Issues), report.Documents, report.Files, report.RepairJob)
+	} else {
+		log.Printf("Corpus check: %d issues in %d documents and %d files; set CORPUS_REPAIR=true or POST /api/admin/corpus/check?repair=true to repair them", len(report.Issues), report.Documents, report.Files)
+	}
+}
+
+// adminCorpusHandler serves GET /api/admin/corpus, the latest corpus check, and
+// POST /api/admin/corpus/check, which runs one now (?repair=true to repair)
+func adminCorpusHandler(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/corpus"), "/")
+	if action != "" && action != "check" {
+		sendError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	method := "GET"
+	if action == "check" {
+		method = "POST"
+	}
+	if !validateMethod(w, r, method) || !requireAdmin(w, r) {
+		return
+	}
+	if readOnlyReplica {
+		sendError(w, http.StatusForbidden, "Read-only replicas follow the writer's store; check the corpus there")
+		return
+	}
+
+	if action == "" {
+		lastCorpusReport.mu.Lock()
+		report := lastCorpusReport.report
+		lastCorpusReport.mu.Unlock()
+		if report == nil {
+			sendError(w, http.StatusNotFound, "The corpus has not been checked yet")
+			return
+		}
+		sendJSON(w, http.StatusOK, report)
+		return
+	}
+
+	repair := r.URL.Query().Get("repair") == "true"
+	if repair && jobStore.Active(corpusRepairJobType) {
+		sendError(w, http.StatusConflict, "A corpus repair is already running")
+		return
+	}
+	report, err := runCorpusCheck(repair)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Sentences with fewer words are never dropped as duplicates, as short headings
+// and labels legitimately repeat
+const minDedupWords = 4
+
+// ContextDedupConfig controls how repeated text is removed from query context
+type ContextDedupConfig struct {
+	Sentences      bool    `json:"sentences"`      // Drop sentences already given in a higher-ranked chunk
+	SummaryOverlap float64 `json:"summaryOverlap"` // Leave the summary out when this share of its words is in the chunks; 0 always keeps it
+}
+
+func (c ContextDedupConfig) validate() error {
+	if c.SummaryOverlap < 0 || c.SummaryOverlap > 1 {
+		return fmt.Errorf("contextDedup.summaryOverlap must be between 0 and 1")
+	}
+	return nil
+}
+
+// sentenceKey normalizes a sentence for comparison, or returns "" for one too
+// short to compare
+func sentenceKey(sentence string) string {
+	words := tokenize(sentence)
+	if len(words) < minDedupWords {
+		return ""
+	}
+	return strings.Join(words, " ")
+}
+
+// dedupeChunks removes sentences repeated across chunks, keeping the first
+// occurrence, so chunks are expected best first. Chunks left with nothing new
+// come back empty.
+func dedupeChunks(chunks []string) []string {
+	seen := make(map[string]bool)
+	deduped := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		var b strings.Builder
+		last := 0
+		for _, span := range sentenceSpans(chunk) {
+			key := sentenceKey(chunk[span[0]:span[1]])
+			if key == "" {
+				continue
+			}
+			if seen[key] {
+				// The white space after the sentence separates what follows
+				b.WriteString(strings.TrimRight(chunk[last:span[0]], " \t"))
+				last = span[1]
+				continue
+			}
+			seen[key] = true
+		}
+		b.WriteString(chunk[last:])
+		deduped[i] = strings.TrimSpace(b.String())
+	}
+	return deduped
+}
+
+// summaryOverlap returns the share of the summary's content words that the
+// chunks already contain
+func summaryOverlap(summary string, chunks []string) float64 {
+	words := contentWords(summary)
+	if len(words) == 0 {
+		return 1
+	}
+	present := make(map[string]bool)
+	for _, chunk := range chunks {
+		for _, w := range tokenize(chunk) {
+			present[w] = true
+		}
+	}
+	found := 0
+	for _, w := range words {
+		if present[w] {
+			found++
+		}
+	}
+	return float64(found) / float64(len(words))
+}
+
+// dedupeContext prepares the retrieved chunks and summary for the prompt:
+// sentences repeated across chunks, or in the summary after a chunk, are dropped,
+// and the summary is left out ("") when the chunks already say most of it. The
+// chunks are returned in a new slice.
+func dedupeContext(chunks []string, summary string) ([]string, string) {
+	config := getConfig().ContextDedup
+	if summary != "" && config.SummaryOverlap > 0 && summaryOverlap(summary, chunks) >= config.SummaryOverlap {
+		summary = ""
+	}
+	if !config.Sentences {
+		return slices.Clone(chunks), summary
+	}
+	deduped := dedupeChunks(append(slices.Clone(chunks), summary))
+	return deduped[:len(chunks)], deduped[len(chunks)]
+}
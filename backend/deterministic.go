@@ -0,0 +1,38 @@
+package main
+
+import "context"
+
+type deterministicKey struct{}
+
+// deterministicContext makes Ollama calls under ctx sample greedily with a fixed seed
+func deterministicContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, deterministicKey{}, true)
+}
+
+// isDeterministic reports whether calls under ctx should be reproducible, either
+// because the request asked for it or the configuration enables it everywhere
+func isDeterministic(ctx context.Context) bool {
+	if on, _ := ctx.Value(deterministicKey{}).(bool); on {
+		return true
+	}
+	return getConfig().Deterministic
+}
+
+// generationOptions returns the Ollama options for calls under ctx, or nil to use
+// the model's defaults
+func generationOptions(ctx context.Context) map[string]interface{} {
+	var options map[string]interface{}
+	if isDeterministic(ctx) {
+		options = map[string]interface{}{
+			"seed":        getConfig().Seed,
+			"temperature": 0,
+		}
+	}
+	if limit := answerTokenLimit(ctx); limit > 0 {
+		if options == nil {
+			options = make(map[string]interface{})
+		}
+		options["num_predict"] = limit
+	}
+	return options
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Digest types
+const (
+	DigestQuery   = "query"   // Ask each document the digest's query
+	DigestSummary = "summary" // Summarize each document
+)
+
+const (
+	digestSchedulerTick     = 30 * time.Second
+	digestRunTimeout        = 30 * time.Minute
+	digestDeliveryTimeout   = 30 * time.Second
+	digestJobType           = "digest"
+	maxDigestEmailReceivers = 20
+)
+
+// Digest runs a query or summary across a collection on a cron schedule and
+// delivers the report to a webhook and/or by email
+type Digest struct {
+	Name        string   `json:"name"`
+	Collection  string   `json:"collection,omitempty"`  // Optional for saved-query digests, which default to the query's scope
+	Type        string   `json:"type"`                  // query or summary
+	Query       string   `json:"query,omitempty"`       // query digests
+	SavedQuery  string   `json:"savedQuery,omitempty"`  // query digests: ID of a saved query to run instead of query
+	Tenant      string   `json:"tenant"`                // Owner of the saved query; its pinned facts apply
+	SummaryType string   `json:"summaryType,omitempty"` // summary digests: Brief, Detailed or empty for concise
+	ModelName   string   `json:"modelName,omitempty"`
+	Schedule    string   `json:"schedule"`              // Cron expression, e.g. "0 8 * * 1" (server local time)
+	ChangedOnly bool     `json:"changedOnly,omitempty"` // Only documents added or updated since the last successful run
+	Webhook     string   `json:"webhook,omitempty"`
+	Email       []string `json:"email,omitempty"`
+}
+
+// DigestEntry is the result for one document of a digest run
+type DigestEntry struct {
+	Document  string   `json:"document"`
+	Title     string   `json:"title,omitempty"`
+	Response  string   `json:"response,omitempty"`
+	Citations []string `json:"citations,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// DigestReport is what a digest run delivers
+type DigestReport struct {
+	Digest     string        `json:"digest"`
+	Collection string        `json:"collection,omitempty"`
+	Type       string        `json:"type"`
+	Query      string        `json:"query,omitempty"`
+	RanAt      time.Time     `json:"ranAt"`
+	Since      *time.Time    `json:"since,omitempty"` // Set for changedOnly digests after their first run
+	Entries    []DigestEntry `json:"entries"`
+	Markdown   string        `json:"markdown"`
+}
+
+// DigestStatus is the schedule state reported for a digest
+type DigestStatus struct {
+	Digest
+	Running     bool          `json:"running"`
+	JobID       string        `json:"jobId,omitempty"` // Latest run
+	LastRun     *time.Time    `json:"lastRun,omitempty"`
+	LastSuccess *time.Time    `json:"lastSuccess,omitempty"`
+	NextRun     *time.Time    `json:"nextRun,omitempty"`
+	LastError   string        `json:"lastError,omitempty"`
+	LastReport  *DigestReport `json:"lastReport,omitempty"`
+}
+
+type digestState struct {
+	status   DigestStatus
+	schedule *cronSchedule
+	mu       sync.Mutex
+}
+
+var digestRegistry = struct {
+	digests map[string]*digestState
+	mu      sync.RWMutex
+}{digests: make(map[string]*digestState)}
+
+func (s *digestState) snapshot() DigestStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// scheduleNext sets the next run after t; callers hold s.mu
+func (s *digestState) scheduleNext(t time.Time) {
+	s.status.NextRun = nil
+	if next := s.schedule.next(t); !next.IsZero() {
+		s.status.NextRun = &next
+	}
+}
+
+// startDigest runs a digest as a background job; it returns nil when a run is
+// already in progress
+func startDigest(s *digestState) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status.Running {
+		return nil
+	}
+	s.status.Running = true
+	digest := s.status.Digest
+	since := s.status.LastSuccess
+
+	job := jobStore.Start(digest.Tenant, digestJobType, "documents", func(ctx context.Context, job *Job) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, digestRunTimeout)
+		defer cancel()
+		start := time.Now()
+		report, err := runDigest(ctx, job, digest, since)
+		if err == nil {
+			err = deliverDigest(ctx, digest, report)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.status.Running = false
+		s.status.LastRun = &start
+		s.status.LastReport = report
+		if err != nil {
+			s.status.LastError = err.Error()
+			log.Printf("Digest %s failed: %v", digest.Name, err)
+		} else {
+			s.status.LastError = ""
+			s.status.LastSuccess = &start
+			log.Printf("Delivered digest %s in %v: %d documents", digest.Name, time.Since(start), len(report.Entries))
+		}
+		return report, err
+	})
+	s.status.JobID = job.Snapshot().ID
+	return job
+}
+
+// runDigest asks or summarizes each document of the collection (only those changed
+// since the given time, if set) and assembles the report
+func runDigest(ctx context.Context, job *Job, digest Digest, since *time.Time) (*DigestReport, error) {
+	report := &DigestReport{
+		Digest:     digest.Name,
+		Collection: digest.Collection,
+		Type:       digest.Type,
+		Query:      digest.Query,
+		RanAt:      time.Now().UTC(),
+		Entries:    []DigestEntry{},
+	}
+	var saved *SavedQuery
+	if digest.SavedQuery != "" {
+		sq, exists := getSavedQuery(digest.Tenant, digest.SavedQuery)
+		if !exists {
+			return report, fmt.Errorf("saved query %s no longer exists", digest.SavedQuery)
+		}
+		saved = sq
+		report.Query = sq.Request.Query
+	}
+
+	candidates := activeDocuments(documentStore.ByCollection(digest.Collection), false)
+	if digest.Collection == "" && saved != nil {
+		report.Collection = saved.Collection
+		candidates = nil
+		for _, name := range saved.documents() {
+			if doc, exists := documentStore.Get(name); exists {
+				candidates = append(candidates, doc)
+			}
+		}
+	}
+	var docs []*Document
+	for _, doc := range candidates {
+		doc.mu.RLock()
+		created := doc.CreatedAt
+		doc.mu.RUnlock()
+		if digest.ChangedOnly && since != nil && !created.After(*since) {
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	if digest.ChangedOnly && since != nil {
+		report.Since = since
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Name < docs[j].Name })
+
+	job.SetProgress(0, len(docs))
+	model := modelOrDefault(digest.ModelName)
+	failed := 0
+	for i, doc := range docs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		doc.mu.RLock()
+		entry := DigestEntry{Document: doc.Name, Title: doc.Metadata.Title}
+		doc.mu.RUnlock()
+
+		switch digest.Type {
+		case DigestQuery:
+			req := QueryRequest{DocumentName: doc.Name, Query: digest.Query, ModelName: model, Tenant: digest.Tenant}
+			if saved != nil {
+				req = saved.request(doc.Name, digest.Tenant)
+				if digest.ModelName != "" {
+					req.ModelName = digest.ModelName
+				}
+			}
+			resp, err := runQuery(req)
+			if err != nil {
+				entry.Error = err.Error()
+			} else {
+				entry.Response = strings.TrimSpace(resp.Response)
+				entry.Citations = resp.Citations
+			}
+		case DigestSummary:
+			summary, err := generateDocumentSummary(ctx, doc, model, digest.SummaryType)
+			if err != nil {
+				entry.Error = err.Error()
+			} else {
+				entry.Response = strings.TrimSpace(summary)
+			}
+		}
+		if entry.Error != "" {
+			failed++
+		}
+		report.Entries = append(report.Entries, entry)
+		job.SetProgress(i+1, len(docs))
+	}
+	report.Markdown = report.markdown()
+	if failed > 0 && failed == len(docs) {
+		return report, fmt.Errorf("all %d documents failed, first error: %s", failed, report.Entries[0].Error)
+	}
+	return report, nil
+}
+
+// markdown renders the report for email and for webhook consumers that post it as is
+func (r *DigestReport) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", r.Digest)
+	if r.Collection != "" {
+		fmt.Fprintf(&b, "- Collection: %s\n", r.Collection)
+	}
+	fmt.Fprintf(&b, "- Run: %s\n", r.RanAt.Format(time.RFC1123))
+	if r.Query != "" {
+		fmt.Fprintf(&b, "- Query: %s\n", r.Query)
+	}
+	if r.Since != nil {
+		fmt.Fprintf(&b, "- Changes since: %s\n", r.Since.Format(time.RFC1123))
+	}
+	if len(r.Entries) == 0 {
+		if r.Since != nil {
+			b.WriteString("\nNo documents were added or updated.\n")
+		} else {
+			b.WriteString("\nThere are no documents to report on.\n")
+		}
+		return b.String()
+	}
+	for _, entry := range r.Entries {
+		heading := entry.Document
+		if entry.Title != "" {
+			heading = fmt.Sprintf("%s (%s)", entry.Title, entry.Document)
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n", heading)
+		if entry.Error != "" {
+			fmt.Fprintf(&b, "_Failed: %s_\n", entry.Error)
+			continue
+		}
+		b.WriteString(entry.Response + "\n")
+		for i, citation := range entry.Citations {
+			fmt.Fprintf(&b, "\n[%d] %s", i+1, citation)
+		}
+		if len(entry.Citations) > 0 {
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+// deliverDigest posts the report to the webhook and emails it; both are attempted
+// and their errors combined
+func deliverDigest(ctx context.Context, digest Digest, report *DigestReport) error {
+	var failures []string
+	if digest.Webhook != "" {
+		if err := postDigestWebhook(ctx, digest.Webhook, report); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(digest.Email) > 0 {
+		if err := emailDigest(digest.Email, report); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("delivery failed: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func postDigestWebhook(ctx context.Context, target string, report *DigestReport) error {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, digestDeliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer closeFile(resp.Body, "digest webhook response body")
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// emailDigest sends the Markdown report through the SMTP relay at SMTP_ADDR
+func emailDigest(to []string, report *DigestReport) error {
+	addr := os.Getenv("SMTP_ADDR")
+	from := os.Getenv("SMTP_FROM")
+	if addr == "" || from == "" {
+		return fmt.Errorf("email delivery needs SMTP_ADDR and SMTP_FROM")
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", fmt.Sprintf("%s: %s", report.Digest, report.RanAt.Format("2006-01-02"))))
+	fmt.Fprintf(&msg, "Date: %s\r\n", report.RanAt.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/markdown; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(report.Markdown, "\n", "\r\n"))
+
+	if err := smtp.SendMail(addr, auth, sender.Address, to, []byte(msg.String())); err != nil {
+		return fmt.Errorf("email failed: %w", err)
+	}
+	return nil
+}
+
+// runDigestScheduler starts digests whose scheduled time has come
+func runDigestScheduler() {
+	ticker := time.NewTicker(digestSchedulerTick)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		digestRegistry.mu.RLock()
+		for _, s := range digestRegistry.digests {
+			s.mu.Lock()
+			due := s.status.NextRun != nil && !s.status.NextRun.After(now)
+			if due {
+				s.scheduleNext(now)
+			}
+			s.mu.Unlock()
+			if due {
+				startDigest(s)
+			}
+		}
+		digestRegistry.mu.RUnlock()
+	}
+}
+
+// validateDigest checks a digest and compiles its schedule
+func validateDigest(digest *Digest) (*cronSchedule, error) {
+	digest.Name = strings.TrimSpace(digest.Name)
+	if digest.Name == "" || strings.Contains(digest.Name, "/") {
+		return nil, newAPIError(http.StatusBadRequest, "Invalid digest name")
+	}
+	switch digest.Type {
+	case DigestQuery:
+		digest.Query = strings.TrimSpace(digest.Query)
+		if (digest.Query == "") == (digest.SavedQuery == "") {
+			return nil, newAPIError(http.StatusBadRequest, "Query digests need either a query or a savedQuery")
+		}
+		if digest.SavedQuery != "" {
+			if _, exists := getSavedQuery(digest.Tenant, digest.SavedQuery); !exists {
+				return nil, newAPIError(http.StatusBadRequest, "Saved query not found")
+			}
+		}
+	case DigestSummary:
+		digest.Query, digest.SavedQuery = "", ""
+	default:
+		return nil, newAPIError(http.StatusBadRequest, "Digest type must be query or summary")
+	}
+	if digest.Collection == "" && digest.SavedQuery == "" {
+		return nil, newAPIError(http.StatusBadRequest, "A collection is required")
+	}
+	schedule, err := parseCron(digest.Schedule)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("Invalid schedule: %v", err))
+	}
+	if schedule.next(time.Now()).IsZero() {
+		return nil, newAPIError(http.StatusBadRequest, "Schedule never runs")
+	}
+	if digest.Webhook != "" {
+		if u, err := url.Parse(digest.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, newAPIError(http.StatusBadRequest, "Webhook must be an http(s) URL")
+		}
+	}
+	if len(digest.Email) > maxDigestEmailReceivers {
+		return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("At most %d email recipients", maxDigestEmailReceivers))
+	}
+	for i, address := range digest.Email {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("Invalid email address %q", address))
+		}
+		digest.Email[i] = parsed.Address
+	}
+	if len(digest.Email) > 0 && (os.Getenv("SMTP_ADDR") == "" || os.Getenv("SMTP_FROM") == "") {
+		return nil, newAPIError(http.StatusBadRequest, "Email delivery needs SMTP_ADDR and SMTP_FROM to be set")
+	}
+	return schedule, nil
+}
+
+// digestsHandler lists digests with their schedule state (GET) or registers one (POST)
+func digestsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && !validateMethod(w, r, "POST") {
+		return
+	}
+
+	if r.Method == "GET" {
+		digestRegistry.mu.RLock()
+		result := make([]DigestStatus, 0, len(digestRegistry.digests))
+		for _, s := range digestRegistry.digests {
+			status := s.snapshot()
+			status.LastReport = nil
+			result = append(result, status)
+		}
+		digestRegistry.mu.RUnlock()
+		sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+		sendJSON(w, http.StatusOK, map[string]interface{}{"digests": result})
+		return
+	}
+
+	var digest Digest
+	if err := json.NewDecoder(r.Body).Decode(&digest); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	digest.Tenant = tenant
+	schedule, err := validateDigest(&digest)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	state := &digestState{schedule: schedule}
+	state.status.Digest = digest
+	state.scheduleNext(time.Now())
+
+	digestRegistry.mu.Lock()
+	if previous, exists := digestRegistry.digests[digest.Name]; exists {
+		// Keep the run history when a digest is redefined
+		old := previous.snapshot()
+		state.status.LastRun, state.status.LastSuccess = old.LastRun, old.LastSuccess
+		state.status.LastError, state.status.LastReport = old.LastError, old.LastReport
+	}
+	digestRegistry.digests[digest.Name] = state
+	digestRegistry.mu.Unlock()
+
+	sendJSON(w, http.StatusCreated, state.snapshot())
+}
+
+// handleDigestByName reports (GET) or removes (DELETE) a digest; POST
+// /api/digest/{name}/run runs it now
+func handleDigestByName(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/digest/"), "/")
+	name := parts[0]
+
+	digestRegistry.mu.RLock()
+	state, exists := digestRegistry.digests[name]
+	digestRegistry.mu.RUnlock()
+	if !exists {
+		sendError(w, http.StatusNotFound, "Digest not found")
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "run" {
+		if !validateMethod(w, r, "POST") {
+			return
+		}
+		job := startDigest(state)
+		if job == nil {
+			sendError(w, http.StatusConflict, "Digest is already running")
+			return
+		}
+		sendJSON(w, http.StatusAccepted, job.Snapshot())
+	} else if len(parts) != 1 {
+		sendError(w, http.StatusNotFound, "Not found")
+	} else if r.Method == "DELETE" {
+		// A run in progress finishes and delivers its report
+		digestRegistry.mu.Lock()
+		delete(digestRegistry.digests, name)
+		digestRegistry.mu.Unlock()
+		sendJSON(w, http.StatusOK, map[string]string{"message": "Digest deleted"})
+	} else if validateMethod(w, r, "GET") {
+		sendJSON(w, http.StatusOK, state.snapshot())
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigestWebhookStaysOffInternalNetworks(t *testing.T) {
+	received := make(chan DigestReport, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report DigestReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Error(err)
+		}
+		received <- report
+	}))
+	defer server.Close()
+	report := &DigestReport{Digest: "policy-changes", Type: "query", RanAt: time.Now()}
+
+	useWebhookNetworks(t, "")
+	for _, target := range []string{server.URL, "http://169.254.169.254/latest/meta-data/"} {
+		if err := postDigestWebhook(context.Background(), target, report); err == nil || !strings.Contains(err.Error(), "internal address") {
+			t.Errorf("posting to %s: %v, want an internal address error", target, err)
+		}
+	}
+
+	useWebhookNetworks(t, "127.0.0.1")
+	if err := postDigestWebhook(context.Background(), server.URL, report); err != nil {
+		t.Fatalf("posting to an allowed network: %v", err)
+	}
+	if got := <-received; got.Digest != "policy-changes" {
+		t.Errorf("received digest %q", got.Digest)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emailMessage is a parsed message with its readable content
+type emailMessage struct {
+	ID          string
+	InReplyTo   string
+	References  []string
+	From        string
+	To          string
+	Subject     string
+	Date        time.Time
+	Body        string
+	Attachments []emailAttachment
+}
+
+type emailAttachment struct {
+	Name string
+	Text string // Extracted text, empty for unsupported types
+}
+
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// charsetReader converts the single-byte charsets common in mail to UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "us-ascii", "":
+		return input, nil
+	case "iso-8859-1", "latin1", "windows-1252", "cp1252":
+		data, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return strings.NewReader(string(runes)), nil
+	default:
+		return nil, fmt.Errorf("unsupported charset %s", charset)
+	}
+}
+
+func decodeHeader(value string) string {
+	if decoded, err := headerDecoder.DecodeHeader(value); err == nil {
+		return strings.TrimSpace(decoded)
+	}
+	return strings.TrimSpace(value)
+}
+
+var messageIDPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+// parseEmail reads a raw RFC 5322 message, preferring plain text bodies and
+// extracting text from supported attachments
+func parseEmail(raw []byte) (*emailMessage, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %w", err)
+	}
+
+	msg := &emailMessage{
+		ID:         messageIDPattern.FindString(m.Header.Get("Message-Id")),
+		InReplyTo:  messageIDPattern.FindString(m.Header.Get("In-Reply-To")),
+		References: messageIDPattern.FindAllString(m.Header.Get("References"), -1),
+		From:       decodeHeader(m.Header.Get("From")),
+		To:         decodeHeader(m.Header.Get("To")),
+		Subject:    decodeHeader(m.Header.Get("Subject")),
+	}
+	if date, err := m.Header.Date(); err == nil {
+		msg.Date = date
+	}
+
+	var plain, htmlBody string
+	if err := walkMIME(m.Header, m.Body, msg, &plain, &htmlBody); err != nil {
+		return nil, err
+	}
+	msg.Body = strings.TrimSpace(plain)
+	if msg.Body == "" && htmlBody != "" {
+		msg.Body = htmlToText(htmlBody)
+	}
+	return msg, nil
+}
+
+// mimeHeader is the subset of header access walkMIME needs from mail and multipart headers
+type mimeHeader interface {
+	Get(key string) string
+}
+
+// walkMIME collects the first plain and HTML bodies and all attachments of a MIME tree
+func walkMIME(header mimeHeader, body io.Reader, msg *emailMessage, plain, htmlBody *string) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("invalid multipart body: %w", err)
+			}
+			if err := walkMIME(part.Header, part, msg, plain, htmlBody); err != nil {
+				return err
+			}
+		}
+	}
+
+	var decoded io.Reader = body
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		decoded = base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: body})
+	case "quoted-printable":
+		decoded = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(decoded)
+	if err != nil {
+		return fmt.Errorf("failed to decode body: %w", err)
+	}
+
+	disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := decodeHeader(dispParams["filename"])
+	if filename == "" {
+		filename = decodeHeader(params["name"])
+	}
+	if disposition == "attachment" || (filename != "" && !strings.HasPrefix(mediaType, "text/")) {
+		msg.Attachments = append(msg.Attachments, emailAttachment{Name: filename, Text: attachmentText(filename, data)})
+		return nil
+	}
+
+	if strings.HasPrefix(mediaType, "text/") {
+		if r, err := charsetReader(params["charset"], bytes.NewReader(data)); err == nil {
+			data, _ = io.ReadAll(r)
+		}
+		if mediaType == "text/html" && *htmlBody == "" {
+			*htmlBody = string(data)
+		} else if mediaType != "text/html" && *plain == "" {
+			*plain = string(data)
+		}
+	}
+	return nil
+}
+
+// newlineStripper drops line breaks so wrapped base64 decodes cleanly
+type newlineStripper struct{ r io.Reader }
+
+func (n *newlineStripper) Read(p []byte) (int, error) {
+	for {
+		count, err := n.r.Read(p)
+		kept := 0
+		for _, b := range p[:count] {
+			if b != '\r' && b != '\n' {
+				p[kept] = b
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// attachmentText extracts text from an attachment in a supported format
+func attachmentText(name string, data []byte) string {
+	if name == "" || !isSupportedFile(name) {
+		return ""
+	}
+	tmp, err := os.CreateTemp("", "attachment-*"+strings.ToLower(filepath.Ext(name)))
+	if err != nil {
+		return ""
+	}
+	defer func() {
+		if err := os.Remove(tmp.Name()); err != nil {
+			log.Printf("Failed to remove %s: %v", tmp.Name(), err)
+		}
+	}()
+
+	_, err = tmp.Write(data)
+	closeFile(tmp, tmp.Name())
+	if err != nil {
+		return ""
+	}
+	extracted, err := extractText(tmp.Name())
+	if err != nil {
+		log.Printf("Skipping attachment %s: %v", name, err)
+		return ""
+	}
+	return strings.TrimSpace(strings.ReplaceAll(extracted.Text, pageSeparator, "\n"))
+}
+
+// splitMbox splits an mboxrd file into raw messages, undoing ">From " quoting
+func splitMbox(data []byte) [][]byte {
+	var messages [][]byte
+	var current bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxRequestSize)
+
+	flush := func() {
+		if len(bytes.TrimSpace(current.Bytes())) > 0 {
+			messages = append(messages, append([]byte(nil), current.Bytes()...))
+		}
+		current.Reset()
+	}
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if bytes.HasPrefix(line, []byte("From ")) {
+			flush()
+			continue
+		}
+		if len(line) > 0 && line[0] == '>' && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			line = line[1:]
+		}
+		current.Write(line)
+		current.WriteByte('\n')
+	}
+	flush()
+	return messages
+}
+
+// appendMbox adds raw messages to an mbox file, skipping Message-IDs it already holds.
+// Only headers are parsed, so attachments are not extracted here.
+func appendMbox(existing []byte, raws [][]byte) []byte {
+	headerOf := func(raw []byte) mail.Header {
+		if m, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+			return m.Header
+		}
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for _, raw := range splitMbox(existing) {
+		if h := headerOf(raw); h != nil {
+			seen[messageIDPattern.FindString(h.Get("Message-Id"))] = true
+		}
+	}
+	delete(seen, "")
+
+	out := bytes.NewBuffer(append([]byte(nil), existing...))
+	for _, raw := range raws {
+		h := headerOf(raw)
+		if h == nil {
+			continue
+		}
+		id := messageIDPattern.FindString(h.Get("Message-Id"))
+		if id != "" && seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		date, err := h.Date()
+		if err != nil {
+			date = time.Unix(0, 0)
+		}
+		sender := "MAILER-DAEMON"
+		if addr, err := mail.ParseAddress(decodeHeader(h.Get("From"))); err == nil {
+			sender = addr.Address
+		}
+		fmt.Fprintf(out, "From %s %s\n", sender, date.UTC().Format(time.ANSIC))
+		for _, line := range strings.SplitAfter(string(raw), "\n") {
+			if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				out.WriteByte('>')
+			}
+			out.WriteString(strings.TrimSuffix(line, "\r\n"))
+			if strings.HasSuffix(line, "\r\n") {
+				out.WriteByte('\n')
+			}
+		}
+		if !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+			out.WriteByte('\n')
+		}
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+var subjectPrefixPattern = regexp.MustCompile(`(?i)^\s*((re|fw|fwd|aw|sv)\s*(\[\d+\])?:\s*)+`)
+
+// threadKey identifies the conversation a message belongs to: the root of its
+// References chain, or its normalized subject when it carries no threading headers
+func threadKey(msg *emailMessage) string {
+	switch {
+	case len(msg.References) > 0:
+		return msg.References[0]
+	case msg.InReplyTo != "":
+		return msg.InReplyTo
+	case msg.ID != "":
+		return msg.ID
+	default:
+		return "subject:" + strings.ToLower(strings.TrimSpace(subjectPrefixPattern.ReplaceAllString(msg.Subject, "")))
+	}
+}
+
+// groupThreads groups messages into conversations ordered by their first message.
+// Replies that only reference an intermediate message are joined through it.
+func groupThreads(messages []*emailMessage) [][]*emailMessage {
+	byID := make(map[string]*emailMessage)
+	for _, m := range messages {
+		if m.ID != "" {
+			byID[m.ID] = m
+		}
+	}
+	root := func(m *emailMessage) string {
+		for hops := 0; hops < 100; hops++ {
+			parent, ok := byID[m.InReplyTo]
+			if len(m.References) > 0 || !ok || parent == m {
+				break
+			}
+			m = parent
+		}
+		return threadKey(m)
+	}
+
+	index := make(map[string]int)
+	var threads [][]*emailMessage
+	for _, m := range messages {
+		key := root(m)
+		i, ok := index[key]
+		if !ok {
+			i = len(threads)
+			index[key] = i
+			threads = append(threads, nil)
+		}
+		threads[i] = append(threads[i], m)
+	}
+	for _, t := range threads {
+		sort.SliceStable(t, func(a, b int) bool { return t[a].Date.Before(t[b].Date) })
+	}
+	sort.SliceStable(threads, func(a, b int) bool { return threads[a][0].Date.Before(threads[b][0].Date) })
+	return threads
+}
+
+// extractEmailText renders .eml and .mbox files as threaded text: one heading per
+// conversation and one sub-heading per message, so threads show up in the TOC
+func extractEmailText(filePath string) (*ExtractedText, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	raws := [][]byte{data}
+	if strings.EqualFold(filepath.Ext(filePath), ".mbox") {
+		raws = splitMbox(data)
+	}
+	var messages []*emailMessage
+	for _, raw := range raws {
+		msg, err := parseEmail(raw)
+		if err != nil {
+			log.Printf("Skipping unreadable message in %s: %v", filePath, err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("no readable messages")
+	}
+
+	var text strings.Builder
+	var toc []TOCEntry
+	var dates []DatedSpan
+	words := 0
+	write := func(s string) {
+		text.WriteString(s)
+		words += len(strings.Fields(s))
+	}
+	participants := make(map[string]bool)
+	var senders []string
+	threads := groupThreads(messages)
+	for _, thread := range threads {
+		subject := strings.TrimSpace(subjectPrefixPattern.ReplaceAllString(thread[0].Subject, ""))
+		if subject == "" {
+			subject = "(no subject)"
+		}
+		toc = append(toc, TOCEntry{Title: subject, Level: 1})
+		write(subject + "\n\n")
+
+		for _, m := range thread {
+			heading := m.From
+			if !m.Date.IsZero() {
+				heading += " " + m.Date.Format("2006-01-02 15:04")
+			}
+			toc = append(toc, TOCEntry{Title: heading, Level: 2})
+			dates = append(dates, DatedSpan{WordStart: words, Date: m.Date})
+			write(heading + "\n")
+			write(fmt.Sprintf("From: %s\nTo: %s\nSubject: %s\n\n%s\n\n", m.From, m.To, m.Subject, m.Body))
+			for _, a := range m.Attachments {
+				write(fmt.Sprintf("Attachment: %s\n%s\n\n", a.Name, a.Text))
+			}
+
+			if !participants[m.From] && m.From != "" {
+				participants[m.From] = true
+				senders = append(senders, m.From)
+			}
+		}
+	}
+
+	first := messages[0]
+	for _, m := range messages {
+		if !m.Date.IsZero() && (first.Date.IsZero() || m.Date.Before(first.Date)) {
+			first = m
+		}
+	}
+	meta := DocumentMetadata{
+		Author: first.From,
+		Custom: map[string]string{
+			"senders":  strings.Join(senders, "; "),
+			"messages": fmt.Sprint(len(messages)),
+			"threads":  fmt.Sprint(len(threads)),
+		},
+	}
+	if len(threads) == 1 {
+		meta.Title = strings.TrimSpace(subjectPrefixPattern.ReplaceAllString(threads[0][0].Subject, ""))
+	}
+	if !first.Date.IsZero() {
+		date := first.Date
+		meta.Date = &date
+	}
+
+	return &ExtractedText{Text: text.String(), TOC: toc, Metadata: meta, Dates: dates}, nil
+}
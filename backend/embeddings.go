@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Ollama embeddings call with connection limiting, timeout and retries
+func callOllamaEmbedding(ctx context.Context, text, model string) ([]float64, error) {
+	var embedding []float64
+	err := retryTransient(ctx, "Ollama embedding", func() error {
+		var err error
+		embedding, err = embedOnce(ctx, text, model)
+		return err
+	})
+	return embedding, err
+}
+
+func embedOnce(ctx context.Context, text, model string) ([]float64, error) {
+	release, err := acquireOllama(ctx, OperationEmbed, model)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	provider, name := providerFor(model)
+	return provider.Embed(ctx, text, name)
+}
+
+// Embed calls Ollama's embeddings API
+func (ollamaProvider) Embed(ctx context.Context, text, model string) ([]float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout())
+	defer cancel()
+
+	reqBody := map[string]interface{}{
+		"model":  model,
+		"prompt": text,
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	var embedding []float64
+	err = ollamaEndpoints.do(ctx, model, func(endpoint *ollamaEndpoint) error {
+		req, err := http.NewRequestWithContext(ctx, "POST", endpoint.api("/embeddings"), bytes.NewBuffer(jsonData))
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		client := &http.Client{Timeout: requestTimeout()}
+		resp, err := client.Do(req)
+		if err != nil {
+			return ollamaRequestError(ctx, err)
+		}
+		defer closeFile(resp.Body, "embedding response body")
+
+		if resp.StatusCode != http.StatusOK {
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			return ollamaStatusError(resp.StatusCode, bodyBytes)
+		}
+
+		var result struct {
+			Embedding []float64 `json:"embedding"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+		if len(result.Embedding) == 0 {
+			return fmt.Errorf("empty embedding returned by model %s", model)
+		}
+		embedding = result.Embedding
+		return nil
+	})
+	return embedding, err
+}
+
+// embedChunks computes one embedding per chunk, stopping at the first failure
+// or when ctx is cancelled
+func embedChunks(ctx context.Context, chunks []string, model string) ([][]float64, error) {
+	vectors := make([][]float64, 0, len(chunks))
+	for i, chunk := range chunks {
+		vec, err := callOllamaEmbedding(ctx, chunk, model)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: %w", i, err)
+		}
+		vectors = append(vectors, vec)
+	}
+	return vectors, nil
+}
+
+// SetEmbeddings safely attaches chunk embeddings to the document
+func (d *Document) SetEmbeddings(model string, vectors []QuantizedVector) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.superseded { // Computed for a version no longer stored
+		return
+	}
+	d.Embeddings = vectors
+	d.EmbeddingModel = model
+	persistence.log(updateRecord(d, walEmbeddings, ""))
+}
+
+// hasVectors reports whether every chunk has an embedding, which switches the
+// document from keyword to vector retrieval; callers hold the document lock
+func (d *Document) hasVectors() bool {
+	return d.EmbeddingModel != "" && len(d.Chunks) > 0 && len(d.Embeddings) == len(d.Chunks)
+}
+
+// defaultEmbeddingModel returns the model documents of a collection are embedded
+// with: the collection's, else EMBEDDING_MODEL; empty when neither is set
+func defaultEmbeddingModel(collection string) string {
+	if c, exists := collectionStore.Get(collection); exists && c.EmbeddingModel != "" {
+		return c.EmbeddingModel
+	}
+	return getConfig().EmbeddingModel
+}
+
+// RetrievalMode returns "vector" or "keyword"
+func (d *Document) RetrievalMode() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.hasVectors() {
+		return "vector"
+	}
+	return "keyword"
+}
+
+// rankByEmbedding orders the allowed chunks by cosine similarity to the query,
+// adjusted by the ranking; callers hold the document lock
+func (d *Document) rankByEmbedding(query string, rank *chunkRanking) ([]int, []float64, error) {
+	raw, err := callOllamaEmbedding(context.Background(), query, d.EmbeddingModel)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d.rankByVector(raw, rank)
+}
+
+// rankByVector is rankByEmbedding for a query already embedded
+func (d *Document) rankByVector(raw []float64, rank *chunkRanking) ([]int, []float64, error) {
+	queryVec := quantizeVector(raw)
+
+	type scored struct {
+		index int
+		score float64
+	}
+	scores := make([]scored, 0, len(d.Embeddings))
+	for i, vec := range d.Embeddings {
+		if !rank.allowed.has(i) {
+			continue
+		}
+		if vec.Dim() != queryVec.Dim() {
+			return nil, nil, fmt.Errorf("embedding dimension mismatch for chunk %d", i)
+		}
+		scores = append(scores, scored{i, rank.similarity(i, cosineSimilarity(vec, queryVec))})
+	}
+	sort.SliceStable(scores, func(a, b int) bool { return scores[a].score > scores[b].score })
+
+	ranked := make([]int, len(scores))
+	similarities := make([]float64, len(scores))
+	for i, s := range scores {
+		ranked[i], similarities[i] = s.index, s.score
+	}
+	return ranked, similarities, nil
+}
+
+// recordRetrieval counts how often each chunk is used as query context
+func (d *Document) recordRetrieval(chunkIdx int) {
+	if chunkIdx >= 0 && chunkIdx < len(d.retrievalHits) {
+		atomic.AddInt64(&d.retrievalHits[chunkIdx], 1)
+	}
+}
+
+// EmbeddingPoint is a single chunk projected onto two dimensions
+type EmbeddingPoint struct {
+	Document   string  `json:"document"`
+	ChunkIndex int     `json:"chunkIndex"`
+	X          float64 `json:"x"`
+	Y          float64 `json:"y"`
+	Label      string  `json:"label"`
+	Retrievals int64   `json:"retrievals"`
+}
+
+// projectPCA reduces vectors to two dimensions using the top principal components.
+// Components are found by power iteration so no covariance matrix is materialized.
+// Vectors of another length than the first are left out and stay at the origin.
+func projectPCA(vectors [][]float64) [][2]float64 {
+	points := make([][2]float64, len(vectors))
+	if len(vectors) == 0 {
+		return points
+	}
+	dim := len(vectors[0])
+	var rows []int // Indexes of the vectors projected
+	for i, v := range vectors {
+		if len(v) == dim {
+			rows = append(rows, i)
+		}
+	}
+
+	// Center the data
+	mean := make([]float64, dim)
+	for _, i := range rows {
+		for j := 0; j < dim; j++ {
+			mean[j] += vectors[i][j]
+		}
+	}
+	for j := range mean {
+		mean[j] /= float64(len(rows))
+	}
+	centered := make([][]float64, len(rows))
+	for k, i := range rows {
+		row := make([]float64, dim)
+		for j := 0; j < dim; j++ {
+			row[j] = vectors[i][j] - mean[j]
+		}
+		centered[k] = row
+	}
+
+	var components [][]float64
+	for c := 0; c < 2; c++ {
+		comp := powerIteration(centered, components, dim)
+		if comp == nil {
+			break
+		}
+		components = append(components, comp)
+	}
+
+	for k, row := range centered {
+		for c, comp := range components {
+			points[rows[k]][c] = dot(row, comp)
+		}
+	}
+	return points
+}
+
+// powerIteration finds the dominant eigenvector of XᵀX orthogonal to prior components
+func powerIteration(x [][]float64, prior [][]float64, dim int) []float64 {
+	const iterations = 100
+
+	// Deterministic start so the same corpus always renders the same map
+	v := make([]float64, dim)
+	for j := range v {
+		v[j] = 1 / math.Sqrt(float64(dim)+float64(j%7))
+	}
+
+	for it := 0; it < iterations; it++ {
+		next := make([]float64, dim)
+		for _, row := range x {
+			p := dot(row, v)
+			for j := 0; j < dim; j++ {
+				next[j] += p * row[j]
+			}
+		}
+		for _, comp := range prior {
+			p := dot(next, comp)
+			for j := 0; j < dim; j++ {
+				next[j] -= p * comp[j]
+			}
+		}
+		norm := math.Sqrt(dot(next, next))
+		if norm == 0 {
+			return nil
+		}
+		for j := range next {
+			next[j] /= norm
+		}
+		v = next
+	}
+	return v
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// chunkLabel returns a short preview of a chunk for display
+func chunkLabel(chunk string) string {
+	const maxWords = 8
+	words := strings.Fields(chunk)
+	if len(words) > maxWords {
+		return strings.Join(words[:maxWords], " ") + "…"
+	}
+	return strings.Join(words, " ")
+}
+
+// collectEmbeddingPoints gathers chunk vectors and their display metadata for one
+// document, leaving out vectors of another dimension than its first
+func collectEmbeddingPoints(doc *Document) ([][]float64, []EmbeddingPoint) {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+
+	vectors := make([][]float64, 0, len(doc.Embeddings))
+	points := make([]EmbeddingPoint, 0, len(doc.Embeddings))
+	for i, vec := range doc.Embeddings {
+		if i >= len(doc.Chunks) {
+			break
+		}
+		if vec.Dim() != doc.Embeddings[0].Dim() {
+			continue
+		}
+		var hits int64
+		if i < len(doc.retrievalHits) {
+			hits = atomic.LoadInt64(&doc.retrievalHits[i])
+		}
+		vectors = append(vectors, vec.Float64s())
+		points = append(points, EmbeddingPoint{
+			Document:   doc.Name,
+			ChunkIndex: i,
+			Label:      chunkLabel(doc.Chunks[i]),
+			Retrievals: hits,
+		})
+	}
+	return vectors, points
+}
+
+func applyProjection(vectors [][]float64, points []EmbeddingPoint) {
+	for i, p := range projectPCA(vectors) {
+		points[i].X = p[0]
+		points[i].Y = p[1]
+	}
+}
+
+func handleGetEmbeddingMap(w http.ResponseWriter, r *http.Request, docName string) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+
+	doc, ok := getDocumentOrError(w, docName)
+	if !ok {
+		return
+	}
+
+	vectors, points := collectEmbeddingPoints(doc)
+	if len(vectors) == 0 {
+		sendError(w, http.StatusNotFound, "No embeddings available for this document")
+		return
+	}
+	applyProjection(vectors, points)
+
+	doc.mu.RLock()
+	model := doc.EmbeddingModel
+	doc.mu.RUnlock()
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"model":  model,
+		"points": points,
+	})
+}
+
+// getCorpusEmbeddingMap projects every document embedded with the same model into one map
+func getCorpusEmbeddingMap(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+
+	model := r.URL.Query().Get("model")
+	docs := documentStore.All()
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Name < docs[j].Name })
+
+	var vectors [][]float64
+	var points []EmbeddingPoint
+	skipped := make([]string, 0)
+	dim := 0
+
+	for _, doc := range docs {
+		doc.mu.RLock()
+		docModel := doc.EmbeddingModel
+		hasEmbeddings := len(doc.Embeddings) > 0
+		docDim := 0
+		if hasEmbeddings {
+			docDim = doc.Embeddings[0].Dim()
+		}
+		doc.mu.RUnlock()
+
+		if !hasEmbeddings {
+			continue
+		}
+		if model == "" {
+			model = docModel
+		}
+		if docModel != model || (dim != 0 && docDim != dim) {
+			skipped = append(skipped, doc.Name)
+			continue
+		}
+		dim = docDim
+
+		v, p := collectEmbeddingPoints(doc)
+		vectors = append(vectors, v...)
+		points = append(points, p...)
+	}
+
+	if len(vectors) == 0 {
+		sendError(w, http.StatusNotFound, "No embeddings available")
+		return
+	}
+	applyProjection(vectors, points)
+
+	log.Printf("Built corpus embedding map: %d points (model: %s)", len(points), model)
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"model":   model,
+		"points":  points,
+		"skipped": skipped,
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestProjectPCASkipsMismatchedRows(t *testing.T) {
+	vectors := [][]float64{
+		{1, 0, 0},
+		{-1, 0, 0},
+		{0, 2, 0},
+		{5, 5},
+		{0, -2, 0},
+		nil,
+	}
+	points := projectPCA(vectors)
+	if len(points) != len(vectors) {
+		t.Fatalf("got %d points for %d vectors", len(points), len(vectors))
+	}
+	for _, i := range []int{3, 5} {
+		if points[i] != [2]float64{} {
+			t.Errorf("vector %d of length %d projected to %v, want the origin", i, len(vectors[i]), points[i])
+		}
+	}
+
+	// The y axis spreads the rows most, so it becomes the first component
+	for i, want := range map[int]float64{0: 0, 1: 0, 2: 2, 4: 2} {
+		if got := math.Abs(points[i][0]); math.Abs(got-want) > 1e-6 {
+			t.Errorf("vector %d has first coordinate %v, want ±%v", i, points[i][0], want)
+		}
+	}
+}
+
+func TestCollectEmbeddingPointsSkipsMismatchedVectors(t *testing.T) {
+	doc := &Document{
+		Name:   "notes.txt",
+		Chunks: []string{"alpha", "beta", "gamma"},
+		Embeddings: []QuantizedVector{
+			quantizeVector([]float64{1, 0, 0}),
+			quantizeVector([]float64{1, 0}),
+			quantizeVector([]float64{0, 1, 0}),
+		},
+	}
+	vectors, points := collectEmbeddingPoints(doc)
+	if len(vectors) != 2 || len(points) != 2 {
+		t.Fatalf("got %d vectors and %d points, want 2", len(vectors), len(points))
+	}
+	if points[0].ChunkIndex != 0 || points[1].ChunkIndex != 2 {
+		t.Errorf("kept chunks %d and %d, want 0 and 2", points[0].ChunkIndex, points[1].ChunkIndex)
+	}
+	applyProjection(vectors, points)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Encrypted files start with this header, followed by the nonce and the
+// AES-GCM ciphertext. Files without it are read as plain, so stores written
+// before encryption was enabled stay readable.
+var sealedMagic = []byte("RAGENC1\n")
+
+// Timeout for ENCRYPTION_KEY_COMMAND
+const keyCommandTimeout = 30 * time.Second
+
+// Errors reading encrypted data without the key it was written with
+var (
+	errNoEncryptionKey = errors.New("data is encrypted but no encryption key is configured")
+	errDecrypt         = errors.New("failed to decrypt data; the encryption key may have changed")
+)
+
+// storageCipher encrypts stored files, trash entries and persisted records; it is
+// nil when encryption at rest is off
+var storageCipher cipher.AEAD
+
+// loadEncryptionKey sets up encryption at rest from ENCRYPTION_KEY, a base64
+// AES-256 key, or from the output of ENCRYPTION_KEY_COMMAND, e.g. a KMS call
+// decrypting a data key
+func loadEncryptionKey() error {
+	encoded := getEnv("ENCRYPTION_KEY", "")
+	if command := getEnv("ENCRYPTION_KEY_COMMAND", ""); command != "" {
+		if encoded != "" {
+			return errors.New("set ENCRYPTION_KEY or ENCRYPTION_KEY_COMMAND, not both")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), keyCommandTimeout)
+		defer cancel()
+		output, err := exec.CommandContext(ctx, "sh", "-c", command).Output()
+		if err != nil {
+			return fmt.Errorf("ENCRYPTION_KEY_COMMAND failed: %w", err)
+		}
+		encoded = string(output)
+	}
+	if encoded == "" {
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return errors.New("the encryption key must be 32 bytes, base64-encoded (openssl rand -base64 32)")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	if storageCipher, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	log.Println("Encryption at rest enabled for documents, trash and persisted records")
+	return nil
+}
+
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealedMagic)
+}
+
+// sealData encrypts data when encryption at rest is on, else returns it unchanged
+func sealData(data []byte) ([]byte, error) {
+	if storageCipher == nil {
+		return data, nil
+	}
+	nonce := make([]byte, storageCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, sealedMagic...), nonce...)
+	return storageCipher.Seal(out, nonce, data, sealedMagic), nil
+}
+
+// openData decrypts sealed data; data written without encryption is returned unchanged
+func openData(data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return data, nil
+	}
+	if storageCipher == nil {
+		return nil, errNoEncryptionKey
+	}
+	data = data[len(sealedMagic):]
+	if len(data) < storageCipher.NonceSize() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	nonce, ciphertext := data[:storageCipher.NonceSize()], data[storageCipher.NonceSize():]
+	plain, err := storageCipher.Open(nil, nonce, ciphertext, sealedMagic)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plain, nil
+}
+
+// sealRecord encodes a persisted record line. Encrypted records are written as
+// base64, keeping the files line-oriented.
+func sealRecord(data []byte) ([]byte, error) {
+	if storageCipher == nil {
+		return data, nil
+	}
+	sealed, err := sealData(data)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// openRecord decodes a persisted record line, encrypted or not
+func openRecord(line []byte) ([]byte, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '{' {
+		return line, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, err
+	}
+	return openData(sealed)
+}
+
+// writeStoredFile writes a file, encrypted when encryption at rest is on. The
+// file is replaced atomically.
+func writeStoredFile(path string, data []byte) error {
+	sealed, err := sealData(data)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, sealed, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readStoredFile reads a stored file, decrypting it when it is encrypted
+func readStoredFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return openData(data)
+}
+
+// openStoredFile returns a path holding the plain content of a stored file, for
+// extractors and tools that read files themselves. An encrypted file is decrypted
+// into a private temporary directory, which release removes.
+func openStoredFile(path string) (string, func(), error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	header := make([]byte, len(sealedMagic))
+	n, _ := io.ReadFull(file, header)
+	closeFile(file, path)
+	if !isSealed(header[:n]) {
+		return path, func() {}, nil
+	}
+
+	data, err := readStoredFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	return writePlainCopy(filepath.Base(path), data)
+}
+
+// writePlainCopy writes data into a private temporary directory under name,
+// keeping the extension extractors go by
+func writePlainCopy(name string, data []byte) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "rag-plain-")
+	if err != nil {
+		return "", nil, err
+	}
+	release := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Warning: failed to remove decrypted copy %s: %v", dir, err)
+		}
+	}
+	plainPath := filepath.Join(dir, name)
+	if err := os.WriteFile(plainPath, data, 0600); err != nil {
+		release()
+		return "", nil, err
+	}
+	return plainPath, release, nil
+}
+
+// serveStoredFile serves a stored file, decrypting it when it is encrypted
+func serveStoredFile(w http.ResponseWriter, r *http.Request, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		sendError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	data, err := readStoredFile(path)
+	if err != nil {
+		log.Printf("Failed to read %s: %v", path, err)
+		sendError(w, http.StatusInternalServerError, "Failed to read file")
+		return
+	}
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), bytes.NewReader(data))
+}
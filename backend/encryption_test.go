@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTestKey turns encryption at rest on with a new random key, or off for nil,
+// until the test ends
+func useTestKey(t *testing.T, key []byte) {
+	t.Helper()
+	saved := storageCipher
+	t.Cleanup(func() { storageCipher = saved })
+	storageCipher = nil
+	if key == nil {
+		return
+	}
+	t.Setenv("ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+	t.Setenv("ENCRYPTION_KEY_COMMAND", "")
+	if err := loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+	plain := []byte("Quarterly revenue was 4.2 million.")
+	key := newTestKey(t)
+	useTestKey(t, key)
+
+	sealed, err := sealData(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed) || bytes.Contains(sealed, plain) {
+		t.Fatalf("sealed data %q is not encrypted", sealed)
+	}
+	again, _ := sealData(plain)
+	if bytes.Equal(sealed, again) {
+		t.Error("sealing twice gave the same ciphertext")
+	}
+	if opened, err := openData(sealed); err != nil || !bytes.Equal(opened, plain) {
+		t.Fatalf("openData = %q, %v", opened, err)
+	}
+	if opened, err := openData(plain); err != nil || !bytes.Equal(opened, plain) {
+		t.Errorf("plain data opened as %q, %v", opened, err)
+	}
+
+	useTestKey(t, newTestKey(t))
+	if _, err := openData(sealed); !errors.Is(err, errDecrypt) {
+		t.Errorf("opening with another key: %v, want errDecrypt", err)
+	}
+	useTestKey(t, nil)
+	if _, err := openData(sealed); !errors.Is(err, errNoEncryptionKey) {
+		t.Errorf("opening without a key: %v, want errNoEncryptionKey", err)
+	}
+	if out, _ := sealData(plain); !bytes.Equal(out, plain) {
+		t.Errorf("sealing without a key changed the data to %q", out)
+	}
+}
+
+func TestOpenTamperedData(t *testing.T) {
+	useTestKey(t, newTestKey(t))
+	sealed, err := sealData([]byte("Payment is due within 30 days."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonceEnd := len(sealedMagic) + storageCipher.NonceSize()
+
+	tests := []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{"ciphertext", func(b []byte) []byte { b[nonceEnd+2] ^= 0x01; return b }},
+		{"authentication tag", func(b []byte) []byte { b[len(b)-1] ^= 0x80; return b }},
+		{"nonce", func(b []byte) []byte { b[len(sealedMagic)] ^= 0x01; return b }},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-4] }},
+		{"cut inside the nonce", func(b []byte) []byte { return b[:nonceEnd-1] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.tamper(append([]byte(nil), sealed...))
+			if opened, err := openData(data); err == nil {
+				t.Fatalf("tampered data opened as %q", opened)
+			}
+		})
+	}
+}
+
+func TestMixedPlainAndEncryptedRecords(t *testing.T) {
+	dir := t.TempDir()
+	useTestKey(t, nil)
+	openTestPersistence(t, dir)
+	documentStore.Set("plain.txt", persistTestDocument("plain.txt", "Written before encryption was enabled."))
+
+	// Turning encryption on keeps earlier records readable and seals new ones
+	useTestKey(t, newTestKey(t))
+	openTestPersistence(t, dir)
+	documentStore.Set("sealed.txt", persistTestDocument("sealed.txt", "Written with encryption on."))
+	doc, _ := documentStore.Get("plain.txt")
+	w := httptest.NewRecorder()
+	if !updateDocument(w, httptest.NewRequest("PUT", "/api/document/plain.txt/instructions", nil), doc, walInstructions, func() string {
+		doc.Instructions = "Amounts are in EUR."
+		return doc.Instructions
+	}) {
+		t.Fatalf("instructions not updated: %d %s", w.Code, w.Body.String())
+	}
+
+	segments, err := walSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plainLines, sealedLines int
+	for _, n := range segments {
+		data, err := os.ReadFile(walSegmentPath(dir, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+			switch {
+			case len(line) == 0:
+			case line[0] == '{':
+				plainLines++
+			default:
+				sealedLines++
+				if bytes.Contains(line, []byte("encryption on")) {
+					t.Error("an encrypted record holds the plain text")
+				}
+			}
+		}
+	}
+	if plainLines != 1 || sealedLines != 2 {
+		t.Fatalf("got %d plain and %d encrypted records, want 1 and 2", plainLines, sealedLines)
+	}
+
+	openTestPersistence(t, dir)
+	if names := storedNames(); len(names) != 2 {
+		t.Fatalf("restored %v, want plain.txt and sealed.txt", names)
+	}
+	if doc, _ := documentStore.Get("plain.txt"); doc.Instructions != "Amounts are in EUR." {
+		t.Errorf("plain.txt restored without the encrypted update, instructions %q", doc.Instructions)
+	}
+
+	// Compaction rewrites everything encrypted
+	if err := persistence.compact(); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(snapshot, []byte("{")) {
+		t.Error("the snapshot holds plain records")
+	}
+
+	// Without the key the store refuses to load rather than dropping documents
+	useTestKey(t, nil)
+	savedStore := documentStore
+	documentStore = NewDocumentStore()
+	defer func() { documentStore = savedStore }()
+	if _, err := openPersistence(dir); !errors.Is(err, errNoEncryptionKey) {
+		t.Errorf("opening without the key: %v, want errNoEncryptionKey", err)
+	}
+}
+
+func TestTamperedRecordStopsReplay(t *testing.T) {
+	dir := t.TempDir()
+	useTestKey(t, newTestKey(t))
+	p := openTestPersistence(t, dir)
+	documentStore.Set("a.txt", persistTestDocument("a.txt", "An encrypted record that is altered on disk."))
+
+	path := p.wal.Name()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed[len(sealed)-10] ^= 0x01
+	tampered := base64.StdEncoding.EncodeToString(sealed) + "\n"
+	if err := os.WriteFile(path, []byte(tampered), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := replayFile(path, NewDocumentStore(), 0); !errors.Is(err, errDecrypt) {
+		t.Errorf("replaying a tampered record: %v, want errDecrypt", err)
+	}
+}
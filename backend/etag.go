@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// MetadataRequest replaces a document's metadata; date is YYYY, YYYY-MM,
+// YYYY-MM-DD or RFC 3339
+type MetadataRequest struct {
+	Title   string            `json:"title"`
+	Author  string            `json:"author"`
+	Subject string            `json:"subject"`
+	Date    string            `json:"date"`
+	Tags    []string          `json:"tags"`
+	Custom  map[string]string `json:"custom"`
+}
+
+// documentETag identifies the version of a document's metadata, instructions,
+// summary and archive state. The creation time tells apart a document from an
+// earlier one of the same name. Callers hold the document lock.
+func documentETag(doc *Document) string {
+	return fmt.Sprintf(`"%d-%x"`, doc.Version, doc.CreatedAt.UnixNano())
+}
+
+// preconditionError checks a mutation's If-Match header against the document.
+// Without the header the mutation proceeds unless requireIfMatch is set. Callers
+// hold the document lock.
+func preconditionError(r *http.Request, doc *Document) error {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		if getConfig().RequireIfMatch {
+			return newAPIError(http.StatusPreconditionRequired, "If-Match is required; send the document's ETag")
+		}
+		return nil
+	}
+	return ifMatchError(header, doc)
+}
+
+// ifMatchError checks an If-Match header value against the document; callers
+// hold the document lock
+func ifMatchError(header string, doc *Document) error {
+	current := documentETag(doc)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == current {
+			return nil
+		}
+	}
+	return newAPIError(http.StatusPreconditionFailed, "The document was changed by someone else; reload it and retry")
+}
+
+// errSuperseded refuses a change to a document version that was replaced or
+// deleted while the change waited for it
+var errSuperseded = newAPIError(http.StatusConflict, "The document was replaced or deleted meanwhile; reload it and retry")
+
+// updateDocument applies a change to a document once its If-Match precondition
+// holds, bumping the version and logging the change with the value apply
+// returns. It sets the ETag header, or responds with the error and returns false.
+func updateDocument(w http.ResponseWriter, r *http.Request, doc *Document, op string, apply func() string) bool {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	if doc.superseded {
+		sendAPIError(w, errSuperseded)
+		return false
+	}
+	if err := preconditionError(r, doc); err != nil {
+		sendAPIError(w, err)
+		return false
+	}
+	value := apply()
+	doc.Version++
+	persistence.log(updateRecord(doc, op, value))
+	w.Header().Set("ETag", documentETag(doc))
+	return true
+}
+
+// updateDocumentLater is updateDocument for a change made after its request was
+// answered: the If-Match value the request came with, if any, must still hold
+func updateDocumentLater(doc *Document, ifMatch, op string, apply func() string) error {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	if doc.superseded {
+		return errSuperseded
+	}
+	if ifMatch = strings.TrimSpace(ifMatch); ifMatch != "" {
+		if err := ifMatchError(ifMatch, doc); err != nil {
+			return err
+		}
+	}
+	value := apply()
+	doc.Version++
+	persistence.log(updateRecord(doc, op, value))
+	return nil
+}
+
+// handleGetDocument returns a document's details without its text (GET /api/document/{name})
+func handleGetDocument(w http.ResponseWriter, r *http.Request, docName string) {
+	doc, ok := getDocumentOrError(w, docName)
+	if !ok {
+		return
+	}
+	doc.mu.RLock()
+	w.Header().Set("ETag", documentETag(doc))
+	details := map[string]interface{}{
+		"name":           doc.Name,
+		"collection":     doc.Collection,
+		"metadata":       doc.Metadata,
+		"instructions":   doc.Instructions,
+		"preset":         doc.Preset,
+		"chunkCount":     doc.ChunkCount,
+		"chunking":       doc.Chunking,
+		"contentHash":    doc.ContentHash,
+		"fileSize":       doc.FileSize,
+		"pageCount":      doc.PageCount,
+		"hasSummary":     doc.HasSummary && doc.Summary != "",
+		"embeddingModel": doc.EmbeddingModel,
+		"createdAt":      doc.CreatedAt,
+		"archivedAt":     doc.ArchivedAt,
+		"version":        doc.Version,
+	}
+	doc.mu.RUnlock()
+	sendJSON(w, http.StatusOK, details)
+}
+
+// handleDocumentMetadata reads (GET) or replaces (PUT) a document's metadata
+func handleDocumentMetadata(w http.ResponseWriter, r *http.Request, docName string) {
+	if r.Method != "GET" && !validateMethod(w, r, "PUT") {
+		return
+	}
+	doc, ok := getDocumentOrError(w, docName)
+	if !ok {
+		return
+	}
+
+	if r.Method == "GET" {
+		doc.mu.RLock()
+		w.Header().Set("ETag", documentETag(doc))
+		response := map[string]interface{}{"metadata": doc.Metadata, "version": doc.Version}
+		doc.mu.RUnlock()
+		sendJSON(w, http.StatusOK, response)
+		return
+	}
+
+	var req MetadataRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	date, err := parseMetadataDate(req.Date)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	meta := DocumentMetadata{
+		Title:   strings.TrimSpace(req.Title),
+		Author:  strings.TrimSpace(req.Author),
+		Subject: strings.TrimSpace(req.Subject),
+		Date:    date,
+		Tags:    parseTags(strings.Join(req.Tags, ",")),
+		Custom:  req.Custom,
+	}
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid metadata")
+		return
+	}
+
+	var version int64
+	if !updateDocument(w, r, doc, walMetadata, func() string {
+		doc.Metadata = meta
+		version = doc.Version + 1
+		return string(encoded)
+	}) {
+		return
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{"metadata": meta, "version": version})
+}
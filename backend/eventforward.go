@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	eventForwardQueue   = 1024 // Events waiting for the message broker before new ones are dropped
+	eventForwardRetries = 3    // Attempts per event, doubling the wait from eventForwardBackoff
+	eventForwardBackoff = time.Second
+)
+
+// eventSink is a message broker store events are forwarded to. publish sends a
+// payload to a subject or topic, keyed so events of one document stay in order.
+type eventSink interface {
+	publish(subject, key string, payload []byte) error
+	close()
+	String() string
+}
+
+// eventForwarder hands store events to a message broker in the order they were
+// raised, from a queue so a slow or unreachable broker never holds up a change
+type eventForwarder struct {
+	sink  eventSink
+	topic string
+	queue chan StoreEvent
+}
+
+// startEventForwarding forwards store events to EVENT_BROKER_URL when set: a
+// nats:// (tls://) or kafka:// url
+func startEventForwarding() error {
+	rawURL := getEnv("EVENT_BROKER_URL", "")
+	if rawURL == "" {
+		return nil
+	}
+	var sink eventSink
+	var err error
+	switch {
+	case strings.HasPrefix(rawURL, "nats://"), strings.HasPrefix(rawURL, "tls://"):
+		sink, err = newNATSClient(rawURL)
+	case strings.HasPrefix(rawURL, "kafka://"):
+		sink, err = newKafkaClient(rawURL)
+	default:
+		err = fmt.Errorf("unsupported event broker %q (use nats://, tls:// or kafka://)", rawURL)
+	}
+	if err != nil {
+		return err
+	}
+	topic := getEnv("EVENT_BROKER_TOPIC", "rag.events")
+	if topic == "" || strings.ContainsAny(topic, " \t\r\n") {
+		return fmt.Errorf("invalid EVENT_BROKER_TOPIC %q", topic)
+	}
+
+	f := &eventForwarder{sink: sink, topic: topic, queue: make(chan StoreEvent, eventForwardQueue)}
+	storeEvents.mu.Lock()
+	storeEvents.forward = f.queue
+	storeEvents.mu.Unlock()
+	go f.run()
+	log.Printf("Forwarding store events to %s (%s)", sink, topic)
+	return nil
+}
+
+func (f *eventForwarder) run() {
+	defer f.sink.close()
+	for event := range f.queue {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Failed to encode %s event: %v", event.Type, err)
+			continue
+		}
+		subject, key := f.destination(event)
+		wait := eventForwardBackoff
+		for attempt := 1; ; attempt++ {
+			err := f.sink.publish(subject, key, payload)
+			if err == nil {
+				break
+			}
+			if attempt == eventForwardRetries {
+				log.Printf("Dropped %s event %d after %d attempts: %v", event.Type, event.ID, attempt, err)
+				break
+			}
+			log.Printf("Failed to forward %s event %d, retrying in %v: %v", event.Type, event.ID, wait, err)
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+}
+
+// destination returns where an event goes. NATS subjects end in the event type,
+// so subscribers can pick types with wildcards; Kafka gets one topic, keyed by
+// the document or job the event is about.
+func (f *eventForwarder) destination(event StoreEvent) (string, string) {
+	key := event.Document
+	if event.Job != nil {
+		key = event.Job.ID
+	}
+	if _, ok := f.sink.(*natsClient); ok {
+		return f.topic + "." + event.Type, key
+	}
+	return f.topic, key
+}
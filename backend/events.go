@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store events
+const (
+	EventDocumentAdded   = "document-added"
+	EventDocumentDeleted = "document-deleted"
+	EventSummaryReady    = "summary-ready"
+	EventJobStateChange  = "job-state-change"
+)
+
+const (
+	eventHistory     = 256              // Recent events kept for clients resuming with Last-Event-ID
+	eventBuffer      = 64               // Events a client may fall behind by before it is dropped
+	eventKeepalive   = 30 * time.Second // Comment sent on idle streams so proxies keep them open
+	eventRetryMillis = 3000             // Reconnection delay suggested to clients
+)
+
+// StoreEvent is a change to the documents or jobs of this instance
+type StoreEvent struct {
+	ID         uint64     `json:"id"`
+	Type       string     `json:"type"`
+	Time       time.Time  `json:"time"`
+	Document   string     `json:"document,omitempty"`
+	Collection string     `json:"collection,omitempty"`
+	Version    int64      `json:"version,omitempty"`
+	Replaced   bool       `json:"replaced,omitempty"` // The added document replaced one of the same name
+	Job        *JobStatus `json:"job,omitempty"`      // Without its result, which /api/jobs/{id} returns
+}
+
+// eventBroker fans store events out to the streams of /api/events
+type eventBroker struct {
+	mu          sync.Mutex
+	next        uint64
+	recent      []StoreEvent
+	subscribers map[chan StoreEvent]bool
+	forward     chan StoreEvent // To the message broker, when EVENT_BROKER_URL is set
+}
+
+// Event IDs start from the clock, so those of an earlier run are lower and a
+// client resuming from one is told to resync
+var storeEvents = &eventBroker{
+	next:        uint64(time.Now().UnixMilli()) * 1000,
+	subscribers: make(map[chan StoreEvent]bool),
+}
+
+// publish numbers an event and sends it to every subscriber. Subscribers too far
+// behind are dropped rather than blocking the change that raised the event; they
+// resume from their last event when they reconnect.
+func (b *eventBroker) publish(event StoreEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.next++
+	event.ID, event.Time = b.next, time.Now()
+	b.recent = append(b.recent, event)
+	if len(b.recent) > eventHistory {
+		b.recent = b.recent[len(b.recent)-eventHistory:]
+	}
+	if b.forward != nil {
+		select {
+		case b.forward <- event:
+		default:
+			log.Printf("Event broker queue is full; dropped %s event %d", event.Type, event.ID)
+		}
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel of the events after lastID, starting with those
+// still kept, and reports whether events between lastID and them were lost
+func (b *eventBroker) subscribe(lastID uint64) (chan StoreEvent, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var missed []StoreEvent
+	gap := false
+	if lastID > 0 && lastID != b.next {
+		gap = lastID > b.next || len(b.recent) == 0 || b.recent[0].ID > lastID+1
+		for _, event := range b.recent {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+	ch := make(chan StoreEvent, eventBuffer+len(missed))
+	for _, event := range missed {
+		ch <- event
+	}
+	b.subscribers[ch] = true
+	return ch, gap
+}
+
+func (b *eventBroker) unsubscribe(ch chan StoreEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[ch] {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publishDocumentEvent raises a document event; callers may hold the document lock
+func publishDocumentEvent(eventType string, doc *Document, replaced bool) {
+	storeEvents.publish(StoreEvent{
+		Type:       eventType,
+		Document:   doc.Name,
+		Collection: doc.Collection,
+		Version:    doc.Version,
+		Replaced:   replaced,
+	})
+}
+
+func publishJobEvent(status JobStatus) {
+	status.Result = nil
+	storeEvents.publish(StoreEvent{Type: EventJobStateChange, Job: &status})
+}
+
+// eventsHandler serves GET /api/events: the changes to this instance's documents
+// and jobs as Server-Sent Events, named by type and carrying a StoreEvent each.
+// `?types=` picks event types. A client reconnecting with Last-Event-ID gets the
+// events it missed, or a `resync` event when they are no longer kept.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+	types := make(map[string]bool)
+	if raw := r.URL.Query().Get("types"); raw != "" {
+		for _, t := range strings.Split(raw, ",") {
+			switch t = strings.TrimSpace(t); t {
+			case EventDocumentAdded, EventDocumentDeleted, EventSummaryReady, EventJobStateChange:
+				types[t] = true
+			default:
+				sendError(w, http.StatusBadRequest, fmt.Sprintf("Unknown event type %q", t))
+				return
+			}
+		}
+	}
+	var lastID uint64
+	if raw := r.Header.Get("Last-Event-ID"); raw != "" {
+		lastID, _ = strconv.ParseUint(raw, 10, 64)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+	// The stream stays open for as long as the client listens
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to lift the write deadline for an event stream: %v", err)
+	}
+
+	events, gap := storeEvents.subscribe(lastID)
+	defer storeEvents.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetryMillis)
+	if gap {
+		// Events were missed; the client should reload the state it mirrors
+		fmt.Fprint(w, "event: resync\ndata: {}\n\n")
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case event, open := <-events:
+			if !open {
+				// Dropped for falling behind; the client reconnects and resumes
+				return
+			}
+			if len(types) > 0 && !types[event.Type] {
+				continue
+			}
+			payload, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Failed to encode %s event: %v", event.Type, err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, payload)
+			flusher.Flush()
+		}
+	}
+}
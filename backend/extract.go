@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	extractionJobType        = "extraction"
+	maxExtractionFields      = 30
+	extractionChunksPerField = 2  // Chunks retrieved for each field
+	maxExtractionChunks      = 12 // Excerpts given to the model per document
+	citationExcerptLength    = 200
+)
+
+// Field types accepted in extraction schemas
+var extractionTypes = map[string]bool{"string": true, "number": true, "integer": true, "boolean": true, "array": true}
+
+// ExtractionField is one column of an extraction, read from a JSON schema property
+type ExtractionField struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Items       string   `json:"items,omitempty"` // Element type of arrays
+	Format      string   `json:"format,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// ExtractionRequest names the fields to extract from each document of a collection
+type ExtractionRequest struct {
+	Schema          json.RawMessage `json:"schema"` // JSON schema of an object; its properties are the fields
+	Documents       []string        `json:"documents,omitempty"`
+	ModelName       string          `json:"modelName,omitempty"`
+	IncludeArchived bool            `json:"includeArchived,omitempty"`
+}
+
+// CellCitation is a passage a cell's value was extracted from
+type CellCitation struct {
+	Chunk   int    `json:"chunk"` // Chunk index in the document
+	Page    int    `json:"page,omitempty"`
+	Excerpt string `json:"excerpt"`
+}
+
+// ExtractionCell is one field of one document; Value is null when the document
+// does not state it
+type ExtractionCell struct {
+	Value       interface{}    `json:"value"`
+	Citations   []CellCitation `json:"citations"`
+	Unsupported bool           `json:"unsupported,omitempty"` // The model cited no passage for the value
+	Error       string         `json:"error,omitempty"`       // The value did not match the field's type
+}
+
+// ExtractionRow holds the cells extracted from one document
+type ExtractionRow struct {
+	Document string                    `json:"document"`
+	Title    string                    `json:"title,omitempty"`
+	Cells    map[string]ExtractionCell `json:"cells,omitempty"`
+	Error    string                    `json:"error,omitempty"`
+}
+
+// ExtractionResult is the table of an extraction, with rows sorted by document
+type ExtractionResult struct {
+	Collection string            `json:"collection"`
+	Fields     []ExtractionField `json:"fields"` // Columns, in schema order
+	Extracted  int               `json:"extracted"`
+	Failed     int               `json:"failed"`
+	Rows       []ExtractionRow   `json:"rows"`
+}
+
+type schemaProperty struct {
+	Type        string          `json:"type"`
+	Format      string          `json:"format"`
+	Enum        []string        `json:"enum"`
+	Description string          `json:"description"`
+	Items       *schemaProperty `json:"items"`
+}
+
+// parseExtractionSchema reads the fields of an object schema, keeping the order
+// of its properties
+func parseExtractionSchema(raw json.RawMessage) ([]ExtractionField, error) {
+	var schema struct {
+		Type       string          `json:"type"`
+		Properties json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(raw, &schema); err != nil || len(schema.Properties) == 0 {
+		return nil, errors.New("schema must be a JSON schema object with properties")
+	}
+	if schema.Type != "" && schema.Type != "object" {
+		return nil, errors.New("schema must have type object")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(schema.Properties))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errors.New("schema properties must be an object")
+	}
+	var fields []ExtractionField
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, errors.New("invalid schema properties")
+		}
+		name := tok.(string)
+		var p schemaProperty
+		if err := dec.Decode(&p); err != nil {
+			return nil, fmt.Errorf("invalid schema for field %s", name)
+		}
+		if p.Type == "" {
+			p.Type = "string"
+		}
+		if !extractionTypes[p.Type] {
+			return nil, fmt.Errorf("field %s: type must be string, number, integer, boolean or array", name)
+		}
+		field := ExtractionField{Name: name, Type: p.Type, Format: p.Format, Enum: p.Enum, Description: p.Description}
+		if p.Type == "array" {
+			field.Items = "string"
+			if p.Items != nil && p.Items.Type != "" {
+				field.Items = p.Items.Type
+			}
+			if field.Items == "array" || !extractionTypes[field.Items] {
+				return nil, fmt.Errorf("field %s: array items must be string, number, integer or boolean", name)
+			}
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) > maxExtractionFields {
+		return nil, fmt.Errorf("at most %d fields can be extracted at once", maxExtractionFields)
+	}
+	return fields, nil
+}
+
+// describe returns the field as listed in the prompt
+func (f ExtractionField) describe() string {
+	kind := f.Type
+	if f.Type == "array" {
+		kind = "list of " + f.Items + "s"
+	}
+	if f.Format != "" {
+		kind += ", " + f.Format
+	}
+	if len(f.Enum) > 0 {
+		kind += ", one of " + strings.Join(f.Enum, ", ")
+	}
+	line := fmt.Sprintf("- %s (%s)", f.Name, kind)
+	if f.Description != "" {
+		line += ": " + f.Description
+	}
+	return line
+}
+
+// searchTerms turns a field into a retrieval query: its name split into words
+// ("effectiveDate" -> "effective date") and its description
+func (f ExtractionField) searchTerms() string {
+	var b strings.Builder
+	prev := ' '
+	for _, r := range f.Name {
+		if unicode.IsUpper(r) && unicode.IsLower(prev) {
+			b.WriteRune(' ')
+		}
+		if r == '_' || r == '-' {
+			r = ' '
+		}
+		b.WriteRune(unicode.ToLower(r))
+		prev = r
+	}
+	return b.String() + " " + f.Description
+}
+
+// coerce converts a model-given value to the field's type
+func (f ExtractionField) coerce(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if f.Type != "array" {
+		return coerceScalar(f.Type, v)
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	values := make([]interface{}, 0, len(list))
+	for _, item := range list {
+		value, err := coerceScalar(f.Items, item)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+func coerceScalar(kind string, v interface{}) (interface{}, error) {
+	switch kind {
+	case "number", "integer":
+		n, ok := v.(float64)
+		if s, isString := v.(string); isString {
+			parsed, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(s), ",", ""), 64)
+			n, ok = parsed, err == nil
+		}
+		if !ok || (kind == "integer" && n != float64(int64(n))) {
+			return nil, fmt.Errorf("expected %s, got %v", kind, v)
+		}
+		return n, nil
+	case "boolean":
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			switch strings.ToLower(strings.TrimSpace(b)) {
+			case "true", "yes":
+				return true, nil
+			case "false", "no":
+				return false, nil
+			}
+		}
+		return nil, fmt.Errorf("expected boolean, got %v", v)
+	default:
+		switch s := v.(type) {
+		case string:
+			return strings.TrimSpace(s), nil
+		case float64, bool:
+			return fmt.Sprint(s), nil
+		}
+		return nil, fmt.Errorf("expected string, got %v", v)
+	}
+}
+
+// extractionChunks retrieves the chunks likely to hold each field and returns
+// their indices in document order; callers hold the document lock
+func extractionChunks(doc *Document, fields []ExtractionField) ([]int, error) {
+	allowed, err := queryChunks(doc, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	picked := make(map[int]bool)
+	for _, field := range fields {
+		query := field.searchTerms()
+		rank := newChunkRanking(doc, query, allowed)
+		var indices []int
+		if doc.hasVectors() {
+			ranked, _, err := doc.rankByEmbedding(query, rank)
+			if err == nil {
+				indices = ranked[:min(extractionChunksPerField, len(ranked))]
+			}
+		}
+		if indices == nil {
+			_, indices, _ = keywordRetrieve(doc, query, rank, extractionChunksPerField)
+		}
+		for _, idx := range indices {
+			if len(picked) < maxExtractionChunks {
+				picked[idx] = true
+			}
+		}
+	}
+	// Without any match the first chunks are given, as for queries
+	if len(picked) == 0 {
+		for i := 0; i < len(doc.Chunks) && len(picked) < maxExtractionChunks; i++ {
+			if allowed.has(i) {
+				picked[i] = true
+			}
+		}
+	}
+
+	indices := make([]int, 0, len(picked))
+	for idx := range picked {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+	return indices, nil
+}
+
+// extractDocument fills one row of the table from a document's passages
+func extractDocument(ctx context.Context, name string, fields []ExtractionField, model string) ExtractionRow {
+	row := ExtractionRow{Document: name}
+	ctx = documentCacheContext(ctx, name)
+	doc, exists := documentStore.Get(name)
+	if !exists {
+		row.Error = "Document not found"
+		return row
+	}
+
+	doc.mu.RLock()
+	row.Title = doc.Metadata.Title
+	indices, err := extractionChunks(doc, fields)
+	chunks := make([]string, len(indices))
+	pages := make([]int, len(indices))
+	for i, idx := range indices {
+		chunks[i] = doc.Chunks[idx]
+		if len(doc.ChunkPages) > idx {
+			pages[i] = doc.ChunkPages[idx]
+		}
+	}
+	instructions := doc.Instructions
+	doc.mu.RUnlock()
+	if err != nil {
+		row.Error = err.Error()
+		return row
+	}
+	if len(chunks) == 0 {
+		row.Error = "The document has no text to extract from"
+		return row
+	}
+
+	var b strings.Builder
+	b.WriteString("Fields:\n")
+	for _, field := range fields {
+		b.WriteString(field.describe() + "\n")
+	}
+	b.WriteString("\nExcerpts:\n")
+	for i, chunk := range chunks {
+		fmt.Fprintf(&b, "[%d] %s\n\n", i+1, chunk)
+	}
+	prompt := fmt.Sprintf(`Extract the fields below from the numbered excerpts of one document. Use only what the excerpts state and do not guess; a field the excerpts do not state is null. Reply with a JSON object only, with one key per field whose value is {"value": ..., "sources": [numbers of the excerpts stating it]}.
+
+%s
+JSON:`, b.String())
+	prompt = withDocumentInstructions(prompt, instructions)
+
+	reply, _, err := cachedAnswer(ctx, prompt, model)
+	if err != nil {
+		row.Error = fmt.Sprintf("Failed to get response: %v", err)
+		return row
+	}
+	start, end := strings.Index(reply, "{"), strings.LastIndex(reply, "}")
+	var values map[string]json.RawMessage
+	if start < 0 || end < start || json.Unmarshal([]byte(reply[start:end+1]), &values) != nil {
+		row.Error = "The model did not reply with a JSON object"
+		return row
+	}
+
+	row.Cells = make(map[string]ExtractionCell, len(fields))
+	for _, field := range fields {
+		cell := ExtractionCell{Citations: []CellCitation{}}
+		var answer struct {
+			Value   interface{}   `json:"value"`
+			Sources []interface{} `json:"sources"`
+		}
+		// Bare values, without the value/sources object, are accepted uncited
+		if raw, ok := values[field.Name]; ok {
+			if json.Unmarshal(raw, &answer) != nil || (answer.Value == nil && answer.Sources == nil) {
+				answer.Sources = nil
+				json.Unmarshal(raw, &answer.Value)
+			}
+		}
+		value, err := field.coerce(answer.Value)
+		if err != nil {
+			cell.Error = err.Error()
+		}
+		cell.Value = value
+		for _, source := range answer.Sources {
+			n, ok := source.(float64)
+			if s, isString := source.(string); isString {
+				parsed, err := strconv.Atoi(strings.Trim(s, "[] "))
+				n, ok = float64(parsed), err == nil
+			}
+			if i := int(n) - 1; ok && i >= 0 && i < len(chunks) {
+				excerpt := chunks[i]
+				if len(excerpt) > citationExcerptLength {
+					excerpt = strings.ToValidUTF8(excerpt[:citationExcerptLength], "") + "…"
+				}
+				cell.Citations = append(cell.Citations, CellCitation{Chunk: indices[i], Page: pages[i], Excerpt: excerpt})
+			}
+		}
+		cell.Unsupported = cell.Value != nil && len(cell.Citations) == 0
+		row.Cells[field.Name] = cell
+	}
+	return row
+}
+
+// runExtraction extracts the fields from each document, publishing rows as they
+// complete
+func runExtraction(ctx context.Context, job *Job, collection string, fields []ExtractionField, names []string, model string) (interface{}, error) {
+	result := &ExtractionResult{Collection: collection, Fields: fields, Rows: make([]ExtractionRow, 0, len(names))}
+	var mu sync.Mutex
+	job.SetProgress(0, len(names))
+
+	forEachDocument(ctx, names, func(name string) {
+		row := extractDocument(ctx, name, fields, model)
+
+		mu.Lock()
+		if row.Error != "" {
+			result.Failed++
+		} else {
+			result.Extracted++
+		}
+		result.Rows = append(result.Rows, row)
+		sort.Slice(result.Rows, func(i, j int) bool { return result.Rows[i].Document < result.Rows[j].Document })
+		snapshot := *result
+		snapshot.Rows = append([]ExtractionRow(nil), result.Rows...)
+		mu.Unlock()
+		job.Update(func(s *JobStatus) {
+			s.Result = &snapshot
+			s.Progress.Done = snapshot.Extracted + snapshot.Failed
+		})
+	})
+
+	job.Update(func(s *JobStatus) {
+		s.Message = fmt.Sprintf("Extracted %d fields from %d of %d documents", len(fields), result.Extracted, len(names))
+	})
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if result.Failed > 0 && result.Extracted == 0 {
+		return result, fmt.Errorf("all %d documents failed", result.Failed)
+	}
+	return result, nil
+}
+
+// handleCollectionExtract starts a job extracting schema fields from every
+// document in a collection (POST /api/collection/{name}/extract)
+func handleCollectionExtract(w http.ResponseWriter, r *http.Request, collection string) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	var req ExtractionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	fields, err := parseExtractionSchema(req.Schema)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	names, err := collectionTargets(collection, req.Documents, req.IncludeArchived)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	model := modelOrDefault(req.ModelName)
+	job := jobStore.Start(tenant, extractionJobType, "documents", func(ctx context.Context, job *Job) (interface{}, error) {
+		return runExtraction(ctx, job, collection, fields, names, model)
+	})
+
+	sendJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message": fmt.Sprintf("Extracting %d fields from %d documents", len(fields), len(names)),
+		"job":     job.Snapshot(),
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits on a tenant's pinned facts, which go into every prompt
+const (
+	maxPinnedFacts      = 50
+	maxPinnedFactLength = 500
+)
+
+// PinnedFact is a fact or preference a tenant wants every answer to respect, such
+// as "our fiscal year starts in April" or "always answer in bullet points"
+type PinnedFact struct {
+	ID        string    `json:"id"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// PinnedFactRequest creates or replaces a pinned fact
+type PinnedFactRequest struct {
+	Text string `json:"text"`
+}
+
+// factsMu serializes this instance's read-modify-write of pinned facts
+var factsMu sync.Mutex
+
+func pinnedFactsKey(tenant string) string {
+	return "facts:" + tenant
+}
+
+// pinnedFacts returns a tenant's facts in the order they were pinned
+func pinnedFacts(tenant string) []PinnedFact {
+	var facts []PinnedFact
+	getJSON(pinnedFactsKey(tenant), &facts)
+	return facts
+}
+
+// updatePinnedFacts applies a change to a tenant's facts and stores the result
+func updatePinnedFacts(tenant string, change func([]PinnedFact) ([]PinnedFact, error)) error {
+	factsMu.Lock()
+	defer factsMu.Unlock()
+	facts, err := change(pinnedFacts(tenant))
+	if err != nil {
+		return err
+	}
+	setJSON(pinnedFactsKey(tenant), facts, 0)
+	return nil
+}
+
+// withPinnedFacts prepends a tenant's pinned facts to a prompt
+func withPinnedFacts(prompt string, facts []PinnedFact) string {
+	if len(facts) == 0 {
+		return prompt
+	}
+	var b strings.Builder
+	b.WriteString("Facts and preferences of this user (take them into account):\n")
+	for _, fact := range facts {
+		fmt.Fprintf(&b, "- %s\n", fact.Text)
+	}
+	return b.String() + "\n" + prompt
+}
+
+// pinnedFactText validates the text of a fact
+func pinnedFactText(r *http.Request) (string, error) {
+	var req PinnedFactRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return "", newAPIError(http.StatusBadRequest, "Invalid request")
+	}
+	text := strings.Join(strings.Fields(req.Text), " ")
+	if text == "" {
+		return "", newAPIError(http.StatusBadRequest, "Fact text is required")
+	}
+	if utf8.RuneCountInString(text) > maxPinnedFactLength {
+		return "", newAPIError(http.StatusBadRequest, fmt.Sprintf("Facts are limited to %d characters", maxPinnedFactLength))
+	}
+	return text, nil
+}
+
+// factsHandler lists (GET) or pins (POST) the tenant's facts
+func factsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && !validateMethod(w, r, "POST") {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	if r.Method == "GET" {
+		facts := pinnedFacts(tenant)
+		if facts == nil {
+			facts = []PinnedFact{}
+		}
+		sendJSON(w, http.StatusOK, map[string]interface{}{"facts": facts})
+		return
+	}
+
+	text, err := pinnedFactText(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	now := time.Now().UTC()
+	fact := PinnedFact{ID: randomID(), Text: text, CreatedAt: now, UpdatedAt: now}
+	err = updatePinnedFacts(tenant, func(facts []PinnedFact) ([]PinnedFact, error) {
+		if len(facts) >= maxPinnedFacts {
+			return nil, newAPIError(http.StatusConflict, fmt.Sprintf("At most %d facts can be pinned", maxPinnedFacts))
+		}
+		return append(facts, fact), nil
+	})
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusCreated, fact)
+}
+
+// handleFactByID reads (GET), replaces (PUT) or unpins (DELETE) one of the tenant's facts
+func handleFactByID(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/facts/"), "/")
+	if id == "" {
+		factsHandler(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "PUT" && !validateMethod(w, r, "DELETE") {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	notFound := newAPIError(http.StatusNotFound, "Fact not found")
+
+	switch r.Method {
+	case "GET":
+		for _, fact := range pinnedFacts(tenant) {
+			if fact.ID == id {
+				sendJSON(w, http.StatusOK, fact)
+				return
+			}
+		}
+		sendAPIError(w, notFound)
+	case "PUT":
+		text, err := pinnedFactText(r)
+		if err != nil {
+			sendAPIError(w, err)
+			return
+		}
+		var updated PinnedFact
+		err = updatePinnedFacts(tenant, func(facts []PinnedFact) ([]PinnedFact, error) {
+			for i := range facts {
+				if facts[i].ID == id {
+					facts[i].Text = text
+					facts[i].UpdatedAt = time.Now().UTC()
+					updated = facts[i]
+					return facts, nil
+				}
+			}
+			return nil, notFound
+		})
+		if err != nil {
+			sendAPIError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, updated)
+	case "DELETE":
+		err := updatePinnedFacts(tenant, func(facts []PinnedFact) ([]PinnedFact, error) {
+			for i := range facts {
+				if facts[i].ID == id {
+					return append(facts[:i], facts[i+1:]...), nil
+				}
+			}
+			return nil, notFound
+		})
+		if err != nil {
+			sendAPIError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, map[string]string{"message": "Fact deleted"})
+	}
+}
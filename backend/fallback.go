@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+)
+
+// What a query does when no chunk matches it
+const (
+	FallbackFirst   = "first"   // Answer from the first chunks of the document
+	FallbackVector  = "vector"  // Rank the chunks by embedding similarity instead
+	FallbackSummary = "summary" // Answer from the document summary alone
+	FallbackNone    = "none"    // Reply that nothing relevant was found, without calling the model
+)
+
+// Most chunks embedded while answering a query with the vector fallback, for
+// documents without stored embeddings
+const fallbackEmbedLimit = 50
+
+// Reply to queries nothing relevant was found for
+const noRelevantContent = "No relevant content found in the document."
+
+func validFallback(fallback string) bool {
+	switch fallback {
+	case "", FallbackFirst, FallbackVector, FallbackSummary, FallbackNone:
+		return true
+	}
+	return false
+}
+
+// retrievalFallback picks the fallback of a query: the request's, else its
+// document's collection's, else the configured one
+func retrievalFallback(requested string, doc *Document) string {
+	if requested != "" {
+		return requested
+	}
+	if c, exists := collectionStore.Get(doc.Collection); exists && c.Fallback != "" {
+		return c.Fallback
+	}
+	return getConfig().RetrievalFallback
+}
+
+// vectorFallback ranks the allowed chunks by embedding similarity to the query,
+// with the document's embeddings or, for chunks without one, embeddings computed
+// now with its collection's model or EMBEDDING_MODEL, up to fallbackEmbedLimit. Callers hold the
+// document lock.
+func vectorFallback(ctx context.Context, doc *Document, query string, rank *chunkRanking, maxChunks int) ([]string, []int) {
+	model := doc.EmbeddingModel
+	if model == "" {
+		model = defaultEmbeddingModel(doc.Collection)
+	}
+	if model == "" {
+		return nil, nil
+	}
+	raw, err := callOllamaEmbedding(ctx, query, model)
+	if err != nil {
+		log.Printf("Vector fallback failed for %s: %v", doc.Name, err)
+		return nil, nil
+	}
+	queryVec := quantizeVector(raw)
+
+	type scored struct {
+		index int
+		score float64
+	}
+	var scores []scored
+	embedded := 0
+	for i, chunk := range doc.Chunks {
+		if !rank.allowed.has(i) {
+			continue
+		}
+		var vec QuantizedVector
+		if i < len(doc.Embeddings) && doc.EmbeddingModel == model {
+			vec = doc.Embeddings[i]
+		} else {
+			if embedded == fallbackEmbedLimit {
+				continue
+			}
+			embedded++
+			raw, err := callOllamaEmbedding(ctx, chunk, model)
+			if err != nil {
+				log.Printf("Vector fallback stopped embedding %s: %v", doc.Name, err)
+				break
+			}
+			vec = quantizeVector(raw)
+		}
+		if vec.Dim() == queryVec.Dim() {
+			scores = append(scores, scored{i, rank.similarity(i, cosineSimilarity(vec, queryVec))})
+		}
+	}
+	sort.SliceStable(scores, func(a, b int) bool { return scores[a].score > scores[b].score })
+
+	var topChunks []string
+	var topIndices []int
+	for _, s := range scores[:min(maxChunks, len(scores))] {
+		topChunks = append(topChunks, doc.Chunks[s.index])
+		topIndices = append(topIndices, s.index)
+		doc.recordRetrieval(s.index)
+	}
+	return topChunks, topIndices
+}
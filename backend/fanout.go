@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	fanOutJobType      = "collection-query"
+	maxFanOutDocuments = 500
+)
+
+// FanOutRequest asks one question of every document in a collection. The query
+// fields are those of /api/document/query, without documentName.
+type FanOutRequest struct {
+	QueryRequest
+	Documents []string `json:"documents,omitempty"` // Only these documents of the collection
+}
+
+// FanOutAnswer is one row of the answer table
+type FanOutAnswer struct {
+	Document    string            `json:"document"`
+	Title       string            `json:"title,omitempty"`
+	Answer      string            `json:"answer,omitempty"`
+	Confidence  *AnswerConfidence `json:"confidence,omitempty"`
+	Citations   []string          `json:"citations,omitempty"`
+	SourcePages []int             `json:"sourcePages,omitempty"`
+	AnswerID    string            `json:"answerId,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// FanOutResult is the answer table of a collection query, sorted by document
+type FanOutResult struct {
+	Collection string         `json:"collection"`
+	Query      string         `json:"query"`
+	Answered   int            `json:"answered"`
+	Failed     int            `json:"failed"`
+	Rows       []FanOutAnswer `json:"rows"`
+}
+
+// fanOutWorkers is how many documents are queried at once: the Ollama slots
+// background work may use, so the table fills as fast as the limiter allows
+// without queueing ahead of interactive queries
+func fanOutWorkers() int {
+	cfg := getConfig()
+	return max(1, cfg.MaxConcurrentOllama-cfg.InteractiveReserved)
+}
+
+// forEachDocument calls fn for each document name on fanOutWorkers goroutines,
+// stopping early once ctx is cancelled
+func forEachDocument(ctx context.Context, names []string, fn func(name string)) {
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for range min(fanOutWorkers(), len(names)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				fn(name)
+			}
+		}()
+	}
+	for _, name := range names {
+		select {
+		case work <- name:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(work)
+	wg.Wait()
+}
+
+// runFanOut answers the query from each document, publishing the rows as they
+// complete
+func runFanOut(ctx context.Context, job *Job, collection string, req QueryRequest, names []string) (interface{}, error) {
+	result := &FanOutResult{Collection: collection, Query: req.Query, Rows: make([]FanOutAnswer, 0, len(names))}
+	var mu sync.Mutex
+	job.SetProgress(0, len(names))
+
+	forEachDocument(ctx, names, func(name string) {
+		row := FanOutAnswer{Document: name}
+		if doc, exists := documentStore.Get(name); exists {
+			doc.mu.RLock()
+			row.Title = doc.Metadata.Title
+			doc.mu.RUnlock()
+		}
+		docReq := req
+		docReq.DocumentName = name
+		resp, err := runQueryContext(ctx, docReq)
+		if err != nil {
+			row.Error = err.Error()
+		} else {
+			row.Answer = strings.TrimSpace(resp.Response)
+			row.Confidence = resp.Confidence
+			row.Citations = resp.Citations
+			row.SourcePages = resp.SourcePages
+			row.AnswerID = resp.AnswerID
+		}
+
+		mu.Lock()
+		if row.Error != "" {
+			result.Failed++
+		} else {
+			result.Answered++
+		}
+		result.Rows = append(result.Rows, row)
+		sort.Slice(result.Rows, func(i, j int) bool { return result.Rows[i].Document < result.Rows[j].Document })
+		snapshot := *result
+		snapshot.Rows = append([]FanOutAnswer(nil), result.Rows...)
+		mu.Unlock()
+		job.Update(func(s *JobStatus) {
+			s.Result = &snapshot
+			s.Progress.Done = snapshot.Answered + snapshot.Failed
+		})
+	})
+
+	job.Update(func(s *JobStatus) {
+		s.Message = fmt.Sprintf("Answered from %d of %d documents", result.Answered, len(names))
+	})
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if result.Failed > 0 && result.Answered == 0 {
+		return result, fmt.Errorf("all %d documents failed", result.Failed)
+	}
+	return result, nil
+}
+
+// collectionTargets returns the sorted names of a collection's documents, or of
+// those listed in documents; archived documents only with includeArchived
+func collectionTargets(collection string, documents []string, includeArchived bool) ([]string, error) {
+	var names []string
+	for _, doc := range activeDocuments(documentStore.ByCollection(collection), includeArchived) {
+		if len(documents) == 0 || slices.Contains(documents, doc.Name) {
+			names = append(names, doc.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, newAPIError(http.StatusNotFound, "The collection has no matching documents")
+	}
+	if len(names) > maxFanOutDocuments {
+		return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("At most %d documents can be processed at once; narrow with documents", maxFanOutDocuments))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// handleCollectionQuery starts a job asking the same question of every document
+// in a collection (POST /api/collection/{name}/query)
+func handleCollectionQuery(w http.ResponseWriter, r *http.Request, collection string) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+
+	var req FanOutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	req.Query = strings.TrimSpace(req.Query)
+	if req.Query == "" {
+		sendError(w, http.StatusBadRequest, "query is required")
+		return
+	}
+	if req.CitationStyle != "" && !validCitationStyle(req.CitationStyle) {
+		sendError(w, http.StatusBadRequest, "Unsupported citation style")
+		return
+	}
+	if !validVerifyMethod(req.Verify) {
+		sendError(w, http.StatusBadRequest, "verify must be lexical or llm")
+		return
+	}
+	if !validTableMode(req.TableMode) {
+		sendError(w, http.StatusBadRequest, "tableMode must be auto or off")
+		return
+	}
+	if _, err := spellingMode(req.Spelling); err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	names, err := collectionTargets(collection, req.Documents, req.IncludeArchived)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	// Answers are not recorded in a chat session or spoken
+	query := req.QueryRequest
+	query.DocumentName, query.SessionID, query.Speech = "", "", false
+	query.Tenant = tenant
+	job := jobStore.Start(tenant, fanOutJobType, "documents", func(ctx context.Context, job *Job) (interface{}, error) {
+		return runFanOut(ctx, job, collection, query, names)
+	})
+
+	sendJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message": fmt.Sprintf("Querying %d documents", len(names)),
+		"job":     job.Snapshot(),
+	})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Chunk metadata holding a chunk's own date, e.g. a mapped record field
+const MetaDate = "date"
+
+// QueryFilters restrict the chunks a query may retrieve. All given conditions must hold.
+type QueryFilters struct {
+	Tags     []string          `json:"tags,omitempty"`     // The document carries every tag
+	Pages    *PageRange        `json:"pages,omitempty"`    // Chunk starts within the pages (PDFs)
+	Section  string            `json:"section,omitempty"`  // Chunk lies in the TOC section
+	DateFrom string            `json:"dateFrom,omitempty"` // YYYY, YYYY-MM or YYYY-MM-DD
+	DateTo   string            `json:"dateTo,omitempty"`   // Inclusive: 2024 covers all of 2024
+	Metadata map[string]string `json:"metadata,omitempty"` // Chunk or document custom metadata equals the value
+	Exclude  *Exclusions       `json:"exclude,omitempty"`  // Added to the collection's exclusions
+}
+
+// Exclusions keep matching chunks out of query context
+type Exclusions struct {
+	Terms    []string `json:"terms,omitempty"`    // Words or phrases, matched as whole words ignoring case and punctuation
+	Sections []string `json:"sections,omitempty"` // Matched against TOC headings, ignoring case
+}
+
+func (e *Exclusions) validate() error {
+	for _, term := range e.Terms {
+		if len(termWords(term)) == 0 {
+			return fmt.Errorf("invalid exclusion term %q", term)
+		}
+	}
+	for _, section := range e.Sections {
+		if strings.TrimSpace(section) == "" {
+			return fmt.Errorf("exclusion sections must not be empty")
+		}
+	}
+	return nil
+}
+
+// termWords splits a term into normalized words
+func termWords(term string) []string {
+	var words []string
+	for _, w := range strings.Fields(term) {
+		if n := normalizeWord(w); n != "" {
+			words = append(words, n)
+		}
+	}
+	return words
+}
+
+// exclude clears chunks containing an excluded term or lying in an excluded section
+func (e *Exclusions) exclude(doc *Document, allowed chunkSet) {
+	for _, entry := range doc.TOC {
+		for _, section := range e.Sections {
+			if entry.ChunkStart >= 0 && strings.Contains(strings.ToLower(entry.Title), strings.ToLower(strings.TrimSpace(section))) {
+				for i := entry.ChunkStart; i < entry.ChunkEnd && i < len(allowed); i++ {
+					allowed[i] = false
+				}
+			}
+		}
+	}
+	if len(e.Terms) == 0 {
+		return
+	}
+	// Words are compared with single spaces around them, so " legal boilerplate "
+	// matches the phrase but "legal" does not match "illegal"
+	terms := make([]string, 0, len(e.Terms))
+	for _, term := range e.Terms {
+		terms = append(terms, " "+strings.Join(termWords(term), " ")+" ")
+	}
+	for i, chunk := range doc.Chunks {
+		if !allowed[i] {
+			continue
+		}
+		normalized := " " + strings.Join(termWords(chunk), " ") + " "
+		for _, term := range terms {
+			if strings.Contains(normalized, term) {
+				allowed[i] = false
+				break
+			}
+		}
+	}
+}
+
+// PageRange is an inclusive range of 1-based pages; a zero bound is open
+type PageRange struct {
+	From int `json:"from,omitempty"`
+	To   int `json:"to,omitempty"`
+}
+
+// chunkSet marks the chunks of a document retrieval may use; nil allows every chunk
+type chunkSet []bool
+
+func (s chunkSet) has(i int) bool {
+	return s == nil || s[i]
+}
+
+// queryChunks returns the chunks a query may retrieve from, combining its section,
+// filters and the exclusions of the document's collection; callers hold the document lock
+func queryChunks(doc *Document, section string, f *QueryFilters) (chunkSet, error) {
+	var exclusions []*Exclusions
+	if c, exists := collectionStore.Get(doc.Collection); exists && c.Exclusions != nil {
+		exclusions = append(exclusions, c.Exclusions)
+	}
+	if f != nil && f.Exclude != nil {
+		if err := f.Exclude.validate(); err != nil {
+			return nil, newAPIError(http.StatusBadRequest, err.Error())
+		}
+		exclusions = append(exclusions, f.Exclude)
+	}
+	if section == "" && f == nil && exclusions == nil {
+		return nil, nil
+	}
+
+	allowed := make(chunkSet, len(doc.Chunks))
+	for i := range allowed {
+		allowed[i] = true
+	}
+	for _, e := range exclusions {
+		e.exclude(doc, allowed)
+	}
+	restrictToSection := func(ref string) error {
+		s, found := findSection(doc.TOC, ref)
+		if !found {
+			return newAPIError(http.StatusBadRequest, fmt.Sprintf("Section not found: %s", ref))
+		}
+		for i := range allowed {
+			if i < s.ChunkStart || i >= s.ChunkEnd {
+				allowed[i] = false
+			}
+		}
+		return nil
+	}
+	if section != "" {
+		if err := restrictToSection(section); err != nil {
+			return nil, err
+		}
+	}
+	if f == nil {
+		return allowed, nil
+	}
+	if f.Section != "" {
+		if err := restrictToSection(f.Section); err != nil {
+			return nil, err
+		}
+	}
+
+	from, err := parseMetadataDate(f.DateFrom)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, err.Error())
+	}
+	to, err := periodEnd(f.DateTo)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, err.Error())
+	}
+
+	for _, tag := range f.Tags {
+		if !hasTag(doc.Metadata.Tags, tag) {
+			// The whole document is excluded
+			return make(chunkSet, len(doc.Chunks)), nil
+		}
+	}
+
+	for i := range allowed {
+		if !allowed[i] {
+			continue
+		}
+		if f.Pages != nil {
+			page := 0
+			if i < len(doc.ChunkPages) {
+				page = doc.ChunkPages[i]
+			}
+			if page == 0 || f.Pages.From > 0 && page < f.Pages.From || f.Pages.To > 0 && page > f.Pages.To {
+				allowed[i] = false
+				continue
+			}
+		}
+		if from != nil || to != nil {
+			date := doc.chunkDate(i)
+			if date == nil || from != nil && date.Before(*from) || to != nil && !date.Before(*to) {
+				allowed[i] = false
+				continue
+			}
+		}
+		for key, want := range f.Metadata {
+			if !metadataMatches(doc.chunkMetadataValue(i, key), want) {
+				allowed[i] = false
+				break
+			}
+		}
+	}
+	return allowed, nil
+}
+
+// periodEnd returns the instant after the period a date names, so "2024-03" ends
+// at the start of April
+func periodEnd(value string) (*time.Time, error) {
+	t, err := parseMetadataDate(value)
+	if t == nil || err != nil {
+		return t, err
+	}
+	var end time.Time
+	switch len(strings.TrimSpace(value)) {
+	case len("2006"):
+		end = t.AddDate(1, 0, 0)
+	case len("2006-01"):
+		end = t.AddDate(0, 1, 0)
+	case len("2006-01-02"):
+		end = t.AddDate(0, 0, 1)
+	default:
+		end = t.Add(time.Nanosecond)
+	}
+	return &end, nil
+}
+
+// chunkDate is the date in a chunk's metadata, or else the document's date
+func (d *Document) chunkDate(i int) *time.Time {
+	if i < len(d.ChunkMetadata) {
+		if t, err := parseMetadataDate(d.ChunkMetadata[i][MetaDate]); err == nil && t != nil {
+			return t
+		}
+	}
+	return d.Metadata.Date
+}
+
+// chunkMetadataValue looks a key up in a chunk's metadata, then the document's
+func (d *Document) chunkMetadataValue(i int, key string) string {
+	if i < len(d.ChunkMetadata) {
+		if v, ok := d.ChunkMetadata[i][key]; ok {
+			return v
+		}
+	}
+	return d.Metadata.Custom[key]
+}
+
+// metadataMatches compares case-insensitively with the whole value or with any
+// item of a comma-separated list such as mapped array fields
+func metadataMatches(value, want string) bool {
+	if strings.EqualFold(value, want) {
+		return true
+	}
+	for _, item := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(item), want) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTags splits a comma-separated tag list, dropping blanks and duplicates
+func parseTags(value string) []string {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" && !hasTag(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
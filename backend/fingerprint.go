@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// fileFingerprint returns the SHA-256 of a file, hex-encoded, and its size
+func fileFingerprint(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer closeFile(file, path)
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// handleHeadDocument answers HEAD /api/document/{name} with the fingerprint of the
+// uploaded file and the parameters it was processed with, so a sync tool can tell
+// whether a local file needs uploading again without fetching anything. Documents
+// stored before fingerprinting have no hash until they are uploaded again.
+func handleHeadDocument(w http.ResponseWriter, docName string) {
+	doc, exists := documentStore.Get(docName)
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	header := w.Header()
+	header.Set("ETag", documentETag(doc))
+	header.Set("Last-Modified", doc.CreatedAt.UTC().Format(http.TimeFormat))
+	if doc.ContentHash != "" {
+		header.Set("X-Content-SHA256", doc.ContentHash)
+		header.Set("X-Content-Size", strconv.FormatInt(doc.FileSize, 10))
+	}
+	if doc.Chunking.Strategy != "" {
+		header.Set("X-Chunk-Strategy", doc.Chunking.Strategy)
+	}
+	header.Set("X-Chunk-Size", strconv.Itoa(doc.Chunking.Size))
+	header.Set("X-Chunk-Overlap", strconv.Itoa(doc.Chunking.Overlap))
+	setOptionalHeader(header, "X-Embedding-Model", doc.EmbeddingModel)
+	setOptionalHeader(header, "X-Collection", doc.Collection)
+	setOptionalHeader(header, "X-Preset", doc.Preset)
+	header.Set("X-Document-Version", strconv.FormatInt(doc.Version, 10))
+	if doc.ArchivedAt != nil {
+		header.Set("X-Archived-At", doc.ArchivedAt.UTC().Format(time.RFC3339))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func setOptionalHeader(header http.Header, key, value string) {
+	if value != "" {
+		header.Set(key, value)
+	}
+}
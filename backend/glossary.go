@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GlossaryRequest asks for a glossary of a single document or a whole collection
+type GlossaryRequest struct {
+	DocumentName string `json:"documentName,omitempty"`
+	Collection   string `json:"collection,omitempty"`
+	ModelName    string `json:"modelName"`
+	Regenerate   bool   `json:"regenerate"`
+}
+
+// GlossaryEntry is a term with its definition and supporting passages
+type GlossaryEntry struct {
+	Term       string           `json:"term"`
+	Definition string           `json:"definition"`
+	Sources    []GlossarySource `json:"sources"`
+}
+
+// GlossarySource points at the chunk a definition was drawn from
+type GlossarySource struct {
+	Document   string `json:"document"`
+	ChunkIndex int    `json:"chunkIndex"`
+}
+
+// Glossary is a generated glossary for one scope
+type Glossary struct {
+	Scope       string          `json:"scope"`
+	Model       string          `json:"model"`
+	Entries     []GlossaryEntry `json:"entries"`
+	GeneratedAt time.Time       `json:"generatedAt"`
+}
+
+// Glossaries are cached per scope ("document:<name>" or "collection:<name>")
+var glossaryCache = struct {
+	entries map[string]*Glossary
+	mu      sync.RWMutex
+}{entries: make(map[string]*Glossary)}
+
+const maxGlossaryPassages = 12
+
+// Phrases that typically introduce a definition
+var definitionPattern = regexp.MustCompile(`("[^"]{2,60}"\s+(?i:means|shall mean|refers to|is defined as))|` +
+	`(?i:\b(?:is|are) defined as\b|\brefers? to\b)|(\(the "[^"]{2,60}"\))|(\b[A-Z][A-Za-z ]{3,60}\s\([A-Z]{2,10}\))`)
+
+func glossaryScope(req GlossaryRequest) string {
+	if req.Collection != "" {
+		return "collection:" + req.Collection
+	}
+	return "document:" + req.DocumentName
+}
+
+// invalidateGlossary drops the cached glossary of a document and those of the
+// collections it belongs or belonged to, which were built from its chunks too
+func invalidateGlossary(docName string, collections ...string) {
+	glossaryCache.mu.Lock()
+	delete(glossaryCache.entries, "document:"+docName)
+	for _, collection := range collections {
+		if collection != "" {
+			delete(glossaryCache.entries, "collection:"+collection)
+		}
+	}
+	glossaryCache.mu.Unlock()
+}
+
+// findDefiningPassages returns chunks that look like they define terms,
+// falling back to leading chunks when nothing matches
+func findDefiningPassages(docs []*Document) []GlossarySource {
+	var matches, leading []GlossarySource
+	for _, doc := range docs {
+		doc.mu.RLock()
+		for i, chunk := range doc.Chunks {
+			if definitionPattern.MatchString(chunk) {
+				matches = append(matches, GlossarySource{doc.Name, i})
+			} else if i < 2 {
+				leading = append(leading, GlossarySource{doc.Name, i})
+			}
+		}
+		doc.mu.RUnlock()
+	}
+
+	if len(matches) == 0 {
+		matches = leading
+	}
+	if len(matches) > maxGlossaryPassages {
+		matches = matches[:maxGlossaryPassages]
+	}
+	return matches
+}
+
+func chunkAtSource(src GlossarySource) string {
+	doc, exists := documentStore.Get(src.Document)
+	if !exists {
+		return ""
+	}
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	if src.ChunkIndex >= len(doc.Chunks) {
+		return ""
+	}
+	return doc.Chunks[src.ChunkIndex]
+}
+
+func generateGlossary(docs []*Document, scope, modelName string) (*Glossary, error) {
+	passages := findDefiningPassages(docs)
+	if len(passages) == 0 {
+		return nil, fmt.Errorf("no content available to build a glossary")
+	}
+
+	var passageText strings.Builder
+	for i, src := range passages {
+		fmt.Fprintf(&passageText, "[%d] %s\n\n", i+1, chunkAtSource(src))
+	}
+
+	prompt := fmt.Sprintf(`Build a glossary of the domain-specific terms, acronyms and defined terms used in these passages.
+Use only definitions supported by the passages. Respond with a JSON array only, in this form:
+[{"term": "...", "definition": "...", "sources": [1, 2]}]
+where sources are the passage numbers the definition came from.
+
+Passages:
+%s
+JSON:`, passageText.String())
+
+	log.Printf("Generating glossary for %s from %d passages", scope, len(passages))
+	response, err := callOllama(prompt, modelName)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []struct {
+		Term       string `json:"term"`
+		Definition string `json:"definition"`
+		Sources    []int  `json:"sources"`
+	}
+	start, end := strings.Index(response, "["), strings.LastIndex(response, "]")
+	if start < 0 || end <= start {
+		return nil, fmt.Errorf("model did not return a JSON glossary")
+	}
+	if err := json.Unmarshal([]byte(response[start:end+1]), &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse glossary: %w", err)
+	}
+
+	entries := make([]GlossaryEntry, 0, len(raw))
+	for _, item := range raw {
+		term := strings.TrimSpace(item.Term)
+		if term == "" || strings.TrimSpace(item.Definition) == "" {
+			continue
+		}
+		sources := make([]GlossarySource, 0, len(item.Sources))
+		for _, n := range item.Sources {
+			if n >= 1 && n <= len(passages) {
+				sources = append(sources, passages[n-1])
+			}
+		}
+		entries = append(entries, GlossaryEntry{
+			Term:       term,
+			Definition: strings.TrimSpace(item.Definition),
+			Sources:    sources,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.ToLower(entries[i].Term) < strings.ToLower(entries[j].Term)
+	})
+
+	return &Glossary{
+		Scope:       scope,
+		Model:       modelName,
+		Entries:     entries,
+		GeneratedAt: time.Now(),
+	}, nil
+}
+
+func glossaryDocument(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+
+	var req GlossaryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	var docs []*Document
+	if req.Collection != "" {
+		docs = activeDocuments(documentStore.ByCollection(req.Collection), false)
+		if len(docs) == 0 {
+			sendError(w, http.StatusNotFound, "Collection not found")
+			return
+		}
+	} else {
+		doc, ok := getDocumentOrError(w, req.DocumentName)
+		if !ok {
+			return
+		}
+		docs = []*Document{doc}
+	}
+
+	scope := glossaryScope(req)
+	if !req.Regenerate {
+		glossaryCache.mu.RLock()
+		cached, exists := glossaryCache.entries[scope]
+		glossaryCache.mu.RUnlock()
+		if exists {
+			sendJSON(w, http.StatusOK, cached)
+			return
+		}
+	}
+
+	glossary, err := generateGlossary(docs, scope, modelOrDefault(req.ModelName))
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to generate glossary: %v", err))
+		return
+	}
+
+	glossaryCache.mu.Lock()
+	glossaryCache.entries[scope] = glossary
+	glossaryCache.mu.Unlock()
+
+	sendJSON(w, http.StatusOK, glossary)
+}
+
+func handleGetDocumentGlossary(w http.ResponseWriter, r *http.Request, docName string) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+
+	if _, ok := getDocumentOrError(w, docName); !ok {
+		return
+	}
+
+	glossaryCache.mu.RLock()
+	glossary, exists := glossaryCache.entries["document:"+docName]
+	glossaryCache.mu.RUnlock()
+
+	if !exists {
+		sendError(w, http.StatusNotFound, "No glossary available")
+		return
+	}
+	sendJSON(w, http.StatusOK, glossary)
+}
@@ -4,4 +4,4 @@ go 1.24.1
 
 toolchain go1.24.10
 
-require github.com/ledongthuc/pdf v0.0.0-20250511090121-5959a4027728 // indirect
+require github.com/ledongthuc/pdf v0.0.0-20250511090121-5959a4027728
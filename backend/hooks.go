@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// IngestStage identifies an extension point in the ingestion pipeline
+type IngestStage string
+
+// Ingestion stages, in pipeline order
+const (
+	StagePostExtract IngestStage = "post-extract" // Text and metadata may be replaced (custom parsers)
+	StagePreChunk    IngestStage = "pre-chunk"    // Text may be rewritten after preprocessing rules
+	StagePostChunk   IngestStage = "post-chunk"   // Chunks may be split, merged or dropped
+	StagePreIndex    IngestStage = "pre-index"    // Metadata may be enriched before the document is indexed
+)
+
+// IngestContext is the state passed through hooks; hooks mutate it in place
+type IngestContext struct {
+	Stage      IngestStage      `json:"stage"`
+	Document   string           `json:"document"`
+	Collection string           `json:"collection,omitempty"`
+	Text       string           `json:"text,omitempty"`
+	Chunks     []string         `json:"chunks,omitempty"`
+	Metadata   DocumentMetadata `json:"metadata"`
+	doc        *Document        // Assembled document, set for pre-index only
+}
+
+// StoredDocument returns the assembled document during the pre-index stage
+func (ic *IngestContext) StoredDocument() *Document {
+	return ic.doc
+}
+
+// IngestHook is implemented by in-process ingestion extensions.
+// Returning an error aborts ingestion of the document.
+type IngestHook interface {
+	Name() string
+	HandleIngest(ic *IngestContext) error
+}
+
+// IngestHookFunc adapts a function to the IngestHook interface
+type IngestHookFunc struct {
+	HookName string
+	Fn       func(ic *IngestContext) error
+}
+
+func (h IngestHookFunc) Name() string                         { return h.HookName }
+func (h IngestHookFunc) HandleIngest(ic *IngestContext) error { return h.Fn(ic) }
+
+type registeredHook struct {
+	hook     IngestHook
+	optional bool // Failures are logged instead of aborting ingestion
+}
+
+var ingestHooks = struct {
+	byStage map[IngestStage][]registeredHook
+	mu      sync.RWMutex
+}{byStage: make(map[IngestStage][]registeredHook)}
+
+// RegisterIngestHook adds a hook to run at the given stage, after any already registered
+func RegisterIngestHook(stage IngestStage, hook IngestHook, optional bool) {
+	ingestHooks.mu.Lock()
+	defer ingestHooks.mu.Unlock()
+	ingestHooks.byStage[stage] = append(ingestHooks.byStage[stage], registeredHook{hook, optional})
+}
+
+// hasIngestHooks reports whether any hook is registered for a stage
+func hasIngestHooks(stage IngestStage) bool {
+	ingestHooks.mu.RLock()
+	defer ingestHooks.mu.RUnlock()
+	return len(ingestHooks.byStage[stage]) > 0
+}
+
+// runIngestHooks runs every hook registered for a stage in registration order
+func runIngestHooks(stage IngestStage, ic *IngestContext) error {
+	ingestHooks.mu.RLock()
+	hooks := ingestHooks.byStage[stage]
+	ingestHooks.mu.RUnlock()
+
+	ic.Stage = stage
+	for _, h := range hooks {
+		start := time.Now()
+		if err := h.hook.HandleIngest(ic); err != nil {
+			if h.optional {
+				log.Printf("Optional %s hook %s failed for %s: %s", stage, h.hook.Name(), ic.Document, loggable(err))
+				continue
+			}
+			return newAPIError(http.StatusUnprocessableEntity,
+				fmt.Sprintf("Ingestion rejected by %s hook %s: %v", stage, h.hook.Name(), err))
+		}
+		log.Printf("Ran %s hook %s for %s in %v", stage, h.hook.Name(), ic.Document, time.Since(start))
+	}
+	return nil
+}
+
+// ExternalHookConfig describes a webhook or executable hook loaded from INGEST_HOOKS_FILE
+type ExternalHookConfig struct {
+	Name     string      `json:"name"`
+	Stage    IngestStage `json:"stage"`
+	Type     string      `json:"type"`              // "webhook" or "exec"
+	URL      string      `json:"url,omitempty"`     // webhook target
+	Command  []string    `json:"command,omitempty"` // exec program and arguments
+	Timeout  string      `json:"timeout,omitempty"` // e.g. "10s" (default 30s)
+	Optional bool        `json:"optional,omitempty"`
+}
+
+// hookResponse is what external hooks return: the (possibly modified) context,
+// or an error message to reject the document
+type hookResponse struct {
+	IngestContext
+	Error string `json:"error,omitempty"`
+}
+
+// externalHook sends the context as JSON to a webhook or to a command's stdin
+// and reads the modified context back
+type externalHook struct {
+	cfg     ExternalHookConfig
+	timeout time.Duration
+}
+
+func (h *externalHook) Name() string { return h.cfg.Name }
+
+func (h *externalHook) HandleIngest(ic *IngestContext) error {
+	payload, err := json.Marshal(ic)
+	if err != nil {
+		return fmt.Errorf("failed to marshal hook payload: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	var output []byte
+	switch h.cfg.Type {
+	case "webhook":
+		req, err := http.NewRequestWithContext(ctx, "POST", h.cfg.URL, bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("webhook request failed: %w", err)
+		}
+		defer closeFile(resp.Body, "hook response body")
+		output, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read webhook response: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return newOutputError(output, "webhook returned status %d", resp.StatusCode)
+		}
+	case "exec":
+		cmd := exec.CommandContext(ctx, h.cfg.Command[0], h.cfg.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(payload)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err = cmd.Output()
+		if err != nil {
+			return newOutputError(stderr.Bytes(), "command failed: %v", err)
+		}
+	}
+
+	// An empty response leaves the context unchanged
+	if len(bytes.TrimSpace(output)) == 0 {
+		return nil
+	}
+	result := hookResponse{IngestContext: *ic}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return fmt.Errorf("invalid hook response: %w", err)
+	}
+	if result.Error != "" {
+		return fmt.Errorf("%s", result.Error)
+	}
+
+	ic.Text = result.Text
+	ic.Chunks = result.Chunks
+	ic.Metadata = result.Metadata
+	return nil
+}
+
+// loadIngestHooks registers external hooks from a JSON file holding an array of ExternalHookConfig
+func loadIngestHooks(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read hooks file: %w", err)
+	}
+	var configs []ExternalHookConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("failed to parse hooks file: %w", err)
+	}
+
+	for _, cfg := range configs {
+		switch cfg.Stage {
+		case StagePostExtract, StagePreChunk, StagePostChunk, StagePreIndex:
+		default:
+			return fmt.Errorf("hook %s: unknown stage %q", cfg.Name, cfg.Stage)
+		}
+		if (cfg.Type == "webhook" && cfg.URL == "") || (cfg.Type == "exec" && len(cfg.Command) == 0) ||
+			(cfg.Type != "webhook" && cfg.Type != "exec") {
+			return fmt.Errorf("hook %s: needs type webhook with url or exec with command", cfg.Name)
+		}
+		if cfg.Type == "webhook" {
+			if u, err := url.Parse(cfg.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("hook %s: url must be an http(s) URL", cfg.Name)
+			}
+		}
+
+		timeout := 30 * time.Second
+		if cfg.Timeout != "" {
+			if timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+				return fmt.Errorf("hook %s: invalid timeout: %w", cfg.Name, err)
+			}
+		}
+
+		RegisterIngestHook(cfg.Stage, &externalHook{cfg: cfg, timeout: timeout}, cfg.Optional)
+		log.Printf("Registered %s %s hook %s", cfg.Stage, cfg.Type, cfg.Name)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestHooks starts the test without registered hooks and restores them when
+// it ends
+func useTestHooks(t *testing.T) {
+	t.Helper()
+	ingestHooks.mu.Lock()
+	saved := ingestHooks.byStage
+	ingestHooks.byStage = make(map[IngestStage][]registeredHook)
+	ingestHooks.mu.Unlock()
+	t.Cleanup(func() {
+		ingestHooks.mu.Lock()
+		ingestHooks.byStage = saved
+		ingestHooks.mu.Unlock()
+	})
+}
+
+// loadTestHooks registers the hooks of a hooks file holding configs
+func loadTestHooks(t *testing.T, configs ...ExternalHookConfig) error {
+	t.Helper()
+	data, err := json.Marshal(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "hooks.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return loadIngestHooks(path)
+}
+
+func TestWebhookHookFailures(t *testing.T) {
+	useWebhookNetworks(t, "127.0.0.1,::1")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ic IngestContext
+		if err := json.NewDecoder(r.Body).Decode(&ic); err != nil {
+			t.Error(err)
+		}
+		switch r.URL.Path {
+		case "/upper":
+			ic.Text = strings.ToUpper(ic.Text)
+			json.NewEncoder(w).Encode(ic)
+		case "/empty":
+		case "/reject":
+			fmt.Fprint(w, `{"error": "contains personal data"}`)
+		case "/broken":
+			http.Error(w, "classifier unavailable", http.StatusInternalServerError)
+		case "/garbled":
+			fmt.Fprint(w, "not json")
+		case "/redirect":
+			http.Redirect(w, r, "/upper", http.StatusFound)
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path     string
+		optional bool
+		text     string // Text after the hooks ran
+		err      string // Empty when ingestion goes on
+	}{
+		{"/upper", false, "MINUTES OF THE MEETING.", ""},
+		{"/empty", false, "Minutes of the meeting.", ""},
+		{"/reject", false, "", "contains personal data"},
+		{"/broken", false, "", "webhook returned status 500: classifier unavailable"},
+		{"/garbled", false, "", "invalid hook response"},
+		{"/redirect", false, "", "redirects are not followed"},
+		{"/slow", false, "", "deadline exceeded"},
+		{"/broken", true, "Minutes of the meeting.", ""},
+		{"/slow", true, "Minutes of the meeting.", ""},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s optional=%v", strings.TrimPrefix(tt.path, "/"), tt.optional), func(t *testing.T) {
+			useTestHooks(t)
+			hook := ExternalHookConfig{Name: "classifier", Stage: StagePreChunk, Type: "webhook", URL: server.URL + tt.path, Timeout: "100ms", Optional: tt.optional}
+			if err := loadTestHooks(t, hook); err != nil {
+				t.Fatal(err)
+			}
+
+			ic := &IngestContext{Document: "minutes.txt", Text: "Minutes of the meeting."}
+			start := time.Now()
+			err := runIngestHooks(StagePreChunk, ic)
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("hooks took %v despite the timeout", elapsed)
+			}
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("rejected: %v", err)
+				}
+				if ic.Text != tt.text {
+					t.Errorf("text %q, want %q", ic.Text, tt.text)
+				}
+				return
+			}
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnprocessableEntity || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got %v, want a 422 about %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestWebhookHookStaysOffInternalNetworks(t *testing.T) {
+	useTestHooks(t)
+	useWebhookNetworks(t, "")
+	var hits int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits++ }))
+	defer server.Close()
+
+	if err := loadTestHooks(t, ExternalHookConfig{Name: "local", Stage: StagePreIndex, Type: "webhook", URL: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	err := runIngestHooks(StagePreIndex, &IngestContext{Document: "minutes.txt"})
+	if err == nil || !strings.Contains(err.Error(), "internal address") {
+		t.Errorf("got %v, want an internal address error", err)
+	}
+	if hits != 0 {
+		t.Errorf("the loopback server got %d requests", hits)
+	}
+}
+
+func TestLoadIngestHooksRejectsBadWebhooks(t *testing.T) {
+	useTestHooks(t)
+	for _, target := range []string{"", "file:///etc/passwd", "gopher://example.com/", "example.com/hook"} {
+		if err := loadTestHooks(t, ExternalHookConfig{Name: "bad", Stage: StagePreIndex, Type: "webhook", URL: target}); err == nil {
+			t.Errorf("webhook hook with url %q accepted", target)
+		}
+	}
+	if err := loadTestHooks(t, ExternalHookConfig{Name: "bad", Stage: StagePreIndex, Type: "webhook", URL: "https://example.com/hook", Timeout: "soon"}); err == nil {
+		t.Error("invalid timeout accepted")
+	}
+}
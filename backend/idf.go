@@ -0,0 +1,173 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Stopwords weigh at most this share of a word found nowhere else, however rare
+// they are in a small corpus
+const stopwordIDFShare = 0.1
+
+// BM25 parameters: how quickly repeats of a word stop adding to a chunk's score,
+// and how much a chunk's length relative to the average discounts it
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// termStats counts the chunks holding each word over the documents of a store,
+// for weighting keyword matches by inverse document frequency
+type termStats struct {
+	mu     sync.RWMutex
+	chunks map[string]int // Chunks holding the word
+	total  int            // Chunks in the corpus
+	words  int            // Words in the corpus, for the average chunk length
+}
+
+// termFrequencies counts the words of a document's chunks, for BM25
+type termFrequencies struct {
+	counts  map[string][]int32 // Occurrences of each word in the chunks its word index entry lists
+	lengths []int              // Words in each chunk
+}
+
+// indexChunks builds the word index of a document's chunks, listing the chunks
+// holding each word in order, along with the term frequencies BM25 ranks them by
+func indexChunks(chunks []string) (map[string][]int, *termFrequencies) {
+	wordIndex := make(map[string][]int)
+	freqs := &termFrequencies{counts: make(map[string][]int32), lengths: make([]int, len(chunks))}
+	for i, chunk := range chunks {
+		words := strings.Fields(strings.ToLower(chunk))
+		freqs.lengths[i] = len(words)
+		for _, word := range words {
+			entry := wordIndex[word]
+			if n := len(entry); n > 0 && entry[n-1] == i {
+				freqs.counts[word][n-1]++
+				continue
+			}
+			wordIndex[word] = append(entry, i)
+			freqs.counts[word] = append(freqs.counts[word], 1)
+		}
+	}
+	return wordIndex, freqs
+}
+
+// termCount returns the occurrences of a word in a chunk; callers hold the document lock
+func (doc *Document) termCount(word string, chunk int) int {
+	pos, found := slices.BinarySearch(doc.wordIndex[word], chunk)
+	if !found || doc.termFreqs == nil {
+		return 0
+	}
+	return int(doc.termFreqs.counts[word][pos])
+}
+
+// bm25 scales a term's IDF weight by its frequency in a chunk: repeats add less
+// and less, and chunks longer than the corpus average count for less
+func (term queryTerm) bm25(doc *Document, chunk int, stats *termStats) float64 {
+	// A phrase occurs as often as its rarest word; of several alternatives the
+	// most frequent counts
+	tf := 0
+	for _, words := range term.alternatives {
+		occurrences := -1
+		for _, w := range words {
+			if n := doc.termCount(w, chunk); occurrences < 0 || n < occurrences {
+				occurrences = n
+			}
+		}
+		tf = max(tf, occurrences)
+	}
+	if tf <= 0 || doc.termFreqs == nil {
+		return 0
+	}
+	norm := 1.0
+	if avg := stats.averageChunkLength(); avg > 0 {
+		norm = 1 - bm25B + bm25B*float64(doc.termFreqs.lengths[chunk])/avg
+	}
+	return term.idfWeight(stats) * float64(tf) * (bm25K1 + 1) / (float64(tf) + bm25K1*norm)
+}
+
+// add counts a document's chunks in (sign 1) or out of (sign -1) the corpus. The
+// word index of a stored document does not change, so no document lock is needed.
+func (s *termStats) add(doc *Document, sign int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for word, chunks := range doc.wordIndex {
+		if s.chunks[word] += sign * len(chunks); s.chunks[word] <= 0 {
+			delete(s.chunks, word)
+		}
+	}
+	s.total = max(0, s.total+sign*len(doc.Chunks))
+	if doc.termFreqs != nil {
+		for _, n := range doc.termFreqs.lengths {
+			s.words += sign * n
+		}
+		s.words = max(0, s.words)
+	}
+}
+
+// averageChunkLength returns the mean number of words of the corpus's chunks
+func (s *termStats) averageChunkLength() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.total == 0 {
+		return 0
+	}
+	return float64(s.words) / float64(s.total)
+}
+
+// idf returns a word's inverse document frequency scaled to 0-1, 1 being a word
+// no chunk holds
+func (s *termStats) idf(word string) float64 {
+	s.mu.RLock()
+	n, df := float64(s.total), float64(s.chunks[word])
+	s.mu.RUnlock()
+	weight := math.Log(1+(n-df+0.5)/(df+0.5)) / math.Log(1+(n+0.5)/0.5)
+	if isStopword(word) {
+		weight = min(weight, stopwordIDFShare)
+	}
+	return weight
+}
+
+func newTermStats() *termStats {
+	return &termStats{chunks: make(map[string]int)}
+}
+
+// replace takes over the counts of other, which is no longer used
+func (s *termStats) replace(other *termStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunks, s.total, s.words = other.chunks, other.total, other.words
+}
+
+// idfWeight is the weight of a query term: the mean over its alternatives of the
+// IDF of each alternative's rarest word, as a phrase is at least as rare as that
+func (term queryTerm) idfWeight(stats *termStats) float64 {
+	var sum float64
+	for _, words := range term.alternatives {
+		var rarest float64
+		for _, w := range words {
+			rarest = max(rarest, stats.idf(w))
+		}
+		sum += rarest
+	}
+	return term.weight * sum / float64(len(term.alternatives))
+}
+
+// put stores a document, keeping the word counts in step; callers hold ds.mu
+func (ds *DocumentStore) put(name string, doc *Document) {
+	if previous, exists := ds.docs[name]; exists {
+		ds.terms.add(previous, -1)
+	}
+	ds.docs[name] = doc
+	ds.terms.add(doc, 1)
+}
+
+// remove deletes a document, keeping the word counts in step; callers hold ds.mu
+func (ds *DocumentStore) remove(name string) {
+	if previous, exists := ds.docs[name]; exists {
+		ds.terms.add(previous, -1)
+		delete(ds.docs, name)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const imapFetchBatch = 25
+
+// imapClient is a minimal IMAP4rev1 client covering login, mailbox selection and message download
+type imapClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+	tls  bool // Set once the connection is encrypted, with imaps or STARTTLS
+}
+
+// imapResponse is one server response line with any literals it carried
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+var imapLiteralPattern = regexp.MustCompile(`\{(\d+)\}$`)
+
+func dialIMAP(ctx context.Context, u *url.URL) (*imapClient, error) {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "imaps" {
+			host += ":993"
+		} else {
+			host += ":143"
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if u.Scheme == "imaps" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			closeFile(conn, "IMAP connection")
+			return nil, err
+		}
+	}
+
+	c := &imapClient{conn: conn, r: bufio.NewReader(conn), tls: u.Scheme == "imaps"}
+	if _, err := c.read(); err != nil { // Server greeting
+		closeFile(conn, "IMAP connection")
+		return nil, err
+	}
+	if !c.tls {
+		if err := c.startTLS(u.Hostname()); err != nil {
+			closeFile(c.conn, "IMAP connection")
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// startTLS upgrades a plain imap:// connection; servers without STARTTLS are
+// refused, so the password is never sent in the clear
+func (c *imapClient) startTLS(serverName string) error {
+	if _, err := c.run("STARTTLS"); err != nil {
+		return fmt.Errorf("%w; use imaps:// or a server that supports STARTTLS", err)
+	}
+	conn := tls.Client(c.conn, &tls.Config{ServerName: serverName})
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("STARTTLS handshake failed: %w", err)
+	}
+	c.conn, c.r, c.tls = conn, bufio.NewReader(conn), true
+	return nil
+}
+
+// login authenticates, only ever over an encrypted connection
+func (c *imapClient) login(user, password string) error {
+	if !c.tls {
+		return errors.New("refusing to log in over an unencrypted IMAP connection")
+	}
+	_, err := c.run("LOGIN " + imapQuote(user) + " " + imapQuote(password))
+	return err
+}
+
+// read returns the next response, following literals onto continuation lines
+func (c *imapClient) read() (imapResponse, error) {
+	var resp imapResponse
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return resp, fmt.Errorf("failed to read IMAP response: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		resp.line += line
+
+		m := imapLiteralPattern.FindStringSubmatch(line)
+		if m == nil {
+			return resp, nil
+		}
+		size, _ := strconv.Atoi(m[1])
+		if size > MaxRequestSize {
+			return resp, fmt.Errorf("IMAP literal of %d bytes is too large", size)
+		}
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return resp, fmt.Errorf("failed to read IMAP literal: %w", err)
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+// run sends a command and returns its untagged responses, failing on NO or BAD
+func (c *imapClient) run(command string) ([]imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("A%03d", c.tag)
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, command); err != nil {
+		return nil, fmt.Errorf("failed to send IMAP command: %w", err)
+	}
+
+	var untagged []imapResponse
+	for {
+		resp, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(resp.line, tag+" ") {
+			untagged = append(untagged, resp)
+			continue
+		}
+		status := strings.TrimPrefix(resp.line, tag+" ")
+		if !strings.HasPrefix(status, "OK") {
+			verb := strings.SplitN(command, " ", 2)[0]
+			return nil, fmt.Errorf("IMAP %s failed: %s", verb, status)
+		}
+		return untagged, nil
+	}
+}
+
+// imapUnsafe reports whether a value would end the command line it is quoted in
+func imapUnsafe(s string) bool {
+	return strings.ContainsAny(s, "\r\n\x00")
+}
+
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (c *imapClient) close() {
+	_, _ = c.run("LOGOUT")
+	closeFile(c.conn, "IMAP connection")
+}
+
+var (
+	imapUIDValidityPattern = regexp.MustCompile(`\[UIDVALIDITY (\d+)\]`)
+	imapFetchUIDPattern    = regexp.MustCompile(`\bUID (\d+)`)
+)
+
+// selectMailbox opens a mailbox read-only and returns its UIDVALIDITY
+func (c *imapClient) selectMailbox(mailbox string) (string, error) {
+	responses, err := c.run("EXAMINE " + imapQuote(mailbox))
+	if err != nil {
+		return "", err
+	}
+	for _, resp := range responses {
+		if m := imapUIDValidityPattern.FindStringSubmatch(resp.line); m != nil {
+			return m[1], nil
+		}
+	}
+	return "", nil
+}
+
+// uidsAfter lists message UIDs greater than last
+func (c *imapClient) uidsAfter(last int) ([]int, error) {
+	responses, err := c.run(fmt.Sprintf("UID SEARCH UID %d:*", last+1))
+	if err != nil {
+		return nil, err
+	}
+	var uids []int
+	for _, resp := range responses {
+		if !strings.HasPrefix(resp.line, "* SEARCH") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(resp.line, "* SEARCH")) {
+			// "n:*" always matches the newest message, even when it is not after last
+			if uid, err := strconv.Atoi(field); err == nil && uid > last {
+				uids = append(uids, uid)
+			}
+		}
+	}
+	sort.Ints(uids)
+	return uids, nil
+}
+
+// fetch downloads full raw messages by UID
+func (c *imapClient) fetch(uids []int) (map[int][]byte, error) {
+	set := make([]string, len(uids))
+	for i, uid := range uids {
+		set[i] = strconv.Itoa(uid)
+	}
+	responses, err := c.run("UID FETCH " + strings.Join(set, ",") + " (UID BODY.PEEK[])")
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make(map[int][]byte)
+	for _, resp := range responses {
+		m := imapFetchUIDPattern.FindStringSubmatch(resp.line)
+		if m == nil || len(resp.literals) == 0 {
+			continue
+		}
+		uid, _ := strconv.Atoi(m[1])
+		messages[uid] = resp.literals[0]
+	}
+	return messages, nil
+}
+
+// imapEnvHost reports whether IMAP_PASSWORD may be used for a server: only the
+// host IMAP_HOST names gets it, so a source cannot send it elsewhere
+func imapEnvHost(u *url.URL) bool {
+	configured := os.Getenv("IMAP_HOST")
+	if configured == "" || os.Getenv("IMAP_PASSWORD") == "" {
+		return false
+	}
+	if host, _, err := net.SplitHostPort(configured); err == nil {
+		configured = host
+	}
+	return strings.EqualFold(u.Hostname(), configured)
+}
+
+// syncIMAPSource downloads messages that arrived since the last sync and appends them to
+// one mbox document per conversation. The mailbox item remembers UIDVALIDITY (etag) and
+// the highest UID ingested (lastModified).
+func syncIMAPSource(ctx context.Context, src Source, items map[string]*SourceItem) (int, int, error) {
+	u, err := url.Parse(src.URL)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid url: %w", err)
+	}
+	mailbox := strings.TrimPrefix(u.Path, "/")
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	password := src.Token
+	if password == "" {
+		if !imapEnvHost(u) {
+			return 0, 0, errors.New("the source has no token and its host is not IMAP_HOST")
+		}
+		password = os.Getenv("IMAP_PASSWORD")
+	}
+	if imapUnsafe(src.Email) || imapUnsafe(mailbox) || imapUnsafe(password) {
+		return 0, 0, errors.New("the email, mailbox and token cannot contain line breaks")
+	}
+
+	client, err := dialIMAP(ctx, u)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer client.close()
+
+	if err := client.login(src.Email, password); err != nil {
+		return 0, 0, err
+	}
+	validity, err := client.selectMailbox(mailbox)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	state := trackItem(items, "mailbox:"+mailbox, "")
+	last := 0
+	if state.ETag == validity {
+		last, _ = strconv.Atoi(state.LastModified)
+	}
+	uids, err := client.uidsAfter(last)
+	if err != nil {
+		return 0, 0, recordItemError(state, err)
+	}
+
+	// Group new messages by conversation, keeping raw bytes for the thread mbox files
+	threads := make(map[string][][]byte)
+	var order []string
+	subjects := make(map[string]string)
+	for start := 0; start < len(uids); start += imapFetchBatch {
+		batch := uids[start:min(start+imapFetchBatch, len(uids))]
+		raws, err := client.fetch(batch)
+		if err != nil {
+			return 0, 0, recordItemError(state, err)
+		}
+		for _, uid := range batch {
+			raw, ok := raws[uid]
+			if !ok {
+				continue
+			}
+			msg, err := parseEmail(raw)
+			if err != nil {
+				continue
+			}
+			key := threadKey(msg)
+			if _, seen := threads[key]; !seen {
+				order = append(order, key)
+				subjects[key] = strings.TrimSpace(subjectPrefixPattern.ReplaceAllString(msg.Subject, ""))
+			}
+			threads[key] = append(threads[key], raw)
+		}
+	}
+
+	var changed int
+	var failed []string
+	for _, key := range order {
+		item := trackItem(items, key, itemDocumentName(src, subjects[key], key, ".mbox"))
+		var existing []byte
+		if item.Hash != "" {
+			if existing, err = readStoredFile(filepath.Join("./documents", item.Document)); err != nil {
+				existing = nil
+			}
+		}
+
+		body := appendMbox(existing, threads[key])
+		ok, err := ingestSourceItem(src, item, &fetchResult{Body: body}, DocumentMetadata{
+			Custom: map[string]string{"mailbox": mailbox},
+		})
+		if recordItemError(item, err) != nil {
+			failed = append(failed, item.Document)
+		} else if ok {
+			changed++
+		}
+	}
+
+	// Only advance past messages once every thread they belong to is ingested
+	if len(failed) > 0 {
+		return changed, 0, recordItemError(state, fmt.Errorf("failed to ingest %s", strings.Join(failed, ", ")))
+	}
+	if len(uids) > 0 {
+		now := time.Now()
+		state.ETag = validity
+		state.LastModified = strconv.Itoa(uids[len(uids)-1])
+		state.LastChanged = &now
+	}
+	return changed, len(items) - 1 - changed, recordItemError(state, nil)
+}
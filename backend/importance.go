@@ -0,0 +1,102 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// boilerplatePhrases mark cover pages, footers, signature blocks and legal notices
+var boilerplatePhrases = regexp.MustCompile(`(?i)all rights reserved|copyright|©|confidential|page \d+ of \d+|signature|signed by|sincerely|kind regards|in witness whereof|table of contents|prepared (?:by|for)|intentionally left blank|disclaimer|_{4,}|\.{6,}`)
+
+// chunkImportance computes a static prior per chunk, from 0 to 1, from where it
+// sits and what it looks like: chunks opening a section and holding names and
+// figures score high, cover pages, signature blocks and notices low. Callers
+// build it before the document is stored.
+func chunkImportance(doc *Document) []float64 {
+	n := len(doc.Chunks)
+	sectionStart := make([]bool, n)
+	inSection := make([]bool, n)
+	for _, entry := range doc.TOC {
+		for i := max(entry.ChunkStart, 0); i < entry.ChunkEnd && i < n; i++ {
+			inSection[i] = true
+			if i <= entry.ChunkStart+1 {
+				sectionStart[i] = true
+			}
+		}
+	}
+
+	importance := make([]float64, n)
+	for i, chunk := range doc.Chunks {
+		heading := 0.5 // Unknown without a table of contents
+		switch {
+		case len(doc.TOC) == 0:
+		case sectionStart[i]:
+			heading = 1
+		case inSection[i]:
+			heading = 0.6
+		default:
+			heading = 0.2 // Before the first heading or outside every section
+		}
+		position := 0.5
+		if n > 1 && (i == 0 || i == n-1) {
+			position = 0.25
+		}
+		importance[i] = 0.25*heading + 0.15*position + 0.2*entityScore(chunk) + 0.4*(1-boilerplateScore(chunk))
+	}
+	return importance
+}
+
+// entityScore rises with the share of words that look like names or figures:
+// capitalized words inside sentences, and numbers
+func entityScore(chunk string) float64 {
+	words := strings.Fields(chunk)
+	if len(words) == 0 {
+		return 0
+	}
+	entities := 0
+	sentenceStart := true
+	for _, w := range words {
+		trimmed := strings.TrimFunc(w, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+		if trimmed != "" {
+			first := []rune(trimmed)[0]
+			if unicode.IsDigit(first) || (unicode.IsUpper(first) && !sentenceStart) {
+				entities++
+			}
+		}
+		sentenceStart = strings.ContainsAny(w[len(w)-1:], ".!?:")
+	}
+	density := float64(entities) / float64(len(words))
+	return 0.3 + 0.5*min(1, density/0.15)
+}
+
+// boilerplateScore estimates from 0 to 1 how likely a chunk is boilerplate:
+// notice and signature phrases, little text, repeated words, short lines
+func boilerplateScore(chunk string) float64 {
+	score := 0.25 * float64(len(boilerplatePhrases.FindAllStringIndex(chunk, 4)))
+	words := tokenize(chunk)
+	if len(words) < 30 {
+		score += 0.3
+	}
+	unique := make(map[string]bool, len(words))
+	for _, w := range words {
+		unique[w] = true
+	}
+	if len(words) > 20 && float64(len(unique)) < 0.3*float64(len(words)) {
+		score += 0.2
+	}
+	lines := strings.FieldsFunc(chunk, func(r rune) bool { return r == '\n' })
+	if len(lines) >= 3 && float64(len(strings.Fields(chunk)))/float64(len(lines)) < 4 {
+		score += 0.3
+	}
+	return min(1, score)
+}
+
+// importanceFactor turns a chunk's prior into a relevance multiplier around 1,
+// with the configured weight; callers hold the document lock
+func (d *Document) importanceFactor(i int, weight float64) float64 {
+	if i >= len(d.importance) {
+		return 1
+	}
+	return 1 + weight*(2*d.importance[i]-1)
+}
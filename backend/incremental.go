@@ -0,0 +1,211 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Summaries of a re-uploaded document are kept when at most this fraction of chunks changed
+const summaryReuseMaxChange = 0.1
+
+// chunkReuse records which chunks of a re-uploaded document were carried over unchanged
+type chunkReuse struct {
+	previous *Document
+	from     []int // Index of each new chunk in the previous version, -1 if new
+}
+
+// changed returns the number of chunks that were not carried over
+func (cr *chunkReuse) changed() int {
+	n := 0
+	for _, j := range cr.from {
+		if j < 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// verify drops reuse entries whose chunk text no longer matches, e.g. after post-chunk hooks
+func (cr *chunkReuse) verify(chunks []string) {
+	if len(chunks) != len(cr.from) {
+		cr.from = make([]int, len(chunks))
+		for i := range cr.from {
+			cr.from[i] = -1
+		}
+		return
+	}
+	for i, j := range cr.from {
+		if j >= 0 && chunks[i] != cr.previous.Chunks[j] {
+			cr.from[i] = -1
+		}
+	}
+}
+
+// wordOffsets splits text like strings.Fields and also returns each word's byte offset
+func wordOffsets(text string) ([]string, []int) {
+	var words []string
+	var offsets []int
+	start := -1
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				words = append(words, text[start:i])
+				offsets = append(offsets, start)
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		words = append(words, text[start:])
+		offsets = append(offsets, start)
+	}
+	return words, offsets
+}
+
+// incrementalChunks chunks a new version of a document, carrying over every chunk of the
+// previous version that still appears verbatim and re-chunking only the text between them.
+// It returns the chunks, their word offsets and the reuse mapping.
+func incrementalChunks(prev *Document, text string, opts ChunkOptions) ([]string, []int, *chunkReuse) {
+	words, offsets := wordOffsets(text)
+	joined := strings.Join(words, " ")
+	joinedPos := make([]int, len(words)+1)
+	for i, w := range words {
+		joinedPos[i+1] = joinedPos[i] + len(w) + 1
+	}
+
+	const keyWords = 3
+	key := func(i int) string { return joined[joinedPos[i] : joinedPos[i+keyWords]-1] }
+	positions := make(map[string][]int)
+	for i := 0; i+keyWords <= len(words); i++ {
+		positions[key(i)] = append(positions[key(i)], i)
+	}
+
+	oldStarts := prev.chunkStarts
+	if len(oldStarts) != len(prev.Chunks) {
+		oldStarts = chunkWordStarts(prev.Chunks)
+	}
+	oldLen := make([]int, len(prev.Chunks))
+	oldKey := make([]string, len(prev.Chunks))
+	for j, c := range prev.Chunks {
+		fields := strings.Fields(c)
+		oldLen[j] = len(fields)
+		if len(fields) >= keyWords {
+			oldKey[j] = strings.Join(fields[:keyWords], " ")
+		}
+	}
+
+	matchAt := func(j, p int) bool {
+		end := p + oldLen[j]
+		return oldLen[j] > 0 && end <= len(words) &&
+			joined[joinedPos[p]:joinedPos[end]-1] == prev.Chunks[j]
+	}
+	// find returns the first word offset >= p where old chunk j appears, or -1
+	find := func(j, p int) int {
+		candidates := positions[oldKey[j]]
+		for i := sort.SearchInts(candidates, p); i < len(candidates); i++ {
+			if matchAt(j, candidates[i]) {
+				return candidates[i]
+			}
+		}
+		return -1
+	}
+
+	var chunks []string
+	var starts, from []int
+	rechunk := func(start, end int) {
+		if start >= end {
+			return
+		}
+		textEnd := len(text)
+		if end < len(words) {
+			textEnd = offsets[end]
+		}
+		gapChunks, gapStarts := chunkWithOptions(text[offsets[start]:textEnd], opts)
+		for i, c := range gapChunks {
+			chunks = append(chunks, c)
+			starts = append(starts, start+gapStarts[i])
+			from = append(from, -1)
+		}
+	}
+
+	p, j := 0, 0
+	for j < len(prev.Chunks) && p < len(words) {
+		if !matchAt(j, p) {
+			// Resynchronise on the next old chunk that still exists further on
+			k, q := j, -1
+			for ; k < len(prev.Chunks); k++ {
+				if oldKey[k] != "" {
+					if q = find(k, p); q >= 0 {
+						break
+					}
+				}
+			}
+			if q < 0 {
+				break
+			}
+			rechunk(p, q)
+			p, j = q, k
+		}
+
+		chunks = append(chunks, prev.Chunks[j])
+		starts = append(starts, p)
+		from = append(from, j)
+		if j+1 < len(prev.Chunks) {
+			p += oldStarts[j+1] - oldStarts[j]
+		} else {
+			p += oldLen[j]
+		}
+		j++
+	}
+	rechunk(p, len(words))
+
+	// Text that is only whitespace still yields one chunk, as in chunkWithOptions
+	if len(chunks) == 0 {
+		chunks, starts = chunkWithOptions(text, opts)
+		from = make([]int, len(chunks))
+		for i := range from {
+			from[i] = -1
+		}
+	}
+
+	return chunks, starts, &chunkReuse{previous: prev, from: from}
+}
+
+// carriedEmbeddings returns previous vectors for reused chunks (empty entries need embedding),
+// or nil when the previous version has no embeddings for the model
+func (cr *chunkReuse) carriedEmbeddings(model string) []QuantizedVector {
+	prev := cr.previous
+	prev.mu.RLock()
+	defer prev.mu.RUnlock()
+	if model == "" || prev.EmbeddingModel != model || len(prev.Embeddings) != len(prev.Chunks) {
+		return nil
+	}
+	vectors := make([]QuantizedVector, len(cr.from))
+	for i, j := range cr.from {
+		if j >= 0 {
+			vectors[i] = prev.Embeddings[j]
+		}
+	}
+	return vectors
+}
+
+// assignChunkIDs gives carried-over chunks their previous IDs and new chunks fresh ones
+func assignChunkIDs(doc *Document, reuse *chunkReuse) {
+	doc.ChunkIDs = make([]int, len(doc.Chunks))
+	next := 0
+	if reuse != nil {
+		next = reuse.previous.nextChunkID
+	}
+	for i := range doc.ChunkIDs {
+		if reuse != nil && reuse.from[i] >= 0 && reuse.from[i] < len(reuse.previous.ChunkIDs) {
+			doc.ChunkIDs[i] = reuse.previous.ChunkIDs[reuse.from[i]]
+			continue
+		}
+		doc.ChunkIDs[i] = next
+		next++
+	}
+	doc.nextChunkID = next
+}
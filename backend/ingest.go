@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// IngestOptions controls how a file is turned into a stored document
+type IngestOptions struct {
+	Name            string
+	Chunking        ChunkOptions // Zero fields fall back to the collection's settings, then defaults
+	Collection      string
+	Metadata        DocumentMetadata
+	Instructions    string
+	GenerateSummary bool
+	ModelName       string
+	SummaryType     string
+	EmbeddingModel  string
+	FullReprocess   bool           // Re-chunk everything instead of reusing unchanged chunks of a stored version
+	RecordMapping   *RecordMapping // Fields of .json and .jsonl records used as text and metadata
+	Preset          string         // Processing preset the options were filled from; its preprocessing rules apply
+	SummarySet      bool           // GenerateSummary was chosen by the upload, so a preset does not change it
+	Classify        *bool          // Label the document against the taxonomy; nil follows classification.enabled
+	Tenant          string         // Tenant the upload acts for, owning its summary job; empty for the default tenant
+	// BeforeSwap runs with the stored version locked right before the new one
+	// replaces it (previous is nil when there is none); an error keeps the stored version
+	BeforeSwap func(doc, previous *Document) error
+}
+
+// ingestOptionsFromForm reads processing parameters from an upload form
+func ingestOptionsFromForm(r *http.Request) (IngestOptions, error) {
+	date, err := parseMetadataDate(r.FormValue("date"))
+	if err != nil {
+		return IngestOptions{}, newAPIError(http.StatusBadRequest, err.Error())
+	}
+
+	chunking := ChunkOptions{Strategy: r.FormValue("chunkStrategy")}
+	if chunkSizeStr := r.FormValue("chunkSize"); chunkSizeStr != "" {
+		if cs, err := strconv.Atoi(chunkSizeStr); err == nil && cs > 0 {
+			chunking.Size = cs
+		}
+	}
+	if overlapStr := r.FormValue("chunkOverlap"); overlapStr != "" {
+		overlap, err := strconv.Atoi(overlapStr)
+		if err != nil {
+			return IngestOptions{}, newAPIError(http.StatusBadRequest, "chunkOverlap must be a number of words")
+		}
+		chunking.Overlap = overlap
+	}
+	if err := validateChunkOptions(chunking); err != nil {
+		return IngestOptions{}, newAPIError(http.StatusBadRequest, err.Error())
+	}
+	mapping, err := parseRecordMapping(r.FormValue("mapping"))
+	if err != nil {
+		return IngestOptions{}, newAPIError(http.StatusBadRequest, err.Error())
+	}
+	instructions := strings.TrimSpace(r.FormValue("instructions"))
+	if err := instructionsTooLong(instructions); err != nil {
+		return IngestOptions{}, err
+	}
+
+	opts := IngestOptions{
+		Chunking:   chunking,
+		Collection: r.FormValue("collection"),
+		Metadata: DocumentMetadata{
+			Title:  strings.TrimSpace(r.FormValue("title")),
+			Author: strings.TrimSpace(r.FormValue("author")),
+			Date:   date,
+			Tags:   parseTags(r.FormValue("tags")),
+		},
+		Instructions:    instructions,
+		GenerateSummary: r.FormValue("generateSummary") == "true",
+		ModelName:       r.FormValue("modelName"),
+		SummaryType:     r.FormValue("summaryType"),
+		EmbeddingModel:  r.FormValue("embeddingModel"),
+		RecordMapping:   mapping,
+		SummarySet:      r.FormValue("generateSummary") != "",
+	}
+	if classify := r.FormValue("classify"); classify != "" {
+		enabled := classify == "true"
+		opts.Classify = &enabled
+	}
+	opts, err = applyPreset(opts, r.FormValue("preset"), opts.SummarySet)
+	if err != nil {
+		return IngestOptions{}, err
+	}
+	opts.ModelName = modelOrDefault(opts.ModelName)
+	return opts, nil
+}
+
+// saveUpload writes an uploaded file into the documents directory and returns a
+// path to read it from. With encryption at rest the stored file is encrypted and
+// the path is a plain copy, which release removes.
+func saveUpload(src io.Reader, name string) (string, func(), error) {
+	filePath := filepath.Join("./documents", name)
+	if storageCipher != nil {
+		data, err := io.ReadAll(src)
+		if err == nil {
+			err = writeStoredFile(filePath, data)
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to save file: %w", err)
+		}
+		return writePlainCopy(name, data)
+	}
+
+	dst, err := os.Create(filePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to save file: %w", err)
+	}
+	defer closeFile(dst, filePath)
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return "", nil, fmt.Errorf("failed to save file: %w", err)
+	}
+	return filePath, func() {}, nil
+}
+
+// UploadResult reports the outcome for one file of a batch upload
+type UploadResult struct {
+	File       string `json:"file"`
+	Document   string `json:"document"`
+	Status     int    `json:"status"`
+	Message    string `json:"message,omitempty"`
+	SummaryJob string `json:"summaryJobId,omitempty"` // Job generating the summary, polled at /api/jobs/{id}
+	Error      string `json:"error,omitempty"`
+}
+
+func uploadResult(file, document, message string, err error) UploadResult {
+	result := UploadResult{File: file, Document: document, Status: http.StatusOK, Message: message}
+	if err != nil {
+		result.Status = http.StatusInternalServerError
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			result.Status = apiErr.Status
+		}
+		result.Message = ""
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// sendUploadResults responds with per-file results; the status is 200 unless every file failed
+func sendUploadResults(w http.ResponseWriter, results []UploadResult) {
+	status := http.StatusOK
+	succeeded := 0
+	for _, result := range results {
+		if result.Error == "" {
+			succeeded++
+		} else if status == http.StatusOK {
+			status = result.Status
+		}
+	}
+	if succeeded > 0 {
+		status = http.StatusOK
+	}
+
+	sendJSON(w, status, map[string]interface{}{
+		"message": fmt.Sprintf("Processed %d of %d files", succeeded, len(results)),
+		"results": results,
+	})
+}
+
+// ingestUpload saves one uploaded file and ingests it as a document named after
+// the file. It returns the ID of the job generating the summary, if one started.
+func ingestUpload(header *multipart.FileHeader, opts IngestOptions) (string, string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return "", "", newAPIError(http.StatusBadRequest, "Failed to read uploaded file")
+	}
+	defer closeFile(file, "uploaded file")
+
+	opts.Name = header.Filename
+	var message, summaryJob string
+	err = withDocumentLease(opts.Name, func() error {
+		filePath, release, err := saveUpload(file, header.Filename)
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, "Failed to save file")
+		}
+		defer release()
+		if splitsIntoDocuments(filePath, opts) {
+			message, err = ingestRecordDocuments(filePath, opts)
+			return err
+		}
+		var doc *Document
+		doc, message, err = ingestFile(filePath, opts)
+		if doc != nil {
+			summaryJob = doc.summaryJob
+		}
+		return err
+	})
+	return message, summaryJob, err
+}
+
+// extractFile extracts a file's text, reading structured files with the record mapping
+func extractFile(filePath string, opts IngestOptions) (*ExtractedText, error) {
+	var extracted *ExtractedText
+	var err error
+	if isStructuredFile(filePath) {
+		extracted, err = extractMappedText(filePath, opts.RecordMapping)
+	} else {
+		extracted, err = extractText(filePath)
+	}
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, fmt.Sprintf("Failed to extract text: %v", err))
+	}
+	return extracted, nil
+}
+
+// extractAndPreprocess extracts a file's text into ic, unless extracted already
+// holds it, and runs the preprocessing rules and text hooks on it
+func extractAndPreprocess(filePath string, extracted *ExtractedText, opts IngestOptions, ic *IngestContext) (*ExtractedText, error) {
+	if extracted == nil {
+		var err error
+		if extracted, err = extractFile(filePath, opts); err != nil {
+			return nil, err
+		}
+	}
+	ic.Text = extracted.Text
+	ic.Metadata = mergeMetadata(opts.Metadata, extracted.Metadata)
+	if err := runIngestHooks(StagePostExtract, ic); err != nil {
+		return nil, err
+	}
+
+	// Apply the collection's and preset's preprocessing rules before chunking.
+	// Records are preprocessed one by one so they stay separate.
+	if rules := ingestRules(opts); len(rules) > 0 {
+		var results []RuleResult
+		before := len(ic.Text)
+		if extracted.Records != nil && ic.Text == extracted.Text {
+			for i := range extracted.Records {
+				extracted.Records[i].Text, results = applyPreprocessRules(extracted.Records[i].Text, rules)
+			}
+			extracted.Text = joinRecords(extracted.Records)
+			ic.Text = extracted.Text
+		} else {
+			ic.Text, results = applyPreprocessRules(ic.Text, rules)
+		}
+		log.Printf("Preprocessed %s with %d rules (%d -> %d chars)", ic.Document, len(results), before, len(ic.Text))
+	}
+	if err := runIngestHooks(StagePreChunk, ic); err != nil {
+		return nil, err
+	}
+
+	// Hooks and rules that rewrite the text leave nothing to split into records
+	// or table rows
+	if ic.Text != extracted.Text {
+		extracted.Records = nil
+		extracted.Tables = nil
+	}
+	return extracted, nil
+}
+
+// inspectUpload classifies and routes a file before it is ingested, filling the
+// options from the preset chosen by the upload, else by the routing rule, else by
+// the document type. The text extracted to do so is returned for reuse; it is nil
+// when neither step runs or only the start of a large text file was read.
+func inspectUpload(filePath string, opts IngestOptions) (IngestOptions, *ExtractedText, error) {
+	classify := classifying(opts) && opts.Metadata.Custom[MetaType] == ""
+	route := routing(opts)
+	if !classify && !route {
+		return opts, nil, nil
+	}
+
+	var extracted *ExtractedText
+	var sample string
+	meta := opts.Metadata
+	if streamable(filePath, opts) {
+		var err error
+		if sample, err = readTextSample(filePath, classifySampleChars); err != nil {
+			return opts, nil, newAPIError(http.StatusInternalServerError, fmt.Sprintf("Failed to extract text: %v", err))
+		}
+	} else {
+		var err error
+		if extracted, err = extractFile(filePath, opts); err != nil {
+			return opts, nil, err
+		}
+		sample = extracted.Text
+		meta = mergeMetadata(meta, extracted.Metadata)
+	}
+
+	var label *ClassLabel
+	if classify {
+		if opts, label = classifyUpload(opts, sample); label != nil {
+			meta = withCustomMetadata(meta, MetaType, label.Name)
+		}
+	}
+	var rule *RoutingRule
+	if route {
+		opts, rule = routeUpload(opts, meta, sample)
+	}
+
+	preset := ""
+	switch {
+	case opts.Preset != "":
+	case rule != nil && rule.Preset != "":
+		preset = rule.Preset
+	case label != nil && label.Preset != "":
+		preset = label.Preset
+	}
+	if preset != "" {
+		withPreset, err := applyPreset(opts, preset, opts.SummarySet)
+		if err != nil {
+			log.Printf("Preset %s not applied to %s: %v", preset, opts.Name, err)
+		} else {
+			opts = withPreset
+			opts.ModelName = modelOrDefault(opts.ModelName)
+		}
+	}
+	return opts, extracted, nil
+}
+
+// ingestFile runs the extraction, preprocessing, chunking and indexing pipeline
+// for a saved file, stores the result and starts any requested background work.
+// It returns the stored document and a human-readable status message.
+func ingestFile(filePath string, opts IngestOptions) (*Document, string, error) {
+	name := opts.Name
+	requestedCollection := opts.Collection
+	contentHash, fileSize, err := fileFingerprint(filePath)
+	if err != nil {
+		return nil, "", newAPIError(http.StatusInternalServerError, fmt.Sprintf("Failed to read file: %v", err))
+	}
+	// Classification and routing run first, as the collection and preset they
+	// pick decide the remaining options
+	opts, extracted, err := inspectUpload(filePath, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	opts = applyCollectionSettings(opts)
+	ic := &IngestContext{
+		Document:   name,
+		Collection: opts.Collection,
+		Metadata:   opts.Metadata,
+	}
+
+	// Extract and chunk the text. Large plain files are chunked as they are read and
+	// never held whole; others are chunked after preprocessing, reusing unchanged
+	// chunks when a stored version was chunked the same way.
+	previous, replacing := documentStore.Get(name)
+	var streamed *streamedText
+	var starts []int
+	var chunkMeta []map[string]string
+	var reuse *chunkReuse
+	if extracted == nil && streamable(filePath, opts) {
+		streamed, err = streamChunkFile(filePath, opts.Chunking)
+		if err != nil {
+			return nil, "", newAPIError(http.StatusInternalServerError, fmt.Sprintf("Failed to extract text: %v", err))
+		}
+		extracted = &ExtractedText{}
+		ic.Chunks, starts = streamed.Chunks, streamed.Starts
+		log.Printf("Streamed %s: %d bytes", name, streamed.Size)
+	} else {
+		if extracted, err = extractAndPreprocess(filePath, extracted, opts, ic); err != nil {
+			return nil, "", err
+		}
+		var previousChunking ChunkOptions
+		var previousModel string
+		if replacing {
+			previous.mu.RLock()
+			previousChunking, previousModel = previous.Chunking, previous.EmbeddingModel
+			previous.mu.RUnlock()
+		}
+		if extracted.Records != nil {
+			// Records are chunked one by one, so a chunk never mixes two records
+			ic.Chunks, starts, chunkMeta = chunkRecords(extracted.Records, opts.Chunking)
+		} else if extracted.Tables != nil {
+			// Table chunks hold whole rows under the column names
+			ic.Chunks, starts, chunkMeta = chunkTables(extracted.Tables, opts.Chunking)
+		} else if replacing && !opts.FullReprocess && previousChunking == opts.Chunking {
+			ic.Chunks, starts, reuse = incrementalChunks(previous, ic.Text, opts.Chunking)
+			if opts.EmbeddingModel == "" {
+				opts.EmbeddingModel = previousModel
+			}
+		} else {
+			ic.Chunks, starts = chunkWithOptions(ic.Text, opts.Chunking)
+		}
+	}
+	// Documents given no embedding model anywhere get the server's, so they are
+	// retrieved by vector once embedded
+	if opts.EmbeddingModel == "" {
+		opts.EmbeddingModel = getConfig().EmbeddingModel
+	}
+	text := ic.Text
+
+	var pages []int
+	if extracted.PageCount > 0 {
+		pages = pageWordStarts(text)
+	}
+
+	if err := runIngestHooks(StagePostChunk, ic); err != nil {
+		return nil, "", err
+	}
+	chunks := ic.Chunks
+	if len(starts) != len(chunks) {
+		// Hooks changed the chunk list; assume consecutive chunks
+		starts = chunkWordStarts(chunks)
+		chunkMeta = nil
+	}
+	if reuse != nil {
+		reuse.verify(chunks)
+	}
+	if extracted.Cues != nil && text == extracted.Text {
+		chunkMeta = cueChunkMetadata(extracted.Cues, chunks, starts)
+	}
+	if extracted.Dates != nil && text == extracted.Text {
+		chunkMeta = datedChunkMetadata(extracted.Dates, starts)
+	}
+
+	// Create document
+	doc := &Document{
+		Name:          name,
+		Text:          text,
+		Chunks:        chunks,
+		ChunkCount:    len(chunks),
+		chunkStarts:   starts,
+		ContentSize:   len(text),
+		ContentHash:   contentHash,
+		FileSize:      fileSize,
+		PageCount:     extracted.PageCount,
+		ChunkPages:    chunkPages(starts, pages),
+		ChunkMetadata: chunkMeta,
+		RecordMapping: opts.RecordMapping,
+		Chunking:      opts.Chunking,
+		Collection:    opts.Collection,
+		Metadata:      ic.Metadata,
+		Instructions:  opts.Instructions,
+		Preset:        opts.Preset,
+		HasSummary:    false,
+		CreatedAt:     time.Now(),
+		textLower:     strings.ToLower(text),
+		retrievalHits: make([]int64, len(chunks)),
+	}
+	if streamed != nil {
+		doc.ContentSize = streamed.Size
+		doc.TOC = locateStreamedTOC(streamed.TOC, starts)
+	} else {
+		doc.TOC = locateTOC(extracted.TOC, text, starts)
+	}
+	assignChunkIDs(doc, reuse)
+	if replacing {
+		// A replacement continues the version count of the document it replaces
+		previous.mu.RLock()
+		doc.Version = previous.Version + 1
+		previous.mu.RUnlock()
+	}
+
+	var carried []QuantizedVector
+	message := fmt.Sprintf("Document processed: %d chunks created", len(chunks))
+	if opts.Collection != requestedCollection {
+		message += fmt.Sprintf(" (routed to collection %s)", opts.Collection)
+	}
+	if reuse != nil {
+		changed := reuse.changed()
+		message = fmt.Sprintf("Document updated: %d of %d chunks changed", changed, len(chunks))
+		for i, j := range reuse.from {
+			if j >= 0 && j < len(previous.retrievalHits) {
+				doc.retrievalHits[i] = atomic.LoadInt64(&previous.retrievalHits[j])
+			}
+		}
+		carried = reuse.carriedEmbeddings(opts.EmbeddingModel)
+
+		// Small edits leave the summary valid, so it is kept instead of regenerated
+		if hasSummary, summary := previous.GetSummaryStatus(); hasSummary &&
+			float64(changed) <= summaryReuseMaxChange*float64(len(chunks)) {
+			doc.HasSummary, doc.Summary = true, summary
+			opts.GenerateSummary = false
+			message += " (summary kept)"
+		}
+	}
+
+	ic.doc = doc
+	if err := runIngestHooks(StagePreIndex, ic); err != nil {
+		return nil, "", err
+	}
+	doc.Metadata = ic.Metadata
+
+	// Build word index for fast searching
+	wordIndex, termFreqs := indexChunks(chunks)
+	doc.wordIndex, doc.termFreqs = wordIndex, termFreqs
+	doc.vocabulary = buildVocabulary(wordIndex)
+	doc.importance = chunkImportance(doc)
+
+	// Store document first
+	if opts.BeforeSwap != nil {
+		if err := documentStore.Replace(name, previous, doc, opts.BeforeSwap); err != nil {
+			return nil, "", err
+		}
+	} else {
+		documentStore.Set(name, doc)
+	}
+	if replacing {
+		previous.mu.RLock()
+		invalidateGlossary(name, doc.Collection, previous.Collection)
+		previous.mu.RUnlock()
+		removePageImages(name)
+	} else {
+		invalidateGlossary(name, doc.Collection)
+	}
+
+	log.Printf("Processed %s: %d chunks, %d chars, %d indexed words",
+		name, len(chunks), doc.ContentSize, len(wordIndex))
+
+	message += startBackgroundProcessing(doc, opts, carried)
+	return doc, message, nil
+}
+
+const summaryJobType = "summary"
+
+// SummaryJobResult is the result of a summary job
+type SummaryJobResult struct {
+	Document      string `json:"document"`
+	Summary       string `json:"summary,omitempty"` // Of summarize requests
+	SummaryLength int    `json:"summaryLength"`
+	Version       int64  `json:"version,omitempty"` // Of the document with the summary
+}
+
+// generateIngestSummary summarizes a newly ingested document and stores the
+// summary, unless the document was deleted or replaced meanwhile
+func generateIngestSummary(ctx context.Context, doc *Document, modelName, summaryType string) (*SummaryJobResult, error) {
+	name := doc.Name
+	lease, err := acquireSummaryLease(name)
+	if err != nil {
+		return nil, err
+	}
+	defer lease.Release()
+
+	log.Printf("Starting async summary generation for %s", name)
+	summary, err := generateDocumentSummary(ctx, doc, modelName, summaryType)
+	if err != nil {
+		log.Printf("Summary generation failed for %s: %v", name, err)
+		return nil, err
+	}
+	if strings.TrimSpace(summary) == "" {
+		return nil, fmt.Errorf("the model returned an empty summary")
+	}
+	// The summary only goes to the version it was made from
+	if !doc.UpdateSummary(summary) {
+		return nil, fmt.Errorf("document %s was deleted or replaced while it was summarized", name)
+	}
+
+	log.Printf("Summary generation completed successfully for %s (length: %d)", name, len(summary))
+	return &SummaryJobResult{Document: name, SummaryLength: len(summary)}, nil
+}
+
+// startBackgroundProcessing launches async summary and embedding generation
+// and returns a note describing what was started. Non-empty entries of carried are
+// reused embeddings; only the remaining chunks are sent to the embedding model.
+func startBackgroundProcessing(doc *Document, opts IngestOptions, carried []QuantizedVector) string {
+	name := doc.Name
+	var note string
+
+	// Generate the summary as a job the client can poll
+	if opts.GenerateSummary && opts.ModelName != "" {
+		job := jobStore.Start(opts.Tenant, summaryJobType, "", func(ctx context.Context, job *Job) (interface{}, error) {
+			result, err := generateIngestSummary(ctx, doc, opts.ModelName, opts.SummaryType)
+			if err != nil {
+				return nil, err
+			}
+			return result, nil
+		})
+		doc.summaryJob = job.Snapshot().ID
+		note += " (summary generating in background)"
+	}
+
+	// Compute chunk embeddings asynchronously if an embedding model was given
+	if opts.EmbeddingModel != "" {
+		vectors := carried
+		if len(vectors) != len(doc.Chunks) {
+			vectors = make([]QuantizedVector, len(doc.Chunks))
+		}
+		var missing []int
+		var pending []string
+		for i, v := range vectors {
+			if v.Dim() == 0 {
+				missing = append(missing, i)
+				pending = append(pending, doc.Chunks[i])
+			}
+		}
+
+		if len(missing) == 0 {
+			doc.SetEmbeddings(opts.EmbeddingModel, vectors)
+			return note
+		}
+
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Panic in embedding generation for %s: %v", name, r)
+				}
+			}()
+
+			computed, err := embedChunks(backgroundContext(context.Background()), pending, opts.EmbeddingModel)
+			if err != nil {
+				log.Printf("Embedding generation failed for %s: %v", name, err)
+				return
+			}
+			for k, i := range missing {
+				vectors[i] = quantizeVector(computed[k])
+			}
+
+			doc.SetEmbeddings(opts.EmbeddingModel, vectors)
+			log.Printf("Embedded %d chunks for %s (model: %s, %d reused)",
+				len(computed), name, opts.EmbeddingModel, len(vectors)-len(computed))
+		}()
+		note += " (embeddings generating in background)"
+	}
+
+	return note
+}
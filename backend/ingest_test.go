@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func uploadForm(values url.Values) *http.Request {
+	r := httptest.NewRequest("POST", "/api/document/process", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestUploadChunkOverlap(t *testing.T) {
+	opts, err := ingestOptionsFromForm(uploadForm(url.Values{"chunkSize": {"200"}, "chunkOverlap": {"6"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Chunking.Size != 200 || opts.Chunking.Overlap != 6 {
+		t.Fatalf("got chunking %+v", opts.Chunking)
+	}
+
+	chunks, _ := chunkWithOptions(chunkTestText(200), opts.Chunking)
+	if len(chunks) < 3 {
+		t.Fatalf("got %d chunks", len(chunks))
+	}
+	for i := 1; i < len(chunks); i++ {
+		prev, next := strings.Fields(chunks[i-1]), strings.Fields(chunks[i])
+		if tail := prev[len(prev)-6:]; !slices.Equal(tail, next[:6]) {
+			t.Errorf("chunk %d starts with %q, want the end of chunk %d, %q", i, next[:6], i-1, tail)
+		}
+	}
+}
+
+func TestUploadChunkOverlapTooLarge(t *testing.T) {
+	_, err := ingestOptionsFromForm(uploadForm(url.Values{"chunkSize": {"100"}, "chunkOverlap": {"40"}}))
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest {
+		t.Fatalf("got %v, want a 400", err)
+	}
+}
+
+func TestPathIngestChunkOverlapTooLarge(t *testing.T) {
+	body := `{"path": "reports", "chunkSize": 100, "chunkOverlap": 40}`
+	w := httptest.NewRecorder()
+	ingestPathHandler(w, httptest.NewRequest("POST", "/api/ingest/path", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "overlap") {
+		t.Fatalf("got %d %s, want a 400 about the overlap", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PathIngestRequest selects files under a server-local directory and how to process them
+type PathIngestRequest struct {
+	Path            string         `json:"path"`
+	Recursive       *bool          `json:"recursive"` // Defaults to true
+	Include         []string       `json:"include"`   // Globs; all supported files when empty
+	Exclude         []string       `json:"exclude"`
+	Collection      string         `json:"collection"`
+	Tags            []string       `json:"tags"`
+	ChunkStrategy   string         `json:"chunkStrategy"`
+	ChunkSize       int            `json:"chunkSize"`
+	ChunkOverlap    int            `json:"chunkOverlap"` // Words repeated from the end of the previous chunk
+	Instructions    string         `json:"instructions"`
+	GenerateSummary bool           `json:"generateSummary"`
+	ModelName       string         `json:"modelName"`
+	SummaryType     string         `json:"summaryType"`
+	EmbeddingModel  string         `json:"embeddingModel"`
+	Mapping         *RecordMapping `json:"mapping"`  // For structured files (.json, .jsonl, .xml)
+	Preset          string         `json:"preset"`   // Processing preset filling the settings left unset
+	Classify        *bool          `json:"classify"` // Defaults to classification.enabled
+}
+
+// ingestPathRoots returns the directories path ingestion may read from, resolved
+// through symlinks. Path ingestion is disabled when INGEST_PATH_ROOTS is unset.
+func ingestPathRoots() []string {
+	var roots []string
+	for _, root := range filepath.SplitList(os.Getenv("INGEST_PATH_ROOTS")) {
+		if root = strings.TrimSpace(root); root == "" {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		if abs, err := filepath.Abs(resolved); err == nil {
+			roots = append(roots, abs)
+		}
+	}
+	return roots
+}
+
+// resolveIngestPath checks that dir is an existing directory inside one of the allowed roots
+func resolveIngestPath(dir string) (string, error) {
+	roots := ingestPathRoots()
+	if len(roots) == 0 {
+		return "", newAPIError(http.StatusForbidden, "Path ingestion is disabled; set INGEST_PATH_ROOTS")
+	}
+	if dir == "" || !filepath.IsAbs(dir) {
+		return "", newAPIError(http.StatusBadRequest, "path must be an absolute directory path")
+	}
+
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", newAPIError(http.StatusNotFound, "Directory not found")
+	}
+	info, err := os.Stat(resolved)
+	if err != nil || !info.IsDir() {
+		return "", newAPIError(http.StatusBadRequest, "path is not a directory")
+	}
+	for _, root := range roots {
+		if rel, err := filepath.Rel(root, resolved); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", newAPIError(http.StatusForbidden, "path is outside INGEST_PATH_ROOTS")
+}
+
+// matchesGlobs reports whether a slash-separated relative path matches any pattern.
+// Patterns without a slash match the file name, others the whole relative path.
+func matchesGlobs(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		target := rel
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(rel)
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// collectIngestFiles lists supported regular files under dir that pass the filters,
+// as slash-separated paths relative to dir. Symlinks are not followed.
+func collectIngestFiles(dir string, recursive bool, include, exclude []string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir {
+				return err
+			}
+			return nil // Skip unreadable entries
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if rel != "." && (!recursive || strings.HasPrefix(d.Name(), ".") || matchesGlobs(exclude, rel)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") || !isSupportedFile(d.Name()) {
+			return nil
+		}
+		if (len(include) > 0 && !matchesGlobs(include, rel)) || matchesGlobs(exclude, rel) {
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// sameFileContent reports whether a file holds the same bytes as a stored file,
+// which may be encrypted
+func sameFileContent(a, stored string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(stored)
+	if errA != nil || errB != nil || storageCipher == nil && infoA.Size() != infoB.Size() {
+		return false
+	}
+	dataA, errA := os.ReadFile(a)
+	dataB, errB := readStoredFile(stored)
+	return errA == nil && errB == nil && bytes.Equal(dataA, dataB)
+}
+
+// ingestLocalFile copies a server-local file into the documents directory and ingests
+// it, skipping files identical to the stored copy of an existing document. It
+// returns the ID of the job generating the summary, if one started.
+func ingestLocalFile(source string, opts IngestOptions) (string, string, error) {
+	stored := filepath.Join("./documents", opts.Name)
+	if _, exists := documentStore.Get(opts.Name); exists && sameFileContent(source, stored) {
+		return "Unchanged, skipped", "", nil
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		return "", "", newAPIError(http.StatusBadRequest, fmt.Sprintf("Failed to read file: %v", err))
+	}
+	defer closeFile(file, source)
+
+	var message, summaryJob string
+	err = withDocumentLease(opts.Name, func() error {
+		filePath, release, err := saveUpload(file, opts.Name)
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, "Failed to save file")
+		}
+		defer release()
+		if splitsIntoDocuments(filePath, opts) {
+			message, err = ingestRecordDocuments(filePath, opts)
+			return err
+		}
+		var doc *Document
+		doc, message, err = ingestFile(filePath, opts)
+		if doc != nil {
+			summaryJob = doc.summaryJob
+		}
+		return err
+	})
+	return message, summaryJob, err
+}
+
+// ingestPathHandler ingests every supported file under a directory on the server.
+// Files in subdirectories are named after their relative path, e.g. reports_q1.pdf.
+func ingestPathHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+
+	var req PathIngestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	for _, pattern := range append(append([]string(nil), req.Include...), req.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid glob pattern: %s", pattern))
+			return
+		}
+	}
+	chunking := ChunkOptions{Strategy: req.ChunkStrategy, Size: max(req.ChunkSize, 0), Overlap: req.ChunkOverlap}
+	if err := validateChunkOptions(chunking); err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := instructionsTooLong(strings.TrimSpace(req.Instructions)); err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	if req.Mapping != nil {
+		if err := req.Mapping.validate(); err != nil {
+			sendError(w, http.StatusBadRequest, fmt.Sprintf("invalid mapping: %v", err))
+			return
+		}
+	}
+
+	base, err := applyPreset(IngestOptions{
+		Chunking:        chunking,
+		Collection:      req.Collection,
+		Instructions:    strings.TrimSpace(req.Instructions),
+		GenerateSummary: req.GenerateSummary,
+		ModelName:       req.ModelName,
+		SummaryType:     req.SummaryType,
+		EmbeddingModel:  req.EmbeddingModel,
+		RecordMapping:   req.Mapping,
+		SummarySet:      req.GenerateSummary,
+		Classify:        req.Classify,
+	}, req.Preset, req.GenerateSummary)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	base.ModelName = modelOrDefault(base.ModelName)
+
+	dir, err := resolveIngestPath(req.Path)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	recursive := req.Recursive == nil || *req.Recursive
+	files, err := collectIngestFiles(dir, recursive, req.Include, req.Exclude)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to list directory: %v", err))
+		return
+	}
+
+	results := make([]UploadResult, 0, len(files))
+	for _, rel := range files {
+		name := sourceDocumentName(rel)
+		opts := base
+		opts.Name = name
+		opts.Metadata = DocumentMetadata{
+			Tags:   parseTags(strings.Join(req.Tags, ",")),
+			Custom: map[string]string{"sourcePath": filepath.Join(req.Path, filepath.FromSlash(rel))},
+		}
+		message, summaryJob, err := ingestLocalFile(filepath.Join(dir, filepath.FromSlash(rel)), opts)
+		result := uploadResult(rel, name, message, err)
+		result.SummaryJob = summaryJob
+		results = append(results, result)
+	}
+	sendUploadResults(w, results)
+}
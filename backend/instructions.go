@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const maxInstructionsLength = 2000
+
+// InstructionsRequest replaces a document's custom instructions
+type InstructionsRequest struct {
+	Instructions string `json:"instructions"`
+}
+
+// instructionsTooLong rejects instructions over maxInstructionsLength, wherever
+// they are set
+func instructionsTooLong(instructions string) error {
+	if len(instructions) > maxInstructionsLength {
+		return newAPIError(http.StatusBadRequest, "Instructions are too long")
+	}
+	return nil
+}
+
+// withDocumentInstructions prepends a document's standing instructions to a prompt
+func withDocumentInstructions(prompt, instructions string) string {
+	if instructions == "" {
+		return prompt
+	}
+	return "Instructions for this document (always follow them):\n" + instructions + "\n\n" + prompt
+}
+
+// handleDocumentInstructions reads (GET) or replaces (POST) a document's instructions
+func handleDocumentInstructions(w http.ResponseWriter, r *http.Request, docName string) {
+	if r.Method != "GET" && !validateMethod(w, r, "POST") {
+		return
+	}
+
+	doc, ok := getDocumentOrError(w, docName)
+	if !ok {
+		return
+	}
+
+	if r.Method == "GET" {
+		doc.mu.RLock()
+		instructions := doc.Instructions
+		w.Header().Set("ETag", documentETag(doc))
+		doc.mu.RUnlock()
+		sendJSON(w, http.StatusOK, map[string]string{"instructions": instructions})
+		return
+	}
+
+	var req InstructionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	instructions := strings.TrimSpace(req.Instructions)
+	if err := instructionsTooLong(instructions); err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	if !updateDocument(w, r, doc, walInstructions, func() string {
+		doc.Instructions = instructions
+		return instructions
+	}) {
+		return
+	}
+
+	sendJSON(w, http.StatusOK, map[string]string{"instructions": instructions})
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job states
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Finished jobs are kept this long for status polling
+const jobRetention = 24 * time.Hour
+
+const jobKeyPrefix = "job:"
+
+const (
+	jobWebhookTimeout  = 10 * time.Second
+	jobWebhookAttempts = 3 // Deliveries of a finished job, doubling the pause from a second
+)
+
+// exclusiveJobTypes never run more than one job at a time
+var exclusiveJobTypes = map[string]bool{backfillJobType: true}
+
+// JobProgress counts completed work units of a job
+type JobProgress struct {
+	Done  int    `json:"done"`
+	Total int    `json:"total"`
+	Unit  string `json:"unit,omitempty"` // e.g. "chunks"
+}
+
+// JobStatus is the externally visible state of a background job
+type JobStatus struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	State      string      `json:"state"`
+	Progress   JobProgress `json:"progress"`
+	Message    string      `json:"message,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	RetryOf    string      `json:"retryOf,omitempty"` // ID of the job this one retries
+	Tenant     string      `json:"tenant"`            // Tenant the job was started for; only it sees the job
+	CreatedAt  time.Time   `json:"createdAt"`
+	StartedAt  *time.Time  `json:"startedAt,omitempty"`
+	FinishedAt *time.Time  `json:"finishedAt,omitempty"`
+}
+
+// jobFunc does a job's work, reporting progress through the job, and returns its
+// result. It should stop early once ctx is cancelled.
+type jobFunc func(ctx context.Context, job *Job) (interface{}, error)
+
+// Job is a unit of background work tracked by the job store
+type Job struct {
+	status  JobStatus
+	run     jobFunc // Kept so the job can be retried
+	webhook string  // Posted the finished job's status, when set
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+}
+
+// Snapshot returns a copy of the job's current status
+func (j *Job) Snapshot() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// Update changes the job's status under its lock and publishes the new status,
+// raising an event when its state changed
+func (j *Job) Update(change func(status *JobStatus)) {
+	j.mu.Lock()
+	previous := j.status.State
+	change(&j.status)
+	status := j.status
+	j.mu.Unlock()
+	publishJobStatus(status)
+	if status.State != previous {
+		publishJobEvent(status)
+	}
+}
+
+// publishJobStatus copies a status to shared state when it is shared with other
+// instances, so any replica can report on the job and it outlives a restart
+func publishJobStatus(status JobStatus) {
+	if sharedStateRemote {
+		setJSON(jobKeyPrefix+status.ID, status, jobRetention)
+	}
+}
+
+// sharedJobStatus loads a job status published by any instance
+func sharedJobStatus(id string) (JobStatus, bool) {
+	var status JobStatus
+	if !sharedStateRemote || !getJSON(jobKeyPrefix+id, &status) {
+		return status, false
+	}
+	return status, true
+}
+
+// SetProgress records how many work units are done
+func (j *Job) SetProgress(done, total int) {
+	j.Update(func(s *JobStatus) {
+		s.Progress.Done, s.Progress.Total = done, total
+	})
+}
+
+// JobStore tracks background jobs by ID
+type JobStore struct {
+	jobs map[string]*Job
+	mu   sync.RWMutex
+}
+
+var jobStore = &JobStore{jobs: make(map[string]*Job)}
+
+func randomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return hex.EncodeToString([]byte(time.Now().Format("150405.000000")))
+	}
+	return hex.EncodeToString(b)
+}
+
+// Start registers a job of a tenant and runs it in the background. The run
+// function reports progress through the job and returns the job's result or
+// error. Jobs the server starts by itself belong to the default tenant.
+func (js *JobStore) Start(tenant, jobType, unit string, run jobFunc) *Job {
+	return js.start(tenant, jobType, unit, "", "", run)
+}
+
+// StartWithWebhook starts a job like Start and posts its status, result included,
+// to webhook once it has finished, whether it succeeded or not
+func (js *JobStore) StartWithWebhook(tenant, jobType, unit, webhook string, run jobFunc) *Job {
+	return js.start(tenant, jobType, unit, "", webhook, run)
+}
+
+func (js *JobStore) start(tenant, jobType, unit, retryOf, webhook string, run jobFunc) *Job {
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	ctx, cancel := context.WithCancel(backgroundContext(context.Background()))
+	job := &Job{
+		status: JobStatus{
+			ID:        randomID(),
+			Type:      jobType,
+			State:     JobPending,
+			Progress:  JobProgress{Unit: unit},
+			RetryOf:   retryOf,
+			Tenant:    tenant,
+			CreatedAt: time.Now(),
+		},
+		run:     run,
+		webhook: webhook,
+		cancel:  cancel,
+	}
+
+	js.mu.Lock()
+	js.prune()
+	js.jobs[job.status.ID] = job
+	js.mu.Unlock()
+	publishJobStatus(job.Snapshot())
+	publishJobEvent(job.Snapshot())
+
+	go func() {
+		defer cancel()
+		now := time.Now()
+		job.Update(func(s *JobStatus) {
+			s.State = JobRunning
+			s.StartedAt = &now
+		})
+
+		var result interface{}
+		var err error
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Panic in %s job %s: %v", jobType, job.status.ID, r)
+					err = fmt.Errorf("job panicked: %v", r)
+				}
+			}()
+			result, err = run(ctx, job)
+		}()
+
+		finished := time.Now()
+		job.Update(func(s *JobStatus) {
+			s.Result = result
+			s.FinishedAt = &finished
+			if err != nil && ctx.Err() != nil {
+				s.State = JobCancelled
+				s.Error = err.Error()
+			} else if err != nil {
+				s.State = JobFailed
+				s.Error = err.Error()
+			} else {
+				s.State = JobDone
+			}
+		})
+		if job.webhook != "" {
+			notifyJobWebhook(job.webhook, job.Snapshot())
+		}
+	}()
+	return job
+}
+
+// notifyJobWebhook posts a finished job's status to its webhook, trying again
+// after a pause when delivery fails
+func notifyJobWebhook(target string, status JobStatus) {
+	payload, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("Failed to encode %s job %s for its webhook: %v", status.Type, status.ID, err)
+		return
+	}
+	wait := time.Second
+	for attempt := 1; ; attempt++ {
+		err := postJobStatus(target, payload)
+		if err == nil {
+			return
+		}
+		if attempt == jobWebhookAttempts {
+			log.Printf("Gave up delivering %s job %s to its webhook after %d attempts: %v", status.Type, status.ID, attempt, err)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func postJobStatus(target string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), jobWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer closeFile(resp.Body, "job webhook response body")
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// prune drops finished jobs past the retention period; callers hold the write lock
+func (js *JobStore) prune() {
+	for id, job := range js.jobs {
+		status := job.Snapshot()
+		if status.FinishedAt != nil && time.Since(*status.FinishedAt) > jobRetention {
+			delete(js.jobs, id)
+		}
+	}
+}
+
+// Status returns a job's status, looking in shared state for jobs run by other
+// instances or before a restart
+func (js *JobStore) Status(id string) (JobStatus, bool) {
+	js.mu.RLock()
+	job, exists := js.jobs[id]
+	js.mu.RUnlock()
+	if exists {
+		return job.Snapshot(), true
+	}
+	return sharedJobStatus(id)
+}
+
+// Cancel asks a pending or running job of a tenant to stop. The job is marked
+// cancelled once its work returns.
+func (js *JobStore) Cancel(tenant, id string) (JobStatus, error) {
+	job, err := js.local(tenant, id)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	status := job.Snapshot()
+	if status.State != JobPending && status.State != JobRunning {
+		return status, newAPIError(http.StatusConflict, fmt.Sprintf("Job is already %s", status.State))
+	}
+	job.cancel()
+	log.Printf("Cancelling %s job %s", status.Type, id)
+	return job.Snapshot(), nil
+}
+
+// Retry runs a failed or cancelled job of a tenant again as a new job of the
+// same tenant
+func (js *JobStore) Retry(tenant, id string) (*Job, error) {
+	job, err := js.local(tenant, id)
+	if err != nil {
+		return nil, err
+	}
+	status := job.Snapshot()
+	if status.State != JobFailed && status.State != JobCancelled {
+		return nil, newAPIError(http.StatusConflict, "Only failed or cancelled jobs can be retried")
+	}
+	if exclusiveJobTypes[status.Type] && js.Active(status.Type) {
+		return nil, newAPIError(http.StatusConflict, fmt.Sprintf("Another %s job is already running", status.Type))
+	}
+	return js.start(status.Tenant, status.Type, status.Progress.Unit, id, job.webhook, job.run), nil
+}
+
+// local returns a tenant's job run by this instance. Jobs known only from shared
+// state cannot be controlled from here, and other tenants' jobs are not found.
+func (js *JobStore) local(tenant, id string) (*Job, error) {
+	js.mu.RLock()
+	job, exists := js.jobs[id]
+	js.mu.RUnlock()
+	if exists && job.Snapshot().ownedBy(tenant) {
+		return job, nil
+	}
+	if status, shared := sharedJobStatus(id); !exists && shared && status.ownedBy(tenant) {
+		return nil, newAPIError(http.StatusConflict, "Job ran on another instance or before a restart")
+	}
+	return nil, newAPIError(http.StatusNotFound, "Job not found")
+}
+
+// Active reports whether a job of the given type is pending or running
+func (js *JobStore) Active(jobType string) bool {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	for _, job := range js.jobs {
+		status := job.Snapshot()
+		if status.Type == jobType && (status.State == JobPending || status.State == JobRunning) {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns a tenant's job statuses, or every tenant's for "", newest first,
+// optionally filtered by type and state. With shared state this includes jobs
+// run by other instances.
+func (js *JobStore) List(tenant, jobType, state string) []JobStatus {
+	js.mu.RLock()
+	statuses := make(map[string]JobStatus, len(js.jobs))
+	for id, job := range js.jobs {
+		statuses[id] = job.Snapshot()
+	}
+	js.mu.RUnlock()
+
+	if sharedStateRemote {
+		keys, err := sharedState.Keys(jobKeyPrefix)
+		if err != nil {
+			log.Printf("Failed to list shared jobs: %v", err)
+		}
+		for _, key := range keys {
+			id := strings.TrimPrefix(key, jobKeyPrefix)
+			if _, local := statuses[id]; local {
+				continue
+			}
+			if status, found := sharedJobStatus(id); found {
+				statuses[id] = status
+			}
+		}
+	}
+
+	result := make([]JobStatus, 0, len(statuses))
+	for _, status := range statuses {
+		if (tenant != "" && !status.ownedBy(tenant)) || (jobType != "" && status.Type != jobType) || (state != "" && status.State != state) {
+			continue
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.After(result[j].CreatedAt) })
+	return result
+}
+
+// ownedBy reports whether a job belongs to tenant. Jobs published before jobs
+// had tenants belong to the default tenant.
+func (s JobStatus) ownedBy(tenant string) bool {
+	return s.Tenant == tenant || (s.Tenant == "" && tenant == defaultTenant)
+}
+
+// jobsHandler lists the request tenant's jobs (?type=, ?state=)
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	sendJSON(w, http.StatusOK, map[string]interface{}{"jobs": jobStore.List(tenant, query.Get("type"), query.Get("state"))})
+}
+
+// handleJobByID serves GET /api/jobs/{id} and POST /api/jobs/{id}/cancel and /retry
+func handleJobByID(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs/"), "/")
+	if path == "" {
+		jobsHandler(w, r)
+		return
+	}
+	parts := strings.Split(path, "/")
+	id := parts[0]
+
+	if len(parts) == 2 && parts[1] == "cancel" {
+		handleCancelJob(w, r, id)
+		return
+	} else if len(parts) == 2 && parts[1] == "retry" {
+		handleRetryJob(w, r, id)
+		return
+	} else if len(parts) != 1 {
+		sendError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	status, exists := jobStore.Status(id)
+	if !exists || !status.ownedBy(tenant) {
+		sendError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	sendJSON(w, http.StatusOK, status)
+}
+
+func handleCancelJob(w http.ResponseWriter, r *http.Request, id string) {
+	if !validateMethod(w, r, "POST") || rejectOnReplica(w) {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	status, err := jobStore.Cancel(tenant, id)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusAccepted, map[string]interface{}{"message": "Cancellation requested", "job": status})
+}
+
+func handleRetryJob(w http.ResponseWriter, r *http.Request, id string) {
+	if !validateMethod(w, r, "POST") || rejectOnReplica(w) {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	job, err := jobStore.Retry(tenant, id)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusAccepted, map[string]interface{}{"message": "Retry started", "job": job.Snapshot()})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useTestJobs starts the test with an empty job store and restores the store
+// when it ends
+func useTestJobs(t *testing.T) {
+	t.Helper()
+	saved := jobStore
+	t.Cleanup(func() { jobStore = saved })
+	jobStore = &JobStore{jobs: make(map[string]*Job)}
+}
+
+// finishedJob starts a job of tenant that succeeds at once and waits for it
+func finishedJob(t *testing.T, tenant string) JobStatus {
+	t.Helper()
+	job := jobStore.Start(tenant, summaryJobType, "", func(ctx context.Context, job *Job) (interface{}, error) {
+		return nil, nil
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Snapshot().FinishedAt == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("job did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return job.Snapshot()
+}
+
+func TestJobsScopedToTenant(t *testing.T) {
+	useTestJobs(t)
+	acme := finishedJob(t, "acme")
+	server := finishedJob(t, "")
+	if server.Tenant != defaultTenant {
+		t.Errorf("a job started without a tenant belongs to %q, want the default tenant", server.Tenant)
+	}
+
+	get := func(path, tenant string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if tenant != "" {
+			r.Header.Set(tenantHeader, tenant)
+		}
+		w := httptest.NewRecorder()
+		handleJobByID(w, r)
+		return w
+	}
+
+	for _, tt := range []struct {
+		tenant string
+		id     string
+		status int
+	}{
+		{"acme", acme.ID, http.StatusOK},
+		{"globex", acme.ID, http.StatusNotFound},
+		{"", acme.ID, http.StatusNotFound},
+		{"", server.ID, http.StatusOK},
+		{"acme", server.ID, http.StatusNotFound},
+	} {
+		if w := get("/api/jobs/"+tt.id, tt.tenant); w.Code != tt.status {
+			t.Errorf("job %s as %q: got %d %s, want %d", tt.id, tt.tenant, w.Code, w.Body.String(), tt.status)
+		}
+	}
+
+	for tenant, want := range map[string]string{"acme": acme.ID, "": server.ID} {
+		var listing struct {
+			Jobs []JobStatus `json:"jobs"`
+		}
+		if err := json.Unmarshal(get("/api/jobs/", tenant).Body.Bytes(), &listing); err != nil {
+			t.Fatal(err)
+		}
+		if len(listing.Jobs) != 1 || listing.Jobs[0].ID != want {
+			t.Errorf("%q lists %+v, want only job %s", tenant, listing.Jobs, want)
+		}
+	}
+	if all := jobStore.List("", "", ""); len(all) != 2 {
+		t.Errorf("listing every tenant's jobs gave %d, want 2", len(all))
+	}
+}
+
+func TestSummaryOfSupersededVersion(t *testing.T) {
+	dir := t.TempDir()
+	openTestPersistence(t, dir)
+	old := persistTestDocument("a.txt", "The first upload.")
+	documentStore.Set("a.txt", old)
+	documentStore.Set("a.txt", persistTestDocument("a.txt", "The second upload."))
+	if old.UpdateSummary("Describes the first upload.") {
+		t.Error("a summary was stored on a replaced upload")
+	}
+	if doc, _ := documentStore.Get("a.txt"); doc.HasSummary {
+		t.Errorf("the second upload took the first one's summary %q", doc.Summary)
+	}
+
+	deleted, _ := documentStore.Get("a.txt")
+	documentStore.Delete("a.txt")
+	if deleted.UpdateSummary("Describes the deleted upload.") {
+		t.Error("a summary was stored on a deleted document")
+	}
+	openTestPersistence(t, dir)
+	if names := storedNames(); len(names) != 0 {
+		t.Errorf("restored %v after the delete", names)
+	}
+}
+
+func TestJobControlScopedToTenant(t *testing.T) {
+	useTestJobs(t)
+	running := jobStore.Start("acme", summaryJobType, "", func(ctx context.Context, job *Job) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	id := running.Snapshot().ID
+
+	post := func(path, tenant string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, nil)
+		r.Header.Set(tenantHeader, tenant)
+		w := httptest.NewRecorder()
+		handleJobByID(w, r)
+		return w
+	}
+
+	for _, action := range []string{"cancel", "retry"} {
+		if w := post("/api/jobs/"+id+"/"+action, "globex"); w.Code != http.StatusNotFound {
+			t.Errorf("%s as another tenant: got %d %s, want 404", action, w.Code, w.Body.String())
+		}
+	}
+	if w := post("/api/jobs/"+id+"/cancel", "acme"); w.Code != http.StatusAccepted {
+		t.Fatalf("cancel as acme: got %d %s", w.Code, w.Body.String())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for running.Snapshot().State != JobCancelled {
+		if time.Now().After(deadline) {
+			t.Fatal("job was not cancelled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w := post("/api/jobs/"+id+"/retry", "acme")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("retry as acme: got %d %s", w.Code, w.Body.String())
+	}
+	var retried struct {
+		Job JobStatus `json:"job"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &retried); err != nil {
+		t.Fatal(err)
+	}
+	if retried.Job.Tenant != "acme" || retried.Job.RetryOf != id {
+		t.Errorf("retry belongs to %q and retries %q, want acme and %s", retried.Job.Tenant, retried.Job.RetryOf, id)
+	}
+	if _, err := jobStore.Cancel("acme", retried.Job.ID); err != nil {
+		t.Errorf("cancelling the retry: %v", err)
+	}
+}
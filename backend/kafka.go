@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kafkaTimeout  = 10 * time.Second
+	kafkaMaxReply = 16 << 20 // Largest response accepted from a broker
+
+	kafkaProduce  = 0 // API keys
+	kafkaMetadata = 3
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaClient is a minimal Kafka producer: it looks up the partition leaders of
+// the topics it writes to and sends each message on its own with acks=all, using
+// Metadata v4 and Produce v3 over plaintext connections. Messages with the same
+// key go to the same partition. Only the event forwarder uses it, from one
+// goroutine.
+type kafkaClient struct {
+	bootstrap []string
+	brokers   map[int32]string   // Node ID to address
+	leaders   map[string][]int32 // Topic to the leader of each partition
+	conns     map[string]net.Conn
+	nextID    int32
+}
+
+// newKafkaClient parses kafka://host[:port][,host[:port]...]
+func newKafkaClient(rawURL string) (*kafkaClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "kafka" || u.Host == "" {
+		return nil, fmt.Errorf("invalid kafka url %q", rawURL)
+	}
+	c := &kafkaClient{conns: make(map[string]net.Conn)}
+	for _, addr := range strings.Split(u.Host, ",") {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "9092")
+		}
+		c.bootstrap = append(c.bootstrap, addr)
+	}
+	return c, nil
+}
+
+func (c *kafkaClient) String() string { return "Kafka at " + strings.Join(c.bootstrap, ",") }
+
+// publish appends a message to a topic. Stale partition leaders are looked up
+// again and the message sent once more.
+func (c *kafkaClient) publish(topic, key string, payload []byte) error {
+	for attempt := 0; ; attempt++ {
+		err := c.produce(topic, key, payload)
+		if err == nil {
+			return nil
+		}
+		delete(c.leaders, topic)
+		if attempt > 0 {
+			return fmt.Errorf("kafka publish to %s failed: %w", topic, err)
+		}
+	}
+}
+
+func (c *kafkaClient) produce(topic, key string, payload []byte) error {
+	leaders, err := c.partitionLeaders(topic)
+	if err != nil {
+		return err
+	}
+	partition := int32(crc32.ChecksumIEEE([]byte(key)) % uint32(len(leaders)))
+	addr, ok := c.brokers[leaders[partition]]
+	if !ok {
+		return fmt.Errorf("partition %d of %s has no leader", partition, topic)
+	}
+
+	var req kafkaEncoder
+	req.int16(-1) // No transactional ID
+	req.int16(-1) // acks=all
+	req.int32(int32(kafkaTimeout / time.Millisecond))
+	req.int32(1)
+	req.string(topic)
+	req.int32(1)
+	req.int32(partition)
+	batch := recordBatch([]byte(key), payload, time.Now())
+	req.int32(int32(len(batch)))
+	req.buf.Write(batch)
+
+	reply, err := c.roundTrip(addr, kafkaProduce, 3, req.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	for topics := reply.int32(); topics > 0 && reply.err == nil; topics-- {
+		reply.string()
+		for partitions := reply.int32(); partitions > 0 && reply.err == nil; partitions-- {
+			reply.int32()
+			if code := reply.int16(); code != 0 {
+				return fmt.Errorf("kafka error %d", code)
+			}
+			reply.int64() // Offset
+			reply.int64() // Append time
+		}
+	}
+	return reply.err
+}
+
+// partitionLeaders returns the leader of each partition of a topic, asking the
+// bootstrap brokers in turn when it is not known
+func (c *kafkaClient) partitionLeaders(topic string) ([]int32, error) {
+	if leaders, ok := c.leaders[topic]; ok {
+		return leaders, nil
+	}
+	var req kafkaEncoder
+	req.int32(1)
+	req.string(topic)
+	req.int8(0) // Topics are not created on demand
+
+	var lastErr error
+	for _, addr := range c.bootstrap {
+		reply, err := c.roundTrip(addr, kafkaMetadata, 4, req.buf.Bytes())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		leaders, err := c.readMetadata(reply, topic)
+		if err != nil {
+			return nil, err
+		}
+		return leaders, nil
+	}
+	return nil, lastErr
+}
+
+func (c *kafkaClient) readMetadata(reply *kafkaDecoder, topic string) ([]int32, error) {
+	reply.int32() // Throttle time
+	brokers := make(map[int32]string)
+	for n := reply.int32(); n > 0 && reply.err == nil; n-- {
+		id, host, port := reply.int32(), reply.string(), reply.int32()
+		reply.nullableString() // Rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	reply.nullableString() // Cluster ID
+	reply.int32()          // Controller
+
+	var leaders []int32
+	for n := reply.int32(); n > 0 && reply.err == nil; n-- {
+		code, name := reply.int16(), reply.string()
+		reply.int8() // Internal
+		var partitions []int32
+		for p := reply.int32(); p > 0 && reply.err == nil; p-- {
+			reply.int16()
+			index, leader := reply.int32(), reply.int32()
+			reply.int32Array() // Replicas
+			reply.int32Array() // In-sync replicas
+			for int(index) >= len(partitions) {
+				partitions = append(partitions, -1)
+			}
+			partitions[index] = leader
+		}
+		if name != topic {
+			continue
+		}
+		if code != 0 {
+			return nil, fmt.Errorf("kafka error %d for topic %s", code, topic)
+		}
+		leaders = partitions
+	}
+	if reply.err != nil {
+		return nil, reply.err
+	}
+	if len(leaders) == 0 {
+		return nil, fmt.Errorf("kafka topic %s has no partitions", topic)
+	}
+	if c.leaders == nil {
+		c.leaders = make(map[string][]int32)
+	}
+	c.brokers, c.leaders[topic] = brokers, leaders
+	return leaders, nil
+}
+
+// roundTrip sends one request to a broker and returns the body of its response.
+// A failed connection is closed, to be dialed again by the next request.
+func (c *kafkaClient) roundTrip(addr string, apiKey, version int16, body []byte) (*kafkaDecoder, error) {
+	conn, ok := c.conns[addr]
+	if !ok {
+		var err error
+		if conn, err = net.DialTimeout("tcp", addr, kafkaTimeout); err != nil {
+			return nil, fmt.Errorf("failed to connect to kafka: %w", err)
+		}
+		c.conns[addr] = conn
+	}
+	reply, err := c.exchange(conn, apiKey, version, body)
+	if err != nil {
+		closeFile(conn, "kafka connection")
+		delete(c.conns, addr)
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *kafkaClient) exchange(conn net.Conn, apiKey, version int16, body []byte) (*kafkaDecoder, error) {
+	if err := conn.SetDeadline(time.Now().Add(kafkaTimeout)); err != nil {
+		return nil, err
+	}
+	c.nextID++
+	var header kafkaEncoder
+	header.int16(apiKey)
+	header.int16(version)
+	header.int32(c.nextID)
+	header.string("rag-backend")
+
+	request := binary.BigEndian.AppendUint32(nil, uint32(header.buf.Len()+len(body)))
+	request = append(append(request, header.buf.Bytes()...), body...)
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > kafkaMaxReply {
+		return nil, fmt.Errorf("invalid kafka response size %d", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+	if id := int32(binary.BigEndian.Uint32(data)); id != c.nextID {
+		return nil, fmt.Errorf("kafka response %d does not match request %d", id, c.nextID)
+	}
+	return &kafkaDecoder{data: data[4:]}, nil
+}
+
+func (c *kafkaClient) close() {
+	for addr, conn := range c.conns {
+		closeFile(conn, "kafka connection")
+		delete(c.conns, addr)
+	}
+}
+
+// recordBatch encodes a message as a batch (format v2) of one record
+func recordBatch(key, value []byte, now time.Time) []byte {
+	var record []byte
+	record = append(record, 0)              // Attributes
+	record = binary.AppendVarint(record, 0) // Timestamp delta
+	record = binary.AppendVarint(record, 0) // Offset delta
+	record = binary.AppendVarint(record, int64(len(key)))
+	record = append(record, key...)
+	record = binary.AppendVarint(record, int64(len(value)))
+	record = append(record, value...)
+	record = binary.AppendVarint(record, 0) // Headers
+
+	var tail kafkaEncoder // The part the CRC covers
+	tail.int16(0)         // Attributes: no compression
+	tail.int32(0)         // Last offset delta
+	tail.int64(now.UnixMilli())
+	tail.int64(now.UnixMilli())
+	tail.int64(-1) // Producer ID
+	tail.int16(-1) // Producer epoch
+	tail.int32(-1) // Base sequence
+	tail.int32(1)
+	tail.buf.Write(binary.AppendVarint(nil, int64(len(record))))
+	tail.buf.Write(record)
+
+	var batch kafkaEncoder
+	batch.int64(0) // Base offset
+	batch.int32(int32(4 + 1 + 4 + tail.buf.Len()))
+	batch.int32(-1) // Partition leader epoch
+	batch.int8(2)   // Magic
+	batch.int32(int32(crc32.Checksum(tail.buf.Bytes(), castagnoli)))
+	batch.buf.Write(tail.buf.Bytes())
+	return batch.buf.Bytes()
+}
+
+// kafkaEncoder writes the big-endian fields of Kafka requests
+type kafkaEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.buf.WriteByte(byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { e.buf.Write(binary.BigEndian.AppendUint16(nil, uint16(v))) }
+func (e *kafkaEncoder) int32(v int32) { e.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(v))) }
+func (e *kafkaEncoder) int64(v int64) { e.buf.Write(binary.BigEndian.AppendUint64(nil, uint64(v))) }
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf.WriteString(s)
+}
+
+// kafkaDecoder reads the fields of a Kafka response; after the first error every
+// read returns zero and err is kept
+type kafkaDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = fmt.Errorf("truncated kafka response")
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	return string(d.take(int(d.int16())))
+}
+
+func (d *kafkaDecoder) nullableString() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *kafkaDecoder) int32Array() {
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.int32()
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kvStore holds small pieces of state that replicas can share: caches, rate-limit
+// counters and job statuses. A zero ttl keeps a key until it is overwritten.
+type kvStore interface {
+	Get(key string) (string, bool, error)
+	Set(key, value string, ttl time.Duration) error
+	Incr(key string, by int64, ttl time.Duration) (int64, error) // ttl applies when the key is created
+	Keys(prefix string) ([]string, error)
+	Delete(key string) error
+}
+
+// sharedState is in memory unless STATE_BACKEND selects Redis
+var sharedState kvStore = newMemoryKV()
+
+// sharedStateRemote reports whether sharedState is visible to other instances
+var sharedStateRemote bool
+
+// getJSON decodes a stored JSON value; a missing or undecodable key reports false
+func getJSON(key string, value interface{}) bool {
+	raw, found, err := sharedState.Get(key)
+	if err != nil {
+		log.Printf("Failed to read %s from shared state: %v", key, err)
+		return false
+	}
+	if !found {
+		return false
+	}
+	return json.Unmarshal([]byte(raw), value) == nil
+}
+
+// setJSON stores a value as JSON, logging failures since callers treat the store as a cache
+func setJSON(key string, value interface{}, ttl time.Duration) {
+	data, err := json.Marshal(value)
+	if err == nil {
+		err = sharedState.Set(key, string(data), ttl)
+	}
+	if err != nil {
+		log.Printf("Failed to write %s to shared state: %v", key, err)
+	}
+}
+
+// memoryKV is the per-process store
+type memoryKV struct {
+	entries   map[string]memoryEntry
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+type memoryEntry struct {
+	value   string
+	expires time.Time // Zero for no expiry
+}
+
+func newMemoryKV() *memoryKV {
+	return &memoryKV{entries: make(map[string]memoryEntry), lastSweep: time.Now()}
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+func expiryFor(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func (m *memoryKV) Get(key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, exists := m.entries[key]
+	if !exists || entry.expired(time.Now()) {
+		return "", false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (m *memoryKV) Set(key, value string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep()
+	m.entries[key] = memoryEntry{value: value, expires: expiryFor(ttl)}
+	return nil
+}
+
+func (m *memoryKV) Incr(key string, by int64, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep()
+	entry, exists := m.entries[key]
+	if !exists || entry.expired(time.Now()) {
+		entry = memoryEntry{value: "0", expires: expiryFor(ttl)}
+	}
+	n, _ := strconv.ParseInt(entry.value, 10, 64)
+	n += by
+	entry.value = strconv.FormatInt(n, 10)
+	m.entries[key] = entry
+	return n, nil
+}
+
+func (m *memoryKV) Keys(prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var keys []string
+	for key, entry := range m.entries {
+		if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (m *memoryKV) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// sweep drops expired entries at most once a minute; callers hold m.mu
+func (m *memoryKV) sweep() {
+	now := time.Now()
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for key, entry := range m.entries {
+		if entry.expired(now) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+// redisKV keeps state in Redis under a common key prefix
+type redisKV struct {
+	client *redisClient
+}
+
+const (
+	redisStatePrefix = "rag:state:"
+	redisIncrScript  = `local n = redis.call("incrby", KEYS[1], ARGV[2]) if tonumber(ARGV[1]) > 0 and redis.call("pttl", KEYS[1]) == -1 then redis.call("pexpire", KEYS[1], ARGV[1]) end return n`
+)
+
+func (r *redisKV) Get(key string) (string, bool, error) {
+	reply, err := r.client.Do("GET", redisStatePrefix+key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	value, ok := reply.(string)
+	return value, ok, nil
+}
+
+func (r *redisKV) Set(key, value string, ttl time.Duration) error {
+	args := []string{"SET", redisStatePrefix + key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := r.client.Do(args...)
+	return err
+}
+
+func (r *redisKV) Incr(key string, by int64, ttl time.Duration) (int64, error) {
+	reply, err := r.client.Do("EVAL", redisIncrScript, "1", redisStatePrefix+key, strconv.FormatInt(ttl.Milliseconds(), 10), strconv.FormatInt(by, 10))
+	if err != nil {
+		return 0, err
+	}
+	n, _ := reply.(int64)
+	return n, nil
+}
+
+func (r *redisKV) Delete(key string) error {
+	_, err := r.client.Do("DEL", redisStatePrefix+key)
+	return err
+}
+
+func (r *redisKV) Keys(prefix string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := r.client.Do("SCAN", cursor, "MATCH", redisStatePrefix+prefix+"*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		parts, _ := reply.([]interface{})
+		if len(parts) != 2 {
+			return keys, nil
+		}
+		cursor, _ = parts[0].(string)
+		batch, _ := parts[1].([]interface{})
+		for _, key := range batch {
+			if s, ok := key.(string); ok {
+				keys = append(keys, strings.TrimPrefix(s, redisStatePrefix))
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
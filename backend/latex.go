@@ -0,0 +1,578 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Includes nested deeper than this are left out
+const maxTeXIncludeDepth = 8
+
+var (
+	texIncludePattern = regexp.MustCompile(`\\(?:input|include|subfile)\s*\{([^{}]+)\}`)
+	texBlankLines     = regexp.MustCompile(`\n[ \t]*(\n[ \t]*)+`)
+	texSpaces         = regexp.MustCompile(`[ \t]+`)
+)
+
+// Sectioning commands and their table of contents level before normalization
+var texSectionLevels = map[string]int{
+	"part": 0, "chapter": 1, "section": 2, "subsection": 3, "subsubsection": 4, "paragraph": 5,
+}
+
+// Commands dropped together with their arguments
+var texDroppedCommands = map[string]int{
+	"label": 1, "includegraphics": 1, "bibliographystyle": 1, "bibliography": 1,
+	"usepackage": 1, "documentclass": 1, "vspace": 1, "hspace": 1, "setlength": 2,
+	"newcommand": 2, "renewcommand": 2, "setcounter": 2, "addtocounter": 2,
+	"pagestyle": 1, "thispagestyle": 1, "pagenumbering": 1, "addbibresource": 1,
+	"newtheorem": 2, "graphicspath": 1, "hypersetup": 1, "color": 1, "thanks": 1,
+}
+
+// Environments whose content is not text
+var texDroppedEnvironments = map[string]bool{"comment": true, "tikzpicture": true, "filecontents": true}
+
+// Environments kept verbatim
+var texVerbatimEnvironments = map[string]bool{"verbatim": true, "lstlisting": true, "minted": true, "Verbatim": true}
+
+// Environments typeset as display math
+var texMathEnvironments = map[string]bool{
+	"equation": true, "equation*": true, "align": true, "align*": true, "gather": true,
+	"gather*": true, "multline": true, "multline*": true, "displaymath": true, "eqnarray": true,
+	"eqnarray*": true, "math": true,
+}
+
+// Text symbols written by commands without arguments
+var texSymbols = map[string]string{
+	"LaTeX": "LaTeX", "TeX": "TeX", "ldots": "…", "dots": "…", "textendash": "–",
+	"textemdash": "—", "S": "§", "P": "¶", "copyright": "©", "textregistered": "®",
+	"textbackslash": `\`, "ss": "ß", "ae": "æ", "oe": "œ", "o": "ø", "aa": "å", "l": "ł",
+	"today": "", "maketitle": "", "tableofcontents": "", "newpage": "\n\n", "clearpage": "\n\n",
+	"noindent": "", "centering": "", "item": "\n- ", "par": "\n\n", "quad": " ", "qquad": " ",
+	"bigskip": "\n", "medskip": "\n", "smallskip": "\n", "hline": "", "toprule": "", "midrule": "",
+	"bottomrule": "", "appendix": "",
+}
+
+// Math symbols written as Unicode
+var texMathSymbols = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ε", "varepsilon": "ε",
+	"zeta": "ζ", "eta": "η", "theta": "θ", "vartheta": "ϑ", "iota": "ι", "kappa": "κ",
+	"lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ", "pi": "π", "rho": "ρ", "sigma": "σ",
+	"tau": "τ", "upsilon": "υ", "phi": "φ", "varphi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ", "Pi": "Π",
+	"Sigma": "Σ", "Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+	"sum": "∑", "prod": "∏", "int": "∫", "oint": "∮", "partial": "∂", "nabla": "∇",
+	"infty": "∞", "pm": "±", "mp": "∓", "times": "×", "cdot": "·", "div": "÷", "ast": "∗",
+	"leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "neq": "≠", "ne": "≠", "approx": "≈",
+	"equiv": "≡", "sim": "∼", "simeq": "≃", "propto": "∝", "ll": "≪", "gg": "≫",
+	"in": "∈", "notin": "∉", "subset": "⊂", "subseteq": "⊆", "supset": "⊃", "supseteq": "⊇",
+	"cup": "∪", "cap": "∩", "emptyset": "∅", "varnothing": "∅", "forall": "∀", "exists": "∃",
+	"neg": "¬", "land": "∧", "wedge": "∧", "lor": "∨", "vee": "∨", "to": "→", "rightarrow": "→",
+	"leftarrow": "←", "Rightarrow": "⇒", "Leftarrow": "⇐", "leftrightarrow": "↔",
+	"Leftrightarrow": "⇔", "iff": "⇔", "implies": "⇒", "mapsto": "↦", "ldots": "…", "cdots": "⋯",
+	"circ": "∘", "degree": "°", "prime": "′", "langle": "⟨", "rangle": "⟩",
+	"lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈", "rceil": "⌉", "mid": "|", "parallel": "∥",
+	"perp": "⊥", "angle": "∠", "hbar": "ℏ", "ell": "ℓ", "Re": "ℜ", "Im": "ℑ", "aleph": "ℵ",
+	"log": "log", "ln": "ln", "exp": "exp", "sin": "sin", "cos": "cos", "tan": "tan",
+	"lim": "lim", "max": "max", "min": "min", "sup": "sup", "inf": "inf", "det": "det",
+	"left": "", "right": "", "big": "", "Big": "", "bigg": "", "Bigg": "", "displaystyle": "",
+	"quad": " ", "qquad": " ", "nonumber": "", "notag": "",
+}
+
+func extractLaTeXText(filePath string) (*ExtractedText, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	source := resolveTeXIncludes(stripTeXComments(string(data)), filepath.Dir(filePath), 0)
+
+	// Title and author come from the preamble; the text from the document body
+	preamble, body := "", source
+	if i := strings.Index(source, `\begin{document}`); i >= 0 {
+		preamble, body = source[:i], source[i+len(`\begin{document}`):]
+		if j := strings.Index(body, `\end{document}`); j >= 0 {
+			body = body[:j]
+		}
+	}
+
+	c := &texConverter{}
+	var meta DocumentMetadata
+	meta.Title = c.inline(preambleArgument(preamble, "title"))
+	meta.Author = strings.ReplaceAll(c.inline(strings.ReplaceAll(preambleArgument(preamble, "author"), `\and`, ";")), " ;", ";")
+
+	text := c.convert(body, false)
+	if meta.Title != "" {
+		text = meta.Title + "\n\n" + text
+	}
+	return &ExtractedText{Text: tidyTeXText(text), TOC: c.normalizedTOC(), Metadata: meta}, nil
+}
+
+// stripTeXComments removes unescaped % comments along with their line break, as TeX does
+func stripTeXComments(source string) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(source, "\n") {
+		cut := -1
+		for i := 0; i < len(line); i++ {
+			if strings.HasPrefix(line[i:], `\verb`) && i+5 < len(line) && !isASCIILetter(line[i+5]) {
+				// Skip inline verbatim text, which may contain %
+				if end := strings.IndexByte(line[i+6:], line[i+5]); end >= 0 {
+					i += 6 + end
+					continue
+				}
+			}
+			if line[i] == '\\' {
+				i++ // Skip the escaped character, including \%
+				continue
+			}
+			if line[i] == '%' {
+				cut = i
+				break
+			}
+		}
+		if cut >= 0 {
+			line = line[:cut]
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// resolveTeXIncludes replaces \input, \include and \subfile with the named files
+// from dir. Paths must stay inside dir; files ingested from subdirectories are
+// also found under their flattened names (sections/intro.tex as sections_intro.tex).
+func resolveTeXIncludes(source, dir string, depth int) string {
+	return texIncludePattern.ReplaceAllStringFunc(source, func(match string) string {
+		name := strings.TrimSpace(texIncludePattern.FindStringSubmatch(match)[1])
+		if depth >= maxTeXIncludeDepth {
+			log.Printf("Skipping LaTeX include %s: nested too deeply", name)
+			return ""
+		}
+		if filepath.Ext(name) == "" {
+			name += ".tex"
+		}
+		clean := filepath.Clean(filepath.FromSlash(name))
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			log.Printf("Skipping LaTeX include %s: outside the document directory", name)
+			return ""
+		}
+		for _, candidate := range []string{clean, strings.ReplaceAll(filepath.ToSlash(clean), "/", "_")} {
+			data, err := os.ReadFile(filepath.Join(dir, candidate))
+			if err == nil {
+				return "\n" + resolveTeXIncludes(stripTeXComments(string(data)), dir, depth+1) + "\n"
+			}
+		}
+		log.Printf("Skipping LaTeX include %s: not found", name)
+		return ""
+	})
+}
+
+// tidyTeXText collapses the whitespace left by removed markup
+func tidyTeXText(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(texSpaces.ReplaceAllString(line, " "))
+	}
+	return strings.TrimSpace(texBlankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// texConverter turns LaTeX source into readable text, collecting section headings
+type texConverter struct {
+	toc []TOCEntry
+}
+
+// normalizedTOC shifts heading levels so the top level used is 1
+func (c *texConverter) normalizedTOC() []TOCEntry {
+	top := 0
+	for i, e := range c.toc {
+		if i == 0 || e.Level < top {
+			top = e.Level
+		}
+	}
+	for i := range c.toc {
+		c.toc[i].Level -= top - 1
+	}
+	return c.toc
+}
+
+// preambleArgument returns the argument of a preamble command such as \title
+func preambleArgument(preamble, command string) string {
+	i := strings.Index(preamble, `\`+command+"{")
+	if i < 0 {
+		return ""
+	}
+	s := &texScanner{src: preamble, pos: i + len(command) + 1}
+	arg, _ := s.group()
+	return arg
+}
+
+// inline converts LaTeX source to text on a single line
+func (c *texConverter) inline(src string) string {
+	return strings.Join(strings.Fields(c.convert(src, false)), " ")
+}
+
+// texScanner reads LaTeX source
+type texScanner struct {
+	src string
+	pos int
+}
+
+func (s *texScanner) done() bool { return s.pos >= len(s.src) }
+
+func (s *texScanner) skipSpaces() {
+	for !s.done() && (s.src[s.pos] == ' ' || s.src[s.pos] == '\t' || s.src[s.pos] == '\n' || s.src[s.pos] == '\r') {
+		s.pos++
+	}
+}
+
+// balanced reads up to the close character matching open, which was just consumed
+func (s *texScanner) balanced(open, close byte) string {
+	start, depth := s.pos, 1
+	for ; !s.done(); s.pos++ {
+		switch s.src[s.pos] {
+		case '\\':
+			s.pos++
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				s.pos++
+				return s.src[start : s.pos-1]
+			}
+		}
+	}
+	return s.src[start:]
+}
+
+// group reads a {...} argument, or a single token when there are no braces
+func (s *texScanner) group() (string, bool) {
+	save := s.pos
+	s.skipSpaces()
+	if s.done() {
+		return "", false
+	}
+	switch s.src[s.pos] {
+	case '{':
+		s.pos++
+		return s.balanced('{', '}'), true
+	case '\\':
+		start := s.pos
+		s.pos++
+		s.commandName()
+		return s.src[start:s.pos], true
+	case '}', '$', '&':
+		s.pos = save
+		return "", false
+	}
+	s.pos++
+	return s.src[s.pos-1 : s.pos], true
+}
+
+// optional reads a [...] argument if present
+func (s *texScanner) optional() (string, bool) {
+	save := s.pos
+	s.skipSpaces()
+	if !s.done() && s.src[s.pos] == '[' {
+		s.pos++
+		return s.balanced('[', ']'), true
+	}
+	s.pos = save
+	return "", false
+}
+
+// commandName reads the name following a backslash: letters, or one other character
+func (s *texScanner) commandName() string {
+	start := s.pos
+	for !s.done() && isASCIILetter(s.src[s.pos]) {
+		s.pos++
+	}
+	if s.pos == start && !s.done() {
+		s.pos++
+	}
+	return s.src[start:s.pos]
+}
+
+// convert turns LaTeX source into text; math is true inside formulas
+func (c *texConverter) convert(src string, math bool) string {
+	var out strings.Builder
+	s := &texScanner{src: src}
+	for !s.done() {
+		ch := s.src[s.pos]
+		switch {
+		case ch == '\\':
+			s.pos++
+			c.command(s, &out, math)
+		case ch == '{':
+			s.pos++
+			out.WriteString(c.convert(s.balanced('{', '}'), math))
+		case ch == '}':
+			s.pos++
+		case ch == '$' && !math:
+			s.pos++
+			closer := "$"
+			if !s.done() && s.src[s.pos] == '$' {
+				s.pos++
+				closer = "$$"
+			}
+			end := strings.Index(s.src[s.pos:], closer)
+			if end < 0 {
+				end = len(s.src) - s.pos
+			}
+			formula := c.convert(s.src[s.pos:s.pos+end], true)
+			s.pos = min(len(s.src), s.pos+end+len(closer))
+			if closer == "$$" {
+				out.WriteString("\n\n" + formula + "\n\n")
+			} else {
+				out.WriteString(formula)
+			}
+		case ch == '~':
+			s.pos++
+			out.WriteByte(' ')
+		case ch == '&':
+			s.pos++
+			out.WriteString(" ")
+		case math && (ch == '^' || ch == '_'):
+			s.pos++
+			arg, _ := s.group()
+			inner := c.convert(arg, true)
+			if len([]rune(inner)) > 1 {
+				inner = "(" + inner + ")"
+			}
+			out.WriteString(string(ch) + inner)
+		case !math && ch == '-' && strings.HasPrefix(s.src[s.pos:], "---"):
+			s.pos += 3
+			out.WriteString("—")
+		case !math && ch == '-' && strings.HasPrefix(s.src[s.pos:], "--"):
+			s.pos += 2
+			out.WriteString("–")
+		case !math && ch == '`' && strings.HasPrefix(s.src[s.pos:], "``"):
+			s.pos += 2
+			out.WriteString("“")
+		case !math && ch == '\'' && strings.HasPrefix(s.src[s.pos:], "''"):
+			s.pos += 2
+			out.WriteString("”")
+		default:
+			s.pos++
+			out.WriteByte(ch)
+		}
+	}
+	return out.String()
+}
+
+// command converts the command whose backslash was just consumed
+func (c *texConverter) command(s *texScanner, out *strings.Builder, math bool) {
+	name := s.commandName()
+	starred := !s.done() && s.src[s.pos] == '*' && isASCIILetter(name[0])
+	if starred {
+		s.pos++
+	}
+
+	if len(name) == 1 && !isASCIILetter(name[0]) {
+		switch name {
+		case `\`:
+			out.WriteString("\n")
+			s.optional()
+		case "(", "[":
+			closer := `\)`
+			if name == "[" {
+				closer = `\]`
+			}
+			end := strings.Index(s.src[s.pos:], closer)
+			if end < 0 {
+				end = len(s.src) - s.pos
+			}
+			formula := c.convert(s.src[s.pos:s.pos+end], true)
+			s.pos = min(len(s.src), s.pos+end+len(closer))
+			if name == "[" {
+				formula = "\n\n" + formula + "\n\n"
+			}
+			out.WriteString(formula)
+		case ",", ";", ":", "!", " ":
+			out.WriteString(" ")
+		case "'", "`", "^", "\"", "~", "=", ".":
+			// Accents: keep the letter
+			arg, _ := s.group()
+			out.WriteString(c.convert(arg, math))
+		default:
+			out.WriteString(name) // Escaped characters such as \% \& \$ \_ \{ \}
+		}
+		return
+	}
+
+	if level, ok := texSectionLevels[name]; ok {
+		s.optional()
+		arg, _ := s.group()
+		title := c.inline(arg)
+		if title != "" {
+			c.toc = append(c.toc, TOCEntry{Title: title, Level: level})
+			out.WriteString("\n\n" + title + "\n\n")
+		}
+		return
+	}
+
+	switch name {
+	case "begin":
+		arg, _ := s.group()
+		c.environment(s, out, strings.TrimSpace(arg))
+		return
+	case "end":
+		s.group()
+		out.WriteString("\n")
+		return
+	case "frac", "dfrac", "tfrac", "binom":
+		num, _ := s.group()
+		den, _ := s.group()
+		sep := "/"
+		if name == "binom" {
+			sep = " choose "
+		}
+		out.WriteString("(" + c.convert(num, true) + ")" + sep + "(" + c.convert(den, true) + ")")
+		return
+	case "sqrt":
+		root, hasRoot := s.optional()
+		arg, _ := s.group()
+		if hasRoot {
+			out.WriteString(c.convert(root, true))
+		}
+		out.WriteString("√(" + c.convert(arg, true) + ")")
+		return
+	case "cite", "citep", "citet", "autocite", "parencite", "textcite":
+		s.optional()
+		s.optional()
+		arg, _ := s.group()
+		out.WriteString("[" + strings.Join(strings.Fields(strings.ReplaceAll(arg, ",", ", ")), " ") + "]")
+		return
+	case "ref", "eqref", "autoref", "cref", "Cref", "pageref":
+		arg, _ := s.group()
+		out.WriteString(strings.TrimSpace(arg))
+		return
+	case "verb":
+		if !s.done() {
+			delim := s.src[s.pos]
+			s.pos++
+			end := strings.IndexByte(s.src[s.pos:], delim)
+			if end < 0 {
+				end = len(s.src) - s.pos
+			}
+			out.WriteString(s.src[s.pos : s.pos+end])
+			s.pos = min(len(s.src), s.pos+end+1)
+		}
+		return
+	case "url":
+		arg, _ := s.group()
+		out.WriteString(arg)
+		return
+	case "href":
+		url, _ := s.group()
+		text, _ := s.group()
+		out.WriteString(c.convert(text, math) + " (" + url + ")")
+		return
+	case "footnote":
+		s.optional()
+		arg, _ := s.group()
+		out.WriteString(" (" + strings.TrimSpace(c.convert(arg, math)) + ")")
+		return
+	case "caption":
+		s.optional()
+		arg, _ := s.group()
+		out.WriteString("\n\n" + c.convert(arg, false) + "\n\n")
+		return
+	case "bibitem":
+		s.optional()
+		s.group()
+		out.WriteString("\n\n")
+		return
+	case "item":
+		if label, ok := s.optional(); ok {
+			out.WriteString("\n- " + c.convert(label, math) + " ")
+			return
+		}
+	}
+
+	if n, ok := texDroppedCommands[name]; ok {
+		s.optional()
+		for i := 0; i < n; i++ {
+			s.group()
+		}
+		return
+	}
+	if math {
+		if sym, ok := texMathSymbols[name]; ok {
+			out.WriteString(sym)
+			if sym != "" && isASCIILetter(sym[0]) {
+				out.WriteString(" ")
+			}
+			return
+		}
+	}
+	if sym, ok := texSymbols[name]; ok {
+		out.WriteString(sym)
+		return
+	}
+	if sym, ok := texMathSymbols[name]; ok {
+		out.WriteString(sym)
+		return
+	}
+
+	// Other commands (\textbf, \emph, \mathbf, \text, ...) keep the text of their
+	// braced arguments
+	s.optional()
+	for !s.done() && s.src[s.pos] == '{' {
+		s.pos++
+		out.WriteString(c.convert(s.balanced('{', '}'), math))
+	}
+}
+
+// environment converts \begin{name}...\end{name}, whose \begin was just consumed
+func (c *texConverter) environment(s *texScanner, out *strings.Builder, name string) {
+	endTag := `\end{` + name + `}`
+	end := strings.Index(s.src[s.pos:], endTag)
+	if end < 0 {
+		end = len(s.src) - s.pos
+	}
+	body := s.src[s.pos : s.pos+end]
+	s.pos = min(len(s.src), s.pos+end+len(endTag))
+
+	switch {
+	case texDroppedEnvironments[name]:
+	case texVerbatimEnvironments[name]:
+		if strings.HasPrefix(body, "[") {
+			inner := &texScanner{src: body}
+			inner.optional()
+			body = body[inner.pos:]
+		}
+		out.WriteString("\n\n" + strings.Trim(body, "\n") + "\n\n")
+	case texMathEnvironments[name]:
+		lines := strings.Split(body, `\\`)
+		for i, line := range lines {
+			lines[i] = strings.TrimSpace(c.convert(line, true))
+		}
+		out.WriteString("\n\n" + strings.Join(lines, "\n") + "\n\n")
+	case name == "abstract":
+		out.WriteString("\n\nAbstract\n\n" + c.convert(body, false) + "\n\n")
+	case name == "tabular" || name == "tabular*" || name == "tabularx" || name == "array":
+		inner := &texScanner{src: body}
+		if name != "tabular" && name != "array" {
+			inner.group() // Width
+		}
+		inner.optional()
+		inner.group() // Column specification
+		rows := strings.Split(body[inner.pos:], `\\`)
+		for i, row := range rows {
+			cells := strings.Split(row, "&")
+			for j, cell := range cells {
+				cells[j] = c.inline(cell)
+			}
+			rows[i] = strings.Join(cells, " | ")
+		}
+		out.WriteString("\n\n" + strings.Join(rows, "\n") + "\n\n")
+	default:
+		// Figures, lists, theorems and the like keep their text
+		inner := &texScanner{src: body}
+		inner.optional()
+		out.WriteString("\n" + c.convert(body[inner.pos:], false) + "\n")
+	}
+}
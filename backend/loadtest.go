@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadTestQuery is one scripted query; scripts are JSON lines of these
+type loadTestQuery struct {
+	Document string `json:"document"`
+	Query    string `json:"query"`
+	Section  string `json:"section,omitempty"`
+}
+
+// LatencyStats summarizes a set of timings in milliseconds
+type LatencyStats struct {
+	P50 float64 `json:"p50Ms"`
+	P95 float64 `json:"p95Ms"`
+	P99 float64 `json:"p99Ms"`
+	Max float64 `json:"maxMs"`
+}
+
+// LoadTestReport is the outcome of a load test run
+type LoadTestReport struct {
+	Seed      int64  `json:"seed"`
+	Documents int    `json:"documents"`
+	Words     int    `json:"words"`
+	Bytes     int    `json:"bytes"`
+	Chunks    int    `json:"chunks"`
+	HeapBytes uint64 `json:"heapBytes"` // Live heap after ingestion
+	Ingest    struct {
+		Seconds     float64      `json:"seconds"`
+		DocsPerSec  float64      `json:"docsPerSecond"`
+		MBPerSecond float64      `json:"mbPerSecond"`
+		Latency     LatencyStats `json:"latency"`
+	} `json:"ingest"`
+	EmbedSeconds float64 `json:"embedSeconds,omitempty"`
+	Queries      struct {
+		Count      int          `json:"count"`
+		Errors     int          `json:"errors"`
+		Seconds    float64      `json:"seconds"`
+		PerSecond  float64      `json:"perSecond"`
+		Latency    LatencyStats `json:"latency"`
+		FirstError string       `json:"firstError,omitempty"`
+	} `json:"queries"`
+}
+
+// runLoadTest generates a deterministic synthetic corpus, ingests it and replays a
+// query mix against the in-process pipeline. Model calls go to the mock provider
+// without latency or failures, so runs need no Ollama and measure chunking,
+// indexing and retrieval alone.
+// Invoked as `rag-backend loadtest [flags]`.
+func runLoadTest(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	docCount := fs.Int("docs", 100, "number of synthetic documents")
+	words := fs.Int("words", 5000, "words per document")
+	queryCount := fs.Int("queries", 1000, "number of generated queries")
+	concurrency := fs.Int("concurrency", 4, "parallel ingest and query workers")
+	seed := fs.Int64("seed", 1, "seed for corpus and query generation")
+	strategy := fs.String("chunk-strategy", "", "chunk strategy (fixed, sentence, paragraph)")
+	chunkSize := fs.Int("chunk-size", 0, "target chunk size in characters")
+	overlap := fs.Int("chunk-overlap", 0, "words repeated between chunks")
+	embed := fs.Bool("embed", false, "embed chunks with mock vectors to measure vector retrieval")
+	script := fs.String("script", "", "JSON lines file of {\"document\", \"query\", \"section\"} to replay instead of generated queries")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	verbose := fs.Bool("verbose", false, "keep pipeline logging")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	chunking := ChunkOptions{Strategy: *strategy, Size: *chunkSize, Overlap: *overlap}
+	if err := validateChunkOptions(chunking); err != nil {
+		return err
+	}
+	if *docCount < 1 || *words < 1 || *concurrency < 1 {
+		return errors.New("docs, words and concurrency must be positive")
+	}
+
+	// Measure the pipeline alone: instant mock model and no answer cache
+	config := *getConfig()
+	config.Provider = ProviderMock
+	config.Mock = MockConfig{}
+	config.QueryCacheTTL = 0
+	config.MaxConcurrentOllama = max(config.MaxConcurrentOllama, *concurrency)
+	config.Concurrency = ConcurrencyConfig{}
+	currentConfig.Store(&config)
+	applyConcurrency(&config)
+	if !*verbose {
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	dir, err := os.MkdirTemp("", "rag-loadtest-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	report := &LoadTestReport{Seed: *seed, Documents: *docCount}
+	vocabulary := syntheticVocabulary(rand.New(rand.NewSource(*seed)), 5000)
+	corpus := make([]syntheticDocument, *docCount)
+	for i := range corpus {
+		corpus[i] = generateSyntheticDocument(rand.New(rand.NewSource(*seed+int64(i)+1)), vocabulary, i, *words)
+		corpus[i].path = filepath.Join(dir, corpus[i].name)
+		if err := os.WriteFile(corpus[i].path, []byte(corpus[i].text), 0644); err != nil {
+			return err
+		}
+		report.Words += *words
+		report.Bytes += len(corpus[i].text)
+	}
+
+	var queries []loadTestQuery
+	if *script != "" {
+		if queries, err = readQueryScript(*script); err != nil {
+			return err
+		}
+	} else {
+		queries = generateQueryMix(rand.New(rand.NewSource(*seed)), corpus, *queryCount)
+	}
+
+	embeddingModel := ""
+	if *embed {
+		embeddingModel = mockModelName
+	}
+	start := time.Now()
+	ingestTimes, ingestErrs := runParallel(len(corpus), *concurrency, func(i int) error {
+		_, _, err := ingestFile(corpus[i].path, IngestOptions{Name: corpus[i].name, Chunking: chunking, EmbeddingModel: embeddingModel})
+		return err
+	})
+	elapsed := time.Since(start).Seconds()
+	if len(ingestErrs) > 0 {
+		return fmt.Errorf("ingestion failed: %v", ingestErrs[0])
+	}
+	report.Ingest.Seconds = elapsed
+	report.Ingest.DocsPerSec = float64(len(corpus)) / elapsed
+	report.Ingest.MBPerSecond = float64(report.Bytes) / (1 << 20) / elapsed
+	report.Ingest.Latency = latencyStats(ingestTimes)
+	for _, doc := range documentStore.All() {
+		report.Chunks += doc.ChunkCount
+	}
+
+	if *embed {
+		embedStart := time.Now()
+		for !allEmbedded() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		report.EmbedSeconds = time.Since(embedStart).Seconds() + elapsed
+	}
+
+	runtime.GC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	report.HeapBytes = mem.HeapAlloc
+
+	start = time.Now()
+	queryTimes, queryErrs := runParallel(len(queries), *concurrency, func(i int) error {
+		q := queries[i]
+		_, err := runQuery(QueryRequest{DocumentName: q.Document, Query: q.Query, Section: q.Section, ModelName: mockModelName})
+		return err
+	})
+	elapsed = time.Since(start).Seconds()
+	report.Queries.Count = len(queries)
+	report.Queries.Errors = len(queryErrs)
+	if len(queryErrs) > 0 {
+		report.Queries.FirstError = queryErrs[0].Error()
+	}
+	report.Queries.Seconds = elapsed
+	report.Queries.PerSecond = float64(len(queries)) / elapsed
+	report.Queries.Latency = latencyStats(queryTimes)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	printLoadTestReport(report)
+	return nil
+}
+
+func allEmbedded() bool {
+	for _, doc := range documentStore.All() {
+		if doc.RetrievalMode() != "vector" {
+			return false
+		}
+	}
+	return true
+}
+
+// runParallel runs task for 0..n-1 on a pool of workers and returns each task's
+// duration and any errors
+func runParallel(n, workers int, task func(i int) error) ([]time.Duration, []error) {
+	durations := make([]time.Duration, n)
+	var errs []error
+	var mu sync.Mutex
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				start := time.Now()
+				err := task(i)
+				durations[i] = time.Since(start)
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return durations, errs
+}
+
+func latencyStats(durations []time.Duration) LatencyStats {
+	if len(durations) == 0 {
+		return LatencyStats{}
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) float64 {
+		d := sorted[min(len(sorted)-1, int(p*float64(len(sorted))))]
+		return float64(d.Microseconds()) / 1000
+	}
+	return LatencyStats{P50: at(0.50), P95: at(0.95), P99: at(0.99), Max: at(1)}
+}
+
+func printLoadTestReport(r *LoadTestReport) {
+	fmt.Printf("Corpus:   %d documents, %d words, %.1f MB, %d chunks (seed %d)\n",
+		r.Documents, r.Words, float64(r.Bytes)/(1<<20), r.Chunks, r.Seed)
+	fmt.Printf("Ingest:   %.2fs, %.1f docs/s, %.2f MB/s, per document p50 %.2fms p95 %.2fms p99 %.2fms max %.2fms\n",
+		r.Ingest.Seconds, r.Ingest.DocsPerSec, r.Ingest.MBPerSecond,
+		r.Ingest.Latency.P50, r.Ingest.Latency.P95, r.Ingest.Latency.P99, r.Ingest.Latency.Max)
+	if r.EmbedSeconds > 0 {
+		fmt.Printf("Embedded: all chunks after %.2fs\n", r.EmbedSeconds)
+	}
+	fmt.Printf("Heap:     %.1f MB after ingestion\n", float64(r.HeapBytes)/(1<<20))
+	fmt.Printf("Queries:  %d in %.2fs, %.1f/s, p50 %.3fms p95 %.3fms p99 %.3fms max %.3fms, %d errors\n",
+		r.Queries.Count, r.Queries.Seconds, r.Queries.PerSecond,
+		r.Queries.Latency.P50, r.Queries.Latency.P95, r.Queries.Latency.P99, r.Queries.Latency.Max, r.Queries.Errors)
+	if r.Queries.FirstError != "" {
+		fmt.Printf("          first error: %s\n", r.Queries.FirstError)
+	}
+}
+
+func readQueryScript(path string) ([]loadTestQuery, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile(file, path)
+
+	var queries []loadTestQuery
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var q loadTestQuery
+		if err := json.Unmarshal([]byte(text), &q); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		queries = append(queries, q)
+	}
+	return queries, scanner.Err()
+}
+
+// syntheticDocument is a generated markdown document
+type syntheticDocument struct {
+	name     string
+	path     string
+	text     string
+	topics   []string // Words this document uses unusually often
+	sections int
+}
+
+var syllables = []string{"ka", "lo", "mi", "ren", "ta", "vo", "shi", "del", "po", "ru", "an", "te", "zu", "mar", "ix", "el", "on", "qua", "bri", "so"}
+
+// syntheticVocabulary generates distinct pronounceable words
+func syntheticVocabulary(rng *rand.Rand, size int) []string {
+	seen := make(map[string]bool, size)
+	words := make([]string, 0, size)
+	for len(words) < size {
+		var b strings.Builder
+		for n := 2 + rng.Intn(3); n > 0; n-- {
+			b.WriteString(syllables[rng.Intn(len(syllables))])
+		}
+		if word := b.String(); !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// generateSyntheticDocument writes numbered sections of paragraphs whose words
+// follow a Zipf distribution, with a few topic words mixed in
+func generateSyntheticDocument(rng *rand.Rand, vocabulary []string, index, words int) syntheticDocument {
+	zipf := rand.NewZipf(rng, 1.1, 1, uint64(len(vocabulary)-1))
+	doc := syntheticDocument{name: fmt.Sprintf("synthetic-%05d.md", index)}
+	for i := 0; i < 5; i++ {
+		doc.topics = append(doc.topics, vocabulary[rng.Intn(len(vocabulary))])
+	}
+	pick := func() string {
+		if rng.Intn(20) == 0 {
+			return doc.topics[rng.Intn(len(doc.topics))]
+		}
+		return vocabulary[zipf.Uint64()]
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Synthetic document %d\n\n", index)
+	written, paragraph, sentence := 0, 0, 0
+	for written < words {
+		if written%400 == 0 {
+			doc.sections++
+			fmt.Fprintf(&b, "\n## %d. %s %s\n\n", doc.sections, pick(), pick())
+		}
+		word := pick()
+		if sentence == 0 {
+			word = strings.ToUpper(word[:1]) + word[1:]
+		}
+		b.WriteString(word)
+		written++
+		sentence++
+		paragraph++
+
+		if sentence >= 8+rng.Intn(12) {
+			b.WriteString(".")
+			sentence = 0
+			if paragraph >= 60+rng.Intn(60) {
+				b.WriteString("\n\n")
+				paragraph = 0
+				continue
+			}
+		}
+		b.WriteString(" ")
+	}
+	b.WriteString(".\n")
+	doc.text = b.String()
+	return doc
+}
+
+// generateQueryMix builds queries of two to four words, mostly drawn from the target
+// document's topics, with some section-scoped queries and some unknown words
+func generateQueryMix(rng *rand.Rand, corpus []syntheticDocument, count int) []loadTestQuery {
+	queries := make([]loadTestQuery, count)
+	for i := range queries {
+		doc := corpus[rng.Intn(len(corpus))]
+		var terms []string
+		for n := 2 + rng.Intn(3); n > 0; n-- {
+			if rng.Intn(10) == 0 {
+				terms = append(terms, fmt.Sprintf("unknown%d", rng.Intn(1000)))
+			} else {
+				terms = append(terms, doc.topics[rng.Intn(len(doc.topics))])
+			}
+		}
+		queries[i] = loadTestQuery{Document: doc.name, Query: strings.Join(terms, " ")}
+		if rng.Intn(10) == 0 {
+			queries[i].Section = fmt.Sprintf("%d", 1+rng.Intn(doc.sections))
+		}
+	}
+	return queries
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	leaseTTL          = 30 * time.Second
+	leaseRetryDelay   = 200 * time.Millisecond
+	documentLeaseWait = 10 * time.Second
+)
+
+var errLeaseHeld = errors.New("lease is held elsewhere")
+
+// lockBackend grants expiring leases identified by a random token, so only the
+// holder can renew or release them
+type lockBackend interface {
+	tryAcquire(key, token string, ttl time.Duration) (bool, error)
+	renew(key, token string, ttl time.Duration) (bool, error)
+	release(key, token string) error
+}
+
+// localLocks coordinates requests within this process
+type localLocks struct {
+	leases map[string]localLease
+	mu     sync.Mutex
+}
+
+type localLease struct {
+	token   string
+	expires time.Time
+}
+
+func (l *localLocks) tryAcquire(key, token string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if current, held := l.leases[key]; held && time.Now().Before(current.expires) {
+		return false, nil
+	}
+	l.leases[key] = localLease{token: token, expires: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (l *localLocks) renew(key, token string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if current, held := l.leases[key]; !held || current.token != token {
+		return false, nil
+	}
+	l.leases[key] = localLease{token: token, expires: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (l *localLocks) release(key, token string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if current, held := l.leases[key]; held && current.token == token {
+		delete(l.leases, key)
+	}
+	return nil
+}
+
+// redisLocks coordinates instances sharing a Redis server. Renew and release
+// only touch the key while it still holds the caller's token.
+type redisLocks struct {
+	client *redisClient
+}
+
+const (
+	redisLockPrefix    = "rag:lock:"
+	redisRenewScript   = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+	redisReleaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+)
+
+func (l *redisLocks) tryAcquire(key, token string, ttl time.Duration) (bool, error) {
+	reply, err := l.client.Do("SET", redisLockPrefix+key, token, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return reply == "OK", err
+}
+
+func (l *redisLocks) renew(key, token string, ttl time.Duration) (bool, error) {
+	reply, err := l.client.Do("EVAL", redisRenewScript, "1", redisLockPrefix+key, token, strconv.FormatInt(ttl.Milliseconds(), 10))
+	return reply == int64(1), err
+}
+
+func (l *redisLocks) release(key, token string) error {
+	_, err := l.client.Do("EVAL", redisReleaseScript, "1", redisLockPrefix+key, token)
+	return err
+}
+
+// leaseBackend switches to Redis when REDIS_URL is configured
+var leaseBackend lockBackend = &localLocks{leases: make(map[string]localLease)}
+
+// Lease is a held lock that renews itself until released
+type Lease struct {
+	key   string
+	token string
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// acquireLease takes the named lease, retrying for up to wait while another
+// request or instance holds it
+func acquireLease(key string, wait time.Duration) (*Lease, error) {
+	token := randomID()
+	deadline := time.Now().Add(wait)
+	for {
+		ok, err := leaseBackend.tryAcquire(key, token, leaseTTL)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			lease := &Lease{key: key, token: token, stop: make(chan struct{})}
+			go lease.keepAlive()
+			return lease, nil
+		}
+		if time.Now().Add(leaseRetryDelay).After(deadline) {
+			return nil, errLeaseHeld
+		}
+		time.Sleep(leaseRetryDelay)
+	}
+}
+
+func (l *Lease) keepAlive() {
+	ticker := time.NewTicker(leaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			ok, err := leaseBackend.renew(l.key, l.token, leaseTTL)
+			if err != nil || !ok {
+				log.Printf("Lost lease %s: renewed=%v err=%v", l.key, ok, err)
+				return
+			}
+		}
+	}
+}
+
+// Release gives up the lease; calling it more than once is harmless
+func (l *Lease) Release() {
+	l.once.Do(func() {
+		close(l.stop)
+		if err := leaseBackend.release(l.key, l.token); err != nil {
+			log.Printf("Failed to release lease %s: %v", l.key, err)
+		}
+	})
+}
+
+// withDocumentLease runs fn while holding the write lease for a document, so two
+// requests or instances never save and process the same document at once
+func withDocumentLease(name string, fn func() error) error {
+	lease, err := acquireLease("document:"+name, documentLeaseWait)
+	if err != nil {
+		return leaseError(err, "Document is being processed by another request")
+	}
+	defer lease.Release()
+	return fn()
+}
+
+// acquireSummaryLease claims summary generation for a document without waiting,
+// so a document is never summarized twice at once
+func acquireSummaryLease(name string) (*Lease, error) {
+	lease, err := acquireLease("summary:"+name, 0)
+	if err != nil {
+		return nil, leaseError(err, "A summary is already being generated for this document")
+	}
+	return lease, nil
+}
+
+// leaseError maps a failed acquisition to an API error
+func leaseError(err error, heldMessage string) error {
+	if errors.Is(err, errLeaseHeld) {
+		return newAPIError(http.StatusConflict, heldMessage)
+	}
+	return newAPIError(http.StatusServiceUnavailable, "Lock service unavailable: "+err.Error())
+}
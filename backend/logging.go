@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Secrets shorter than this are not masked, as they would match ordinary words
+const minSecretLength = 6
+
+// secretPatterns match credentials by their shape: bearer tokens, URL user info
+// and key, token, password or signature parameters in query strings, JSON and headers
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`),
+	regexp.MustCompile(`(://[^/\s:@]+:)[^@\s/]+(@)`),
+	regexp.MustCompile(`(?i)((?:api[_-]?key|access[_-]?key|secret|token|password|passwd|signature|x-amz-security-token)["']?\s*[:=]\s*["']?)[^\s"'&,;}]+`),
+}
+
+// logSecrets holds configured secret values, longest first, so they are masked
+// wherever they appear
+var logSecrets struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// registerSecret masks a value in all further log output
+func registerSecret(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minSecretLength {
+		return
+	}
+	logSecrets.mu.Lock()
+	defer logSecrets.mu.Unlock()
+	for _, existing := range logSecrets.values {
+		if existing == value {
+			return
+		}
+	}
+	logSecrets.values = append(logSecrets.values, value)
+	sort.Slice(logSecrets.values, func(i, j int) bool { return len(logSecrets.values[i]) > len(logSecrets.values[j]) })
+}
+
+// registerEnvSecrets masks the values of environment variables that hold
+// credentials, and the password of REDIS_URL
+func registerEnvSecrets() {
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		upper := strings.ToUpper(name)
+		for _, suffix := range []string{"_KEY", "_TOKEN", "_PASSWORD", "_SECRET", "_SECRET_ACCESS_KEY"} {
+			if strings.HasSuffix(upper, suffix) {
+				registerSecret(value)
+				break
+			}
+		}
+	}
+	if u, err := url.Parse(getEnv("REDIS_URL", "")); err == nil && u.User != nil {
+		password, _ := u.User.Password()
+		registerSecret(password)
+	}
+}
+
+// redactSecrets masks credentials in a log line
+func redactSecrets(s string) string {
+	logSecrets.mu.RLock()
+	for _, secret := range logSecrets.values {
+		s = strings.ReplaceAll(s, secret, "[REDACTED]")
+	}
+	logSecrets.mu.RUnlock()
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, "${1}[REDACTED]${2}")
+	}
+	return s
+}
+
+// redactingWriter masks secrets in everything written through the log package,
+// including the standard library's own messages
+type redactingWriter struct {
+	out io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, redactSecrets(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// installLogRedaction routes log output through secret masking
+func installLogRedaction() {
+	registerEnvSecrets()
+	log.SetOutput(redactingWriter{out: os.Stderr})
+}
+
+// verboseLogging tells whether prompts, model replies and third-party output
+// may be logged (LOG_PROMPTS); it is off by default as they hold document text
+func verboseLogging() bool {
+	return getConfig().LogPrompts
+}
+
+// logPrompt logs a prompt and the model's reply when verbose logging is on
+func logPrompt(model, prompt, response string) {
+	if !verboseLogging() {
+		return
+	}
+	log.Printf("Prompt to %s (%d chars):\n%s\nReply (%d chars):\n%s", model, len(prompt), prompt, len(response), response)
+}
+
+// outputError is a failure whose message includes output from a hook, webhook or
+// command, which may echo document text. Requests see the output; logs only with
+// verbose logging.
+type outputError struct {
+	message string
+	output  string
+}
+
+func newOutputError(output []byte, format string, args ...interface{}) *outputError {
+	return &outputError{message: fmt.Sprintf(format, args...), output: string(bytes.TrimSpace(output))}
+}
+
+func (e *outputError) Error() string {
+	if e.output == "" {
+		return e.message
+	}
+	return e.message + ": " + e.output
+}
+
+// loggable returns an error's message for the log, leaving out output that may
+// hold document text unless verbose logging is on
+func loggable(err error) string {
+	var outErr *outputError
+	if err == nil || verboseLogging() || !errors.As(err, &outErr) || outErr.output == "" {
+		return fmt.Sprint(err)
+	}
+	return strings.Replace(err.Error(), outErr.Error(), outErr.message+fmt.Sprintf(" (%d bytes of output withheld)", len(outErr.output)), 1)
+}
@@ -4,14 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,24 +24,68 @@ import (
 
 // Document represents a processed document
 type Document struct {
-	Name        string           `json:"name"`
-	Text        string           `json:"text"`
-	Chunks      []string         `json:"chunks"`
-	ChunkCount  int              `json:"chunkCount"`
-	ContentSize int              `json:"contentSize"`
-	HasSummary  bool             `json:"hasSummary"`
-	Summary     string           `json:"summary,omitempty"`
-	CreatedAt   time.Time        `json:"createdAt"`
-	textLower   string           // Cached lowercase version for search
-	wordIndex   map[string][]int // Word-to-chunk index for faster queries
-	mu          sync.RWMutex     // Read-write mutex for thread safety
-}
-
-func (d *Document) UpdateSummary(summary string) {
+	Name           string              `json:"name"`
+	Text           string              `json:"text"`
+	Chunks         []string            `json:"chunks"`
+	ChunkCount     int                 `json:"chunkCount"`
+	ChunkIDs       []int               `json:"chunkIds"` // Stable across incremental updates
+	Chunking       ChunkOptions        `json:"chunking"` // Settings the chunks were produced with
+	ContentSize    int                 `json:"contentSize"`
+	ContentHash    string              `json:"contentHash,omitempty"` // SHA-256 of the uploaded file, hex-encoded
+	FileSize       int64               `json:"fileSize,omitempty"`    // Size of the uploaded file in bytes
+	PageCount      int                 `json:"pageCount,omitempty"`
+	Collection     string              `json:"collection,omitempty"`
+	Metadata       DocumentMetadata    `json:"metadata"`
+	Instructions   string              `json:"instructions,omitempty"` // Injected into every prompt
+	Preset         string              `json:"preset,omitempty"`       // Processing preset chosen at upload
+	ArchivedAt     *time.Time          `json:"archivedAt,omitempty"`   // Archived documents are only queried on request
+	Version        int64               `json:"version"`                // Bumped by every change to metadata, instructions, summary or archive state
+	TOC            []TOCEntry          `json:"toc,omitempty"`
+	ChunkPages     []int               `json:"chunkPages,omitempty"`    // 1-based page of each chunk
+	ChunkMetadata  []map[string]string `json:"chunkMetadata,omitempty"` // Record fields (.json, .jsonl) or time span (.srt, .vtt) of each chunk
+	RecordMapping  *RecordMapping      `json:"recordMapping,omitempty"` // Mapping the records were read with
+	HasSummary     bool                `json:"hasSummary"`
+	Summary        string              `json:"summary,omitempty"`
+	CreatedAt      time.Time           `json:"createdAt"`
+	Embeddings     []QuantizedVector   `json:"-"` // Per-chunk vectors, aligned with Chunks
+	EmbeddingModel string              `json:"embeddingModel,omitempty"`
+	textLower      string              // Cached lowercase version for search
+	chunkStarts    []int               // Word offset of each chunk in Text
+	nextChunkID    int
+	wordIndex      map[string][]int // Word-to-chunk index for faster queries
+	termFreqs      *termFrequencies // Occurrences of the indexed words and chunk lengths, for BM25
+	vocabulary     map[string]int   // Chunks holding each normalized word, for spelling correction
+	importance     []float64        // Static prior of each chunk, see chunkImportance
+	summaryVec     summaryVector    // Embedding of the summary, for retrieving it like a chunk
+	retrievalHits  []int64          // Times each chunk was used as query context
+	summaryJob     string           // Job generating the summary requested at ingestion
+	superseded     bool             // Replaced in or deleted from the store; changes to it would be lost
+	id             string           // Names this version in WAL records; set when it is first stored
+	mu             sync.RWMutex     // Read-write mutex for thread safety
+}
+
+// DocumentMetadata holds bibliographic details used for listings and citations
+type DocumentMetadata struct {
+	Title   string            `json:"title,omitempty"`
+	Author  string            `json:"author,omitempty"`
+	Subject string            `json:"subject,omitempty"`
+	Date    *time.Time        `json:"date,omitempty"`
+	Tags    []string          `json:"tags,omitempty"`
+	Custom  map[string]string `json:"custom,omitempty"` // Free-form, e.g. added by ingestion hooks
+}
+
+func (d *Document) UpdateSummary(summary string) bool {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	if d.superseded { // The summary belongs to a version no longer stored
+		return false
+	}
 	d.Summary = summary
 	d.HasSummary = true
+	d.Version++
+	persistence.log(updateRecord(d, walSummary, summary))
+	publishDocumentEvent(EventSummaryReady, d, false)
+	return true
 }
 
 // GetSummaryStatus Method to safely get summary status
@@ -50,34 +97,79 @@ func (d *Document) GetSummaryStatus() (bool, string) {
 
 // QueryRequest represents a document query request
 type QueryRequest struct {
-	DocumentName string `json:"documentName"`
-	Query        string `json:"query"`
-	ModelName    string `json:"modelName"`
+	DocumentName    string            `json:"documentName"`
+	Documents       DocumentSelection `json:"documents,omitempty"` // Names, or "all", to answer from several documents together instead of documentName
+	Query           string            `json:"query"`
+	ModelName       string            `json:"modelName"`
+	Section         string            `json:"section,omitempty"`         // Restrict retrieval to a TOC section
+	CitationStyle   string            `json:"citationStyle,omitempty"`   // apa, mla or bluebook
+	Speech          bool              `json:"speech,omitempty"`          // Embed the answer as synthesized audio
+	Deterministic   bool              `json:"deterministic,omitempty"`   // Fixed seed and zero temperature
+	Filters         *QueryFilters     `json:"filters,omitempty"`         // Restrict retrieval by tags, pages, section, date or metadata
+	Spelling        string            `json:"spelling,omitempty"`        // off, suggest or auto; defaults to SPELL_CORRECTION
+	SessionID       string            `json:"sessionId,omitempty"`       // Records the exchange in this chat session
+	SelfAssess      bool              `json:"selfAssess,omitempty"`      // Have the model rate its answer for the confidence score
+	Verify          string            `json:"verify,omitempty"`          // Check each answer sentence against the sources: lexical or llm
+	TableMode       string            `json:"tableMode,omitempty"`       // auto (default) gives table sources as rows; off gives them as text
+	IncludeArchived bool              `json:"includeArchived,omitempty"` // Allow archived documents
+	ExactCache      bool              `json:"exactCache,omitempty"`      // Reuse cached answers only for the same prompt, not similar questions
+	Fallback        string            `json:"fallback,omitempty"`        // When no chunk matches: first, vector, summary or none
+	ContextOverflow string            `json:"contextOverflow,omitempty"` // trim or reject a prompt over the model's context window; defaults to the config
+	QueryType       string            `json:"queryType,omitempty"`       // factoid, summarization, comparison, calculation or navigation; classified when empty
+	Tenant          string            `json:"-"`                         // Owner of the chat session, from the request header
 }
 
 // QueryResponse represents the response to a document query
 type QueryResponse struct {
-	Response     string   `json:"response"`
-	SourceChunks []string `json:"sourceChunks"`
-	UsedSummary  bool     `json:"usedSummary"`
+	Response        string              `json:"response"`
+	SourceChunks    []string            `json:"sourceChunks"`
+	UsedSummary     bool                `json:"usedSummary"`
+	Citations       []string            `json:"citations,omitempty"`       // Aligned with SourceChunks
+	SourcePages     []int               `json:"sourcePages,omitempty"`     // Page of each source chunk (PDFs)
+	SourceMetadata  []map[string]string `json:"sourceMetadata,omitempty"`  // Record fields or time span of each source chunk
+	SourceDocuments []string            `json:"sourceDocuments,omitempty"` // Document of each source chunk, for multi-document queries
+	SourceScores    []float64           `json:"sourceScores,omitempty"`    // Retrieval score of each source chunk: BM25 for keyword retrieval, similarity for vector retrieval
+	Audio           string              `json:"audio,omitempty"`           // Base64 speech, when requested
+	AudioFormat     string              `json:"audioFormat,omitempty"`
+	Cached          bool                `json:"cached,omitempty"`         // Answer reused from the query cache
+	CacheMatch      *CacheMatch         `json:"cacheMatch,omitempty"`     // Similar earlier question whose answer was reused
+	CorrectedQuery  string              `json:"correctedQuery,omitempty"` // Query retrieval and answering used instead, in auto spelling mode
+	Suggestion      string              `json:"suggestion,omitempty"`     // Spelling-corrected query, in suggest mode
+	Confidence      *AnswerConfidence   `json:"confidence,omitempty"`
+	QueryType       string              `json:"queryType,omitempty"`      // Question shape the answer's pipeline was chosen by
+	ReusedSources   bool                `json:"reusedSources,omitempty"`  // Sources carried over from the chat session's previous turn
+	RewrittenQuery  string              `json:"rewrittenQuery,omitempty"` // Follow-up restated on its own, which retrieval and answering used
+	Verification    *AnswerVerification `json:"verification,omitempty"`   // Per-sentence support, when requested
+	TableRows       []TableRow          `json:"tableRows,omitempty"`      // Spreadsheet rows the answer relies on, in table mode
+	Computation     *Computation        `json:"computation,omitempty"`    // Arithmetic done over the sources for aggregation questions
+	AnswerID        string              `json:"answerId,omitempty"`       // Pass to /api/document/query/refine to revise the answer
+	RefinedFrom     string              `json:"refinedFrom,omitempty"`    // Answer this one revises
+	Archived        bool                `json:"archived,omitempty"`       // The answer comes from an archived document
+	Fallback        string              `json:"fallback,omitempty"`       // How context was chosen when no chunk matched the query
+	ContextTrimmed  *ContextTrim        `json:"contextTrimmed,omitempty"` // Chunks left out so that the prompt fits the model's context window
 }
 
 // SummarizeRequest represents a summarization request
 type SummarizeRequest struct {
-	DocumentName string `json:"documentName"`
-	ModelName    string `json:"modelName"`
-	SummaryType  string `json:"summaryType"`
+	DocumentName  string `json:"documentName"`
+	ModelName     string `json:"modelName"`
+	SummaryType   string `json:"summaryType"`
+	Deterministic bool   `json:"deterministic,omitempty"` // Fixed seed and zero temperature
+	Async         bool   `json:"async,omitempty"`         // Answer with a summary job instead of waiting for the summary
+	Webhook       string `json:"webhook,omitempty"`       // Posted the finished job; implies async
 }
 
 // DocumentStore global storage with concurrent access protection
 type DocumentStore struct {
-	docs map[string]*Document
-	mu   sync.RWMutex
+	docs  map[string]*Document
+	terms *termStats // Chunks holding each word, for IDF weighting; never replaced
+	mu    sync.RWMutex
 }
 
 func NewDocumentStore() *DocumentStore {
 	return &DocumentStore{
-		docs: make(map[string]*Document),
+		docs:  make(map[string]*Document),
+		terms: newTermStats(),
 	}
 }
 
@@ -91,44 +183,114 @@ func (ds *DocumentStore) Get(name string) (*Document, bool) {
 func (ds *DocumentStore) Set(name string, doc *Document) {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
-	ds.docs[name] = doc
+	doc.Version = max(doc.Version, 1)
+	if doc.id == "" {
+		doc.id = randomID()
+	}
+	previous, replaced := ds.docs[name]
+	if replaced && previous != doc {
+		previous.mu.Lock()
+		previous.superseded = true
+		previous.mu.Unlock()
+	}
+	ds.put(name, doc)
+	persistence.log(newPutRecord(doc))
+	publishDocumentEvent(EventDocumentAdded, doc, replaced)
 }
 
-func (ds *DocumentStore) Delete(name string) bool {
+// Replace stores doc in place of previous (nil for a new document) and fails when
+// the stored document is no longer previous. before runs with previous locked, so
+// no change made to previous is lost between it and the swap.
+func (ds *DocumentStore) Replace(name string, previous, doc *Document, before func(doc, previous *Document) error) error {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
-	if _, exists := ds.docs[name]; !exists {
-		return false
+	if ds.docs[name] != previous {
+		return newAPIError(http.StatusConflict, "The document was replaced meanwhile; retry")
 	}
-	delete(ds.docs, name)
-	return true
+	if previous != nil {
+		previous.mu.Lock()
+		defer previous.mu.Unlock()
+	}
+	if err := before(doc, previous); err != nil {
+		return err
+	}
+	if previous != nil {
+		previous.superseded = true
+	}
+	doc.Version = max(doc.Version, 1)
+	if doc.id == "" {
+		doc.id = randomID()
+	}
+	ds.put(name, doc)
+	persistence.log(newPutRecord(doc))
+	publishDocumentEvent(EventDocumentAdded, doc, previous != nil)
+	return nil
 }
 
-func (ds *DocumentStore) UpdateSummary(name, summary string) bool {
+// All returns a snapshot of every stored document
+func (ds *DocumentStore) All() []*Document {
 	ds.mu.RLock()
-	doc, exists := ds.docs[name]
-	ds.mu.RUnlock()
+	defer ds.mu.RUnlock()
+
+	docs := make([]*Document, 0, len(ds.docs))
+	for _, doc := range ds.docs {
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// ByCollection returns the documents uploaded into the named collection
+func (ds *DocumentStore) ByCollection(collection string) []*Document {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
 
+	docs := make([]*Document, 0)
+	for _, doc := range ds.docs {
+		if doc.Collection == collection {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+func (ds *DocumentStore) Delete(name string) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	doc, exists := ds.docs[name]
 	if !exists {
 		return false
 	}
-
-	doc.UpdateSummary(summary)
+	doc.mu.Lock()
+	doc.superseded = true
+	doc.mu.Unlock()
+	ds.remove(name)
+	persistence.log(walRecord{Op: walDelete, Name: name})
+	publishDocumentEvent(EventDocumentDeleted, doc, false)
 	return true
 }
 
-func (ds *DocumentStore) List() map[string]interface{} {
+// List returns listing entries for documents accepted by match (all when nil)
+func (ds *DocumentStore) List(match func(*Document) bool) map[string]interface{} {
 	ds.mu.RLock()
 	defer ds.mu.RUnlock()
 
 	result := make(map[string]interface{})
 	for name, doc := range ds.docs {
+		if match != nil && !match(doc) {
+			continue
+		}
 		hasSummary, summary := doc.GetSummaryStatus()
 		result[name] = map[string]interface{}{
 			"chunkCount":  doc.ChunkCount,
+			"chunking":    doc.Chunking,
 			"contentSize": doc.ContentSize,
 			"hasSummary":  hasSummary && summary != "",
 			"createdAt":   doc.CreatedAt,
+			"collection":  doc.Collection,
+			"metadata":    doc.Metadata,
+			"retrieval":   doc.RetrievalMode(),
+			"archivedAt":  doc.ArchivedAt,
+			"version":     doc.Version,
 		}
 	}
 	return result
@@ -136,51 +298,200 @@ func (ds *DocumentStore) List() map[string]interface{} {
 
 var documentStore = NewDocumentStore()
 
+// Defaults of settings read from the environment and CONFIG_FILE
 const (
-	OllamaApi           = "http://localhost:11434/api"
-	MaxRequestSize      = 32 << 20 // 32MB
-	DefaultChunkSize    = 512
-	MaxConcurrentOllama = 5
-	RequestTimeout      = 30 * time.Second
+	MaxRequestSize        = 32 << 20 // 32MB
+	DefaultChunkSize      = 512
+	MaxConcurrentOllama   = 5
+	DefaultRequestTimeout = 30 * time.Second
 )
 
-// Connection pool for Ollama requests
-var ollamaLimiter = make(chan struct{}, MaxConcurrentOllama)
-
-func init() {
-	// Fill the limiter channel
-	for i := 0; i < MaxConcurrentOllama; i++ {
-		ollamaLimiter <- struct{}{}
+// getEnv returns the value of an environment variable, or fallback when unset
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
 	}
+	return fallback
 }
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	installLogRedaction()
+
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		if err := runLoadTest(os.Args[2:]); err != nil {
+			log.Fatal("Load test failed: ", err)
+		}
+		return
+	}
 
 	// Create documents directory
 	if err := os.MkdirAll("./documents", 0755); err != nil {
 		log.Fatal("Failed to create documents directory:", err)
 	}
+	if err := loadEncryptionKey(); err != nil {
+		log.Fatal("Failed to set up encryption at rest: ", err)
+	}
+
+	// Share locks, and unless STATE_BACKEND=memory caches, rate limits and job
+	// statuses, with other instances through Redis when configured
+	if redisURL := getEnv("REDIS_URL", ""); redisURL != "" {
+		client, err := newRedisClient(redisURL)
+		if err != nil {
+			log.Fatal("Invalid REDIS_URL:", err)
+		}
+		if _, err := client.Do("PING"); err != nil {
+			log.Fatal("Failed to reach Redis:", err)
+		}
+		sharedRedis = client
+		leaseBackend = &redisLocks{client: client}
+
+		switch backend := getEnv("STATE_BACKEND", "redis"); backend {
+		case "redis":
+			sharedState = &redisKV{client: client}
+			sharedStateRemote = true
+			log.Printf("Using Redis at %s for locks and shared state", client.addr)
+		case "memory":
+			log.Printf("Using Redis at %s for locks", client.addr)
+		default:
+			log.Fatal("Invalid STATE_BACKEND (use redis or memory): ", backend)
+		}
+	}
+
+	// Restore documents saved by a previous run; replicas follow the writer's files
+	// instead. An empty PERSIST_DIR keeps documents in memory only.
+	persistDir := getEnv("PERSIST_DIR", "./data")
+	if readOnlyReplica {
+		if persistDir == "" {
+			log.Fatal("READ_ONLY requires PERSIST_DIR to point at the writer's store")
+		}
+		interval, err := time.ParseDuration(getEnv("REPLICA_REFRESH_INTERVAL", "5s"))
+		if err != nil || interval <= 0 {
+			log.Fatal("Invalid REPLICA_REFRESH_INTERVAL:", getEnv("REPLICA_REFRESH_INTERVAL", ""))
+		}
+		if err := startReplica(persistDir, interval); err != nil {
+			log.Fatal("Failed to load persisted documents:", err)
+		}
+	} else if persistDir != "" {
+		p, err := openPersistence(persistDir)
+		if err != nil {
+			log.Fatal("Failed to load persisted documents:", err)
+		}
+		interval, err := time.ParseDuration(getEnv("PERSIST_COMPACT_INTERVAL", "10m"))
+		if err != nil || interval <= 0 {
+			log.Fatal("Invalid PERSIST_COMPACT_INTERVAL:", getEnv("PERSIST_COMPACT_INTERVAL", ""))
+		}
+		persistence = p
+		go p.runCompaction(interval)
+		if err := loadSources(persistDir); err != nil {
+			log.Fatal("Failed to load sources:", err)
+		}
+	}
+
+	if err := loadWebhookNetworks(); err != nil {
+		log.Fatal("Invalid WEBHOOK_ALLOWED_NETWORKS: ", err)
+	}
+	if err := loadIngestHooks(getEnv("INGEST_HOOKS_FILE", "")); err != nil {
+		log.Fatal("Failed to load ingestion hooks:", err)
+	}
+
+	if err := loadAuthenticator(); err != nil {
+		log.Fatal("Invalid authentication settings:", err)
+	}
+
+	// Forward store events to NATS or Kafka when configured
+	if err := startEventForwarding(); err != nil {
+		log.Fatal("Invalid EVENT_BROKER_URL:", err)
+	}
+
+	go runOllamaHealthChecks()
+	if !readOnlyReplica {
+		go runSourceScheduler()
+		go runDigestScheduler()
+		go runTrashPurge()
+	}
+
+	// Apply CONFIG_FILE on top of the environment; SIGHUP re-reads it
+	if _, err := reloadConfig(); err != nil {
+		log.Fatal("Invalid configuration:", err)
+	}
+	go watchConfigSignals()
+
+	// Reconcile the restored documents with their files and embeddings
+	if persistence != nil {
+		startupCorpusCheck()
+	}
 
 	// Setup routes
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/models", corsHandler(getModels))
 	mux.HandleFunc("/api/documents", corsHandler(getDocuments))
-	mux.HandleFunc("/api/document/process", corsHandler(processDocument))
-	mux.HandleFunc("/api/document/query", corsHandler(queryDocument))
-	mux.HandleFunc("/api/document/summarize", corsHandler(summarizeDocument))
-	mux.HandleFunc("/api/document/", corsHandler(handleDocumentByName))
+	mux.HandleFunc("/api/documents/embedding-map", corsHandler(getCorpusEmbeddingMap))
+	mux.HandleFunc("/api/embeddings/backfill", corsHandler(writerOnly(backfillEmbeddings)))
+	mux.HandleFunc("/api/admin/config", corsHandler(adminConfigHandler))
+	mux.HandleFunc("/api/admin/config/reload", corsHandler(adminReloadConfigHandler))
+	mux.HandleFunc("/api/admin/signed-urls", corsHandler(signedURLsHandler))
+	mux.HandleFunc("/api/admin/ollama", corsHandler(ollamaStatusHandler))
+	mux.HandleFunc("/api/admin/usage", corsHandler(adminUsageHandler))
+	mux.HandleFunc("/api/admin", corsHandler(adminIndexHandler))
+	mux.HandleFunc("/api/admin/tenants", corsHandler(adminTenantsHandler))
+	mux.HandleFunc("/api/admin/tenants/", corsHandler(handleAdminTenant))
+	mux.HandleFunc("/api/admin/circuits", corsHandler(adminCircuitsHandler))
+	mux.HandleFunc("/api/admin/circuits/", corsHandler(adminCircuitsHandler))
+	mux.HandleFunc("/api/admin/jobs", corsHandler(adminJobsHandler))
+	mux.HandleFunc("/api/admin/cache", corsHandler(adminCacheHandler))
+	mux.HandleFunc("/api/admin/cache/", corsHandler(adminCacheHandler))
+	mux.HandleFunc("/api/admin/stats", corsHandler(adminStatsHandler))
+	mux.HandleFunc("/api/admin/corpus", corsHandler(adminCorpusHandler))
+	mux.HandleFunc("/api/admin/corpus/", corsHandler(adminCorpusHandler))
+	mux.HandleFunc("/api/tenant/usage", corsHandler(tenantUsageHandler))
+	mux.HandleFunc("/api/signed/upload", corsHandler(writerOnly(rateLimited(signedUploadHandler))))
+	mux.HandleFunc("/api/signed/download/", corsHandler(rateLimited(handleSignedDownload)))
+	mux.HandleFunc("/api/events", corsHandler(eventsHandler))
+	mux.HandleFunc("/api/jobs", corsHandler(writerOnly(jobsHandler)))
+	mux.HandleFunc("/api/jobs/", corsHandler(writerOnly(handleJobByID)))
+	mux.HandleFunc("/api/chat", corsHandler(rateLimited(chatHandler)))
+	mux.HandleFunc("/api/chat/sessions", corsHandler(chatSessionsHandler))
+	mux.HandleFunc("/api/chat/", corsHandler(handleChatByID))
+	mux.HandleFunc("/api/facts", corsHandler(writerOnly(factsHandler)))
+	mux.HandleFunc("/api/shares", corsHandler(writerOnly(sharesHandler)))
+	mux.HandleFunc("/api/shares/", corsHandler(writerOnly(handleShareByID)))
+	mux.HandleFunc("/api/share/", corsHandler(rateLimited(handleShare)))
+	mux.HandleFunc("/api/facts/", corsHandler(writerOnly(handleFactByID)))
+	mux.HandleFunc("/api/document/process", corsHandler(writerOnly(rateLimited(processDocument))))
+	mux.HandleFunc("/api/document/query", corsHandler(rateLimited(queryDocument)))
+	mux.HandleFunc("/api/document/query/voice", corsHandler(rateLimited(queryDocumentByVoice)))
+	mux.HandleFunc("/api/document/query/stream", corsHandler(rateLimited(queryDocumentStream)))
+	mux.HandleFunc("/api/document/query/speech", corsHandler(rateLimited(queryDocumentSpeech)))
+	mux.HandleFunc("/api/document/query/refine", corsHandler(rateLimited(refineAnswer)))
+	mux.HandleFunc("/api/document/summarize", corsHandler(writerOnly(rateLimited(summarizeDocument))))
+	mux.HandleFunc("/api/document/glossary", corsHandler(rateLimited(glossaryDocument)))
+	mux.HandleFunc("/api/trash", corsHandler(writerOnly(trashHandler)))
+	mux.HandleFunc("/api/trash/", corsHandler(writerOnly(handleTrashByName)))
+	mux.HandleFunc("/api/ingest/path", corsHandler(adminOnly(writerOnly(ingestPathHandler))))
+	mux.HandleFunc("/api/document/", corsHandler(writerOnly(handleDocumentByName)))
+	mux.HandleFunc("/api/collections", corsHandler(writerOnly(collectionsHandler)))
+	mux.HandleFunc("/api/collection/", corsHandler(handleCollectionByName))
+	mux.HandleFunc("/api/presets", corsHandler(writerOnly(presetsHandler)))
+	mux.HandleFunc("/api/preset/", corsHandler(writerOnly(handlePresetByName)))
+	mux.HandleFunc("/api/sources", corsHandler(adminOnly(writerOnly(sourcesHandler))))
+	mux.HandleFunc("/api/source/", corsHandler(adminOnly(writerOnly(handleSourceByName))))
+	mux.HandleFunc("/api/saved-queries", corsHandler(savedQueriesHandler))
+	mux.HandleFunc("/api/saved-queries/", corsHandler(handleSavedQueryByID))
+	mux.HandleFunc("/api/digests", corsHandler(writerOnly(digestsHandler)))
+	mux.HandleFunc("/api/digest/", corsHandler(writerOnly(handleDigestByName)))
 
 	// HTTP server configuration
+	port := getEnv("PORT", "8080")
 	server := &http.Server{
-		Addr:         ":8080",
-		Handler:      mux,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:         ":" + port,
+		Handler:      authenticated(mux),
+		ReadTimeout:  time.Duration(envDuration("HTTP_READ_TIMEOUT", 30*time.Second)),
+		WriteTimeout: time.Duration(envDuration("HTTP_WRITE_TIMEOUT", 30*time.Second)),
+		IdleTimeout:  time.Duration(envDuration("HTTP_IDLE_TIMEOUT", 60*time.Second)),
 	}
 
-	log.Println("Server starting on http://localhost:8080")
+	log.Println("Server starting on http://localhost:" + port)
 	if err := server.ListenAndServe(); err != nil {
 		log.Fatal("Server failed to start:", err)
 	}
@@ -190,9 +501,14 @@ func main() {
 func corsHandler(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		header := w.Header()
-		header.Set("Access-Control-Allow-Origin", "*")
-		header.Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-		header.Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
+		if origin := allowedOrigin(r.Header.Get("Origin")); origin != "" {
+			header.Set("Access-Control-Allow-Origin", origin)
+			if origin != "*" {
+				header.Add("Vary", "Origin")
+			}
+		}
+		header.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		header.Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-API-Key, "+adminTokenHeader+", "+tenantHeader)
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -232,6 +548,39 @@ func sendError(w http.ResponseWriter, status int, message string) {
 	sendJSON(w, status, map[string]string{"error": message})
 }
 
+// apiError carries the HTTP status a pipeline failure should be reported with
+type apiError struct {
+	Status  int
+	Message string
+	Details map[string]interface{} // Sent alongside the message, e.g. which limit was exceeded
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, message string) error {
+	return &apiError{Status: status, Message: message}
+}
+
+// sendAPIError reports err with its own status, or as an internal error
+func sendAPIError(w http.ResponseWriter, err error) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		if len(apiErr.Details) == 0 {
+			sendError(w, apiErr.Status, apiErr.Message)
+			return
+		}
+		body := map[string]interface{}{"error": apiErr.Message}
+		for key, value := range apiErr.Details {
+			body[key] = value
+		}
+		sendJSON(w, apiErr.Status, body)
+		return
+	}
+	sendError(w, http.StatusInternalServerError, err.Error())
+}
+
 // closeFile is a helper to handle file closing with error logging
 func closeFile(f io.Closer, name string) {
 	if err := f.Close(); err != nil {
@@ -239,23 +588,54 @@ func closeFile(f io.Closer, name string) {
 	}
 }
 
+// ExtractedText holds extractor output plus structural details found along the way
+type ExtractedText struct {
+	Text      string
+	PageCount int
+	TOC       []TOCEntry // Headings in document order, not yet mapped to chunks
+	Metadata  DocumentMetadata
+	Records   []TextRecord // Records of structured files, whose texts make up Text
+	Tables    []TextTable  // Tables of spreadsheets, whose rows make up Text
+	Cues      []Cue        // Timing of subtitle text
+	Dates     []DatedSpan  // Dates of parts of the text, such as the messages of a mailbox
+}
+
+// pageSeparator marks page boundaries in text extracted from paged formats
+const pageSeparator = "\f"
+
+// pageWordStarts returns the word offset at which each page begins
+func pageWordStarts(text string) []int {
+	pages := strings.Split(text, pageSeparator)
+	starts := make([]int, len(pages))
+	offset := 0
+	for i, page := range pages {
+		starts[i] = offset
+		offset += len(strings.Fields(page))
+	}
+	return starts
+}
+
 // Optimized PDF text extraction
-func extractPDFText(filePath string) (string, error) {
+func extractPDFText(filePath string) (*ExtractedText, error) {
 	file, reader, err := pdf.Open(filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to open PDF: %w", err)
+		return nil, fmt.Errorf("failed to open PDF: %w", err)
 	}
 	defer closeFile(file, filePath)
 
 	numPages := reader.NumPage()
 	if numPages == 0 {
-		return "", fmt.Errorf("PDF has no pages")
+		return nil, fmt.Errorf("PDF has no pages")
 	}
 
 	var text strings.Builder
 	text.Grow(numPages * 2000)
 
 	for i := 1; i <= numPages; i++ {
+		// Pages are separated by form feeds so they can be located after preprocessing
+		if i > 1 {
+			text.WriteString(pageSeparator)
+		}
 		page := reader.Page(i)
 		if page.V.IsNull() {
 			continue
@@ -279,10 +659,22 @@ func extractPDFText(filePath string) (string, error) {
 		text.WriteString("\n")
 	}
 
-	return text.String(), nil
+	return &ExtractedText{
+		Text:      text.String(),
+		PageCount: numPages,
+		TOC:       pdfOutlineTOC(reader),
+		Metadata:  extractPDFMetadata(reader),
+	}, nil
+}
+
+// supportedExtensions lists the file types extractText understands
+var supportedExtensions = map[string]bool{".pdf": true, ".txt": true, ".md": true, ".eml": true, ".mbox": true, ".rtf": true, ".doc": true, ".tex": true, ".json": true, ".jsonl": true, ".srt": true, ".vtt": true, ".xml": true, ".dita": true, ".csv": true, ".tsv": true, ".xlsx": true, ".docx": true, ".odt": true}
+
+func isSupportedFile(name string) bool {
+	return supportedExtensions[strings.ToLower(filepath.Ext(name))]
 }
 
-func extractText(filePath string) (string, error) {
+func extractText(filePath string) (*ExtractedText, error) {
 	ext := strings.ToLower(filepath.Ext(filePath))
 
 	switch ext {
@@ -291,90 +683,96 @@ func extractText(filePath string) (string, error) {
 	case ".txt", ".md":
 		content, err := os.ReadFile(filePath)
 		if err != nil {
-			return "", fmt.Errorf("failed to read file: %w", err)
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		extracted := &ExtractedText{Text: string(content)}
+		if ext == ".md" {
+			extracted.TOC = markdownTOC(extracted.Text)
 		}
-		return string(content), nil
+		return extracted, nil
+	case ".eml", ".mbox":
+		return extractEmailText(filePath)
+	case ".rtf":
+		return extractRTFText(filePath)
+	case ".doc":
+		return extractDocText(filePath)
+	case ".docx":
+		return extractDOCXText(filePath)
+	case ".odt":
+		return extractODTText(filePath)
+	case ".tex":
+		return extractLaTeXText(filePath)
+	case ".json", ".jsonl", ".xml", ".dita":
+		return extractMappedText(filePath, nil)
+	case ".srt", ".vtt":
+		return extractSubtitleText(filePath)
+	case ".csv", ".tsv":
+		return extractCSVText(filePath)
+	case ".xlsx":
+		return extractXLSXText(filePath)
 	default:
-		return "", fmt.Errorf("unsupported file format: %s", ext)
+		return nil, fmt.Errorf("unsupported file format: %s", ext)
 	}
 }
 
-func chunkText(text string, chunkSize int) []string {
-	if len(text) == 0 {
-		return []string{}
-	}
-
-	words := strings.Fields(text)
-	if len(words) == 0 {
-		return []string{text}
-	}
-
-	estimatedChunks := len(text) / chunkSize
-	if estimatedChunks == 0 {
-		estimatedChunks = 1
-	}
-	chunks := make([]string, 0, estimatedChunks)
-
-	var currentChunk strings.Builder
-	currentChunk.Grow(chunkSize + 100)
-	currentSize := 0
-
-	for _, word := range words {
-		wordLen := len(word) + 1
-
-		if currentSize+wordLen > chunkSize && currentChunk.Len() > 0 {
-			chunks = append(chunks, strings.TrimSpace(currentChunk.String()))
-			currentChunk.Reset()
-			currentChunk.Grow(chunkSize + 100)
-			currentSize = 0
-		}
-
-		if currentChunk.Len() > 0 {
-			currentChunk.WriteString(" ")
-		}
-		currentChunk.WriteString(word)
-		currentSize += wordLen
+// chunkPages maps each chunk to the 1-based page its first word falls on
+func chunkPages(chunkStarts []int, pageWordStarts []int) []int {
+	if len(pageWordStarts) == 0 {
+		return nil
 	}
-
-	if currentChunk.Len() > 0 {
-		chunks = append(chunks, strings.TrimSpace(currentChunk.String()))
+	pages := make([]int, len(chunkStarts))
+	for i, start := range chunkStarts {
+		pages[i] = sort.Search(len(pageWordStarts), func(p int) bool {
+			return pageWordStarts[p] > start
+		})
 	}
-
-	return chunks
+	return pages
 }
 
 // Build word index for faster searching
 func buildWordIndex(chunks []string) map[string][]int {
-	wordIndex := make(map[string][]int)
+	wordIndex, _ := indexChunks(chunks)
+	return wordIndex
+}
 
-	for i, chunk := range chunks {
-		words := strings.Fields(strings.ToLower(chunk))
-		wordSet := make(map[string]bool)
+// Ollama call with connection limiting, timeout and retries
+func callOllama(prompt, model string) (string, error) {
+	return callOllamaContext(context.Background(), prompt, model)
+}
 
-		// Deduplicate words in this chunk
-		for _, word := range words {
-			if !wordSet[word] {
-				wordSet[word] = true
-				wordIndex[word] = append(wordIndex[word], i)
-			}
-		}
+// callOllamaContext generates a response, retrying transient failures, until ctx is cancelled
+func callOllamaContext(ctx context.Context, prompt, model string) (string, error) {
+	var response string
+	err := retryTransient(ctx, "Ollama generate", func() error {
+		var err error
+		response, err = generateOnce(ctx, prompt, model)
+		return err
+	})
+	if err == nil {
+		logPrompt(model, prompt, response)
 	}
+	return response, err
+}
 
-	return wordIndex
+func generateOnce(ctx context.Context, prompt, model string) (string, error) {
+	release, err := acquireOllama(ctx, OperationGenerate, model)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	provider, name := providerFor(model)
+	return provider.Generate(ctx, prompt, name)
 }
 
-// Ollama call with connection limiting and timeout
-func callOllama(prompt, model string) (string, error) {
-	select {
-	case <-ollamaLimiter:
-		defer func() { ollamaLimiter <- struct{}{} }()
-	case <-time.After(5 * time.Second):
-		return "", fmt.Errorf("ollama service too busy")
+// Generate calls Ollama's generate API, streaming when ctx has a token sink
+func (ollamaProvider) Generate(ctx context.Context, prompt, model string) (string, error) {
+	if sink := tokenSinkOf(ctx); sink != nil {
+		return generateStreaming(ctx, prompt, model, sink)
 	}
 
 	start := time.Now()
 
-	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout())
 	defer cancel()
 
 	reqBody := map[string]interface{}{
@@ -382,51 +780,62 @@ func callOllama(prompt, model string) (string, error) {
 		"prompt": prompt,
 		"stream": false,
 	}
+	if options := ollamaOptions(ctx, model); options != nil {
+		reqBody["options"] = options
+	}
 
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", OllamaApi+"/generate", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: RequestTimeout}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("ollama request failed: %w", err)
-	}
-	defer closeFile(resp.Body, "response body")
-
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("ollama error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
-	}
+	var response string
+	err = ollamaEndpoints.do(ctx, model, func(endpoint *ollamaEndpoint) error {
+		req, err := http.NewRequestWithContext(ctx, "POST", endpoint.api("/generate"), bytes.NewBuffer(jsonData))
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
-	}
+		client := &http.Client{Timeout: requestTimeout()}
+		resp, err := client.Do(req)
+		if err != nil {
+			return ollamaRequestError(ctx, err)
+		}
+		defer closeFile(resp.Body, "response body")
 
-	response, ok := result["response"].(string)
-	if !ok {
-		return "", fmt.Errorf("invalid response format")
-	}
+		if resp.StatusCode != http.StatusOK {
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			return ollamaStatusError(resp.StatusCode, bodyBytes)
+		}
 
-	duration := time.Since(start)
-	log.Printf("Ollama call completed in %v (model: %s)", duration, model)
+		var result map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
 
-	return response, nil
+		var ok bool
+		if response, ok = result["response"].(string); !ok {
+			return fmt.Errorf("invalid response format")
+		}
+		promptTokens, _ := result["prompt_eval_count"].(float64)
+		generatedTokens, _ := result["eval_count"].(float64)
+		meterTokens(ctx, int64(promptTokens+generatedTokens), prompt, response)
+		log.Printf("Ollama call completed in %v (model: %s, endpoint: %s)", time.Since(start), model, endpoint.URL)
+		return nil
+	})
+	return response, err
 }
 
+// Longest document text sent for summarization
+const maxSummaryText = 6000
+
 // document summarization
-func generateDocumentSummary(doc *Document, modelName, summaryType string) (string, error) {
+func generateDocumentSummary(ctx context.Context, doc *Document, modelName, summaryType string) (string, error) {
 	doc.mu.RLock()
-	text := doc.Text
+	text := doc.plainText(maxSummaryText + 1)
 	name := doc.Name
+	docInstructions := doc.Instructions
 	doc.mu.RUnlock()
 
 	var instructions string
@@ -440,9 +849,8 @@ func generateDocumentSummary(doc *Document, modelName, summaryType string) (stri
 	}
 
 	// Truncate text if too long to avoid Ollama timeouts
-	const maxTextLength = 6000
-	if len(text) > maxTextLength {
-		text = text[:maxTextLength] + "...[text truncated due to length]"
+	if len(text) > maxSummaryText {
+		text = text[:maxSummaryText] + "...[text truncated due to length]"
 	}
 
 	// Clean the text - remove excessive whitespace and newlines
@@ -450,72 +858,58 @@ func generateDocumentSummary(doc *Document, modelName, summaryType string) (stri
 
 	// Create a well-formatted prompt
 	prompt := fmt.Sprintf("Task: %s\n\nDocument Content:\n%s\n\nPlease provide the summary:", instructions, text)
+	prompt = withDocumentInstructions(prompt, docInstructions)
 
 	log.Printf("Generating summary for %s (%d chars)", name, len(text))
-	return callOllama(prompt, modelName)
+	return callOllamaContext(ctx, prompt, modelName)
 }
 
-// Get available models from Ollama with caching
-var modelsCache struct {
-	models    []string
-	timestamp time.Time
-	mu        sync.RWMutex
-}
+// Get available models from the provider with caching in shared state
+const modelsCacheKey = "models"
 
+// getModels lists the models of the configured provider, or with ?provider= those
+// of another, named provider:model so they can be passed back as they are
 func getModels(w http.ResponseWriter, r *http.Request) {
 	if !validateMethod(w, r, "GET") {
 		return
 	}
 
-	// Check cache (valid for 5 minutes)
-	modelsCache.mu.RLock()
-	if time.Since(modelsCache.timestamp) < 5*time.Minute && len(modelsCache.models) > 0 {
-		models := modelsCache.models
-		modelsCache.mu.RUnlock()
-		sendJSON(w, http.StatusOK, map[string]interface{}{"models": models})
-		return
+	name := r.URL.Query().Get("provider")
+	provider, exists := lookupProvider(getConfig().Provider)
+	if name != "" {
+		provider, exists = lookupProvider(name)
 	}
-	modelsCache.mu.RUnlock()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, "GET", OllamaApi+"/tags", nil)
-	if err != nil {
-		sendError(w, http.StatusServiceUnavailable, "Failed to create request")
+	if !exists {
+		sendError(w, http.StatusNotFound, fmt.Sprintf("Unknown provider %q", name))
 		return
 	}
+	cacheKey := modelsCacheKey
+	if name != "" {
+		cacheKey += ":" + name
+	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		sendError(w, http.StatusServiceUnavailable, "Failed to connect to Ollama")
+	// Check cache (valid for 5 minutes)
+	var cached []string
+	if getJSON(cacheKey, &cached) && len(cached) > 0 {
+		sendJSON(w, http.StatusOK, map[string]interface{}{"models": cached})
 		return
 	}
-	defer closeFile(resp.Body, "models response body")
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		sendError(w, http.StatusServiceUnavailable, "Invalid response from Ollama")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	models, err := provider.ListModels(ctx)
+	if err != nil {
+		sendError(w, http.StatusServiceUnavailable, fmt.Sprintf("Failed to list models: %v", err))
 		return
 	}
-
-	models := make([]string, 0)
-	if modelList, ok := result["models"].([]interface{}); ok {
-		for _, model := range modelList {
-			if modelMap, ok := model.(map[string]interface{}); ok {
-				if name, ok := modelMap["name"].(string); ok {
-					models = append(models, name)
-				}
-			}
+	if name != "" {
+		for i, m := range models {
+			models[i] = name + ":" + m
 		}
 	}
 
 	// Update cache
-	modelsCache.mu.Lock()
-	modelsCache.models = models
-	modelsCache.timestamp = time.Now()
-	modelsCache.mu.Unlock()
+	setJSON(cacheKey, models, 5*time.Minute)
 
 	sendJSON(w, http.StatusOK, map[string]interface{}{"models": models})
 }
@@ -525,7 +919,17 @@ func getDocuments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	docsResponse := documentStore.List()
+	match, err := metadataFilter(r)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if match, err = archivedFilter(r, match); err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	docsResponse := documentStore.List(match)
 	sendJSON(w, http.StatusOK, map[string]interface{}{"documents": docsResponse})
 }
 
@@ -534,120 +938,89 @@ func processDocument(w http.ResponseWriter, r *http.Request) {
 	if !validateMethod(w, r, "POST") {
 		return
 	}
+	processUploadForm(w, r, "")
+}
+
+// processUploadForm ingests the files of an upload form. A non-empty collection
+// is that of a signed URL: it overrides the form's collection field, the form
+// may not choose a preset, instructions or models, and no file may replace a
+// document of another collection.
+func processUploadForm(w http.ResponseWriter, r *http.Request, collection string) {
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	limitUploadSize(w, r, tenant)
 
 	// Parse form with size limit
 	if err := r.ParseMultipartForm(MaxRequestSize); err != nil {
+		if tooLarge := uploadSizeError(err, tenant); tooLarge != nil {
+			sendAPIError(w, tooLarge)
+			return
+		}
 		sendError(w, http.StatusBadRequest, "Failed to parse form or file too large")
 		return
 	}
 
-	// Get file
-	file, header, err := r.FormFile("file")
-	if err != nil {
+	// Get files; several "file" parts make a batch upload
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
 		sendError(w, http.StatusBadRequest, "No file uploaded")
 		return
 	}
-	defer closeFile(file, "uploaded file")
 
-	// Get form values with defaults
-	chunkSizeStr := r.FormValue("chunkSize")
-	generateSummaryStr := r.FormValue("generateSummary")
-	modelName := r.FormValue("modelName")
-	summaryType := r.FormValue("summaryType")
-
-	chunkSize := DefaultChunkSize
-	if chunkSizeStr != "" {
-		if cs, err := strconv.Atoi(chunkSizeStr); err == nil && cs > 0 {
-			chunkSize = cs
+	if collection != "" {
+		for _, field := range signedUploadIgnoredFields {
+			r.Form.Del(field)
 		}
 	}
-
-	generateSummary := generateSummaryStr == "true"
-
-	// Save file
-	filePath := filepath.Join("./documents", header.Filename)
-	dst, err := os.Create(filePath)
+	opts, err := ingestOptionsFromForm(r)
 	if err != nil {
-		sendError(w, http.StatusInternalServerError, "Failed to save file")
+		sendAPIError(w, err)
 		return
 	}
-	defer closeFile(dst, filePath)
-
-	if _, err := io.Copy(dst, file); err != nil {
-		sendError(w, http.StatusInternalServerError, "Failed to save file")
-		return
-	}
-
-	// Extract text
-	text, err := extractText(filePath)
-	if err != nil {
-		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to extract text: %v", err))
-		return
-	}
-
-	// Create chunks
-	chunks := chunkText(text, chunkSize)
-
-	// Build word index for fast searching
-	wordIndex := buildWordIndex(chunks)
-
-	// Create document
-	doc := &Document{
-		Name:        header.Filename,
-		Text:        text,
-		Chunks:      chunks,
-		ChunkCount:  len(chunks),
-		ContentSize: len(text),
-		HasSummary:  false,
-		CreatedAt:   time.Now(),
-		textLower:   strings.ToLower(text),
-		wordIndex:   wordIndex,
+	opts.Tenant = tenant
+	if collection != "" {
+		opts.Collection = collection
+		opts.BeforeSwap = func(doc, previous *Document) error {
+			return signedUploadConflict(previous, collection)
+		}
 	}
-
-	// Store document first
-	documentStore.Set(header.Filename, doc)
-
-	log.Printf("Processed %s: %d chunks, %d chars, %d indexed words",
-		header.Filename, len(chunks), len(text), len(wordIndex))
-
-	message := fmt.Sprintf("Document processed: %d chunks created", len(chunks))
-
-	// Generate summary asynchronously if requested
-	if generateSummary && modelName != "" {
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					log.Printf("Panic in summary generation for %s: %v", header.Filename, r)
+	upload := func(header *multipart.FileHeader) (string, string, error) {
+		if collection != "" {
+			if previous, exists := documentStore.Get(header.Filename); exists {
+				if err := signedUploadConflict(previous, collection); err != nil {
+					return "", "", err
 				}
-			}()
-
-			log.Printf("Starting async summary generation for %s", header.Filename)
-
-			summary, err := generateDocumentSummary(doc, modelName, summaryType)
-			if err != nil {
-				log.Printf("Summary generation failed for %s: %v", header.Filename, err)
-				return
-			}
-
-			// Ensure summary is not empty before updating
-			if strings.TrimSpace(summary) == "" {
-				log.Printf("Generated empty summary for %s", header.Filename)
-				return
-			}
-
-			// Update document using the safe method
-			if !documentStore.UpdateSummary(header.Filename, summary) {
-				log.Printf("Failed to update summary for %s: document not found", header.Filename)
-				return
 			}
+		}
+		return ingestUpload(header, opts)
+	}
 
-			log.Printf("Summary generation completed successfully for %s (length: %d)",
-				header.Filename, len(summary))
-		}()
-		message += " (summary generating in background)"
+	if len(files) == 1 {
+		message, summaryJob, err := upload(files[0])
+		if err != nil {
+			sendAPIError(w, err)
+			return
+		}
+		response := map[string]string{"message": message}
+		if summaryJob != "" {
+			response["summaryJobId"] = summaryJob
+		}
+		sendJSON(w, http.StatusOK, response)
+		return
 	}
 
-	sendJSON(w, http.StatusOK, map[string]string{"message": message})
+	// Each file is processed as its own document; one failure does not stop the rest
+	results := make([]UploadResult, 0, len(files))
+	for _, header := range files {
+		message, summaryJob, err := upload(header)
+		result := uploadResult(header.Filename, header.Filename, message, err)
+		result.SummaryJob = summaryJob
+		results = append(results, result)
+	}
+	sendUploadResults(w, results)
 }
 
 // validateMethod checks if the HTTP method is allowed
@@ -680,24 +1053,42 @@ func queryDocument(w http.ResponseWriter, r *http.Request) {
 		sendError(w, http.StatusBadRequest, "Invalid request")
 		return
 	}
-
-	doc, ok := getDocumentOrError(w, req.DocumentName)
-	if !ok {
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
 		return
 	}
+	req.Tenant = tenant
 
-	doc.mu.RLock()
-	defer doc.mu.RUnlock()
+	resp, err := runQuery(req)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
 
-	// relevance scoring using word index
-	queryWords := strings.Fields(strings.ToLower(req.Query))
-	chunkScores := make(map[int]int)
+	sendJSON(w, http.StatusOK, resp)
+}
 
-	// Use word index for faster lookup
-	for _, qWord := range queryWords {
-		if chunkIndices, exists := doc.wordIndex[qWord]; exists {
-			for _, chunkIdx := range chunkIndices {
-				chunkScores[chunkIdx]++
+// keywordRetrieve ranks the allowed chunks by how many query words they contain,
+// using the word index, and by matches in their headings and titles; callers hold
+// the document lock
+func keywordRetrieve(doc *Document, query string, rank *chunkRanking, maxChunks int) ([]string, []int, []float64) {
+	// relevance scoring using word index, with the collection's synonyms counting
+	// as matches of the terms they stand for
+	var synonyms *thesaurus
+	if c, exists := collectionStore.Get(doc.Collection); exists {
+		synonyms = c.thesaurus
+	}
+	chunkScores := make(map[int]float64)
+
+	// Use word index for faster lookup; chunks are scored by BM25, so matches on
+	// rare words weigh more than matches on words most chunks hold, and repeats
+	// and long chunks do not dominate
+	stats := documentStore.terms
+	for _, term := range synonyms.expandQuery(query) {
+		for _, chunkIdx := range term.chunks(doc.wordIndex) {
+			if rank.allowed.has(chunkIdx) {
+				chunkScores[chunkIdx] += term.bm25(doc, chunkIdx, stats)
 			}
 		}
 	}
@@ -705,48 +1096,440 @@ func queryDocument(w http.ResponseWriter, r *http.Request) {
 	// Convert to sorted slice
 	type chunkScore struct {
 		index int
-		score int
+		score float64
 		chunk string
 	}
 
 	scores := make([]chunkScore, 0, len(chunkScores))
 	for idx, score := range chunkScores {
-		scores = append(scores, chunkScore{idx, score, doc.Chunks[idx]})
+		scores = append(scores, chunkScore{idx, rank.keyword(idx, score), doc.Chunks[idx]})
+	}
+	// Chunks matching only in their headings or title
+	for idx, field := range rank.fields {
+		if _, scored := chunkScores[idx]; !scored && field > 0 && rank.allowed.has(idx) {
+			scores = append(scores, chunkScore{idx, rank.keyword(idx, 0), doc.Chunks[idx]})
+		}
 	}
 
-	// Sort by relevance (descending)
+	// Sort by relevance (descending), ties in document order so results are stable
 	sort.Slice(scores, func(i, j int) bool {
-		return scores[i].score > scores[j].score
+		if scores[i].score != scores[j].score {
+			return scores[i].score > scores[j].score
+		}
+		return scores[i].index < scores[j].index
 	})
 
-	// Get top 3 chunks
-	maxChunks := 3
+	// Get top chunks
 	if len(scores) < maxChunks {
 		maxChunks = len(scores)
 	}
 
 	topChunks := make([]string, 0, maxChunks)
+	topIndices := make([]int, 0, maxChunks)
+	topScores := make([]float64, 0, maxChunks)
 	for i := 0; i < maxChunks; i++ {
 		topChunks = append(topChunks, scores[i].chunk)
+		topIndices = append(topIndices, scores[i].index)
+		topScores = append(topScores, scores[i].score)
+		doc.recordRetrieval(scores[i].index)
+	}
+	return topChunks, topIndices, topScores
+}
+
+// runQuery executes the retrieval and generation pipeline for a single question
+func runQuery(req QueryRequest) (*QueryResponse, error) {
+	return runQueryContext(context.Background(), req)
+}
+
+// runQueryContext is runQuery with model calls made under ctx, so background work
+// takes the background lane and stops when cancelled
+func runQueryContext(ctx context.Context, req QueryRequest) (*QueryResponse, error) {
+	if req.CitationStyle != "" && !validCitationStyle(req.CitationStyle) {
+		return nil, newAPIError(http.StatusBadRequest, "Unsupported citation style")
+	}
+	if !validVerifyMethod(req.Verify) {
+		return nil, newAPIError(http.StatusBadRequest, "verify must be lexical or llm")
+	}
+	if !validTableMode(req.TableMode) {
+		return nil, newAPIError(http.StatusBadRequest, "tableMode must be auto or off")
+	}
+	if !validFallback(req.Fallback) {
+		return nil, newAPIError(http.StatusBadRequest, "fallback must be first, vector, summary or none")
+	}
+	if !validQueryType(req.QueryType) {
+		return nil, newAPIError(http.StatusBadRequest, "queryType must be factoid, summarization, comparison, calculation or navigation")
+	}
+	if !validContextOverflow(req.ContextOverflow) {
+		return nil, newAPIError(http.StatusBadRequest, "contextOverflow must be trim or reject")
+	}
+	spelling, err := spellingMode(req.Spelling)
+	if err != nil {
+		return nil, err
+	}
+	if req.SessionID != "" && !validChatSessionID(req.SessionID) {
+		return nil, newAPIError(http.StatusBadRequest, "Invalid sessionId (use up to 64 letters, digits, - or _)")
+	}
+	if req.Tenant == "" {
+		req.Tenant = defaultTenant
+	}
+	if req.ModelName, err = tenantModel(req.Tenant, req.ModelName); err != nil {
+		return nil, err
+	}
+	if err := queryTooLong(req.Tenant, req.Query); err != nil {
+		return nil, err
+	}
+	if err := quotaExceeded(req.Tenant); err != nil {
+		return nil, err
+	}
+	addUsage(req.Tenant, "queries", 1)
+	ctx = answerLimitContext(ctx, req.Tenant)
+	ctx, meter := meteredContext(ctx)
+	defer func() { addUsage(req.Tenant, "tokens", meter.tokens.Load()) }()
+	ctx, sink := takeTokenSink(ctx)
+	if req.Documents.selected() {
+		return runMultiQuery(ctx, sink, req)
+	}
+	var session *ChatSession
+	if req.SessionID != "" {
+		session, _ = getChatSession(req.Tenant, req.SessionID)
+	}
+	asked := req.Query
+
+	doc, exists := documentStore.Get(req.DocumentName)
+	if !exists {
+		return nil, newAPIError(http.StatusNotFound, "Document not found")
+	}
+	ctx = documentCacheContext(ctx, doc.Name)
+
+	// The lock is released once the prompt is built, so a slow answer does not
+	// hold up changes to the document, nor the queries queued behind them
+	doc.mu.RLock()
+	release := sync.OnceFunc(doc.mu.RUnlock)
+	defer release()
+	if doc.ArchivedAt != nil && !req.IncludeArchived {
+		return nil, newAPIError(http.StatusConflict, "Document is archived; set includeArchived to query it")
+	}
+
+	// Optional section scoping via the table of contents, and filters
+	allowed, err := queryChunks(doc, req.Section, req.Filters)
+	if err != nil {
+		return nil, err
+	}
+	if allowed != nil && !slices.Contains(allowed, true) {
+		return nil, newAPIError(http.StatusNotFound, "No chunks match the filters")
+	}
+
+	// Words missing from the document are checked against its vocabulary
+	var corrected, suggestion string
+	if spelling != SpellingOff {
+		if c := correctQuery(req.Query, doc.vocabulary); c != "" && spelling == SpellingAuto {
+			corrected, req.Query = c, c
+		} else {
+			suggestion = c
+		}
+	}
+
+	// Follow-ups in a chat session reuse the passage of the turn they refer to;
+	// others that point back are restated so retrieval finds what they mean
+	reused := sessionSources(session, doc, req.Query, allowed)
+	var rewritten string
+	if reused == nil {
+		if q := standaloneQuestion(ctx, session, req.Query, req.ModelName); q != "" {
+			rewritten, req.Query = q, q
+		}
+	}
+	rank := newChunkRanking(doc, req.Query, allowed)
+
+	// The shape of the question picks the pipeline answering it
+	req.QueryType = queryType(req)
+
+	// A similar question answered earlier may be reused
+	var queryVec []float64
+	var semanticKey string
+	if useSemanticCache(req, doc) {
+		semanticKey = semanticScope(doc, req, modelOrDefault(req.ModelName))
+		var entry *semanticEntry
+		var match *CacheMatch
+		queryVec, entry, match = semanticCacheQuery(ctx, doc, req.Query, semanticKey)
+		if entry != nil {
+			result := entry.Response
+			result.Cached, result.CacheMatch = true, match
+			result.CorrectedQuery, result.Suggestion = corrected, suggestion
+			result.AnswerID = storeAnswer(req.Tenant, entry.Answer)
+			if req.Speech {
+				if err := attachSpeech(&result); err != nil {
+					return nil, err
+				}
+			}
+			return &result, nil
+		}
+	}
+
+	// Documents with embeddings for every chunk use vector retrieval,
+	// falling back to the word index if the query cannot be embedded.
+	// Summarization questions are answered from the summary, or from chunks
+	// spread over documents without one.
+	maxChunks := routeChunks(req.QueryType)
+	var topChunks []string
+	var topIndices []int
+	var signals retrievalSignals
+	summarizing := req.QueryType == QuerySummarization && reused == nil
+	useSummary := summarizing && doc.HasSummary && doc.Summary != ""
+	if reused != nil {
+		topIndices = mergeFollowUp(doc, req.Query, rank, reused, maxChunks+followUpMergeChunks)
+		for _, idx := range topIndices {
+			topChunks = append(topChunks, doc.Chunks[idx])
+		}
+	} else if summarizing && !useSummary {
+		topChunks, topIndices = spreadChunks(doc, allowed, maxChunks)
+	} else if !summarizing && doc.hasVectors() {
+		var ranked []int
+		var scores []float64
+		var err error
+		if queryVec == nil {
+			queryVec, err = callOllamaEmbedding(ctx, req.Query, doc.EmbeddingModel)
+		}
+		if err == nil {
+			ranked, scores, err = doc.rankByVector(queryVec, rank)
+		}
+		if err != nil {
+			log.Printf("Vector retrieval failed for %s, using keywords: %v", doc.Name, err)
+		}
+		signals.scores = scores
+		for _, idx := range ranked[:min(maxChunks, len(ranked))] {
+			topChunks = append(topChunks, doc.Chunks[idx])
+			topIndices = append(topIndices, idx)
+			doc.recordRetrieval(idx)
+		}
+	}
+	var sourceScores []float64
+	if !summarizing && reused == nil {
+		var topScores, retrievalVec []float64
+		if topIndices == nil {
+			topChunks, topIndices, topScores = keywordRetrieve(doc, req.Query, rank, maxChunks)
+		} else {
+			topScores, retrievalVec = signals.scores[:len(topIndices)], queryVec
+		}
+
+		// The summary is retrieved like a chunk, taking the place of the weakest
+		// one when it matches the query better
+		var takesSlot bool
+		useSummary, takesSlot = summaryContext(ctx, doc, req.Query, retrievalVec, topScores, maxChunks)
+		if useSummary && takesSlot {
+			topChunks, topIndices = topChunks[:len(topChunks)-1], topIndices[:len(topIndices)-1]
+		}
+		if req.QueryType == QueryComparison && len(topChunks) > 0 {
+			topChunks, topIndices = withSides(doc, req.Query, rank, topChunks, topIndices)
+		}
+		// Chunks added for the sides of a comparison were scored against another
+		// query and are left at 0
+		sourceScores = make([]float64, len(topIndices))
+		copy(sourceScores, topScores)
+	}
+
+	// Without matches the context comes from the fallback
+	var fallback string
+	if len(topChunks) == 0 && !useSummary {
+		signals.noMatch = true
+		fallback = retrievalFallback(req.Fallback, doc)
+		switch fallback {
+		case FallbackFirst:
+			for i := 0; i < len(doc.Chunks) && len(topIndices) < maxChunks; i++ {
+				if allowed.has(i) {
+					topChunks = append(topChunks, doc.Chunks[i])
+					topIndices = append(topIndices, i)
+				}
+			}
+		case FallbackVector:
+			topChunks, topIndices = vectorFallback(ctx, doc, req.Query, rank, maxChunks)
+		}
+		useSummary = fallback == FallbackSummary && doc.HasSummary && doc.Summary != ""
+		if len(topChunks) == 0 && !useSummary {
+			return &QueryResponse{
+				Response:       noRelevantContent,
+				SourceChunks:   []string{},
+				CorrectedQuery: corrected,
+				Suggestion:     suggestion,
+				RewrittenQuery: rewritten,
+				Archived:       doc.ArchivedAt != nil,
+				Fallback:       FallbackNone,
+			}, nil
+		}
+	}
+
+	// The prompt has to fit the model's context window along with the answer;
+	// the lowest-ranked chunks are left out until it does
+	var built queryPrompt
+	kept, promptTokens, err := fitContextWindow(ctx, modelOrDefault(req.ModelName), req.ContextOverflow, len(topChunks), func(n int) string {
+		built = buildQueryPrompt(doc, req, session, topChunks[:n], topIndices[:n], useSummary)
+		return built.prompt
+	})
+	if err != nil {
+		return nil, err
+	}
+	var contextTrim *ContextTrim
+	if kept < len(topChunks) {
+		contextTrim = &ContextTrim{
+			Window:        getConfig().ContextWindow.window(modelOrDefault(req.ModelName)),
+			PromptTokens:  promptTokens,
+			DroppedChunks: droppedChunks(doc, topChunks[kept:], topIndices[kept:], sourceScores[min(kept, len(sourceScores)):]),
+		}
+		topChunks, topIndices = topChunks[:kept], topIndices[:kept]
+		sourceScores = sourceScores[:min(kept, len(sourceScores))]
+	}
+	prompt, sourcePages, sourceMetadata := built.prompt, built.sourcePages, built.sourceMetadata
+	tables, computation, usedSummary := built.tables, built.computation, built.usedSummary
+
+	// Navigation questions are answered with where the best chunks are
+	var response string
+	if req.QueryType == QueryNavigation && !signals.noMatch {
+		response = navigationAnswer(doc, topIndices)
+	}
+	var citations []string
+	if req.CitationStyle != "" {
+		citation := formatCitation(doc.Metadata, doc.Name, req.CitationStyle)
+		citations = make([]string, len(topChunks))
+		for i := range citations {
+			citations[i] = citation
+			if sourceMetadata != nil && timeCode(sourceMetadata[i]) != "" {
+				citations[i] += " [" + timeCode(sourceMetadata[i]) + "]"
+			}
+		}
+	}
+	chunkIDs := sourceChunkIDs(doc, topIndices)
+	docName, collection, archived := doc.Name, doc.Collection, doc.ArchivedAt != nil
+	release()
+
+	// Get response from Ollama
+	if req.Deterministic {
+		ctx = deterministicContext(ctx)
+	}
+	var cached bool
+	if response == "" {
+		response, cached, err = cachedAnswer(streamingContext(ctx, sink), prompt, modelOrDefault(req.ModelName))
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, fmt.Sprintf("Failed to get response: %v", err))
+		}
+	}
+	var tableRows []TableRow
+	if tables != nil {
+		response, tableRows = usedRows(response, tables)
+	}
+	if computation != nil {
+		computation.checkAnswer(response)
+	}
+
+	result := &QueryResponse{
+		Response:       response,
+		SourceChunks:   topChunks,
+		UsedSummary:    usedSummary,
+		Citations:      citations,
+		SourcePages:    sourcePages,
+		SourceMetadata: sourceMetadata,
+		SourceScores:   sourceScores,
+		Cached:         cached,
+		CorrectedQuery: corrected,
+		Suggestion:     suggestion,
+		TableRows:      tableRows,
+		Computation:    computation,
+		Archived:       archived,
+		Fallback:       fallback,
+		QueryType:      req.QueryType,
+		ReusedSources:  reused != nil,
+		RewrittenQuery: rewritten,
+		ContextTrimmed: contextTrim,
+		Confidence:     scoreConfidence(ctx, req, collection, topChunks, response, signals),
+	}
+	if req.Verify != "" {
+		result.Verification = verifyAnswer(ctx, req.Verify, response, topChunks, modelOrDefault(req.ModelName))
+	}
+	answer := storedAnswer{
+		DocumentName:   docName,
+		ModelName:      modelOrDefault(req.ModelName),
+		Prompt:         prompt,
+		Response:       response,
+		SourceChunks:   topChunks,
+		UsedSummary:    usedSummary,
+		Citations:      citations,
+		SourcePages:    sourcePages,
+		SourceMetadata: sourceMetadata,
+		Deterministic:  req.Deterministic,
+		Tables:         tables,
+	}
+	result.AnswerID = storeAnswer(req.Tenant, answer)
+	if semanticKey != "" && queryVec != nil {
+		storeSemanticCache(semanticKey, req.Query, queryVec, result, answer)
+	}
+	if req.SessionID != "" {
+		turn := chatTurn(req, result)
+		turn.Query = asked
+		turn.SourceChunkIDs = chunkIDs
+		recordChatTurn(req.Tenant, req.SessionID, modelOrDefault(req.ModelName), turn)
+	}
+	if req.Speech {
+		if err := attachSpeech(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// queryPrompt is the prompt of a single-document query and what it was built from
+type queryPrompt struct {
+	prompt         string
+	sourcePages    []int
+	sourceMetadata []map[string]string
+	tables         []*tableSource
+	computation    *Computation
+	usedSummary    bool
+}
+
+// buildQueryPrompt assembles the prompt answering a query from its source chunks,
+// and the summary when useSummary is set
+func buildQueryPrompt(doc *Document, req QueryRequest, session *ChatSession, topChunks []string, topIndices []int, useSummary bool) queryPrompt {
+	var p queryPrompt
+	if len(doc.ChunkPages) > 0 {
+		p.sourcePages = make([]int, len(topIndices))
+		for i, idx := range topIndices {
+			p.sourcePages[i] = doc.ChunkPages[idx]
+		}
 	}
 
-	// Fallback to first chunks if no matches
-	if len(topChunks) == 0 {
-		maxChunks = 3
-		if len(doc.Chunks) < maxChunks {
-			maxChunks = len(doc.Chunks)
+	if len(doc.ChunkMetadata) == len(doc.Chunks) {
+		p.sourceMetadata = make([]map[string]string, len(topIndices))
+		for i, idx := range topIndices {
+			p.sourceMetadata[i] = doc.ChunkMetadata[idx]
 		}
-		topChunks = doc.Chunks[:maxChunks]
 	}
 
-	// Build context
-	ragContext := strings.Join(topChunks, "\n\n")
-	usedSummary := false
+	// Build context without text repeated across chunks and the summary; transcript
+	// chunks are prefixed with their time code so answers can cite it, and table
+	// chunks are given as one object per row
+	var summary string
+	if useSummary {
+		summary = doc.Summary
+	}
+	contextChunks, summary := dedupeContext(topChunks, summary)
+	if len(p.sourceMetadata) > 0 && timeCode(p.sourceMetadata[0]) != "" {
+		for i, chunk := range contextChunks {
+			if chunk != "" {
+				contextChunks[i] = fmt.Sprintf("[%s] %s", timeCode(p.sourceMetadata[i]), chunk)
+			}
+		}
+	}
+	p.tables = tableSources(doc, topIndices, req.TableMode)
+	for _, t := range p.tables {
+		contextChunks[t.Source] = t.structured()
+	}
+	ragContext := strings.Join(slices.DeleteFunc(contextChunks, func(c string) bool { return c == "" }), "\n\n")
 
 	// Add summary if available
-	if doc.HasSummary && doc.Summary != "" {
-		ragContext = fmt.Sprintf("Summary: %s\n\nRelevant sections:\n%s", doc.Summary, ragContext)
-		usedSummary = true
+	if summary != "" && ragContext == "" {
+		ragContext = "Summary: " + summary
+		p.usedSummary = true
+	} else if summary != "" {
+		ragContext = fmt.Sprintf("Summary: %s\n\nRelevant sections:\n%s", summary, ragContext)
+		p.usedSummary = true
 	}
 
 	// Create prompt
@@ -757,19 +1540,19 @@ func queryDocument(w http.ResponseWriter, r *http.Request) {
 Question: %s
 
 Answer:`, ragContext, req.Query)
-
-	// Get response from Ollama
-	response, err := callOllama(prompt, req.ModelName)
-	if err != nil {
-		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get response: %v", err))
-		return
-	}
-
-	sendJSON(w, http.StatusOK, QueryResponse{
-		Response:     response,
-		SourceChunks: topChunks,
-		UsedSummary:  usedSummary,
-	})
+	p.computation = computeAggregate(req.Query, topChunks, p.tables)
+	prompt = withComputation(prompt, p.computation)
+	if req.QueryType == QueryComparison {
+		prompt = withComparison(prompt)
+	}
+	if p.tables != nil {
+		prompt = withTableInstructions(prompt)
+	}
+	prompt = withConversation(prompt, session)
+	prompt = withPinnedFacts(prompt, pinnedFacts(req.Tenant))
+	prompt = withDocumentInstructions(prompt, doc.Instructions)
+	p.prompt = prompt
+	return p
 }
 
 func summarizeDocument(w http.ResponseWriter, r *http.Request) {
@@ -782,24 +1565,130 @@ func summarizeDocument(w http.ResponseWriter, r *http.Request) {
 		sendError(w, http.StatusBadRequest, "Invalid request")
 		return
 	}
+	if req.Webhook != "" {
+		if u, err := url.Parse(req.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			sendError(w, http.StatusBadRequest, "Webhook must be an http(s) URL")
+			return
+		}
+		req.Async = true
+	}
+
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	model, err := tenantModel(tenant, req.ModelName)
+	if err == nil {
+		err = quotaExceeded(tenant)
+	}
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
 
 	doc, ok := getDocumentOrError(w, req.DocumentName)
 	if !ok {
 		return
 	}
 
-	summary, err := generateDocumentSummary(doc, req.ModelName, req.SummaryType)
+	// Fail early rather than after generating a summary that would be refused
+	doc.mu.RLock()
+	err = preconditionError(r, doc)
+	doc.mu.RUnlock()
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	if req.Async {
+		ifMatch := r.Header.Get("If-Match")
+		job := jobStore.StartWithWebhook(tenant, summaryJobType, "", req.Webhook, func(ctx context.Context, job *Job) (interface{}, error) {
+			result, err := summarizeInBackground(ctx, doc, tenant, model, req, ifMatch)
+			if err != nil {
+				return nil, err
+			}
+			return result, nil
+		})
+		sendJSON(w, http.StatusAccepted, map[string]interface{}{
+			"message": fmt.Sprintf("Generating a summary of %s", doc.Name),
+			"job":     job.Snapshot(),
+		})
+		return
+	}
+
+	lease, err := acquireSummaryLease(doc.Name)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	defer lease.Release()
+
+	ctx, meter := meteredContext(r.Context())
+	defer func() { addUsage(tenant, "tokens", meter.tokens.Load()) }()
+	if req.Deterministic {
+		ctx = deterministicContext(ctx)
+	}
+	summary, err := generateDocumentSummary(ctx, doc, model, req.SummaryType)
 	if err != nil {
 		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to generate summary: %v", err))
 		return
 	}
 
-	doc.mu.Lock()
-	doc.Summary = summary
-	doc.HasSummary = true
-	doc.mu.Unlock()
+	// The If-Match check is repeated so a change made during generation is not overwritten
+	var version int64
+	if !updateDocument(w, r, doc, walSummary, func() string {
+		doc.Summary = summary
+		doc.HasSummary = true
+		version = doc.Version + 1
+		return summary
+	}) {
+		return
+	}
+	doc.mu.RLock()
+	publishDocumentEvent(EventSummaryReady, doc, false)
+	doc.mu.RUnlock()
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{"summary": summary, "version": version})
+}
+
+// summarizeInBackground does the work of an asynchronous summarize request. The
+// summary is stored like that of a synchronous one, unless the document was
+// replaced or no longer matches the request's If-Match by then.
+func summarizeInBackground(ctx context.Context, doc *Document, tenant, model string, req SummarizeRequest, ifMatch string) (*SummaryJobResult, error) {
+	lease, err := acquireSummaryLease(doc.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer lease.Release()
+
+	ctx, meter := meteredContext(ctx)
+	defer func() { addUsage(tenant, "tokens", meter.tokens.Load()) }()
+	if req.Deterministic {
+		ctx = deterministicContext(ctx)
+	}
+	summary, err := generateDocumentSummary(ctx, doc, model, req.SummaryType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate summary: %w", err)
+	}
+	if current, exists := documentStore.Get(doc.Name); !exists || current != doc {
+		return nil, fmt.Errorf("document %s was deleted or replaced while it was summarized", doc.Name)
+	}
 
-	sendJSON(w, http.StatusOK, map[string]string{"summary": summary})
+	result := &SummaryJobResult{Document: doc.Name, Summary: summary, SummaryLength: len(summary)}
+	err = updateDocumentLater(doc, ifMatch, walSummary, func() string {
+		doc.Summary = summary
+		doc.HasSummary = true
+		result.Version = doc.Version + 1
+		return summary
+	})
+	if err != nil {
+		return nil, err
+	}
+	doc.mu.RLock()
+	publishDocumentEvent(EventSummaryReady, doc, false)
+	doc.mu.RUnlock()
+	return result, nil
 }
 
 func handleDocumentByName(w http.ResponseWriter, r *http.Request) {
@@ -815,6 +1704,32 @@ func handleDocumentByName(w http.ResponseWriter, r *http.Request) {
 
 	if len(parts) == 2 && parts[1] == "summary" {
 		handleGetDocumentSummary(w, r, docName)
+	} else if len(parts) == 2 && parts[1] == "embedding-map" {
+		handleGetEmbeddingMap(w, r, docName)
+	} else if len(parts) == 2 && parts[1] == "stats" {
+		handleGetDocumentStats(w, r, docName)
+	} else if len(parts) == 2 && parts[1] == "toc" {
+		handleGetDocumentTOC(w, r, docName)
+	} else if len(parts) == 2 && parts[1] == "glossary" {
+		handleGetDocumentGlossary(w, r, docName)
+	} else if len(parts) == 2 && parts[1] == "instructions" {
+		handleDocumentInstructions(w, r, docName)
+	} else if len(parts) == 2 && parts[1] == "citation" {
+		handleGetDocumentCitation(w, r, docName)
+	} else if len(parts) == 4 && parts[1] == "page" && parts[3] == "image" {
+		handleGetPageImage(w, r, docName, parts[2])
+	} else if len(parts) == 2 && parts[1] == "metadata" {
+		handleDocumentMetadata(w, r, docName)
+	} else if len(parts) == 2 && (parts[1] == "archive" || parts[1] == "unarchive") {
+		handleArchiveDocument(w, r, docName, parts[1] == "archive")
+	} else if len(parts) == 2 && parts[1] == "restore" {
+		handleRestoreDocument(w, r, docName)
+	} else if len(parts) == 2 && parts[1] == "reprocess" {
+		handleReprocessDocument(w, r, docName)
+	} else if len(parts) == 1 && r.Method == "GET" {
+		handleGetDocument(w, r, docName)
+	} else if len(parts) == 1 && r.Method == "HEAD" {
+		handleHeadDocument(w, docName)
 	} else if len(parts) == 1 {
 		handleDeleteDocument(w, r, docName)
 	} else {
@@ -832,31 +1747,71 @@ func handleGetDocumentSummary(w http.ResponseWriter, r *http.Request, docName st
 		return
 	}
 
-	// Use the safe method
-	hasSummary, summary := doc.GetSummaryStatus()
+	doc.mu.RLock()
+	hasSummary, summary, version := doc.HasSummary, doc.Summary, doc.Version
+	w.Header().Set("ETag", documentETag(doc))
+	doc.mu.RUnlock()
 
 	if !hasSummary || summary == "" {
 		sendError(w, http.StatusNotFound, "No summary available")
 		return
 	}
 
-	sendJSON(w, http.StatusOK, map[string]string{"summary": summary})
+	sendJSON(w, http.StatusOK, map[string]interface{}{"summary": summary, "version": version})
 }
 
 func handleDeleteDocument(w http.ResponseWriter, r *http.Request, docName string) {
 	if !validateMethod(w, r, "DELETE") {
 		return
 	}
-
-	if !documentStore.Delete(docName) {
-		sendError(w, http.StatusNotFound, "Document not found")
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
 		return
 	}
 
-	// Clean up file
-	if err := os.Remove(filepath.Join("./documents", docName)); err != nil {
-		log.Printf("Warning: failed to delete file %s: %v", docName, err)
+	// Documents go to the trash for the retention window unless it is 0
+	retention := time.Duration(getConfig().TrashRetention)
+	err = withDocumentLease(docName, func() error {
+		doc, exists := documentStore.Get(docName)
+		if !exists {
+			return newAPIError(http.StatusNotFound, "Document not found")
+		}
+		doc.mu.RLock()
+		err := preconditionError(r, doc)
+		doc.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		if retention > 0 {
+			if err := trashDocument(doc, tenant); err != nil {
+				return err
+			}
+		}
+		documentStore.Delete(docName)
+		invalidateGlossary(docName, doc.Collection)
+		removePageImages(docName)
+
+		// Clean up file
+		if retention == 0 {
+			if err := os.Remove(filepath.Join("./documents", docName)); err != nil {
+				log.Printf("Warning: failed to delete file %s: %v", docName, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		sendAPIError(w, err)
+		return
 	}
 
-	sendJSON(w, http.StatusOK, map[string]string{"message": "Document deleted"})
+	if retention == 0 {
+		sendJSON(w, http.StatusOK, map[string]string{"message": "Document deleted"})
+		return
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Document moved to trash",
+		"purgeAt": time.Now().Add(retention),
+		"restore": "/api/document/" + docName + "/restore",
+	})
 }
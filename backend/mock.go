@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	mockModelName         = "mock"
+	defaultMockDimensions = 64
+)
+
+// MockConfig tunes the built-in mock provider, which answers generate and
+// embedding calls without Ollama for offline development and tests
+type MockConfig struct {
+	Responses     []MockResponse `json:"responses,omitempty"` // Canned answers; first match wins, otherwise the question is echoed
+	Latency       duration       `json:"latency"`             // Added to every call
+	LatencyJitter duration       `json:"latencyJitter"`       // Up to this much more, at random
+	FailureRate   float64        `json:"failureRate"`         // Share of calls failing with a retryable 503
+	Dimensions    int            `json:"dimensions"`          // Embedding size
+}
+
+// MockResponse is returned for prompts containing Match (case-insensitive)
+type MockResponse struct {
+	Match    string `json:"match"`
+	Response string `json:"response"`
+}
+
+func (m MockConfig) validate() error {
+	switch {
+	case m.Latency < 0 || m.LatencyJitter < 0:
+		return errors.New("mock latency cannot be negative")
+	case m.FailureRate < 0 || m.FailureRate > 1:
+		return errors.New("mock failureRate must be between 0 and 1")
+	case m.Dimensions < 0:
+		return errors.New("mock dimensions cannot be negative")
+	}
+	return nil
+}
+
+func usingMockProvider() bool {
+	return getConfig().Provider == ProviderMock
+}
+
+// mockCall simulates a model call's latency and failures
+func mockCall(ctx context.Context, m MockConfig) error {
+	delay := time.Duration(m.Latency)
+	if m.LatencyJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(m.LatencyJitter) + 1))
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if m.FailureRate > 0 && rand.Float64() < m.FailureRate {
+		return ollamaStatusError(503, []byte("mock provider: simulated failure"))
+	}
+	return nil
+}
+
+// mockGenerate returns the first canned response matching the prompt's question (or
+// the whole prompt when it has none), or echoes the question
+func mockGenerate(ctx context.Context, prompt string) (string, error) {
+	m := getConfig().Mock
+	if err := mockCall(ctx, m); err != nil {
+		return "", err
+	}
+
+	// Match against the question alone when there is one, not the retrieved context
+	question, hasQuestion := "", false
+	if i := strings.LastIndex(prompt, "Question:"); i >= 0 {
+		question = strings.TrimSpace(strings.SplitN(prompt[i+len("Question:"):], "\n", 2)[0])
+		hasQuestion = true
+	}
+	target := prompt
+	if hasQuestion {
+		target = question
+	}
+	target = strings.ToLower(target)
+	for _, r := range m.Responses {
+		if strings.Contains(target, strings.ToLower(r.Match)) {
+			return r.Response, nil
+		}
+	}
+	if hasQuestion {
+		return fmt.Sprintf("Mock answer to %q (%d-character prompt)", question, len(prompt)), nil
+	}
+	return fmt.Sprintf("Mock response to a %d-character prompt", len(prompt)), nil
+}
+
+// mockEmbedding hashes words into a fixed number of buckets, so texts sharing
+// words get similar vectors
+func mockEmbedding(ctx context.Context, text string) ([]float64, error) {
+	m := getConfig().Mock
+	if err := mockCall(ctx, m); err != nil {
+		return nil, err
+	}
+
+	dimensions := m.Dimensions
+	if dimensions == 0 {
+		dimensions = defaultMockDimensions
+	}
+	vec := make([]float64, dimensions)
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(word))
+		vec[h.Sum32()%uint32(dimensions)]++
+	}
+	var norm float64
+	for _, v := range vec {
+		norm += v * v
+	}
+	if norm == 0 {
+		vec[0] = 1 // Empty text still needs a non-zero vector
+		return vec, nil
+	}
+	norm = math.Sqrt(norm)
+	for i := range vec {
+		vec[i] /= norm
+	}
+	return vec, nil
+}
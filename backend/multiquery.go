@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	maxQueryDocuments = 500 // Documents one query can span
+	multiQueryChunks  = 6   // Chunks of combined context, from all documents together
+)
+
+// DocumentSelection is the documents a query spans: a list of names, or "all"
+type DocumentSelection struct {
+	All   bool
+	Names []string
+}
+
+func (s *DocumentSelection) UnmarshalJSON(data []byte) error {
+	var all string
+	if err := json.Unmarshal(data, &all); err == nil {
+		if all != "all" {
+			return fmt.Errorf(`documents must be a list of names or "all"`)
+		}
+		*s = DocumentSelection{All: true}
+		return nil
+	}
+	s.All = false
+	return json.Unmarshal(data, &s.Names)
+}
+
+func (s DocumentSelection) MarshalJSON() ([]byte, error) {
+	if s.All {
+		return json.Marshal("all")
+	}
+	return json.Marshal(s.Names)
+}
+
+// selected tells whether the query spans several documents rather than documentName
+func (s DocumentSelection) selected() bool {
+	return s.All || len(s.Names) > 0
+}
+
+// documents returns the selected documents sorted by name
+func (s DocumentSelection) documents(includeArchived bool) ([]*Document, error) {
+	var docs []*Document
+	if s.All {
+		docs = activeDocuments(documentStore.All(), includeArchived)
+	} else {
+		for _, name := range s.Names {
+			doc, exists := documentStore.Get(name)
+			if !exists {
+				return nil, newAPIError(http.StatusNotFound, "Document not found: "+name)
+			}
+			if !slices.Contains(docs, doc) {
+				docs = append(docs, doc)
+			}
+		}
+		if !includeArchived && len(activeDocuments(docs, false)) < len(docs) {
+			return nil, newAPIError(http.StatusConflict, "Some documents are archived; set includeArchived to query them")
+		}
+	}
+	if len(docs) == 0 {
+		return nil, newAPIError(http.StatusNotFound, "No documents to query")
+	}
+	if len(docs) > maxQueryDocuments {
+		return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("At most %d documents can be queried at once", maxQueryDocuments))
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Name < docs[j].Name })
+	return docs, nil
+}
+
+// multiSource is a chunk retrieved for a multi-document query
+type multiSource struct {
+	doc      *Document
+	index    int
+	chunk    string
+	score    float64
+	page     int
+	metadata map[string]string
+	archived bool
+}
+
+// multiQueryVector embeds the query when every document has embeddings from the
+// same model, so chunks of all of them can be ranked by one similarity. Otherwise
+// they are ranked by keyword score, whose IDF weights are shared by the store.
+func multiQueryVector(ctx context.Context, docs []*Document, query string) []float64 {
+	model := ""
+	for _, doc := range docs {
+		doc.mu.RLock()
+		vectors, embeddingModel := doc.hasVectors(), doc.EmbeddingModel
+		doc.mu.RUnlock()
+		if !vectors || model != "" && embeddingModel != model {
+			return nil
+		}
+		model = embeddingModel
+	}
+	vec, err := callOllamaEmbedding(ctx, query, model)
+	if err != nil {
+		log.Printf("Failed to embed a multi-document query, using keywords: %v", err)
+		return nil
+	}
+	return vec
+}
+
+// documentSources returns a document's best chunks for the query, with their
+// scores; documents the filters rule out give none
+func documentSources(doc *Document, req QueryRequest, queryVec []float64, limit int) ([]multiSource, error) {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	allowed, err := queryChunks(doc, "", req.Filters)
+	if err != nil {
+		return nil, err
+	}
+	rank := newChunkRanking(doc, req.Query, allowed)
+
+	var indices []int
+	var scores []float64
+	if queryVec != nil {
+		if indices, scores, err = doc.rankByVector(queryVec, rank); err != nil {
+			return nil, err
+		}
+		indices, scores = indices[:min(limit, len(indices))], scores[:min(limit, len(scores))]
+	} else {
+		_, indices, scores = keywordRetrieve(doc, req.Query, rank, limit)
+	}
+
+	sources := make([]multiSource, len(indices))
+	for i, idx := range indices {
+		sources[i] = multiSource{doc: doc, index: idx, chunk: doc.Chunks[idx], score: scores[i], archived: doc.ArchivedAt != nil}
+		if idx < len(doc.ChunkPages) {
+			sources[i].page = doc.ChunkPages[idx]
+		}
+		if len(doc.ChunkMetadata) == len(doc.Chunks) {
+			sources[i].metadata = doc.ChunkMetadata[idx]
+		}
+	}
+	return sources, nil
+}
+
+// runMultiQuery answers a query from the best chunks of several documents
+// together. Each source chunk is attributed to its document in sourceDocuments,
+// and the context names the document each passage comes from.
+func runMultiQuery(ctx context.Context, sink tokenSink, req QueryRequest) (*QueryResponse, error) {
+	switch {
+	case req.DocumentName != "":
+		return nil, newAPIError(http.StatusBadRequest, "Give either documentName or documents")
+	case req.Section != "" || req.SessionID != "":
+		return nil, newAPIError(http.StatusBadRequest, "section and sessionId apply to single-document queries; use filters.section")
+	}
+	docs, err := req.Documents.documents(req.IncludeArchived)
+	if err != nil {
+		return nil, err
+	}
+
+	queryVec := multiQueryVector(ctx, docs, req.Query)
+	var sources []multiSource
+	var filterErr error
+	for _, doc := range docs {
+		found, err := documentSources(doc, req, queryVec, multiQueryChunks)
+		if err != nil {
+			// Another document may match; the error is reported if none does
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) {
+				log.Printf("Retrieval failed for %s: %v", doc.Name, err)
+			}
+			if filterErr == nil {
+				filterErr = err
+			}
+			continue
+		}
+		sources = append(sources, found...)
+	}
+	if len(sources) == 0 {
+		if filterErr != nil {
+			return nil, filterErr
+		}
+		return &QueryResponse{Response: noRelevantContent, SourceChunks: []string{}, Fallback: FallbackNone}, nil
+	}
+	sort.SliceStable(sources, func(i, j int) bool { return sources[i].score > sources[j].score })
+	sources = sources[:min(multiQueryChunks, len(sources))]
+
+	// The weakest passages are left out when the prompt would not fit the model's
+	// context window
+	model := modelOrDefault(req.ModelName)
+	var prompt string
+	kept, promptTokens, err := fitContextWindow(ctx, model, req.ContextOverflow, len(sources), func(n int) string {
+		prompt = multiQueryPrompt(req, sources[:n])
+		return prompt
+	})
+	if err != nil {
+		return nil, err
+	}
+	var contextTrim *ContextTrim
+	if kept < len(sources) {
+		contextTrim = &ContextTrim{Window: getConfig().ContextWindow.window(model), PromptTokens: promptTokens}
+		for _, s := range sources[kept:] {
+			s.doc.mu.RLock()
+			contextTrim.DroppedChunks = append(contextTrim.DroppedChunks, droppedChunks(s.doc, []string{s.chunk}, []int{s.index}, []float64{s.score})...)
+			s.doc.mu.RUnlock()
+		}
+		sources = sources[:kept]
+	}
+
+	chunks := make([]string, len(sources))
+	names := make([]string, len(sources))
+	scores := make([]float64, len(sources))
+	pages := make([]int, len(sources))
+	metadata := make([]map[string]string, len(sources))
+	hasPages, hasMetadata, archived := false, false, false
+	for i, s := range sources {
+		chunks[i], names[i], scores[i], pages[i], metadata[i] = s.chunk, s.doc.Name, s.score, s.page, s.metadata
+		s.doc.recordRetrieval(s.index)
+		hasPages = hasPages || s.page > 0
+		hasMetadata = hasMetadata || s.metadata != nil
+		archived = archived || s.archived
+	}
+	// Pages and metadata are left out when no source has any
+	if !hasPages {
+		pages = nil
+	}
+	if !hasMetadata {
+		metadata = nil
+	}
+	var citations []string
+	if req.CitationStyle != "" {
+		citations = make([]string, len(sources))
+		for i, s := range sources {
+			s.doc.mu.RLock()
+			citations[i] = formatCitation(s.doc.Metadata, s.doc.Name, req.CitationStyle)
+			s.doc.mu.RUnlock()
+		}
+	}
+
+	if req.Deterministic {
+		ctx = deterministicContext(ctx)
+	}
+	response, cached, err := cachedAnswer(streamingContext(ctx, sink), prompt, model)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, fmt.Sprintf("Failed to get response: %v", err))
+	}
+
+	result := &QueryResponse{
+		Response:        response,
+		SourceChunks:    chunks,
+		SourceDocuments: names,
+		SourceScores:    scores,
+		Citations:       citations,
+		SourcePages:     pages,
+		SourceMetadata:  metadata,
+		Cached:          cached,
+		Archived:        archived,
+		ContextTrimmed:  contextTrim,
+	}
+	if req.Verify != "" {
+		result.Verification = verifyAnswer(ctx, req.Verify, response, chunks, model)
+	}
+	result.AnswerID = storeAnswer(req.Tenant, storedAnswer{
+		ModelName:      model,
+		Prompt:         prompt,
+		Response:       response,
+		SourceChunks:   chunks,
+		Citations:      citations,
+		SourcePages:    pages,
+		SourceMetadata: metadata,
+		SourceDocs:     names,
+		Deterministic:  req.Deterministic,
+	})
+	if req.Speech {
+		if err := attachSpeech(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// multiQueryPrompt asks for an answer from passages of several documents, each
+// headed by the name of its document
+func multiQueryPrompt(req QueryRequest, sources []multiSource) string {
+	passages := make([]string, len(sources))
+	for i, s := range sources {
+		passages[i] = fmt.Sprintf("[%s]\n%s", s.doc.Name, s.chunk)
+	}
+	prompt := fmt.Sprintf(`Answer based on this context, taken from several documents. Each passage starts with the name of its document in brackets; say which document each fact comes from.
+
+%s
+
+Question: %s
+
+Answer:`, strings.Join(passages, "\n\n"), req.Query)
+	return withPinnedFacts(prompt, pinnedFacts(req.Tenant))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const natsTimeout = 5 * time.Second
+
+// natsClient is a minimal NATS publisher over a single connection. Each message
+// is followed by a PING, so a publish returns once the server has processed it.
+// Only the event forwarder uses it, from one goroutine.
+type natsClient struct {
+	addr     string
+	host     string
+	username string
+	password string
+	token    string
+	useTLS   bool
+	conn     net.Conn
+	r        *bufio.Reader
+}
+
+// newNATSClient parses nats://[user:password@|token@]host[:port] (tls:// for TLS)
+func newNATSClient(rawURL string) (*natsClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+		return nil, fmt.Errorf("invalid nats url %q", rawURL)
+	}
+	c := &natsClient{addr: u.Host, host: u.Hostname(), useTLS: u.Scheme == "tls"}
+	if u.Port() == "" {
+		c.addr += ":4222"
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			c.username, c.password = u.User.Username(), password
+		} else {
+			c.token = u.User.Username()
+		}
+	}
+	return c, nil
+}
+
+func (c *natsClient) String() string { return "NATS at " + c.addr }
+
+// connect dials, upgrades to TLS after the server's INFO when asked to, and
+// sends CONNECT
+func (c *natsClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, natsTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to nats: %w", err)
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	if err := c.handshake(); err != nil {
+		c.disconnect()
+		return err
+	}
+	return nil
+}
+
+func (c *natsClient) handshake() error {
+	if err := c.conn.SetDeadline(time.Now().Add(natsTimeout)); err != nil {
+		return err
+	}
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected nats greeting %q", line)
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(line[len("INFO "):]), &info); err != nil {
+		return fmt.Errorf("invalid nats INFO: %w", err)
+	}
+	if info.TLSRequired && !c.useTLS {
+		return fmt.Errorf("nats server requires TLS; use a tls:// url")
+	}
+	if c.useTLS {
+		conn := tls.Client(c.conn, &tls.Config{ServerName: c.host})
+		if err := conn.Handshake(); err != nil {
+			return fmt.Errorf("nats TLS handshake failed: %w", err)
+		}
+		c.conn, c.r = conn, bufio.NewReader(conn)
+	}
+
+	options := map[string]interface{}{
+		"verbose":      false,
+		"pedantic":     false,
+		"tls_required": c.useTLS,
+		"name":         "rag-backend",
+		"lang":         "go",
+		"version":      "1.0",
+		"protocol":     0,
+	}
+	if c.token != "" {
+		options["auth_token"] = c.token
+	}
+	if c.username != "" {
+		options["user"], options["pass"] = c.username, c.password
+	}
+	connectOptions, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.conn, "CONNECT %s\r\nPING\r\n", connectOptions); err != nil {
+		return err
+	}
+	return c.awaitPong()
+}
+
+func (c *natsClient) disconnect() {
+	if c.conn != nil {
+		closeFile(c.conn, "nats connection")
+		c.conn, c.r = nil, nil
+	}
+}
+
+// publish sends a message to a subject. A broken connection is re-established
+// and the message sent again once.
+func (c *natsClient) publish(subject, _ string, payload []byte) error {
+	for attempt := 0; ; attempt++ {
+		if c.conn == nil {
+			if err := c.connect(); err != nil {
+				return err
+			}
+		}
+		err := c.roundTrip(subject, payload)
+		if err == nil {
+			return nil
+		}
+		c.disconnect()
+		if attempt > 0 {
+			return fmt.Errorf("nats publish to %s failed: %w", subject, err)
+		}
+	}
+}
+
+func (c *natsClient) roundTrip(subject string, payload []byte) error {
+	if err := c.conn.SetDeadline(time.Now().Add(natsTimeout)); err != nil {
+		return err
+	}
+	message := make([]byte, 0, len(subject)+len(payload)+32)
+	message = fmt.Appendf(message, "PUB %s %d\r\n", subject, len(payload))
+	message = append(message, payload...)
+	message = append(message, "\r\nPING\r\n"...)
+	if _, err := c.conn.Write(message); err != nil {
+		return err
+	}
+	return c.awaitPong()
+}
+
+// awaitPong reads until the server answers our PING, answering its own PINGs
+// and failing on an -ERR
+func (c *natsClient) awaitPong() error {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := io.WriteString(c.conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats error: %s", strings.TrimSpace(line[len("-ERR"):]))
+		}
+		// +OK and updated INFO need no answer
+	}
+}
+
+func (c *natsClient) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *natsClient) close() { c.disconnect() }
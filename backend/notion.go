@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	notionAPI     = "https://api.notion.com/v1"
+	notionVersion = "2022-06-28"
+	// Notion allows about three requests per second per integration
+	notionRequestInterval = 350 * time.Millisecond
+	notionMaxDepth        = 10
+)
+
+type notionClient struct {
+	token string
+	last  time.Time
+}
+
+type notionRichText struct {
+	PlainText   string `json:"plain_text"`
+	Href        string `json:"href"`
+	Annotations struct {
+		Bold          bool `json:"bold"`
+		Italic        bool `json:"italic"`
+		Strikethrough bool `json:"strikethrough"`
+		Code          bool `json:"code"`
+	} `json:"annotations"`
+}
+
+type notionPage struct {
+	ID         string `json:"id"`
+	URL        string `json:"url"`
+	LastEdited string `json:"last_edited_time"`
+	Properties map[string]struct {
+		Type  string           `json:"type"`
+		Title []notionRichText `json:"title"`
+	} `json:"properties"`
+}
+
+func (p *notionPage) title() string {
+	for _, prop := range p.Properties {
+		if prop.Type == "title" {
+			if t := strings.TrimSpace(notionPlainText(prop.Title)); t != "" {
+				return t
+			}
+		}
+	}
+	return "Untitled"
+}
+
+// notionBlock is a content block; the type-specific payload sits under a key named after Type
+type notionBlock struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	HasChildren bool   `json:"has_children"`
+	content     struct {
+		RichText []notionRichText   `json:"rich_text"`
+		Title    string             `json:"title"` // child_page
+		Language string             `json:"language"`
+		Checked  bool               `json:"checked"`
+		Cells    [][]notionRichText `json:"cells"` // table_row
+	}
+}
+
+func (b *notionBlock) UnmarshalJSON(data []byte) error {
+	type plain notionBlock
+	if err := json.Unmarshal(data, (*plain)(b)); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if payload, ok := fields[b.Type]; ok {
+		return json.Unmarshal(payload, &b.content)
+	}
+	return nil
+}
+
+// call performs a rate-limited Notion API request and decodes the JSON response
+func (c *notionClient) call(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	if wait := notionRequestInterval - time.Since(c.last); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	c.last = time.Now()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, notionAPI+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Notion-Version", notionVersion)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := sourceHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("notion request failed: %w", err)
+	}
+	defer closeFile(resp.Body, "notion response body")
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("notion error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// queryDatabase returns every page of a database
+func (c *notionClient) queryDatabase(ctx context.Context, id string) ([]notionPage, error) {
+	var pages []notionPage
+	body := map[string]interface{}{"page_size": 100}
+	for {
+		var result struct {
+			Results    []notionPage `json:"results"`
+			HasMore    bool         `json:"has_more"`
+			NextCursor string       `json:"next_cursor"`
+		}
+		if err := c.call(ctx, "POST", "/databases/"+id+"/query", body, &result); err != nil {
+			return nil, err
+		}
+		pages = append(pages, result.Results...)
+		if !result.HasMore {
+			return pages, nil
+		}
+		body["start_cursor"] = result.NextCursor
+	}
+}
+
+// children returns every child block of a block or page
+func (c *notionClient) children(ctx context.Context, id string) ([]notionBlock, error) {
+	var blocks []notionBlock
+	cursor := ""
+	for {
+		path := "/blocks/" + id + "/children?page_size=100"
+		if cursor != "" {
+			path += "&start_cursor=" + cursor
+		}
+		var result struct {
+			Results    []notionBlock `json:"results"`
+			HasMore    bool          `json:"has_more"`
+			NextCursor string        `json:"next_cursor"`
+		}
+		if err := c.call(ctx, "GET", path, nil, &result); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, result.Results...)
+		if !result.HasMore {
+			return blocks, nil
+		}
+		cursor = result.NextCursor
+	}
+}
+
+func notionPlainText(rich []notionRichText) string {
+	var b strings.Builder
+	for _, t := range rich {
+		b.WriteString(t.PlainText)
+	}
+	return b.String()
+}
+
+// notionMarkdownText renders rich text with its annotations and links
+func notionMarkdownText(rich []notionRichText) string {
+	var b strings.Builder
+	for _, t := range rich {
+		text := t.PlainText
+		if strings.TrimSpace(text) == "" {
+			b.WriteString(text)
+			continue
+		}
+		if t.Annotations.Code {
+			text = "`" + text + "`"
+		}
+		if t.Annotations.Bold {
+			text = "**" + text + "**"
+		}
+		if t.Annotations.Italic {
+			text = "_" + text + "_"
+		}
+		if t.Annotations.Strikethrough {
+			text = "~~" + text + "~~"
+		}
+		if t.Href != "" {
+			text = "[" + text + "](" + t.Href + ")"
+		}
+		b.WriteString(text)
+	}
+	return b.String()
+}
+
+// renderBlocks writes blocks as Markdown and collects the IDs of child pages
+func (c *notionClient) renderBlocks(ctx context.Context, blocks []notionBlock, indent string, b *strings.Builder, childPages *[]string) error {
+	number := 0
+	for _, block := range blocks {
+		text := notionMarkdownText(block.content.RichText)
+		nested := indent
+		if block.Type == "numbered_list_item" {
+			number++
+		} else {
+			number = 0
+		}
+		switch block.Type {
+		case "heading_1", "heading_2", "heading_3":
+			b.WriteString("\n" + strings.Repeat("#", int(block.Type[8]-'0')+1) + " " + text + "\n\n")
+		case "bulleted_list_item", "toggle":
+			b.WriteString(indent + "- " + text + "\n")
+			nested = indent + "  "
+		case "numbered_list_item":
+			b.WriteString(fmt.Sprintf("%s%d. %s\n", indent, number, text))
+			nested = indent + "   "
+		case "to_do":
+			mark := " "
+			if block.content.Checked {
+				mark = "x"
+			}
+			b.WriteString(indent + "- [" + mark + "] " + text + "\n")
+			nested = indent + "  "
+		case "quote", "callout":
+			b.WriteString(indent + "> " + text + "\n\n")
+		case "code":
+			b.WriteString("```" + block.content.Language + "\n" + notionPlainText(block.content.RichText) + "\n```\n\n")
+		case "divider":
+			b.WriteString("---\n\n")
+		case "table_row":
+			cells := make([]string, len(block.content.Cells))
+			for k, cell := range block.content.Cells {
+				cells[k] = notionMarkdownText(cell)
+			}
+			b.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+		case "child_page":
+			*childPages = append(*childPages, block.ID)
+			b.WriteString(indent + "- " + block.content.Title + " (subpage)\n")
+			continue
+		case "child_database":
+			continue
+		default:
+			if text != "" {
+				b.WriteString(indent + text + "\n\n")
+			}
+		}
+
+		if block.HasChildren {
+			children, err := c.children(ctx, block.ID)
+			if err != nil {
+				return err
+			}
+			if err := c.renderBlocks(ctx, children, nested, b, childPages); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// syncNotionSource imports a database's pages, or a page and its subpages, with
+// the page path as hierarchy metadata
+func syncNotionSource(ctx context.Context, src Source, items map[string]*SourceItem) (int, int, error) {
+	token := src.Token
+	if token == "" {
+		token = os.Getenv("NOTION_TOKEN")
+	}
+	client := &notionClient{token: token}
+
+	var roots []notionPage
+	if src.Database != "" {
+		pages, err := client.queryDatabase(ctx, src.Database)
+		if err != nil {
+			return 0, 0, err
+		}
+		roots = pages
+	} else {
+		var page notionPage
+		if err := client.call(ctx, "GET", "/pages/"+src.Page, nil, &page); err != nil {
+			return 0, 0, err
+		}
+		roots = []notionPage{page}
+	}
+
+	var changed, unchanged int
+	var failed []string
+	visited := make(map[string]bool)
+
+	var importPage func(page notionPage, parent []string, depth int) error
+	importPage = func(page notionPage, parent []string, depth int) error {
+		if visited[page.ID] || depth > notionMaxDepth {
+			return nil
+		}
+		visited[page.ID] = true
+		title := page.title()
+		path := append(append([]string(nil), parent...), title)
+
+		blocks, err := client.children(ctx, page.ID)
+		if err != nil {
+			return err
+		}
+		var markdown strings.Builder
+		var childPages []string
+		if err := client.renderBlocks(ctx, blocks, "", &markdown, &childPages); err != nil {
+			return err
+		}
+
+		ok, err := ingestPage(src, items, page.ID, title, path, page.URL, markdown.String(), page.LastEdited)
+		switch {
+		case err != nil:
+			failed = append(failed, title)
+		case ok:
+			changed++
+		default:
+			unchanged++
+		}
+
+		for _, id := range childPages {
+			var child notionPage
+			if err := client.call(ctx, "GET", "/pages/"+id, nil, &child); err != nil {
+				return err
+			}
+			if err := importPage(child, path, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, page := range roots {
+		if err := importPage(page, nil, 0); err != nil {
+			return changed, unchanged, err
+		}
+	}
+
+	if len(failed) > 0 {
+		return changed, unchanged, fmt.Errorf("failed to ingest %s", strings.Join(failed, ", "))
+	}
+	return changed, unchanged, nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Aggregations computed over numbers in the sources
+const (
+	AggregateSum        = "sum"
+	AggregateAverage    = "average"
+	AggregateMax        = "max"
+	AggregateMin        = "min"
+	AggregateDifference = "difference" // Largest minus smallest
+)
+
+// aggregationPatterns detect questions that need arithmetic, checked in order
+var aggregationPatterns = []struct {
+	operation string
+	pattern   *regexp.Regexp
+}{
+	{AggregateAverage, regexp.MustCompile(`(?i)\b(?:average|mean|per capita)\b`)},
+	{AggregateDifference, regexp.MustCompile(`(?i)\b(?:difference|how much (?:more|less|higher|lower)|gap between)\b`)},
+	{AggregateSum, regexp.MustCompile(`(?i)\b(?:total|sum|add(?:ed)? up|altogether|combined)\b`)},
+	{AggregateMax, regexp.MustCompile(`(?i)\b(?:highest|largest|biggest|greatest|most|maximum|max)\b`)},
+	{AggregateMin, regexp.MustCompile(`(?i)\b(?:lowest|smallest|least|fewest|minimum|min|cheapest)\b`)},
+}
+
+// Words of aggregation questions that say nothing about which values to use
+var aggregationWords = wordSet("average mean per capita difference more less higher lower gap between total sum add added up altogether combined highest largest biggest greatest most maximum max lowest smallest least fewest minimum min cheapest value values number amount")
+
+// detectAggregation returns the operation a question asks for, or ""
+func detectAggregation(query string) string {
+	for _, p := range aggregationPatterns {
+		if p.pattern.MatchString(query) {
+			return p.operation
+		}
+	}
+	return ""
+}
+
+// NumericValue is a number taken from a source, with where it came from
+type NumericValue struct {
+	Value   float64 `json:"value"`
+	Text    string  `json:"text"`             // As written in the source
+	Unit    string  `json:"unit,omitempty"`   // Currency symbol, %, or the word after the number
+	Source  int     `json:"source"`           // Index into sourceChunks
+	Table   string  `json:"table,omitempty"`  // For table cells
+	Row     int     `json:"row,omitempty"`    // Spreadsheet row
+	Column  string  `json:"column,omitempty"` // Table column
+	Context string  `json:"context"`          // Sentence or row the value appears in
+}
+
+// Computation is an aggregate computed from the sources instead of by the model
+type Computation struct {
+	Operation    string         `json:"operation"`
+	Result       float64        `json:"result"`
+	Unit         string         `json:"unit,omitempty"`
+	Values       []NumericValue `json:"values"`
+	AnswerAgrees bool           `json:"answerAgrees"` // The answer states the computed result
+}
+
+var (
+	// Numbers such as 1,250.50, $12k, €3.5 million, 40%
+	numberPattern = regexp.MustCompile(`(?i)([$€£¥])?\s?(\d{1,3}(?:,\d{3})+(?:\.\d+)?|\d+(?:\.\d+)?)(?:\s?(%|percent\b|k\b|thousand\b|m\b|mn\b|million\b|bn\b|billion\b))?(?:\s+([a-z]+))?`)
+	// Words before numbers that are references rather than quantities
+	referenceWords = wordSet("section sections clause clauses article articles page pages chapter chapters paragraph item no number rule figure table appendix version step")
+)
+
+var scaleFactors = map[string]float64{
+	"k": 1e3, "thousand": 1e3, "m": 1e6, "mn": 1e6, "million": 1e6, "bn": 1e9, "billion": 1e9,
+}
+
+// parseNumbers finds the quantities in text
+func parseNumbers(text string) []NumericValue {
+	return scanNumbers(text, true)
+}
+
+// scanNumbers finds the numbers in text, skipping likely years when asked
+func scanNumbers(text string, skipYears bool) []NumericValue {
+	var values []NumericValue
+	for _, m := range numberPattern.FindAllStringSubmatchIndex(text, -1) {
+		currency := submatch(text, m, 1)
+		digits := submatch(text, m, 2)
+		suffix := strings.ToLower(submatch(text, m, 3))
+		next := strings.ToLower(submatch(text, m, 4))
+
+		// Skip parts of longer tokens (dates, IDs, decimals already consumed)
+		if m[4] > 0 && (isWordByte(text[m[4]-1]) || text[m[4]-1] == '.' || text[m[4]-1] == '/' || text[m[4]-1] == '-') && currency == "" {
+			continue
+		}
+		if end := m[5]; end < len(text) && (text[end] == '/' || text[end] == '-' || isWordByte(text[end])) && suffix == "" {
+			continue
+		}
+		if words := tokenize(text[:m[0]]); len(words) > 0 && referenceWords[words[len(words)-1]] {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.ReplaceAll(digits, ",", ""), 64)
+		if err != nil {
+			continue
+		}
+		// Four-digit numbers without a unit are most likely years
+		if skipYears && currency == "" && suffix == "" && !strings.Contains(digits, ",") && !strings.Contains(digits, ".") && n >= 1900 && n <= 2100 {
+			continue
+		}
+
+		unit := currency
+		switch {
+		case suffix == "%" || suffix == "percent":
+			unit = "%"
+		case scaleFactors[suffix] > 0:
+			n *= scaleFactors[suffix]
+		}
+		if unit == "" && next != "" && !isStopword(next) {
+			unit = next
+		}
+		end := m[1]
+		if m[8] >= 0 {
+			end = m[8] // The word after the number is not part of it
+		}
+		values = append(values, NumericValue{Value: n, Text: strings.TrimSpace(text[m[0]:end]), Unit: unit})
+	}
+	return values
+}
+
+func submatch(text string, m []int, group int) string {
+	if m[2*group] < 0 {
+		return ""
+	}
+	return text[m[2*group]:m[2*group+1]]
+}
+
+func isWordByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_'
+}
+
+// queryTerms returns the words of a question that name what to aggregate
+func queryTerms(query string) map[string]bool {
+	terms := make(map[string]bool)
+	for _, w := range contentWords(query) {
+		if !aggregationWords[w] && !isNumber(w) {
+			terms[w] = true
+			terms[strings.TrimSuffix(w, "s")] = true
+		}
+	}
+	return terms
+}
+
+func overlap(text string, terms map[string]bool) int {
+	n := 0
+	for _, w := range tokenize(text) {
+		if terms[w] || terms[strings.TrimSuffix(w, "s")] {
+			n++
+		}
+	}
+	return n
+}
+
+// tableValues returns the cells of the numeric column the question names,
+// from every row of the table sources
+func tableValues(tables []*tableSource, terms map[string]bool) []NumericValue {
+	type column struct {
+		name  string
+		score int
+	}
+	var best column
+	numericColumns := make(map[string]bool)
+	for _, t := range tables {
+		for i, name := range t.Columns {
+			numeric := 0
+			for _, row := range t.Rows {
+				if i < len(row.Cells) && len(scanNumbers(row.Cells[i], false)) == 1 {
+					numeric++
+				}
+			}
+			if numeric*2 < len(t.Rows) || numeric == 0 {
+				continue
+			}
+			numericColumns[name] = true
+			if score := overlap(name, terms); score > best.score {
+				best = column{name, score}
+			}
+		}
+	}
+	// A single numeric column needs no naming
+	if best.name == "" && len(numericColumns) == 1 {
+		for name := range numericColumns {
+			best.name = name
+		}
+	}
+	if best.name == "" {
+		return nil
+	}
+
+	var values []NumericValue
+	for _, t := range tables {
+		for i, name := range t.Columns {
+			if name != best.name {
+				continue
+			}
+			for _, row := range t.Rows {
+				if i >= len(row.Cells) {
+					continue
+				}
+				numbers := scanNumbers(row.Cells[i], false)
+				if len(numbers) != 1 {
+					continue
+				}
+				v := numbers[0]
+				v.Source, v.Table, v.Row, v.Column = t.Source, t.Table, row.Number, name
+				v.Context = strings.Join(row.Cells, " | ")
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// textValues returns the numbers in source sentences that mention the question's
+// terms, keeping the unit the question names or else the most common one
+func textValues(sources []string, terms map[string]bool) []NumericValue {
+	var candidates []NumericValue
+	seen := make(map[string]bool)
+	for i, source := range sources {
+		for _, span := range sentenceSpans(source) {
+			sentence := source[span[0]:span[1]]
+			if overlap(sentence, terms) == 0 {
+				continue
+			}
+			for _, v := range parseNumbers(sentence) {
+				// Overlapping chunks repeat sentences
+				key := sentence + "\x00" + v.Text
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				v.Source, v.Context = i, sentence
+				candidates = append(candidates, v)
+			}
+		}
+	}
+
+	counts := make(map[string]int)
+	unit := ""
+	for _, v := range candidates {
+		counts[v.Unit]++
+		if terms[v.Unit] || terms[strings.TrimSuffix(v.Unit, "s")] {
+			unit = v.Unit
+		}
+	}
+	if unit == "" {
+		for u, n := range counts {
+			if n > counts[unit] || (n == counts[unit] && u < unit) {
+				unit = u
+			}
+		}
+	}
+	var values []NumericValue
+	for _, v := range candidates {
+		if v.Unit == unit {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// computeAggregate does the arithmetic an aggregation question asks for over
+// the numbers in its sources: table columns when a source is a table, else the
+// quantities in sentences mentioning the question's terms. It returns nil for
+// other questions or when fewer than two values are found.
+func computeAggregate(query string, sources []string, tables []*tableSource) *Computation {
+	operation := detectAggregation(query)
+	if operation == "" {
+		return nil
+	}
+	terms := queryTerms(query)
+	var values []NumericValue
+	if len(tables) > 0 {
+		values = tableValues(tables, terms)
+	}
+	if len(values) < 2 {
+		values = textValues(sources, terms)
+	}
+	if len(values) < 2 {
+		return nil
+	}
+
+	c := &Computation{Operation: operation, Values: values, Unit: values[0].Unit}
+	lowest, highest, sum := math.Inf(1), math.Inf(-1), 0.0
+	for _, v := range values {
+		lowest, highest, sum = math.Min(lowest, v.Value), math.Max(highest, v.Value), sum+v.Value
+	}
+	switch operation {
+	case AggregateSum:
+		c.Result = sum
+	case AggregateAverage:
+		c.Result = sum / float64(len(values))
+	case AggregateMax:
+		c.Result = highest
+	case AggregateMin:
+		c.Result = lowest
+	case AggregateDifference:
+		c.Result = highest - lowest
+	}
+	c.Result = math.Round(c.Result*1e6) / 1e6
+	return c
+}
+
+// formatNumber writes a result without trailing zeros
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(math.Round(n*100)/100, 'f', -1, 64)
+}
+
+// describe states the computation for the prompt
+func (c *Computation) describe() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Computed from the context (%s of %d values", c.Operation, len(c.Values))
+	if c.Values[0].Column != "" {
+		fmt.Fprintf(&b, " in column %q", c.Values[0].Column)
+	}
+	result := formatNumber(c.Result)
+	switch {
+	case strings.ContainsAny(c.Unit, "$€£¥"):
+		result = c.Unit + result
+	case c.Unit == "%":
+		result += "%"
+	case c.Unit != "":
+		result += " " + c.Unit
+	}
+	fmt.Fprintf(&b, "): %s", result)
+	b.WriteString(". Values used: ")
+	for i, v := range c.Values {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(v.Text)
+	}
+	b.WriteString(".\nUse this result rather than doing the arithmetic yourself, and say which values it covers.")
+	return b.String()
+}
+
+// withComputation adds the computed aggregate after the context
+func withComputation(prompt string, c *Computation) string {
+	if c == nil {
+		return prompt
+	}
+	question := strings.LastIndex(prompt, "\n\nQuestion: ")
+	if question < 0 {
+		return prompt + "\n\n" + c.describe()
+	}
+	return prompt[:question] + "\n\n" + c.describe() + prompt[question:]
+}
+
+// checkAnswer records whether the answer states the computed result, allowing
+// for rounding
+func (c *Computation) checkAnswer(response string) {
+	tolerance := math.Max(math.Abs(c.Result)*0.005, 0.01)
+	for _, v := range scanNumbers(response, false) {
+		if math.Abs(v.Value-c.Result) <= tolerance {
+			c.AnswerAgrees = true
+			return
+		}
+	}
+}
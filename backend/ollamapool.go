@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Ollama used when OLLAMA_URLS is unset
+const DefaultOllamaURL = "http://localhost:11434"
+
+// Ways of spreading requests over the Ollama endpoints
+const (
+	BalanceLeastLoaded = "least-loaded" // The endpoint with the fewest requests in flight
+	BalanceRoundRobin  = "round-robin"  // Each endpoint in turn
+)
+
+// Timeout of a health check
+const ollamaHealthTimeout = 5 * time.Second
+
+// OllamaPoolConfig lists the Ollama servers generate and embedding calls are spread over
+type OllamaPoolConfig struct {
+	URLs           []string `json:"urls"`           // Base URLs, e.g. http://gpu1:11434
+	Balancing      string   `json:"balancing"`      // least-loaded or round-robin
+	HealthInterval duration `json:"healthInterval"` // How often endpoints are checked
+	SwapDelay      duration `json:"swapDelay"`      // Longest a request waits rather than swap out a model in use; 0 disables
+}
+
+func (c OllamaPoolConfig) validate() error {
+	if len(c.URLs) == 0 {
+		return errors.New("ollama.urls needs at least one URL")
+	}
+	for _, raw := range c.URLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid Ollama URL %q", raw)
+		}
+	}
+	if c.Balancing != BalanceLeastLoaded && c.Balancing != BalanceRoundRobin {
+		return fmt.Errorf("unknown ollama.balancing %q (use least-loaded or round-robin)", c.Balancing)
+	}
+	if c.HealthInterval <= 0 {
+		return errors.New("ollama.healthInterval must be positive")
+	}
+	if c.SwapDelay < 0 {
+		return errors.New("ollama.swapDelay cannot be negative")
+	}
+	return nil
+}
+
+// parseOllamaURLs splits OLLAMA_URLS
+func parseOllamaURLs(value string) []string {
+	var urls []string
+	for _, u := range strings.Split(value, ",") {
+		if u = strings.TrimRight(strings.TrimSpace(u), "/"); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// ollamaEndpoint is one Ollama server and what is known about it
+type ollamaEndpoint struct {
+	URL       string
+	inFlight  atomic.Int64
+	mu        sync.Mutex
+	healthy   bool
+	models    []string // From the last health check; nil until one succeeded
+	sizes     map[string]int64
+	loaded    []loadedModel // Models in memory; nil when unknown
+	vramPeak  int64         // Most VRAM seen in use
+	active    map[string]int
+	changed   chan struct{} // Closed when active changes
+	lastError string
+	checkedAt time.Time
+}
+
+// OllamaEndpointStatus reports an endpoint on /api/admin/ollama
+type OllamaEndpointStatus struct {
+	URL       string        `json:"url"`
+	Healthy   bool          `json:"healthy"`
+	InFlight  int64         `json:"inFlight"`
+	Models    []string      `json:"models"`
+	Loaded    []loadedModel `json:"loaded"`
+	VRAMPeak  int64         `json:"vramPeak"` // Most VRAM seen in use, in bytes
+	LastError string        `json:"lastError,omitempty"`
+	CheckedAt time.Time     `json:"checkedAt,omitempty"`
+}
+
+func (e *ollamaEndpoint) api(path string) string {
+	return strings.TrimRight(e.URL, "/") + "/api" + path
+}
+
+func (e *ollamaEndpoint) setHealth(healthy bool, models []ollamaModel, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.healthy = healthy
+	if models != nil {
+		e.models = make([]string, 0, len(models))
+		e.sizes = make(map[string]int64, len(models))
+		for _, m := range models {
+			e.models = append(e.models, m.Name)
+			e.sizes[m.Name] = m.Size
+		}
+	}
+	e.lastError = ""
+	if err != nil {
+		e.lastError = err.Error()
+	}
+	e.checkedAt = time.Now()
+}
+
+// serves reports whether the endpoint is up and, when its models are known, has model
+func (e *ollamaEndpoint) serves(model string) (healthy, hasModel bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.models == nil || model == "" {
+		return e.healthy, true
+	}
+	return e.healthy, slices.Contains(e.models, model) || slices.Contains(e.models, model+":latest")
+}
+
+// ollamaPool spreads Ollama calls over the configured endpoints and fails over
+// to the next one when an endpoint is down or overloaded
+type ollamaPool struct {
+	mu        sync.RWMutex
+	endpoints []*ollamaEndpoint
+	next      atomic.Uint64
+}
+
+var ollamaEndpoints = &ollamaPool{}
+
+// setURLs replaces the endpoints, keeping the state of those still listed
+func (p *ollamaPool) setURLs(urls []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	endpoints := make([]*ollamaEndpoint, 0, len(urls))
+	for _, u := range urls {
+		i := slices.IndexFunc(p.endpoints, func(e *ollamaEndpoint) bool { return e.URL == u })
+		if i >= 0 {
+			endpoints = append(endpoints, p.endpoints[i])
+			continue
+		}
+		// New endpoints are tried until a health check says otherwise
+		endpoints = append(endpoints, &ollamaEndpoint{URL: u, healthy: true})
+	}
+	p.endpoints = endpoints
+}
+
+func (p *ollamaPool) all() []*ollamaEndpoint {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return slices.Clone(p.endpoints)
+}
+
+// order returns the endpoints to try for a model, best first: healthy endpoints
+// with the model loaded, then those known to have it, then other healthy ones,
+// then those that are down
+func (p *ollamaPool) order(model string) []*ollamaEndpoint {
+	endpoints := p.all()
+	if len(endpoints) == 0 {
+		return nil
+	}
+	// Rank and load are read once, as they change while sorting
+	type candidate struct {
+		endpoint *ollamaEndpoint
+		rank     int
+		load     int64
+	}
+	leastLoaded := getConfig().Ollama.Balancing == BalanceLeastLoaded
+	candidates := make([]candidate, len(endpoints))
+	for i, e := range endpoints {
+		c := candidate{endpoint: e, rank: 3}
+		if healthy, hasModel := e.serves(model); healthy && hasModel {
+			c.rank = 1
+			e.mu.Lock()
+			if e.isLoaded(model) {
+				c.rank = 0
+			}
+			e.mu.Unlock()
+		} else if healthy {
+			c.rank = 2
+		}
+		if leastLoaded {
+			c.load = e.inFlight.Load()
+		}
+		candidates[i] = c
+	}
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		if a.rank != b.rank {
+			return a.rank - b.rank
+		}
+		return int(a.load - b.load)
+	})
+	// Requests take turns among the endpoints tied for first place
+	tied := 1
+	for tied < len(candidates) && candidates[tied].rank == candidates[0].rank && candidates[tied].load == candidates[0].load {
+		tied++
+	}
+	turn := int(p.next.Add(1)-1) % tied
+	candidates = slices.Concat(candidates[turn:tied], candidates[:turn], candidates[tied:])
+	for i, c := range candidates {
+		endpoints[i] = c.endpoint
+	}
+	return endpoints
+}
+
+// do runs call against the endpoints in turn until one succeeds. Connection
+// failures and 5xx responses mark an endpoint down; those, 429s and missing
+// models move on to the next endpoint. The last error is returned when all fail.
+// A call that would swap out a model in use waits for it first; see waitForSwap.
+func (p *ollamaPool) do(ctx context.Context, model string, call func(e *ollamaEndpoint) error) error {
+	endpoints := p.order(model)
+	if len(endpoints) == 0 {
+		return errors.New("no Ollama endpoints configured")
+	}
+	var err error
+	for _, e := range endpoints {
+		waitForSwap(ctx, e, model)
+		e.begin(model)
+		err = call(e)
+		e.end(model, err == nil)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		var statusErr ollamaHTTPError
+		switch {
+		case errors.As(err, &statusErr) && statusErr.Status == http.StatusNotFound,
+			errors.As(err, &statusErr) && statusErr.Status == http.StatusTooManyRequests:
+		case isTransient(err):
+			log.Printf("Ollama endpoint %s failed, marking it down: %v", e.URL, err)
+			e.setHealth(false, nil, err)
+		default:
+			return err
+		}
+	}
+	return err
+}
+
+// check asks an endpoint for its models, which also tells whether it is up
+func (e *ollamaEndpoint) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), ollamaHealthTimeout)
+	defer cancel()
+	models, err := fetchOllamaModels(ctx, e)
+	e.mu.Lock()
+	wasHealthy := e.healthy
+	e.mu.Unlock()
+	if err != nil {
+		if wasHealthy {
+			log.Printf("Ollama endpoint %s is down: %v", e.URL, err)
+		}
+		e.setHealth(false, nil, err)
+		return
+	}
+	if !wasHealthy {
+		log.Printf("Ollama endpoint %s is back up", e.URL)
+	}
+	e.setHealth(true, models, nil)
+
+	loaded, err := fetchOllamaLoaded(ctx, e)
+	if err != nil {
+		log.Printf("Failed to list the loaded models of %s: %v", e.URL, err)
+	}
+	e.setLoaded(loaded)
+}
+
+// runOllamaHealthChecks checks every endpoint at the configured interval
+func runOllamaHealthChecks() {
+	for {
+		if !usingMockProvider() {
+			var wg sync.WaitGroup
+			for _, e := range ollamaEndpoints.all() {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					e.check()
+				}()
+			}
+			wg.Wait()
+		}
+		time.Sleep(time.Duration(getConfig().Ollama.HealthInterval))
+	}
+}
+
+// ollamaModel is a model an endpoint has pulled
+type ollamaModel struct {
+	Name string
+	Size int64 // Bytes on disk, close to what it takes in memory
+}
+
+// fetchOllamaModels lists the models an endpoint has pulled
+func fetchOllamaModels(ctx context.Context, e *ollamaEndpoint) ([]ollamaModel, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", e.api("/tags"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile(resp.Body, "models response body")
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Models []struct {
+			Name string `json:"name"`
+			Size int64  `json:"size"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	models := make([]ollamaModel, 0, len(result.Models))
+	for _, m := range result.Models {
+		models = append(models, ollamaModel{Name: m.Name, Size: m.Size})
+	}
+	return models, nil
+}
+
+// ollamaStatusHandler reports the Ollama endpoints and the queues of the
+// concurrency budgets (GET /api/admin/ollama)
+func ollamaStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "GET") || !requireAdmin(w, r) {
+		return
+	}
+	endpoints := ollamaEndpoints.all()
+	statuses := make([]OllamaEndpointStatus, 0, len(endpoints))
+	for _, e := range endpoints {
+		e.mu.Lock()
+		statuses = append(statuses, OllamaEndpointStatus{
+			URL:       e.URL,
+			Healthy:   e.healthy,
+			InFlight:  e.inFlight.Load(),
+			Models:    slices.Clone(e.models),
+			Loaded:    slices.Clone(e.loaded),
+			VRAMPeak:  e.vramPeak,
+			LastError: e.lastError,
+			CheckedAt: e.checkedAt,
+		})
+		e.mu.Unlock()
+	}
+	shared, budgets := concurrencyStats()
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"balancing": getConfig().Ollama.Balancing,
+		"endpoints": statuses,
+		"queue":     shared,
+		"budgets":   budgets,
+	})
+}
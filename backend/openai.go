@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// openAIProvider calls an OpenAI-compatible API: chat completions with the prompt
+// as the user message, embeddings and the model list
+type openAIProvider struct {
+	name   string
+	server OpenAIServer
+}
+
+// openAIUsage counts the tokens of a completion
+type openAIUsage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+}
+
+// openAICompletion is a chat completion, or one event of a streamed one
+type openAICompletion struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+}
+
+func (p openAIProvider) Generate(ctx context.Context, prompt, model string) (string, error) {
+	reqBody := map[string]interface{}{
+		"model":    model,
+		"messages": []map[string]string{{"role": "user", "content": prompt}},
+	}
+	// Ollama's options map to request fields of the same meaning
+	for name, value := range generationOptions(ctx) {
+		if name == "num_predict" {
+			name = "max_tokens"
+		}
+		reqBody[name] = value
+	}
+	if sink := tokenSinkOf(ctx); sink != nil {
+		return p.generateStreaming(ctx, reqBody, prompt, model, sink)
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout())
+	defer cancel()
+	resp, err := p.post(ctx, "/chat/completions", reqBody)
+	if err != nil {
+		return "", err
+	}
+	defer closeFile(resp.Body, "completion response body")
+
+	var result openAICompletion
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(result.Choices) == 0 {
+		return "", fmt.Errorf("invalid response format")
+	}
+	response := result.Choices[0].Message.Content
+	var tokens int64
+	if result.Usage != nil {
+		tokens = result.Usage.PromptTokens + result.Usage.CompletionTokens
+	}
+	meterTokens(ctx, tokens, prompt, response)
+	log.Printf("%s call completed in %v (model: %s)", p.name, time.Since(start), model)
+	return response, nil
+}
+
+// generateStreaming reads a streamed completion's server-sent events. Like
+// Ollama's streaming, the request timeout bounds the wait for each piece of text.
+func (p openAIProvider) generateStreaming(ctx context.Context, reqBody map[string]interface{}, prompt, model string, sink tokenSink) (string, error) {
+	start := time.Now()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	timeout := requestTimeout()
+	idle := time.AfterFunc(timeout, func() { cancel(errStreamIdle) })
+	defer idle.Stop()
+
+	reqBody["stream"] = true
+	reqBody["stream_options"] = map[string]bool{"include_usage": true}
+	var response strings.Builder
+	err := func() error {
+		resp, err := p.post(ctx, "/chat/completions", reqBody)
+		if err != nil {
+			return err
+		}
+		defer closeFile(resp.Body, "completion response body")
+
+		var usage *openAIUsage
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+		for scanner.Scan() {
+			idle.Reset(timeout)
+			data, isData := strings.CutPrefix(scanner.Text(), "data:")
+			data = strings.TrimSpace(data)
+			if !isData || data == "" {
+				continue
+			}
+			if data == "[DONE]" {
+				var tokens int64
+				if usage != nil {
+					tokens = usage.PromptTokens + usage.CompletionTokens
+				}
+				meterTokens(ctx, tokens, prompt, response.String())
+				log.Printf("%s call completed in %v (model: %s, streamed)", p.name, time.Since(start), model)
+				return nil
+			}
+			var part openAICompletion
+			if err := json.Unmarshal([]byte(data), &part); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+			if part.Usage != nil {
+				usage = part.Usage
+			}
+			for _, choice := range part.Choices {
+				if choice.Delta.Content != "" {
+					response.WriteString(choice.Delta.Content)
+					sink(choice.Delta.Content)
+				}
+			}
+		}
+		err = scanner.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return streamFailure(response.Len(), p.requestError(ctx, err))
+	}()
+	if errors.Is(context.Cause(ctx), errStreamIdle) {
+		err = errStreamIdle
+	}
+	return response.String(), err
+}
+
+func (p openAIProvider) Embed(ctx context.Context, text, model string) ([]float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout())
+	defer cancel()
+	resp, err := p.post(ctx, "/embeddings", map[string]interface{}{"model": model, "input": text})
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile(resp.Body, "embedding response body")
+
+	var result struct {
+		Data []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(result.Data) == 0 || len(result.Data[0].Embedding) == 0 {
+		return nil, fmt.Errorf("empty embedding returned by model %s", model)
+	}
+	return result.Data[0].Embedding, nil
+}
+
+func (p openAIProvider) ListModels(ctx context.Context) ([]string, error) {
+	req, err := p.request(ctx, "GET", "/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, p.requestError(ctx, err)
+	}
+	defer closeFile(resp.Body, "models response body")
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, p.statusError(resp.StatusCode, body)
+	}
+
+	var result struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	models := make([]string, 0, len(result.Data))
+	for _, m := range result.Data {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
+
+// post sends a JSON request and returns the response when it is a 200
+func (p openAIProvider) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	req, err := p.request(ctx, "POST", path, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, p.requestError(ctx, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer closeFile(resp.Body, "response body")
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, p.statusError(resp.StatusCode, bodyBytes)
+	}
+	return resp, nil
+}
+
+func (p openAIProvider) request(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(p.server.URL, "/")+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if p.server.APIKeyEnv != "" {
+		if key := os.Getenv(p.server.APIKeyEnv); key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+	}
+	return req, nil
+}
+
+// statusError describes a non-200 response, marking rate limiting and server
+// errors as transient
+func (p openAIProvider) statusError(status int, body []byte) error {
+	err := fmt.Errorf("%s error: status %d, body: %s", p.name, status, strings.TrimSpace(string(body)))
+	if status == http.StatusTooManyRequests || status >= 500 {
+		return transientError{err}
+	}
+	return err
+}
+
+// requestError wraps a failed request; it is transient unless ctx was cancelled
+func (p openAIProvider) requestError(ctx context.Context, err error) error {
+	err = fmt.Errorf("%s request failed: %w", p.name, err)
+	if ctx.Err() != nil {
+		return err
+	}
+	return transientError{err}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XML namespaces of the Word (.docx) and OpenDocument (.odt) elements read
+const (
+	wordNamespace      = "http://schemas.openxmlformats.org/wordprocessingml/2006/main"
+	odfTextNamespace   = "urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+	odfTableNamespace  = "urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+	odfOfficeNamespace = "urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+)
+
+var odfSpace = regexp.MustCompile(`[ \t\r\n]+`)
+
+// officeText collects the paragraphs of a word-processing document. Paragraphs
+// are separated by blank lines so paragraph chunking keeps them whole, headings
+// also go to the table of contents, and the rows of a table form one paragraph.
+type officeText struct {
+	paragraphs []string
+	toc        []TOCEntry
+	open       []*officeParagraph // Paragraphs being read; text boxes nest them
+	tableDepth int
+	rows       []string // Rows of the outermost table being read
+	row        []string // Cells of its current row
+	cell       []string // Paragraphs of its current cell
+}
+
+type officeParagraph struct {
+	text  strings.Builder
+	level int  // Heading level, 0 for body text
+	list  bool // List item
+}
+
+func (t *officeText) start() *officeParagraph {
+	p := &officeParagraph{}
+	t.open = append(t.open, p)
+	return p
+}
+
+func (t *officeText) current() *officeParagraph {
+	if len(t.open) == 0 {
+		return nil
+	}
+	return t.open[len(t.open)-1]
+}
+
+func (t *officeText) write(s string) {
+	if p := t.current(); p != nil {
+		p.text.WriteString(s)
+	}
+}
+
+func (t *officeText) end() {
+	p := t.current()
+	if p == nil {
+		return
+	}
+	t.open = t.open[:len(t.open)-1]
+	text := strings.TrimSpace(p.text.String())
+	switch {
+	case text == "":
+	case t.tableDepth > 0:
+		t.cell = append(t.cell, text)
+	case p.level > 0:
+		t.toc = append(t.toc, TOCEntry{Title: text, Level: p.level})
+		t.paragraphs = append(t.paragraphs, text)
+	case p.list:
+		t.paragraphs = append(t.paragraphs, "- "+text)
+	default:
+		t.paragraphs = append(t.paragraphs, text)
+	}
+}
+
+// Nested tables are read as text of the outer table's cells
+func (t *officeText) endCell() {
+	if t.tableDepth == 1 {
+		t.row = append(t.row, strings.Join(t.cell, " "))
+		t.cell = nil
+	}
+}
+
+func (t *officeText) endRow() {
+	if t.tableDepth == 1 {
+		if strings.Join(t.row, "") != "" {
+			t.rows = append(t.rows, markdownRow(t.row))
+		}
+		t.row = nil
+	}
+}
+
+func (t *officeText) endTable() {
+	t.tableDepth--
+	if t.tableDepth == 0 && len(t.rows) > 0 {
+		t.paragraphs = append(t.paragraphs, strings.Join(t.rows, "\n"))
+		t.rows = nil
+	}
+}
+
+func (t *officeText) extracted(meta DocumentMetadata) *ExtractedText {
+	return &ExtractedText{Text: strings.Join(t.paragraphs, "\n\n"), TOC: t.toc, Metadata: meta}
+}
+
+func xmlAttr(el xml.StartElement, local string) string {
+	for _, a := range el.Attr {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// openZipPackage opens a zip-based document and indexes its parts by name
+func openZipPackage(filePath string) (*zip.ReadCloser, map[string]*zip.File, error) {
+	zr, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open document: %w", err)
+	}
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	return zr, files, nil
+}
+
+// officeDate reads the day of an ISO 8601 timestamp from document properties
+func officeDate(value string) *time.Time {
+	if len(value) < 10 {
+		return nil
+	}
+	t, err := time.Parse("2006-01-02", value[:10])
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// headingLevel reads the level of a heading style, by name ("heading 2") or ID
+// ("Heading2"); the title style counts as a first-level heading
+func headingLevel(style string) int {
+	style = strings.ReplaceAll(strings.ToLower(style), " ", "")
+	if style == "title" {
+		return 1
+	}
+	if !strings.HasPrefix(style, "heading") {
+		return 0
+	}
+	if level, err := strconv.Atoi(strings.TrimPrefix(style, "heading")); err == nil && level >= 1 && level <= 9 {
+		return level
+	}
+	return 0
+}
+
+// docxHeadingStyles maps the IDs of a .docx file's heading styles to their level.
+// Styles are looked up by name, as IDs are localized, or by outline level.
+func docxHeadingStyles(files map[string]*zip.File) map[string]int {
+	var styles struct {
+		Styles []struct {
+			ID   string `xml:"styleId,attr"`
+			Name struct {
+				Val string `xml:"val,attr"`
+			} `xml:"name"`
+			Outline *struct {
+				Val int `xml:"val,attr"`
+			} `xml:"pPr>outlineLvl"`
+		} `xml:"style"`
+	}
+	levels := make(map[string]int)
+	if _, exists := files["word/styles.xml"]; !exists {
+		return levels
+	}
+	if err := readZipXML(files, "word/styles.xml", &styles); err != nil {
+		return levels
+	}
+	for _, s := range styles.Styles {
+		if level := headingLevel(s.Name.Val); level > 0 {
+			levels[s.ID] = level
+		} else if s.Outline != nil && s.Outline.Val < 9 {
+			levels[s.ID] = s.Outline.Val + 1
+		}
+	}
+	return levels
+}
+
+// extractDOCXText reads the body of a Word .docx document. Heading styles form
+// the table of contents, list items are marked with "- ", table rows are written
+// as Markdown rows, and the title, author, subject and creation date come from
+// the document properties. Headers, footers, footnotes and deleted text are left out.
+func extractDOCXText(filePath string) (*ExtractedText, error) {
+	zr, files, err := openZipPackage(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	styles := docxHeadingStyles(files)
+	rc, err := openZipPart(files, "word/document.xml")
+	if err != nil {
+		return nil, fmt.Errorf("invalid document: %w", err)
+	}
+	defer rc.Close()
+
+	var out officeText
+	inRun, inText := false, false
+	dec := xml.NewDecoder(rc)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid document: %w", err)
+		}
+		switch el := tok.(type) {
+		case xml.StartElement:
+			if el.Name.Space != wordNamespace {
+				continue
+			}
+			p := out.current()
+			switch el.Name.Local {
+			case "p":
+				out.start()
+			case "pStyle":
+				if p != nil {
+					style := xmlAttr(el, "val")
+					if level, known := styles[style]; known {
+						p.level = level
+					} else if level := headingLevel(style); level > 0 {
+						p.level = level
+					}
+				}
+			case "outlineLvl":
+				if level, err := strconv.Atoi(xmlAttr(el, "val")); p != nil && err == nil && level < 9 {
+					p.level = level + 1
+				}
+			case "numPr":
+				if p != nil {
+					p.list = true
+				}
+			case "r":
+				inRun = true
+			case "t":
+				inText = true
+			case "tab":
+				// Tab stops in paragraph properties share the element name
+				if inRun {
+					out.write("\t")
+				}
+			case "br", "cr":
+				if inRun {
+					out.write("\n")
+				}
+			case "tbl":
+				out.tableDepth++
+			}
+		case xml.EndElement:
+			if el.Name.Space != wordNamespace {
+				continue
+			}
+			switch el.Name.Local {
+			case "p":
+				out.end()
+			case "r":
+				inRun = false
+			case "t":
+				inText = false
+			case "tc":
+				out.endCell()
+			case "tr":
+				out.endRow()
+			case "tbl":
+				out.endTable()
+			}
+		case xml.CharData:
+			if inText {
+				out.write(string(el))
+			}
+		}
+	}
+
+	var meta DocumentMetadata
+	var core struct {
+		Title   string `xml:"title"`
+		Creator string `xml:"creator"`
+		Subject string `xml:"subject"`
+		Created string `xml:"created"`
+	}
+	if _, exists := files["docProps/core.xml"]; exists && readZipXML(files, "docProps/core.xml", &core) == nil {
+		meta = DocumentMetadata{
+			Title:   strings.TrimSpace(core.Title),
+			Author:  strings.TrimSpace(core.Creator),
+			Subject: strings.TrimSpace(core.Subject),
+			Date:    officeDate(core.Created),
+		}
+	}
+	return out.extracted(meta), nil
+}
+
+// extractODTText reads the body of an OpenDocument text (.odt) file, structured
+// like a .docx one: headings form the table of contents, list items are marked
+// with "- " and table rows are written as Markdown rows. Notes and tracked
+// deletions are left out.
+func extractODTText(filePath string) (*ExtractedText, error) {
+	zr, files, err := openZipPackage(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	rc, err := openZipPart(files, "content.xml")
+	if err != nil {
+		return nil, fmt.Errorf("invalid document: %w", err)
+	}
+	defer rc.Close()
+
+	var out officeText
+	inBody, listDepth := false, 0
+	dec := xml.NewDecoder(rc)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid document: %w", err)
+		}
+		switch el := tok.(type) {
+		case xml.StartElement:
+			if el.Name.Space == odfOfficeNamespace && el.Name.Local == "text" {
+				inBody = true
+			}
+			if !inBody {
+				continue
+			}
+			switch el.Name {
+			case xml.Name{Space: odfTextNamespace, Local: "p"}:
+				out.start().list = listDepth > 0
+			case xml.Name{Space: odfTextNamespace, Local: "h"}:
+				p := out.start()
+				if p.level, err = strconv.Atoi(xmlAttr(el, "outline-level")); err != nil || p.level < 1 {
+					p.level = 1
+				}
+			case xml.Name{Space: odfTextNamespace, Local: "s"}:
+				count, err := strconv.Atoi(xmlAttr(el, "c"))
+				if err != nil || count < 1 {
+					count = 1
+				}
+				out.write(strings.Repeat(" ", min(count, 100)))
+			case xml.Name{Space: odfTextNamespace, Local: "tab"}:
+				out.write("\t")
+			case xml.Name{Space: odfTextNamespace, Local: "line-break"}:
+				out.write("\n")
+			case xml.Name{Space: odfTextNamespace, Local: "list-item"}:
+				listDepth++
+			case xml.Name{Space: odfTextNamespace, Local: "tracked-changes"},
+				xml.Name{Space: odfTextNamespace, Local: "note"},
+				xml.Name{Space: odfTableNamespace, Local: "covered-table-cell"}:
+				if err := dec.Skip(); err != nil {
+					return nil, fmt.Errorf("invalid document: %w", err)
+				}
+			case xml.Name{Space: odfTableNamespace, Local: "table"}:
+				out.tableDepth++
+			}
+		case xml.EndElement:
+			if !inBody {
+				continue
+			}
+			switch el.Name {
+			case xml.Name{Space: odfTextNamespace, Local: "p"}, xml.Name{Space: odfTextNamespace, Local: "h"}:
+				out.end()
+			case xml.Name{Space: odfTextNamespace, Local: "list-item"}:
+				listDepth--
+			case xml.Name{Space: odfTableNamespace, Local: "table-cell"}:
+				out.endCell()
+			case xml.Name{Space: odfTableNamespace, Local: "table-row"}:
+				out.endRow()
+			case xml.Name{Space: odfTableNamespace, Local: "table"}:
+				out.endTable()
+			case xml.Name{Space: odfOfficeNamespace, Local: "text"}:
+				inBody = false
+			}
+		case xml.CharData:
+			// Runs of whitespace in OpenDocument text count as one space
+			if inBody {
+				out.write(odfSpace.ReplaceAllString(string(el), " "))
+			}
+		}
+	}
+
+	var meta DocumentMetadata
+	var props struct {
+		Title          string `xml:"meta>title"`
+		Subject        string `xml:"meta>subject"`
+		InitialCreator string `xml:"meta>initial-creator"`
+		Creator        string `xml:"meta>creator"`
+		Created        string `xml:"meta>creation-date"`
+	}
+	if _, exists := files["meta.xml"]; exists && readZipXML(files, "meta.xml", &props) == nil {
+		author := props.InitialCreator
+		if author == "" {
+			author = props.Creator
+		}
+		meta = DocumentMetadata{
+			Title:   strings.TrimSpace(props.Title),
+			Author:  strings.TrimSpace(author),
+			Subject: strings.TrimSpace(props.Subject),
+			Date:    officeDate(props.Created),
+		}
+	}
+	return out.extracted(meta), nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PDF pages are rendered with poppler's pdftoppm (or a compatible command)
+var (
+	pdfRenderCommand = getEnv("PDF_RENDER_COMMAND", "pdftoppm")
+	pdfRenderDPI     = getEnv("PDF_RENDER_DPI", "110")
+)
+
+// Rendered pages are cached next to the uploaded files
+var pageImageDir = filepath.Join("./documents", ".pages")
+
+// Serializes renders of the same page so concurrent requests don't race on the cache file
+var pageRenderLocks sync.Map
+
+func pageImagePath(docName string, page int) string {
+	return filepath.Join(pageImageDir, docName, fmt.Sprintf("%d.png", page))
+}
+
+// renderPDFPage renders one page to PNG, reusing a cached rendering when present
+func renderPDFPage(docName string, page int) (string, error) {
+	out := pageImagePath(docName, page)
+
+	lock, _ := pageRenderLocks.LoadOrStore(out, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	if _, err := os.Stat(out); err == nil {
+		return out, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return "", fmt.Errorf("failed to create page cache: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout())
+	defer cancel()
+
+	source, release, err := openStoredFile(filepath.Join("./documents", docName))
+	if err != nil {
+		return "", fmt.Errorf("failed to read document: %w", err)
+	}
+	defer release()
+
+	// pdftoppm appends ".png" to the output root when -singlefile is used
+	n := strconv.Itoa(page)
+	cmd := exec.CommandContext(ctx, pdfRenderCommand,
+		"-f", n, "-l", n, "-r", pdfRenderDPI, "-png", "-singlefile",
+		source, strings.TrimSuffix(out, ".png"))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("page render failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	// Rendered pages show the document's content, so they are encrypted like it
+	if storageCipher != nil {
+		data, err := os.ReadFile(out)
+		if err == nil {
+			err = writeStoredFile(out, data)
+		}
+		if err != nil {
+			_ = os.Remove(out)
+			return "", fmt.Errorf("failed to encrypt page image: %w", err)
+		}
+	}
+	return out, nil
+}
+
+func removePageImages(docName string) {
+	if err := os.RemoveAll(filepath.Join(pageImageDir, docName)); err != nil {
+		log.Printf("Warning: failed to remove page images for %s: %v", docName, err)
+	}
+}
+
+func handleGetPageImage(w http.ResponseWriter, r *http.Request, docName, pageStr string) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+
+	doc, ok := getDocumentOrError(w, docName)
+	if !ok {
+		return
+	}
+
+	if strings.ToLower(filepath.Ext(docName)) != ".pdf" {
+		sendError(w, http.StatusBadRequest, "Page images are only available for PDF documents")
+		return
+	}
+
+	page, err := strconv.Atoi(pageStr)
+	doc.mu.RLock()
+	pageCount := doc.PageCount
+	doc.mu.RUnlock()
+	if err != nil || page < 1 || page > pageCount {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("Page must be between 1 and %d", pageCount))
+		return
+	}
+
+	start := time.Now()
+	path, err := renderPDFPage(docName, page)
+	if err != nil {
+		log.Printf("Failed to render page %d of %s: %v", page, docName, err)
+		sendError(w, http.StatusInternalServerError, "Failed to render page")
+		return
+	}
+	log.Printf("Served page %d of %s in %v", page, docName, time.Since(start))
+
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	serveStoredFile(w, r, path)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// extractPDFMetadata reads the document info dictionary, filling gaps from XMP metadata
+func extractPDFMetadata(reader *pdf.Reader) (meta DocumentMetadata) {
+	// Malformed metadata objects make the PDF library panic; metadata is best effort
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Ignoring unreadable PDF metadata: %v", r)
+		}
+	}()
+
+	info := reader.Trailer().Key("Info")
+	meta.Title = strings.TrimSpace(info.Key("Title").Text())
+	meta.Author = strings.TrimSpace(info.Key("Author").Text())
+	meta.Subject = strings.TrimSpace(info.Key("Subject").Text())
+	meta.Date = parsePDFDate(info.Key("CreationDate").Text())
+
+	if meta.Title != "" && meta.Author != "" && meta.Subject != "" && meta.Date != nil {
+		return meta
+	}
+
+	stream := reader.Trailer().Key("Root").Key("Metadata")
+	if stream.IsNull() {
+		return meta
+	}
+	rc := stream.Reader()
+	defer closeFile(rc, "XMP metadata")
+
+	xmp := parseXMP(rc)
+	if meta.Title == "" {
+		meta.Title = xmp["title"]
+	}
+	if meta.Author == "" {
+		meta.Author = xmp["creator"]
+	}
+	if meta.Subject == "" {
+		meta.Subject = xmp["description"]
+	}
+	if meta.Date == nil {
+		if t, err := time.Parse(time.RFC3339, xmp["CreateDate"]); err == nil {
+			meta.Date = &t
+		} else if t, err := time.Parse("2006-01-02", xmp["CreateDate"]); err == nil {
+			meta.Date = &t
+		}
+	}
+	return meta
+}
+
+// parsePDFDate parses PDF date strings such as "D:20200115103000+01'00'"
+func parsePDFDate(value string) *time.Time {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "D:")
+	layouts := []string{"20060102150405", "200601021504", "2006010215", "20060102", "200601", "2006"}
+	for _, layout := range layouts {
+		if len(value) >= len(layout) {
+			if t, err := time.Parse(layout, value[:len(layout)]); err == nil {
+				return &t
+			}
+		}
+	}
+	return nil
+}
+
+// parseXMP collects the first text value of the Dublin Core / XMP properties we care about
+func parseXMP(r io.Reader) map[string]string {
+	wanted := map[string]bool{"title": true, "creator": true, "description": true, "CreateDate": true}
+	values := make(map[string]string)
+
+	decoder := xml.NewDecoder(r)
+	var current string
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if wanted[t.Name.Local] {
+				current = t.Name.Local
+			}
+		case xml.EndElement:
+			if t.Name.Local == current {
+				current = ""
+			}
+		case xml.CharData:
+			text := strings.TrimSpace(string(t))
+			if current != "" && text != "" && values[current] == "" {
+				values[current] = text
+			}
+		}
+	}
+	return values
+}
+
+// mergeMetadata lets values supplied at upload take precedence over extracted ones
+func mergeMetadata(supplied, extracted DocumentMetadata) DocumentMetadata {
+	if supplied.Title == "" {
+		supplied.Title = extracted.Title
+	}
+	if supplied.Author == "" {
+		supplied.Author = extracted.Author
+	}
+	if supplied.Subject == "" {
+		supplied.Subject = extracted.Subject
+	}
+	if supplied.Date == nil {
+		supplied.Date = extracted.Date
+	}
+	if len(supplied.Tags) == 0 {
+		supplied.Tags = extracted.Tags
+	}
+	for k, v := range extracted.Custom {
+		if _, exists := supplied.Custom[k]; !exists {
+			if supplied.Custom == nil {
+				supplied.Custom = make(map[string]string)
+			}
+			supplied.Custom[k] = v
+		}
+	}
+	return supplied
+}
+
+// metadataFilter builds a listing predicate from title/author/subject substring,
+// tag and from/to date query parameters
+func metadataFilter(r *http.Request) (func(*Document) bool, error) {
+	q := r.URL.Query()
+	title := strings.ToLower(q.Get("title"))
+	author := strings.ToLower(q.Get("author"))
+	subject := strings.ToLower(q.Get("subject"))
+	tag := q.Get("tag")
+
+	from, err := parseMetadataDate(q.Get("from"))
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseMetadataDate(q.Get("to"))
+	if err != nil {
+		return nil, err
+	}
+
+	return func(doc *Document) bool {
+		meta := doc.Metadata
+		if title != "" && !strings.Contains(strings.ToLower(meta.Title), title) {
+			return false
+		}
+		if author != "" && !strings.Contains(strings.ToLower(meta.Author), author) {
+			return false
+		}
+		if subject != "" && !strings.Contains(strings.ToLower(meta.Subject), subject) {
+			return false
+		}
+		if tag != "" && !hasTag(meta.Tags, tag) {
+			return false
+		}
+		if from != nil && (meta.Date == nil || meta.Date.Before(*from)) {
+			return false
+		}
+		if to != nil && (meta.Date == nil || meta.Date.After(*to)) {
+			return false
+		}
+		return true
+	}, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Layout of generated PDFs: US Letter with Courier, whose glyphs are all 0.6em
+// wide, so lines wrap at a fixed number of characters
+const (
+	pdfPageWidth    = 612
+	pdfPageHeight   = 792
+	pdfMargin       = 54
+	pdfFontSize     = 10
+	pdfLineHeight   = 13
+	pdfCharsPerLine = (pdfPageWidth - 2*pdfMargin) * 10 / (6 * pdfFontSize)
+	pdfLinesPerPage = (pdfPageHeight - 2*pdfMargin) / pdfLineHeight
+)
+
+// pdfLine is a line of a text PDF; bold lines are headings
+type pdfLine struct {
+	Text string
+	Bold bool
+}
+
+// renderTextPDF lays lines out on as many pages as they need, wrapping long lines.
+// Characters WinAnsi lacks are written as "?".
+func renderTextPDF(lines []pdfLine) []byte {
+	var wrapped []pdfLine
+	for _, line := range lines {
+		for _, text := range wrapLine(line.Text, pdfCharsPerLine) {
+			wrapped = append(wrapped, pdfLine{Text: text, Bold: line.Bold})
+		}
+	}
+	var pages [][]pdfLine
+	for len(wrapped) > pdfLinesPerPage {
+		pages = append(pages, wrapped[:pdfLinesPerPage])
+		wrapped = wrapped[pdfLinesPerPage:]
+	}
+	pages = append(pages, wrapped)
+
+	// Objects 1-4 are the catalog, page tree and fonts; each page adds a page
+	// object and its content stream
+	var objects []string
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>",
+	)
+	for i, page := range pages {
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT\n%d TL\n%d %d Td\n", pdfLineHeight, pdfMargin, pdfPageHeight-pdfMargin-pdfFontSize)
+		for _, line := range page {
+			font := "F1"
+			if line.Bold {
+				font = "F2"
+			}
+			fmt.Fprintf(&content, "/%s %d Tf\n(%s) '\n", font, pdfFontSize, pdfString(line.Text))
+		}
+		content.WriteString("ET")
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+				pdfPageWidth, pdfPageHeight, 6+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// wrapLine breaks text at spaces into lines of at most width characters, splitting
+// words longer than a line
+func wrapLine(text string, width int) []string {
+	var lines []string
+	var current []rune
+	for _, word := range strings.Fields(text) {
+		w := []rune(word)
+		if len(current) > 0 && len(current)+1+len(w) > width {
+			lines = append(lines, string(current))
+			current = nil
+		}
+		for len(w) > width {
+			lines = append(lines, string(w[:width]))
+			w = w[width:]
+		}
+		if len(current) > 0 {
+			current = append(current, ' ')
+		}
+		current = append(current, w...)
+	}
+	if len(current) > 0 || len(lines) == 0 {
+		lines = append(lines, string(current))
+	}
+	return lines
+}
+
+// Typographic characters WinAnsi places below 0xa0
+var winAnsiPunctuation = map[rune]byte{
+	'€': 0x80, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+}
+
+// pdfString encodes text as the body of a PDF literal string in WinAnsi
+func pdfString(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		if c, ok := winAnsiPunctuation[r]; ok {
+			fmt.Fprintf(&b, "\\%03o", c)
+			continue
+		}
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == utf8.RuneError || r < ' ' || r >= 0x7f && r < 0xa0 || r > 0xff:
+			b.WriteByte('?')
+		case r < 0x7f:
+			b.WriteRune(r)
+		default:
+			fmt.Fprintf(&b, "\\%03o", r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WAL record operations
+const (
+	walPut          = "put"
+	walDelete       = "delete"
+	walSummary      = "summary"
+	walEmbeddings   = "embeddings"
+	walInstructions = "instructions"
+	walArchive      = "archive"
+	walMetadata     = "metadata"
+)
+
+const (
+	snapshotFile     = "snapshot.jsonl"
+	walSegmentPrefix = "wal-"
+	walSegmentSuffix = ".jsonl"
+)
+
+// persistedDocument is the on-disk form of a document, including the derived state
+// that cannot be rebuilt from its exported fields
+type persistedDocument struct {
+	*Document
+	ID          string            `json:"id,omitempty"`
+	ChunkStarts []int             `json:"chunkStarts"`
+	NextChunkID int               `json:"nextChunkId"`
+	Vectors     []persistedVector `json:"vectors,omitempty"`
+}
+
+// walRecord is one logged change. Updates carry the ID of the document version
+// they apply to, so updates to a since-replaced document are ignored; records
+// written before versions had IDs carry its CreatedAt instead.
+type walRecord struct {
+	Op             string             `json:"op"`
+	Name           string             `json:"name"`
+	ID             string             `json:"id,omitempty"`
+	CreatedAt      time.Time          `json:"createdAt"`
+	Document       *persistedDocument `json:"document,omitempty"`
+	Value          string             `json:"value,omitempty"`   // Summary, instructions, archive time or metadata JSON
+	Version        int64              `json:"version,omitempty"` // Document version after the change
+	EmbeddingModel string             `json:"embeddingModel,omitempty"`
+	Vectors        []persistedVector  `json:"vectors,omitempty"`
+}
+
+// persistStore keeps the document store on disk as a snapshot plus numbered
+// write-ahead log segments. Every change is appended and fsynced before the
+// request that made it returns; compaction rotates to a new segment, writes a
+// fresh snapshot and then drops the segments the snapshot covers.
+type persistStore struct {
+	dir     string
+	wal     *os.File
+	segment int
+	records int
+	mu      sync.Mutex
+}
+
+// persistence is nil when PERSIST_DIR is empty; its methods are no-ops then
+var persistence *persistStore
+
+func newPutRecord(doc *Document) walRecord {
+	vectors := make([]persistedVector, len(doc.Embeddings))
+	for i, v := range doc.Embeddings {
+		vectors[i] = v.persisted()
+	}
+	return walRecord{
+		Op:        walPut,
+		Name:      doc.Name,
+		CreatedAt: doc.CreatedAt,
+		Document: &persistedDocument{
+			Document:    doc,
+			ID:          doc.id,
+			ChunkStarts: doc.chunkStarts,
+			NextChunkID: doc.nextChunkID,
+			Vectors:     vectors,
+		},
+	}
+}
+
+// updateRecord logs a change to one field of a stored document; callers hold the document lock
+func updateRecord(doc *Document, op, value string) walRecord {
+	rec := walRecord{Op: op, Name: doc.Name, ID: doc.id, CreatedAt: doc.CreatedAt, Value: value, Version: doc.Version}
+	if op == walEmbeddings {
+		rec.EmbeddingModel = doc.EmbeddingModel
+		rec.Vectors = make([]persistedVector, len(doc.Embeddings))
+		for i, v := range doc.Embeddings {
+			rec.Vectors[i] = v.persisted()
+		}
+	}
+	return rec
+}
+
+// restoreDocument rebuilds a document, including its indexes, from its persisted form
+func restoreDocument(p *persistedDocument) *Document {
+	doc := p.Document
+	doc.id = p.ID
+	doc.chunkStarts = p.ChunkStarts
+	doc.nextChunkID = p.NextChunkID
+	doc.textLower = strings.ToLower(doc.Text)
+	doc.wordIndex, doc.termFreqs = indexChunks(doc.Chunks)
+	doc.vocabulary = buildVocabulary(doc.wordIndex)
+	doc.importance = chunkImportance(doc)
+	doc.retrievalHits = make([]int64, len(doc.Chunks))
+	if doc.Version == 0 {
+		doc.Version = 1 // Stored before documents were versioned
+	}
+	if len(p.Vectors) > 0 {
+		doc.Embeddings = make([]QuantizedVector, len(p.Vectors))
+		for i, v := range p.Vectors {
+			doc.Embeddings[i] = v.vector()
+		}
+	}
+	return doc
+}
+
+// apply replays a record onto a document store without logging it again
+func (rec walRecord) apply(ds *DocumentStore) {
+	if rec.Op == walDelete {
+		ds.mu.Lock()
+		ds.remove(rec.Name)
+		ds.mu.Unlock()
+		return
+	}
+	if rec.Op == walPut {
+		if rec.Document == nil || rec.Document.Document == nil {
+			return
+		}
+		ds.mu.Lock()
+		ds.put(rec.Name, restoreDocument(rec.Document))
+		ds.mu.Unlock()
+		return
+	}
+
+	doc, exists := ds.Get(rec.Name)
+	if !exists {
+		return
+	}
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	if rec.ID != doc.id || (rec.ID == "" && !doc.CreatedAt.Equal(rec.CreatedAt)) {
+		return
+	}
+	if rec.Version > 0 {
+		doc.Version = rec.Version
+	}
+	switch rec.Op {
+	case walSummary:
+		doc.Summary, doc.HasSummary = rec.Value, true
+	case walInstructions:
+		doc.Instructions = rec.Value
+	case walArchive:
+		doc.ArchivedAt = nil
+		if at, err := time.Parse(time.RFC3339Nano, rec.Value); err == nil {
+			doc.ArchivedAt = &at
+		}
+	case walMetadata:
+		var meta DocumentMetadata
+		if err := json.Unmarshal([]byte(rec.Value), &meta); err == nil {
+			doc.Metadata = meta
+		}
+	case walEmbeddings:
+		doc.EmbeddingModel = rec.EmbeddingModel
+		doc.Embeddings = make([]QuantizedVector, len(rec.Vectors))
+		for i, v := range rec.Vectors {
+			doc.Embeddings[i] = v.vector()
+		}
+	}
+}
+
+// openPersistence loads the snapshot and WAL segments in dir into the document
+// store and opens a new segment for appending
+func openPersistence(dir string) (*persistStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	p := &persistStore{dir: dir}
+
+	replayed, _, err := replayFile(filepath.Join(dir, snapshotFile), documentStore, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	segments, err := walSegments(p.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range segments {
+		count, _, err := replayFile(walSegmentPath(p.dir, n), documentStore, 0)
+		if err != nil {
+			return nil, err
+		}
+		replayed += count
+		p.segment = n
+	}
+
+	if err := p.rotate(); err != nil {
+		return nil, err
+	}
+	p.records = len(segments) // Fold segments from earlier runs into the next snapshot
+	log.Printf("Loaded %d documents from %s (%d records replayed)", len(documentStore.All()), dir, replayed)
+	return p, nil
+}
+
+// replayFile applies the records of a snapshot or WAL segment from offset onwards
+// and returns how many were applied and the offset after the last complete line.
+// An unterminated final line, from a crash or an append in progress, is not applied.
+func replayFile(path string, ds *DocumentStore, offset int64) (int, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, offset, err
+	}
+	defer closeFile(file, path)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, offset, fmt.Errorf("failed to seek %s: %w", path, err)
+	}
+
+	reader := bufio.NewReader(file)
+	count := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return count, offset, nil
+		}
+		offset += int64(len(line))
+
+		var rec walRecord
+		data, err := openRecord(line)
+		if errors.Is(err, errNoEncryptionKey) || errors.Is(err, errDecrypt) {
+			// Skipping the records would drop their documents at the next compaction
+			return count, offset, fmt.Errorf("%s: %w", path, err)
+		}
+		if err == nil {
+			err = json.Unmarshal(data, &rec)
+		}
+		if err != nil {
+			log.Printf("Skipping unreadable record in %s: %v", path, err)
+			continue
+		}
+		rec.apply(ds)
+		count++
+	}
+}
+
+func walSegmentPath(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%06d%s", walSegmentPrefix, n, walSegmentSuffix))
+}
+
+// walSegments lists the numbers of the WAL segments in dir in order
+func walSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	var numbers []int
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, walSegmentPrefix) || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, walSegmentPrefix), walSegmentSuffix))
+		if err == nil {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+// rotate closes the current segment and starts the next one; callers hold p.mu
+// or have exclusive access
+func (p *persistStore) rotate() error {
+	if p.wal != nil {
+		closeFile(p.wal, p.wal.Name())
+	}
+	p.segment++
+	wal, err := os.OpenFile(walSegmentPath(p.dir, p.segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+	p.wal = wal
+	p.records = 0
+	return nil
+}
+
+// log appends a record and syncs it to disk
+func (p *persistStore) log(rec walRecord) {
+	if p == nil {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err == nil {
+		data, err = sealRecord(data)
+	}
+	if err != nil {
+		log.Printf("Failed to encode %s record for %s: %v", rec.Op, rec.Name, err)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.wal.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write %s record for %s: %v", rec.Op, rec.Name, err)
+		return
+	}
+	if err := p.wal.Sync(); err != nil {
+		log.Printf("Failed to sync write-ahead log: %v", err)
+	}
+	p.records++
+}
+
+// compact writes a snapshot of the store and removes the segments it replaces
+func (p *persistStore) compact() error {
+	p.mu.Lock()
+	if p.records == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	covered := p.segment
+	err := p.rotate()
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Records logged after the rotation may also be in the snapshot; replaying
+	// them again on startup is harmless because every record sets absolute values.
+	docs := documentStore.All()
+	if err := p.writeSnapshot(docs); err != nil {
+		return err
+	}
+	if err := p.dropSegments(covered); err != nil {
+		return err
+	}
+	log.Printf("Compacted store: snapshot of %d documents", len(docs))
+	return nil
+}
+
+// writeSnapshot replaces the snapshot with put records of docs
+func (p *persistStore) writeSnapshot(docs []*Document) error {
+	tmpPath := filepath.Join(p.dir, snapshotFile+".tmp")
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, doc := range docs {
+		var data []byte
+		doc.mu.RLock()
+		data, err = json.Marshal(newPutRecord(doc))
+		doc.mu.RUnlock()
+		if err == nil {
+			data, err = sealRecord(data)
+		}
+		if err == nil {
+			_, err = writer.Write(append(data, '\n'))
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeFile(tmp, tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(p.dir, snapshotFile)); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	if dir, err := os.Open(p.dir); err == nil {
+		_ = dir.Sync()
+		closeFile(dir, p.dir)
+	}
+	return nil
+}
+
+// dropSegments removes the WAL segments up to covered, which a snapshot replaces
+func (p *persistStore) dropSegments(covered int) error {
+	segments, err := walSegments(p.dir)
+	if err != nil {
+		return err
+	}
+	for _, n := range segments {
+		if n <= covered {
+			if err := os.Remove(walSegmentPath(p.dir, n)); err != nil {
+				log.Printf("Failed to remove WAL segment %d: %v", n, err)
+			}
+		}
+	}
+	return nil
+}
+
+// runCompaction compacts the log periodically
+func (p *persistStore) runCompaction(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := p.compact(); err != nil {
+			log.Printf("Compaction failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+// persistTestDocument is a small document as ingestion would store it
+func persistTestDocument(name, text string) *Document {
+	chunks, starts := chunkWithOptions(text, ChunkOptions{Size: 40})
+	return &Document{
+		Name:        name,
+		Text:        text,
+		Chunks:      chunks,
+		ChunkCount:  len(chunks),
+		chunkStarts: starts,
+		ContentSize: len(text),
+		CreatedAt:   time.Now(),
+	}
+}
+
+// openTestPersistence starts the document store and its log afresh from dir, as
+// a restart does, and restores both when the test ends
+func openTestPersistence(t *testing.T, dir string) *persistStore {
+	t.Helper()
+	savedStore, savedPersistence := documentStore, persistence
+	t.Cleanup(func() { documentStore, persistence = savedStore, savedPersistence })
+
+	documentStore = NewDocumentStore()
+	p, err := openPersistence(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeFile(p.wal, p.wal.Name()) })
+	persistence = p
+	return p
+}
+
+func storedNames() map[string]bool {
+	names := make(map[string]bool)
+	for _, doc := range documentStore.All() {
+		names[doc.Name] = true
+	}
+	return names
+}
+
+func TestReplayTruncatedFinalLine(t *testing.T) {
+	dir := t.TempDir()
+	p := openTestPersistence(t, dir)
+	documentStore.Set("a.txt", persistTestDocument("a.txt", "The first document holds a few words."))
+	documentStore.Set("b.txt", persistTestDocument("b.txt", "The second document holds a few more words."))
+
+	// A crash part way through appending the next record leaves half a line
+	data, err := json.Marshal(newPutRecord(persistTestDocument("c.txt", "The third document never made it.")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := p.wal.Name()
+	if _, err := p.wal.Write(data[:len(data)/2]); err != nil {
+		t.Fatal(err)
+	}
+	complete, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := int64(bytes.LastIndexByte(complete, '\n') + 1)
+
+	count, offset, err := replayFile(path, NewDocumentStore(), 0)
+	if err != nil || count != 2 || offset != end {
+		t.Fatalf("replayFile = %d records up to %d, %v; want 2 up to %d", count, offset, err, end)
+	}
+
+	openTestPersistence(t, dir)
+	if names := storedNames(); len(names) != 2 || !names["a.txt"] || !names["b.txt"] {
+		t.Fatalf("restored %v, want a.txt and b.txt", names)
+	}
+	doc, _ := documentStore.Get("b.txt")
+	if len(doc.wordIndex) == 0 || doc.Version != 1 {
+		t.Errorf("b.txt restored without its index or at version %d", doc.Version)
+	}
+
+	// Records logged after the restart land in a new segment and replay too
+	documentStore.Set("c.txt", persistTestDocument("c.txt", "The third document, uploaded again."))
+	openTestPersistence(t, dir)
+	if names := storedNames(); len(names) != 3 {
+		t.Errorf("restored %v, want a.txt, b.txt and c.txt", names)
+	}
+}
+
+func TestDeleteAfterSnapshotRotation(t *testing.T) {
+	dir := t.TempDir()
+	p := openTestPersistence(t, dir)
+	documentStore.Set("a.txt", persistTestDocument("a.txt", "Deleted while the snapshot is written."))
+	documentStore.Set("b.txt", persistTestDocument("b.txt", "Kept through the compaction."))
+
+	// Compaction rotates, then snapshots the documents it listed. A delete logged
+	// in between goes to the new segment while the snapshot still has the document.
+	p.mu.Lock()
+	covered := p.segment
+	err := p.rotate()
+	p.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := documentStore.All()
+	if !documentStore.Delete("a.txt") {
+		t.Fatal("a.txt was not stored")
+	}
+	if err := p.writeSnapshot(listed); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.dropSegments(covered); err != nil {
+		t.Fatal(err)
+	}
+	if segments, _ := walSegments(dir); len(segments) != 1 || segments[0] != covered+1 {
+		t.Fatalf("segments %v remain, want only %d", segments, covered+1)
+	}
+
+	openTestPersistence(t, dir)
+	if names := storedNames(); len(names) != 1 || !names["b.txt"] {
+		t.Fatalf("restored %v, want only b.txt", names)
+	}
+
+	// A full compaction of the restored store keeps the delete
+	if err := persistence.compact(); err != nil {
+		t.Fatal(err)
+	}
+	openTestPersistence(t, dir)
+	if names := storedNames(); len(names) != 1 || !names["b.txt"] {
+		t.Errorf("restored %v after compaction, want only b.txt", names)
+	}
+}
+
+func TestLateUpdatesToReplacedVersion(t *testing.T) {
+	dir := t.TempDir()
+	openTestPersistence(t, dir)
+	old := persistTestDocument("a.txt", "The version that is reprocessed.")
+	documentStore.Set("a.txt", old)
+
+	// An update logged before the swap but replayed after it, as a record
+	// written by a slow request would be
+	old.mu.Lock()
+	stale := updateRecord(old, walSummary, "Describes the old version.")
+	old.mu.Unlock()
+
+	// The new version keeps the creation time, so only the version ID tells
+	// the two apart
+	updated := persistTestDocument("a.txt", "The reprocessed version.")
+	updated.CreatedAt = old.CreatedAt
+	if err := documentStore.Replace("a.txt", old, updated, func(doc, previous *Document) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	persistence.log(stale)
+
+	// Background work finishing on the old version is dropped
+	old.SetEmbeddings("test-model", []QuantizedVector{quantizeVector([]float64{1, 0})})
+	old.UpdateSummary("Also describes the old version.")
+	if old.HasSummary || len(old.Embeddings) != 0 {
+		t.Error("the replaced version took the late updates")
+	}
+
+	openTestPersistence(t, dir)
+	doc, exists := documentStore.Get("a.txt")
+	if !exists || doc.Text != "The reprocessed version." {
+		t.Fatalf("restored %+v, want the reprocessed version", doc)
+	}
+	if doc.HasSummary || len(doc.Embeddings) != 0 || doc.EmbeddingModel != "" {
+		t.Errorf("the reprocessed version was restored with the old version's summary %q or %d embeddings", doc.Summary, len(doc.Embeddings))
+	}
+
+	// Updates to the restored version still apply after another restart
+	doc.UpdateSummary("Describes the reprocessed version.")
+	openTestPersistence(t, dir)
+	if doc, _ := documentStore.Get("a.txt"); doc.Summary != "Describes the reprocessed version." {
+		t.Errorf("summary %q after a restart, want the reprocessed version's", doc.Summary)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Preprocessing rule types
+const (
+	RuleRegexRemove        = "regex_remove"
+	RuleRegexReplace       = "regex_replace"
+	RuleStripRepeatedLines = "strip_repeated_lines"
+	RuleUnwrapLines        = "unwrap_lines"
+)
+
+// PreprocessRule is a text transformation applied to extracted text before chunking
+type PreprocessRule struct {
+	Name        string `json:"name,omitempty"`
+	Type        string `json:"type"`
+	Pattern     string `json:"pattern,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+	MinRepeats  int    `json:"minRepeats,omitempty"` // strip_repeated_lines threshold (default 3)
+}
+
+// RuleResult reports how much a rule changed the text
+type RuleResult struct {
+	Rule    string `json:"rule"`
+	Changes int    `json:"changes"`
+}
+
+type compiledRule struct {
+	label string
+	apply func(string) (string, int)
+}
+
+var digitsPattern = regexp.MustCompile(`\d+`)
+
+// compileRules validates rules and prepares them for repeated application
+func compileRules(rules []PreprocessRule) ([]compiledRule, error) {
+	compiled := make([]compiledRule, 0, len(rules))
+	for i, rule := range rules {
+		label := rule.Name
+		if label == "" {
+			label = fmt.Sprintf("%d:%s", i+1, rule.Type)
+		}
+
+		switch rule.Type {
+		case RuleRegexRemove, RuleRegexReplace:
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: invalid pattern: %w", label, err)
+			}
+			replacement := ""
+			if rule.Type == RuleRegexReplace {
+				replacement = rule.Replacement
+			}
+			compiled = append(compiled, compiledRule{label, func(text string) (string, int) {
+				n := len(re.FindAllStringIndex(text, -1))
+				if n == 0 {
+					return text, 0
+				}
+				return re.ReplaceAllString(text, replacement), n
+			}})
+
+		case RuleStripRepeatedLines:
+			minRepeats := rule.MinRepeats
+			if minRepeats <= 0 {
+				minRepeats = 3
+			}
+			compiled = append(compiled, compiledRule{label, func(text string) (string, int) {
+				return stripRepeatedLines(text, minRepeats)
+			}})
+
+		case RuleUnwrapLines:
+			compiled = append(compiled, compiledRule{label, unwrapLines})
+
+		default:
+			return nil, fmt.Errorf("rule %s: unknown type %q", label, rule.Type)
+		}
+	}
+	return compiled, nil
+}
+
+// applyPreprocessRules runs rules in order and reports per-rule change counts
+func applyPreprocessRules(text string, rules []compiledRule) (string, []RuleResult) {
+	results := make([]RuleResult, 0, len(rules))
+	for _, rule := range rules {
+		var changes int
+		text, changes = rule.apply(text)
+		results = append(results, RuleResult{Rule: rule.label, Changes: changes})
+	}
+	return text, results
+}
+
+// stripRepeatedLines removes boilerplate such as running headers, footers and
+// confidentiality notices: lines that recur at least minRepeats times.
+// Digits are ignored when comparing lines so "Page 3 of 10" matches "Page 4 of 10".
+func stripRepeatedLines(text string, minRepeats int) (string, int) {
+	lines := strings.Split(text, "\n")
+	key := func(line string) string {
+		return digitsPattern.ReplaceAllString(strings.TrimSpace(strings.Trim(line, pageSeparator)), "#")
+	}
+
+	counts := make(map[string]int)
+	for _, line := range lines {
+		if k := key(line); k != "" && k != "#" {
+			counts[k]++
+		}
+	}
+
+	kept := make([]string, 0, len(lines))
+	removed := 0
+	for _, line := range lines {
+		if counts[key(line)] >= minRepeats {
+			removed++
+			// Keep page boundaries even when the header line carrying them is dropped
+			if strings.Contains(line, pageSeparator) {
+				kept = append(kept, pageSeparator)
+			}
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\n"), removed
+}
+
+// unwrapLines rejoins hard-wrapped lines within paragraphs and
+// de-hyphenates words split across lines. Blank lines and page breaks are kept.
+func unwrapLines(text string) (string, int) {
+	runes := []rune(text)
+	out := make([]rune, 0, len(runes))
+	sep := []rune(pageSeparator)[0]
+	joined := 0
+
+	for i, r := range runes {
+		if r != '\n' || i == 0 || i == len(runes)-1 {
+			out = append(out, r)
+			continue
+		}
+
+		prev, next := runes[i-1], runes[i+1]
+		if prev == '\n' || next == '\n' || prev == sep || next == sep {
+			out = append(out, r)
+			continue
+		}
+
+		joined++
+		if prev == '-' && i >= 2 && unicode.IsLetter(runes[i-2]) && unicode.IsLower(next) {
+			// "exam-\nple" -> "example"
+			out = out[:len(out)-1]
+			continue
+		}
+		out = append(out, ' ')
+	}
+	return string(out), joined
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProcessingPreset is a named set of ingestion settings chosen at upload with the
+// preset form field. Settings given explicitly with the upload win over the
+// preset, and the preset wins over the collection's settings. Its preprocessing
+// rules run after the collection's.
+type ProcessingPreset struct {
+	Name            string           `json:"name"`
+	Description     string           `json:"description,omitempty"`
+	Chunking        ChunkOptions     `json:"chunking"`
+	PreprocessRules []PreprocessRule `json:"preprocessRules,omitempty"`
+	Instructions    string           `json:"instructions,omitempty"`
+	GenerateSummary bool             `json:"generateSummary,omitempty"`
+	SummaryType     string           `json:"summaryType,omitempty"`
+	ModelName       string           `json:"modelName,omitempty"` // Model for the summary
+	EmbeddingModel  string           `json:"embeddingModel,omitempty"`
+	BuiltIn         bool             `json:"builtIn"`
+	CreatedAt       time.Time        `json:"createdAt"`
+	UpdatedAt       time.Time        `json:"updatedAt"`
+	rules           []compiledRule   // Compiled PreprocessRules
+}
+
+// builtInPresets are available from startup; they can be replaced or deleted
+var builtInPresets = []ProcessingPreset{
+	{
+		Name:        "contract",
+		Description: "Contracts and agreements: whole clauses per chunk, running headers and footers removed, detailed summary",
+		Chunking:    ChunkOptions{Strategy: ChunkParagraph, Size: 1200, Overlap: 20},
+		PreprocessRules: []PreprocessRule{
+			{Name: "headers-footers", Type: RuleStripRepeatedLines},
+		},
+		Instructions:    "When citing terms, give the clause or section number.",
+		GenerateSummary: true,
+		SummaryType:     "Detailed",
+	},
+	{
+		Name:        "research-paper",
+		Description: "Papers and reports: hard-wrapped lines joined, sentence chunks with overlap, detailed summary",
+		Chunking:    ChunkOptions{Strategy: ChunkSentence, Size: 1000, Overlap: 30},
+		PreprocessRules: []PreprocessRule{
+			{Name: "headers-footers", Type: RuleStripRepeatedLines},
+			{Name: "unwrap", Type: RuleUnwrapLines},
+		},
+		GenerateSummary: true,
+		SummaryType:     "Detailed",
+	},
+	{
+		Name:        "meeting-transcript",
+		Description: "Meeting transcripts: filler words removed, small sentence chunks, brief summary",
+		Chunking:    ChunkOptions{Strategy: ChunkSentence, Size: 800, Overlap: 40},
+		PreprocessRules: []PreprocessRule{
+			{Name: "fillers", Type: RuleRegexRemove, Pattern: `(?i)\b(?:um+|uh+|erm|you know),?\s+`},
+		},
+		Instructions:    "Attribute statements and decisions to the speaker who made them.",
+		GenerateSummary: true,
+		SummaryType:     "Brief",
+	},
+}
+
+// PresetStore holds processing presets by name
+type PresetStore struct {
+	presets map[string]*ProcessingPreset
+	mu      sync.RWMutex
+}
+
+// NewPresetStore returns a store holding the built-in presets
+func NewPresetStore() *PresetStore {
+	ps := &PresetStore{presets: make(map[string]*ProcessingPreset)}
+	now := time.Now()
+	for _, p := range builtInPresets {
+		rules, err := compileRules(p.PreprocessRules)
+		if err != nil {
+			panic(fmt.Sprintf("built-in preset %s: %v", p.Name, err))
+		}
+		p.rules = rules
+		p.BuiltIn = true
+		p.CreatedAt, p.UpdatedAt = now, now
+		ps.presets[p.Name] = &p
+	}
+	return ps
+}
+
+func (ps *PresetStore) Get(name string) (*ProcessingPreset, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	p, exists := ps.presets[name]
+	return p, exists
+}
+
+func (ps *PresetStore) Set(p *ProcessingPreset) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.presets[p.Name] = p
+}
+
+func (ps *PresetStore) Delete(name string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, exists := ps.presets[name]; !exists {
+		return false
+	}
+	delete(ps.presets, name)
+	return true
+}
+
+func (ps *PresetStore) List() []*ProcessingPreset {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	result := make([]*ProcessingPreset, 0, len(ps.presets))
+	for _, p := range ps.presets {
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+var presetStore = NewPresetStore()
+
+// presetRules returns the compiled preprocessing rules of a preset, if any
+func presetRules(name string) []compiledRule {
+	if p, exists := presetStore.Get(name); exists {
+		return p.rules
+	}
+	return nil
+}
+
+// ingestRules returns the preprocessing rules for an ingestion: the collection's,
+// then the preset's
+func ingestRules(opts IngestOptions) []compiledRule {
+	collection, preset := collectionRules(opts.Collection), presetRules(opts.Preset)
+	if len(preset) == 0 {
+		return collection
+	}
+	return append(append([]compiledRule(nil), collection...), preset...)
+}
+
+// applyPreset fills the options left unset at upload from the named preset;
+// summarySet tells whether the upload chose generateSummary itself
+func applyPreset(opts IngestOptions, name string, summarySet bool) (IngestOptions, error) {
+	if name == "" {
+		return opts, nil
+	}
+	p, exists := presetStore.Get(name)
+	if !exists {
+		return opts, newAPIError(http.StatusBadRequest, fmt.Sprintf("Unknown preset %q", name))
+	}
+	opts.Preset = p.Name
+	if opts.Chunking.Strategy == "" {
+		opts.Chunking.Strategy = p.Chunking.Strategy
+	}
+	if opts.Chunking.Size == 0 {
+		opts.Chunking.Size = p.Chunking.Size
+	}
+	if opts.Chunking.Overlap == 0 {
+		opts.Chunking.Overlap = p.Chunking.Overlap
+	}
+	if opts.Instructions == "" {
+		opts.Instructions = p.Instructions
+	}
+	if !summarySet {
+		opts.GenerateSummary = p.GenerateSummary
+	}
+	if opts.SummaryType == "" {
+		opts.SummaryType = p.SummaryType
+	}
+	if opts.ModelName == "" {
+		opts.ModelName = p.ModelName
+	}
+	if opts.EmbeddingModel == "" {
+		opts.EmbeddingModel = p.EmbeddingModel
+	}
+	return opts, nil
+}
+
+// presetsHandler lists presets (GET) or creates/replaces one (POST)
+func presetsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && !validateMethod(w, r, "POST") {
+		return
+	}
+
+	if r.Method == "GET" {
+		sendJSON(w, http.StatusOK, map[string]interface{}{"presets": presetStore.List()})
+		return
+	}
+
+	var p ProcessingPreset
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" || strings.Contains(p.Name, "/") {
+		sendError(w, http.StatusBadRequest, "Invalid preset name")
+		return
+	}
+	if err := validateChunkOptions(p.Chunking); err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rules, err := compileRules(p.PreprocessRules)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p.Instructions = strings.TrimSpace(p.Instructions)
+	if err := instructionsTooLong(p.Instructions); err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	p.rules = rules
+	p.BuiltIn = false
+	p.UpdatedAt = time.Now()
+	p.CreatedAt = p.UpdatedAt
+	if previous, exists := presetStore.Get(p.Name); exists {
+		p.CreatedAt = previous.CreatedAt
+	}
+
+	presetStore.Set(&p)
+	sendJSON(w, http.StatusOK, &p)
+}
+
+// handlePresetByName returns (GET) or deletes (DELETE) a preset; documents
+// processed with it keep their chunks
+func handlePresetByName(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/preset/")
+	if r.Method == "DELETE" {
+		if !presetStore.Delete(name) {
+			sendError(w, http.StatusNotFound, "Preset not found")
+			return
+		}
+		sendJSON(w, http.StatusOK, map[string]string{"message": "Preset deleted"})
+		return
+	}
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+	p, exists := presetStore.Get(name)
+	if !exists {
+		sendError(w, http.StatusNotFound, "Preset not found")
+		return
+	}
+	sendJSON(w, http.StatusOK, p)
+}
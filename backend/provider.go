@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// LLM providers
+const (
+	ProviderOllama = "ollama"
+	ProviderOpenAI = "openai" // An OpenAI-compatible API: OpenAI, vLLM, LM Studio, OpenRouter...
+	ProviderMock   = "mock"
+)
+
+// LLMProvider is a backend answering model calls. Calls are made through
+// callOllamaContext and callOllamaEmbedding, which queue them on the concurrency
+// budgets and retry transient errors (see transientError); Generate sends the
+// text to the context's token sink as it is generated, when there is one.
+type LLMProvider interface {
+	Generate(ctx context.Context, prompt, model string) (string, error)
+	Embed(ctx context.Context, text, model string) ([]float64, error)
+	ListModels(ctx context.Context) ([]string, error)
+}
+
+var llmProviders = struct {
+	mu    sync.RWMutex
+	named map[string]LLMProvider
+}{named: map[string]LLMProvider{
+	ProviderOllama: ollamaProvider{},
+	ProviderMock:   mockProvider{},
+}}
+
+// RegisterLLMProvider makes a provider available under a name, for the provider
+// setting and for model names of the form name:model. It replaces a provider
+// registered or configured under the same name.
+func RegisterLLMProvider(name string, provider LLMProvider) {
+	llmProviders.mu.Lock()
+	defer llmProviders.mu.Unlock()
+	llmProviders.named[name] = provider
+}
+
+// lookupProvider returns the provider of a name: a registered one, or openai and
+// the OpenAI-compatible servers of the providers setting
+func lookupProvider(name string) (LLMProvider, bool) {
+	llmProviders.mu.RLock()
+	provider, exists := llmProviders.named[name]
+	llmProviders.mu.RUnlock()
+	if exists {
+		return provider, true
+	}
+	config := getConfig()
+	if name == ProviderOpenAI {
+		return openAIProvider{name: name, server: config.OpenAI}, true
+	}
+	if server, exists := config.Providers[name]; exists {
+		return openAIProvider{name: name, server: server}, true
+	}
+	return nil, false
+}
+
+// providerFor returns the provider answering calls for a model and the model's
+// name there. Models named provider:model go to that provider; Ollama tags such
+// as llama3:8b do not name one and, like other models, go to the configured
+// provider.
+func providerFor(model string) (LLMProvider, string) {
+	if name, rest, found := strings.Cut(model, ":"); found && rest != "" {
+		if provider, exists := lookupProvider(name); exists {
+			return provider, rest
+		}
+	}
+	if provider, exists := lookupProvider(getConfig().Provider); exists {
+		return provider, model
+	}
+	return ollamaProvider{}, model
+}
+
+// validateProviders checks the provider setting and the OpenAI-compatible servers.
+// Providers registered in code count as known.
+func validateProviders(c Config) error {
+	for name, server := range c.Providers {
+		if name == "" || strings.ContainsAny(name, ":/ ") || slices.Contains([]string{ProviderOllama, ProviderOpenAI, ProviderMock}, name) {
+			return fmt.Errorf("invalid provider name %q", name)
+		}
+		if err := server.validate(); err != nil {
+			return fmt.Errorf("provider %s: %w", name, err)
+		}
+	}
+	if c.Provider == ProviderOpenAI {
+		if err := c.OpenAI.validate(); err != nil {
+			return fmt.Errorf("openai: %w", err)
+		}
+	}
+	llmProviders.mu.RLock()
+	_, registered := llmProviders.named[c.Provider]
+	llmProviders.mu.RUnlock()
+	if _, configured := c.Providers[c.Provider]; !registered && !configured && c.Provider != ProviderOpenAI {
+		return fmt.Errorf("unknown provider %q (use ollama, openai, mock or a name from providers)", c.Provider)
+	}
+	return nil
+}
+
+// OpenAIServer is an OpenAI-compatible API. The key is read from an environment
+// variable so that it stays out of the config file and /api/admin/config.
+type OpenAIServer struct {
+	URL       string `json:"url"`                 // Base URL with the version, e.g. http://localhost:8000/v1
+	APIKeyEnv string `json:"apiKeyEnv,omitempty"` // Environment variable holding the API key, sent as a bearer token
+}
+
+func (s OpenAIServer) validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q", s.URL)
+	}
+	return nil
+}
+
+// ollamaProvider calls the Ollama servers of the pool
+type ollamaProvider struct{}
+
+// ListModels returns the models pulled on any reachable Ollama endpoint
+func (ollamaProvider) ListModels(ctx context.Context) ([]string, error) {
+	models := make([]string, 0)
+	reached := false
+	for _, endpoint := range ollamaEndpoints.all() {
+		pulled, err := fetchOllamaModels(ctx, endpoint)
+		if err != nil {
+			continue
+		}
+		reached = true
+		for _, m := range pulled {
+			if !slices.Contains(models, m.Name) {
+				models = append(models, m.Name)
+			}
+		}
+	}
+	if !reached {
+		return nil, errors.New("failed to connect to Ollama")
+	}
+	return models, nil
+}
+
+// mockProvider answers without a model; see MockConfig
+type mockProvider struct{}
+
+func (mockProvider) Generate(ctx context.Context, prompt, _ string) (string, error) {
+	response, err := mockGenerate(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	meterTokens(ctx, 0, prompt, response)
+	if sink := tokenSinkOf(ctx); sink != nil {
+		sink(response)
+	}
+	return response, nil
+}
+
+func (mockProvider) Embed(ctx context.Context, text, _ string) ([]float64, error) {
+	return mockEmbedding(ctx, text)
+}
+
+func (mockProvider) ListModels(context.Context) ([]string, error) {
+	return []string{mockModelName}, nil
+}
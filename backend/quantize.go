@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log"
+	"math"
+)
+
+// Embedding storage precisions
+const (
+	PrecisionInt8    = "int8"
+	PrecisionFloat16 = "float16"
+	PrecisionFloat32 = "float32"
+)
+
+// embeddingPrecision is how chunk vectors are kept in memory. int8 uses a quarter of
+// float32's memory (an eighth of float64's) at a small cost in ranking accuracy.
+var embeddingPrecision = func() string {
+	precision := getEnv("EMBEDDING_PRECISION", PrecisionInt8)
+	switch precision {
+	case PrecisionInt8, PrecisionFloat16, PrecisionFloat32:
+		return precision
+	}
+	log.Printf("Unknown EMBEDDING_PRECISION %q, using %s", precision, PrecisionInt8)
+	return PrecisionInt8
+}()
+
+// QuantizedVector is an embedding stored at reduced precision. Exactly one of the
+// value slices is set; int8 values are multiplied by scale to recover the vector.
+type QuantizedVector struct {
+	scale float32
+	norm  float32 // Euclidean norm of the stored (dequantized) vector
+	int8s []int8
+	halfs []uint16
+	full  []float32
+}
+
+// quantizeVector converts a vector to the configured storage precision
+func quantizeVector(vec []float64) QuantizedVector {
+	var q QuantizedVector
+	switch embeddingPrecision {
+	case PrecisionFloat32:
+		q.full = make([]float32, len(vec))
+		for i, v := range vec {
+			q.full[i] = float32(v)
+		}
+	case PrecisionFloat16:
+		q.halfs = make([]uint16, len(vec))
+		for i, v := range vec {
+			q.halfs[i] = float16Bits(float32(v))
+		}
+	default:
+		// Symmetric quantization: the largest magnitude maps to ±127
+		var maxAbs float64
+		for _, v := range vec {
+			maxAbs = math.Max(maxAbs, math.Abs(v))
+		}
+		q.int8s = make([]int8, len(vec))
+		if maxAbs > 0 {
+			q.scale = float32(maxAbs / 127)
+			for i, v := range vec {
+				q.int8s[i] = int8(math.Round(v / float64(q.scale)))
+			}
+		}
+	}
+
+	return q.withNorm()
+}
+
+func (q QuantizedVector) withNorm() QuantizedVector {
+	var sum float64
+	for i := 0; i < q.Dim(); i++ {
+		v := q.at(i)
+		sum += v * v
+	}
+	q.norm = float32(math.Sqrt(sum))
+	return q
+}
+
+// persistedVector is the on-disk form of a QuantizedVector
+type persistedVector struct {
+	Scale float32   `json:"s,omitempty"`
+	Int8  []int8    `json:"i,omitempty"`
+	Half  []uint16  `json:"h,omitempty"`
+	Full  []float32 `json:"f,omitempty"`
+}
+
+func (q QuantizedVector) persisted() persistedVector {
+	return persistedVector{Scale: q.scale, Int8: q.int8s, Half: q.halfs, Full: q.full}
+}
+
+func (p persistedVector) vector() QuantizedVector {
+	return QuantizedVector{scale: p.Scale, int8s: p.Int8, halfs: p.Half, full: p.Full}.withNorm()
+}
+
+// Dim returns the vector's dimension; zero means no vector
+func (q QuantizedVector) Dim() int {
+	return len(q.int8s) + len(q.halfs) + len(q.full)
+}
+
+func (q QuantizedVector) at(i int) float64 {
+	switch {
+	case q.int8s != nil:
+		return float64(q.int8s[i]) * float64(q.scale)
+	case q.halfs != nil:
+		return float64(float16Value(q.halfs[i]))
+	default:
+		return float64(q.full[i])
+	}
+}
+
+// Float64s dequantizes the vector
+func (q QuantizedVector) Float64s() []float64 {
+	vec := make([]float64, q.Dim())
+	for i := range vec {
+		vec[i] = q.at(i)
+	}
+	return vec
+}
+
+// cosineSimilarity compares two vectors of the same dimension, using an integer
+// dot product when both are int8
+func cosineSimilarity(a, b QuantizedVector) float64 {
+	if a.norm == 0 || b.norm == 0 {
+		return 0
+	}
+	var d float64
+	if a.int8s != nil && b.int8s != nil {
+		var sum int64
+		for i, v := range a.int8s {
+			sum += int64(v) * int64(b.int8s[i])
+		}
+		d = float64(sum) * float64(a.scale) * float64(b.scale)
+	} else {
+		for i := 0; i < a.Dim(); i++ {
+			d += a.at(i) * b.at(i)
+		}
+	}
+	return d / (float64(a.norm) * float64(b.norm))
+}
+
+// float16Bits converts to IEEE 754 half precision, rounding to nearest
+func float16Bits(f float32) uint16 {
+	b := math.Float32bits(f)
+	sign := uint16(b>>16) & 0x8000
+	exp := int((b>>23)&0xff) - 127 + 15
+	mant := b & 0x7fffff
+
+	switch {
+	case (b>>23)&0xff == 0xff: // Inf or NaN
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp >= 0x1f: // Too large, saturate to infinity
+		return sign | 0x7c00
+	case exp <= 0: // Subnormal or zero
+		if exp < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint(14 - exp)
+		half := uint16(mant >> shift)
+		if (mant>>(shift-1))&1 != 0 {
+			half++
+		}
+		return sign | half
+	}
+
+	half := sign | uint16(exp)<<10 | uint16(mant>>13)
+	if mant&0x1000 != 0 {
+		half++ // A carry into the exponent is still correct
+	}
+	return half
+}
+
+// float16Value converts IEEE 754 half precision bits to a float32
+func float16Value(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch exp {
+	case 0:
+		f := float32(mant) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+}
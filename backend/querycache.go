@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+type cacheDocumentKey struct{}
+
+// documentCacheContext files the answers cached under ctx with a document, so they
+// can be invalidated with it
+func documentCacheContext(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, cacheDocumentKey{}, name)
+}
+
+// documentCacheTag is the part of cache keys naming a document: a fixed-length
+// hash, so one document's prefix never matches another's keys
+func documentCacheTag(name string) string {
+	if name == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:8]) + ":"
+}
+
+func queryCacheKey(document, prompt, model string, deterministic bool, answerTokens int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%t\x00%d\x00%s", model, deterministic, answerTokens, prompt)))
+	return "query:" + documentCacheTag(document) + hex.EncodeToString(sum[:])
+}
+
+// cachedAnswer calls the model unless the same prompt was answered within
+// QueryCacheTTL and reports whether the answer came from the cache. The prompt holds
+// the retrieved chunks, summary and instructions, so a changed document never hits
+// a stale entry.
+func cachedAnswer(ctx context.Context, prompt, model string) (string, bool, error) {
+	ttl := time.Duration(getConfig().QueryCacheTTL)
+	if ttl == 0 {
+		answer, err := callOllamaContext(ctx, prompt, model)
+		return answer, false, err
+	}
+
+	document, _ := ctx.Value(cacheDocumentKey{}).(string)
+	key := queryCacheKey(document, prompt, model, isDeterministic(ctx), answerTokenLimit(ctx))
+	var answer string
+	if getJSON(key, &answer) {
+		return answer, true, nil
+	}
+	answer, err := callOllamaContext(ctx, prompt, model)
+	if err != nil {
+		return "", false, err
+	}
+	setJSON(key, answer, ttl)
+	return answer, false, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Question shapes, each answered by its own pipeline
+const (
+	QueryFactoid       = "factoid"       // Chunk retrieval
+	QuerySummarization = "summarization" // The document summary
+	QueryComparison    = "comparison"    // Chunks retrieved for each side of the comparison
+	QueryCalculation   = "calculation"   // More chunks, computed over as tables and figures
+	QueryNavigation    = "navigation"    // Sections and pages holding the best chunks, without the model
+)
+
+func validQueryType(queryType string) bool {
+	switch queryType {
+	case "", QueryFactoid, QuerySummarization, QueryComparison, QueryCalculation, QueryNavigation:
+		return true
+	}
+	return false
+}
+
+// queryShapes detect question shapes, checked in order
+var queryShapes = []struct {
+	queryType string
+	pattern   *regexp.Regexp
+}{
+	{QueryNavigation, regexp.MustCompile(`(?i)\b(?:where in (?:the|this)|where (?:is|are|does|do) .+ (?:discuss|mention|cover|describ|explain|defin|talk)\w*|(?:which|what) (?:sections?|chapters?|pages?)|on what page|point me to)\b`)},
+	{QuerySummarization, regexp.MustCompile(`(?i)\b(?:summar(?:y|ize|ise)|overview|gist|tl;?dr|main (?:points|ideas|themes|findings)|key (?:points|takeaways|findings)|what is (?:this|the) (?:document|paper|report|file|text) about)\b`)},
+	{QueryComparison, regexp.MustCompile(`(?i)\b(?:compare|comparison|versus|vs\.?|contrast|differen(?:ce|ces|t) between|similarit(?:y|ies) between|how does .+ differ)\b`)},
+	{QueryCalculation, regexp.MustCompile(`(?i)\b(?:how (?:many|much)|calculate|compute|count|percentage|ratio)\b`)},
+}
+
+// classifyQuery picks the shape of a question, factoid unless it reads as another
+func classifyQuery(query string) string {
+	for _, s := range queryShapes {
+		if s.pattern.MatchString(query) {
+			return s.queryType
+		}
+	}
+	if detectAggregation(query) != "" {
+		return QueryCalculation
+	}
+	return QueryFactoid
+}
+
+// queryType resolves the shape a query is answered as: the requested one, else
+// the classified one when routing is on
+func queryType(req QueryRequest) string {
+	if req.QueryType != "" {
+		return req.QueryType
+	}
+	if !getConfig().QueryRouting {
+		return QueryFactoid
+	}
+	return classifyQuery(req.Query)
+}
+
+// Chunks given as context per question shape
+func routeChunks(queryType string) int {
+	switch queryType {
+	case QueryCalculation:
+		return 6
+	case QuerySummarization:
+		return 5
+	}
+	return 3
+}
+
+// Words joining the sides of a comparison
+var comparisonSplit = regexp.MustCompile(`(?i)\s+(?:and|vs\.?|versus|with|to|or|differs? (?:from|to))\s+|,\s*`)
+
+// comparisonLead is what comes before the first side of a comparison
+var comparisonLead = regexp.MustCompile(`(?i)^.*?\b(?:compare|comparison of|contrast|between|how does|how do)\s+`)
+
+// comparisonSides splits a comparison into what is compared, e.g. "compare the
+// 2022 budget with the 2023 budget" into its two budgets; nil when it finds fewer
+// than two sides
+func comparisonSides(query string) []string {
+	rest := strings.TrimRight(comparisonLead.ReplaceAllString(query, ""), "?. ")
+	var sides []string
+	for _, side := range comparisonSplit.Split(rest, -1) {
+		if side = strings.TrimSpace(side); side != "" {
+			sides = append(sides, side)
+		}
+	}
+	if len(sides) < 2 {
+		return nil
+	}
+	return sides
+}
+
+// withSides adds the best keyword matches of each side of a comparison to the
+// retrieved chunks, so one side matching more words does not crowd out the other;
+// callers hold the document lock
+func withSides(doc *Document, query string, rank *chunkRanking, chunks []string, indices []int) ([]string, []int) {
+	for _, side := range comparisonSides(query) {
+		sideChunks, sideIndices, _ := keywordRetrieve(doc, side, rank, 2)
+		for i, idx := range sideIndices {
+			if !slices.Contains(indices, idx) {
+				chunks = append(chunks, sideChunks[i])
+				indices = append(indices, idx)
+			}
+		}
+	}
+	return chunks, indices
+}
+
+// spreadChunks picks n allowed chunks spread evenly over the document, for
+// summarizing one without a stored summary
+func spreadChunks(doc *Document, allowed chunkSet, n int) ([]string, []int) {
+	var candidates []int
+	for i := range doc.Chunks {
+		if allowed.has(i) {
+			candidates = append(candidates, i)
+		}
+	}
+	var chunks []string
+	var indices []int
+	for k := 0; k < min(n, len(candidates)); k++ {
+		idx := candidates[k*len(candidates)/min(n, len(candidates))]
+		chunks = append(chunks, doc.Chunks[idx])
+		indices = append(indices, idx)
+	}
+	return chunks, indices
+}
+
+// withComparison asks for the answer to go over the compared sides point by point
+func withComparison(prompt string) string {
+	return prompt + "\n\nCompare the items the question names point by point, saying for each point what the context gives for each of them and where it says nothing."
+}
+
+// navigationAnswer names the sections and pages holding the given chunks, or
+// returns "" when the document has neither; callers hold the document lock
+func navigationAnswer(doc *Document, indices []int) string {
+	var places []string
+	for _, idx := range indices {
+		var place string
+		if entry, ok := innermostSection(doc.TOC, idx); ok {
+			place = fmt.Sprintf("%q", entry.Title)
+		}
+		if idx < len(doc.ChunkPages) && doc.ChunkPages[idx] > 0 {
+			page := fmt.Sprintf("page %d", doc.ChunkPages[idx])
+			if place != "" {
+				page = place + ", " + page
+			}
+			place = page
+		}
+		if place != "" && !slices.Contains(places, place) {
+			places = append(places, place)
+		}
+	}
+	if len(places) == 0 {
+		return ""
+	}
+	return "This is covered in " + strings.Join(places, "; ") + "."
+}
+
+// innermostSection returns the deepest table of contents entry holding a chunk
+func innermostSection(toc []TOCEntry, chunk int) (TOCEntry, bool) {
+	var found TOCEntry
+	ok := false
+	for _, entry := range toc {
+		if chunk >= entry.ChunkStart && chunk < entry.ChunkEnd && (!ok || entry.Level >= found.Level) {
+			found, ok = entry, true
+		}
+	}
+	return found, ok
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type tokenSinkKey struct{}
+
+// tokenSink receives the text of an answer piece by piece as the model generates it
+type tokenSink func(text string)
+
+// errStreamIdle cancels a streamed generation that stopped sending text
+var errStreamIdle = errors.New("no response from the model within the request timeout")
+
+// streamingContext makes generation calls under ctx stream their text to sink
+func streamingContext(ctx context.Context, sink tokenSink) context.Context {
+	return context.WithValue(ctx, tokenSinkKey{}, sink)
+}
+
+func tokenSinkOf(ctx context.Context) tokenSink {
+	sink, _ := ctx.Value(tokenSinkKey{}).(tokenSink)
+	return sink
+}
+
+// takeTokenSink returns ctx without its sink, and the sink, so that only the call
+// generating the answer streams and not those classifying, verifying or rating it
+func takeTokenSink(ctx context.Context) (context.Context, tokenSink) {
+	sink := tokenSinkOf(ctx)
+	if sink == nil {
+		return ctx, nil
+	}
+	return streamingContext(ctx, nil), sink
+}
+
+// ollamaStreamPart is one line of a streamed Ollama response
+type ollamaStreamPart struct {
+	Response        string `json:"response"`
+	Done            bool   `json:"done"`
+	Error           string `json:"error"`
+	PromptEvalCount int64  `json:"prompt_eval_count"`
+	EvalCount       int64  `json:"eval_count"`
+}
+
+// generateStreaming is generateOnce in Ollama's streaming mode. The request timeout
+// bounds the wait for each piece of text rather than the whole answer, so long
+// answers are not cut off.
+func generateStreaming(ctx context.Context, prompt, model string, sink tokenSink) (string, error) {
+	start := time.Now()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	timeout := requestTimeout()
+
+	reqBody := map[string]interface{}{
+		"model":  model,
+		"prompt": prompt,
+		"stream": true,
+	}
+	if options := ollamaOptions(ctx, model); options != nil {
+		reqBody["options"] = options
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	var response strings.Builder
+	err = ollamaEndpoints.do(ctx, model, func(endpoint *ollamaEndpoint) error {
+		idle := time.AfterFunc(timeout, func() { cancel(errStreamIdle) })
+		defer idle.Stop()
+
+		req, err := http.NewRequestWithContext(ctx, "POST", endpoint.api("/generate"), bytes.NewBuffer(jsonData))
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return ollamaRequestError(ctx, err)
+		}
+		defer closeFile(resp.Body, "response body")
+
+		if resp.StatusCode != http.StatusOK {
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			return ollamaStatusError(resp.StatusCode, bodyBytes)
+		}
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+		for scanner.Scan() {
+			idle.Reset(timeout)
+			var part ollamaStreamPart
+			if err := json.Unmarshal(scanner.Bytes(), &part); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+			if part.Error != "" {
+				return streamFailure(response.Len(), transientError{fmt.Errorf("ollama error: %s", part.Error)})
+			}
+			if part.Response != "" {
+				response.WriteString(part.Response)
+				sink(part.Response)
+			}
+			if part.Done {
+				meterTokens(ctx, part.PromptEvalCount+part.EvalCount, prompt, response.String())
+				log.Printf("Ollama call completed in %v (model: %s, endpoint: %s, streamed)", time.Since(start), model, endpoint.URL)
+				return nil
+			}
+		}
+		err = scanner.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return streamFailure(response.Len(), ollamaRequestError(ctx, err))
+	})
+	if errors.Is(context.Cause(ctx), errStreamIdle) {
+		err = errStreamIdle
+	}
+	return response.String(), err
+}
+
+// streamFailure keeps a failure from being retried, or sent to another endpoint,
+// once part of the answer has reached the client
+func streamFailure(sent int, err error) error {
+	var t transientError
+	if sent > 0 && errors.As(err, &t) {
+		return t.err
+	}
+	return err
+}
+
+// queryDocumentStream answers like /api/document/query, sending the answer as
+// Server-Sent Events while the model generates it: `token` events carry pieces of
+// text, then `done` carries the whole response, sources included, or `error` a
+// failure. Requests failing before any text is sent get a plain error response.
+func queryDocumentStream(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+
+	var req QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	req.Tenant = tenant
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+	// Streamed answers may outlast the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to lift the write deadline for a streamed query: %v", err)
+	}
+
+	started, streamed := false, false
+	send := func(event string, data interface{}) {
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("X-Accel-Buffering", "no")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		payload, err := json.Marshal(data)
+		if err != nil {
+			log.Printf("Failed to encode %s event: %v", event, err)
+			return
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		flusher.Flush()
+	}
+
+	ctx := streamingContext(r.Context(), func(text string) {
+		streamed = true
+		send("token", map[string]string{"text": text})
+	})
+	resp, err := runQueryContext(ctx, req)
+	if err != nil {
+		if !started {
+			sendAPIError(w, err)
+			return
+		}
+		status := http.StatusInternalServerError
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			status = apiErr.Status
+		}
+		send("error", map[string]interface{}{"error": err.Error(), "status": status})
+		return
+	}
+
+	// Cached and navigation answers come whole
+	if !streamed && resp.Response != "" {
+		send("token", map[string]string{"text": resp.Response})
+	}
+	send("done", resp)
+}
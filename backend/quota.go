@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Days of usage kept for the usage endpoints
+const usageRetentionDays = 31
+
+// TenantSettings are a tenant's model defaults and daily limits. Days are UTC.
+type TenantSettings struct {
+	DefaultModel  string   `json:"defaultModel,omitempty"`  // Used when the tenant's requests name no model
+	AllowedModels []string `json:"allowedModels,omitempty"` // Models the tenant may use; empty allows any
+	DailyQueries  int64    `json:"dailyQueries,omitempty"`  // Queries per day; 0 is unlimited
+	DailyTokens   int64    `json:"dailyTokens,omitempty"`   // Prompt and generated tokens per day; 0 is unlimited
+
+	MaxUploadBytes  int64 `json:"maxUploadBytes,omitempty"`  // Largest upload request, all files together; 0 is unlimited
+	MaxQueryLength  int   `json:"maxQueryLength,omitempty"`  // Characters of a question; 0 is unlimited
+	MaxAnswerTokens int   `json:"maxAnswerTokens,omitempty"` // Tokens generated per answer; 0 leaves it to the model
+}
+
+// TenantConfig holds the settings of each tenant; tenants without an entry use
+// the server defaults without limits
+type TenantConfig map[string]TenantSettings
+
+func (c TenantConfig) validate() error {
+	for tenant, s := range c {
+		switch {
+		case !validTenant.MatchString(tenant):
+			return fmt.Errorf("invalid tenant name %q", tenant)
+		case s.DailyQueries < 0 || s.DailyTokens < 0:
+			return fmt.Errorf("tenants.%s: daily quotas cannot be negative", tenant)
+		case s.MaxUploadBytes < 0 || s.MaxQueryLength < 0 || s.MaxAnswerTokens < 0:
+			return fmt.Errorf("tenants.%s: size limits cannot be negative", tenant)
+		case s.DefaultModel != "" && len(s.AllowedModels) > 0 && !slices.Contains(s.AllowedModels, s.DefaultModel):
+			return fmt.Errorf("tenants.%s: defaultModel %q is not in allowedModels", tenant, s.DefaultModel)
+		}
+	}
+	return nil
+}
+
+// tenantSettings returns the settings of a tenant: those set through the admin
+// API, else those in CONFIG_FILE, else zero
+func tenantSettings(tenant string) TenantSettings {
+	if settings, overridden := tenantOverride(tenant); overridden {
+		return settings
+	}
+	return getConfig().Tenants[tenant]
+}
+
+// tenantOverride returns the settings set for a tenant through the admin API
+func tenantOverride(tenant string) (TenantSettings, bool) {
+	var settings TenantSettings
+	found := getJSON(tenantSettingsKey(tenant), &settings)
+	return settings, found
+}
+
+// tenantModel resolves the model a tenant's request uses: the requested one, else
+// the tenant's default, else the server's. Models outside the tenant's allowed
+// list are refused.
+func tenantModel(tenant, model string) (string, error) {
+	settings := tenantSettings(tenant)
+	if model == "" {
+		model = settings.DefaultModel
+	}
+	model = modelOrDefault(model)
+	if len(settings.AllowedModels) > 0 && !slices.Contains(settings.AllowedModels, model) {
+		return "", newAPIError(http.StatusForbidden, fmt.Sprintf("Model %q is not allowed for tenant %s", model, tenant))
+	}
+	return model, nil
+}
+
+// TenantUsage is what a tenant used on one day
+type TenantUsage struct {
+	Date    string `json:"date"` // YYYY-MM-DD, UTC
+	Queries int64  `json:"queries"`
+	Tokens  int64  `json:"tokens"`
+}
+
+func usageDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func usageKey(tenant, date, counter string) string {
+	return "usage:" + tenant + ":" + date + ":" + counter
+}
+
+// usageCounter reads a usage counter, 0 when it was never incremented
+func usageCounter(key string) int64 {
+	raw, found, err := sharedState.Get(key)
+	if err != nil || !found {
+		return 0
+	}
+	n, _ := strconv.ParseInt(raw, 10, 64)
+	return n
+}
+
+// tenantUsage returns a tenant's usage on a day
+func tenantUsage(tenant string, day time.Time) TenantUsage {
+	date := usageDate(day)
+	return TenantUsage{
+		Date:    date,
+		Queries: usageCounter(usageKey(tenant, date, "queries")),
+		Tokens:  usageCounter(usageKey(tenant, date, "tokens")),
+	}
+}
+
+// addUsage adds to a tenant's counters for today
+func addUsage(tenant, counter string, n int64) {
+	if n <= 0 {
+		return
+	}
+	ttl := usageRetentionDays * 24 * time.Hour
+	if _, err := sharedState.Incr(usageKey(tenant, usageDate(time.Now()), counter), n, ttl); err != nil {
+		log.Printf("Failed to record usage of tenant %s: %v", tenant, err)
+	}
+}
+
+// quotaExceeded returns a 429 error when a tenant has used up a daily quota
+func quotaExceeded(tenant string) error {
+	settings := tenantSettings(tenant)
+	if settings.DailyQueries == 0 && settings.DailyTokens == 0 {
+		return nil
+	}
+	usage := tenantUsage(tenant, time.Now())
+	reset := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour).Format(time.RFC3339)
+	switch {
+	case settings.DailyQueries > 0 && usage.Queries >= settings.DailyQueries:
+		return newAPIError(http.StatusTooManyRequests, fmt.Sprintf("Daily query quota of %d exceeded for tenant %s; it resets at %s", settings.DailyQueries, tenant, reset))
+	case settings.DailyTokens > 0 && usage.Tokens >= settings.DailyTokens:
+		return newAPIError(http.StatusTooManyRequests, fmt.Sprintf("Daily token quota of %d exceeded for tenant %s; it resets at %s", settings.DailyTokens, tenant, reset))
+	}
+	return nil
+}
+
+// newLimitError reports a request over one of a tenant's size limits with 413,
+// naming the limit so clients can tell which one to stay under
+func newLimitError(tenant, limit string, max, size int64) error {
+	details := map[string]interface{}{"limit": limit, "max": max}
+	message := fmt.Sprintf("%s of %d exceeded for tenant %s", limit, max, tenant)
+	if size > 0 {
+		details["size"] = size
+		message = fmt.Sprintf("%s of %d exceeded for tenant %s (got %d)", limit, max, tenant, size)
+	}
+	return &apiError{Status: http.StatusRequestEntityTooLarge, Message: message, Details: details}
+}
+
+// queryTooLong returns a 413 error when a question is longer than its tenant allows
+func queryTooLong(tenant, query string) error {
+	max := tenantSettings(tenant).MaxQueryLength
+	if length := utf8.RuneCountInString(query); max > 0 && length > max {
+		return newLimitError(tenant, "maxQueryLength", int64(max), int64(length))
+	}
+	return nil
+}
+
+// limitUploadSize caps the body of a tenant's upload request at its limit; reading
+// past it fails with an error uploadSizeError recognizes
+func limitUploadSize(w http.ResponseWriter, r *http.Request, tenant string) {
+	if max := tenantSettings(tenant).MaxUploadBytes; max > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+	}
+}
+
+// uploadSizeError turns a read past the upload limit into a 413 error, or
+// returns nil for other errors
+func uploadSizeError(err error, tenant string) error {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return nil
+	}
+	return newLimitError(tenant, "maxUploadBytes", tooLarge.Limit, 0)
+}
+
+type answerLimitKey struct{}
+
+// answerLimitContext caps the tokens generated by model calls under ctx at the
+// tenant's maxAnswerTokens
+func answerLimitContext(ctx context.Context, tenant string) context.Context {
+	if max := tenantSettings(tenant).MaxAnswerTokens; max > 0 {
+		return context.WithValue(ctx, answerLimitKey{}, max)
+	}
+	return ctx
+}
+
+// answerTokenLimit returns the cap on generated tokens under ctx, 0 for none
+func answerTokenLimit(ctx context.Context) int {
+	max, _ := ctx.Value(answerLimitKey{}).(int)
+	return max
+}
+
+type tokenMeterKey struct{}
+
+// tokenMeter counts the tokens of the model calls made under a context
+type tokenMeter struct {
+	tokens atomic.Int64
+}
+
+// meteredContext returns a context whose model calls are counted by the meter
+func meteredContext(ctx context.Context) (context.Context, *tokenMeter) {
+	meter := &tokenMeter{}
+	return context.WithValue(ctx, tokenMeterKey{}, meter), meter
+}
+
+// meterTokens adds a model call's tokens to the context's meter, if any. Without
+// counts from the model they are estimated at four characters per token.
+func meterTokens(ctx context.Context, counted int64, prompt, response string) {
+	meter, ok := ctx.Value(tokenMeterKey{}).(*tokenMeter)
+	if !ok {
+		return
+	}
+	if counted <= 0 {
+		counted = int64(len(prompt)+len(response)+3) / 4
+	}
+	meter.tokens.Add(counted)
+}
+
+// tenantUsageHandler serves GET /api/tenant/usage: the requesting tenant's
+// limits and usage over the last `days` days (7 by default)
+func tenantUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	days := 7
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		if days, err = strconv.Atoi(raw); err != nil || days < 1 || days > usageRetentionDays {
+			sendError(w, http.StatusBadRequest, fmt.Sprintf("days must be between 1 and %d", usageRetentionDays))
+			return
+		}
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"tenant":   tenant,
+		"settings": tenantSettings(tenant),
+		"usage":    usageHistory(tenant, days),
+	})
+}
+
+// usageHistory returns a tenant's usage over the last days, today first
+func usageHistory(tenant string, days int) []TenantUsage {
+	usage := make([]TenantUsage, days)
+	now := time.Now()
+	for i := range usage {
+		usage[i] = tenantUsage(tenant, now.AddDate(0, 0, -i))
+	}
+	return usage
+}
+
+// adminUsageHandler serves GET /api/admin/usage: today's usage and limits of
+// every tenant that used the server today or has settings
+func adminUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "GET") || !requireAdmin(w, r) {
+		return
+	}
+	names, err := knownTenants()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to list usage: %v", err))
+		return
+	}
+
+	type tenantReport struct {
+		Tenant   string         `json:"tenant"`
+		Settings TenantSettings `json:"settings"`
+		Today    TenantUsage    `json:"today"`
+	}
+	reports := make([]tenantReport, len(names))
+	for i, tenant := range names {
+		reports[i] = tenantReport{tenant, tenantSettings(tenant), tenantUsage(tenant, time.Now())}
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{"tenants": reports})
+}
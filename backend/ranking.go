@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DatedSpan dates the part of a text starting at a word offset, up to the next span
+type DatedSpan struct {
+	WordStart int
+	Date      time.Time // Zero when the part has no date
+}
+
+// datedChunkMetadata gives each chunk the date of the span holding its first word;
+// text before the first span takes its date
+func datedChunkMetadata(spans []DatedSpan, chunkStarts []int) []map[string]string {
+	metadata := make([]map[string]string, len(chunkStarts))
+	for i, start := range chunkStarts {
+		j := sort.Search(len(spans), func(j int) bool { return spans[j].WordStart > start })
+		if span := spans[max(j-1, 0)]; !span.Date.IsZero() {
+			metadata[i] = map[string]string{MetaDate: span.Date.UTC().Format(time.RFC3339)}
+		}
+	}
+	return metadata
+}
+
+// RecencyRanking favours newer chunks: relevance is multiplied by
+// (1 - weight) + weight * 0.5^(age / halfLife), where age comes from the chunk's
+// date metadata or else the document date. Undated chunks are treated as old.
+type RecencyRanking struct {
+	HalfLife string   `json:"halfLife"`         // Go duration or days, e.g. "720h" or "30d"
+	Weight   *float64 `json:"weight,omitempty"` // 0-1, defaults to 1
+	halfLife time.Duration
+}
+
+func (r *RecencyRanking) validate() error {
+	halfLife, err := parseDays(r.HalfLife)
+	if err != nil || halfLife <= 0 {
+		return fmt.Errorf("invalid recency halfLife %q (use e.g. 720h or 30d)", r.HalfLife)
+	}
+	if r.Weight != nil && (*r.Weight < 0 || *r.Weight > 1) {
+		return fmt.Errorf("recency weight must be between 0 and 1")
+	}
+	r.halfLife = halfLife
+	return nil
+}
+
+// parseDays reads a duration that may also be given in days ("30d")
+func parseDays(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// factor is the multiplier for a chunk dated date
+func (r *RecencyRanking) factor(date *time.Time, now time.Time) float64 {
+	weight := 1.0
+	if r.Weight != nil {
+		weight = *r.Weight
+	}
+	decay := 0.0
+	if date != nil {
+		age := max(now.Sub(*date), 0)
+		decay = math.Pow(0.5, float64(age)/float64(r.halfLife))
+	}
+	return 1 - weight + weight*decay
+}
+
+// FieldBoosts weigh a query word found in a chunk's headings or title against one
+// found in its text (weight 1). Headings are those of the TOC sections holding the
+// chunk; the title is the chunk's title metadata, such as a record title, or else
+// the document title.
+type FieldBoosts struct {
+	Heading float64 `json:"heading"`
+	Title   float64 `json:"title"`
+}
+
+func (f *FieldBoosts) validate() error {
+	if f.Heading < 0 || f.Title < 0 {
+		return fmt.Errorf("field boosts must not be negative")
+	}
+	return nil
+}
+
+// chunkRanking holds what query-time ranking knows about each chunk of a document
+type chunkRanking struct {
+	allowed    chunkSet
+	boosts     []float64 // Relevance multipliers, nil for none
+	fields     []float64 // Weighted query words matched in headings and titles, nil for none
+	queryWords int
+}
+
+// newChunkRanking prepares ranking of a document's allowed chunks for a query;
+// callers hold the document lock
+func newChunkRanking(doc *Document, query string, allowed chunkSet) *chunkRanking {
+	r := &chunkRanking{allowed: allowed}
+	c, _ := collectionStore.Get(doc.Collection)
+	if c != nil && c.Recency != nil {
+		now := time.Now()
+		r.boosts = make([]float64, len(doc.Chunks))
+		for i := range r.boosts {
+			r.boosts[i] = c.Recency.factor(doc.chunkDate(i), now)
+		}
+	}
+	if weight := getConfig().ImportanceWeight; weight > 0 {
+		if r.boosts == nil {
+			r.boosts = make([]float64, len(doc.Chunks))
+			for i := range r.boosts {
+				r.boosts[i] = 1
+			}
+		}
+		for i := range r.boosts {
+			r.boosts[i] *= doc.importanceFactor(i, weight)
+		}
+	}
+
+	fieldBoosts := getConfig().FieldBoosts
+	if c != nil && c.FieldBoosts != nil {
+		fieldBoosts = *c.FieldBoosts
+	}
+	words := termWords(query)
+	r.queryWords = len(words)
+	if len(words) > 64 {
+		words = words[:64] // Matches are tracked as bits
+	}
+	if len(words) > 0 && (fieldBoosts.Heading > 0 || fieldBoosts.Title > 0) {
+		r.fields = fieldScores(doc, words, fieldBoosts)
+	}
+	return r
+}
+
+// matchedWords returns a bit for each query word found in text
+func matchedWords(text string, queryWords []string) uint64 {
+	var mask uint64
+	for _, w := range termWords(text) {
+		for k, q := range queryWords {
+			if w == q {
+				mask |= 1 << k
+			}
+		}
+	}
+	return mask
+}
+
+// fieldScores weighs the query words each chunk's headings and title contain, or
+// returns nil when none match
+func fieldScores(doc *Document, queryWords []string, boosts FieldBoosts) []float64 {
+	headings := make([]uint64, len(doc.Chunks))
+	if boosts.Heading > 0 {
+		for _, entry := range doc.TOC {
+			mask := matchedWords(entry.Title, queryWords)
+			for i := max(entry.ChunkStart, 0); mask != 0 && i < entry.ChunkEnd && i < len(headings); i++ {
+				headings[i] |= mask
+			}
+		}
+	}
+	var docTitle uint64
+	if boosts.Title > 0 {
+		docTitle = matchedWords(doc.Metadata.Title, queryWords)
+	}
+
+	var scores []float64
+	for i := range doc.Chunks {
+		title := docTitle
+		if boosts.Title > 0 && i < len(doc.ChunkMetadata) && doc.ChunkMetadata[i][MetaTitle] != "" {
+			title = matchedWords(doc.ChunkMetadata[i][MetaTitle], queryWords)
+		}
+		score := boosts.Heading*float64(bits.OnesCount64(headings[i])) + boosts.Title*float64(bits.OnesCount64(title))
+		if score > 0 {
+			if scores == nil {
+				scores = make([]float64, len(doc.Chunks))
+			}
+			scores[i] = score
+		}
+	}
+	return scores
+}
+
+// keyword scores a chunk whose text holds matches of the query words
+func (r *chunkRanking) keyword(i int, matches float64) float64 {
+	if r.fields != nil {
+		matches += r.fields[i]
+	}
+	return r.boosted(i, matches)
+}
+
+// similarity scores a chunk by its embedding similarity; field matches raise it in
+// proportion to the share of query words they cover
+func (r *chunkRanking) similarity(i int, similarity float64) float64 {
+	if r.fields != nil && r.queryWords > 0 && similarity > 0 {
+		similarity *= 1 + r.fields[i]/float64(r.queryWords)
+	}
+	return r.boosted(i, similarity)
+}
+
+// boosted applies a chunk's multiplier to a relevance score. Only positive scores
+// are scaled, so a boost never turns a poor match into a good one.
+func (r *chunkRanking) boosted(i int, score float64) float64 {
+	if r.boosts == nil || score <= 0 {
+		return score
+	}
+	return score * r.boosts[i]
+}
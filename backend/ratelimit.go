@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Behind a load balancer every request comes from the proxy, so with
+// RateLimitTrustProxy the client is taken from X-Forwarded-For instead
+func rateLimitClient(r *http.Request) string {
+	if getConfig().RateLimitTrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimited counts requests per client in one-minute windows. Counters live in
+// shared state, so with Redis the limit holds across replicas and restarts.
+func rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := getConfig().RateLimitPerMinute
+		if limit <= 0 {
+			next(w, r)
+			return
+		}
+
+		now := time.Now()
+		window := now.Unix() / 60
+		count, err := sharedState.Incr("ratelimit:"+rateLimitClient(r)+":"+strconv.FormatInt(window, 10), 1, 2*time.Minute)
+		if err != nil {
+			// Fail open: an unreachable store should not take the API down
+			log.Printf("Rate limit check failed: %v", err)
+			next(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Set("X-RateLimit-Limit", strconv.FormatInt(limit, 10))
+		header.Set("X-RateLimit-Remaining", strconv.FormatInt(max(limit-count, 0), 10))
+		if count > limit {
+			header.Set("Retry-After", strconv.FormatInt((window+1)*60-now.Unix(), 10))
+			sendError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redisTimeout = 5 * time.Second
+
+// redisClient is a minimal RESP2 client over a single connection, enough for the
+// shared state multiple instances coordinate through (locks, caches, counters)
+type redisClient struct {
+	addr     string
+	username string
+	password string
+	db       int
+	useTLS   bool
+	conn     net.Conn
+	r        *bufio.Reader
+	mu       sync.Mutex
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// sharedRedis is set from REDIS_URL; nil keeps all shared state in process
+var sharedRedis *redisClient
+
+// newRedisClient parses redis://[user:password@]host[:port][/db] (rediss:// for TLS)
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis url %q", rawURL)
+	}
+	c := &redisClient{addr: u.Host, useTLS: u.Scheme == "rediss"}
+	if u.Port() == "" {
+		c.addr += ":6379"
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// connect dials and authenticates; callers hold c.mu
+func (c *redisClient) connect() error {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if c.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{ServerName: strings.Split(c.addr, ":")[0]})
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := c.roundTrip(args); err != nil {
+			c.disconnect()
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.roundTrip([]string{"SELECT", strconv.Itoa(c.db)}); err != nil {
+			c.disconnect()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) disconnect() {
+	if c.conn != nil {
+		closeFile(c.conn, "redis connection")
+		c.conn, c.r = nil, nil
+	}
+}
+
+// Do runs a command and returns its reply: string, int64, nil, []interface{} or a
+// redisError. A broken connection is re-established and the command retried once.
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if c.conn == nil {
+			if err := c.connect(); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := c.roundTrip(args)
+		var replyErr redisError
+		if err == nil || errors.As(err, &replyErr) {
+			return reply, err
+		}
+		c.disconnect()
+		if attempt > 0 {
+			return nil, fmt.Errorf("redis %s failed: %w", args[0], err)
+		}
+	}
+}
+
+// roundTrip writes a command and reads its reply; callers hold c.mu
+func (c *redisClient) roundTrip(args []string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisClient) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			item, err := c.readReply()
+			var replyErr redisError
+			if err != nil && !errors.As(err, &replyErr) {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply %q", line)
+}
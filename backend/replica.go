@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// readOnlyReplica is set by READ_ONLY=true. Replicas serve queries from the store
+// persisted by a single writer instance and reject requests that change it.
+var readOnlyReplica = getEnv("READ_ONLY", "") == "true"
+
+// replicaFollower keeps a replica's document store in step with the writer's
+// snapshot and WAL segments
+type replicaFollower struct {
+	dir     string
+	offsets map[int]int64 // Bytes applied from each segment
+}
+
+// reload rebuilds the store from the snapshot and all segments, then swaps it in.
+// A segment removed while loading means the writer compacted meanwhile, so the
+// load is retried against the new snapshot.
+func (f *replicaFollower) reload() error {
+	const attempts = 5
+	for attempt := 0; attempt < attempts; attempt++ {
+		segments, err := walSegments(f.dir)
+		if err != nil {
+			return err
+		}
+
+		store := NewDocumentStore()
+		if _, _, err := replayFile(filepath.Join(f.dir, snapshotFile), store, 0); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		offsets := make(map[int]int64)
+		complete := true
+		for _, n := range segments {
+			_, offset, err := replayFile(walSegmentPath(f.dir, n), store, 0)
+			if os.IsNotExist(err) {
+				complete = false
+				break
+			}
+			if err != nil {
+				return err
+			}
+			offsets[n] = offset
+		}
+		if !complete {
+			continue
+		}
+
+		documentStore.mu.Lock()
+		documentStore.docs = store.docs
+		documentStore.terms.replace(store.terms)
+		documentStore.mu.Unlock()
+		f.offsets = offsets
+		return nil
+	}
+	return fmt.Errorf("store kept changing during %d reload attempts", attempts)
+}
+
+// refresh applies records appended since the last refresh, reloading fully
+// when the writer has compacted away a segment this replica was following
+func (f *replicaFollower) refresh() error {
+	segments, err := walSegments(f.dir)
+	if err != nil {
+		return err
+	}
+	present := make(map[int]bool, len(segments))
+	for _, n := range segments {
+		present[n] = true
+	}
+	for n := range f.offsets {
+		if !present[n] {
+			return f.reload()
+		}
+	}
+
+	for _, n := range segments {
+		_, offset, err := replayFile(walSegmentPath(f.dir, n), documentStore, f.offsets[n])
+		if os.IsNotExist(err) {
+			return f.reload()
+		}
+		if err != nil {
+			return err
+		}
+		f.offsets[n] = offset
+	}
+	return nil
+}
+
+// startReplica loads the persisted store and follows the writer's changes
+func startReplica(dir string, interval time.Duration) error {
+	f := &replicaFollower{dir: dir}
+	if err := f.reload(); err != nil {
+		return err
+	}
+	log.Printf("Read-only replica loaded %d documents from %s", len(documentStore.All()), dir)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := f.refresh(); err != nil {
+				log.Printf("Replica refresh failed: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// rejectOnReplica answers write requests on a read-only replica and reports whether it did
+func rejectOnReplica(w http.ResponseWriter) bool {
+	if !readOnlyReplica {
+		return false
+	}
+	sendError(w, http.StatusForbidden, "This instance is a read-only replica; send changes to the writer")
+	return true
+}
+
+// writerOnly guards routes whose requests other than GET and HEAD change stored state
+func writerOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" && rejectOnReplica(w) {
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// ReprocessRequest changes how a document is chunked when it is processed again;
+// settings left out keep the document's
+type ReprocessRequest struct {
+	Chunking struct {
+		Strategy *string `json:"strategy"`
+		Size     *int    `json:"size"`    // 0 takes the collection's setting or the default
+		Overlap  *int    `json:"overlap"` // Words repeated from the end of the previous chunk
+	} `json:"chunking"`
+}
+
+// handleReprocessDocument serves POST /api/document/{name}/reprocess: the document
+// is extracted again from its stored file and chunked with the given settings.
+// Queries keep using the current version until the new one replaces it.
+func handleReprocessDocument(w http.ResponseWriter, r *http.Request, docName string) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+	doc, ok := getDocumentOrError(w, docName)
+	if !ok {
+		return
+	}
+	var req ReprocessRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, http.StatusBadRequest, "Invalid request")
+			return
+		}
+	}
+
+	doc.mu.RLock()
+	err := preconditionError(r, doc)
+	chunking := doc.Chunking
+	doc.mu.RUnlock()
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	if req.Chunking.Strategy != nil {
+		chunking.Strategy = *req.Chunking.Strategy
+	}
+	if req.Chunking.Size != nil {
+		chunking.Size = *req.Chunking.Size
+	}
+	if req.Chunking.Overlap != nil {
+		chunking.Overlap = *req.Chunking.Overlap
+	}
+	if err := validateChunkOptions(chunking); err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	updated, err := reprocessStored(docName, doc, &chunking, r.Header.Get("If-Match"))
+	if errors.Is(err, fs.ErrNotExist) {
+		sendError(w, http.StatusConflict, "The document's file is no longer stored; upload it again")
+		return
+	}
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	updated.mu.RLock()
+	defer updated.mu.RUnlock()
+	w.Header().Set("ETag", documentETag(updated))
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"message":  fmt.Sprintf("Document reprocessed: %d chunks created", len(updated.Chunks)),
+		"chunks":   len(updated.Chunks),
+		"chunking": updated.Chunking,
+		"version":  updated.Version,
+	})
+}
+
+// reprocessStored indexes a document again from its stored file, keeping the
+// settings, metadata, instructions and summary it has, or changing its chunking
+// when one is given; doc is nil for a file that has no document yet. The new
+// version replaces the stored one only once it is complete, and only while the
+// stored one is still doc and matches ifMatch, when given. Changes made to doc
+// meanwhile carry over, as do its creation and archive times.
+func reprocessStored(name string, doc *Document, chunking *ChunkOptions, ifMatch string) (*Document, error) {
+	opts := IngestOptions{Name: name, ModelName: modelOrDefault(""), FullReprocess: true}
+	var version int64
+	if doc != nil {
+		classify := false // Keep the document's label and preset
+		doc.mu.RLock()
+		opts.Collection, opts.Chunking, opts.Metadata = doc.Collection, doc.Chunking, doc.Metadata
+		opts.Instructions, opts.EmbeddingModel = doc.Instructions, doc.EmbeddingModel
+		opts.RecordMapping, opts.Preset, opts.Classify = doc.RecordMapping, doc.Preset, &classify
+		version = doc.Version
+		doc.mu.RUnlock()
+	}
+	if chunking != nil {
+		opts.Chunking = *chunking
+	}
+	opts.BeforeSwap = func(updated, previous *Document) error {
+		if previous != doc {
+			return newAPIError(http.StatusConflict, "The document was replaced while it was reprocessed")
+		}
+		if previous == nil {
+			return nil
+		}
+		if ifMatch = strings.TrimSpace(ifMatch); ifMatch != "" {
+			if err := ifMatchError(ifMatch, previous); err != nil {
+				return err
+			}
+		}
+		if previous.Version != version {
+			updated.Metadata = previous.Metadata // Changed while the file was processed
+		}
+		// Summaries describe the whole text, so they survive re-processing
+		updated.HasSummary, updated.Summary = previous.HasSummary, previous.Summary
+		updated.Instructions = previous.Instructions
+		// CreatedAt stays the new version's: it dates the index, which corpus
+		// checks compare with the file's modification time
+		updated.ArchivedAt = previous.ArchivedAt
+		updated.Version = previous.Version + 1
+		return nil
+	}
+
+	var updated *Document
+	err := withDocumentLease(name, func() error {
+		filePath, release, err := openStoredFile(filepath.Join("./documents", name))
+		if err != nil {
+			return err
+		}
+		defer release()
+		updated, _, err = ingestFile(filePath, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	invalidateGlossary(name, opts.Collection, updated.Collection)
+	return updated, nil
+}
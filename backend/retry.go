@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// transientError marks a failure worth retrying: a busy limiter, a connection
+// problem, or a 429 or 5xx response
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string { return e.err.Error() }
+func (e transientError) Unwrap() error { return e.err }
+
+func isTransient(err error) bool {
+	var t transientError
+	return errors.As(err, &t)
+}
+
+// ollamaHTTPError is a non-200 Ollama response
+type ollamaHTTPError struct {
+	Status int
+	Body   string
+}
+
+func (e ollamaHTTPError) Error() string {
+	return fmt.Sprintf("ollama error: status %d, body: %s", e.Status, e.Body)
+}
+
+// ollamaStatusError describes a non-200 Ollama response, marking overload and
+// server errors as transient
+func ollamaStatusError(status int, body []byte) error {
+	err := ollamaHTTPError{Status: status, Body: string(body)}
+	if status == 429 || status >= 500 {
+		return transientError{err}
+	}
+	return err
+}
+
+// ollamaRequestError wraps a failed request; it is transient unless ctx was cancelled
+func ollamaRequestError(ctx context.Context, err error) error {
+	err = fmt.Errorf("ollama request failed: %w", err)
+	if ctx.Err() != nil {
+		return err
+	}
+	return transientError{err}
+}
+
+// retryTransient runs attempt until it succeeds, fails permanently or runs out of
+// retries, backing off exponentially with jitter from OllamaRetryBackoff. Cancelling ctx stops the retries.
+func retryTransient(ctx context.Context, what string, attempt func() error) error {
+	config := getConfig()
+	backoff := time.Duration(config.OllamaRetryBackoff)
+	for i := 0; ; i++ {
+		err := attempt()
+		if err == nil || !isTransient(err) || i >= config.OllamaRetries || ctx.Err() != nil {
+			return err
+		}
+
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		log.Printf("%s failed (attempt %d of %d), retrying in %v: %v", what, i+1, config.OllamaRetries+1, wait.Round(time.Millisecond), err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Document metadata holding the language detected for routing
+const MetaLanguage = "language"
+
+// RoutingConfig places documents ingested without a collection
+type RoutingConfig struct {
+	Rules []RoutingRule `json:"rules"` // The first matching rule wins
+}
+
+// RoutingRule sends documents matching all of its conditions to a collection.
+// A rule without conditions matches every document.
+type RoutingRule struct {
+	Name       string   `json:"name,omitempty"`
+	Type       string   `json:"type,omitempty"`     // Classification label
+	Sender     string   `json:"sender,omitempty"`   // Part of the author or an email sender, e.g. "@acme.com"
+	Filename   string   `json:"filename,omitempty"` // Glob matched against the file name, ignoring case
+	Language   string   `json:"language,omitempty"` // Detected language code: en, de, fr, es, it, nl or pt
+	Collection string   `json:"collection"`
+	Preset     string   `json:"preset,omitempty"` // Applied unless the upload chose a preset
+	Tags       []string `json:"tags,omitempty"`   // Added to the document's tags
+}
+
+func (c RoutingConfig) validate() error {
+	for i, rule := range c.Rules {
+		label := rule.Name
+		if label == "" {
+			label = fmt.Sprint(i + 1)
+		}
+		if rule.Collection == "" || strings.Contains(rule.Collection, "/") {
+			return fmt.Errorf("routing rule %s needs a valid collection", label)
+		}
+		if _, err := path.Match(rule.Filename, ""); err != nil {
+			return fmt.Errorf("routing rule %s: invalid filename pattern %q", label, rule.Filename)
+		}
+		if _, known := stopwords[rule.Language]; rule.Language != "" && !known {
+			return fmt.Errorf("routing rule %s: unsupported language %q (use en, de, fr, es, it, nl or pt)", label, rule.Language)
+		}
+	}
+	return nil
+}
+
+// routing tells whether an ingestion is placed by the routing rules: those
+// naming a collection are not
+func routing(opts IngestOptions) bool {
+	return opts.Collection == "" && len(getConfig().Routing.Rules) > 0
+}
+
+// routeUpload moves a document into the collection of the first rule it
+// matches and adds the rule's tags. meta is the document's metadata including
+// what extraction found, and text the start of its text. It returns the rule, or
+// nil when none matched.
+func routeUpload(opts IngestOptions, meta DocumentMetadata, text string) (IngestOptions, *RoutingRule) {
+	rules := getConfig().Routing.Rules
+	language := ""
+	if slices.ContainsFunc(rules, func(r RoutingRule) bool { return r.Language != "" }) {
+		if language = detectLanguage(tokenize(text)); language != "unknown" {
+			opts.Metadata = withCustomMetadata(opts.Metadata, MetaLanguage, language)
+		}
+	}
+	senders := strings.ToLower(meta.Author + "; " + meta.Custom["senders"])
+	filename := strings.ToLower(path.Base(opts.Name))
+
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Type != "" && !strings.EqualFold(rule.Type, meta.Custom[MetaType]) ||
+			rule.Sender != "" && !strings.Contains(senders, strings.ToLower(rule.Sender)) ||
+			rule.Language != "" && rule.Language != language {
+			continue
+		}
+		if rule.Filename != "" {
+			if matched, _ := path.Match(strings.ToLower(rule.Filename), filename); !matched {
+				continue
+			}
+		}
+
+		opts.Collection = rule.Collection
+		if len(rule.Tags) > 0 {
+			tags := slices.Clone(meta.Tags)
+			for _, tag := range rule.Tags {
+				if !slices.Contains(tags, tag) {
+					tags = append(tags, tag)
+				}
+			}
+			opts.Metadata.Tags = tags
+		}
+		log.Printf("Routed %s to collection %s (rule %s)", opts.Name, rule.Collection, rule.Name)
+		return opts, rule
+	}
+	return opts, nil
+}
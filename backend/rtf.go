@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Destinations whose content is formatting or embedded data rather than text
+var rtfSkippedDestinations = map[string]bool{
+	"fonttbl": true, "colortbl": true, "stylesheet": true, "listtable": true,
+	"listoverridetable": true, "revtbl": true, "rsidtbl": true, "generator": true,
+	"pict": true, "object": true, "objdata": true, "themedata": true, "colorschememapping": true,
+	"datastore": true, "latentstyles": true, "xmlnstbl": true, "mmathPr": true,
+	"fldinst": true, "header": true, "headerl": true, "headerr": true, "headerf": true,
+	"footer": true, "footerl": true, "footerr": true, "footerf": true, "filetbl": true,
+	"pgdsctbl": true, "bkmkstart": true, "bkmkend": true, "private": true, "pnseclvl": true,
+	"operator": true, "keywords": true, "comment": true, "doccomm": true, "company": true,
+	"category": true, "manager": true, "hlinkbase": true, "nonshppict": true, "xe": true, "tc": true,
+}
+
+// Characters written by symbol control words
+var rtfSymbols = map[string]string{
+	"par": "\n\n", "sect": "\n\n", "page": "\n\n", "line": "\n", "row": "\n",
+	"tab": "\t", "cell": "\t", "emdash": "—", "endash": "–", "bullet": "•",
+	"lquote": "‘", "rquote": "’", "ldblquote": "“", "rdblquote": "”",
+	"emspace": " ", "enspace": " ", "qmspace": " ",
+}
+
+// Windows-1252 characters in 0x80-0x9F; the rest of the upper half matches Latin-1
+var cp1252High = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+func cp1252Rune(b byte) rune {
+	if b >= 0x80 && b < 0xa0 {
+		return cp1252High[b-0x80]
+	}
+	return rune(b)
+}
+
+// rtfState is the formatting state of one RTF group
+type rtfState struct {
+	skip       bool   // Inside a destination that produces no text
+	dest       string // Info field being captured (title, author, subject, creatim)
+	unicodeAlt int    // Fallback characters following each \u, set by \uc
+}
+
+func extractRTFText(filePath string) (*ExtractedText, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	if !isRTF(data) {
+		return nil, fmt.Errorf("not an RTF document")
+	}
+	text, meta := parseRTF(data)
+	return &ExtractedText{Text: text, Metadata: meta}, nil
+}
+
+func isRTF(data []byte) bool {
+	return strings.HasPrefix(string(data[:min(len(data), 5)]), `{\rtf`)
+}
+
+// parseRTF returns the plain text of an RTF document with paragraphs separated by
+// blank lines, and the title, author, subject and creation date from its info group
+func parseRTF(data []byte) (string, DocumentMetadata) {
+	var text strings.Builder
+	info := make(map[string]*strings.Builder)
+	created := make(map[string]int)
+
+	state := rtfState{unicodeAlt: 1}
+	var stack []rtfState
+	pendingAlt := 0 // Fallback characters still to drop after a \u
+
+	write := func(s string) {
+		if pendingAlt > 0 {
+			pendingAlt--
+			return
+		}
+		switch {
+		case state.dest != "":
+			if info[state.dest] == nil {
+				info[state.dest] = &strings.Builder{}
+			}
+			info[state.dest].WriteString(s)
+		case !state.skip:
+			text.WriteString(s)
+		}
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch c {
+		case '{':
+			stack = append(stack, state)
+			pendingAlt = 0
+		case '}':
+			if len(stack) > 0 {
+				state = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+			pendingAlt = 0
+		case '\r', '\n':
+			// Line breaks in the source are not part of the text
+		case '\\':
+			if i+1 >= len(data) {
+				break
+			}
+			next := data[i+1]
+			switch {
+			case next == '\'' && i+3 < len(data):
+				if b, err := strconv.ParseUint(string(data[i+2:i+4]), 16, 8); err == nil {
+					write(string(cp1252Rune(byte(b))))
+				}
+				i += 3
+			case next == '*':
+				// Ignorable destination we do not understand
+				state.skip = true
+				i++
+			case next == '\r' || next == '\n':
+				write("\n\n")
+				i++
+			case next == '~':
+				write(" ")
+				i++
+			case next == '_':
+				write("-")
+				i++
+			case next == '-':
+				i++
+			case isASCIILetter(next):
+				j := i + 1
+				for j < len(data) && isASCIILetter(data[j]) {
+					j++
+				}
+				word := string(data[i+1 : j])
+				k := j
+				if k < len(data) && data[k] == '-' {
+					k++
+				}
+				for k < len(data) && data[k] >= '0' && data[k] <= '9' {
+					k++
+				}
+				param, hasParam := 0, k > j
+				if hasParam {
+					param, _ = strconv.Atoi(string(data[j:k]))
+				}
+				if k < len(data) && data[k] == ' ' {
+					k++ // The delimiting space belongs to the control word
+				}
+				i = k - 1
+
+				switch {
+				case word == "bin" && hasParam:
+					i += max(param, 0)
+				case word == "u" && hasParam:
+					if param < 0 {
+						param += 65536
+					}
+					write(string(rune(param)))
+					pendingAlt = state.unicodeAlt
+				case word == "uc" && hasParam:
+					state.unicodeAlt = max(param, 0)
+				case word == "title" || word == "author" || word == "subject" || word == "creatim":
+					state.dest = word
+				case word == "yr" || word == "mo" || word == "dy":
+					if state.dest == "creatim" {
+						created[word] = param
+					}
+				case rtfSkippedDestinations[word]:
+					state.skip = true
+				case rtfSymbols[word] != "":
+					write(rtfSymbols[word])
+				}
+			default:
+				// Escaped character such as \{ \} or \\
+				write(string(next))
+				i++
+			}
+		default:
+			if c >= 0x80 {
+				write(string(cp1252Rune(c)))
+			} else {
+				write(string(c))
+			}
+		}
+	}
+
+	var meta DocumentMetadata
+	field := func(name string) string {
+		if b := info[name]; b != nil {
+			return strings.TrimSpace(b.String())
+		}
+		return ""
+	}
+	meta.Title, meta.Author, meta.Subject = field("title"), field("author"), field("subject")
+	if created["yr"] > 0 {
+		t := time.Date(created["yr"], time.Month(max(created["mo"], 1)), max(created["dy"], 1), 0, 0, 0, 0, time.UTC)
+		meta.Date = &t
+	}
+	return strings.TrimSpace(text.String()), meta
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Hash of an empty request body, used as the payload hash of signed GET requests
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Client talks to S3-compatible storage using path-style URLs. Requests are signed
+// with AWS Signature Version 4 when AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are set.
+type s3Client struct {
+	endpoint     string
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3Client(src Source) *s3Client {
+	region := src.Region
+	if region == "" {
+		region = getEnv("AWS_REGION", "us-east-1")
+	}
+	endpoint := strings.TrimSuffix(src.URL, "/")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	return &s3Client{
+		endpoint:     endpoint,
+		region:       region,
+		bucket:       src.Bucket,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// awsURIEncode escapes everything except unreserved characters, as SigV4 requires
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// url builds an object (or bucket, for an empty key) URL with a canonically encoded query
+func (c *s3Client) url(key string, query map[string]string) string {
+	u := c.endpoint + "/" + awsURIEncode(c.bucket, true) + "/" + awsURIEncode(key, false)
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, len(keys))
+	for i, k := range keys {
+		params[i] = awsURIEncode(k, true) + "=" + awsURIEncode(query[k], true)
+	}
+	if len(params) > 0 {
+		u += "?" + strings.Join(params, "&")
+	}
+	return u
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds SigV4 headers to a bodiless request
+func (c *s3Client) sign(req *http.Request) {
+	if c.accessKey == "" || c.secretKey == "" {
+		return
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", emptyPayloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// s3Object is an entry of a ListObjectsV2 response
+type s3Object struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+}
+
+// list returns every object under prefix, following continuation tokens
+func (c *s3Client) list(ctx context.Context, prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+	for {
+		query := map[string]string{"list-type": "2", "prefix": prefix}
+		if token != "" {
+			query["continuation-token"] = token
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", c.url("", query), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		c.sign(req)
+
+		resp, err := sourceHTTPClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("list request failed: %w", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		closeFile(resp.Body, "S3 list response body")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read list response: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("list returned status %d: %s", resp.StatusCode, string(body))
+		}
+
+		var result struct {
+			Contents              []s3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("invalid list response: %w", err)
+		}
+		objects = append(objects, result.Contents...)
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// syncS3Source re-ingests objects whose ETag changed since the last sync
+func syncS3Source(ctx context.Context, src Source, items map[string]*SourceItem) (int, int, error) {
+	client := newS3Client(src)
+	objects, err := client.list(ctx, src.Prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var changed, unchanged int
+	var failed []string
+	for _, obj := range objects {
+		if strings.HasSuffix(obj.Key, "/") || !isSupportedFile(obj.Key) {
+			continue
+		}
+		item := trackItem(items, obj.Key, sourceDocumentName(strings.TrimPrefix(obj.Key, src.Prefix)))
+
+		// Listing ETags let unchanged objects be skipped without downloading them
+		if item.Hash != "" && item.ETag == obj.ETag {
+			unchanged++
+			continue
+		}
+
+		fetched, err := conditionalGet(ctx, client.url(obj.Key, nil), item, client.sign)
+		if err == nil && fetched != nil {
+			var ok bool
+			ok, err = ingestSourceItem(src, item, fetched, DocumentMetadata{Custom: map[string]string{"s3Key": obj.Key}})
+			if ok {
+				changed++
+			} else if err == nil {
+				unchanged++
+			}
+		} else if err == nil {
+			unchanged++
+		}
+		if recordItemError(item, err) != nil {
+			failed = append(failed, obj.Key)
+		}
+	}
+
+	if len(failed) > 0 {
+		return changed, unchanged, fmt.Errorf("failed to sync %s", strings.Join(failed, ", "))
+	}
+	return changed, unchanged, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Limits on saved queries
+const (
+	maxSavedQueries         = 200 // Per tenant
+	maxSavedQueryDocuments  = 50  // Documents a collection-scoped run answers from
+	maxSavedQueryNameLength = 100
+)
+
+// SavedQuery is a named query definition (question, scope, model and parameters)
+// that clients and digests re-run by ID
+type SavedQuery struct {
+	ID          string       `json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Collection  string       `json:"collection,omitempty"` // Run against each document of the collection instead of request.documentName
+	Request     QueryRequest `json:"request"`
+	CreatedAt   time.Time    `json:"createdAt"`
+	UpdatedAt   time.Time    `json:"updatedAt"`
+}
+
+// SavedQueryRun overrides parts of a saved query for one run
+type SavedQueryRun struct {
+	DocumentName string `json:"documentName,omitempty"` // One document of a collection-scoped query
+	ModelName    string `json:"modelName,omitempty"`
+	SessionID    string `json:"sessionId,omitempty"`
+}
+
+// SavedQueryResult is the answer from one document of a run
+type SavedQueryResult struct {
+	Document string `json:"document"`
+	*QueryResponse
+	Error string `json:"error,omitempty"`
+}
+
+func savedQueryKey(tenant, id string) string {
+	return "savedquery:" + tenant + ":" + id
+}
+
+// getSavedQuery loads one of a tenant's saved queries
+func getSavedQuery(tenant, id string) (*SavedQuery, bool) {
+	var sq SavedQuery
+	if !getJSON(savedQueryKey(tenant, id), &sq) {
+		return nil, false
+	}
+	return &sq, true
+}
+
+// listSavedQueries returns a tenant's saved queries sorted by name
+func listSavedQueries(tenant string) ([]SavedQuery, error) {
+	keys, err := sharedState.Keys(savedQueryKey(tenant, ""))
+	if err != nil {
+		return nil, err
+	}
+	queries := make([]SavedQuery, 0, len(keys))
+	for _, key := range keys {
+		var sq SavedQuery
+		if getJSON(key, &sq) {
+			queries = append(queries, sq)
+		}
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		if queries[i].Name != queries[j].Name {
+			return queries[i].Name < queries[j].Name
+		}
+		return queries[i].ID < queries[j].ID
+	})
+	return queries, nil
+}
+
+// validate checks a definition and drops the fields that belong to a single run
+func (sq *SavedQuery) validate() error {
+	sq.Name = strings.TrimSpace(sq.Name)
+	if sq.Name == "" || len(sq.Name) > maxSavedQueryNameLength {
+		return newAPIError(http.StatusBadRequest, fmt.Sprintf("A name of up to %d characters is required", maxSavedQueryNameLength))
+	}
+	req := &sq.Request
+	req.Query = strings.TrimSpace(req.Query)
+	if req.Query == "" {
+		return newAPIError(http.StatusBadRequest, "request.query is required")
+	}
+	if (req.DocumentName == "") == (sq.Collection == "") {
+		return newAPIError(http.StatusBadRequest, "Give either request.documentName or a collection")
+	}
+	if req.CitationStyle != "" && !validCitationStyle(req.CitationStyle) {
+		return newAPIError(http.StatusBadRequest, "Unsupported citation style")
+	}
+	if _, err := spellingMode(req.Spelling); err != nil {
+		return err
+	}
+	if !validTableMode(req.TableMode) {
+		return newAPIError(http.StatusBadRequest, "tableMode must be auto or off")
+	}
+	req.SessionID = ""
+	req.Speech = false
+	return nil
+}
+
+// documents returns the names of the documents in the query's scope, sorted
+func (sq *SavedQuery) documents() []string {
+	if sq.Collection == "" {
+		return []string{sq.Request.DocumentName}
+	}
+	var names []string
+	for _, doc := range activeDocuments(documentStore.ByCollection(sq.Collection), sq.Request.IncludeArchived) {
+		names = append(names, doc.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// request returns the query to run against one document
+func (sq *SavedQuery) request(document, tenant string) QueryRequest {
+	req := sq.Request
+	req.DocumentName = document
+	req.Tenant = tenant
+	return req
+}
+
+// savedQueryFromRequest decodes and validates a definition from a request body
+func savedQueryFromRequest(r *http.Request) (*SavedQuery, error) {
+	var sq SavedQuery
+	if err := json.NewDecoder(r.Body).Decode(&sq); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "Invalid request")
+	}
+	if err := sq.validate(); err != nil {
+		return nil, err
+	}
+	return &sq, nil
+}
+
+// savedQueriesHandler lists (GET) or saves (POST) the tenant's queries
+func savedQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && !validateMethod(w, r, "POST") {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	queries, err := listSavedQueries(tenant)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to list saved queries: %v", err))
+		return
+	}
+
+	if r.Method == "GET" {
+		sendJSON(w, http.StatusOK, map[string]interface{}{"savedQueries": queries})
+		return
+	}
+
+	if rejectOnReplica(w) {
+		return
+	}
+	if len(queries) >= maxSavedQueries {
+		sendError(w, http.StatusConflict, fmt.Sprintf("At most %d queries can be saved", maxSavedQueries))
+		return
+	}
+	sq, err := savedQueryFromRequest(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	now := time.Now().UTC()
+	sq.ID = randomID()
+	sq.CreatedAt, sq.UpdatedAt = now, now
+	setJSON(savedQueryKey(tenant, sq.ID), sq, 0)
+	sendJSON(w, http.StatusCreated, sq)
+}
+
+// handleSavedQueryByID reads (GET), replaces (PUT) or deletes (DELETE) a saved
+// query; POST /api/saved-queries/{id}/run runs it
+func handleSavedQueryByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/saved-queries/"), "/"), "/")
+	if parts[0] == "" {
+		savedQueriesHandler(w, r)
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	sq, exists := getSavedQuery(tenant, parts[0])
+	if !exists {
+		sendError(w, http.StatusNotFound, "Saved query not found")
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "run" {
+		if validateMethod(w, r, "POST") {
+			rateLimited(func(w http.ResponseWriter, r *http.Request) { runSavedQuery(w, r, sq, tenant) })(w, r)
+		}
+		return
+	}
+	if len(parts) != 1 {
+		sendError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != "GET" && r.Method != "PUT" && !validateMethod(w, r, "DELETE") {
+		return
+	}
+	if r.Method != "GET" && rejectOnReplica(w) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		sendJSON(w, http.StatusOK, sq)
+	case "PUT":
+		updated, err := savedQueryFromRequest(r)
+		if err != nil {
+			sendAPIError(w, err)
+			return
+		}
+		updated.ID, updated.CreatedAt = sq.ID, sq.CreatedAt
+		updated.UpdatedAt = time.Now().UTC()
+		setJSON(savedQueryKey(tenant, sq.ID), updated, 0)
+		sendJSON(w, http.StatusOK, updated)
+	case "DELETE":
+		if err := sharedState.Delete(savedQueryKey(tenant, sq.ID)); err != nil {
+			sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to delete saved query: %v", err))
+			return
+		}
+		sendJSON(w, http.StatusOK, map[string]string{"message": "Saved query deleted"})
+	}
+}
+
+// runSavedQuery answers a saved query from each document in its scope. A failing
+// document is reported in its result; the run fails only when it has no documents
+// or a single-document run fails.
+func runSavedQuery(w http.ResponseWriter, r *http.Request, sq *SavedQuery, tenant string) {
+	var run SavedQueryRun
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&run); err != nil {
+			sendError(w, http.StatusBadRequest, "Invalid request")
+			return
+		}
+	}
+	if run.ModelName != "" {
+		sq.Request.ModelName = run.ModelName
+	}
+	sq.Request.SessionID = run.SessionID
+
+	documents := sq.documents()
+	if run.DocumentName != "" {
+		doc, exists := documentStore.Get(run.DocumentName)
+		if !exists || (sq.Collection != "" && doc.Collection != sq.Collection) || (sq.Collection == "" && doc.Name != sq.Request.DocumentName) {
+			sendError(w, http.StatusNotFound, "Document not found in the saved query's scope")
+			return
+		}
+		documents = []string{run.DocumentName}
+	}
+	if len(documents) == 0 {
+		sendError(w, http.StatusNotFound, "The collection has no documents")
+		return
+	}
+	truncated := len(documents) > maxSavedQueryDocuments
+	if truncated {
+		documents = documents[:maxSavedQueryDocuments]
+	}
+
+	results := make([]SavedQueryResult, 0, len(documents))
+	for _, name := range documents {
+		resp, err := runQuery(sq.request(name, tenant))
+		if err != nil && len(documents) == 1 {
+			sendAPIError(w, err)
+			return
+		}
+		result := SavedQueryResult{Document: name, QueryResponse: resp}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"id":        sq.ID,
+		"name":      sq.Name,
+		"results":   results,
+		"truncated": truncated,
+	})
+}
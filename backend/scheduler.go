@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+)
+
+// Ollama request lanes. Interactive requests (queries, on-demand summaries) are
+// served before background work (ingest-time summaries, embeddings, jobs).
+type ollamaLane int
+
+const (
+	laneInteractive ollamaLane = iota
+	laneBackground
+)
+
+// Interactive requests give up after this long in the queue; background work waits
+// until its context is cancelled
+const interactiveQueueWait = 5 * time.Second
+
+// Kinds of Ollama calls a concurrency budget can be limited to
+const (
+	OperationGenerate = "generate"
+	OperationEmbed    = "embed"
+)
+
+type laneKey struct{}
+
+// backgroundContext marks Ollama calls made under ctx as background work
+func backgroundContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, laneKey{}, laneBackground)
+}
+
+func laneOf(ctx context.Context) ollamaLane {
+	if lane, ok := ctx.Value(laneKey{}).(ollamaLane); ok {
+		return lane
+	}
+	return laneInteractive
+}
+
+// ollamaScheduler limits concurrent Ollama requests. Freed slots go to waiting
+// interactive requests first, and background work never holds the reserved slots,
+// so a queue of background jobs cannot keep questions waiting.
+type ollamaScheduler struct {
+	capacity   int
+	reserved   int // Slots only interactive requests may use
+	inUse      int
+	background int // Slots held by background requests
+	waiting    [2][]*laneWaiter
+	mu         sync.Mutex
+
+	// Queue metrics since startup
+	granted  int64
+	queued   int64 // Requests that had to wait for a slot
+	rejected int64 // Requests that gave up waiting
+	waited   time.Duration
+}
+
+type laneWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// OllamaQueueStats reports a scheduler's slots and queue
+type OllamaQueueStats struct {
+	Capacity           int     `json:"capacity"`
+	Reserved           int     `json:"reserved"`
+	InUse              int     `json:"inUse"`
+	Background         int     `json:"background"`
+	WaitingInteractive int     `json:"waitingInteractive"`
+	WaitingBackground  int     `json:"waitingBackground"`
+	Granted            int64   `json:"granted"`
+	Queued             int64   `json:"queued"`
+	Rejected           int64   `json:"rejected"`
+	AverageWaitMs      float64 `json:"averageWaitMs"` // Over the requests that waited
+}
+
+// Connection pool for Ollama requests, sized from the configuration
+var ollamaLimiter = &ollamaScheduler{}
+
+// resize changes the number of slots; requests already running keep theirs
+func (s *ollamaScheduler) resize(capacity, reserved int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capacity = capacity
+	s.reserved = max(0, min(reserved, capacity-1))
+	s.dispatch()
+}
+
+// canRun reports whether a request in lane may take a slot now; callers hold s.mu
+func (s *ollamaScheduler) canRun(lane ollamaLane) bool {
+	if s.inUse >= s.capacity {
+		return false
+	}
+	return lane == laneInteractive || s.background < s.capacity-s.reserved
+}
+
+// grant hands a slot to a request; callers hold s.mu
+func (s *ollamaScheduler) grant(lane ollamaLane) {
+	s.granted++
+	s.inUse++
+	if lane == laneBackground {
+		s.background++
+	}
+}
+
+// acquire waits for a slot in the lane taken from ctx and returns the function that
+// frees it. Interactive requests fail with a transient error after
+// interactiveQueueWait so they can be retried.
+func (s *ollamaScheduler) acquire(ctx context.Context) (func(), error) {
+	lane := laneOf(ctx)
+	release := func() { s.release(lane) }
+
+	s.mu.Lock()
+	// Background requests also yield to interactive ones already queued
+	if s.canRun(lane) && len(s.waiting[laneInteractive]) == 0 && len(s.waiting[lane]) == 0 {
+		s.grant(lane)
+		s.mu.Unlock()
+		return release, nil
+	}
+	w := &laneWaiter{ready: make(chan struct{})}
+	s.waiting[lane] = append(s.waiting[lane], w)
+	s.queued++
+	s.mu.Unlock()
+	queuedAt := time.Now()
+
+	var timeout <-chan time.Time
+	if lane == laneInteractive {
+		timer := time.NewTimer(interactiveQueueWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		s.mu.Lock()
+		s.waited += time.Since(queuedAt)
+		s.mu.Unlock()
+		return release, nil
+	case <-timeout:
+		err = transientError{fmt.Errorf("ollama service too busy")}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	s.rejected++
+	s.waited += time.Since(queuedAt)
+	if w.granted {
+		// The slot arrived as we gave up; pass it on
+		s.mu.Unlock()
+		release()
+		return nil, err
+	}
+	queue := s.waiting[lane]
+	for i, queued := range queue {
+		if queued == w {
+			s.waiting[lane] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+	return nil, err
+}
+
+func (s *ollamaScheduler) release(lane ollamaLane) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inUse--
+	if lane == laneBackground {
+		s.background--
+	}
+	s.dispatch()
+}
+
+// dispatch grants free slots to waiters, interactive lane first; callers hold s.mu
+func (s *ollamaScheduler) dispatch() {
+	for _, lane := range []ollamaLane{laneInteractive, laneBackground} {
+		for len(s.waiting[lane]) > 0 && s.canRun(lane) {
+			w := s.waiting[lane][0]
+			s.waiting[lane] = s.waiting[lane][1:]
+			s.grant(lane)
+			w.granted = true
+			close(w.ready)
+		}
+	}
+}
+
+// stats reports the scheduler's slots, queue and metrics
+func (s *ollamaScheduler) stats() OllamaQueueStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := OllamaQueueStats{
+		Capacity:           s.capacity,
+		Reserved:           s.reserved,
+		InUse:              s.inUse,
+		Background:         s.background,
+		WaitingInteractive: len(s.waiting[laneInteractive]),
+		WaitingBackground:  len(s.waiting[laneBackground]),
+		Granted:            s.granted,
+		Queued:             s.queued,
+		Rejected:           s.rejected,
+	}
+	if s.queued > 0 {
+		stats.AverageWaitMs = float64(s.waited.Milliseconds()) / float64(s.queued)
+	}
+	return stats
+}
+
+// ConcurrencyConfig gives models or kinds of calls their own Ollama slots, so a
+// backfill of embeddings and chat on a large model do not queue behind each other
+type ConcurrencyConfig struct {
+	Budgets []ConcurrencyBudget `json:"budgets"` // The first matching budget wins; other calls share maxConcurrentOllama
+}
+
+// ConcurrencyBudget limits the calls matching its model and operation
+type ConcurrencyBudget struct {
+	Model               string `json:"model,omitempty"`     // Glob matched against the model name, e.g. "llama3:70b*"; empty matches any
+	Operation           string `json:"operation,omitempty"` // generate or embed; empty matches both
+	MaxConcurrent       int    `json:"maxConcurrent"`
+	InteractiveReserved int    `json:"interactiveReserved"` // Slots background work may not use
+}
+
+func (c ConcurrencyConfig) validate() error {
+	for i, budget := range c.Budgets {
+		if budget.Model == "" && budget.Operation == "" {
+			return fmt.Errorf("concurrency budget %d needs a model or an operation", i+1)
+		}
+		if _, err := path.Match(budget.Model, ""); err != nil {
+			return fmt.Errorf("concurrency budget %d: invalid model pattern %q", i+1, budget.Model)
+		}
+		if budget.Operation != "" && budget.Operation != OperationGenerate && budget.Operation != OperationEmbed {
+			return fmt.Errorf("concurrency budget %d: unknown operation %q (use generate or embed)", i+1, budget.Operation)
+		}
+		if budget.MaxConcurrent < 1 {
+			return fmt.Errorf("concurrency budget %d: maxConcurrent must be at least 1", i+1)
+		}
+		if budget.InteractiveReserved < 0 {
+			return fmt.Errorf("concurrency budget %d: interactiveReserved cannot be negative", i+1)
+		}
+	}
+	return nil
+}
+
+func (b ConcurrencyBudget) matches(operation, model string) bool {
+	if b.Operation != "" && b.Operation != operation {
+		return false
+	}
+	matched, _ := path.Match(b.Model, model)
+	return b.Model == "" || matched
+}
+
+// key identifies a budget across reloads, so its scheduler and metrics are kept
+func (b ConcurrencyBudget) key() string {
+	return b.Operation + "|" + b.Model
+}
+
+// budgetSchedulers holds a scheduler per configured budget
+var budgetSchedulers = struct {
+	mu         sync.Mutex
+	schedulers map[string]*ollamaScheduler
+}{schedulers: map[string]*ollamaScheduler{}}
+
+// applyConcurrency sizes the shared scheduler and those of the budgets. Budgets
+// that are still configured keep their slots and metrics.
+func applyConcurrency(c *Config) {
+	ollamaLimiter.resize(c.MaxConcurrentOllama, c.InteractiveReserved)
+	budgetSchedulers.mu.Lock()
+	defer budgetSchedulers.mu.Unlock()
+	schedulers := make(map[string]*ollamaScheduler, len(c.Concurrency.Budgets))
+	for _, budget := range c.Concurrency.Budgets {
+		s := budgetSchedulers.schedulers[budget.key()]
+		if s == nil {
+			s = &ollamaScheduler{}
+		}
+		s.resize(budget.MaxConcurrent, budget.InteractiveReserved)
+		schedulers[budget.key()] = s
+	}
+	budgetSchedulers.schedulers = schedulers
+}
+
+// schedulerFor returns the scheduler limiting an operation on a model
+func schedulerFor(operation, model string) *ollamaScheduler {
+	for _, budget := range getConfig().Concurrency.Budgets {
+		if !budget.matches(operation, model) {
+			continue
+		}
+		budgetSchedulers.mu.Lock()
+		s := budgetSchedulers.schedulers[budget.key()]
+		budgetSchedulers.mu.Unlock()
+		if s != nil {
+			return s
+		}
+		break
+	}
+	return ollamaLimiter
+}
+
+// acquireOllama waits for a slot for an operation on a model; see acquire
+func acquireOllama(ctx context.Context, operation, model string) (func(), error) {
+	return schedulerFor(operation, model).acquire(ctx)
+}
+
+// OllamaBudgetStats reports a budget and its queue on /api/admin/ollama
+type OllamaBudgetStats struct {
+	Model     string `json:"model,omitempty"`
+	Operation string `json:"operation,omitempty"`
+	OllamaQueueStats
+}
+
+// concurrencyStats reports the shared scheduler and those of the budgets
+func concurrencyStats() (OllamaQueueStats, []OllamaBudgetStats) {
+	budgets := getConfig().Concurrency.Budgets
+	stats := make([]OllamaBudgetStats, 0, len(budgets))
+	budgetSchedulers.mu.Lock()
+	defer budgetSchedulers.mu.Unlock()
+	for _, budget := range budgets {
+		if s := budgetSchedulers.schedulers[budget.key()]; s != nil {
+			stats = append(stats, OllamaBudgetStats{Model: budget.Model, Operation: budget.Operation, OllamaQueueStats: s.stats()})
+		}
+	}
+	return ollamaLimiter.stats(), stats
+}
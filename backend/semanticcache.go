@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// SemanticCacheConfig lets a question reuse the answer to an earlier one about the
+// same document when their embeddings are close enough
+type SemanticCacheConfig struct {
+	Threshold  float64 `json:"threshold"`  // Least cosine similarity for a match; 0 disables matching
+	MaxEntries int     `json:"maxEntries"` // Questions kept per document scope
+}
+
+func (c SemanticCacheConfig) validate() error {
+	if c.Threshold < 0 || c.Threshold > 1 {
+		return errors.New("semanticCache.threshold must be between 0 and 1")
+	}
+	if c.MaxEntries < 1 {
+		return errors.New("semanticCache.maxEntries must be at least 1")
+	}
+	return nil
+}
+
+// CacheMatch reports the earlier question an answer was reused from
+type CacheMatch struct {
+	Query string  `json:"query"`
+	Score float64 `json:"score"` // Cosine similarity of the two questions
+}
+
+// semanticEntry is a cached answer with the question it answered
+type semanticEntry struct {
+	Query    string        `json:"query"`
+	Vector   []float32     `json:"vector"`
+	Response QueryResponse `json:"response"`
+	Answer   storedAnswer  `json:"answer"` // Kept again under a new ID on a match, so the answer can be refined
+}
+
+// semanticCacheMu serializes updates of the entry lists within this process;
+// across instances a lost update only costs a cache entry
+var semanticCacheMu sync.Mutex
+
+// semanticScope returns the key of the cached questions whose answers a request
+// may reuse: those about the same version of the document, asked of the same
+// model with the same options and pinned facts. Callers hold the document lock.
+func semanticScope(doc *Document, req QueryRequest, model string) string {
+	scope, _ := json.Marshal([]interface{}{
+		doc.Name, doc.Version, doc.CreatedAt, doc.EmbeddingModel, len(doc.Chunks),
+		model, req.Section, req.Filters, req.CitationStyle, req.TableMode, req.Verify, req.SelfAssess,
+		req.Deterministic, req.IncludeArchived, req.Fallback, req.QueryType, req.Tenant, pinnedFacts(req.Tenant),
+	})
+	sum := sha256.Sum256(scope)
+	return "semantic:" + documentCacheTag(doc.Name) + hex.EncodeToString(sum[:])
+}
+
+// useSemanticCache tells whether a query may be answered from a similar earlier
+// one. Chat turns depend on the conversation, and documents without embeddings
+// have no model to compare questions with.
+func useSemanticCache(req QueryRequest, doc *Document) bool {
+	config := getConfig()
+	return config.SemanticCache.Threshold > 0 && config.QueryCacheTTL > 0 &&
+		!req.ExactCache && req.SessionID == "" && doc.hasVectors()
+}
+
+// lookupSemanticCache returns the cached answer to the question closest to vec,
+// if it is within the threshold
+func lookupSemanticCache(scope string, vec []float64) (*semanticEntry, *CacheMatch) {
+	var entries []semanticEntry
+	if !getJSON(scope, &entries) {
+		return nil, nil
+	}
+	query := quantizeVector(vec)
+	var best *semanticEntry
+	bestScore := getConfig().SemanticCache.Threshold
+	for i := range entries {
+		cached := make([]float64, len(entries[i].Vector))
+		for j, v := range entries[i].Vector {
+			cached[j] = float64(v)
+		}
+		if len(cached) != len(vec) {
+			continue
+		}
+		if score := cosineSimilarity(query, quantizeVector(cached)); score >= bestScore {
+			best, bestScore = &entries[i], score
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	return best, &CacheMatch{Query: best.Query, Score: bestScore}
+}
+
+// storeSemanticCache adds an answered question to its scope, dropping the oldest
+// beyond MaxEntries
+func storeSemanticCache(scope, query string, vec []float64, resp *QueryResponse, answer storedAnswer) {
+	config := getConfig()
+	entry := semanticEntry{Query: query, Vector: make([]float32, len(vec)), Response: *resp, Answer: answer}
+	for i, v := range vec {
+		entry.Vector[i] = float32(v)
+	}
+	// Per-request parts are not reused
+	entry.Response.AnswerID, entry.Response.Audio, entry.Response.AudioFormat = "", "", ""
+	entry.Response.CorrectedQuery, entry.Response.Suggestion = "", ""
+	entry.Answer.ID = ""
+
+	semanticCacheMu.Lock()
+	defer semanticCacheMu.Unlock()
+	var entries []semanticEntry
+	getJSON(scope, &entries)
+	entries = append(entries, entry)
+	if len(entries) > config.SemanticCache.MaxEntries {
+		entries = entries[len(entries)-config.SemanticCache.MaxEntries:]
+	}
+	setJSON(scope, entries, time.Duration(config.QueryCacheTTL))
+}
+
+// semanticCacheQuery embeds a question and looks for a cached answer to a
+// similar one. The embedding is returned for retrieval and for caching the
+// answer; it is nil when the question could not be embedded.
+func semanticCacheQuery(ctx context.Context, doc *Document, query, scope string) ([]float64, *semanticEntry, *CacheMatch) {
+	vec, err := callOllamaEmbedding(ctx, query, doc.EmbeddingModel)
+	if err != nil {
+		log.Printf("Failed to embed query for the semantic cache of %s: %v", doc.Name, err)
+		return nil, nil, nil
+	}
+	entry, match := lookupSemanticCache(scope, vec)
+	return vec, entry, match
+}
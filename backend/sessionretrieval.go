@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Chunks of a follow-up's own matches added to the passage it reuses, which
+// grows to at most this many more than a query's usual chunks
+const followUpMergeChunks = 2
+
+// Follow-ups with more content words than this ask something new, even when
+// they refer back
+const followUpMaxWords = 4
+
+// followUpReference matches questions pointing back at the previous answer
+var followUpReference = regexp.MustCompile(`(?i)^(?:and|but|so|also|what about|how about|why|then)\b|\b(?:it|its|this|that|these|those|they|them|their|there|the same|above|mentioned|elaborate|more detail|more about|explain further|go on)\b`)
+
+// isFollowUp tells whether a question clearly refers to the passage of the
+// previous turn: it points back and brings few words of its own
+func isFollowUp(query string) bool {
+	return followUpReference.MatchString(query) && len(contentWords(query)) <= followUpMaxWords
+}
+
+// sessionSources returns the chunks the session's latest turn about the document
+// was answered from, when the question is a follow-up to it and they are all
+// still in the document and allowed; nil otherwise. Callers hold the document lock.
+func sessionSources(session *ChatSession, doc *Document, query string, allowed chunkSet) []int {
+	if session == nil || !getConfig().ChatReuseRetrieval || !isFollowUp(query) {
+		return nil
+	}
+	recent := session.recentTurns()
+	var previous *ChatTurn
+	for i := len(recent) - 1; i >= 0 && previous == nil; i-- {
+		if recent[i].Document == doc.Name {
+			previous = &recent[i]
+		}
+	}
+	if previous == nil || len(previous.SourceChunkIDs) == 0 {
+		return nil
+	}
+	position := make(map[int]int, len(doc.ChunkIDs))
+	for i, id := range doc.ChunkIDs {
+		position[id] = i
+	}
+	indices := make([]int, 0, len(previous.SourceChunkIDs))
+	for _, id := range previous.SourceChunkIDs {
+		i, exists := position[id]
+		if !exists || !allowed.has(i) {
+			return nil
+		}
+		indices = append(indices, i)
+	}
+	return indices
+}
+
+// mergeFollowUp adds to a reused passage the best chunks for the follow-up's words
+// the passage does not hold, up to limit chunks; callers hold the document lock
+func mergeFollowUp(doc *Document, query string, rank *chunkRanking, indices []int, limit int) []int {
+	held := make(map[string]bool)
+	for _, i := range indices {
+		for _, w := range tokenize(doc.Chunks[i]) {
+			held[w] = true
+		}
+	}
+	var missing []string
+	for _, w := range contentWords(query) {
+		if !held[w] && !slices.Contains(missing, w) {
+			missing = append(missing, w)
+		}
+	}
+	if len(missing) == 0 || len(indices) >= limit {
+		return indices
+	}
+	_, matched, _ := keywordRetrieve(doc, strings.Join(missing, " "), rank, followUpMergeChunks+len(indices))
+	added := 0
+	for _, i := range matched {
+		if added < followUpMergeChunks && len(indices) < limit && !slices.Contains(indices, i) {
+			indices = append(indices, i)
+			added++
+		}
+	}
+	return indices
+}
+
+// standaloneQuestion has the model restate a follow-up that points back at the
+// conversation as a question that can be understood without it, so retrieval
+// searches for what "it" or "that" stands for. It returns "" for other questions,
+// outside sessions and when the model fails.
+func standaloneQuestion(ctx context.Context, session *ChatSession, query, model string) string {
+	if session == nil || !getConfig().ChatRewriteFollowUps || !followUpReference.MatchString(query) {
+		return ""
+	}
+	recent := session.recentTurns()
+	if len(recent) == 0 && session.Memory == "" {
+		return ""
+	}
+	var conversation strings.Builder
+	if session.Memory != "" {
+		fmt.Fprintf(&conversation, "Summary of earlier turns: %s\n", session.Memory)
+	}
+	for _, turn := range recent {
+		fmt.Fprintf(&conversation, "User: %s\nAssistant: %s\n", turn.Query, excerpt(turn.Response))
+	}
+	prompt := fmt.Sprintf(`Rewrite the follow-up question so it can be understood without the conversation: replace words such as "it", "that" or "they" with what they refer to, and keep everything else. Reply with the question only.
+
+Conversation:
+%s
+Follow-up question: %s
+
+Standalone question:`, conversation.String(), query)
+	response, err := callOllamaContext(ctx, prompt, model)
+	if err != nil {
+		log.Printf("Failed to rewrite a follow-up question: %v", err)
+		return ""
+	}
+	rewritten := strings.TrimSpace(response)
+	if i := strings.IndexByte(rewritten, '\n'); i >= 0 {
+		rewritten = rewritten[:i]
+	}
+	rewritten = strings.Trim(strings.TrimSpace(strings.TrimPrefix(rewritten, "Standalone question:")), `"'* `)
+	if rewritten == "" || strings.EqualFold(rewritten, query) {
+		return ""
+	}
+	return rewritten
+}
+
+// sourceChunkIDs returns the stable IDs of the chunks at indices
+func sourceChunkIDs(doc *Document, indices []int) []int {
+	if len(doc.ChunkIDs) != len(doc.Chunks) {
+		return nil
+	}
+	ids := make([]int, len(indices))
+	for i, idx := range indices {
+		ids[i] = doc.ChunkIDs[idx]
+	}
+	return ids
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Lifetimes of share links
+const (
+	defaultShareLifetime = 7 * 24 * time.Hour
+	maxShareLifetime     = 90 * 24 * time.Hour
+)
+
+// ShareLink lets whoever holds its token query one document or the documents of
+// one collection, until it expires. Only a hash of the token is stored.
+type ShareLink struct {
+	ID         string    `json:"id"`
+	Document   string    `json:"document,omitempty"`
+	Collection string    `json:"collection,omitempty"`
+	Label      string    `json:"label,omitempty"`
+	Tenant     string    `json:"tenant"` // Queries use the tenant's pinned facts
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// ShareRequest creates a share link
+type ShareRequest struct {
+	Document   string `json:"document,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	Label      string `json:"label,omitempty"`
+	ExpiresIn  string `json:"expiresIn,omitempty"` // Go duration or days, e.g. "72h" or "7d"; defaults to 7 days
+}
+
+func shareKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "share:" + hex.EncodeToString(sum[:])
+}
+
+func newShareToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// allows reports whether a share link covers a document
+func (s *ShareLink) allows(doc *Document) bool {
+	if s.Document != "" {
+		return doc.Name == s.Document
+	}
+	return doc.Collection == s.Collection
+}
+
+// sharesHandler lists the request tenant's share links (GET) or creates one
+// (POST). The token is only returned when the link is created.
+func sharesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && !validateMethod(w, r, "POST") {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	if r.Method == "GET" {
+		shares, err := listShares(tenant)
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to list share links: %v", err))
+			return
+		}
+		sendJSON(w, http.StatusOK, map[string]interface{}{"shares": shares})
+		return
+	}
+
+	var req ShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if (req.Document == "") == (req.Collection == "") {
+		sendError(w, http.StatusBadRequest, "Give either a document or a collection")
+		return
+	}
+	if req.Document != "" {
+		if _, exists := documentStore.Get(req.Document); !exists {
+			sendError(w, http.StatusNotFound, "Document not found")
+			return
+		}
+	} else if _, exists := collectionStore.Get(req.Collection); !exists && len(documentStore.ByCollection(req.Collection)) == 0 {
+		sendError(w, http.StatusNotFound, "Collection not found")
+		return
+	}
+	lifetime := defaultShareLifetime
+	if req.ExpiresIn != "" {
+		d, err := parseDays(req.ExpiresIn)
+		if err != nil || d <= 0 || d > maxShareLifetime {
+			sendError(w, http.StatusBadRequest, "expiresIn must be a duration such as 72h or 7d, up to 90d")
+			return
+		}
+		lifetime = d
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "Failed to create token")
+		return
+	}
+	now := time.Now().UTC()
+	share := ShareLink{
+		ID:         randomID(),
+		Document:   req.Document,
+		Collection: req.Collection,
+		Label:      req.Label,
+		Tenant:     tenant,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(lifetime),
+	}
+	data, _ := json.Marshal(share)
+	if err := sharedState.Set(shareKey(token), string(data), lifetime); err != nil {
+		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to store share link: %v", err))
+		return
+	}
+	sendJSON(w, http.StatusCreated, map[string]interface{}{
+		"share": share,
+		"token": token,
+		"url":   "/api/share/" + token,
+	})
+}
+
+// listShares returns a tenant's unexpired share links, newest first
+func listShares(tenant string) ([]ShareLink, error) {
+	keys, err := sharedState.Keys("share:")
+	if err != nil {
+		return nil, err
+	}
+	shares := make([]ShareLink, 0, len(keys))
+	for _, key := range keys {
+		var share ShareLink
+		if getJSON(key, &share) && share.Tenant == tenant {
+			shares = append(shares, share)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].CreatedAt.After(shares[j].CreatedAt) })
+	return shares, nil
+}
+
+// handleShareByID revokes one of the request tenant's share links
+// (DELETE /api/shares/{id})
+func handleShareByID(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/shares/"), "/")
+	if id == "" {
+		sharesHandler(w, r)
+		return
+	}
+	if !validateMethod(w, r, "DELETE") {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	keys, err := sharedState.Keys("share:")
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to read share links: %v", err))
+		return
+	}
+	for _, key := range keys {
+		var share ShareLink
+		if getJSON(key, &share) && share.ID == id && share.Tenant == tenant {
+			if err := sharedState.Delete(key); err != nil {
+				sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to revoke share link: %v", err))
+				return
+			}
+			sendJSON(w, http.StatusOK, map[string]string{"message": "Share link revoked"})
+			return
+		}
+	}
+	sendError(w, http.StatusNotFound, "Share link not found")
+}
+
+// handleShare serves the read-only API of a share link: GET /api/share/{token}
+// describes it and lists its documents, POST /api/share/{token}/query asks one of
+// them a question
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/share/"), "/"), "/")
+	var share ShareLink
+	if parts[0] == "" || !getJSON(shareKey(parts[0]), &share) || time.Now().After(share.ExpiresAt) {
+		sendError(w, http.StatusNotFound, "Share link not found or expired")
+		return
+	}
+
+	var docs []*Document
+	if share.Document != "" {
+		if doc, exists := documentStore.Get(share.Document); exists {
+			docs = append(docs, doc)
+		}
+	} else {
+		docs = activeDocuments(documentStore.ByCollection(share.Collection), false)
+	}
+
+	switch {
+	case len(parts) == 1:
+		if !validateMethod(w, r, "GET") {
+			return
+		}
+		names := make([]string, 0, len(docs))
+		for _, doc := range docs {
+			names = append(names, doc.Name)
+		}
+		sort.Strings(names)
+		sendJSON(w, http.StatusOK, map[string]interface{}{
+			"label":      share.Label,
+			"document":   share.Document,
+			"collection": share.Collection,
+			"expiresAt":  share.ExpiresAt,
+			"documents":  names,
+		})
+	case len(parts) == 2 && parts[1] == "query":
+		if !validateMethod(w, r, "POST") {
+			return
+		}
+		var req QueryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, http.StatusBadRequest, "Invalid request")
+			return
+		}
+		if req.DocumentName == "" && share.Document != "" {
+			req.DocumentName = share.Document
+		}
+		doc, exists := documentStore.Get(req.DocumentName)
+		if !exists || !share.allows(doc) {
+			sendError(w, http.StatusNotFound, "Document not found")
+			return
+		}
+		// Shared queries leave no trace in the owner's chat sessions
+		req.SessionID = ""
+		req.Tenant = share.Tenant
+		resp, err := runQuery(req)
+		if err != nil {
+			sendAPIError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, resp)
+	default:
+		sendError(w, http.StatusNotFound, "Not found")
+	}
+}
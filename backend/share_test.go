@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestShares starts the test with no share links and an empty document store
+// and restores both when it ends
+func useTestShares(t *testing.T) {
+	t.Helper()
+	savedState, savedStore := sharedState, documentStore
+	t.Cleanup(func() { sharedState, documentStore = savedState, savedStore })
+	sharedState = newMemoryKV()
+	documentStore = NewDocumentStore()
+}
+
+// createShare posts a share request as tenant and returns the response
+func createShare(t *testing.T, tenant, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/api/shares", strings.NewReader(body))
+	r.Header.Set(tenantHeader, tenant)
+	w := httptest.NewRecorder()
+	sharesHandler(w, r)
+	return w
+}
+
+func TestShareLinkAllows(t *testing.T) {
+	report := &Document{Name: "report.txt", Collection: "finance"}
+	budget := &Document{Name: "budget.txt", Collection: "finance"}
+	memo := &Document{Name: "memo.txt", Collection: "legal"}
+
+	byDocument := &ShareLink{Document: "report.txt"}
+	byCollection := &ShareLink{Collection: "finance"}
+	tests := []struct {
+		share *ShareLink
+		doc   *Document
+		want  bool
+	}{
+		{byDocument, report, true},
+		{byDocument, budget, false},
+		{byDocument, memo, false},
+		{byCollection, report, true},
+		{byCollection, budget, true},
+		{byCollection, memo, false},
+		{&ShareLink{Collection: ""}, memo, false},
+	}
+	for _, tt := range tests {
+		if got := tt.share.allows(tt.doc); got != tt.want {
+			t.Errorf("share of %q/%q allows %s = %v, want %v", tt.share.Document, tt.share.Collection, tt.doc.Name, got, tt.want)
+		}
+	}
+}
+
+func TestShareLinksScopedToTenant(t *testing.T) {
+	useTestShares(t)
+	documentStore.Set("report.txt", persistTestDocument("report.txt", "Quarterly revenue was 4.2 million."))
+
+	w := createShare(t, "acme", `{"document": "report.txt", "label": "board"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		Share ShareLink `json:"share"`
+		Token string    `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Share.Tenant != "acme" {
+		t.Errorf("share belongs to %q, want acme", created.Share.Tenant)
+	}
+
+	list := func(tenant string) []ShareLink {
+		r := httptest.NewRequest("GET", "/api/shares", nil)
+		r.Header.Set(tenantHeader, tenant)
+		w := httptest.NewRecorder()
+		sharesHandler(w, r)
+		var listing struct {
+			Shares []ShareLink `json:"shares"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+			t.Fatal(err)
+		}
+		return listing.Shares
+	}
+	if shares := list("globex"); len(shares) != 0 {
+		t.Errorf("globex lists %+v", shares)
+	}
+	if shares := list("acme"); len(shares) != 1 || shares[0].ID != created.Share.ID {
+		t.Errorf("acme lists %+v, want its share", shares)
+	}
+
+	revoke := func(tenant string) int {
+		r := httptest.NewRequest("DELETE", "/api/shares/"+created.Share.ID, nil)
+		r.Header.Set(tenantHeader, tenant)
+		w := httptest.NewRecorder()
+		handleShareByID(w, r)
+		return w.Code
+	}
+	if status := revoke("globex"); status != http.StatusNotFound {
+		t.Errorf("revoke as globex: got %d, want 404", status)
+	}
+	if !getJSON(shareKey(created.Token), &ShareLink{}) {
+		t.Fatal("another tenant revoked the share")
+	}
+	if status := revoke("acme"); status != http.StatusOK {
+		t.Errorf("revoke as acme: got %d, want 200", status)
+	}
+	if getJSON(shareKey(created.Token), &ShareLink{}) {
+		t.Error("the share outlived its revocation")
+	}
+}
+
+func TestShareLinkExpiry(t *testing.T) {
+	useTestShares(t)
+	documentStore.Set("report.txt", persistTestDocument("report.txt", "Quarterly revenue was 4.2 million."))
+
+	for _, expiresIn := range []string{"0s", "-1h", "91d", "soon"} {
+		if w := createShare(t, "acme", `{"document": "report.txt", "expiresIn": "`+expiresIn+`"}`); w.Code != http.StatusBadRequest {
+			t.Errorf("expiresIn %q: got %d, want 400", expiresIn, w.Code)
+		}
+	}
+
+	// A link past its expiry is refused even while its record is still stored
+	token, err := newShareToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := ShareLink{ID: randomID(), Document: "report.txt", Tenant: "acme", CreatedAt: time.Now().Add(-2 * time.Hour), ExpiresAt: time.Now().Add(-time.Hour)}
+	data, _ := json.Marshal(expired)
+	if err := sharedState.Set(shareKey(token), string(data), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handleShare(w, httptest.NewRequest("GET", "/api/share/"+token, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expired link: got %d %s, want 404", w.Code, w.Body.String())
+	}
+
+	w = createShare(t, "acme", `{"document": "report.txt", "expiresIn": "1d"}`)
+	var created struct {
+		Share ShareLink `json:"share"`
+		Token string    `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := created.Share.ExpiresAt.Sub(created.Share.CreatedAt); lifetime != 24*time.Hour {
+		t.Errorf("lifetime %v, want 24h", lifetime)
+	}
+	w = httptest.NewRecorder()
+	handleShare(w, httptest.NewRequest("GET", "/api/share/"+created.Token, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "report.txt") {
+		t.Errorf("live link: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestShareLinkQueryScope(t *testing.T) {
+	useTestShares(t)
+	report := persistTestDocument("report.txt", "Quarterly revenue was 4.2 million.")
+	report.Collection = "finance"
+	documentStore.Set("report.txt", report)
+	documentStore.Set("memo.txt", persistTestDocument("memo.txt", "The office moves in May."))
+
+	w := createShare(t, "acme", `{"collection": "finance"}`)
+	var created struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || created.Token == "" {
+		t.Fatalf("create: got %d %s", w.Code, w.Body.String())
+	}
+
+	r := httptest.NewRequest("POST", "/api/share/"+created.Token+"/query", strings.NewReader(`{"documentName": "memo.txt", "query": "When is the move?"}`))
+	w = httptest.NewRecorder()
+	handleShare(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("querying a document outside the share: got %d %s, want 404", w.Code, w.Body.String())
+	}
+}
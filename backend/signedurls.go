@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lifetimes of signed URLs
+const (
+	defaultSignedURLLifetime = time.Hour
+	maxSignedURLLifetime     = 7 * 24 * time.Hour
+)
+
+// Actions a signed URL permits
+const (
+	SignedUpload   = "upload"   // Upload files into one collection
+	SignedDownload = "download" // Download one document's source file
+)
+
+// SignedURLRequest mints a signed URL
+type SignedURLRequest struct {
+	Action     string `json:"action"`               // upload or download
+	Collection string `json:"collection,omitempty"` // For upload
+	Document   string `json:"document,omitempty"`   // For download
+	ExpiresIn  string `json:"expiresIn,omitempty"`  // Go duration or days, e.g. "30m" or "1d"; defaults to 1 hour
+}
+
+var (
+	signingKeyOnce sync.Once
+	signingKey     []byte
+)
+
+// urlSigningKey returns the key signed URLs are signed with: URL_SIGNING_KEY,
+// else ADMIN_TOKEN, else a random key that only lasts until the server restarts
+func urlSigningKey() []byte {
+	signingKeyOnce.Do(func() {
+		if key := getEnv("URL_SIGNING_KEY", getEnv("ADMIN_TOKEN", "")); key != "" {
+			signingKey = []byte(key)
+			return
+		}
+		signingKey = make([]byte, 32)
+		if _, err := rand.Read(signingKey); err != nil {
+			log.Fatalf("Failed to create URL signing key: %v", err)
+		}
+		log.Println("URL_SIGNING_KEY is not set; signed URLs stop working when the server restarts")
+	})
+	return signingKey
+}
+
+// signedUploadIgnoredFields are upload form fields a signed URL's holder may not
+// set: the preset, instructions and models stay those of the collection
+var signedUploadIgnoredFields = []string{"preset", "instructions", "modelName", "embeddingModel"}
+
+// urlSignature signs an action on a target until expires
+func urlSignature(action, target string, expires int64) string {
+	mac := hmac.New(sha256.New, urlSigningKey())
+	fmt.Fprintf(mac, "%s\n%s\n%d", action, target, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// uploadTarget is what an upload URL signs: the collection and the tenant the
+// uploads act for
+func uploadTarget(collection, tenant string) string {
+	return collection + "\n" + tenant
+}
+
+// signedPath returns the URL path and query performing an action on a target.
+// Upload URLs also name the tenant they were minted for.
+func signedPath(action, target, tenant string, expires time.Time) string {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	if action == SignedUpload {
+		query.Set("collection", target)
+		query.Set("tenant", tenant)
+		query.Set("signature", urlSignature(action, uploadTarget(target, tenant), expires.Unix()))
+		return "/api/signed/upload?" + query.Encode()
+	}
+	query.Set("signature", urlSignature(action, target, expires.Unix()))
+	return "/api/signed/download/" + url.PathEscape(target) + "?" + query.Encode()
+}
+
+// verifySignedURL checks a request's signature and expiry for an action on a target
+func verifySignedURL(r *http.Request, action, target string) error {
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || query.Get("signature") == "" {
+		return newAPIError(http.StatusUnauthorized, "Signed URL required")
+	}
+	expected := urlSignature(action, target, expires)
+	if !hmac.Equal([]byte(query.Get("signature")), []byte(expected)) {
+		return newAPIError(http.StatusForbidden, "Invalid signature")
+	}
+	if time.Now().Unix() > expires {
+		return newAPIError(http.StatusForbidden, "Signed URL has expired")
+	}
+	return nil
+}
+
+// signedURLsHandler mints a time-limited URL for uploading into a collection or
+// downloading a document's source file (POST /api/admin/signed-urls). Browsers
+// can use it without holding the admin token.
+func signedURLsHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "POST") || !requireAdmin(w, r) {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	var req SignedURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	lifetime := defaultSignedURLLifetime
+	if req.ExpiresIn != "" {
+		d, err := parseDays(req.ExpiresIn)
+		if err != nil || d <= 0 || d > maxSignedURLLifetime {
+			sendError(w, http.StatusBadRequest, "expiresIn must be a duration such as 30m or 1d, up to 7d")
+			return
+		}
+		lifetime = d
+	}
+
+	var target string
+	switch req.Action {
+	case SignedUpload:
+		target = strings.TrimSpace(req.Collection)
+		if target == "" || strings.Contains(target, "/") {
+			sendError(w, http.StatusBadRequest, "Upload URLs need a valid collection")
+			return
+		}
+	case SignedDownload:
+		target = req.Document
+		if _, exists := documentStore.Get(target); !exists {
+			sendError(w, http.StatusNotFound, "Document not found")
+			return
+		}
+	default:
+		sendError(w, http.StatusBadRequest, "action must be upload or download")
+		return
+	}
+
+	expires := time.Now().Add(lifetime).Truncate(time.Second)
+	log.Printf("Signed %s URL for %s, valid until %s", req.Action, target, expires.Format(time.RFC3339))
+	sendJSON(w, http.StatusCreated, map[string]interface{}{
+		"url":       signedPath(req.Action, target, tenant, expires),
+		"method":    map[string]string{SignedUpload: "POST", SignedDownload: "GET"}[req.Action],
+		"expiresAt": expires.UTC(),
+	})
+}
+
+// signedUploadConflict refuses a signed upload into collection that would
+// replace previous, a document of another collection
+func signedUploadConflict(previous *Document, collection string) error {
+	if previous != nil && previous.Collection != collection {
+		return newAPIError(http.StatusConflict, "A document with this name exists outside the signed collection")
+	}
+	return nil
+}
+
+// signedUploadHandler ingests files into the collection a signed URL names
+// (POST /api/signed/upload). The form is that of /api/document/process, except
+// that the collection and tenant are fixed by the URL and the form cannot pick
+// a preset, instructions or models.
+func signedUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+	collection, tenant := r.URL.Query().Get("collection"), r.URL.Query().Get("tenant")
+	if err := verifySignedURL(r, SignedUpload, uploadTarget(collection, tenant)); err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	r.Header.Set(tenantHeader, tenant)
+	processUploadForm(w, r, collection)
+}
+
+// handleSignedDownload serves the source file of the document a signed URL
+// names (GET /api/signed/download/{name})
+func handleSignedDownload(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+	docName := strings.TrimPrefix(r.URL.Path, "/api/signed/download/")
+	if err := verifySignedURL(r, SignedDownload, docName); err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	if _, ok := getDocumentOrError(w, docName); !ok {
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(docName)))
+	w.Header().Set("Cache-Control", "private, no-store")
+	serveStoredFile(w, r, filepath.Join("./documents", docName))
+}
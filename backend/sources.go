@@ -0,0 +1,811 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source types
+const (
+	SourceURL        = "url"        // A single file or web page
+	SourceS3         = "s3"         // Objects under a bucket prefix
+	SourceFeed       = "feed"       // Entries of an RSS or Atom feed
+	SourceNotion     = "notion"     // Pages of a Notion database or page tree
+	SourceConfluence = "confluence" // Pages of a Confluence space
+	SourceIMAP       = "imap"       // Messages of an IMAP mailbox, one document per conversation
+)
+
+const (
+	sourceSchedulerTick = 15 * time.Second
+	sourceMinInterval   = time.Minute
+	sourceSyncTimeout   = 10 * time.Minute
+)
+
+// Source describes an external location whose content is ingested and kept in sync
+type Source struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	URL        string `json:"url,omitempty"`      // url and feed sources; optional endpoint for s3; imap(s)://host/mailbox
+	Document   string `json:"document,omitempty"` // Document name for url sources (default: last path segment)
+	Bucket     string `json:"bucket,omitempty"`
+	Prefix     string `json:"prefix,omitempty"`
+	Region     string `json:"region,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	Interval   string `json:"interval,omitempty"` // e.g. "1h"; empty syncs only on demand
+	Token      string `json:"token,omitempty"`    // API token or IMAP password; never reported back
+	Email      string `json:"email,omitempty"`    // Confluence Cloud account or IMAP user
+	Space      string `json:"space,omitempty"`    // Confluence space key
+	Database   string `json:"database,omitempty"` // Notion database ID
+	Page       string `json:"page,omitempty"`     // Notion root page ID
+}
+
+// SourceItem tracks change detection for one fetched object
+type SourceItem struct {
+	Key          string     `json:"key"`
+	Document     string     `json:"document,omitempty"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified string     `json:"lastModified,omitempty"`
+	Hash         string     `json:"hash,omitempty"` // SHA-256 of the last ingested content
+	LastChanged  *time.Time `json:"lastChanged,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// SourceStatus is the sync state reported for a source
+type SourceStatus struct {
+	Source
+	Syncing     bool          `json:"syncing"`
+	LastSync    *time.Time    `json:"lastSync,omitempty"`
+	LastSuccess *time.Time    `json:"lastSuccess,omitempty"`
+	NextSync    *time.Time    `json:"nextSync,omitempty"`
+	LastError   string        `json:"lastError,omitempty"`
+	Changed     int           `json:"changed"` // Items re-ingested by the last sync
+	Unchanged   int           `json:"unchanged"`
+	Items       []*SourceItem `json:"items,omitempty"`
+}
+
+type sourceState struct {
+	status   SourceStatus
+	token    string // Kept out of status so it is never returned
+	interval time.Duration
+	items    map[string]*SourceItem
+	mu       sync.Mutex
+}
+
+var sourceRegistry = struct {
+	sources map[string]*sourceState
+	mu      sync.RWMutex
+}{sources: make(map[string]*sourceState)}
+
+// sourcesFile keeps the registered sources in the persistence directory
+const sourcesFile = "sources.json"
+
+// persistedSource is the on-disk form of a source, with its token and the items
+// that let the next sync skip unchanged content
+type persistedSource struct {
+	Source
+	Items       map[string]*SourceItem `json:"items,omitempty"`
+	LastSuccess *time.Time             `json:"lastSuccess,omitempty"`
+}
+
+// sourcesFileMu orders writes of the sources file
+var sourcesFileMu sync.Mutex
+
+// newSourceState prepares a validated source for the registry, keeping its token
+// out of the reported status
+func newSourceState(src Source) (*sourceState, error) {
+	registerSecret(src.Token)
+	state := &sourceState{token: src.Token, items: make(map[string]*SourceItem)}
+	src.Token = ""
+	state.status.Source = src
+	if src.Interval != "" {
+		interval, err := time.ParseDuration(src.Interval)
+		if err != nil || interval < sourceMinInterval {
+			return nil, fmt.Errorf("Interval must be a duration of at least %v", sourceMinInterval)
+		}
+		state.interval = interval
+	}
+	return state, nil
+}
+
+// saveSources writes the registered sources to the persistence directory, so they
+// and their change tracking survive a restart. Tokens are kept in the file, which
+// is encrypted when encryption at rest is on.
+func saveSources() {
+	if persistence == nil {
+		return
+	}
+	sourcesFileMu.Lock()
+	defer sourcesFileMu.Unlock()
+
+	sourceRegistry.mu.RLock()
+	saved := make([]persistedSource, 0, len(sourceRegistry.sources))
+	for _, s := range sourceRegistry.sources {
+		s.mu.Lock()
+		p := persistedSource{Source: s.status.Source, Items: make(map[string]*SourceItem, len(s.items)), LastSuccess: s.status.LastSuccess}
+		p.Token = s.token
+		for k, item := range s.items {
+			c := *item
+			p.Items[k] = &c
+		}
+		s.mu.Unlock()
+		saved = append(saved, p)
+	}
+	sourceRegistry.mu.RUnlock()
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Name < saved[j].Name })
+
+	data, err := json.Marshal(saved)
+	if err == nil {
+		err = writeStoredFile(filepath.Join(persistence.dir, sourcesFile), data)
+	}
+	if err != nil {
+		log.Printf("Failed to save sources: %v", err)
+	}
+}
+
+// loadSources registers the sources saved in dir by a previous run; the scheduler
+// syncs those with an interval right away
+func loadSources(dir string) error {
+	data, err := readStoredFile(filepath.Join(dir, sourcesFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []persistedSource
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("invalid %s: %w", sourcesFile, err)
+	}
+
+	sourceRegistry.mu.Lock()
+	defer sourceRegistry.mu.Unlock()
+	for _, p := range saved {
+		state, err := newSourceState(p.Source)
+		if err != nil {
+			return fmt.Errorf("source %s: %w", p.Name, err)
+		}
+		if p.Items != nil {
+			state.items = p.Items
+		}
+		state.status.LastSuccess = p.LastSuccess
+		sourceRegistry.sources[p.Name] = state
+	}
+	log.Printf("Loaded %d sources from %s", len(saved), dir)
+	return nil
+}
+
+// snapshot copies the status and items for reporting
+func (s *sourceState) snapshot() SourceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := s.status
+	status.Items = make([]*SourceItem, 0, len(s.items))
+	for _, item := range s.items {
+		c := *item
+		status.Items = append(status.Items, &c)
+	}
+	sort.Slice(status.Items, func(i, j int) bool { return status.Items[i].Key < status.Items[j].Key })
+	return status
+}
+
+// sourceFetcher updates items in place and returns how many were re-ingested and left as is
+type sourceFetcher func(ctx context.Context, src Source, items map[string]*SourceItem) (int, int, error)
+
+var sourceFetchers = map[string]sourceFetcher{
+	SourceURL:        syncURLSource,
+	SourceS3:         syncS3Source,
+	SourceFeed:       syncFeedSource,
+	SourceNotion:     syncNotionSource,
+	SourceConfluence: syncConfluenceSource,
+	SourceIMAP:       syncIMAPSource,
+}
+
+// syncSource fetches a source and re-ingests changed content; concurrent calls are ignored
+func syncSource(s *sourceState) {
+	s.mu.Lock()
+	if s.status.Syncing {
+		s.mu.Unlock()
+		return
+	}
+	s.status.Syncing = true
+	src := s.status.Source
+	src.Token = s.token
+	items := make(map[string]*SourceItem, len(s.items))
+	for k, item := range s.items {
+		c := *item
+		items[k] = &c
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), sourceSyncTimeout)
+	defer cancel()
+
+	start := time.Now()
+	changed, unchanged, err := sourceFetchers[src.Type](ctx, src, items)
+
+	s.mu.Lock()
+	s.items = items
+	s.status.Syncing = false
+	s.status.LastSync = &start
+	s.status.Changed, s.status.Unchanged = changed, unchanged
+	if err != nil {
+		s.status.LastError = err.Error()
+		log.Printf("Sync of source %s failed: %v", src.Name, err)
+	} else {
+		s.status.LastError = ""
+		s.status.LastSuccess = &start
+		log.Printf("Synced source %s in %v: %d changed, %d unchanged", src.Name, time.Since(start), changed, unchanged)
+	}
+	if s.interval > 0 {
+		next := start.Add(s.interval)
+		s.status.NextSync = &next
+	}
+	s.mu.Unlock()
+	saveSources()
+}
+
+// runSourceScheduler starts syncs for sources whose refresh interval has elapsed
+func runSourceScheduler() {
+	ticker := time.NewTicker(sourceSchedulerTick)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		sourceRegistry.mu.RLock()
+		for _, s := range sourceRegistry.sources {
+			s.mu.Lock()
+			due := s.interval > 0 && !s.status.Syncing && (s.status.NextSync == nil || !s.status.NextSync.After(now))
+			s.mu.Unlock()
+			if due {
+				go syncSource(s)
+			}
+		}
+		sourceRegistry.mu.RUnlock()
+	}
+}
+
+// sourceHTTPClient fetches source content; the sync context bounds each run
+var sourceHTTPClient = &http.Client{Timeout: 2 * time.Minute}
+
+// fetchResult is a downloaded object with the validators to remember for the next sync
+type fetchResult struct {
+	Body         []byte
+	ContentType  string
+	ETag         string
+	LastModified string
+}
+
+// conditionalGet downloads rawURL unless the server reports it unchanged since item was
+// last fetched, in which case it returns nil. sign, if set, authorizes the request.
+func conditionalGet(ctx context.Context, rawURL string, item *SourceItem, sign func(*http.Request)) (*fetchResult, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if item.Hash != "" {
+		if item.ETag != "" {
+			req.Header.Set("If-None-Match", item.ETag)
+		}
+		if item.LastModified != "" {
+			req.Header.Set("If-Modified-Since", item.LastModified)
+		}
+	}
+	if sign != nil {
+		sign(req)
+	}
+
+	resp, err := sourceHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer closeFile(resp.Body, "source response body")
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxRequestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if len(body) > MaxRequestSize {
+		return nil, fmt.Errorf("content exceeds %d bytes", MaxRequestSize)
+	}
+
+	return &fetchResult{
+		Body:         body,
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// ingestSourceItem stores and ingests fetched content unless its hash is unchanged.
+// It reports whether the document was re-ingested.
+func ingestSourceItem(src Source, item *SourceItem, fetched *fetchResult, meta DocumentMetadata) (bool, error) {
+	sum := sha256.Sum256(fetched.Body)
+	hash := hex.EncodeToString(sum[:])
+	if hash == item.Hash {
+		item.ETag, item.LastModified = fetched.ETag, fetched.LastModified
+		return false, nil
+	}
+
+	if meta.Custom == nil {
+		meta.Custom = make(map[string]string)
+	}
+	meta.Custom["source"] = src.Name
+	err := withDocumentLease(item.Document, func() error {
+		if err := sourceOwnsDocument(src, item.Document); err != nil {
+			return err
+		}
+		filePath, release, err := saveUpload(bytes.NewReader(fetched.Body), item.Document)
+		if err != nil {
+			return err
+		}
+		defer release()
+		_, _, err = ingestFile(filePath, IngestOptions{Name: item.Document, Collection: src.Collection, Metadata: meta})
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	item.Hash = hash
+	item.ETag, item.LastModified = fetched.ETag, fetched.LastModified
+	item.LastChanged = &now
+	return true, nil
+}
+
+// sourceOwnsDocument refuses to replace a document that the source did not
+// ingest, such as an upload that happens to have the same name
+func sourceOwnsDocument(src Source, name string) error {
+	doc, exists := documentStore.Get(name)
+	if !exists {
+		return nil
+	}
+	doc.mu.RLock()
+	owner := doc.Metadata.Custom["source"]
+	doc.mu.RUnlock()
+	if owner != src.Name {
+		return fmt.Errorf("document %s exists and was not ingested from this source; set a different document name", name)
+	}
+	return nil
+}
+
+// trackItem returns the item for key, creating it with the given document name
+func trackItem(items map[string]*SourceItem, key, document string) *SourceItem {
+	item, exists := items[key]
+	if !exists {
+		item = &SourceItem{Key: key, Document: document}
+		items[key] = item
+	}
+	return item
+}
+
+var documentNameUnsafe = regexp.MustCompile(`[^\w.\-]+`)
+
+// sourceDocumentName makes a name usable as a document name and file name
+func sourceDocumentName(name string) string {
+	name = strings.Trim(documentNameUnsafe.ReplaceAllString(name, "_"), "_.")
+	if name == "" {
+		name = "document"
+	}
+	return name
+}
+
+// itemDocumentName names the document for a titled item; a short hash of the
+// item key keeps names unique and stable when titles change
+func itemDocumentName(src Source, title, key, ext string) string {
+	sum := sha256.Sum256([]byte(key))
+	slug := sourceDocumentName(strings.ToLower(title))
+	if len(slug) > 60 {
+		slug = slug[:60]
+	}
+	return fmt.Sprintf("%s-%s-%x%s", src.Name, slug, sum[:3], ext)
+}
+
+// ingestPage ingests an imported page as Markdown, recording its place in the page hierarchy.
+// version identifies the page revision; unchanged revisions are skipped without re-ingesting.
+func ingestPage(src Source, items map[string]*SourceItem, key, title string, path []string, pageURL, markdown, version string) (bool, error) {
+	item := trackItem(items, key, itemDocumentName(src, title, key, ".md"))
+	if pageUnchanged(items, key, version) {
+		return false, recordItemError(item, nil)
+	}
+
+	body := "# " + title + "\n\n" + markdown
+	meta := DocumentMetadata{
+		Title:  title,
+		Custom: map[string]string{"path": strings.Join(path, " / "), "url": pageURL, "pageId": key},
+	}
+	changed, err := ingestSourceItem(src, item, &fetchResult{Body: []byte(body), LastModified: version}, meta)
+	return changed, recordItemError(item, err)
+}
+
+// pageUnchanged reports whether a page revision was already ingested
+func pageUnchanged(items map[string]*SourceItem, key, version string) bool {
+	item, exists := items[key]
+	return exists && item.Hash != "" && version != "" && item.LastModified == version
+}
+
+// withContentExtension makes sure a name has an extension extractText supports,
+// deriving it from the Content-Type when needed. HTML is converted to text.
+func withContentExtension(name string, fetched *fetchResult) string {
+	mediaType, _, _ := mime.ParseMediaType(fetched.ContentType)
+	if mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+		fetched.Body = []byte(htmlToText(string(fetched.Body)))
+		return strings.TrimSuffix(name, path.Ext(name)) + ".txt"
+	}
+	if isSupportedFile(name) {
+		return name
+	}
+	switch mediaType {
+	case "application/pdf":
+		return name + ".pdf"
+	case "text/markdown":
+		return name + ".md"
+	default:
+		return name + ".txt"
+	}
+}
+
+func syncURLSource(ctx context.Context, src Source, items map[string]*SourceItem) (int, int, error) {
+	name := src.Document
+	if name == "" {
+		u, _ := url.Parse(src.URL)
+		name = sourceDocumentName(path.Base(u.Path))
+		if name == "document" {
+			name = sourceDocumentName(u.Host)
+		}
+	}
+	item := trackItem(items, src.URL, name)
+
+	fetched, err := conditionalGet(ctx, src.URL, item, nil)
+	if err != nil {
+		return 0, 0, recordItemError(item, err)
+	}
+	if fetched == nil {
+		return 0, 1, recordItemError(item, nil)
+	}
+	item.Document = withContentExtension(item.Document, fetched)
+
+	changed, err := ingestSourceItem(src, item, fetched, DocumentMetadata{Custom: map[string]string{"url": src.URL}})
+	if err := recordItemError(item, err); err != nil {
+		return 0, 0, err
+	}
+	if !changed {
+		return 0, 1, nil
+	}
+	return 1, 0, nil
+}
+
+// recordItemError stores err on the item and passes it through
+func recordItemError(item *SourceItem, err error) error {
+	item.Error = ""
+	if err != nil {
+		item.Error = err.Error()
+	}
+	return err
+}
+
+// feedEntry covers the RSS <item> and Atom <entry> fields we use
+type feedEntry struct {
+	Title string `xml:"title"`
+	Links []struct {
+		Href string `xml:"href,attr"`
+		Text string `xml:",chardata"`
+	} `xml:"link"`
+	GUID        string `xml:"guid"`
+	ID          string `xml:"id"`
+	Description string `xml:"description"`
+	Summary     string `xml:"summary"`
+	Content     string `xml:"content"`
+	Encoded     string `xml:"encoded"` // content:encoded
+	PubDate     string `xml:"pubDate"`
+	Updated     string `xml:"updated"`
+}
+
+type feedDocument struct {
+	ChannelItems []feedEntry `xml:"channel>item"` // RSS 2.0
+	Items        []feedEntry `xml:"item"`         // RSS 1.0
+	Entries      []feedEntry `xml:"entry"`        // Atom
+}
+
+func (e *feedEntry) link() string {
+	for _, l := range e.Links {
+		if l.Href != "" {
+			return l.Href
+		}
+		if s := strings.TrimSpace(l.Text); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+func (e *feedEntry) date() *time.Time {
+	for _, value := range []string{e.PubDate, e.Updated} {
+		for _, layout := range []string{time.RFC1123Z, time.RFC1123, time.RFC3339} {
+			if t, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+				return &t
+			}
+		}
+	}
+	return nil
+}
+
+func syncFeedSource(ctx context.Context, src Source, items map[string]*SourceItem) (int, int, error) {
+	// The feed itself is tracked as an item without a document
+	feedItem := trackItem(items, src.URL, "")
+	fetched, err := conditionalGet(ctx, src.URL, feedItem, nil)
+	if err != nil {
+		return 0, 0, recordItemError(feedItem, err)
+	}
+	if fetched == nil {
+		return 0, 0, nil
+	}
+
+	var feed feedDocument
+	if err := xml.Unmarshal(fetched.Body, &feed); err != nil {
+		return 0, 0, recordItemError(feedItem, fmt.Errorf("invalid feed: %w", err))
+	}
+	entries := append(append(feed.ChannelItems, feed.Items...), feed.Entries...)
+
+	var changed, unchanged int
+	var failed []string
+	for _, e := range entries {
+		key := e.GUID
+		if key == "" {
+			key = e.ID
+		}
+		if key == "" {
+			key = e.link()
+		}
+		if key == "" {
+			continue
+		}
+
+		item := trackItem(items, key, itemDocumentName(src, e.Title, key, ".txt"))
+
+		body := e.Encoded
+		for _, alt := range []string{e.Content, e.Description, e.Summary} {
+			if strings.TrimSpace(body) == "" {
+				body = alt
+			}
+		}
+		text := strings.TrimSpace(html.UnescapeString(e.Title)) + "\n\n" + htmlToText(body)
+
+		meta := DocumentMetadata{
+			Title:  strings.TrimSpace(html.UnescapeString(e.Title)),
+			Date:   e.date(),
+			Custom: map[string]string{"url": e.link()},
+		}
+		ok, err := ingestSourceItem(src, item, &fetchResult{Body: []byte(text)}, meta)
+		if recordItemError(item, err) != nil {
+			failed = append(failed, item.Document)
+		} else if ok {
+			changed++
+		} else {
+			unchanged++
+		}
+	}
+
+	// Only remember the feed validators once every entry made it in
+	if len(failed) > 0 {
+		return changed, unchanged, recordItemError(feedItem, fmt.Errorf("failed to ingest %s", strings.Join(failed, ", ")))
+	}
+	sum := sha256.Sum256(fetched.Body)
+	feedItem.Hash = hex.EncodeToString(sum[:])
+	feedItem.ETag, feedItem.LastModified = fetched.ETag, fetched.LastModified
+	return changed, unchanged, recordItemError(feedItem, nil)
+}
+
+var (
+	htmlDropPattern  = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)>`)
+	htmlBlockPattern = regexp.MustCompile(`(?i)<(br|p|div|li|tr|h[1-6])[\s/>]|</(p|div|li|tr|h[1-6])>`)
+	htmlTagPattern   = regexp.MustCompile(`<[^>]*>`)
+	blankRunPattern  = regexp.MustCompile(`\n[ \t]*(\n[ \t]*)+`)
+)
+
+var (
+	htmlHeadingPattern = regexp.MustCompile(`(?i)<h([1-6])[^>]*>`)
+	htmlLinkPattern    = regexp.MustCompile(`(?is)<a\s[^>]*href="([^"]*)"[^>]*>(.*?)</a>`)
+	htmlPrePattern     = regexp.MustCompile(`(?is)<pre[^>]*>(.*?)</pre>`)
+	htmlInlinePatterns = []struct {
+		pattern     *regexp.Regexp
+		replacement string
+	}{
+		{regexp.MustCompile(`(?i)</?(strong|b)>`), "**"},
+		{regexp.MustCompile(`(?i)</?(em|i)>`), "_"},
+		{regexp.MustCompile(`(?i)</?code>`), "`"},
+		{regexp.MustCompile(`(?i)<li[^>]*>`), "\n- "},
+		{regexp.MustCompile(`(?i)</(li|tr)>`), ""},
+		{regexp.MustCompile(`(?i)</t[dh]>`), " | "},
+		{regexp.MustCompile(`(?i)</h[1-6]>`), "\n\n"},
+	}
+)
+
+// htmlToMarkdown converts an HTML fragment to Markdown, keeping headings, lists,
+// emphasis, links and code blocks
+func htmlToMarkdown(s string) string {
+	s = htmlDropPattern.ReplaceAllString(s, "")
+	s = htmlPrePattern.ReplaceAllStringFunc(s, func(block string) string {
+		code := htmlPrePattern.FindStringSubmatch(block)[1]
+		return "\n```\n" + htmlTagPattern.ReplaceAllString(code, "") + "\n```\n"
+	})
+	s = htmlHeadingPattern.ReplaceAllStringFunc(s, func(tag string) string {
+		level := int(htmlHeadingPattern.FindStringSubmatch(tag)[1][0] - '0')
+		return "\n\n" + strings.Repeat("#", level) + " "
+	})
+	s = htmlLinkPattern.ReplaceAllString(s, "[$2]($1)")
+	for _, p := range htmlInlinePatterns {
+		s = p.pattern.ReplaceAllString(s, p.replacement)
+	}
+	return htmlToText(s)
+}
+
+// htmlToText reduces an HTML page or fragment to plain text, keeping block breaks
+func htmlToText(s string) string {
+	s = htmlDropPattern.ReplaceAllString(s, "")
+	s = htmlBlockPattern.ReplaceAllStringFunc(s, func(tag string) string { return "\n" + tag })
+	s = htmlTagPattern.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	return strings.TrimSpace(blankRunPattern.ReplaceAllString(s, "\n\n"))
+}
+
+// validateSource checks the fields each source type needs and returns a problem, if any
+func validateSource(src Source) string {
+	isHTTP := func(raw string) bool {
+		u, err := url.Parse(raw)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+	}
+
+	switch src.Type {
+	case SourceS3:
+		if src.Bucket == "" {
+			return "S3 sources need a bucket"
+		}
+	case SourceNotion:
+		if (src.Database == "") == (src.Page == "") {
+			return "Notion sources need either a database or a page"
+		}
+		if src.Token == "" && os.Getenv("NOTION_TOKEN") == "" {
+			return "Notion sources need a token"
+		}
+	case SourceConfluence:
+		if !isHTTP(src.URL) || src.Space == "" {
+			return "Confluence sources need an http(s) url and a space"
+		}
+		if src.Token == "" && !confluenceEnvSite(src.URL) {
+			return "Confluence sources need a token unless their url is CONFLUENCE_URL"
+		}
+	case SourceIMAP:
+		u, err := url.Parse(src.URL)
+		if err != nil || (u.Scheme != "imap" && u.Scheme != "imaps") || u.Host == "" || src.Email == "" {
+			return "IMAP sources need an imap(s)://host/mailbox url and an email (user name)"
+		}
+		if imapUnsafe(src.Email) || imapUnsafe(u.Path) || imapUnsafe(src.Token) {
+			return "IMAP email, mailbox and token cannot contain line breaks"
+		}
+		if src.Token == "" && !imapEnvHost(u) {
+			return "IMAP sources need a token (password) unless their host is IMAP_HOST"
+		}
+	default:
+		if !isHTTP(src.URL) {
+			return "Source needs an http(s) url"
+		}
+	}
+	return ""
+}
+
+// sourcesHandler lists sources with their sync status (GET) or registers one (POST)
+func sourcesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && !validateMethod(w, r, "POST") {
+		return
+	}
+
+	if r.Method == "GET" {
+		sourceRegistry.mu.RLock()
+		result := make([]SourceStatus, 0, len(sourceRegistry.sources))
+		for _, s := range sourceRegistry.sources {
+			status := s.snapshot()
+			status.Items = nil
+			result = append(result, status)
+		}
+		sourceRegistry.mu.RUnlock()
+		sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+		sendJSON(w, http.StatusOK, map[string]interface{}{"sources": result})
+		return
+	}
+
+	var src Source
+	if err := json.NewDecoder(r.Body).Decode(&src); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	src.Name = strings.TrimSpace(src.Name)
+	if src.Name == "" || strings.Contains(src.Name, "/") {
+		sendError(w, http.StatusBadRequest, "Invalid source name")
+		return
+	}
+	if _, ok := sourceFetchers[src.Type]; !ok {
+		sendError(w, http.StatusBadRequest, "Source type must be url, s3, feed, notion, confluence or imap")
+		return
+	}
+	if message := validateSource(src); message != "" {
+		sendError(w, http.StatusBadRequest, message)
+		return
+	}
+	if src.Document != "" {
+		src.Document = sourceDocumentName(src.Document)
+	}
+
+	state, err := newSourceState(src)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sourceRegistry.mu.Lock()
+	sourceRegistry.sources[src.Name] = state
+	sourceRegistry.mu.Unlock()
+	saveSources()
+
+	go syncSource(state)
+	sendJSON(w, http.StatusAccepted, state.snapshot())
+}
+
+func handleSourceByName(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/source/")
+	parts := strings.Split(path, "/")
+	name := parts[0]
+
+	sourceRegistry.mu.RLock()
+	state, exists := sourceRegistry.sources[name]
+	sourceRegistry.mu.RUnlock()
+	if !exists {
+		sendError(w, http.StatusNotFound, "Source not found")
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "sync" {
+		if !validateMethod(w, r, "POST") {
+			return
+		}
+		go syncSource(state)
+		sendJSON(w, http.StatusAccepted, map[string]string{"message": "Sync started"})
+	} else if len(parts) != 1 {
+		sendError(w, http.StatusNotFound, "Not found")
+	} else if r.Method == "DELETE" {
+		// Documents ingested from the source are kept
+		sourceRegistry.mu.Lock()
+		delete(sourceRegistry.sources, name)
+		sourceRegistry.mu.Unlock()
+		saveSources()
+		sendJSON(w, http.StatusOK, map[string]string{"message": "Source deleted"})
+	} else if validateMethod(w, r, "GET") {
+		sendJSON(w, http.StatusOK, state.snapshot())
+	}
+}
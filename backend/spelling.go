@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// Spelling correction modes for queries
+const (
+	SpellingOff     = "off"
+	SpellingSuggest = "suggest" // Return a corrected query without using it
+	SpellingAuto    = "auto"    // Retrieve and answer with the corrected query
+)
+
+// Words shorter than this are never corrected
+const minCorrectedWordLength = 4
+
+func validSpellingMode(mode string) bool {
+	return mode == SpellingOff || mode == SpellingSuggest || mode == SpellingAuto
+}
+
+// buildVocabulary counts the chunks each normalized word of a document occurs in
+func buildVocabulary(wordIndex map[string][]int) map[string]int {
+	vocabulary := make(map[string]int, len(wordIndex))
+	for word, chunks := range wordIndex {
+		if w := normalizeWord(word); w != "" {
+			vocabulary[w] += len(chunks)
+		}
+	}
+	return vocabulary
+}
+
+// spellingMode returns the mode a query asked for, or else the configured default
+func spellingMode(requested string) (string, error) {
+	if requested == "" {
+		return getConfig().SpellCorrection, nil
+	}
+	if !validSpellingMode(requested) {
+		return "", newAPIError(http.StatusBadRequest, fmt.Sprintf("Unsupported spelling mode %q (use off, suggest or auto)", requested))
+	}
+	return requested, nil
+}
+
+// correctQuery replaces query words missing from the vocabulary with the closest
+// known word, keeping the surrounding punctuation. It returns "" when nothing
+// changed.
+func correctQuery(query string, vocabulary map[string]int) string {
+	words := strings.Fields(query)
+	changed := false
+	for i, token := range words {
+		start := strings.IndexFunc(token, isWordRune)
+		if start < 0 {
+			continue
+		}
+		end := strings.LastIndexFunc(token, isWordRune) + 1
+		if end <= start {
+			continue
+		}
+		if correction := correctWord(strings.ToLower(token[start:end]), vocabulary); correction != "" {
+			words[i] = token[:start] + correction + token[end:]
+			changed = true
+		}
+	}
+	if !changed {
+		return ""
+	}
+	return strings.Join(words, " ")
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// correctWord returns the known word nearest to an unknown one, preferring fewer
+// edits and then more frequent words, or "" when the word is known or has no
+// close match. Words holding digits are codes and identifiers, so they are kept.
+func correctWord(word string, vocabulary map[string]int) string {
+	length := len([]rune(word))
+	if length < minCorrectedWordLength || vocabulary[word] > 0 || strings.IndexFunc(word, unicode.IsDigit) >= 0 {
+		return ""
+	}
+	limit := 1
+	if length >= 8 {
+		limit = 2
+	}
+
+	best, bestDistance, bestCount := "", limit+1, 0
+	for candidate, count := range vocabulary {
+		if d := len([]rune(candidate)) - length; d > limit || -d > limit {
+			continue
+		}
+		distance := editDistance(word, candidate, limit)
+		if distance < bestDistance || distance == bestDistance && (count > bestCount || count == bestCount && candidate < best) {
+			best, bestDistance, bestCount = candidate, distance, count
+		}
+	}
+	if bestDistance > limit {
+		return ""
+	}
+	return best
+}
+
+// editDistance counts the insertions, deletions, substitutions and transpositions
+// of adjacent letters turning a into b, stopping early once it exceeds limit
+func editDistance(a, b string, limit int) int {
+	s, t := []rune(a), []rune(b)
+	// Three rows of the optimal string alignment table
+	prev2 := make([]int, len(t)+1)
+	prev := make([]int, len(t)+1)
+	cur := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(t)]
+}
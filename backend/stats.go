@@ -0,0 +1,172 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const wordsPerMinute = 200
+
+// Common function words per language, used for language guessing and term filtering
+var stopwords = map[string]map[string]bool{
+	"en": wordSet("the and of to a in is that for it as with was on be by this are or from at an not which have has but were their been they its"),
+	"es": wordSet("el la de que y en los se del las un por con no una su para es al lo como más pero sus le ya o este"),
+	"fr": wordSet("le la les de des et en un une du que qui est dans pour pas au sur ce il elle avec par se plus sont"),
+	"de": wordSet("der die das und in zu den von mit ist des sich nicht auf für ein eine dem im auch es an als werden"),
+	"it": wordSet("il di che la e un una per in non del della le si con sono da al come anche gli lo ma nel"),
+	"pt": wordSet("o a de que e do da em um uma para com não os as no na por mais dos das se ao como foi"),
+	"nl": wordSet("de het een en van in is dat op te zijn voor met die niet aan er als bij ook door om maar"),
+}
+
+func wordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+// DocumentStats summarizes the shape and quality of an extracted document
+type DocumentStats struct {
+	WordCount          int        `json:"wordCount"`
+	ReadingTimeMinutes float64    `json:"readingTimeMinutes"`
+	Language           string     `json:"language"`
+	UniqueTermCount    int        `json:"uniqueTermCount"`
+	TopTerms           []TermFreq `json:"topTerms"`
+	PageCount          int        `json:"pageCount,omitempty"`
+	ChunkCount         int        `json:"chunkCount"`
+	AvgChunkLength     float64    `json:"avgChunkLength"`
+	ExtractionQuality  float64    `json:"extractionQuality"`
+}
+
+// TermFreq pairs a term with its occurrence count
+type TermFreq struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+// tokenize splits text into lowercase letter/digit runs
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// detectLanguage picks the language whose stopwords appear most often
+func detectLanguage(tokens []string) string {
+	best, bestCount := "unknown", 0
+	for lang, words := range stopwords {
+		count := 0
+		for _, t := range tokens {
+			if words[t] {
+				count++
+			}
+		}
+		if count > bestCount || (count == bestCount && count > 0 && lang < best) {
+			best, bestCount = lang, count
+		}
+	}
+	return best
+}
+
+// extractionQuality estimates how cleanly text was extracted, from 0 (garbage) to 1.
+// It penalizes control/replacement characters and tokens that don't look like words.
+func extractionQuality(text string, tokens []string) float64 {
+	if len(text) == 0 {
+		return 0
+	}
+
+	var total, clean int
+	for _, r := range text {
+		total++
+		if r == unicode.ReplacementChar || (unicode.IsControl(r) && !unicode.IsSpace(r)) {
+			continue
+		}
+		clean++
+	}
+	charScore := float64(clean) / float64(total)
+
+	if len(tokens) == 0 {
+		return charScore * 0.5
+	}
+	wordLike := 0
+	for _, t := range tokens {
+		if n := len([]rune(t)); n >= 1 && n <= 20 {
+			wordLike++
+		}
+	}
+	tokenScore := float64(wordLike) / float64(len(tokens))
+
+	return math.Round(charScore*tokenScore*100) / 100
+}
+
+func computeDocumentStats(doc *Document) DocumentStats {
+	doc.mu.RLock()
+	text := doc.plainText(0)
+	chunks := doc.Chunks
+	pageCount := doc.PageCount
+	doc.mu.RUnlock()
+
+	tokens := tokenize(text)
+	lang := detectLanguage(tokens)
+
+	counts := make(map[string]int)
+	for _, t := range tokens {
+		counts[t]++
+	}
+
+	skip := stopwords[lang]
+	terms := make([]TermFreq, 0, len(counts))
+	for term, count := range counts {
+		if skip[term] || len([]rune(term)) < 3 {
+			continue
+		}
+		terms = append(terms, TermFreq{term, count})
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].Count != terms[j].Count {
+			return terms[i].Count > terms[j].Count
+		}
+		return terms[i].Term < terms[j].Term
+	})
+	if len(terms) > 10 {
+		terms = terms[:10]
+	}
+
+	var avgChunk float64
+	if len(chunks) > 0 {
+		total := 0
+		for _, c := range chunks {
+			total += len(c)
+		}
+		avgChunk = math.Round(float64(total)/float64(len(chunks))*10) / 10
+	}
+
+	return DocumentStats{
+		WordCount:          len(tokens),
+		ReadingTimeMinutes: math.Round(float64(len(tokens))/wordsPerMinute*10) / 10,
+		Language:           lang,
+		UniqueTermCount:    len(counts),
+		TopTerms:           terms,
+		PageCount:          pageCount,
+		ChunkCount:         len(chunks),
+		AvgChunkLength:     avgChunk,
+		ExtractionQuality:  extractionQuality(text, tokens),
+	}
+}
+
+func handleGetDocumentStats(w http.ResponseWriter, r *http.Request, docName string) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+
+	doc, ok := getDocumentOrError(w, docName)
+	if !ok {
+		return
+	}
+
+	sendJSON(w, http.StatusOK, computeDocumentStats(doc))
+}
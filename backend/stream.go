@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Plain text and Markdown files at least this large are chunked while they are
+// read instead of being loaded whole (0 disables streaming)
+var streamExtractThreshold = envInt("STREAM_EXTRACT_THRESHOLD", 32<<20)
+
+// Longest line inspected for a Markdown heading; longer lines are never headings
+const maxHeadingLine = 1024
+
+// streamedText is the result of chunking a file as it is read
+type streamedText struct {
+	Chunks []string
+	Starts []int
+	TOC    []TOCEntry // Markdown headings; ChunkStart holds the heading's word offset
+	Size   int        // Bytes read
+}
+
+// streamable reports whether a file can be chunked as it is read. Streaming skips
+// the stages that need the whole text: preprocessing rules, text hooks and reuse of
+// a stored version's chunks.
+func streamable(filePath string, opts IngestOptions) bool {
+	if streamExtractThreshold == 0 {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".txt", ".md":
+	default:
+		return false
+	}
+	info, err := os.Stat(filePath)
+	if err != nil || info.Size() < streamExtractThreshold {
+		return false
+	}
+	return len(ingestRules(opts)) == 0 &&
+		!hasIngestHooks(StagePostExtract) && !hasIngestHooks(StagePreChunk)
+}
+
+// streamChunkFile chunks a plain text or Markdown file as it is read
+func streamChunkFile(filePath string, opts ChunkOptions) (*streamedText, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	defer closeFile(file, filePath)
+
+	markdown := strings.ToLower(filepath.Ext(filePath)) == ".md"
+	return streamChunks(bufio.NewReaderSize(file, 256*1024), opts, markdown)
+}
+
+// streamChunks splits text read from r exactly as chunkWithOptions splits the
+// whole text, holding no more than the current chunk and segment in memory
+func streamChunks(r *bufio.Reader, opts ChunkOptions, markdown bool) (*streamedText, error) {
+	size := opts.Size
+	if size <= 0 {
+		size = getConfig().ChunkSize
+	}
+	result := &streamedText{Chunks: []string{}, Starts: []int{}}
+
+	// Words from curStart onwards that belong to the chunk being built, the first
+	// carried of them repeated from the previous chunk
+	var window []string
+	curStart, curSize, carried := 0, 0, 0
+
+	flush := func() {
+		if len(window) <= carried {
+			return
+		}
+		result.Chunks = append(result.Chunks, strings.Join(window, " "))
+		result.Starts = append(result.Starts, curStart)
+
+		// Carry the trailing overlap words into the next chunk; a chunk shorter
+		// than the overlap carries all but its first word
+		keep := max(min(opts.Overlap, len(window)-1), 0)
+		curStart += len(window) - keep
+		window = append(window[:0:0], window[len(window)-keep:]...)
+		curSize, carried = 0, keep
+		for _, w := range window {
+			curSize += len(w) + 1
+		}
+	}
+	add := func(words []string, segSize int) {
+		if curSize+segSize > size && len(window) > carried {
+			flush()
+		}
+		// Carried words give way to a segment that would not fit beside them
+		for carried > 0 && curSize+segSize > size {
+			curSize -= len(window[0]) + 1
+			window, carried = window[1:], carried-1
+			curStart++
+		}
+		window = append(window, words...)
+		curSize += segSize
+	}
+
+	// Words of the segment being read; a segment that outgrows the chunk size is
+	// added word by word from then on, as chunkWithOptions does
+	var segment []string
+	segSize, overflowing := 0, false
+	endSegment := func() {
+		if len(segment) > 0 {
+			add(segment, segSize)
+		}
+		segment, segSize, overflowing = segment[:0], 0, false
+	}
+	addWord := func(w string) {
+		n := len(w) + 1
+		switch {
+		case opts.Strategy != ChunkSentence && opts.Strategy != ChunkParagraph:
+			add([]string{w}, n)
+			return
+		case overflowing:
+			add([]string{w}, n)
+		default:
+			segment = append(segment, w)
+			segSize += n
+			if segSize > size && len(segment) > 1 {
+				for _, s := range segment {
+					add([]string{s}, len(s)+1)
+				}
+				segment, segSize, overflowing = segment[:0], 0, true
+			}
+		}
+		if opts.Strategy == ChunkSentence {
+			trimmed := strings.TrimRight(w, `"')]»”’`)
+			if strings.HasSuffix(trimmed, ".") || strings.HasSuffix(trimmed, "!") || strings.HasSuffix(trimmed, "?") {
+				endSegment()
+			}
+		}
+	}
+
+	// Tokenizer state: the word being read, whether the whitespace since the last
+	// word holds a blank line, and the start of the current line for headings
+	var word strings.Builder
+	wordCount := 0
+	afterNewline, paragraphBreak := false, false
+	var line strings.Builder
+	lineWordStart, lineTooLong, inFence := 0, false, false
+
+	endLine := func() {
+		if markdown && !lineTooLong {
+			if entry, ok := markdownHeading(line.String(), &inFence); ok {
+				entry.ChunkStart = lineWordStart + 1 // After the "#" marker
+				result.TOC = append(result.TOC, entry)
+			}
+		}
+		line.Reset()
+		lineWordStart, lineTooLong = wordCount, false
+	}
+	endWord := func() {
+		if word.Len() == 0 {
+			return
+		}
+		if paragraphBreak && opts.Strategy == ChunkParagraph {
+			endSegment()
+		}
+		paragraphBreak = false
+		addWord(word.String())
+		word.Reset()
+		wordCount++
+	}
+
+	for {
+		c, n, err := r.ReadRune()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		result.Size += n
+		if c == utf8.RuneError && n == 1 {
+			// Keep invalid bytes in words as strings.Fields does
+			_ = r.UnreadRune()
+			b, _ := r.ReadByte()
+			word.WriteByte(b)
+			if markdown && !lineTooLong {
+				line.WriteByte(b)
+			}
+			afterNewline = false
+			continue
+		}
+
+		if markdown && c != '\n' && !lineTooLong {
+			if line.Len()+n > maxHeadingLine {
+				lineTooLong = true
+			} else {
+				line.WriteRune(c)
+			}
+		}
+
+		if !unicode.IsSpace(c) {
+			word.WriteRune(c)
+			afterNewline = false
+			continue
+		}
+
+		endWord()
+		switch c {
+		case '\n':
+			if afterNewline {
+				paragraphBreak = true
+			}
+			afterNewline = true
+			endLine()
+		case '\f':
+			paragraphBreak = true
+		case ' ', '\t', '\r':
+		default:
+			afterNewline = false
+		}
+	}
+	endWord()
+	endLine()
+	endSegment()
+	flush()
+
+	// As in chunkWithOptions, input that is only whitespace still yields one chunk
+	if wordCount == 0 && result.Size > 0 {
+		result.Chunks, result.Starts = []string{""}, []int{0}
+	}
+	return result, nil
+}
+
+// plainText returns the document's text, rebuilt from its chunks for streamed
+// documents, which keep no copy; whitespace is collapsed in rebuilt text. Rebuilding
+// stops once limit bytes are written (0 for no limit). Callers hold the document lock.
+func (d *Document) plainText(limit int) string {
+	if d.Text != "" || len(d.Chunks) == 0 || len(d.chunkStarts) != len(d.Chunks) {
+		return d.Text
+	}
+	var b strings.Builder
+	next := 0 // Word offset following the words written so far
+	for i, chunk := range d.Chunks {
+		if limit > 0 && b.Len() >= limit {
+			break
+		}
+		words := strings.Fields(chunk)
+		if skip := next - d.chunkStarts[i]; skip > 0 {
+			words = words[min(skip, len(words)):]
+		}
+		for _, w := range words {
+			if b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(w)
+		}
+		next = max(next, d.chunkStarts[i]+len(strings.Fields(chunk)))
+	}
+	return b.String()
+}
+
+// locateStreamedTOC maps headings found while streaming, whose ChunkStart holds
+// their word offset, onto chunk ranges
+func locateStreamedTOC(entries []TOCEntry, chunkStarts []int) []TOCEntry {
+	if len(entries) == 0 {
+		return nil
+	}
+	located := make([]TOCEntry, len(entries))
+	for i, e := range entries {
+		located[i] = e
+		located[i].ChunkStart = chunkAt(chunkStarts, e.ChunkStart)
+	}
+	setSectionEnds(located, len(chunkStarts))
+	return located
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// How records in structured files are stored
+// Chunk metadata holding the title of the record a chunk came from
+const MetaTitle = "title"
+
+const (
+	RecordPerChunk    = "chunk"    // One document; each record is chunked on its own
+	RecordPerDocument = "document" // One document per record
+)
+
+// Longest JSON Lines record accepted
+const maxJSONLineSize = 16 << 20
+
+// RecordMapping selects how records in structured files become text and metadata.
+// In .json and .jsonl files fields are dot-separated paths such as "customer.name",
+// and arrays along a path contribute every element; in .xml files they are XPaths
+// relative to the record element.
+type RecordMapping struct {
+	Records  string            `json:"records,omitempty"`  // Path to the records in a .json file, or XPath of the record elements; the whole file when empty
+	Title    string            `json:"title,omitempty"`    // Field heading each record's text
+	Text     []string          `json:"text,omitempty"`     // Fields forming the text; every other field, labelled, when empty
+	Metadata map[string]string `json:"metadata,omitempty"` // Chunk metadata name to field
+	ID       string            `json:"id,omitempty"`       // Field naming per-record documents; the record number when empty
+	Split    string            `json:"split,omitempty"`    // chunk (default) or document
+}
+
+// TextRecord is one record of a structured file
+type TextRecord struct {
+	Title    string
+	Text     string // Title first, when there is one
+	Metadata map[string]string
+}
+
+func (m *RecordMapping) validate() error {
+	switch m.Split {
+	case "", RecordPerChunk, RecordPerDocument:
+	default:
+		return fmt.Errorf("unknown split %q (use chunk or document)", m.Split)
+	}
+	for name, field := range m.Metadata {
+		if name == "" || field == "" {
+			return errors.New("metadata entries need a name and a field")
+		}
+	}
+	return nil
+}
+
+// parseRecordMapping reads a mapping supplied as JSON; empty input means none
+func parseRecordMapping(raw string) (*RecordMapping, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var m RecordMapping
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid mapping: %v", err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("invalid mapping: %v", err)
+	}
+	return &m, nil
+}
+
+// recordSource is one record of a structured file before mapping
+type recordSource interface {
+	values(path string) []string             // Non-empty values at a field path
+	defaultText(used map[string]bool) string // Text when the mapping selects none; used holds mapped paths
+	encode() []byte                          // The record as a file of its own
+}
+
+func isStructuredFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".jsonl", ".xml", ".dita":
+		return true
+	}
+	return false
+}
+
+// isXMLFile reports whether a file holds XML: .xml, or .dita for DITA topics
+func isXMLFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".xml" || ext == ".dita"
+}
+
+// readRecords reads the records of a structured file
+func readRecords(filePath string, mapping *RecordMapping) ([]recordSource, error) {
+	if isXMLFile(filePath) {
+		return readXMLRecords(filePath, mapping)
+	}
+	values, err := readJSONRecords(filePath, mapping)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]recordSource, len(values))
+	for i, v := range values {
+		records[i] = jsonRecord{v}
+	}
+	return records, nil
+}
+
+// extractMappedText extracts a structured file with a mapping, which may be nil.
+// XML files without one are read as a single document rather than as records.
+func extractMappedText(filePath string, mapping *RecordMapping) (*ExtractedText, error) {
+	if mapping == nil && isXMLFile(filePath) {
+		return extractXMLDocument(filePath)
+	}
+	return extractRecordsText(filePath, mapping)
+}
+
+// extractRecordsText extracts the records of a structured file
+func extractRecordsText(filePath string, mapping *RecordMapping) (*ExtractedText, error) {
+	if mapping == nil {
+		mapping = &RecordMapping{}
+	}
+	sources, err := readRecords(filePath, mapping)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]TextRecord, 0, len(sources))
+	for _, src := range sources {
+		records = append(records, mapping.record(src))
+	}
+	extracted := &ExtractedText{Text: joinRecords(records), Records: records}
+
+	// A file holding one record describes a single item
+	if len(records) == 1 {
+		extracted.Metadata.Title = records[0].Title
+		extracted.Metadata.Custom = records[0].Metadata
+	}
+	return extracted, nil
+}
+
+// joinRecords returns a document's text with one paragraph block per record
+func joinRecords(records []TextRecord) string {
+	texts := make([]string, len(records))
+	for i, rec := range records {
+		texts[i] = rec.Text
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// readJSONRecords decodes the records of a .json or .jsonl file
+func readJSONRecords(filePath string, mapping *RecordMapping) ([]interface{}, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	defer closeFile(file, filePath)
+
+	if strings.ToLower(filepath.Ext(filePath)) == ".jsonl" {
+		var records []interface{}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxJSONLineSize)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			value, err := decodeJSON(bytes.NewReader(scanner.Bytes()))
+			if err != nil {
+				return nil, fmt.Errorf("invalid JSON on line %d: %v", line, err)
+			}
+			records = append(records, value)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		return records, nil
+	}
+
+	value, err := decodeJSON(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if mapping.Records != "" {
+		found := jsonPath(value, mapping.Records)
+		if len(found) == 0 {
+			return nil, fmt.Errorf("no records at %q", mapping.Records)
+		}
+		return found, nil
+	}
+	if list, ok := value.([]interface{}); ok {
+		return list, nil
+	}
+	return []interface{}{value}, nil
+}
+
+func decodeJSON(r io.Reader) (interface{}, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// jsonPath returns the values at a dotted path, descending into every element of
+// arrays met along the way
+func jsonPath(value interface{}, path string) []interface{} {
+	current := []interface{}{value}
+	for _, key := range strings.Split(path, ".") {
+		var next []interface{}
+		for _, v := range current {
+			next = appendField(next, v, key)
+		}
+		current = next
+	}
+	// A path ending at an array yields its elements
+	var values []interface{}
+	for _, v := range current {
+		if list, ok := v.([]interface{}); ok {
+			values = append(values, list...)
+		} else {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func appendField(values []interface{}, v interface{}, key string) []interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		if field, ok := node[key]; ok && field != nil {
+			values = append(values, field)
+		}
+	case []interface{}:
+		for _, item := range node {
+			values = appendField(values, item, key)
+		}
+	}
+	return values
+}
+
+// jsonString renders scalar values; objects and arrays are written as JSON
+func jsonString(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	case nil:
+		return ""
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// field returns the values at a path joined with commas
+func field(src recordSource, path string) string {
+	if path == "" {
+		return ""
+	}
+	return strings.Join(src.values(path), ", ")
+}
+
+// record converts one record into text and metadata
+func (m *RecordMapping) record(src recordSource) TextRecord {
+	rec := TextRecord{Title: field(src, m.Title)}
+	if len(m.Metadata) > 0 {
+		rec.Metadata = make(map[string]string, len(m.Metadata))
+		for name, path := range m.Metadata {
+			if s := field(src, path); s != "" {
+				rec.Metadata[name] = s
+			}
+		}
+	}
+
+	paragraphs := []string{rec.Title}
+	if len(m.Text) > 0 {
+		for _, path := range m.Text {
+			if s := field(src, path); s != "" {
+				paragraphs = append(paragraphs, s)
+			}
+		}
+	} else {
+		used := map[string]bool{m.Title: true, m.ID: true}
+		for _, path := range m.Metadata {
+			used[path] = true
+		}
+		paragraphs = append(paragraphs, src.defaultText(used))
+	}
+	rec.Text = strings.TrimSpace(strings.Join(paragraphs, "\n\n"))
+	return rec
+}
+
+// jsonRecord is a decoded JSON value
+type jsonRecord struct {
+	value interface{}
+}
+
+func (r jsonRecord) values(path string) []string {
+	var values []string
+	for _, v := range jsonPath(r.value, path) {
+		if s := strings.TrimSpace(jsonString(v)); s != "" {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// defaultText writes every field not used elsewhere as "field: value" so values
+// keep their meaning
+func (r jsonRecord) defaultText(used map[string]bool) string {
+	var lines []string
+	flattenJSON(r.value, "", func(path, s string) {
+		if !used[path] && strings.TrimSpace(s) != "" {
+			lines = append(lines, path+": "+s)
+		}
+	})
+	return strings.Join(lines, "\n")
+}
+
+func (r jsonRecord) encode() []byte {
+	data, _ := json.Marshal(r.value)
+	return data
+}
+
+// flattenJSON calls fn for every scalar in value with its dotted path, in key order.
+// Arrays of scalars are reported once, joined with commas.
+func flattenJSON(value interface{}, prefix string, fn func(path, value string)) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+	switch node := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(node))
+		for key := range node {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			flattenJSON(node[key], join(key), fn)
+		}
+	case []interface{}:
+		var scalars []string
+		for _, item := range node {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				flattenJSON(item, prefix, fn)
+			default:
+				if s := jsonString(item); s != "" {
+					scalars = append(scalars, s)
+				}
+			}
+		}
+		if len(scalars) > 0 {
+			fn(prefix, strings.Join(scalars, ", "))
+		}
+	default:
+		fn(prefix, jsonString(node))
+	}
+}
+
+// chunkRecords chunks each record on its own so no chunk spans two records. It
+// returns the chunks, their word offsets in the joined text and each chunk's
+// record metadata.
+func chunkRecords(records []TextRecord, opts ChunkOptions) ([]string, []int, []map[string]string) {
+	var chunks []string
+	var starts []int
+	var metadata []map[string]string
+	offset := 0
+	for _, rec := range records {
+		meta := rec.Metadata
+		if _, mapped := meta[MetaTitle]; rec.Title != "" && !mapped {
+			meta = maps.Clone(meta)
+			if meta == nil {
+				meta = make(map[string]string, 1)
+			}
+			meta[MetaTitle] = rec.Title
+		}
+		recChunks, recStarts := chunkWithOptions(rec.Text, opts)
+		for i, chunk := range recChunks {
+			chunks = append(chunks, chunk)
+			starts = append(starts, offset+recStarts[i])
+			metadata = append(metadata, meta)
+		}
+		offset += len(strings.Fields(rec.Text))
+	}
+	return chunks, starts, metadata
+}
+
+// splitsIntoDocuments reports whether a file's records become separate documents
+func splitsIntoDocuments(filePath string, opts IngestOptions) bool {
+	return opts.RecordMapping != nil && opts.RecordMapping.Split == RecordPerDocument && isStructuredFile(filePath)
+}
+
+// ingestRecordDocuments stores each record of a saved structured file as its own
+// file and document, named after the file and the record's ID field, then removes
+// the combined file
+func ingestRecordDocuments(filePath string, opts IngestOptions) (string, error) {
+	mapping := opts.RecordMapping
+	raw, err := readRecords(filePath, mapping)
+	if err != nil {
+		return "", newAPIError(http.StatusUnprocessableEntity, fmt.Sprintf("Failed to extract text: %v", err))
+	}
+
+	// Each stored record is a single-record file, so the mapping no longer selects
+	// or splits records
+	perRecord := *mapping
+	perRecord.Records, perRecord.Split = "", ""
+	ext := strings.ToLower(filepath.Ext(opts.Name))
+	base := strings.TrimSuffix(opts.Name, filepath.Ext(opts.Name))
+	if ext == ".jsonl" {
+		ext = ".json"
+	}
+
+	var failed []string
+	for i, src := range raw {
+		id := strconv.Itoa(i + 1)
+		if s := field(src, mapping.ID); s != "" {
+			id = s
+		}
+		name := sourceDocumentName(base+"-"+id) + ext
+		recordOpts := opts
+		recordOpts.Name, recordOpts.RecordMapping = name, &perRecord
+		err := withDocumentLease(name, func() error {
+			path, release, err := saveUpload(bytes.NewReader(src.encode()), name)
+			if err != nil {
+				return err
+			}
+			defer release()
+			_, _, err = ingestFile(path, recordOpts)
+			return err
+		})
+		if err != nil {
+			log.Printf("Failed to ingest record %s of %s: %v", id, opts.Name, err)
+			failed = append(failed, name)
+		}
+	}
+	if err := os.Remove(filePath); err != nil {
+		log.Printf("Failed to remove %s: %v", filePath, err)
+	}
+
+	if len(failed) == len(raw) && len(raw) > 0 {
+		return "", newAPIError(http.StatusInternalServerError, fmt.Sprintf("Failed to ingest any of %d records", len(raw)))
+	}
+	message := fmt.Sprintf("Split into %d documents", len(raw)-len(failed))
+	if len(failed) > 0 {
+		message += fmt.Sprintf(" (%d failed: %s)", len(failed), strings.Join(failed, ", "))
+	}
+	return message, nil
+}
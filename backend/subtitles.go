@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chunk metadata holding the time span of transcript chunks
+const (
+	MetaStart = "start"
+	MetaEnd   = "end"
+)
+
+// Cues further apart than this start a new paragraph
+const cueParagraphGap = 3 * time.Second
+
+// Cue is one timed caption of a subtitle file
+type Cue struct {
+	WordStart int // Word offset of the cue's text in the extracted text
+	Start     time.Duration
+	End       time.Duration
+}
+
+var (
+	// Timing lines: 00:01:02,500 --> 00:01:04,000 (SRT) or 01:02.500 --> 01:04.000 line:0 (WebVTT)
+	cueTimingLine = regexp.MustCompile(`^\s*((?:\d+:)?\d{1,2}:\d{2}[,.]\d{1,3})\s*-->\s*((?:\d+:)?\d{1,2}:\d{2}[,.]\d{1,3})`)
+	// WebVTT voice spans name the speaker: <v Ana>, <v.loud Ana>
+	cueVoiceTag = regexp.MustCompile(`<v(?:\.[^ >]*)?\s+([^>]+)>`)
+	// Formatting tags (<i>, <c.yellow>, <00:00:01.000>, <font ...>) and SSA overrides ({\an8})
+	cueMarkup = regexp.MustCompile(`<[^>]*>|\{\\[^}]*\}`)
+)
+
+func extractSubtitleText(filePath string) (*ExtractedText, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	content := strings.TrimPrefix(string(data), "\ufeff")
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+
+	vtt := strings.ToLower(filepath.Ext(filePath)) == ".vtt"
+	if vtt && !strings.HasPrefix(content, "WEBVTT") {
+		return nil, fmt.Errorf("not a WebVTT file")
+	}
+	text, cues := parseCues(content, vtt)
+	if len(cues) == 0 {
+		return nil, fmt.Errorf("no subtitle cues found")
+	}
+	return &ExtractedText{Text: text, Cues: cues}, nil
+}
+
+// parseCues returns the readable text of SRT or WebVTT content, one line per cue and
+// a paragraph per speaker turn or pause, with the timing of each cue
+func parseCues(content string, vtt bool) (string, []Cue) {
+	var text strings.Builder
+	var cues []Cue
+	words := 0
+	speaker, lastLine := "", ""
+	var lastEnd time.Duration
+
+	for _, block := range strings.Split(content, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		// The timing line follows an optional cue number or identifier
+		timing := -1
+		for i := 0; i < len(lines) && i < 2; i++ {
+			if cueTimingLine.MatchString(lines[i]) {
+				timing = i
+				break
+			}
+		}
+		if timing < 0 {
+			// Headers and NOTE, STYLE and REGION blocks
+			continue
+		}
+		m := cueTimingLine.FindStringSubmatch(lines[timing])
+		start, end := parseCueTime(m[1]), parseCueTime(m[2])
+
+		var cueLines []string
+		newTurn := false
+		for _, line := range lines[timing+1:] {
+			if vtt {
+				if v := cueVoiceTag.FindStringSubmatch(line); v != nil && strings.TrimSpace(v[1]) != speaker {
+					speaker = strings.TrimSpace(v[1])
+					line = speaker + ": " + line
+					newTurn = true
+				}
+			}
+			line = strings.Join(strings.Fields(decodeCueEntities(cueMarkup.ReplaceAllString(line, ""))), " ")
+			// Rolling captions repeat the previous line
+			if line == "" || line == lastLine {
+				continue
+			}
+			cueLines = append(cueLines, line)
+			lastLine = line
+		}
+		if len(cueLines) == 0 {
+			continue
+		}
+
+		if text.Len() > 0 {
+			if newTurn || start-lastEnd > cueParagraphGap {
+				text.WriteString("\n\n")
+			} else {
+				text.WriteString("\n")
+			}
+		}
+		cueText := strings.Join(cueLines, "\n")
+		text.WriteString(cueText)
+		cues = append(cues, Cue{WordStart: words, Start: start, End: end})
+		words += len(strings.Fields(cueText))
+		lastEnd = end
+	}
+	return text.String(), cues
+}
+
+// parseCueTime reads HH:MM:SS,mmm, HH:MM:SS.mmm or MM:SS.mmm
+func parseCueTime(s string) time.Duration {
+	var seconds float64
+	for _, part := range strings.Split(strings.Replace(s, ",", ".", 1), ":") {
+		v, _ := strconv.ParseFloat(part, 64)
+		seconds = seconds*60 + v
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func decodeCueEntities(s string) string {
+	return strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&nbsp;", " ", "&lrm;", "", "&rlm;", "").Replace(s)
+}
+
+// formatTimestamp writes a cue time as HH:MM:SS
+func formatTimestamp(d time.Duration) string {
+	s := int(d / time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+// cueChunkMetadata returns the start of the cue holding each chunk's first word and
+// the end of the cue holding its last
+func cueChunkMetadata(cues []Cue, chunks []string, chunkStarts []int) []map[string]string {
+	cueAt := func(word int) Cue {
+		i := sort.Search(len(cues), func(i int) bool { return cues[i].WordStart > word })
+		return cues[max(i-1, 0)]
+	}
+	metadata := make([]map[string]string, len(chunks))
+	for i, chunk := range chunks {
+		last := chunkStarts[i] + max(len(strings.Fields(chunk))-1, 0)
+		metadata[i] = map[string]string{
+			MetaStart: formatTimestamp(cueAt(chunkStarts[i]).Start),
+			MetaEnd:   formatTimestamp(cueAt(last).End),
+		}
+	}
+	return metadata
+}
+
+// timeCode returns the span of a transcript chunk, e.g. "00:01:02-00:01:30"
+func timeCode(metadata map[string]string) string {
+	if metadata[MetaStart] == "" {
+		return ""
+	}
+	return metadata[MetaStart] + "-" + metadata[MetaEnd]
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// How a document's summary reaches query context
+const (
+	SummaryRetrieve = "retrieve" // Retrieved like a chunk: used when it matches the query as well as the chosen chunks do
+	SummaryAlways   = "always"   // Prepended to every query's context
+	SummaryNever    = "never"    // Only used by the summary fallback
+)
+
+func validSummaryContext(mode string) bool {
+	return mode == SummaryRetrieve || mode == SummaryAlways || mode == SummaryNever
+}
+
+// summaryVector caches the embedding of a document's summary, computed on the
+// first query that needs it
+type summaryVector struct {
+	mu      sync.Mutex
+	summary string
+	model   string
+	vec     QuantizedVector
+}
+
+// get returns the embedding of summary with model, embedding it unless cached
+func (s *summaryVector) get(ctx context.Context, summary, model string) (QuantizedVector, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.summary == summary && s.model == model && s.vec.Dim() > 0 {
+		return s.vec, nil
+	}
+	raw, err := callOllamaEmbedding(ctx, summary, model)
+	if err != nil {
+		return QuantizedVector{}, err
+	}
+	s.summary, s.model, s.vec = summary, model, quantizeVector(raw)
+	return s.vec, nil
+}
+
+// cached reports whether an embedding is held
+func (s *summaryVector) cached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.vec.Dim() > 0
+}
+
+// reset drops the embedding, so the next query that needs it embeds the summary again
+func (s *summaryVector) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.summary, s.model, s.vec = "", "", QuantizedVector{}
+}
+
+// summaryKeywordScore scores the summary the way keywordRetrieve scores a chunk:
+// the IDF weights of the query terms it holds
+func summaryKeywordScore(doc *Document, query string) float64 {
+	index := buildWordIndex([]string{doc.Summary})
+	var synonyms *thesaurus
+	if c, exists := collectionStore.Get(doc.Collection); exists {
+		synonyms = c.thesaurus
+	}
+	var score float64
+	for _, term := range synonyms.expandQuery(query) {
+		if len(term.chunks(index)) > 0 {
+			score += term.idfWeight(documentStore.terms)
+		}
+	}
+	return score
+}
+
+// summaryContext decides whether a document's summary goes into a query's
+// context, given the scores of the chosen chunks (best first, from the same
+// retrieval as queryVec, which is nil for keyword retrieval). takesSlot tells
+// that the summary replaces the weakest chunk once all maxChunks are taken.
+// Callers hold the document lock.
+func summaryContext(ctx context.Context, doc *Document, query string, queryVec []float64, scores []float64, maxChunks int) (use, takesSlot bool) {
+	if !doc.HasSummary || doc.Summary == "" {
+		return false, false
+	}
+	switch getConfig().SummaryContext {
+	case SummaryAlways:
+		return true, false
+	case SummaryNever:
+		return false, false
+	}
+
+	var score float64
+	if queryVec != nil {
+		vec, err := doc.summaryVec.get(ctx, doc.Summary, doc.EmbeddingModel)
+		if err != nil {
+			log.Printf("Failed to embed the summary of %s: %v", doc.Name, err)
+			return false, false
+		}
+		if vec.Dim() != len(queryVec) {
+			return false, false
+		}
+		score = cosineSimilarity(vec, quantizeVector(queryVec))
+	} else {
+		score = summaryKeywordScore(doc, query)
+	}
+	if score <= 0 {
+		return false, false
+	}
+	if len(scores) < maxChunks {
+		return true, false
+	}
+	return score >= scores[len(scores)-1], true
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Chunk metadata of rows read from spreadsheets
+const (
+	MetaTable = "table" // Sheet, or file name for CSV files
+	MetaRows  = "rows"  // Spreadsheet rows in the chunk, e.g. "2-40,42-57"
+)
+
+// Table modes of queries
+const (
+	TableAuto = "auto" // Table sources are given as rows when any source is a table
+	TableOff  = "off"  // Tables are given as plain text
+)
+
+func validTableMode(mode string) bool {
+	return mode == "" || mode == TableAuto || mode == TableOff
+}
+
+// TextTable is a table read from a spreadsheet
+type TextTable struct {
+	Name    string
+	Columns []string
+	Rows    [][]string
+	Numbers []int // Spreadsheet row number of each row
+}
+
+// markdownCell escapes a cell for a Markdown table row
+func markdownCell(cell string) string {
+	cell = strings.Join(strings.Fields(cell), " ")
+	return strings.ReplaceAll(cell, "|", `\|`)
+}
+
+func markdownRow(cells []string) string {
+	escaped := make([]string, len(cells))
+	for i, cell := range cells {
+		escaped[i] = markdownCell(cell)
+	}
+	return "| " + strings.Join(escaped, " | ") + " |"
+}
+
+// headerLines returns the column names and separator of the table in Markdown
+func (t *TextTable) headerLines() []string {
+	separator := make([]string, len(t.Columns))
+	for i := range separator {
+		separator[i] = "---"
+	}
+	return []string{markdownRow(t.Columns), "| " + strings.Join(separator, " | ") + " |"}
+}
+
+// joinTables returns a document's text: each table in Markdown under its name
+func joinTables(tables []TextTable) string {
+	var b strings.Builder
+	for i, t := range tables {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString("## " + t.Name + "\n\n")
+		b.WriteString(strings.Join(t.headerLines(), "\n"))
+		for _, row := range t.Rows {
+			b.WriteString("\n" + markdownRow(row))
+		}
+	}
+	return b.String()
+}
+
+// chunkTables packs whole rows into chunks of the chunk size, repeating the
+// column names in each chunk so every chunk reads as a table on its own. Chunk
+// metadata names the table and the rows in the chunk; starts are word offsets in
+// the text from joinTables.
+func chunkTables(tables []TextTable, opts ChunkOptions) ([]string, []int, []map[string]string) {
+	size := opts.Size
+	if size <= 0 {
+		size = getConfig().ChunkSize
+	}
+	var chunks []string
+	var starts []int
+	var metadata []map[string]string
+	offset := 0
+	for _, t := range tables {
+		header := strings.Join(t.headerLines(), "\n")
+		offset += len(strings.Fields("## "+t.Name)) + len(strings.Fields(header))
+
+		var rows []string
+		first, start := 0, offset
+		flush := func(end int) {
+			if len(rows) == 0 {
+				return
+			}
+			chunks = append(chunks, header+"\n"+strings.Join(rows, "\n"))
+			starts = append(starts, start)
+			metadata = append(metadata, map[string]string{
+				MetaTable: t.Name,
+				MetaRows:  formatRowRanges(t.Numbers[first:end]),
+			})
+			rows = nil
+		}
+		chunkSize := len(header)
+		for i, row := range t.Rows {
+			line := markdownRow(row)
+			if len(rows) > 0 && chunkSize+len(line)+1 > size {
+				flush(i)
+				first, start, chunkSize = i, offset, len(header)
+			}
+			rows = append(rows, line)
+			chunkSize += len(line) + 1
+			offset += len(strings.Fields(line))
+		}
+		flush(len(t.Rows))
+	}
+	return chunks, starts, metadata
+}
+
+// formatRowRanges writes ascending row numbers as ranges: 2-40,42
+func formatRowRanges(numbers []int) string {
+	var parts []string
+	for i := 0; i < len(numbers); {
+		j := i
+		for j+1 < len(numbers) && numbers[j+1] == numbers[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, fmt.Sprintf("%d-%d", numbers[i], numbers[j]))
+		} else {
+			parts = append(parts, strconv.Itoa(numbers[i]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseRowRanges reads row numbers written by formatRowRanges
+func parseRowRanges(ranges string) ([]int, error) {
+	var numbers []int
+	for _, part := range strings.Split(ranges, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(to); err != nil {
+				return nil, err
+			}
+		}
+		for n := first; n <= last; n++ {
+			numbers = append(numbers, n)
+		}
+	}
+	return numbers, nil
+}
+
+// newTable builds a table from a sheet's rows, rows[i] being row i+1. The first
+// non-blank row holds the column names; blank rows are dropped.
+func newTable(name string, rows [][]string) (TextTable, bool) {
+	header := 0
+	for header < len(rows) && isBlankRow(rows[header]) {
+		header++
+	}
+	if header == len(rows) {
+		return TextTable{}, false
+	}
+	width := 0
+	for _, row := range rows[header:] {
+		width = max(width, len(row))
+	}
+	t := TextTable{Name: name, Columns: make([]string, width)}
+	for i := range t.Columns {
+		if i < len(rows[header]) {
+			t.Columns[i] = strings.TrimSpace(rows[header][i])
+		}
+		if t.Columns[i] == "" {
+			t.Columns[i] = fmt.Sprintf("Column %d", i+1)
+		}
+	}
+	for i := header + 1; i < len(rows); i++ {
+		if isBlankRow(rows[i]) {
+			continue
+		}
+		padded := make([]string, width)
+		copy(padded, rows[i])
+		t.Rows = append(t.Rows, padded)
+		t.Numbers = append(t.Numbers, i+1)
+	}
+	return t, true
+}
+
+func isBlankRow(row []string) bool {
+	for _, cell := range row {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// extractCSVText reads a .csv or .tsv file as one table
+func extractCSVText(filePath string) (*ExtractedText, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	if strings.EqualFold(filepath.Ext(filePath), ".tsv") {
+		reader.Comma = '\t'
+	}
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filepath.Base(filePath), err)
+	}
+	t, ok := newTable(filepath.Base(filePath), rows)
+	if !ok {
+		return &ExtractedText{}, nil
+	}
+	tables := []TextTable{t}
+	return &ExtractedText{Text: joinTables(tables), Tables: tables}, nil
+}
+
+// Parts of .xlsx workbooks
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxRichText struct {
+	Text string `xml:"t"`
+	Runs []struct {
+		Text string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (s xlsxRichText) String() string {
+	if len(s.Runs) == 0 {
+		return s.Text
+	}
+	var b strings.Builder
+	for _, r := range s.Runs {
+		b.WriteString(r.Text)
+	}
+	return b.String()
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		Number int `xml:"r,attr"`
+		Cells  []struct {
+			Ref    string       `xml:"r,attr"`
+			Type   string       `xml:"t,attr"`
+			Value  string       `xml:"v"`
+			Inline xlsxRichText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+var cellColumn = regexp.MustCompile(`^[A-Z]+`)
+
+// columnIndex returns the 0-based column of a cell reference such as "C12"
+func columnIndex(ref string) int {
+	n := 0
+	for _, r := range cellColumn.FindString(ref) {
+		n = n*26 + int(r-'A'+1)
+	}
+	return n - 1
+}
+
+func readZipXML(files map[string]*zip.File, name string, v interface{}) error {
+	rc, err := openZipPart(files, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(rc).Decode(v)
+}
+
+// openZipPart opens a part of a zip package, reading at most maxDecompressedPart bytes
+func openZipPart(files map[string]*zip.File, name string) (io.ReadCloser, error) {
+	f, exists := files[name]
+	if !exists {
+		return nil, fmt.Errorf("missing %s", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, maxDecompressedPart), rc}, nil
+}
+
+// Largest part of a workbook or document package read, guarding against zip bombs
+const maxDecompressedPart = 256 << 20
+
+// extractXLSXText reads each non-empty sheet of an .xlsx workbook as a table.
+// Cells hold their stored values: formulas give their last computed result and
+// dates the spreadsheet's serial number.
+func extractXLSXText(filePath string) (*ExtractedText, error) {
+	zr, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open workbook: %w", err)
+	}
+	defer zr.Close()
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var workbook xlsxWorkbook
+	var rels xlsxRelationships
+	if err := readZipXML(files, "xl/workbook.xml", &workbook); err != nil {
+		return nil, fmt.Errorf("invalid workbook: %w", err)
+	}
+	if err := readZipXML(files, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, fmt.Errorf("invalid workbook: %w", err)
+	}
+	targets := make(map[string]string, len(rels.Relationships))
+	for _, rel := range rels.Relationships {
+		target := strings.TrimPrefix(rel.Target, "/")
+		if !strings.HasPrefix(target, "xl/") {
+			target = path.Join("xl", target)
+		}
+		targets[rel.ID] = target
+	}
+	var shared struct {
+		Items []xlsxRichText `xml:"si"`
+	}
+	if _, exists := files["xl/sharedStrings.xml"]; exists {
+		if err := readZipXML(files, "xl/sharedStrings.xml", &shared); err != nil {
+			return nil, fmt.Errorf("invalid shared strings: %w", err)
+		}
+	}
+
+	var tables []TextTable
+	for _, s := range workbook.Sheets {
+		var sheet xlsxSheet
+		if err := readZipXML(files, targets[s.RID], &sheet); err != nil {
+			return nil, fmt.Errorf("invalid sheet %s: %w", s.Name, err)
+		}
+		var rows [][]string
+		for _, row := range sheet.Rows {
+			number := row.Number
+			if number == 0 {
+				number = len(rows) + 1
+			}
+			for len(rows) < number {
+				rows = append(rows, nil)
+			}
+			cells := rows[number-1]
+			for i, c := range row.Cells {
+				col := i
+				if c.Ref != "" {
+					col = columnIndex(c.Ref)
+				}
+				if col < 0 {
+					continue
+				}
+				value := c.Value
+				switch c.Type {
+				case "s":
+					if idx, err := strconv.Atoi(c.Value); err == nil && idx >= 0 && idx < len(shared.Items) {
+						value = shared.Items[idx].String()
+					}
+				case "inlineStr":
+					value = c.Inline.String()
+				case "b":
+					value = map[string]string{"1": "TRUE", "0": "FALSE"}[c.Value]
+				}
+				for len(cells) <= col {
+					cells = append(cells, "")
+				}
+				cells[col] = value
+			}
+			rows[number-1] = cells
+		}
+		if t, ok := newTable(s.Name, rows); ok {
+			tables = append(tables, t)
+		}
+	}
+	if len(tables) == 0 {
+		return &ExtractedText{}, nil
+	}
+	return &ExtractedText{Text: joinTables(tables), Tables: tables}, nil
+}
+
+// tableSource is a table chunk among a query's sources
+type tableSource struct {
+	Label   string // T1, T2, ... in the prompt
+	Source  int    // Index in the source chunks
+	Table   string
+	Columns []string
+	Rows    []tableRow
+}
+
+type tableRow struct {
+	Number int
+	Cells  []string
+}
+
+// TableRow is a spreadsheet row an answer relies on
+type TableRow struct {
+	Table  string            `json:"table"`
+	Row    int               `json:"row"`    // Row number in the sheet
+	Source int               `json:"source"` // Index into sourceChunks
+	Cells  map[string]string `json:"cells"`  // Column name to value
+}
+
+// splitMarkdownRow returns the cells of a row written by markdownRow
+func splitMarkdownRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimSuffix(strings.TrimPrefix(line, "| "), " |")
+	var cells []string
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			b.WriteByte('|')
+			i++
+		case strings.HasPrefix(line[i:], " | "):
+			cells = append(cells, b.String())
+			b.Reset()
+			i += 2
+		default:
+			b.WriteByte(line[i])
+		}
+	}
+	return append(cells, b.String())
+}
+
+// parseTableChunk reads back a chunk written by chunkTables
+func parseTableChunk(chunk string, metadata map[string]string) (*tableSource, bool) {
+	numbers, err := parseRowRanges(metadata[MetaRows])
+	lines := strings.Split(chunk, "\n")
+	if err != nil || len(lines) != len(numbers)+2 {
+		return nil, false
+	}
+	t := &tableSource{Table: metadata[MetaTable], Columns: splitMarkdownRow(lines[0])}
+	for i, line := range lines[2:] {
+		t.Rows = append(t.Rows, tableRow{Number: numbers[i], Cells: splitMarkdownRow(line)})
+	}
+	return t, true
+}
+
+// tableSources returns the table chunks among a query's sources, or nil when the
+// mode is off or no source is a table; callers hold the document lock
+func tableSources(doc *Document, indices []int, mode string) []*tableSource {
+	if mode == TableOff || len(doc.ChunkMetadata) != len(doc.Chunks) {
+		return nil
+	}
+	var tables []*tableSource
+	for i, idx := range indices {
+		if doc.ChunkMetadata[idx][MetaTable] == "" {
+			continue
+		}
+		if t, ok := parseTableChunk(doc.Chunks[idx], doc.ChunkMetadata[idx]); ok {
+			t.Label = fmt.Sprintf("T%d", len(tables)+1)
+			t.Source = i
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// structured writes the table as one JSON object per row, keyed by column, so the
+// model sees which value belongs to which column
+func (t *tableSource) structured() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Table %s (sheet %q), one JSON object per row:\n", t.Label, t.Table)
+	for _, row := range t.Rows {
+		fmt.Fprintf(&b, `{"row": "%s:%d"`, t.Label, row.Number)
+		for i, column := range t.Columns {
+			value := ""
+			if i < len(row.Cells) {
+				value = row.Cells[i]
+			}
+			key, _ := json.Marshal(column)
+			val, _ := json.Marshal(value)
+			fmt.Fprintf(&b, ", %s: %s", key, val)
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// withTableInstructions tells the model how to read table sources and to name
+// the rows it used
+func withTableInstructions(prompt string) string {
+	return `Some of the context is tables given as one JSON object per row. Answer from the rows and columns: filter, compare, count or add up values as the question requires instead of reading the tables as prose. After the answer, add a last line "Rows:" followed by the "row" values of the rows the answer relies on, separated by commas, or "Rows: none".
+
+` + prompt
+}
+
+var (
+	rowsLine = regexp.MustCompile(`(?im)^[ \t*_]*rows[ \t*_]*:(.*)$`)
+	rowRef   = regexp.MustCompile(`T(\d+):(\d+)`)
+)
+
+// usedRows removes the model's "Rows:" line from an answer and returns the rows
+// it names
+func usedRows(response string, tables []*tableSource) (string, []TableRow) {
+	matches := rowsLine.FindAllStringSubmatchIndex(response, -1)
+	if matches == nil {
+		return response, nil
+	}
+	last := matches[len(matches)-1]
+	refs := response[last[2]:last[3]]
+	response = strings.TrimSpace(response[:last[0]] + response[last[1]:])
+
+	rows := []TableRow{}
+	seen := make(map[string]bool)
+	for _, m := range rowRef.FindAllStringSubmatch(refs, -1) {
+		if seen[m[0]] {
+			continue
+		}
+		seen[m[0]] = true
+		n, _ := strconv.Atoi(m[1])
+		number, _ := strconv.Atoi(m[2])
+		if n < 1 || n > len(tables) {
+			continue
+		}
+		t := tables[n-1]
+		for _, row := range t.Rows {
+			if row.Number != number {
+				continue
+			}
+			cells := make(map[string]string, len(t.Columns))
+			for i, column := range t.Columns {
+				if i < len(row.Cells) {
+					cells[column] = row.Cells[i]
+				}
+			}
+			rows = append(rows, TableRow{Table: t.Table, Row: number, Source: t.Source, Cells: cells})
+		}
+	}
+	return response, rows
+}
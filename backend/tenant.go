@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// Requests name their tenant in this header; requests without one belong to the
+// default tenant. Tenants scope chat sessions, so one tenant cannot list or read
+// another's conversations.
+const (
+	tenantHeader  = "X-Tenant-ID"
+	defaultTenant = "default"
+)
+
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// requestTenant returns the tenant a request acts for: the one its credentials
+// are bound to, if any, or else the one it names
+func requestTenant(r *http.Request) (string, error) {
+	tenant := r.Header.Get(tenantHeader)
+	if bound := authenticatedTenant(r); bound != "" {
+		if tenant != "" && tenant != bound {
+			return "", newAPIError(http.StatusForbidden, tenantHeader+" does not match the tenant of the credentials")
+		}
+		return bound, nil
+	}
+	if tenant == "" {
+		return defaultTenant, nil
+	}
+	if !validTenant.MatchString(tenant) {
+		return "", newAPIError(http.StatusBadRequest, "Invalid "+tenantHeader+" (use up to 64 letters, digits, ., - or _)")
+	}
+	return tenant, nil
+}
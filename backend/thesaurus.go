@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Largest thesaurus file accepted
+const maxThesaurusSize = 1 << 20
+
+// thesaurus maps each normalized phrase of a synonym group to the other phrases of
+// its groups
+type thesaurus struct {
+	synonyms map[string][]string
+	maxWords int // Words in the longest phrase
+}
+
+// compileThesaurus checks synonym groups and indexes them; nil when there are none
+func compileThesaurus(groups [][]string) (*thesaurus, error) {
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	t := &thesaurus{synonyms: make(map[string][]string)}
+	for i, group := range groups {
+		keys := make([]string, 0, len(group))
+		for _, phrase := range group {
+			words := termWords(phrase)
+			if len(words) == 0 {
+				return nil, fmt.Errorf("synonym group %d has an empty term", i+1)
+			}
+			keys = append(keys, strings.Join(words, " "))
+			t.maxWords = max(t.maxWords, len(words))
+		}
+		if len(keys) < 2 {
+			return nil, fmt.Errorf("synonym group %d needs at least two terms", i+1)
+		}
+		for _, key := range keys {
+			for _, other := range keys {
+				if other != key && !slices.Contains(t.synonyms[key], other) {
+					t.synonyms[key] = append(t.synonyms[key], other)
+				}
+			}
+		}
+	}
+	return t, nil
+}
+
+// parseThesaurus reads a thesaurus file: one synonym group per line, terms separated
+// by commas or "=", e.g. "MSA = master services agreement". Blank lines and lines
+// starting with # are skipped.
+func parseThesaurus(r io.Reader) ([][]string, error) {
+	var groups [][]string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var group []string
+		for _, term := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '=' }) {
+			if term = strings.TrimSpace(term); term != "" {
+				group = append(group, term)
+			}
+		}
+		if len(group) < 2 {
+			return nil, fmt.Errorf("line %d: a synonym group needs at least two terms", line)
+		}
+		groups = append(groups, group)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// queryTerm is a query word or phrase with the alternatives that count as matching
+// it; each alternative is a list of words that must all be in a chunk
+type queryTerm struct {
+	alternatives [][]string
+	weight       float64 // Query words the term stands for
+}
+
+// expandQuery splits a query into the lowercase words the word index holds,
+// joining phrases found in the thesaurus into one term with their synonyms
+func (t *thesaurus) expandQuery(query string) []queryTerm {
+	words := strings.Fields(strings.ToLower(query))
+	var terms []queryTerm
+	for i := 0; i < len(words); {
+		n, synonyms := t.match(words[i:])
+		if n == 0 {
+			terms = append(terms, queryTerm{alternatives: [][]string{{words[i]}}, weight: 1})
+			i++
+			continue
+		}
+		term := queryTerm{alternatives: [][]string{words[i : i+n]}, weight: float64(n)}
+		for _, synonym := range synonyms {
+			term.alternatives = append(term.alternatives, strings.Fields(synonym))
+		}
+		terms = append(terms, term)
+		i += n
+	}
+	return terms
+}
+
+// chunks returns the chunks holding every word of any of the term's alternatives
+func (term queryTerm) chunks(wordIndex map[string][]int) []int {
+	matched := make(map[int]bool)
+	for _, words := range term.alternatives {
+		counts := make(map[int]int)
+		for _, w := range words {
+			for _, i := range wordIndex[w] {
+				counts[i]++
+			}
+		}
+		for i, n := range counts {
+			if n == len(words) {
+				matched[i] = true
+			}
+		}
+	}
+	indices := make([]int, 0, len(matched))
+	for i := range matched {
+		indices = append(indices, i)
+	}
+	return indices
+}
+
+// match returns the length and synonyms of the longest thesaurus phrase the words
+// start with, or 0 when there is none
+func (t *thesaurus) match(words []string) (int, []string) {
+	if t == nil {
+		return 0, nil
+	}
+	for n := min(t.maxWords, len(words)); n > 0; n-- {
+		normalized := make([]string, n)
+		for i, w := range words[:n] {
+			normalized[i] = normalizeWord(w)
+		}
+		if synonyms, ok := t.synonyms[strings.Join(normalized, " ")]; ok {
+			return n, synonyms
+		}
+	}
+	return 0, nil
+}
+
+// handleCollectionThesaurus replaces a collection's synonym groups with those of an
+// uploaded thesaurus file (PUT), or returns them (GET)
+func handleCollectionThesaurus(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "GET" && !validateMethod(w, r, "PUT") {
+		return
+	}
+
+	c, exists := collectionStore.Get(name)
+	if !exists {
+		sendError(w, http.StatusNotFound, "Collection not found")
+		return
+	}
+	if r.Method == "GET" {
+		sendJSON(w, http.StatusOK, map[string]interface{}{"collection": name, "synonyms": c.Synonyms})
+		return
+	}
+
+	groups, err := parseThesaurus(http.MaxBytesReader(w, r.Body, maxThesaurusSize))
+	if err != nil {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid thesaurus: %v", err))
+		return
+	}
+	compiled, err := compileThesaurus(groups)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid thesaurus: %v", err))
+		return
+	}
+
+	// Collections are never mutated, so the update is a modified copy
+	updated := *c
+	updated.Synonyms = groups
+	updated.thesaurus = compiled
+	updated.UpdatedAt = time.Now()
+	collectionStore.Set(&updated)
+	sendJSON(w, http.StatusOK, map[string]interface{}{"collection": name, "synonyms": groups})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// TOCEntry is one heading in a document's table of contents.
+// ChunkStart/ChunkEnd delimit the chunks belonging to the section (end exclusive),
+// and are -1 when the heading could not be located in the extracted text.
+type TOCEntry struct {
+	Title      string `json:"title"`
+	Level      int    `json:"level"`
+	ChunkStart int    `json:"chunkStart"`
+	ChunkEnd   int    `json:"chunkEnd"`
+}
+
+// pdfOutlineTOC flattens PDF bookmarks into TOC entries
+func pdfOutlineTOC(reader *pdf.Reader) []TOCEntry {
+	var entries []TOCEntry
+	var walk func(o pdf.Outline, level int)
+	walk = func(o pdf.Outline, level int) {
+		for _, child := range o.Child {
+			if title := strings.TrimSpace(child.Title); title != "" {
+				entries = append(entries, TOCEntry{Title: title, Level: level})
+			}
+			walk(child, level+1)
+		}
+	}
+	walk(reader.Outline(), 1)
+	return entries
+}
+
+// markdownTOC collects ATX-style headings ("# Title") from Markdown source
+func markdownTOC(text string) []TOCEntry {
+	var entries []TOCEntry
+	inFence := false
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if entry, ok := markdownHeading(scanner.Text(), &inFence); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// markdownHeading parses one line of Markdown source as a heading, tracking
+// whether the line is inside a fenced code block
+func markdownHeading(line string, inFence *bool) (TOCEntry, bool) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "```") {
+		*inFence = !*inFence
+		return TOCEntry{}, false
+	}
+	if *inFence || !strings.HasPrefix(line, "#") {
+		return TOCEntry{}, false
+	}
+
+	level := len(line) - len(strings.TrimLeft(line, "#"))
+	title := strings.TrimSpace(strings.Trim(line[level:], "# "))
+	if level > 6 || title == "" || !strings.HasPrefix(line[level:], " ") {
+		return TOCEntry{}, false
+	}
+	return TOCEntry{Title: title, Level: level}, true
+}
+
+func normalizeWord(w string) string {
+	return strings.ToLower(strings.TrimFunc(w, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}))
+}
+
+// locateTOC maps each heading onto the chunk range that holds its section.
+// Headings are searched for in order, so repeated titles resolve to successive occurrences.
+func locateTOC(entries []TOCEntry, text string, chunkStarts []int) []TOCEntry {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	words := strings.Fields(text)
+	norm := make([]string, len(words))
+	for i, w := range words {
+		norm[i] = normalizeWord(w)
+	}
+
+	located := make([]TOCEntry, len(entries))
+	cursor := 0
+	for i, e := range entries {
+		located[i] = e
+		located[i].ChunkStart, located[i].ChunkEnd = -1, -1
+
+		var title []string
+		for _, w := range strings.Fields(e.Title) {
+			if n := normalizeWord(w); n != "" {
+				title = append(title, n)
+			}
+		}
+		if len(title) == 0 {
+			continue
+		}
+
+		for pos := cursor; pos+len(title) <= len(norm); pos++ {
+			match := true
+			for k, tw := range title {
+				if norm[pos+k] != tw {
+					match = false
+					break
+				}
+			}
+			if match {
+				located[i].ChunkStart = chunkAt(chunkStarts, pos)
+				cursor = pos + len(title)
+				break
+			}
+		}
+	}
+
+	setSectionEnds(located, len(chunkStarts))
+	return located
+}
+
+// chunkAt returns the chunk holding a word, given each chunk's starting word
+func chunkAt(chunkStarts []int, wordIdx int) int {
+	idx := 0
+	for i, start := range chunkStarts {
+		if start > wordIdx {
+			break
+		}
+		idx = i
+	}
+	return idx
+}
+
+// setSectionEnds ends each located section at the next located heading at the same
+// or a higher level
+func setSectionEnds(located []TOCEntry, chunkCount int) {
+	for i := range located {
+		if located[i].ChunkStart < 0 {
+			continue
+		}
+		located[i].ChunkEnd = chunkCount
+		for j := i + 1; j < len(located); j++ {
+			if located[j].ChunkStart >= 0 && located[j].Level <= located[i].Level {
+				end := located[j].ChunkStart
+				if end <= located[i].ChunkStart {
+					end = located[i].ChunkStart + 1
+				}
+				located[i].ChunkEnd = end
+				break
+			}
+		}
+	}
+}
+
+var sectionPrefixes = []string{"section", "chapter", "part", "appendix"}
+
+// headingNumber returns the leading number or letter of a heading,
+// e.g. "7" for "7. Termination" or "b" for "Appendix B: Pricing"
+func headingNumber(title string) string {
+	fields := strings.Fields(strings.ToLower(title))
+	if len(fields) > 1 {
+		for _, prefix := range sectionPrefixes {
+			if fields[0] == prefix {
+				return normalizeWord(fields[1])
+			}
+		}
+	}
+	return normalizeWord(fields[0])
+}
+
+// findSection resolves a user-supplied section reference such as "Section 7",
+// "7" or "Termination" to a located TOC entry
+func findSection(toc []TOCEntry, ref string) (TOCEntry, bool) {
+	ref = strings.ToLower(strings.TrimSpace(ref))
+	if ref == "" {
+		return TOCEntry{}, false
+	}
+	// Only short references ("7", "b", "iv", "7.2") are treated as section numbers
+	number := headingNumber(ref)
+	if len(number) > 3 && strings.IndexFunc(number, unicode.IsDigit) < 0 {
+		number = ""
+	}
+
+	var contains *TOCEntry
+	for i, e := range toc {
+		if e.ChunkStart < 0 {
+			continue
+		}
+		title := strings.ToLower(e.Title)
+		if title == ref || (number != "" && headingNumber(title) == number) {
+			return e, true
+		}
+		if contains == nil && strings.Contains(title, ref) {
+			contains = &toc[i]
+		}
+	}
+	if contains != nil {
+		return *contains, true
+	}
+	return TOCEntry{}, false
+}
+
+func handleGetDocumentTOC(w http.ResponseWriter, r *http.Request, docName string) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+
+	doc, ok := getDocumentOrError(w, docName)
+	if !ok {
+		return
+	}
+
+	doc.mu.RLock()
+	toc := doc.TOC
+	doc.mu.RUnlock()
+
+	if toc == nil {
+		toc = []TOCEntry{}
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{"toc": toc})
+}
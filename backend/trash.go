@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deleted documents are kept here, one directory per document holding the
+// uploaded file and the stored document with its embeddings
+var trashDir = filepath.Join("./documents", ".trash")
+
+const (
+	trashEntryFile     = "document.json"
+	trashUploadFile    = "file"
+	trashPurgeInterval = time.Hour
+)
+
+// trashEntry is a deleted document as kept in the trash
+type trashEntry struct {
+	DeletedAt time.Time          `json:"deletedAt"`
+	Tenant    string             `json:"tenant,omitempty"` // Tenant that deleted the document; only it sees the entry
+	Document  *persistedDocument `json:"document"`
+}
+
+// TrashedDocument is a listing entry for the trash
+type TrashedDocument struct {
+	Name       string    `json:"name"`
+	Collection string    `json:"collection,omitempty"`
+	ChunkCount int       `json:"chunkCount"`
+	DeletedAt  time.Time `json:"deletedAt"`
+	PurgeAt    time.Time `json:"purgeAt"` // When the document is removed for good
+	tenant     string
+}
+
+func trashEntryDir(name string) string {
+	return filepath.Join(trashDir, name)
+}
+
+// validTrashName rejects names that would leave the trash directory
+func validTrashName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// trashDocument moves a stored document and its file into the trash for tenant,
+// replacing an earlier trashed document of the same name. Callers hold the
+// document lease.
+func trashDocument(doc *Document, tenant string) error {
+	dir := trashEntryDir(doc.Name)
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to clear trash entry: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create trash entry: %w", err)
+	}
+
+	doc.mu.RLock()
+	data, err := json.Marshal(trashEntry{DeletedAt: time.Now(), Tenant: tenant, Document: newPutRecord(doc).Document})
+	doc.mu.RUnlock()
+	if err == nil {
+		err = writeStoredFile(filepath.Join(dir, trashEntryFile), data)
+	}
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("failed to write trash entry: %w", err)
+	}
+
+	// Documents from sources and path ingestion may have no file of their own
+	err = os.Rename(filepath.Join("./documents", doc.Name), filepath.Join(dir, trashUploadFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("failed to move file to trash: %w", err)
+	}
+	return nil
+}
+
+// readTrashEntry loads a trashed document
+func readTrashEntry(name string) (*trashEntry, error) {
+	data, err := readStoredFile(filepath.Join(trashEntryDir(name), trashEntryFile))
+	if err != nil {
+		return nil, err
+	}
+	var entry trashEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("unreadable trash entry: %w", err)
+	}
+	if entry.Document == nil || entry.Document.Document == nil {
+		return nil, errors.New("trash entry holds no document")
+	}
+	if entry.Tenant == "" { // Trashed before entries recorded their tenant
+		entry.Tenant = defaultTenant
+	}
+	return &entry, nil
+}
+
+// listTrash returns the trashed documents, most recently deleted first
+func listTrash() ([]TrashedDocument, error) {
+	dirs, err := os.ReadDir(trashDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []TrashedDocument{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	retention := time.Duration(getConfig().TrashRetention)
+	result := make([]TrashedDocument, 0, len(dirs))
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		entry, err := readTrashEntry(d.Name())
+		if err != nil {
+			log.Printf("Skipping trash entry %s: %v", d.Name(), err)
+			continue
+		}
+		result = append(result, TrashedDocument{
+			Name:       d.Name(),
+			Collection: entry.Document.Collection,
+			ChunkCount: entry.Document.ChunkCount,
+			DeletedAt:  entry.DeletedAt,
+			PurgeAt:    entry.DeletedAt.Add(retention),
+			tenant:     entry.Tenant,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].DeletedAt.After(result[j].DeletedAt) })
+	return result, nil
+}
+
+// purgeTrash removes trashed documents older than the retention window
+func purgeTrash() {
+	entries, err := listTrash()
+	if err != nil {
+		log.Printf("Failed to read trash: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if now.Before(entry.PurgeAt) {
+			continue
+		}
+		if err := os.RemoveAll(trashEntryDir(entry.Name)); err != nil {
+			log.Printf("Failed to purge %s from trash: %v", entry.Name, err)
+			continue
+		}
+		log.Printf("Purged %s from trash (deleted %s)", entry.Name, entry.DeletedAt.Format(time.RFC3339))
+	}
+}
+
+// runTrashPurge purges expired trash entries periodically
+func runTrashPurge() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		purgeTrash()
+		<-ticker.C
+	}
+}
+
+// handleRestoreDocument puts a trashed document back, with its embeddings and
+// summary (POST /api/document/{name}/restore)
+func handleRestoreDocument(w http.ResponseWriter, r *http.Request, docName string) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+
+	if !validTrashName(docName) {
+		sendError(w, http.StatusBadRequest, "Invalid document name")
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	var restored *Document
+	err = withDocumentLease(docName, func() error {
+		entry, err := readTrashEntry(docName)
+		if errors.Is(err, os.ErrNotExist) || (err == nil && entry.Tenant != tenant) {
+			return newAPIError(http.StatusNotFound, "Document not found in trash")
+		}
+		if err != nil {
+			return err
+		}
+		if _, exists := documentStore.Get(docName); exists {
+			return newAPIError(http.StatusConflict, "A document with this name exists; delete or rename it first")
+		}
+
+		dir := trashEntryDir(docName)
+		err = os.Rename(filepath.Join(dir, trashUploadFile), filepath.Join("./documents", docName))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to restore file: %w", err)
+		}
+		restored = restoreDocument(entry.Document)
+		documentStore.Set(docName, restored)
+		invalidateGlossary(docName, restored.Collection)
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Warning: failed to remove trash entry %s: %v", docName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	log.Printf("Restored %s from trash", docName)
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"message":    "Document restored",
+		"name":       restored.Name,
+		"chunkCount": restored.ChunkCount,
+		"collection": restored.Collection,
+	})
+}
+
+// trashHandler lists the documents the request's tenant trashed (GET /api/trash)
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "GET") {
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	entries, err := listTrash()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to read trash: %v", err))
+		return
+	}
+	own := make([]TrashedDocument, 0, len(entries))
+	for _, entry := range entries {
+		if entry.tenant == tenant {
+			own = append(own, entry)
+		}
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"documents": own,
+		"retention": getConfig().TrashRetention,
+	})
+}
+
+// handleTrashByName removes a trashed document for good before its retention
+// window ends (DELETE /api/trash/{name}); it needs admin rights
+func handleTrashByName(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "DELETE") || !requireAdmin(w, r) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/trash/")
+	if !validTrashName(name) {
+		sendError(w, http.StatusBadRequest, "Invalid document name")
+		return
+	}
+	if _, err := os.Stat(filepath.Join(trashEntryDir(name), trashEntryFile)); err != nil {
+		sendError(w, http.StatusNotFound, "Document not found in trash")
+		return
+	}
+	if err := os.RemoveAll(trashEntryDir(name)); err != nil {
+		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to purge document: %v", err))
+		return
+	}
+	log.Printf("Purged %s from trash", name)
+	sendJSON(w, http.StatusOK, map[string]string{"message": "Document purged"})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useTestTrash keeps the trash in a temporary directory and the document store
+// empty until the test ends
+func useTestTrash(t *testing.T) {
+	t.Helper()
+	savedDir, savedStore := trashDir, documentStore
+	t.Cleanup(func() { trashDir, documentStore = savedDir, savedStore })
+	trashDir = t.TempDir()
+	documentStore = NewDocumentStore()
+}
+
+func TestTrashScopedToTenant(t *testing.T) {
+	useTestTrash(t)
+	if err := trashDocument(persistTestDocument("acme.txt", "Deleted by acme."), "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := trashDocument(persistTestDocument("globex.txt", "Deleted by globex."), "globex"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/trash", nil)
+	r.Header.Set(tenantHeader, "acme")
+	w := httptest.NewRecorder()
+	trashHandler(w, r)
+	var listing struct {
+		Documents []TrashedDocument `json:"documents"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Documents) != 1 || listing.Documents[0].Name != "acme.txt" {
+		t.Fatalf("acme sees %+v, want only acme.txt", listing.Documents)
+	}
+
+	// Another tenant cannot restore the document, its own tenant can
+	for _, tt := range []struct {
+		tenant string
+		status int
+	}{{"globex", http.StatusNotFound}, {"acme", http.StatusOK}} {
+		r := httptest.NewRequest("POST", "/api/document/acme.txt/restore", nil)
+		r.Header.Set(tenantHeader, tt.tenant)
+		w := httptest.NewRecorder()
+		handleRestoreDocument(w, r, "acme.txt")
+		if w.Code != tt.status {
+			t.Errorf("restore as %s: got %d %s, want %d", tt.tenant, w.Code, w.Body.String(), tt.status)
+		}
+	}
+	if _, exists := documentStore.Get("acme.txt"); !exists {
+		t.Error("acme.txt was not restored")
+	}
+}
+
+func TestTrashPurgeBehindAPIKeys(t *testing.T) {
+	useTestTrash(t)
+	t.Setenv("API_KEYS", "key-1")
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	useAuthMode(t, AuthAPIKey)
+	if err := trashDocument(persistTestDocument("old.txt", "Purged early."), defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/trash/", corsHandler(writerOnly(handleTrashByName)))
+	r := httptest.NewRequest("DELETE", "/api/trash/old.txt", nil)
+	r.Header.Set("Authorization", "Bearer key-1")
+	r.Header.Set(adminTokenHeader, "admin-secret")
+	w := httptest.NewRecorder()
+	authenticated(mux).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("purge: got %d %s, want 200", w.Code, w.Body.String())
+	}
+	if entries, _ := listTrash(); len(entries) != 0 {
+		t.Errorf("trash still holds %+v", entries)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Verification methods
+const (
+	VerifyLexical = "lexical" // Word overlap between each sentence and the sources
+	VerifyLLM     = "llm"     // The model judges which sources entail each sentence
+)
+
+// Share of a sentence's content words a source must contain to support it lexically
+const lexicalSupportThreshold = 0.6
+
+// Marker appended to unsupported sentences in the annotated answer
+const unsupportedMarker = " [unsupported]"
+
+// SentenceSupport tells which source chunks back one sentence of an answer
+type SentenceSupport struct {
+	Text      string  `json:"text"`
+	Supported bool    `json:"supported"`
+	Sources   []int   `json:"sources"`           // Indices into sourceChunks
+	Score     float64 `json:"score"`             // Best word overlap (lexical) or 1/0 (llm)
+	Skipped   bool    `json:"skipped,omitempty"` // Too little content to check; counted as supported
+}
+
+// AnswerVerification is the per-sentence support map of an answer
+type AnswerVerification struct {
+	Method      string            `json:"method"` // Method used; llm falls back to lexical when the model's reply cannot be read
+	Supported   int               `json:"supported"`
+	Unsupported int               `json:"unsupported"`
+	Sentences   []SentenceSupport `json:"sentences"`
+	Annotated   string            `json:"annotated"` // The answer with unsupported sentences marked
+}
+
+func validVerifyMethod(method string) bool {
+	return method == "" || method == VerifyLexical || method == VerifyLLM
+}
+
+var (
+	listMarker   = regexp.MustCompile(`^\s*(?:[-*•]|\d+[.)])\s+`)
+	citationRefs = regexp.MustCompile(`\[\d+(?:\s*[,-]\s*\d+)*\]`)
+)
+
+// sentenceSpans splits text into sentences at line breaks and after ., ! or ?
+// followed by white space, returning byte offsets into text
+func sentenceSpans(text string) [][2]int {
+	var spans [][2]int
+	start := 0
+	flush := func(end int) {
+		if strings.TrimSpace(text[start:end]) != "" {
+			// Trim surrounding white space so markers land right after the sentence
+			s := start + len(text[start:end]) - len(strings.TrimLeftFunc(text[start:end], unicode.IsSpace))
+			e := start + len(strings.TrimRightFunc(text[start:end], unicode.IsSpace))
+			spans = append(spans, [2]int{s, e})
+		}
+		start = end
+	}
+	for i, r := range text {
+		if i < start {
+			continue
+		}
+		switch {
+		case r == '\n':
+			flush(i + 1)
+		case r == '.' || r == '!' || r == '?':
+			end := i + 1
+			for end < len(text) {
+				next, size := utf8.DecodeRuneInString(text[end:])
+				if !strings.ContainsRune(`"')]»”’`, next) {
+					break
+				}
+				end += size
+			}
+			if end == len(text) || text[end] == ' ' || text[end] == '\t' || text[end] == '\n' {
+				flush(end)
+			}
+		}
+	}
+	flush(len(text))
+	return spans
+}
+
+// contentWords returns a sentence's words minus stopwords, list markers and
+// citation references
+func contentWords(sentence string) []string {
+	sentence = citationRefs.ReplaceAllString(listMarker.ReplaceAllString(sentence, ""), "")
+	var words []string
+	for _, w := range tokenize(sentence) {
+		if !isStopword(w) && !questionWords[w] {
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+func isNumber(w string) bool {
+	_, err := strconv.ParseFloat(w, 64)
+	return err == nil
+}
+
+// lexicalSupport scores a sentence against each source by the share of its content
+// words the source contains. Numbers must all appear in a supporting source.
+func lexicalSupport(words []string, sources []map[string]bool) SentenceSupport {
+	support := SentenceSupport{Sources: []int{}}
+	for i, source := range sources {
+		found := 0
+		numbersFound := true
+		for _, w := range words {
+			if source[w] {
+				found++
+			} else if isNumber(w) {
+				numbersFound = false
+			}
+		}
+		score := float64(found) / float64(len(words))
+		support.Score = max(support.Score, score)
+		if score >= lexicalSupportThreshold && numbersFound {
+			support.Sources = append(support.Sources, i)
+		}
+	}
+	support.Supported = len(support.Sources) > 0
+	return support
+}
+
+// verifyAnswer checks each sentence of an answer against the source chunks it was
+// generated from
+func verifyAnswer(ctx context.Context, method, response string, sources []string, model string) *AnswerVerification {
+	sourceWords := make([]map[string]bool, len(sources))
+	for i, source := range sources {
+		sourceWords[i] = make(map[string]bool)
+		for _, w := range tokenize(source) {
+			sourceWords[i][w] = true
+		}
+	}
+
+	spans := sentenceSpans(response)
+	v := &AnswerVerification{Method: VerifyLexical, Sentences: make([]SentenceSupport, len(spans))}
+	var checked []int
+	for i, span := range spans {
+		text := response[span[0]:span[1]]
+		words := contentWords(text)
+		if len(words) < 2 {
+			v.Sentences[i] = SentenceSupport{Text: text, Supported: true, Sources: []int{}, Skipped: true}
+			continue
+		}
+		v.Sentences[i] = lexicalSupport(words, sourceWords)
+		v.Sentences[i].Text = text
+		checked = append(checked, i)
+	}
+
+	if method == VerifyLLM && len(checked) > 0 && len(sources) > 0 {
+		if judged, ok := llmSupport(ctx, v.Sentences, checked, sources, model); ok {
+			v.Method = VerifyLLM
+			for _, i := range checked {
+				v.Sentences[i].Sources = judged[i]
+				v.Sentences[i].Supported = len(judged[i]) > 0
+				v.Sentences[i].Score = 0
+				if v.Sentences[i].Supported {
+					v.Sentences[i].Score = 1
+				}
+			}
+		}
+	}
+
+	var annotated strings.Builder
+	last := 0
+	for i, s := range v.Sentences {
+		if s.Supported {
+			v.Supported++
+			continue
+		}
+		v.Unsupported++
+		annotated.WriteString(response[last:spans[i][1]])
+		annotated.WriteString(unsupportedMarker)
+		last = spans[i][1]
+	}
+	annotated.WriteString(response[last:])
+	v.Annotated = annotated.String()
+	return v
+}
+
+var judgmentLine = regexp.MustCompile(`(?m)^\s*S?(\d+)\s*[:.)-]\s*(.*)$`)
+
+// llmSupport asks the model which sources state each checked sentence, returning
+// 0-based source indices by sentence index. ok is false when the reply does not
+// cover every sentence.
+func llmSupport(ctx context.Context, sentences []SentenceSupport, checked []int, sources []string, model string) (map[int][]int, bool) {
+	var b strings.Builder
+	b.WriteString("Sources:\n")
+	for i, source := range sources {
+		fmt.Fprintf(&b, "[%d] %s\n\n", i+1, source)
+	}
+	b.WriteString("Sentences:\n")
+	for n, i := range checked {
+		fmt.Fprintf(&b, "S%d: %s\n", n+1, sentences[i].Text)
+	}
+	prompt := fmt.Sprintf(`For each sentence, list the sources that state or directly imply everything it claims. A sentence whose claims are not all backed by one source is unsupported. Reply with one line per sentence in the form "S1: 2, 3" or "S1: none", and nothing else.
+
+%s
+Answer:`, b.String())
+
+	reply, _, err := cachedAnswer(ctx, prompt, model)
+	if err != nil {
+		return nil, false
+	}
+	judged := make(map[int][]int)
+	for _, m := range judgmentLine.FindAllStringSubmatch(reply, -1) {
+		n, _ := strconv.Atoi(m[1])
+		if n < 1 || n > len(checked) {
+			continue
+		}
+		refs := []int{}
+		for _, field := range strings.FieldsFunc(m[2], func(r rune) bool { return !unicode.IsDigit(r) }) {
+			if ref, err := strconv.Atoi(field); err == nil && ref >= 1 && ref <= len(sources) {
+				refs = append(refs, ref-1)
+			}
+		}
+		judged[checked[n-1]] = refs
+	}
+	return judged, len(judged) == len(checked)
+}
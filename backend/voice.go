@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Whisper-compatible transcription backend (OpenAI /v1/audio/transcriptions API)
+var (
+	whisperAPI    = getEnv("WHISPER_API_URL", "")
+	whisperModel  = getEnv("WHISPER_MODEL", "whisper-1")
+	whisperAPIKey = getEnv("WHISPER_API_KEY", "")
+)
+
+// Text-to-speech backend (OpenAI /v1/audio/speech API)
+var (
+	ttsAPI    = getEnv("TTS_API_URL", "")
+	ttsModel  = getEnv("TTS_MODEL", "tts-1")
+	ttsVoice  = getEnv("TTS_VOICE", "alloy")
+	ttsFormat = getEnv("TTS_FORMAT", "mp3")
+	ttsAPIKey = getEnv("TTS_API_KEY", "")
+)
+
+// Content types for the audio formats TTS backends commonly return
+var audioContentTypes = map[string]string{
+	"mp3":  "audio/mpeg",
+	"opus": "audio/ogg",
+	"aac":  "audio/aac",
+	"flac": "audio/flac",
+	"wav":  "audio/wav",
+	"pcm":  "audio/pcm",
+}
+
+// VoiceQueryResponse is a normal query response plus the recognized question
+type VoiceQueryResponse struct {
+	Transcript string `json:"transcript"`
+	*QueryResponse
+}
+
+// transcribeAudio sends an audio clip to the configured Whisper endpoint
+func transcribeAudio(audio io.Reader, fileName, language string) (string, error) {
+	if whisperAPI == "" {
+		return "", newAPIError(http.StatusServiceUnavailable, "Voice queries are not configured (set WHISPER_API_URL)")
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", fileName)
+	if err != nil {
+		return "", fmt.Errorf("failed to build transcription request: %w", err)
+	}
+	if _, err := io.Copy(part, audio); err != nil {
+		return "", fmt.Errorf("failed to read audio: %w", err)
+	}
+	fields := map[string]string{"model": whisperModel, "response_format": "json"}
+	if language != "" {
+		fields["language"] = language
+	}
+	for key, value := range fields {
+		if err := writer.WriteField(key, value); err != nil {
+			return "", fmt.Errorf("failed to build transcription request: %w", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("failed to build transcription request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", whisperAPI, &body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if whisperAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+whisperAPIKey)
+	}
+
+	start := time.Now()
+	client := &http.Client{Timeout: requestTimeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("transcription request failed: %w", err)
+	}
+	defer closeFile(resp.Body, "transcription response body")
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("transcription error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode transcription: %w", err)
+	}
+
+	log.Printf("Transcription completed in %v", time.Since(start))
+	return strings.TrimSpace(result.Text), nil
+}
+
+// synthesizeSpeech requests audio for text; the caller must close the returned stream
+func synthesizeSpeech(ctx context.Context, text string) (io.ReadCloser, error) {
+	if ttsAPI == "" {
+		return nil, newAPIError(http.StatusServiceUnavailable, "Speech synthesis is not configured (set TTS_API_URL)")
+	}
+
+	jsonData, err := json.Marshal(map[string]string{
+		"model":           ttsModel,
+		"input":           text,
+		"voice":           ttsVoice,
+		"response_format": ttsFormat,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", ttsAPI, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ttsAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+ttsAPIKey)
+	}
+
+	// The timeout also bounds reading the audio, which callers may stream on
+	client := &http.Client{Timeout: requestTimeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("speech request failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		closeFile(resp.Body, "speech response body")
+		return nil, fmt.Errorf("speech error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return resp.Body, nil
+}
+
+// attachSpeech embeds the synthesized answer in the response as base64 audio
+func attachSpeech(resp *QueryResponse) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout())
+	defer cancel()
+
+	audio, err := synthesizeSpeech(ctx, resp.Response)
+	if err != nil {
+		return err
+	}
+	defer closeFile(audio, "speech response body")
+
+	data, err := io.ReadAll(audio)
+	if err != nil {
+		return fmt.Errorf("failed to read speech audio: %w", err)
+	}
+	resp.Audio = base64.StdEncoding.EncodeToString(data)
+	resp.AudioFormat = ttsFormat
+	return nil
+}
+
+// queryDocumentSpeech answers a query and streams the spoken answer as audio
+func queryDocumentSpeech(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+
+	var req QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	req.Speech = false
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	req.Tenant = tenant
+
+	resp, err := runQuery(req)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	audio, err := synthesizeSpeech(r.Context(), resp.Response)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	defer closeFile(audio, "speech response body")
+
+	contentType, ok := audioContentTypes[ttsFormat]
+	if !ok {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, audio); err != nil {
+		log.Printf("Error streaming speech audio: %v", err)
+	}
+}
+
+// queryDocumentByVoice transcribes an uploaded audio question and answers it
+func queryDocumentByVoice(w http.ResponseWriter, r *http.Request) {
+	if !validateMethod(w, r, "POST") {
+		return
+	}
+
+	if err := r.ParseMultipartForm(MaxRequestSize); err != nil {
+		sendError(w, http.StatusBadRequest, "Failed to parse form or file too large")
+		return
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	audio, header, err := r.FormFile("audio")
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "No audio uploaded")
+		return
+	}
+	defer closeFile(audio, "uploaded audio")
+
+	transcript, err := transcribeAudio(audio, header.Filename, r.FormValue("language"))
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	if transcript == "" {
+		sendError(w, http.StatusUnprocessableEntity, "No speech recognized in audio")
+		return
+	}
+
+	resp, err := runQuery(QueryRequest{
+		DocumentName:  r.FormValue("documentName"),
+		Query:         transcript,
+		ModelName:     r.FormValue("modelName"),
+		Section:       r.FormValue("section"),
+		CitationStyle: r.FormValue("citationStyle"),
+		Speech:        r.FormValue("speech") == "true",
+		SessionID:     r.FormValue("sessionId"),
+		Tenant:        tenant,
+	})
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, VoiceQueryResponse{Transcript: transcript, QueryResponse: resp})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// loadedModel is a model an Ollama endpoint holds in memory (/api/ps)
+type loadedModel struct {
+	Name      string    `json:"name"`
+	SizeVRAM  int64     `json:"sizeVram"` // Bytes of GPU memory it takes
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// sameModel tells whether two model names refer to the same model, "llama3"
+// being short for "llama3:latest"
+func sameModel(a, b string) bool {
+	return a == b || a+":latest" == b || a == b+":latest"
+}
+
+// fetchOllamaLoaded lists the models an endpoint has loaded. Endpoints without
+// /api/ps report nil, which disables scheduling hints for them.
+func fetchOllamaLoaded(ctx context.Context, e *ollamaEndpoint) ([]loadedModel, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", e.api("/ps"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile(resp.Body, "ps response body")
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Models []struct {
+			Name      string    `json:"name"`
+			SizeVRAM  int64     `json:"size_vram"`
+			ExpiresAt time.Time `json:"expires_at"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	loaded := make([]loadedModel, 0, len(result.Models))
+	for _, m := range result.Models {
+		loaded = append(loaded, loadedModel{Name: m.Name, SizeVRAM: m.SizeVRAM, ExpiresAt: m.ExpiresAt})
+	}
+	return loaded, nil
+}
+
+// setLoaded records the models an endpoint has in memory and the most VRAM seen
+// in use, the best estimate of what it has
+func (e *ollamaEndpoint) setLoaded(loaded []loadedModel) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.loaded = loaded
+	var inUse int64
+	for _, m := range loaded {
+		inUse += m.SizeVRAM
+	}
+	e.vramPeak = max(e.vramPeak, inUse)
+}
+
+// isLoaded tells whether an endpoint has a model in memory; callers hold e.mu
+func (e *ollamaEndpoint) isLoaded(model string) bool {
+	return slices.ContainsFunc(e.loaded, func(m loadedModel) bool { return sameModel(m.Name, model) })
+}
+
+// swapLikely tells whether running a model would make the endpoint unload
+// others: it is not loaded and, as far as is known, does not fit beside the
+// loaded ones. Callers hold e.mu.
+func (e *ollamaEndpoint) swapLikely(model string) bool {
+	if model == "" || len(e.loaded) == 0 || e.isLoaded(model) {
+		return false
+	}
+	size, known := e.sizes[model]
+	if !known {
+		size, known = e.sizes[model+":latest"]
+	}
+	if !known {
+		return true
+	}
+	var inUse int64
+	for _, m := range e.loaded {
+		inUse += m.SizeVRAM
+	}
+	return inUse+size > e.vramPeak
+}
+
+// othersActive tells whether requests for other models are running on the
+// endpoint; callers hold e.mu
+func (e *ollamaEndpoint) othersActive(model string) bool {
+	for name, n := range e.active {
+		if n > 0 && !sameModel(name, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// begin and end track the requests in flight on an endpoint per model. A
+// successful request leaves its model loaded until the next health check says
+// otherwise.
+func (e *ollamaEndpoint) begin(model string) {
+	e.inFlight.Add(1)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.active == nil {
+		e.active = map[string]int{}
+	}
+	e.active[model]++
+	e.notify()
+}
+
+func (e *ollamaEndpoint) end(model string, ok bool) {
+	e.inFlight.Add(-1)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.active[model]--; e.active[model] <= 0 {
+		delete(e.active, model)
+	}
+	if ok && model != "" && e.loaded != nil && !e.isLoaded(model) {
+		e.loaded = append(e.loaded, loadedModel{Name: model})
+	}
+	e.notify()
+}
+
+// notify wakes requests waiting for the endpoint's requests to change; callers
+// hold e.mu
+func (e *ollamaEndpoint) notify() {
+	if e.changed != nil {
+		close(e.changed)
+		e.changed = nil
+	}
+}
+
+// waitForSwap holds back a request whose model would evict models that requests
+// are still using, until those finish or the configured swap delay passes, so
+// alternating models do not reload on every call
+func waitForSwap(ctx context.Context, e *ollamaEndpoint, model string) {
+	delay := time.Duration(getConfig().Ollama.SwapDelay)
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	start := time.Now()
+	for {
+		e.mu.Lock()
+		if !e.swapLikely(model) || !e.othersActive(model) {
+			e.mu.Unlock()
+			if waited := time.Since(start); waited > 100*time.Millisecond {
+				log.Printf("Delayed %s on %s by %v to avoid a model swap", model, e.URL, waited.Round(time.Millisecond))
+			}
+			return
+		}
+		if e.changed == nil {
+			e.changed = make(chan struct{})
+		}
+		changed := e.changed
+		e.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// errWebhookRedirect is returned for webhooks answering with a redirect, which
+// is not followed
+var errWebhookRedirect = errors.New("webhook redirects are not followed")
+
+// sharedAddressSpace is carrier-grade NAT space (RFC 6598), as internal as the
+// private ranges
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// webhookAllowedNets are internal networks webhooks may reach anyway, from
+// WEBHOOK_ALLOWED_NETWORKS
+var webhookAllowedNets []*net.IPNet
+
+// webhookClient posts to webhooks: those of jobs, digests and ingestion hooks.
+// It speaks http(s) only, dials public addresses only, unless
+// WEBHOOK_ALLOWED_NETWORKS admits them, and does not follow redirects, so a
+// webhook URL cannot reach the server's own network or a cloud metadata service.
+var webhookClient = &http.Client{
+	Transport: webhookTransport{&http.Transport{
+		DialContext:           dialPublic,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}},
+	CheckRedirect: func(*http.Request, []*http.Request) error { return errWebhookRedirect },
+}
+
+// webhookTransport refuses schemes other than http and https
+type webhookTransport struct {
+	next http.RoundTripper
+}
+
+func (t webhookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("webhook URL scheme %q is not http or https", req.URL.Scheme)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// loadWebhookNetworks reads WEBHOOK_ALLOWED_NETWORKS: comma-separated CIDRs or
+// addresses webhooks may reach although they are internal
+func loadWebhookNetworks() error {
+	webhookAllowedNets = nil
+	for _, entry := range strings.Split(getEnv("WEBHOOK_ALLOWED_NETWORKS", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			webhookAllowedNets = append(webhookAllowedNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid network %q", entry)
+		}
+		webhookAllowedNets = append(webhookAllowedNets, network)
+	}
+	return nil
+}
+
+// internalAddress reports whether ip is loopback, private, link-local,
+// unspecified or otherwise not on the public internet
+func internalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// webhookAddressAllowed reports whether webhooks may connect to ip
+func webhookAddressAllowed(ip net.IP) bool {
+	for _, network := range webhookAllowedNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return !internalAddress(ip)
+}
+
+// dialPublic resolves the host itself and connects only when every address it
+// resolves to is allowed, dialing the checked address so a second lookup cannot
+// swap in another
+func dialPublic(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if !webhookAddressAllowed(a.IP) {
+			return nil, fmt.Errorf("webhook host %s resolves to internal address %s", host, a.IP)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	for _, a := range addrs {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no addresses for webhook host %s", host)
+	}
+	return nil, err
+}
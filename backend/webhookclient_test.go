@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// useWebhookNetworks admits internal networks to webhooks until the test ends,
+// as WEBHOOK_ALLOWED_NETWORKS does
+func useWebhookNetworks(t *testing.T, networks string) {
+	t.Helper()
+	saved := webhookAllowedNets
+	t.Cleanup(func() { webhookAllowedNets = saved })
+	t.Setenv("WEBHOOK_ALLOWED_NETWORKS", networks)
+	if err := loadWebhookNetworks(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookAddressAllowed(t *testing.T) {
+	useWebhookNetworks(t, "")
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+	}
+	for _, tt := range tests {
+		if got := webhookAddressAllowed(net.ParseIP(tt.ip)); got != tt.allowed {
+			t.Errorf("webhookAddressAllowed(%s) = %v, want %v", tt.ip, got, tt.allowed)
+		}
+	}
+
+	useWebhookNetworks(t, "10.0.0.0/8, 127.0.0.1")
+	if !webhookAddressAllowed(net.ParseIP("10.1.2.3")) || !webhookAddressAllowed(net.ParseIP("127.0.0.1")) {
+		t.Error("allowed networks refused")
+	}
+	if webhookAddressAllowed(net.ParseIP("169.254.169.254")) || webhookAddressAllowed(net.ParseIP("127.0.0.2")) {
+		t.Error("networks outside WEBHOOK_ALLOWED_NETWORKS allowed")
+	}
+
+	t.Setenv("WEBHOOK_ALLOWED_NETWORKS", "10.0.0.0/33")
+	if err := loadWebhookNetworks(); err == nil {
+		t.Error("invalid network accepted")
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	post := func(target string) error {
+		req, err := http.NewRequest("POST", target, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := webhookClient.Do(req)
+		if err == nil {
+			closeFile(resp.Body, "test response body")
+		}
+		return err
+	}
+
+	useWebhookNetworks(t, "")
+	for _, target := range []string{server.URL, "http://localhost:1/", "http://169.254.169.254/latest/meta-data/", "http://[::1]:1/"} {
+		if err := post(target); err == nil || !strings.Contains(err.Error(), "internal address") {
+			t.Errorf("posting to %s: %v, want an internal address error", target, err)
+		}
+	}
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("the loopback server got %d requests", n)
+	}
+	if err := post("ftp://example.com/hook"); err == nil || !strings.Contains(err.Error(), "scheme") {
+		t.Errorf("ftp URL: %v, want a scheme error", err)
+	}
+
+	useWebhookNetworks(t, "127.0.0.1/32,::1/128")
+	if err := post(server.URL); err != nil {
+		t.Fatalf("posting to an allowed network: %v", err)
+	}
+	if err := post(server.URL + "/redirect"); !errors.Is(err, errWebhookRedirect) {
+		t.Errorf("redirect: %v, want errWebhookRedirect", err)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("the server got %d requests, want 2", n)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Legacy binary Word documents are converted to text by an external command such
+// as antiword, catdoc or "soffice --headless --cat", run with the file path as its
+// last argument and printing the text to stdout
+var docConvertCommand = getEnv("DOC_CONVERT_COMMAND", "antiword")
+
+// Signature of OLE compound files, the container of binary .doc files
+var oleSignature = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+
+func extractDocText(filePath string) (*ExtractedText, error) {
+	header := make([]byte, 8)
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	n, _ := file.Read(header)
+	closeFile(file, filePath)
+	header = header[:n]
+
+	// Word could save RTF under a .doc name, and many archives hold such files
+	if isRTF(header) {
+		return extractRTFText(filePath)
+	}
+	if !bytes.Equal(header, oleSignature) {
+		return nil, fmt.Errorf("not a Word 97-2003 document")
+	}
+
+	args := strings.Fields(docConvertCommand)
+	if len(args) == 0 {
+		return nil, fmt.Errorf(".doc conversion is disabled (DOC_CONVERT_COMMAND is empty)")
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil, fmt.Errorf(".doc converter %q not found; install it or set DOC_CONVERT_COMMAND", args[0])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout())
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], filePath)...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf(".doc conversion timed out")
+		}
+		return nil, fmt.Errorf(".doc conversion failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	text := strings.ReplaceAll(stdout.String(), "\r\n", "\n")
+	return &ExtractedText{Text: strings.TrimSpace(text)}, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// extractXMLDocument reads an XML file as one document. Elements holding text form
+// paragraphs, and the titles of nested titled elements (DocBook sections and
+// chapters, DITA topics) form the table of contents; the root's title and the first
+// author become metadata.
+func extractXMLDocument(filePath string) (*ExtractedText, error) {
+	root, err := readXML(filePath)
+	if err != nil {
+		return nil, err
+	}
+	extracted := &ExtractedText{}
+	var paragraphs []string
+
+	// depth counts the titled elements enclosing a node, with the root as the first
+	var walk func(n *xmlNode, depth int)
+	walk = func(n *xmlNode, depth int) {
+		if n.hasOwnText() {
+			text := n.stringValue()
+			paragraphs = append(paragraphs, text)
+			switch {
+			case n.Name == "title" && depth <= 1:
+				if extracted.Metadata.Title == "" {
+					extracted.Metadata.Title = text
+				}
+			case n.Name == "title":
+				extracted.TOC = append(extracted.TOC, TOCEntry{Title: text, Level: depth - 1})
+			case n.Name == "author" && extracted.Metadata.Author == "":
+				extracted.Metadata.Author = text
+			}
+			return
+		}
+		if n.Name == "author" && extracted.Metadata.Author == "" {
+			// DocBook nests names: <author><personname><firstname>
+			extracted.Metadata.Author = n.stringValue()
+		}
+		for _, child := range n.Children {
+			if !child.isElement() {
+				continue
+			}
+			d := depth
+			if hasTitle(child) {
+				d++
+			}
+			walk(child, d)
+		}
+	}
+	walk(root, 1)
+
+	extracted.Text = strings.Join(paragraphs, "\n\n")
+	return extracted, nil
+}
+
+// Elements holding a document's front matter rather than a section
+var xmlFrontMatter = map[string]bool{"info": true, "bookinfo": true, "articleinfo": true, "prolog": true, "front": true}
+
+func hasTitle(n *xmlNode) bool {
+	if xmlFrontMatter[n.Name] {
+		return false
+	}
+	for _, child := range n.Children {
+		if child.Name == "title" {
+			return true
+		}
+	}
+	return false
+}
+
+func readXML(filePath string) (*xmlNode, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	defer closeFile(file, filePath)
+
+	root, err := parseXML(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid XML: %v", err)
+	}
+	return root, nil
+}
+
+// readXMLRecords returns the elements the mapping's records XPath selects, or the
+// root element when it has none
+func readXMLRecords(filePath string, mapping *RecordMapping) ([]recordSource, error) {
+	paths := append([]string{mapping.Records, mapping.Title, mapping.ID}, mapping.Text...)
+	for _, path := range mapping.Metadata {
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if _, _, err := compileXPath(path); err != nil {
+			return nil, fmt.Errorf("invalid mapping: %v", err)
+		}
+	}
+
+	root, err := readXML(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if mapping.Records == "" {
+		return []recordSource{xmlRecord{root}}, nil
+	}
+	nodes, err := xpathSelect(root, mapping.Records)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mapping: %v", err)
+	}
+	var records []recordSource
+	for _, n := range nodes {
+		if n.isElement() {
+			records = append(records, xmlRecord{n})
+		}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no records at %q", mapping.Records)
+	}
+	return records, nil
+}
+
+// xmlRecord is an element selected as a record
+type xmlRecord struct {
+	node *xmlNode
+}
+
+func (r xmlRecord) values(path string) []string {
+	values, _ := xpathValues(r.node, path) // Paths were checked when the file was read; one over maxXPathVisits gives none
+	return values
+}
+
+// defaultText is the record's text with a paragraph per element holding text,
+// leaving out elements the mapping uses elsewhere
+func (r xmlRecord) defaultText(used map[string]bool) string {
+	skip := make(map[*xmlNode]bool)
+	for path := range used {
+		if path != "" {
+			nodes, _ := xpathSelect(r.node, path)
+			for _, n := range nodes {
+				skip[n] = true
+			}
+		}
+	}
+
+	var paragraphs []string
+	var walk func(n *xmlNode)
+	walk = func(n *xmlNode) {
+		if skip[n] {
+			return
+		}
+		if n.hasOwnText() {
+			paragraphs = append(paragraphs, n.stringValue())
+			return
+		}
+		for _, child := range n.Children {
+			if child.isElement() {
+				walk(child)
+			}
+		}
+	}
+	walk(r.node)
+	return strings.Join(paragraphs, "\n\n")
+}
+
+func (r xmlRecord) encode() []byte {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	r.node.encode(&b)
+	return []byte(b.String())
+}
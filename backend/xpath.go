@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits on XML documents and the XPaths evaluated on them, which both come
+// from uploads
+const (
+	maxXMLDepth     = 256       // Nesting of elements
+	maxXMLNodes     = 1_000_000 // Element, text and attribute nodes of a document
+	maxXPathLength  = 1024      // Characters of an XPath
+	maxXPathNesting = 8         // Predicates within predicates
+	maxXPathVisits  = 1_000_000 // Nodes one evaluation may examine, predicates included
+)
+
+// xmlNode is an element, text or attribute node of a parsed XML document. Names
+// are local names; namespace prefixes are ignored when matching.
+type xmlNode struct {
+	Name     string // Element name, "@name" for attributes, empty for text
+	Attr     []xml.Attr
+	Text     string // Content of text and attribute nodes
+	Children []*xmlNode
+	Parent   *xmlNode
+}
+
+func (n *xmlNode) isElement() bool {
+	return n.Name != "" && n.Name[0] != '@'
+}
+
+// parseXML reads a document into a tree and returns its root element. Entities
+// defined in a DTD are left as written. Documents nested deeper than maxXMLDepth
+// or with more than maxXMLNodes nodes are refused.
+func parseXML(r io.Reader) (*xmlNode, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+
+	document := &xmlNode{Name: "/"}
+	current := document
+	depth, nodes := 0, 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if depth++; depth > maxXMLDepth {
+				return nil, fmt.Errorf("elements nested deeper than %d levels", maxXMLDepth)
+			}
+			nodes += 1 + len(t.Attr)
+			node := &xmlNode{Name: t.Name.Local, Attr: t.Copy().Attr, Parent: current}
+			current.Children = append(current.Children, node)
+			current = node
+		case xml.EndElement:
+			if current.Parent != nil {
+				current = current.Parent
+				depth--
+			}
+		case xml.CharData:
+			if current != document {
+				nodes++
+				current.Children = append(current.Children, &xmlNode{Text: string(t), Parent: current})
+			}
+		}
+		if nodes > maxXMLNodes {
+			return nil, fmt.Errorf("more than %d nodes", maxXMLNodes)
+		}
+	}
+	for _, child := range document.Children {
+		if child.isElement() {
+			return child, nil
+		}
+	}
+	return nil, fmt.Errorf("no root element")
+}
+
+// stringValue is the whitespace-collapsed text of a node and its descendants
+func (n *xmlNode) stringValue() string {
+	if !n.isElement() {
+		return strings.Join(strings.Fields(n.Text), " ")
+	}
+	var b strings.Builder
+	var walk func(*xmlNode)
+	walk = func(node *xmlNode) {
+		for _, child := range node.Children {
+			if child.isElement() {
+				walk(child)
+			} else {
+				b.WriteString(child.Text)
+			}
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// hasOwnText reports whether an element directly holds non-blank text
+func (n *xmlNode) hasOwnText() bool {
+	for _, child := range n.Children {
+		if !child.isElement() && strings.TrimSpace(child.Text) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// encode writes the node and its descendants back as XML
+func (n *xmlNode) encode(b *strings.Builder) {
+	if !n.isElement() {
+		_ = xml.EscapeText(b, []byte(n.Text))
+		return
+	}
+	b.WriteString("<" + n.Name)
+	for _, a := range n.Attr {
+		b.WriteString(" " + a.Name.Local + `="`)
+		_ = xml.EscapeText(b, []byte(a.Value))
+		b.WriteString(`"`)
+	}
+	b.WriteString(">")
+	for _, child := range n.Children {
+		child.encode(b)
+	}
+	b.WriteString("</" + n.Name + ">")
+}
+
+// xpathStep is one location step such as //section[@id='a'][2]
+type xpathStep struct {
+	descendant bool   // Reached with //
+	test       string // Name, *, @name, @*, text(), node(), . or ..
+	predicates []string
+}
+
+// compileXPath parses the supported XPath subset: absolute and relative location
+// paths with / and //, name tests, *, @attr, text(), . and .., and predicates that
+// are positions, last(), paths, comparisons of a path with a string (= or !=) and
+// contains(path, 'string')
+func compileXPath(expr string) ([]xpathStep, bool, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, false, fmt.Errorf("empty XPath")
+	}
+	if len(expr) > maxXPathLength {
+		return nil, false, fmt.Errorf("XPath longer than %d characters", maxXPathLength)
+	}
+	absolute := strings.HasPrefix(expr, "/")
+	var steps []xpathStep
+	descendant := false
+	for i := 0; i < len(expr); {
+		if expr[i] == '/' {
+			if strings.HasPrefix(expr[i:], "//") {
+				descendant = true
+				i += 2
+			} else {
+				i++
+			}
+			continue
+		}
+		step := xpathStep{descendant: descendant}
+		descendant = false
+		start := i
+		for i < len(expr) && expr[i] != '/' && expr[i] != '[' {
+			i++
+		}
+		step.test = strings.TrimSpace(expr[start:i])
+		for i < len(expr) && expr[i] == '[' {
+			end, err := predicateEnd(expr, i)
+			if err != nil {
+				return nil, false, err
+			}
+			step.predicates = append(step.predicates, strings.TrimSpace(expr[i+1:end]))
+			i = end + 1
+		}
+		if step.test == "" || (step.test != "text()" && step.test != "node()" && strings.ContainsAny(step.test, "[]()'\"=! ")) {
+			return nil, false, fmt.Errorf("invalid XPath %q", expr)
+		}
+		steps = append(steps, step)
+	}
+	if descendant {
+		return nil, false, fmt.Errorf("invalid XPath %q: trailing //", expr)
+	}
+	return steps, absolute, nil
+}
+
+// predicateEnd returns the index of the bracket closing the predicate opened at i
+func predicateEnd(expr string, i int) (int, error) {
+	depth := 0
+	var quote byte
+	for j := i; j < len(expr); j++ {
+		c := expr[j]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			if depth++; depth > maxXPathNesting {
+				return 0, fmt.Errorf("invalid XPath %q: predicates nested deeper than %d levels", expr, maxXPathNesting)
+			}
+		case c == ']':
+			depth--
+			if depth == 0 {
+				return j, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("invalid XPath %q: unclosed predicate", expr)
+}
+
+// xpathEval counts the nodes an evaluation examines, so that paths such as
+// //*//*//* over a large document give up instead of running for minutes
+type xpathEval struct {
+	visits int
+}
+
+// visit counts n more examined nodes
+func (ev *xpathEval) visit(n int) error {
+	if ev.visits += n; ev.visits > maxXPathVisits {
+		return fmt.Errorf("XPath examines more than %d nodes", maxXPathVisits)
+	}
+	return nil
+}
+
+// xpathSelect evaluates an XPath against a context node
+func xpathSelect(context *xmlNode, expr string) ([]*xmlNode, error) {
+	return (&xpathEval{}).selectNodes(context, expr)
+}
+
+func (ev *xpathEval) selectNodes(context *xmlNode, expr string) ([]*xmlNode, error) {
+	steps, absolute, err := compileXPath(expr)
+	if err != nil {
+		return nil, err
+	}
+	current := []*xmlNode{context}
+	if absolute {
+		// Absolute paths start at the document node above the root element
+		document := context
+		for document.Parent != nil {
+			document = document.Parent
+		}
+		current = []*xmlNode{document}
+	}
+	for _, step := range steps {
+		var next []*xmlNode
+		seen := make(map[*xmlNode]bool)
+		for _, node := range current {
+			matched, err := step.apply(ev, node)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range matched {
+				if !seen[m] {
+					seen[m] = true
+					next = append(next, m)
+				}
+			}
+		}
+		current = next
+	}
+	return current, nil
+}
+
+// xpathValues returns the non-empty string values of the nodes an XPath selects
+func xpathValues(context *xmlNode, expr string) ([]string, error) {
+	return (&xpathEval{}).values(context, expr)
+}
+
+func (ev *xpathEval) values(context *xmlNode, expr string) ([]string, error) {
+	nodes, err := ev.selectNodes(context, expr)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, n := range nodes {
+		if s := n.stringValue(); s != "" {
+			values = append(values, s)
+		}
+	}
+	return values, nil
+}
+
+// apply returns the nodes a step selects from one context node, in document order
+func (s xpathStep) apply(ev *xpathEval, node *xmlNode) ([]*xmlNode, error) {
+	contexts := []*xmlNode{node}
+	if s.descendant {
+		contexts = append(contexts, descendants(node)...)
+	}
+	if err := ev.visit(len(contexts)); err != nil {
+		return nil, err
+	}
+
+	var selected []*xmlNode
+	for _, ctx := range contexts {
+		var candidates []*xmlNode
+		switch {
+		case s.test == ".":
+			candidates = []*xmlNode{ctx}
+		case s.test == "..":
+			if ctx.Parent != nil {
+				candidates = []*xmlNode{ctx.Parent}
+			}
+		case strings.HasPrefix(s.test, "@"):
+			name := s.test[1:]
+			for _, a := range ctx.Attr {
+				if name == "*" || localName(name) == a.Name.Local {
+					candidates = append(candidates, &xmlNode{Name: "@" + a.Name.Local, Text: a.Value, Parent: ctx})
+				}
+			}
+		default:
+			if err := ev.visit(len(ctx.Children)); err != nil {
+				return nil, err
+			}
+			for _, child := range ctx.Children {
+				if s.matches(child) {
+					candidates = append(candidates, child)
+				}
+			}
+		}
+
+		for _, predicate := range s.predicates {
+			var kept []*xmlNode
+			for i, c := range candidates {
+				ok, err := ev.predicate(predicate, c, i+1, len(candidates))
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					kept = append(kept, c)
+				}
+			}
+			candidates = kept
+		}
+		selected = append(selected, candidates...)
+	}
+	return selected, nil
+}
+
+func (s xpathStep) matches(n *xmlNode) bool {
+	switch s.test {
+	case "node()":
+		return true
+	case "text()":
+		return !n.isElement()
+	case "*":
+		return n.isElement()
+	}
+	return n.isElement() && n.Name == localName(s.test)
+}
+
+func descendants(n *xmlNode) []*xmlNode {
+	var nodes []*xmlNode
+	for _, child := range n.Children {
+		if child.isElement() {
+			nodes = append(nodes, child)
+			nodes = append(nodes, descendants(child)...)
+		}
+	}
+	return nodes
+}
+
+// localName drops a namespace prefix
+func localName(name string) string {
+	if i := strings.LastIndexByte(name, ':'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// predicate evaluates a predicate for a node at position of size candidates
+func (ev *xpathEval) predicate(predicate string, node *xmlNode, position, size int) (bool, error) {
+	if n, err := strconv.Atoi(predicate); err == nil {
+		return position == n, nil
+	}
+	if predicate == "last()" {
+		return position == size, nil
+	}
+	if strings.HasPrefix(predicate, "contains(") && strings.HasSuffix(predicate, ")") {
+		args := strings.SplitN(predicate[len("contains("):len(predicate)-1], ",", 2)
+		if len(args) != 2 {
+			return false, fmt.Errorf("invalid XPath predicate %q", predicate)
+		}
+		want, ok := xpathLiteral(args[1])
+		if !ok {
+			return false, fmt.Errorf("invalid XPath predicate %q", predicate)
+		}
+		values, err := ev.values(node, strings.TrimSpace(args[0]))
+		if err != nil {
+			return false, err
+		}
+		for _, v := range values {
+			if strings.Contains(v, want) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	// path, path='value' or path!='value'
+	path, want, negate := predicate, "", false
+	compare := false
+	if i := comparisonIndex(predicate); i > 0 {
+		literal := predicate[i+1:]
+		if predicate[i] == '!' {
+			if !strings.HasPrefix(literal, "=") {
+				return false, fmt.Errorf("invalid XPath predicate %q", predicate)
+			}
+			literal, negate = literal[1:], true
+		}
+		var ok bool
+		if want, ok = xpathLiteral(literal); !ok {
+			return false, fmt.Errorf("invalid XPath predicate %q", predicate)
+		}
+		path, compare = strings.TrimSpace(predicate[:i]), true
+	}
+	nodes, err := ev.selectNodes(node, path)
+	if err != nil {
+		return false, err
+	}
+	if !compare {
+		return len(nodes) > 0, nil
+	}
+	for _, n := range nodes {
+		if (n.stringValue() == want) != negate {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// comparisonIndex returns the index of the = or != comparing a predicate's path
+// with a string, skipping those inside the path's own predicates, or -1
+func comparisonIndex(predicate string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(predicate); i++ {
+		c := predicate[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case depth == 0 && (c == '=' || c == '!'):
+			return i
+		}
+	}
+	return -1
+}
+
+// xpathLiteral reads a quoted string
+func xpathLiteral(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1], true
+	}
+	return "", false
+}
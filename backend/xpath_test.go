@@ -0,0 +1,122 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+const xpathTestCatalog = `<?xml version="1.0"?>
+<catalog xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <book id="b1" lang="en">
+    <dc:title>Go in Practice</dc:title>
+    <author>Ann</author>
+    <author>Bob</author>
+    <price currency="EUR">30</price>
+  </book>
+  <book id="b2" lang="de">
+    <dc:title>Verteilte Systeme</dc:title>
+    <author>Carl</author>
+    <price currency="USD">45</price>
+  </book>
+  <book id="b3">
+    <dc:title>Untitled Draft</dc:title>
+  </book>
+</catalog>`
+
+func parseTestXML(t *testing.T, doc string) *xmlNode {
+	t.Helper()
+	root, err := parseXML(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestXPathPredicatesAndAttributes(t *testing.T) {
+	root := parseTestXML(t, xpathTestCatalog)
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"/catalog/book/title", []string{"Go in Practice", "Verteilte Systeme", "Untitled Draft"}},
+		{"//dc:title", []string{"Go in Practice", "Verteilte Systeme", "Untitled Draft"}},
+		{"book[2]/title", []string{"Verteilte Systeme"}},
+		{"book[last()]/@id", []string{"b3"}},
+		{"book/author[1]", []string{"Ann", "Carl"}},
+		{"book[@lang='de']/title", []string{"Verteilte Systeme"}},
+		{`book[@lang!="de"]/title`, []string{"Go in Practice"}},
+		{"book[@lang]/@id", []string{"b1", "b2"}},
+		{"book[author]/@id", []string{"b1", "b2"}},
+		{"book[author='Bob']/@id", []string{"b1"}},
+		{"book[contains(title, 'Systeme')]/@id", []string{"b2"}},
+		{"book[price[@currency='USD']]/title", []string{"Verteilte Systeme"}},
+		{"book[@lang='en'][author='Carl']/title", nil},
+		{"//price/@currency", []string{"EUR", "USD"}},
+		{"book/@*", []string{"b1", "en", "b2", "de", "b3"}},
+		{"//author/..//price", []string{"30", "45"}},
+		{"book[1]/author/text()", []string{"Ann", "Bob"}},
+		{"book[9]", nil},
+	}
+	for _, tt := range tests {
+		got, err := xpathValues(root, tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestXPathMalformed(t *testing.T) {
+	root := parseTestXML(t, xpathTestCatalog)
+	for _, expr := range []string{
+		"",
+		"   ",
+		"book//",
+		"book[1",
+		"book[@id='b1']]",
+		"book[@id=b1]",
+		"book[@id!'b1']",
+		"book[contains(title)]",
+		"book[contains(title, Go)]",
+		"book[" + strings.Repeat("a[", maxXPathNesting) + "1" + strings.Repeat("]", maxXPathNesting+1),
+		strings.Repeat("book/", maxXPathLength/5+1) + "title",
+	} {
+		if nodes, err := xpathSelect(root, expr); err == nil {
+			t.Errorf("%q selected %d nodes, want an error", expr, len(nodes))
+		}
+	}
+}
+
+func TestXPathLimits(t *testing.T) {
+	deep := strings.Repeat("<a>", maxXMLDepth+1) + strings.Repeat("</a>", maxXMLDepth+1)
+	if _, err := parseXML(strings.NewReader(deep)); err == nil || !strings.Contains(err.Error(), "nested") {
+		t.Errorf("document nested %d deep: %v, want a nesting error", maxXMLDepth+1, err)
+	}
+	nested := strings.Repeat("<a>", maxXMLDepth) + strings.Repeat("</a>", maxXMLDepth)
+	if _, err := parseXML(strings.NewReader(nested)); err != nil {
+		t.Errorf("document nested %d deep: %v", maxXMLDepth, err)
+	}
+
+	var b strings.Builder
+	b.WriteString("<r>")
+	for i := 0; i < maxXMLNodes/2+1; i++ {
+		b.WriteString(`<i n="1"/>`)
+	}
+	b.WriteString("</r>")
+	if _, err := parseXML(strings.NewReader(b.String())); err == nil || !strings.Contains(err.Error(), "nodes") {
+		t.Errorf("document of %d nodes: %v, want a node count error", maxXMLNodes+2, err)
+	}
+
+	// Each nested predicate rescans the subtree of every node the outer one tests
+	root := parseTestXML(t, "<r>"+strings.Repeat("<a>", 200)+strings.Repeat("</a>", 200)+"</r>")
+	if _, err := xpathSelect(root, "//a//a"); err != nil {
+		t.Errorf("//a//a: %v", err)
+	}
+	if _, err := xpathSelect(root, "//a[.//a[.//a[.//a]]]"); err == nil || !strings.Contains(err.Error(), "examines more than") {
+		t.Errorf("//a[.//a[.//a[.//a]]]: %v, want the evaluation to give up", err)
+	}
+}